@@ -0,0 +1,281 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Storage buckets used by the account store.
+const (
+	accountsBucket     = "accounts"
+	fingerprintsBucket = "certfp"
+)
+
+// Account holds the persisted state of a registered user account.
+type Account struct {
+	Name         string    `json:"name"`
+	PasswordHash []byte    `json:"password_hash"`
+	Fingerprints []string  `json:"fingerprints"`
+	Created      time.Time `json:"created"`
+}
+
+// accountStore manages accounts persisted in the server storage, along with an
+// index of linked certificate fingerprints used for SASL EXTERNAL.
+type accountStore struct {
+	mu      sync.Mutex
+	storage Storage
+	tracer  trace.Tracer
+}
+
+func newAccountStore(storage Storage, tracer trace.Tracer) *accountStore {
+	return &accountStore{storage: storage, tracer: tracer}
+}
+
+// traced calls the storage operation on the bucket in a span continuing the trace of the
+// context, returning its error.
+func (as *accountStore) traced(ctx context.Context, name, bucket string, op func() error) error {
+	_, span := as.tracer.Start(ctx, name, trace.WithAttributes(attrBucket.String(bucket)))
+	err := op()
+	if errors.Is(err, ErrNotFound) {
+		// Missing keys are expected, and are not errors of the storage.
+		span.End()
+	} else {
+		endSpan(span, err)
+	}
+	return err
+}
+
+// accountKey returns the storage key of the named account.
+func accountKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// get returns the named account, or ErrNotFound.
+func (as *accountStore) get(ctx context.Context, name string) (*Account, error) {
+	account := &Account{}
+	if err := as.traced(ctx, "storage.get", accountsBucket, func() error {
+		return loadJSON(as.storage, accountsBucket, accountKey(name), account)
+	}); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// put stores the account under the name.
+func (as *accountStore) put(ctx context.Context, name string, account *Account) error {
+	return as.traced(ctx, "storage.put", accountsBucket, func() error {
+		return storeJSON(as.storage, accountsBucket, accountKey(name), account)
+	})
+}
+
+// create registers a new account with the given name and password.
+func (as *accountStore) create(ctx context.Context, name, password string) (*Account, error) {
+	if len(name) == 0 || len(name) > MaxAccountLength || strings.ContainsAny(name, " :#*!@,") {
+		return nil, ErrAccountInvalid
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing account password: %w", err)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if _, getErr := as.get(ctx, name); getErr == nil {
+		return nil, ErrAccountExists
+	} else if !errors.Is(getErr, ErrNotFound) {
+		return nil, getErr
+	}
+
+	account := &Account{
+		Name:         name,
+		PasswordHash: hash,
+		Created:      time.Now().UTC(),
+	}
+
+	if err = as.put(ctx, name, account); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// authenticate returns the named account if the password matches, or ErrBadCredentials.
+func (as *accountStore) authenticate(ctx context.Context, name, password string) (*Account, error) {
+	account, err := as.get(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrBadCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+
+	return account, nil
+}
+
+// byFingerprint returns the account linked to the certificate fingerprint, or ErrBadCredentials.
+func (as *accountStore) byFingerprint(ctx context.Context, fingerprint string) (*Account, error) {
+	var name []byte
+	err := as.traced(ctx, "storage.get", fingerprintsBucket, func() (err error) {
+		name, err = as.storage.Get(fingerprintsBucket, fingerprint)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrBadCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	return as.get(ctx, string(name))
+}
+
+// addFingerprint links the certificate fingerprint to the named account.
+func (as *accountStore) addFingerprint(ctx context.Context, name, fingerprint string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if err := as.traced(ctx, "storage.get", fingerprintsBucket, func() error {
+		_, err := as.storage.Get(fingerprintsBucket, fingerprint)
+		return err
+	}); err == nil {
+		return ErrFingerprintInUse
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	account, err := as.get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	account.Fingerprints = append(account.Fingerprints, fingerprint)
+	if err = as.put(ctx, name, account); err != nil {
+		return err
+	}
+
+	return as.traced(ctx, "storage.put", fingerprintsBucket, func() error {
+		return as.storage.Put(fingerprintsBucket, fingerprint, []byte(accountKey(name)))
+	})
+}
+
+// delFingerprint unlinks the certificate fingerprint from the named account.
+func (as *accountStore) delFingerprint(ctx context.Context, name, fingerprint string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	account, err := as.get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	idx := slices.Index(account.Fingerprints, fingerprint)
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	account.Fingerprints = slices.Delete(account.Fingerprints, idx, idx+1)
+	if err = as.put(ctx, name, account); err != nil {
+		return err
+	}
+
+	return as.traced(ctx, "storage.delete", fingerprintsBucket, func() error {
+		return as.storage.Delete(fingerprintsBucket, fingerprint)
+	})
+}
+
+// AuthProvider validates account credentials against an external source, such as the
+// LDAP directory and command providers in the auth packages, in place of the built-in
+// account store.
+//
+// Implementations must be safe for concurrent use.
+type AuthProvider interface {
+	// Authenticate returns the account name the credentials authenticate to, which may
+	// differ from the given name in case or form, or ErrBadCredentials if they are invalid.
+	Authenticate(ctx context.Context, name, password string) (string, error)
+}
+
+// authTimeout bounds an AuthProvider validating a single set of credentials.
+const authTimeout = 10 * time.Second
+
+// WithAuthProvider sets the server to validate SASL PLAIN credentials with the provider
+// instead of the built-in account store. SASL EXTERNAL still uses the built-in store.
+func WithAuthProvider(provider AuthProvider) ServerOption {
+	return option(func(s *Server) error {
+		if provider == nil {
+			return errors.New("auth provider must not be nil")
+		}
+		s.authProvider = provider
+		return nil
+	})
+}
+
+// authenticatePlain returns the account the name and password authenticate to, with the
+// auth provider if one is set, or ErrBadCredentials.
+func (srv *Server) authenticatePlain(ctx context.Context, name, password string) (*Account, error) {
+	if srv.authProvider == nil {
+		return srv.accounts.authenticate(ctx, name, password)
+	}
+
+	// Directories commonly treat a bind with an empty password as anonymous.
+	if len(password) == 0 {
+		return nil, ErrBadCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+
+	ctx, span := srv.startSpan(ctx, "auth.authenticate")
+	account, err := srv.authProvider.Authenticate(ctx, name, password)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return externalAccount(account)
+}
+
+// externalAccount returns an account authenticated to by an external source, which is
+// not held in the account store.
+func externalAccount(name string) (*Account, error) {
+	if len(name) == 0 || len(name) > MaxAccountLength || strings.ContainsAny(name, " :#*!@,") {
+		return nil, fmt.Errorf("external account name [%s] is invalid", name)
+	}
+	return &Account{Name: name}, nil
+}
+
+// RegisterAccount creates a new user account with the given name and password,
+// which users may then log in to with SASL.
+func (srv *Server) RegisterAccount(name, password string) error {
+	if srv.lockedDown(LockdownRegistration) {
+		return ErrRegistrationClosed
+	}
+	_, err := srv.accounts.create(context.Background(), name, password)
+	return err
+}
+
+// loginAccount marks the connection as logged in to the account and notifies the user.
+func (conn *Conn) loginAccount(account *Account) {
+	conn.user.SetAccount(account.Name)
+	conn.user.AddMode(UModeRegistered)
+	conn.ReplyLoggedIn(account.Name)
+	conn.logger.WithField("operation", "login").Infof("logged in to account [%s]", account.Name)
+	conn.deliverMemos()
+}
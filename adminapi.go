@@ -0,0 +1,390 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminAPIPrefix is the path prefix under which the admin API endpoints are served.
+const adminAPIPrefix = "/api/"
+
+// adminAPI serves the authenticated HTTP management API of a server.
+type adminAPI struct {
+	server *Server
+	token  []byte
+}
+
+// WithAdminAPI sets the server to serve an HTTP management API at the given address,
+// for use by external admin panels. Requests must present the token in an
+// "Authorization: Bearer <token>" header. The API is served in plain text, so it
+// should be bound to a loopback or otherwise trusted address, or put behind a
+// TLS-terminating proxy.
+//
+// Endpoints:
+//
+//	GET    /api/connections              List connections
+//	DELETE /api/connections/<nick>       Kill the user, with an optional ?reason=
+//	GET    /api/channels                 List channels
+//	GET    /api/channels/<name>          List the members of a channel
+//	GET    /api/klines                   List K-lines
+//	POST   /api/klines                   Add a K-line: {"mask", "reason", "duration"}
+//	DELETE /api/klines/<user@host>       Remove a K-line
+//	POST   /api/notice                   Send a global notice: {"text"}
+//	POST   /api/rehash                   Rehash the server
+//	GET    /api/loglevel                 List the log levels
+//	PUT    /api/loglevel                 Set a log level: {"category", "level"}
+func WithAdminAPI(address, token string) ServerOption {
+	return option(func(s *Server) error {
+		if len(token) == 0 {
+			return errors.New("admin API token must not be empty")
+		}
+
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return fmt.Errorf("error resolving admin API address [%s]: %w", address, err)
+		}
+
+		api := &adminAPI{server: s, token: []byte(token)}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(adminAPIPrefix+"connections", api.handleConnections)
+		mux.HandleFunc(adminAPIPrefix+"connections/", api.handleConnection)
+		mux.HandleFunc(adminAPIPrefix+"channels", api.handleChannels)
+		mux.HandleFunc(adminAPIPrefix+"channels/", api.handleChannel)
+		mux.HandleFunc(adminAPIPrefix+"klines", api.handleKLines)
+		mux.HandleFunc(adminAPIPrefix+"klines/", api.handleKLine)
+		mux.HandleFunc(adminAPIPrefix+"notice", api.handleNotice)
+		mux.HandleFunc(adminAPIPrefix+"rehash", api.handleRehash)
+		mux.HandleFunc(adminAPIPrefix+"loglevel", api.handleLogLevel)
+
+		s.adminServer = &http.Server{
+			Addr:              addr.String(),
+			Handler:           api.authenticate(mux),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		return nil
+	})
+}
+
+// startAdminAPI starts serving the admin API, if configured.
+func (srv *Server) startAdminAPI() {
+	if srv.adminServer == nil {
+		return
+	}
+
+	logger := srv.logger.WithField("sub-component", "admin-api")
+
+	adminServer := srv.adminServer
+	srv.registerOnShutdown(func() {
+		_ = adminServer.Close()
+	})
+
+	go func() {
+		logger.Infof("serving admin API at [http://%s%s]", adminServer.Addr, adminAPIPrefix)
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(fmt.Errorf("admin API terminated: %w", err))
+		}
+	}()
+}
+
+// authenticate is a middleware which rejects requests not bearing the API token.
+func (api *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), api.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dircd"`)
+			api.writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiConnection is the admin API representation of a connection.
+type apiConnection struct {
+	Address    string    `json:"address"`
+	Nick       string    `json:"nick,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Account    string    `json:"account,omitempty"`
+	Registered bool      `json:"registered"`
+	Oper       bool      `json:"oper"`
+	Connected  time.Time `json:"connected"`
+	SendQueue  int64     `json:"sendq"`
+	SentMsgs   uint64    `json:"sent_messages"`
+	SentBytes  uint64    `json:"sent_bytes"`
+	RecvMsgs   uint64    `json:"received_messages"`
+	RecvBytes  uint64    `json:"received_bytes"`
+}
+
+// apiChannel is the admin API representation of a channel.
+type apiChannel struct {
+	Name    string   `json:"name"`
+	Topic   string   `json:"topic,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Count   int      `json:"count"`
+}
+
+func (api *adminAPI) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	srv := api.server
+	srv.mu.Lock()
+	conns := make([]*Conn, 0, len(srv.activeConn))
+	for conn := range srv.activeConn {
+		conns = append(conns, conn)
+	}
+	srv.mu.Unlock()
+
+	list := make([]apiConnection, 0, len(conns))
+	for _, conn := range conns {
+		stats := conn.Stats()
+		list = append(list, apiConnection{
+			Address:    conn.remAddr,
+			Nick:       conn.user.Nick(),
+			User:       conn.user.Name(),
+			Host:       conn.user.Hostname(),
+			Account:    conn.user.Account(),
+			Registered: conn.isRegistered(),
+			Oper:       conn.user.IsOper(),
+			Connected:  stats.Connected,
+			SendQueue:  stats.SendQueue,
+			SentMsgs:   stats.SentMessages,
+			SentBytes:  stats.SentBytes,
+			RecvMsgs:   stats.ReceivedMessages,
+			RecvBytes:  stats.ReceivedBytes,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Connected.Before(list[j].Connected)
+	})
+	api.writeJSON(w, http.StatusOK, list)
+}
+
+func (api *adminAPI) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+
+	nick := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"connections/")
+	reason := r.URL.Query().Get("reason")
+	if err := api.server.KillUser(nick, reason, "admin API"); err != nil {
+		api.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *adminAPI) handleChannels(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	list := make([]apiChannel, 0, api.server.Channels.Length())
+	api.server.Channels.ForEach(func(_ string, channel *Channel) error {
+		list = append(list, apiChannel{
+			Name:  channel.Name(),
+			Topic: channel.Topic(),
+			Count: channel.Nicks.Length(),
+		})
+		return nil
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	api.writeJSON(w, http.StatusOK, list)
+}
+
+func (api *adminAPI) handleChannel(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"channels/")
+	channel, exists := api.server.Channels.Get(name)
+	if !exists {
+		api.writeError(w, http.StatusNotFound, ErrNoSuchChan)
+		return
+	}
+
+	members := channel.GetNicks()
+	sort.Strings(members)
+	api.writeJSON(w, http.StatusOK, apiChannel{
+		Name:    channel.Name(),
+		Topic:   channel.Topic(),
+		Members: members,
+		Count:   len(members),
+	})
+}
+
+func (api *adminAPI) handleKLines(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		api.writeJSON(w, http.StatusOK, api.server.KLines())
+		return
+	}
+
+	var request struct {
+		Mask     string `json:"mask"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"` // eg: "1h30m", permanent if empty.
+	}
+	if !api.readJSON(w, r, &request) {
+		return
+	}
+
+	var duration time.Duration
+	if len(request.Duration) > 0 {
+		var err error
+		if duration, err = time.ParseDuration(request.Duration); err != nil || duration < 0 {
+			api.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration: %s", request.Duration))
+			return
+		}
+	}
+	if len(request.Mask) == 0 {
+		api.writeError(w, http.StatusBadRequest, errors.New("mask is required"))
+		return
+	}
+
+	kline, err := api.server.AddKLine(request.Mask, request.Reason, "admin API", duration)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	api.writeJSON(w, http.StatusCreated, kline)
+}
+
+func (api *adminAPI) handleKLine(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+
+	mask := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"klines/")
+	switch err := api.server.RemoveKLine(mask, "admin API"); {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNotFound):
+		api.writeError(w, http.StatusNotFound, err)
+	default:
+		api.writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (api *adminAPI) handleNotice(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var request struct {
+		Text string `json:"text"`
+	}
+	if !api.readJSON(w, r, &request) {
+		return
+	}
+	if len(request.Text) == 0 {
+		api.writeError(w, http.StatusBadRequest, errors.New("text is required"))
+		return
+	}
+
+	api.server.GlobalNotice(request.Text)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *adminAPI) handleRehash(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := api.server.Rehash(); err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiLogLevels is the admin API representation of the log levels.
+type apiLogLevels struct {
+	Level      string            `json:"level"`
+	Categories map[string]string `json:"categories"`
+}
+
+func (api *adminAPI) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !api.allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var request struct {
+			Category string `json:"category"` // The level of the server logger if empty.
+			Level    string `json:"level"`
+		}
+		if !api.readJSON(w, r, &request) {
+			return
+		}
+		if err := api.server.SetLogLevel(request.Category, request.Level); err != nil {
+			api.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	level, categories := api.server.LogLevels()
+	api.writeJSON(w, http.StatusOK, apiLogLevels{Level: level, Categories: categories})
+}
+
+// allowMethods replies with 405 Method Not Allowed, and reports false,
+// if the request method is not one of the given methods.
+func (api *adminAPI) allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	api.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+	return false
+}
+
+// readJSON decodes the request body into v, replying with 400 Bad Request,
+// and reporting false, if it is not valid.
+func (api *adminAPI) readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		api.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func (api *adminAPI) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		api.server.logger.WithField("sub-component", "admin-api").Warn(fmt.Errorf("error writing response: %w", err))
+	}
+}
+
+func (api *adminAPI) writeError(w http.ResponseWriter, status int, err error) {
+	api.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminAPIServer returns a server with the admin API, and a function making requests to
+// it with the token, returning the response.
+func adminAPIServer(t *testing.T, options ...ServerOption) (*Server, func(method, path, body string) *httptest.ResponseRecorder) {
+	base := logrus.New()
+	base.SetOutput(io.Discard)
+	srv, err := NewServer(append([]ServerOption{
+		WithHostname("irc.example.net"),
+		WithLogger(base),
+		WithAdminAPI("127.0.0.1:0", "s3cret"),
+	}, options...)...)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		recorder := httptest.NewRecorder()
+		srv.adminServer.Handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	return srv, request
+}
+
+func TestWithAdminAPI(t *testing.T) {
+	_, err := NewServer(WithAdminAPI("127.0.0.1:0", ""))
+	assert.Error(t, err, "the token must not be empty")
+	_, err = NewServer(WithAdminAPI("localhost:port", "s3cret"))
+	assert.Error(t, err)
+}
+
+func TestAdminAPIAuthentication(t *testing.T) {
+	srv, _ := adminAPIServer(t)
+
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "Bearer s3cret2", "Basic s3cret", "s3cret"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/connections", nil)
+		if len(header) > 0 {
+			req.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		srv.adminServer.Handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, header)
+		assert.Equal(t, `Bearer realm="dircd"`, recorder.Header().Get("WWW-Authenticate"))
+		assert.JSONEq(t, `{"error":"unauthorized"}`, recorder.Body.String())
+	}
+}
+
+func TestAdminAPIConnections(t *testing.T) {
+	srv, request := adminAPIServer(t)
+
+	conn, route, expect := connectClient(t, srv, "")
+	srv.trackConn(conn, true)
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	resp := request(http.MethodGet, "/api/connections", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	var connections []apiConnection
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &connections))
+	if assert.Len(t, connections, 1) {
+		assert.Equal(t, "bob", connections[0].Nick)
+		assert.Equal(t, "bob", connections[0].User)
+		assert.True(t, connections[0].Registered)
+		assert.False(t, connections[0].Oper)
+	}
+
+	resp = request(http.MethodPost, "/api/connections", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, http.MethodGet, resp.Header().Get("Allow"))
+
+	resp = request(http.MethodDelete, "/api/connections/nobody", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.JSONEq(t, `{"error":"`+string(ErrNoSuchNick)+`"}`, resp.Body.String())
+
+	resp = request(http.MethodDelete, "/api/connections/bob?reason=Spamming", "")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	expect("ERROR :Closing link: irc.example.net [Killed: [admin API [Spamming]]]")
+}
+
+func TestAdminAPIChannels(t *testing.T) {
+	srv, request := adminAPIServer(t)
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("JOIN #chan")
+	expect(" 366 bob #chan ")
+	channel, exists := srv.Channels.Get("#chan")
+	require.True(t, exists)
+	channel.SetTopic("Welcome aboard")
+
+	resp := request(http.MethodGet, "/api/channels", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `[{"name":"#chan","topic":"Welcome aboard","count":1}]`, resp.Body.String())
+
+	resp = request(http.MethodGet, "/api/channels/%23chan", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"name":"#chan","topic":"Welcome aboard","members":["~bob"],"count":1}`, resp.Body.String())
+
+	resp = request(http.MethodGet, "/api/channels/%23nowhere", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.JSONEq(t, `{"error":"`+string(ErrNoSuchChan)+`"}`, resp.Body.String())
+}
+
+func TestAdminAPIKLines(t *testing.T) {
+	_, request := adminAPIServer(t)
+
+	for _, body := range []string{
+		`{"reason":"no mask"}`,
+		`{"mask":"*@bad.example.net","duration":"forever"}`,
+		`{"mask":"*@bad.example.net","duration":"-1h"}`,
+		`{"mask":"*@bad.example.net","unknown":true}`,
+		`not json`,
+	} {
+		resp := request(http.MethodPost, "/api/klines", body)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+	}
+
+	resp := request(http.MethodPost, "/api/klines", `{"mask":"*@bad.example.net","reason":"Spam","duration":"1h"}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var kline KLine
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &kline))
+	assert.Equal(t, "*@bad.example.net", kline.Mask)
+	assert.Equal(t, "Spam", kline.Reason)
+	assert.Equal(t, "admin API", kline.Setter)
+	assert.False(t, kline.Expires.IsZero())
+
+	resp = request(http.MethodGet, "/api/klines", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var klines []KLine
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &klines))
+	if assert.Len(t, klines, 1) {
+		assert.Equal(t, "*@bad.example.net", klines[0].Mask)
+	}
+
+	resp = request(http.MethodDelete, "/api/klines/*@bad.example.net", "")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	resp = request(http.MethodDelete, "/api/klines/*@bad.example.net", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	resp = request(http.MethodGet, "/api/klines", "")
+	assert.JSONEq(t, `[]`, resp.Body.String())
+}
+
+func TestAdminAPINotice(t *testing.T) {
+	srv, request := adminAPIServer(t)
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	resp := request(http.MethodPost, "/api/notice", `{"text":""}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = request(http.MethodPost, "/api/notice", `{"text":"Maintenance at noon"}`)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	expect(":irc.example.net NOTICE bob :Maintenance at noon")
+}
+
+func TestAdminAPIRehash(t *testing.T) {
+	rehashed := 0
+	_, request := adminAPIServer(t, WithRehashHook(func() error {
+		rehashed++
+		return nil
+	}))
+
+	resp := request(http.MethodGet, "/api/rehash", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, http.MethodPost, resp.Header().Get("Allow"))
+	assert.Zero(t, rehashed)
+
+	resp = request(http.MethodPost, "/api/rehash", "")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, 1, rehashed)
+}
+
+func TestAdminAPILogLevel(t *testing.T) {
+	_, request := adminAPIServer(t)
+
+	resp := request(http.MethodGet, "/api/loglevel", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var levels apiLogLevels
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &levels))
+	assert.Equal(t, "info", levels.Level)
+	assert.Equal(t, "default", levels.Categories["reader"])
+
+	resp = request(http.MethodPut, "/api/loglevel", `{"category":"reader","level":"trace"}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &levels))
+	assert.Equal(t, "trace", levels.Categories["reader"])
+
+	resp = request(http.MethodPut, "/api/loglevel", `{"level":"loud"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = request(http.MethodDelete, "/api/loglevel", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, "GET, PUT", resp.Header().Get("Allow"))
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// alwaysOnQuitReason is the reason the user quits with once they have been disconnected
+// for longer than the always-on timeout.
+const alwaysOnQuitReason = "Persistence timeout."
+
+// WithAlwaysOn keeps users logged in to an account connected, in their channels and
+// under their nick, for up to the timeout after their last session disconnects, like a
+// built-in bouncer. Up to history of the messages sent to them meanwhile are kept, and
+// replayed to the next session attaching to them. Users killed, and those disconnected
+// by the server shutting down, are not kept. It enables WithMultiSession.
+func WithAlwaysOn(timeout time.Duration, history int) ServerOption {
+	return option(func(s *Server) error {
+		if timeout <= 0 {
+			return errors.New("always-on timeout must be positive")
+		}
+		if history < 0 {
+			return errors.New("always-on history must not be negative")
+		}
+		s.multiSession = true
+		s.alwaysOnTimeout = timeout
+		s.alwaysOnHistory = history
+		return nil
+	})
+}
+
+// persistence holds the state of an always-on user while they have no sessions.
+type persistence struct {
+	timer *time.Timer // Quits the user once the timeout has passed.
+	since time.Time   // When the last session disconnected.
+	limit int         // Number of lines of history kept.
+}
+
+// historyLine is a line sent to an always-on user while they had no sessions.
+type historyLine struct {
+	at   time.Time
+	line []byte
+}
+
+// persist keeps the user of the connection, whose last session it was, connected with
+// WithAlwaysOn, reporting whether they are kept. Each connection keeps its user at most
+// once, so that once the timeout has passed, or they are killed, they do quit.
+func (conn *Conn) persist() bool {
+	srv := conn.server
+	user := conn.user
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.persist != nil {
+		return true
+	}
+	if srv.alwaysOnTimeout == 0 || !conn.isRegistered() || len(user.account) == 0 || srv.shuttingDown() {
+		return false
+	}
+	if !conn.persisted.CompareAndSwap(false, true) {
+		return false
+	}
+
+	user.persist = &persistence{since: time.Now(), limit: srv.alwaysOnHistory}
+	user.persist.timer = time.AfterFunc(srv.alwaysOnTimeout, func() {
+		srv.expirePersistent(user, alwaysOnQuitReason)
+	})
+
+	conn.logger.Debugf("keeping always-on user: %s", user.nick)
+	return true
+}
+
+// expirePersistent quits the always-on user without sessions with the reason, unless a
+// session has attached to them since.
+func (srv *Server) expirePersistent(user *User, reason string) {
+	user.mu.Lock()
+	persist := user.persist
+	user.persist = nil
+	conn := user.conn
+	user.mu.Unlock()
+
+	if persist == nil {
+		return
+	}
+	persist.timer.Stop()
+
+	conn.doQuit(reason)
+	conn.unregister()
+}
+
+// keep adds a copy of the line to the history of the always-on user without sessions,
+// dropping the oldest line beyond the limit, reporting whether they are one. The history
+// is kept across sessions, for playback with znc.in/playback.
+func (user *User) keep(line []byte) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.persist == nil {
+		return false
+	}
+	if user.persist.limit == 0 {
+		return true
+	}
+	if len(user.history) >= user.persist.limit {
+		user.history = user.history[len(user.history)-user.persist.limit+1:]
+	}
+	user.history = append(user.history, historyLine{at: time.Now(), line: append([]byte(nil), line...)})
+	return true
+}
+
+// keptHistory returns the lines kept for the always-on user while they had no sessions,
+// oldest first.
+func (user *User) keptHistory() []historyLine {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return slices.Clone(user.history)
+}
+
+// forgetHistory removes the lines matching from the history kept for the user.
+func (user *User) forgetHistory(matches func(historyLine) bool) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.history = slices.DeleteFunc(user.history, matches)
+}
+
+// resume ends the persistence of the always-on user, making the connection their primary
+// one, and returns the lines sent to them since their last session disconnected. It
+// reports false if the user is not an always-on user without sessions.
+func (user *User) resume(conn *Conn) ([][]byte, bool) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.persist == nil {
+		return nil, false
+	}
+	user.persist.timer.Stop()
+
+	var missed [][]byte
+	for _, entry := range user.history {
+		if !entry.at.Before(user.persist.since) {
+			missed = append(missed, entry.line)
+		}
+	}
+	user.persist = nil
+	user.conn = conn
+	return missed, true
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlwaysOn(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithAlwaysOn(time.Hour, 2))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	first, routeFirst, expectFirst := connectClient(t, srv, "bob")
+	routeFirst("NICK bob")
+	routeFirst("USER bob 0 * :Bob")
+	expectFirst(" 001 bob ")
+	routeFirst("JOIN #dircd")
+	expectFirst(" JOIN #dircd")
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	expectAlice(" 001 alice ")
+
+	// The user is kept after their last session disconnects.
+	first.doQuit("gone")
+	first.cleanup()
+	user, exists := srv.Nicks.Get("bob")
+	require.True(t, exists)
+	assert.Len(t, user.Channels(), 1)
+	assert.Empty(t, user.Sessions())
+
+	for _, text := range []string{"one", "two", "three"} {
+		routeAlice("PRIVMSG bob :" + text)
+	}
+
+	// The history kept meanwhile is replayed to the next session.
+	second, routeSecond, expectSecond := connectClient(t, srv, "bob")
+	routeSecond("NICK bob")
+	routeSecond("USER bob 0 * :Bob")
+	expectSecond(" 001 bob ")
+	expectSecond("bob!bob@ JOIN #dircd")
+	expectSecond(" PRIVMSG bob :two")
+	expectSecond(" PRIVMSG bob :three")
+
+	assert.Same(t, user, second.user)
+	assert.Equal(t, []*Conn{second}, user.Sessions())
+}
+
+func TestAlwaysOnExpiry(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithAlwaysOn(10*time.Millisecond, 0))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "bob")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+	conn.doQuit("gone")
+	assert.True(t, srv.Nicks.Exists("bob"))
+
+	assert.Eventually(t, func() bool { return !srv.Nicks.Exists("bob") }, time.Second, time.Millisecond)
+}
+
+func TestAlwaysOnKill(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithAlwaysOn(time.Hour, 0))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "bob")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+	conn.doQuit("gone")
+	require.True(t, srv.Nicks.Exists("bob"))
+
+	require.NoError(t, srv.KillUser("bob", "bye", "oper"))
+	assert.False(t, srv.Nicks.Exists("bob"))
+
+	_, err = NewServer(WithAlwaysOn(0, 0))
+	assert.Error(t, err)
+	_, err = NewServer(WithAlwaysOn(time.Second, -1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// Audit log settings
+const (
+	auditBucket       = "audit"
+	auditHistory      = 1000 // Number of recent entries kept in memory for the AUDIT command.
+	auditDefaultCount = 20
+)
+
+// AuditEntry records a privileged action taken by an operator.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Text   string    `json:"text,omitempty"`
+}
+
+// auditLog records operator actions published on the event bus, keeping the most recent
+// in memory and appending every entry to the audit file and storage when configured.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	persist bool
+	storage Storage // Nil unless entries are persisted in the server storage.
+	entries []*AuditEntry
+	lastKey int64
+}
+
+// WithAuditLog sets the server to append every audit log entry to the file at the path,
+// as a line of JSON.
+func WithAuditLog(path string) ServerOption {
+	return option(func(s *Server) error {
+		if len(path) == 0 {
+			return fmt.Errorf("audit log path must not be empty")
+		}
+		s.audit.path = path
+		return nil
+	})
+}
+
+// WithAuditStorage sets the server to persist every audit log entry in the server storage,
+// retaining the recent history across restarts.
+func WithAuditStorage() ServerOption {
+	return option(func(s *Server) error {
+		s.audit.persist = true
+		return nil
+	})
+}
+
+// startAudit opens the audit log file, loads the recent history from storage, and
+// subscribes the audit log to operator actions.
+func (srv *Server) startAudit() error {
+	audit := &srv.audit
+
+	if audit.persist {
+		audit.storage = srv.storage
+		if err := audit.load(); err != nil {
+			return err
+		}
+	}
+
+	if len(audit.path) > 0 {
+		file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("error opening audit log: %w", err)
+		}
+		audit.file = file
+		srv.registerOnShutdown(func() {
+			audit.mu.Lock()
+			defer audit.mu.Unlock()
+			_ = audit.file.Close()
+		})
+	}
+
+	srv.Subscribe(func(event Event) {
+		if err := audit.record(auditEntry(event)); err != nil {
+			srv.logger.WithField("sub-component", "audit").Error(fmt.Errorf("error recording audit entry: %w", err))
+		}
+	}, EventOperUp, EventOperAction)
+	return nil
+}
+
+// auditEntry returns the audit log entry recording the operator event.
+func auditEntry(event Event) *AuditEntry {
+	entry := &AuditEntry{
+		Time:   event.Time,
+		Actor:  event.Actor,
+		Action: event.Action,
+		Target: event.Target,
+		Reason: event.Reason,
+		Text:   event.Text,
+	}
+	if event.Type == EventOperUp {
+		entry.Actor = fmt.Sprintf("%s!%s@%s", event.Nick, event.User, event.Host)
+		entry.Action = CmdOper
+	}
+	return entry
+}
+
+// load loads the most recent entries persisted in storage.
+func (al *auditLog) load() error {
+	stored, err := al.storage.List(auditBucket)
+	if err != nil {
+		return fmt.Errorf("error loading audit log: %w", err)
+	}
+
+	keys := make([]int64, 0, len(stored))
+	for key := range stored {
+		parsed, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid audit log key [%s]", key)
+		}
+		keys = append(keys, parsed)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if len(keys) > 0 {
+		al.lastKey = keys[len(keys)-1]
+	}
+	if len(keys) > auditHistory {
+		keys = keys[len(keys)-auditHistory:]
+	}
+
+	for _, key := range keys {
+		entry := &AuditEntry{}
+		if err = json.Unmarshal(stored[strconv.FormatInt(key, 10)], entry); err != nil {
+			return fmt.Errorf("error decoding audit entry [%d]: %w", key, err)
+		}
+		al.entries = append(al.entries, entry)
+	}
+	return nil
+}
+
+// record appends the entry to the audit log.
+func (al *auditLog) record(entry *AuditEntry) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.entries = append(al.entries, entry)
+	if len(al.entries) > auditHistory {
+		al.entries = al.entries[len(al.entries)-auditHistory:]
+	}
+
+	if al.file != nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err = al.file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if al.storage != nil {
+		key := entry.Time.UnixNano()
+		if key <= al.lastKey {
+			key = al.lastKey + 1
+		}
+		al.lastKey = key
+		return storeJSON(al.storage, auditBucket, strconv.FormatInt(key, 10), entry)
+	}
+	return nil
+}
+
+// query returns up to count of the most recent entries whose actor, action, or target
+// matches the mask, oldest first. Every entry matches an empty mask.
+func (al *auditLog) query(count int, mask string) []*AuditEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	var matched []*AuditEntry
+	for i := len(al.entries) - 1; i >= 0 && len(matched) < count; i-- {
+		entry := al.entries[i]
+		if len(mask) == 0 || stringutils.MatchMask(mask, entry.Actor) ||
+			stringutils.MatchMask(mask, entry.Action) || stringutils.MatchMask(mask, entry.Target) {
+			matched = append(matched, entry)
+		}
+	}
+
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched
+}
+
+// AuditLog returns up to count of the most recent audit log entries whose actor, action,
+// or target matches the mask (which may contain * and ? wildcards), oldest first.
+func (srv *Server) AuditLog(count int, mask string) []*AuditEntry {
+	return srv.audit.query(count, mask)
+}
+
+// doAudit lists the most recent audit log entries, optionally the given number of
+// entries and only those matching a mask.
+func (conn *Conn) doAudit(params []string) {
+	count, mask := auditDefaultCount, ""
+	for _, param := range params {
+		if n, err := strconv.Atoi(param); err == nil && n > 0 {
+			count = min(n, auditHistory)
+		} else {
+			mask = param
+		}
+	}
+
+	entries := conn.server.AuditLog(count, mask)
+	if len(entries) == 0 {
+		conn.ReplyServerNotice("No matching audit log entries")
+		return
+	}
+
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s [%s] %s", entry.Time.Format(time.RFC3339), entry.Actor, entry.Action)
+		if len(entry.Target) > 0 {
+			line += " " + entry.Target
+		}
+		if len(entry.Reason) > 0 {
+			line += ": " + entry.Reason
+		} else if len(entry.Text) > 0 {
+			line += ": " + entry.Text
+		}
+		conn.ReplyServerNotice(line)
+	}
+	conn.ReplyServerNotice(fmt.Sprintf("End of audit log (%d entries)", len(entries)))
+}
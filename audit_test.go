@@ -0,0 +1,57 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	storage := NewMemoryStorage()
+	audit := &auditLog{storage: storage}
+
+	now := time.Now().UTC()
+	entries := []*AuditEntry{
+		{Time: now, Actor: "oper!o@host", Action: CmdKLine, Target: "*@bad.host", Reason: "spam"},
+		{Time: now, Actor: "oper!o@host", Action: CmdLockdown, Target: "3"},
+		{Time: now, Actor: "admin!a@host", Action: CmdUnKLine, Target: "*@bad.host"},
+	}
+	for _, entry := range entries {
+		assert.NoError(t, audit.record(entry))
+	}
+
+	tests := []struct {
+		name    string
+		count   int
+		mask    string
+		entries []*AuditEntry
+	}{
+		{name: "all", count: 10, entries: entries},
+		{name: "most recent", count: 2, entries: entries[1:]},
+		{name: "actor", count: 10, mask: "oper!*", entries: entries[:2]},
+		{name: "action", count: 10, mask: "*kline", entries: []*AuditEntry{entries[0], entries[2]}},
+		{name: "target", count: 1, mask: "*@bad.host", entries: entries[2:]},
+		{name: "no match", count: 10, mask: "nobody"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.entries, audit.query(test.count, test.mask))
+		})
+	}
+
+	loaded := &auditLog{storage: storage}
+	assert.NoError(t, loaded.load())
+	assert.Len(t, loaded.entries, len(entries))
+	for i := range entries {
+		assert.Equal(t, entries[i].Action, loaded.entries[i].Action)
+	}
+}
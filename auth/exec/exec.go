@@ -0,0 +1,71 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package exec provides a dircd auth provider which validates credentials by running an
+// external command, for directories without a native provider.
+//
+// The command is given the account name and password on separate lines of its standard
+// input, so they never appear in its arguments. It must exit with status 0 to accept the
+// credentials, optionally printing the canonical account name on the first line of its
+// standard output, or with status 1 to reject them. Any other status is an error.
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Provider validates credentials with an external command, implementing dircd.AuthProvider.
+type Provider struct {
+	path string
+	args []string
+}
+
+// New returns a provider running the command at the path with the arguments.
+func New(path string, args ...string) (*Provider, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("error finding auth command: %w", err)
+	}
+	return &Provider{path: resolved, args: args}, nil
+}
+
+// Authenticate runs the command with the credentials, returning the account name it printed,
+// or the given name if it printed none.
+func (p *Provider) Authenticate(ctx context.Context, name, password string) (string, error) {
+	if strings.ContainsAny(name+password, "\r\n") {
+		return "", dircd.ErrBadCredentials
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.path, p.args...)
+	cmd.Stdin = strings.NewReader(name + "\n" + password + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", dircd.ErrBadCredentials
+		}
+		return "", fmt.Errorf("error running auth command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if line, _, _ := bufio.NewReader(&stdout).ReadLine(); len(bytes.TrimSpace(line)) > 0 {
+		return string(bytes.TrimSpace(line)), nil
+	}
+	return name, nil
+}
+
+var _ dircd.AuthProvider = (*Provider)(nil)
@@ -0,0 +1,46 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package exec
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestAuthenticate(t *testing.T) {
+	// Accepts alice with hunter2 as Alice, rejects other credentials, and fails for bob.
+	provider, err := New("sh", "-c", `read name; read password
+[ "$name" = bob ] && { echo broken >&2; exit 2; }
+[ "$name" = alice ] && [ "$password" = hunter2 ] && { echo Alice; exit 0; }
+exit 1`)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		password string
+		account  string
+		err      error
+	}{
+		{name: "alice", password: "hunter2", account: "Alice"},
+		{name: "alice", password: "wrong", err: dircd.ErrBadCredentials},
+		{name: "alice\nalice", password: "hunter2", err: dircd.ErrBadCredentials},
+	}
+
+	for _, test := range tests {
+		account, err := provider.Authenticate(context.Background(), test.name, test.password)
+		assert.Equal(t, test.err, err)
+		assert.Equal(t, test.account, account)
+	}
+
+	_, err = provider.Authenticate(context.Background(), "bob", "pass")
+	assert.ErrorContains(t, err, "broken")
+}
@@ -0,0 +1,319 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package jwt provides a dircd token validator which validates JWT bearer tokens issued by
+// an OAuth2/OpenID Connect provider, with signing keys fetched from the provider's JWKS.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Validator defaults
+const (
+	defaultClaim   = "preferred_username"
+	defaultRefresh = time.Hour
+	minRefetch     = time.Minute
+	leeway         = 30 * time.Second
+	maxJWKSSize    = 1 << 20
+)
+
+// validMethods are the accepted signing algorithms. Symmetric algorithms are excluded, as
+// the keys are public.
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// errFetch marks errors fetching the signing keys, which are not the token's fault.
+var errFetch = errors.New("error fetching signing keys")
+
+// Validator validates JWT bearer tokens, implementing dircd.TokenValidator.
+type Validator struct {
+	issuer   string
+	jwksURL  string
+	audience string
+	claim    string
+	refresh  time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithJWKSURL sets the URL of the JWKS holding the signing keys, instead of discovering
+// it from the issuer's OpenID configuration.
+func WithJWKSURL(url string) Option {
+	return func(v *Validator) {
+		v.jwksURL = url
+	}
+}
+
+// WithAudience sets the audience tokens must be issued for, such as the client ID of
+// the IRC network. Any audience is accepted if not set.
+func WithAudience(audience string) Option {
+	return func(v *Validator) {
+		v.audience = audience
+	}
+}
+
+// WithAccountClaim sets the claim holding the account name, "preferred_username" by default.
+func WithAccountClaim(claim string) Option {
+	return func(v *Validator) {
+		v.claim = claim
+	}
+}
+
+// WithRefreshInterval sets how often the signing keys are refetched, hourly by default.
+// Keys are also refetched when a token is signed by an unknown key, at most once a minute.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(v *Validator) {
+		v.refresh = interval
+	}
+}
+
+// WithHTTPClient sets the client used to fetch the OpenID configuration and JWKS.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *Validator) {
+		v.client = client
+	}
+}
+
+// New returns a validator for tokens issued by the issuer.
+func New(issuer string, options ...Option) (*Validator, error) {
+	if len(issuer) == 0 {
+		return nil, errors.New("issuer must not be empty")
+	}
+
+	validator := &Validator{
+		issuer:  issuer,
+		claim:   defaultClaim,
+		refresh: defaultRefresh,
+		client:  http.DefaultClient,
+	}
+	for _, option := range options {
+		option(validator)
+	}
+	return validator, nil
+}
+
+// ValidateToken validates the token's signature, issuer, audience, and expiry, returning
+// the account name held in its account claim.
+func (v *Validator) ValidateToken(ctx context.Context, token string) (string, error) {
+	options := []gojwt.ParserOption{
+		gojwt.WithValidMethods(validMethods),
+		gojwt.WithIssuer(v.issuer),
+		gojwt.WithExpirationRequired(),
+		gojwt.WithLeeway(leeway),
+	}
+	if len(v.audience) > 0 {
+		options = append(options, gojwt.WithAudience(v.audience))
+	}
+
+	claims := gojwt.MapClaims{}
+	_, err := gojwt.ParseWithClaims(token, claims, func(token *gojwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}, options...)
+	if errors.Is(err, errFetch) {
+		return "", err
+	} else if err != nil {
+		return "", dircd.ErrBadCredentials
+	}
+
+	account, _ := claims[v.claim].(string)
+	if len(account) == 0 {
+		return "", dircd.ErrBadCredentials
+	}
+	return account, nil
+}
+
+// key returns the signing key with the ID, fetching the keys if they are stale or the key is unknown.
+func (v *Validator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, known := v.lookup(kid)
+	age := time.Since(v.fetched)
+	if (known && age < v.refresh) || (!known && age < minRefetch) {
+		if !known {
+			return nil, fmt.Errorf("unknown signing key [%s]", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errFetch, err)
+	}
+	v.keys, v.fetched = keys, time.Now()
+
+	if key, known = v.lookup(kid); !known {
+		return nil, fmt.Errorf("unknown signing key [%s]", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the signing key with the ID, or the only key if the token names none.
+func (v *Validator) lookup(kid string) (crypto.PublicKey, bool) {
+	if len(kid) == 0 && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, known := v.keys[kid]
+	return key, known
+}
+
+// fetch fetches the signing keys from the JWKS, discovering its URL if not configured.
+func (v *Validator) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := v.jwksURL
+	if len(jwksURL) == 0 {
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.get(ctx, strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+			return nil, err
+		}
+		if len(config.JWKSURI) == 0 {
+			return nil, errors.New("OpenID configuration has no jwks_uri")
+		}
+		jwksURL = config.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.get(ctx, jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key [%s]: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// get fetches the JSON document at the URL.
+func (v *Validator) get(ctx context.Context, url string, document any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching [%s]: %s", url, resp.Status)
+	}
+	return json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKSSize)).Decode(document)
+}
+
+// jwk is a JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the public key, or nil for key types which can't sign tokens.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, supported := curves[k.Crv]
+		if !supported {
+			return nil, fmt.Errorf("unsupported curve [%s]", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve [%s]", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// decodeInt decodes a base64url encoded big-endian integer.
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+var _ dircd.TokenValidator = (*Validator)(nil)
@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package jwt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestValidateToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"jwks_uri": server.URL + "/keys"})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "one",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		}
+	}))
+	defer server.Close()
+
+	validator, err := New(server.URL, WithAudience("irc"))
+	assert.NoError(t, err)
+
+	sign := func(signer *rsa.PrivateKey, kid string, claims gojwt.MapClaims) string {
+		token := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(signer)
+		assert.NoError(t, err)
+		return signed
+	}
+	claims := func(issuer string, expiry time.Duration) gojwt.MapClaims {
+		return gojwt.MapClaims{
+			"iss":                issuer,
+			"aud":                "irc",
+			"exp":                time.Now().Add(expiry).Unix(),
+			"preferred_username": "alice",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		account string
+		err     error
+	}{
+		{name: "valid", token: sign(key, "one", claims(server.URL, time.Hour)), account: "alice"},
+		{name: "expired", token: sign(key, "one", claims(server.URL, -time.Hour)), err: dircd.ErrBadCredentials},
+		{name: "wrong issuer", token: sign(key, "one", claims("https://evil.example.com", time.Hour)), err: dircd.ErrBadCredentials},
+		{name: "wrong key", token: sign(other, "one", claims(server.URL, time.Hour)), err: dircd.ErrBadCredentials},
+		{name: "unknown key", token: sign(key, "two", claims(server.URL, time.Hour)), err: dircd.ErrBadCredentials},
+		{name: "malformed", token: "not.a.token", err: dircd.ErrBadCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account, err := validator.ValidateToken(context.Background(), test.token)
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.account, account)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package ldap provides a dircd auth provider which validates credentials against an
+// LDAP directory, by searching for the user's entry and binding as it with the password.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Provider defaults
+const (
+	defaultFilter    = "(uid=%s)"
+	defaultAttribute = "uid"
+	defaultTimeout   = 10 * time.Second
+)
+
+// Provider validates credentials against an LDAP directory, implementing dircd.AuthProvider.
+type Provider struct {
+	url          string
+	baseDN       string
+	bindDN       string
+	bindPassword string
+	filter       string
+	attribute    string
+	startTLS     bool
+	tlsConfig    *tls.Config
+}
+
+// Option configures a Provider.
+type Option func(*Provider)
+
+// WithBind sets the DN and password to bind as when searching for users, instead of
+// searching anonymously.
+func WithBind(dn, password string) Option {
+	return func(p *Provider) {
+		p.bindDN = dn
+		p.bindPassword = password
+	}
+}
+
+// WithFilter sets the search filter used to find a user's entry, with %s replaced by the
+// escaped account name, "(uid=%s)" by default, eg:
+//
+//	ldap.WithFilter("(&(objectClass=person)(sAMAccountName=%s)(memberOf=cn=irc,ou=groups,dc=example,dc=com))")
+func WithFilter(filter string) Option {
+	return func(p *Provider) {
+		p.filter = filter
+	}
+}
+
+// WithAccountAttribute sets the attribute of a user's entry used as their account name,
+// "uid" by default. The name given by the user is used if the entry lacks the attribute.
+func WithAccountAttribute(attribute string) Option {
+	return func(p *Provider) {
+		p.attribute = attribute
+	}
+}
+
+// WithStartTLS sets the provider to upgrade ldap:// connections with StartTLS.
+func WithStartTLS() Option {
+	return func(p *Provider) {
+		p.startTLS = true
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for ldaps:// URLs and StartTLS.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(p *Provider) {
+		p.tlsConfig = config
+	}
+}
+
+// New returns a provider for the directory at the ldap:// or ldaps:// URL, searching for
+// users under the base DN.
+func New(rawURL, baseDN string, options ...Option) (*Provider, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	if parsed.Scheme != "ldap" && parsed.Scheme != "ldaps" {
+		return nil, fmt.Errorf("unsupported LDAP URL scheme [%s]", parsed.Scheme)
+	}
+	if len(baseDN) == 0 {
+		return nil, errors.New("base DN must not be empty")
+	}
+
+	provider := &Provider{
+		url:       rawURL,
+		baseDN:    baseDN,
+		filter:    defaultFilter,
+		attribute: defaultAttribute,
+	}
+	for _, option := range options {
+		option(provider)
+	}
+
+	if strings.Count(provider.filter, "%s") != 1 {
+		return nil, fmt.Errorf("filter [%s] must contain a single %%s", provider.filter)
+	}
+	if provider.tlsConfig == nil {
+		provider.tlsConfig = &tls.Config{ServerName: parsed.Hostname()}
+	}
+	return provider, nil
+}
+
+// Authenticate finds the entry of the named user and binds as it with the password,
+// returning the account name of the entry.
+func (p *Provider) Authenticate(ctx context.Context, name, password string) (string, error) {
+	if len(password) == 0 {
+		return "", dircd.ErrBadCredentials // An empty password would be an unauthenticated bind.
+	}
+
+	timeout := defaultTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := goldap.DialURL(p.url,
+		goldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		goldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return "", fmt.Errorf("error connecting to LDAP server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if p.startTLS {
+		if err = conn.StartTLS(p.tlsConfig); err != nil {
+			return "", fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+
+	if len(p.bindDN) > 0 {
+		if err = conn.Bind(p.bindDN, p.bindPassword); err != nil {
+			return "", fmt.Errorf("error binding as [%s]: %w", p.bindDN, err)
+		}
+	}
+
+	result, err := conn.Search(goldap.NewSearchRequest(
+		p.baseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, int(timeout.Seconds()), false,
+		fmt.Sprintf(p.filter, goldap.EscapeFilter(name)), []string{p.attribute}, nil))
+	if err != nil {
+		return "", fmt.Errorf("error searching for user: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return "", dircd.ErrBadCredentials
+	}
+	entry := result.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return "", dircd.ErrBadCredentials
+		}
+		return "", fmt.Errorf("error binding as [%s]: %w", entry.DN, err)
+	}
+
+	if account := entry.GetAttributeValue(p.attribute); len(account) > 0 {
+		return account, nil
+	}
+	return name, nil
+}
+
+var _ dircd.AuthProvider = (*Provider)(nil)
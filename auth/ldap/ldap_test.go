@@ -0,0 +1,33 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestNew(t *testing.T) {
+	provider, err := New("ldaps://ldap.example.com", "dc=example,dc=com", WithFilter("(cn=%s)"))
+	assert.NoError(t, err)
+	assert.Equal(t, "(cn=%s)", provider.filter)
+	assert.Equal(t, "ldap.example.com", provider.tlsConfig.ServerName)
+
+	_, err = New("http://ldap.example.com", "dc=example,dc=com")
+	assert.Error(t, err)
+
+	_, err = New("ldap://ldap.example.com", "dc=example,dc=com", WithFilter("(cn=*)"))
+	assert.Error(t, err)
+
+	_, err = provider.Authenticate(context.Background(), "alice", "")
+	assert.Equal(t, dircd.ErrBadCredentials, err)
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// K-lines and filter rules are propagated to linked servers with ENCAP subcommands, which
+// servers not supporting them ignore:
+//
+//	ENCAP * SYNCBAN K <created> <expires> <origin> <setter> <mask> :<reason>
+//	ENCAP * SYNCBAN F <created> 0 <origin> <setter> <name> <field> <action> <glob|regex> <reason> :<pattern>
+//	ENCAP * SYNCUNBAN <K|F> <removed> <origin> <remover> :<mask|name>
+//
+// Times are in seconds since the epoch, expires being zero for a permanent K-line, and the
+// setter, remover, and filter reason have underscores for spaces. Each server propagates
+// the changes it applies to its other links, so that they reach the whole network.
+const (
+	encapSyncBan   = "SYNCBAN"
+	encapSyncUnban = "SYNCUNBAN"
+
+	banTypeKLine  = "K"
+	banTypeFilter = "F"
+)
+
+// supersedes reports whether a ban set at created on the origin server takes precedence
+// over another on the same mask or name: the newest wins, or that of the server name
+// sorting first if both were set in the same second, so that every server keeps the same
+// ban whatever order they are received in.
+func supersedes(created time.Time, origin string, otherCreated time.Time, otherOrigin string) bool {
+	if !created.Equal(otherCreated) {
+		return created.After(otherCreated)
+	}
+	return strings.ToLower(origin) < strings.ToLower(otherOrigin)
+}
+
+// spaceParam returns the text as a middle parameter, with underscores for spaces, or - if empty.
+func spaceParam(text string) string {
+	if len(text) == 0 {
+		return "-"
+	}
+	return strings.ReplaceAll(text, SPACE, "_")
+}
+
+// unspaceParam returns the text of a middle parameter encoded with spaceParam.
+func unspaceParam(param string) string {
+	if param == "-" {
+		return ""
+	}
+	return strings.ReplaceAll(param, "_", SPACE)
+}
+
+// banOrigin returns the origin of a ban, which is this server for those persisted before
+// their origin was recorded.
+func (srv *Server) banOrigin(origin string) string {
+	if len(origin) == 0 {
+		return srv.Hostname()
+	}
+	return origin
+}
+
+// propagate sends the line to the established links of the server, other than the link
+// it was received on, if any.
+func (srv *Server) propagate(from *servicesLink, line string) {
+	for _, link := range srv.serverLinks() {
+		if link != from {
+			link.send(line)
+		}
+	}
+}
+
+// klineLine returns the SYNCBAN message propagating the K-line.
+func (srv *Server) klineLine(kline *KLine) string {
+	var expires int64
+	if !kline.Expires.IsZero() {
+		expires = kline.Expires.Unix()
+	}
+	return fmt.Sprintf(":%s ENCAP * %s %s %d %d %s %s %s :%s", srv.sid, encapSyncBan, banTypeKLine,
+		kline.Created.Unix(), expires, srv.banOrigin(kline.Origin), spaceParam(kline.Setter), kline.Mask, kline.Reason)
+}
+
+// filterLine returns the SYNCBAN message propagating the filter rule.
+func (srv *Server) filterLine(rule *FilterRule) string {
+	kind := "glob"
+	if rule.Regex {
+		kind = "regex"
+	}
+	return fmt.Sprintf(":%s ENCAP * %s %s %d 0 %s %s %s %s %s %s %s :%s", srv.sid, encapSyncBan, banTypeFilter,
+		rule.Created.Unix(), srv.banOrigin(rule.Origin), spaceParam(rule.Setter), rule.Name,
+		rule.Field, rule.Action, kind, spaceParam(rule.Reason), rule.Pattern)
+}
+
+// unbanLine returns the SYNCUNBAN message propagating the removal of the K-line on the
+// mask, or filter rule with the name, by the remover on this server now.
+func (srv *Server) unbanLine(banType, target, remover string) string {
+	return fmt.Sprintf(":%s ENCAP * %s %s %d %s %s :%s", srv.sid, encapSyncUnban, banType,
+		time.Now().Unix(), srv.Hostname(), spaceParam(remover), target)
+}
+
+// burstBans sends the K-lines and filter rules of the server to the linked server, other
+// than the K-lines set in its configuration.
+func (link *servicesLink) burstBans() {
+	srv := link.server
+	for _, kline := range srv.klines.list() {
+		if !kline.configured {
+			link.send(srv.klineLine(kline))
+		}
+	}
+	for _, rule := range srv.filters.list() {
+		link.send(srv.filterLine(rule))
+	}
+}
+
+// receiveBan applies a K-line or filter rule propagated by a linked server, unless the
+// ban it conflicts with takes precedence, propagating it to the other links if applied.
+func (srv *Server) receiveBan(from *servicesLink, params []string) {
+	logger := from.logger.WithField("operation", "ban-sync")
+	if len(params) < 7 {
+		logger.Warn("ignoring malformed SYNCBAN")
+		return
+	}
+
+	created, createdErr := strconv.ParseInt(params[1], 10, 64)
+	expires, expiresErr := strconv.ParseInt(params[2], 10, 64)
+	if createdErr != nil || expiresErr != nil {
+		logger.Warn("ignoring SYNCBAN with invalid times")
+		return
+	}
+
+	switch params[0] {
+	case banTypeKLine:
+		kline := &KLine{
+			Mask:    params[5],
+			Reason:  params[6],
+			Setter:  unspaceParam(params[4]),
+			Origin:  params[3],
+			Created: time.Unix(created, 0).UTC(),
+		}
+		if expires > 0 {
+			kline.Expires = time.Unix(expires, 0).UTC()
+		}
+		if !strings.Contains(kline.Mask, AT) || kline.Expired() {
+			return
+		}
+
+		applied, err := srv.klines.merge(kline)
+		if err != nil {
+			logger.Error(fmt.Errorf("error adding K-line [%s] from [%s]: %w", kline.Mask, kline.Origin, err))
+		}
+		if !applied {
+			return
+		}
+		logger.Infof("added K-line [%s] set by [%s] on [%s]", kline.Mask, kline.Setter, kline.Origin)
+		srv.propagate(from, srv.klineLine(kline))
+		srv.enforceKLine(kline)
+
+	case banTypeFilter:
+		if len(params) < 11 {
+			logger.Warn("ignoring malformed SYNCBAN")
+			return
+		}
+		rule := &FilterRule{
+			Name:    params[5],
+			Field:   FilterField(params[6]),
+			Action:  FilterAction(params[7]),
+			Regex:   params[8] == "regex",
+			Reason:  unspaceParam(params[9]),
+			Pattern: params[10],
+			Setter:  unspaceParam(params[4]),
+			Origin:  params[3],
+			Created: time.Unix(created, 0).UTC(),
+		}
+		if err := rule.compile(); err != nil {
+			logger.Warn(fmt.Errorf("ignoring filter from [%s]: %w", rule.Origin, err))
+			return
+		}
+
+		applied, err := srv.filters.merge(rule)
+		if err != nil {
+			logger.Error(fmt.Errorf("error adding filter [%s] from [%s]: %w", rule.Name, rule.Origin, err))
+		}
+		if !applied {
+			return
+		}
+		logger.Infof("added filter [%s] set by [%s] on [%s]", rule.Name, rule.Setter, rule.Origin)
+		srv.propagate(from, srv.filterLine(rule))
+	}
+}
+
+// receiveUnban removes a K-line or filter rule as propagated by a linked server, unless it
+// was set again since, propagating the removal to the other links if applied.
+func (srv *Server) receiveUnban(from *servicesLink, params []string) {
+	logger := from.logger.WithField("operation", "ban-sync")
+	if len(params) < 5 {
+		logger.Warn("ignoring malformed SYNCUNBAN")
+		return
+	}
+
+	seconds, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		logger.Warn("ignoring SYNCUNBAN with an invalid time")
+		return
+	}
+	removed := time.Unix(seconds, 0).UTC()
+
+	var applied bool
+	switch params[0] {
+	case banTypeKLine:
+		applied, err = srv.klines.removeBefore(params[4], removed)
+	case banTypeFilter:
+		applied, err = srv.filters.removeBefore(params[4], removed)
+	default:
+		return
+	}
+	if err != nil {
+		logger.Error(fmt.Errorf("error removing [%s] from [%s]: %w", params[4], params[2], err))
+	}
+	if !applied {
+		return
+	}
+
+	logger.Infof("removed [%s] as removed by [%s] on [%s]", params[4], unspaceParam(params[3]), params[2])
+	line := fmt.Sprintf(":%s ENCAP * %s %s", srv.sid, encapSyncUnban, strings.Join(params[:4], SPACE))
+	srv.propagate(from, line+" :"+params[4])
+}
+
+// doBanInfo replies with where the K-line on the mask, or the filter rule with the name,
+// was set, and by whom.
+func (conn *Conn) doBanInfo(target string) {
+	srv := conn.server
+	found := false
+
+	mask := target
+	if !strings.Contains(mask, AT) {
+		mask = "*@" + mask
+	}
+	if kline := srv.klines.get(mask); kline != nil && !kline.Expired() {
+		found = true
+		expiry := "permanent"
+		if !kline.Expires.IsZero() {
+			expiry = "expires " + kline.Expires.Format(time.RFC3339)
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("K-line [%s] set on %s by %s at %s, %s: %s",
+			kline.Mask, srv.banOrigin(kline.Origin), kline.Setter, kline.Created.Format(time.RFC3339), expiry, kline.Reason))
+	}
+
+	if rule := srv.filters.get(target); rule != nil {
+		found = true
+		conn.ReplyServerNotice(fmt.Sprintf("Filter [%s] set on %s by %s at %s: %s",
+			rule.Name, srv.banOrigin(rule.Origin), rule.Setter, rule.Created.Format(time.RFC3339), rule.Reason))
+	}
+
+	if !found {
+		conn.ReplyServerNotice(fmt.Sprintf("No K-line or filter for [%s]", target))
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queuedLink adds an established link to the server whose sent lines are queued, rather
+// than written to a connection.
+func queuedLink(srv *Server, name string) *servicesLink {
+	link := &servicesLink{
+		server: srv,
+		name:   name,
+		logger: srv.logger,
+		queue:  make(chan string, 64),
+	}
+	srv.connectBlocks = append(srv.connectBlocks, link)
+	return link
+}
+
+// sent returns the next line queued on the link, or an empty string if there is none.
+func sent(link *servicesLink) string {
+	select {
+	case line := <-link.queue:
+		return line
+	default:
+		return ""
+	}
+}
+
+// receive processes the line as received from the link.
+func receive(t *testing.T, link *servicesLink, line string) {
+	source, command, params := parseTS6(line)
+	require.NoError(t, link.handle(source, command, params))
+}
+
+func TestSupersedes(t *testing.T) {
+	now := time.Now()
+	assert.True(t, supersedes(now, "b.example.net", now.Add(-time.Second), "a.example.net"))
+	assert.False(t, supersedes(now.Add(-time.Second), "a.example.net", now, "b.example.net"))
+	assert.True(t, supersedes(now, "a.example.net", now, "B.example.net"), "ties go to the server name sorting first")
+	assert.False(t, supersedes(now, "b.example.net", now, "a.example.net"))
+}
+
+func TestKLinePropagation(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	hub := queuedLink(srv, "hub.example.net")
+	leaf := queuedLink(srv, "leaf.example.net")
+
+	kline, err := srv.AddKLine("*@bad.example.net", "spam", "bob!bob@host", time.Hour)
+	require.NoError(t, err)
+	expected := fmt.Sprintf(":0DC ENCAP * SYNCBAN K %d %d irc.example.net bob!bob@host *@bad.example.net :spam",
+		kline.Created.Unix(), kline.Expires.Unix())
+	assert.Equal(t, expected, sent(hub))
+	assert.Equal(t, expected, sent(leaf))
+
+	// A newer K-line on the same mask replaces it, and is propagated to the other links.
+	newer := kline.Created.Add(time.Second).Unix()
+	receive(t, hub, fmt.Sprintf(":1HB ENCAP * SYNCBAN K %d 0 hub.example.net admin_API *@bad.example.net :flood", newer))
+	replaced := srv.klines.get("*@bad.example.net")
+	require.NotNil(t, replaced)
+	assert.Equal(t, "flood", replaced.Reason)
+	assert.Equal(t, "admin API", replaced.Setter)
+	assert.Equal(t, "hub.example.net", replaced.Origin)
+	assert.True(t, replaced.Expires.IsZero())
+	assert.Contains(t, sent(leaf), " SYNCBAN K ")
+	assert.Empty(t, sent(hub), "changes aren't echoed to the link they were received on")
+
+	// An older K-line, or a removal before the K-line was set, is ignored.
+	receive(t, leaf, fmt.Sprintf(":2LF ENCAP * SYNCBAN K %d 0 leaf.example.net oper *@bad.example.net :old", newer-10))
+	receive(t, leaf, fmt.Sprintf(":2LF ENCAP * SYNCUNBAN K %d leaf.example.net oper :*@bad.example.net", newer-1))
+	assert.Equal(t, "flood", srv.klines.get("*@bad.example.net").Reason)
+	assert.Empty(t, sent(hub))
+
+	receive(t, leaf, fmt.Sprintf(":2LF ENCAP * SYNCUNBAN K %d leaf.example.net oper :*@bad.example.net", newer))
+	assert.Nil(t, srv.klines.get("*@bad.example.net"))
+	assert.Equal(t, fmt.Sprintf(":0DC ENCAP * SYNCUNBAN K %d leaf.example.net oper :*@bad.example.net", newer), sent(hub))
+}
+
+func TestFilterPropagation(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithOper("admin", "hunter2", "*@*", PrivKLine))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	hub := queuedLink(srv, "hub.example.net")
+
+	receive(t, hub, ":1HB ENCAP * SYNCBAN F 1700000000 0 hub.example.net carol spam text block glob No_spam :*free money*")
+	rule := srv.filters.get("spam")
+	require.NotNil(t, rule)
+	assert.Equal(t, "*free money*", rule.Pattern)
+	assert.Equal(t, "No spam", rule.Reason)
+	assert.Equal(t, FilterBlock, rule.Action)
+
+	// Rules are sent to servers when they link, K-lines set in the configuration aside.
+	srv.klines.lines["*@config"] = &KLine{Mask: "*@config", configured: true}
+	hub.burstBans()
+	assert.Equal(t, ":0DC ENCAP * SYNCBAN F 1700000000 0 hub.example.net carol spam text block glob No_spam :*free money*", sent(hub))
+	assert.Empty(t, sent(hub))
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("OPER admin hunter2")
+	route("BANINFO spam")
+	expect("Filter [spam] set on hub.example.net by carol at 2023-11-14T22:13:20Z: No spam")
+	route("BANINFO *@nowhere")
+	expect("No K-line or filter for [*@nowhere]")
+
+	require.NoError(t, srv.RemoveFilter("spam", "bob"))
+	assert.Contains(t, sent(hub), ":0DC ENCAP * SYNCUNBAN F ")
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// broadcastInterval limits how often an operator may send a global notice or GLOBOPS.
+const broadcastInterval = 10 * time.Second
+
+const (
+	// fanOutThreshold is the number of recipients from which a message is delivered by
+	// the fan-out workers, rather than by the sender alone.
+	fanOutThreshold = 512
+
+	// fanOutPartition is the number of recipients a fan-out worker delivers to at a time.
+	fanOutPartition = 256
+)
+
+// fanOutJob is a partition of the recipients of a message, delivered by a worker.
+type fanOutJob struct {
+	users []*User
+	line  []byte
+	done  *sync.WaitGroup
+}
+
+// fanOutPool is the pool of workers of a server delivering messages to many recipients
+// concurrently, started on the first such message and stopped when the server shuts down.
+type fanOutPool struct {
+	start sync.Once
+	stop  sync.Once
+	jobs  chan fanOutJob // Unbuffered, so that a job is only handed to an idle worker.
+	done  chan struct{}
+}
+
+// newFanOutPool returns a fan-out pool whose workers are not yet started.
+func newFanOutPool() *fanOutPool {
+	return &fanOutPool{
+		jobs: make(chan fanOutJob),
+		done: make(chan struct{}),
+	}
+}
+
+// deliver writes a copy of the rendered line to each of the users, partitioning them
+// between the fan-out workers if there are many. It returns once every user has been
+// written to, so that the messages sent to a channel are received in order. The users
+// are written to by the sender alone if the pool is nil.
+func (pool *fanOutPool) deliver(users []*User, line []byte) {
+	if pool == nil || len(users) < fanOutThreshold {
+		deliverTo(users, line)
+		return
+	}
+
+	pool.start.Do(func() {
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			go pool.work()
+		}
+	})
+
+	var done sync.WaitGroup
+	for start := 0; start < len(users); start += fanOutPartition {
+		partition := users[start:min(start+fanOutPartition, len(users))]
+		done.Add(1)
+		select {
+		case pool.jobs <- fanOutJob{users: partition, line: line, done: &done}:
+		default:
+			// No worker is idle, or the pool is stopped, so the sender delivers the
+			// partition itself.
+			deliverTo(partition, line)
+			done.Done()
+		}
+	}
+	done.Wait()
+}
+
+// work delivers the jobs handed to the worker until the pool is stopped.
+func (pool *fanOutPool) work() {
+	for {
+		select {
+		case <-pool.done:
+			return
+		case job := <-pool.jobs:
+			deliverTo(job.users, job.line)
+			job.done.Done()
+		}
+	}
+}
+
+// close stops the workers of the pool once they finish their current job, after which
+// every message is delivered by its sender.
+func (pool *fanOutPool) close() {
+	pool.stop.Do(func() {
+		close(pool.done)
+	})
+}
+
+// deliverTo writes a copy of the rendered line to each of the users in turn.
+func deliverTo(users []*User, line []byte) {
+	for _, user := range users {
+		buffer := bufPool.New()
+		buffer.Write(line)
+		user.Write(buffer)
+	}
+}
+
+// Broadcast sends a server NOTICE with the text to every connected user, or only to
+// operators, returning the number of users it was sent to. The sender is reported to
+// event subscribers as the actor.
+func (srv *Server) Broadcast(text string, opersOnly bool, sender string) int {
+	action := CmdGlobalNotice
+	if opersOnly {
+		action = CmdGlobops
+	}
+
+	sent := srv.noticeUsers(text, opersOnly)
+
+	srv.logger.WithField("operation", "broadcast").Infof("%s from [%s] sent to %d users: %s", action, sender, sent, text)
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  sender,
+		Action: action,
+		Text:   text,
+	})
+	return sent
+}
+
+// noticeUsers sends a server NOTICE with the text to every connected user, or only to
+// operators, returning the number of users it was sent to.
+func (srv *Server) noticeUsers(text string, opersOnly bool) int {
+	return srv.noticeMatching(text, func(user *User) bool {
+		return !opersOnly || user.IsOper()
+	})
+}
+
+// noticeMatching sends a server NOTICE with the text to every connected user matching
+// the filter, returning the number of users it was sent to.
+func (srv *Server) noticeMatching(text string, filter func(user *User) bool) int {
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = srv.Hostname()
+	msg.Command = CmdNotice
+	msg.Trailing = text
+
+	sent := 0
+	srv.Users.ForEach(func(_ string, user *User) error {
+		if user.conn == nil || !filter(user) {
+			return nil
+		}
+
+		msg.Params = []string{user.Nick()}
+		user.Write(msg.RenderBuffer())
+		sent++
+		return nil
+	})
+	return sent
+}
+
+// doBroadcast sends the operator's global notice, or GLOBOPS to operators only, if they
+// have not sent one too recently.
+func (conn *Conn) doBroadcast(command, text string) {
+	if wait := time.Until(conn.lastBroadcast.Add(broadcastInterval)); wait > 0 {
+		conn.ReplyServerNotice(fmt.Sprintf("Please wait %v before sending another %s", wait.Round(time.Second), command))
+		return
+	}
+	conn.lastBroadcast = time.Now()
+
+	if command == CmdGlobops {
+		conn.server.Broadcast(fmt.Sprintf("*** Global -- from %s: %s", conn.user.Nick(), text), true, conn.user.Hostmask())
+		return
+	}
+
+	sent := conn.server.Broadcast("[Global Notice] "+text, false, conn.user.Hostmask())
+	conn.ReplyServerNotice(fmt.Sprintf("Global notice sent to %d users", sent))
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSinkChannel returns a channel with the number of members, whose connections count
+// the messages written to them and discard them.
+func newSinkChannel(tb testing.TB, members int) (*Channel, *atomic.Int64) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(tb, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+
+	var received atomic.Int64
+	channel := srv.newChannel("#dircd", nil)
+	for i := 0; i < members; i++ {
+		conn := &Conn{server: srv, ctx: ctx, logger: srv.logger, listener: &listenerConfig{}}
+		conn.setState(StateConnected)
+		for lane := range conn.writeQueue {
+			conn.writeQueue[lane] = make(chan *bytes.Buffer, writeQueueLength)
+		}
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case buffer := <-conn.writeQueue[laneNormal]:
+					received.Add(1)
+					bufPool.Recycle(buffer)
+				}
+			}
+		}()
+
+		user := &User{nick: fmt.Sprintf("user%d", i), conn: conn}
+		conn.user = user
+		channel.Nicks.Set(user.nick, user)
+	}
+	channel.refreshMembers()
+	return channel, &received
+}
+
+func TestDeliverFanOut(t *testing.T) {
+	for _, members := range []int{10, fanOutThreshold, 3*fanOutPartition + fanOutThreshold + 1} {
+		channel, received := newSinkChannel(t, members)
+		msg := &Message{Source: "alice!alice@example.org", Command: CmdPrivMsg, Params: []string{"#dircd"}, Trailing: "hello"}
+
+		channel.Send(msg, "user0")
+		assert.Eventually(t, func() bool { return received.Load() == int64(members-1) }, time.Second, time.Millisecond)
+	}
+}
+
+func TestFanOutBusyWorkers(t *testing.T) {
+	members := fanOutThreshold + 1
+	channel, received := newSinkChannel(t, members)
+	pool := channel.fanOut
+	var recipients []*User
+	_ = channel.Nicks.ForEach(func(_ string, user *User) error {
+		recipients = append(recipients, user)
+		return nil
+	})
+	line := []byte("PRIVMSG #dircd :hello\r\n")
+
+	pool.deliver(recipients, line) // Starts the workers.
+	require.Eventually(t, func() bool { return received.Load() == int64(members) }, time.Second, time.Millisecond)
+
+	// Each worker is handed a user whose queue is never read, and is stuck writing to them.
+	ctx, cancel := context.WithCancel(context.Background())
+	stuck := &Conn{server: recipients[0].conn.server, ctx: ctx, logger: recipients[0].conn.logger, listener: &listenerConfig{}}
+	stuck.setState(StateConnected)
+	for lane := range stuck.writeQueue {
+		stuck.writeQueue[lane] = make(chan *bytes.Buffer)
+	}
+	stuckUser := &User{nick: "stuck", conn: stuck}
+	stuck.user = stuckUser
+
+	var busy sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		busy.Add(1)
+		pool.jobs <- fanOutJob{users: []*User{stuckUser}, line: line, done: &busy}
+	}
+
+	// With every worker busy, the sender delivers the message itself rather than waiting.
+	delivered := make(chan struct{})
+	go func() {
+		pool.deliver(recipients, line)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message waited for a busy worker")
+	}
+	assert.Eventually(t, func() bool { return received.Load() == int64(2*members) }, time.Second, time.Millisecond)
+
+	cancel()
+	busy.Wait()
+
+	// Once the pool is stopped, messages are still delivered, by their sender.
+	pool.close()
+	pool.deliver(recipients, line)
+	assert.Eventually(t, func() bool { return received.Load() == int64(3*members) }, time.Second, time.Millisecond)
+}
+
+func BenchmarkChannelSend(b *testing.B) {
+	msg := &Message{Source: "alice!alice@example.org", Command: CmdPrivMsg, Params: []string{"#dircd"}, Trailing: "hello"}
+	for _, members := range []int{1000, 10000} {
+		channel, _ := newSinkChannel(b, members)
+		var recipients []*User
+		_ = channel.Nicks.ForEach(func(_ string, user *User) error {
+			recipients = append(recipients, user)
+			return nil
+		})
+		line := []byte(msg.Render())
+
+		b.Run(fmt.Sprintf("sequential/%d", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				deliverTo(recipients, line)
+			}
+		})
+		b.Run(fmt.Sprintf("fan-out/%d", members), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				channel.fanOut.deliver(recipients, line)
+			}
+		})
+	}
+}
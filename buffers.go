@@ -0,0 +1,130 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BufferSizes are the sizes of the buffers of client connections, which are pooled and
+// reused by later connections once a connection closes.
+type BufferSizes struct {
+	Read  int // Initial size of the buffer lines are read into, grown for longer lines.
+	Write int // Size of the buffer messages are written through before the socket.
+}
+
+// DefaultBufferSizes returns the buffer sizes used unless configured with WithBufferSizes.
+func DefaultBufferSizes() BufferSizes {
+	return BufferSizes{Read: 4096, Write: 4096}
+}
+
+// validate checks both sizes are positive.
+func (b BufferSizes) validate() error {
+	var errs []error
+	if b.Read <= 0 {
+		errs = append(errs, fmt.Errorf("read buffer size must be positive, got %d", b.Read))
+	}
+	if b.Write <= 0 {
+		errs = append(errs, fmt.Errorf("write buffer size must be positive, got %d", b.Write))
+	}
+	return errors.Join(errs...)
+}
+
+// WithBufferSizes sets the sizes of the read and write buffers of client connections.
+// Larger write buffers let more queued messages be sent to a slow client in a single
+// write, as the buffer is only flushed once the write queue is empty or it is full.
+func WithBufferSizes(sizes BufferSizes) ServerOption {
+	return option(func(s *Server) error {
+		if err := sizes.validate(); err != nil {
+			return err
+		}
+		s.bufferSizes = &sizes
+		return nil
+	})
+}
+
+// BufferSizes returns the sizes of the buffers of client connections.
+func (srv *Server) BufferSizes() BufferSizes {
+	if srv.bufferSizes != nil {
+		return *srv.bufferSizes
+	}
+	return DefaultBufferSizes()
+}
+
+// connBuffers pools the read and write buffers of the connections of a server.
+type connBuffers struct {
+	sizes   BufferSizes
+	readers sync.Pool // *[]byte
+	writers sync.Pool // *bufio.Writer
+}
+
+// newConnBuffers returns the pools of buffers of the sizes.
+func newConnBuffers(sizes BufferSizes) *connBuffers {
+	buffers := &connBuffers{sizes: sizes}
+	buffers.readers.New = func() any {
+		buf := make([]byte, sizes.Read)
+		return &buf
+	}
+	buffers.writers.New = func() any {
+		return bufio.NewWriterSize(nil, sizes.Write)
+	}
+	return buffers
+}
+
+// readBuffer returns a read buffer from the pool.
+func (b *connBuffers) readBuffer() *[]byte {
+	return b.readers.Get().(*[]byte)
+}
+
+// scanner returns a scanner of lines from the reader, reading into the buffer.
+func (b *connBuffers) scanner(reader io.Reader, buf *[]byte) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(*buf, bufio.MaxScanTokenSize)
+	return scanner
+}
+
+// writer returns a writer from the pool, writing to the writer given.
+func (b *connBuffers) writer(writer io.Writer) *bufio.Writer {
+	buffered := b.writers.Get().(*bufio.Writer)
+	buffered.Reset(writer)
+	return buffered
+}
+
+// recycle returns the buffers to the pools, discarding anything left unwritten.
+func (b *connBuffers) recycle(readBuf *[]byte, writer *bufio.Writer) {
+	if readBuf != nil {
+		b.readers.Put(readBuf)
+	}
+	if writer != nil {
+		writer.Reset(nil)
+		b.writers.Put(writer)
+	}
+}
+
+// releaseBuffers returns the buffers of the connection to the pools of the server, once
+// its socket is closed. Anything written to the connection afterwards is dropped.
+func (conn *Conn) releaseBuffers() {
+	conn.sockMu.Lock()
+	defer conn.sockMu.Unlock()
+	conn.server.buffers.recycle(conn.readBuffer, conn.outgoing)
+	conn.readBuffer, conn.outgoing = nil, nil
+	conn.incoming = nil
+}
+
+// queued returns the number of messages waiting in the write queue of the connection.
+func (conn *Conn) queued() int {
+	var queued int
+	for _, lane := range conn.writeQueue {
+		queued += len(lane)
+	}
+	return queued
+}
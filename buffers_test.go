@@ -0,0 +1,69 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferSizes(t *testing.T) {
+	_, err := NewServer(WithBufferSizes(BufferSizes{Read: 0, Write: 1024}))
+	assert.Error(t, err)
+
+	sizes := BufferSizes{Read: 1024, Write: 16384}
+	srv, err := NewServer(WithHostname("irc.example.net"), WithBufferSizes(sizes))
+	require.NoError(t, err)
+	assert.Equal(t, sizes, srv.BufferSizes())
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	assert.Equal(t, 16384, conn.outgoing.Size())
+	assert.Len(t, *conn.readBuffer, 1024)
+
+	// Once the buffers are released, writes are dropped.
+	conn.releaseBuffers()
+	assert.Nil(t, conn.outgoing)
+	buffer := bufPool.New()
+	buffer.WriteString("PING :dircd\r\n")
+	conn.write(buffer)
+	assert.Zero(t, conn.sentMessages.Load())
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+
+	// Messages queued before the write loop runs are all sent, the last one flushing them.
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		msg := conn.newMessage()
+		msg.Command = CmdNotice
+		msg.Params = []string{nick}
+		msg.Trailing = "hello"
+		conn.WriteMessage(msg)
+	}
+	go conn.writeLoop()
+	t.Cleanup(func() { conn.cancel(nil) })
+
+	scanner := bufio.NewScanner(client)
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		require.True(t, scanner.Scan())
+		assert.Equal(t, ":irc.example.net NOTICE "+nick+" :hello", scanner.Text())
+	}
+}
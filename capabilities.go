@@ -7,31 +7,13 @@
 
 package dircd
 
-// TODO: bitmasks :)
-
-// Capabilities contains the information for CAP negotiation.
-type Capabilities struct {
-	AccountNotify   bool // Notifies clients when other clients in comon channels authenticate or deauthenticate (eg: NickServ, SASL).
-	AccountTag      bool // Attach a tag containing the user's account to every message they send.
-	AwayNotify      bool // Notifies clients when other clients in common channels go away or come back.
-	Batch           bool // Allow server to bundle common messages together.
-	CapNotify       bool // Notify when capabilties become available or are no longer available.
-	ChgHost         bool // Enable CHGHOST message, which lets servers notify clients when another cleint's username and/or hostname changes.
-	EchoMessage     bool // Notifies clients when their PRIVMSG and NOTICEs are correctly received by the server.
-	ExtendedJoin    bool // Extends the JOIN message to include the account name of the joining client.
-	InviteNotify    bool // Notifies clients when other clients are invited to common channels.
-	LabeledResponse bool // Allows clients to correlate requests with server responses.
-	MessageTags     bool // Allows Clients and servers to use tags more broadly.
-	Metadata        bool // Lets clients store metadata about themselves with the server, for other clients to request and retrieve later.
-	Monitor         bool // Lets users request notifications for qhen clients become online/offline.
-	MultiPrefix     bool // Makes the server send all prefixes in NAMES and WHO output, in order of rank from highest to lowest.
-	Multiline       bool // Allows clients and servers to use send messages that can exceed the usual byte length limit and that can contain line breaks.
-	SASL            bool // Indicates support for SASL authentication.
-	ServerTime      bool // Lets clients show the actual time messages were received by the server.
-	Setname         bool // Lets clients change their realname after connecting to the server.
-	TLS             bool // Indicates support for the STARTTLS command, which lets clients upgrade their connection to use TLS encryption.
-	UserhostInNames bool // Extends the NAMEREPLY message to contain the full nickmask (nick!user@host) of every user, rather than just the nickname.
-}
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
 
 // Capabilities bitmask flags for CAP negotiation.
 const (
@@ -55,6 +37,36 @@ const (
 	Setname                         // Lets clients change their realname after connecting to the server.
 	TLS                             // Indicates support for the STARTTLS command, which lets clients upgrade their connection to use TLS encryption.
 	UserhostInNames                 // Extends the NAMEREPLY message to contain the full nickmask (nick!user@host) of every user, rather than just the nickname.
+	ZNCPlayback                     // Lets bouncer clients request the history of always-on users from a timestamp with PRIVMSG *playback.
+	EventPlayback                   // Includes events such as JOIN and PART, besides messages, in history playback.
+)
+
+// CapSet is a set of capabilities, holding the bits of their flags, eg: those enabled
+// by a connection.
+type CapSet uint64
+
+// Has reports whether the set holds the capability with the given flag.
+func (set CapSet) Has(flag int) bool {
+	return uint64(set)&uint64(flag) == uint64(flag)
+}
+
+// With returns the set with the capability with the given flag added.
+func (set CapSet) With(flag int) CapSet {
+	return set | CapSet(flag)
+}
+
+// Without returns the set with the capability with the given flag removed.
+func (set CapSet) Without(flag int) CapSet {
+	return set &^ CapSet(flag)
+}
+
+// capNegotiation is the state of the capability negotiation of a connection.
+type capNegotiation uint8
+
+const (
+	capNotRequested capNegotiation = iota // The client has not started negotiating.
+	capNegotiating                        // Registration is held until the client sends CAP END.
+	capNegotiated                         // The client ended the negotiation.
 )
 
 // SASL Types
@@ -67,3 +79,202 @@ const (
 	SaslDigestMD5
 	SaslScramSHA1
 )
+
+// Capability describes a capability clients may request with CAP REQ.
+type Capability struct {
+	Name      string           // The name requested by clients, eg: "sasl".
+	Value     func() string    // Returns the value advertised in CAP LS 302, if not nil.
+	Requires  []string         // The capabilities which must be enabled for it to be.
+	OnEnable  func(conn *Conn) // Called when a client enables it, if not nil.
+	OnDisable func(conn *Conn) // Called when a client disables it, if not nil.
+
+	flag      int
+	available bool
+}
+
+// Flag returns the flag of the capability, to check for it with Conn.HasCap.
+func (capability *Capability) Flag() int {
+	return capability.flag
+}
+
+// advertised returns the capability as advertised in CAP LS, with its value if any.
+func (capability *Capability) advertised(withValue bool) string {
+	if withValue && capability.Value != nil {
+		if value := capability.Value(); len(value) > 0 {
+			return capability.Name + EQUAL + value
+		}
+	}
+	return capability.Name
+}
+
+// capRegistry holds the capabilities supported by the server, by name. Only those
+// available are advertised to and may be requested by clients.
+type capRegistry struct {
+	mu       sync.RWMutex
+	caps     map[string]*Capability
+	nextFlag int
+}
+
+// newCapRegistry returns a registry of the built-in capabilities, those of always-on
+// users available only if they are enabled.
+func newCapRegistry(srv *Server) *capRegistry {
+	registry := &capRegistry{caps: make(map[string]*Capability), nextFlag: EventPlayback << 1}
+	playback := srv.alwaysOnTimeout > 0
+	builtins := []struct {
+		capability Capability
+		flag       int
+		available  bool
+	}{
+		{Capability{Name: "batch"}, Batch, srv.quitThreshold > 0},
+		{Capability{Name: "cap-notify"}, CapNotify, true},
+		{Capability{Name: "echo-message"}, EchoMessage, true},
+		{Capability{Name: "sasl", Value: func() string { return strings.Join(srv.saslMechanisms(), ",") }}, SASL, true},
+		{Capability{Name: "znc.in/playback"}, ZNCPlayback, playback},
+		{Capability{Name: "draft/event-playback", Requires: []string{"znc.in/playback"}}, EventPlayback, playback},
+	}
+	for _, builtin := range builtins {
+		capability := builtin.capability
+		capability.flag = builtin.flag
+		capability.available = builtin.available
+		registry.caps[capability.Name] = &capability
+	}
+	return registry
+}
+
+// register adds the capability, available at once, returning its flag.
+func (registry *capRegistry) register(capability Capability) (int, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	capability.Name = strings.ToLower(capability.Name)
+	if len(capability.Name) == 0 || strings.ContainsAny(capability.Name, " =") {
+		return 0, fmt.Errorf("invalid capability name [%s]", capability.Name)
+	}
+	if _, exists := registry.caps[capability.Name]; exists {
+		return 0, fmt.Errorf("capability [%s] is already registered", capability.Name)
+	}
+	if registry.nextFlag == 0 {
+		return 0, errors.New("no capability flags left")
+	}
+
+	capability.flag = registry.nextFlag
+	capability.available = true
+	registry.nextFlag <<= 1
+	registry.caps[capability.Name] = &capability
+	return capability.flag, nil
+}
+
+// lookup returns the named capability if it is available.
+func (registry *capRegistry) lookup(name string) (*Capability, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	capability, exists := registry.caps[name]
+	if !exists || !capability.available {
+		return nil, false
+	}
+	return capability, true
+}
+
+// list returns the capabilities registered, only those available if availableOnly,
+// sorted by name.
+func (registry *capRegistry) list(availableOnly bool) []*Capability {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	caps := make([]*Capability, 0, len(registry.caps))
+	for _, capability := range registry.caps {
+		if capability.available || !availableOnly {
+			caps = append(caps, capability)
+		}
+	}
+	slices.SortFunc(caps, func(a, b *Capability) int { return strings.Compare(a.Name, b.Name) })
+	return caps
+}
+
+// setAvailable makes the named capability available or not, returning it and whether
+// that changed its availability.
+func (registry *capRegistry) setAvailable(name string, available bool) (*Capability, bool, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	capability, exists := registry.caps[name]
+	if !exists {
+		return nil, false, fmt.Errorf("capability [%s] is not registered", name)
+	}
+	changed := capability.available != available
+	capability.available = available
+	return capability, changed, nil
+}
+
+// SetCapabilityAvailable makes the named capability available to clients or not while
+// the server runs. Clients which enabled cap-notify are sent CAP NEW or CAP DEL, and the
+// capability is disabled for those which had enabled it when it becomes unavailable.
+func (srv *Server) SetCapabilityAvailable(name string, available bool) error {
+	capability, changed, err := srv.capabilities.setAvailable(strings.ToLower(name), available)
+	if err != nil || !changed {
+		return err
+	}
+
+	srv.Users.ForEach(func(_ string, user *User) error {
+		for _, conn := range user.Sessions() {
+			if !available && conn.HasCap(capability.flag) {
+				conn.applyCaps(conn.Caps().Without(capability.flag))
+			}
+			if !conn.HasCap(CapNotify) {
+				continue
+			}
+			if available {
+				conn.ReplyCap("NEW", capability.advertised(true))
+			} else {
+				conn.ReplyCap("DEL", capability.Name)
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// capabilityFlag returns the flag of the named capability, if available.
+func (srv *Server) capabilityFlag(name string) (int, bool) {
+	capability, exists := srv.capabilities.lookup(name)
+	if !exists {
+		return 0, false
+	}
+	return capability.flag, true
+}
+
+// capabilityValue returns the value advertised with the named capability in CAP LS 302, if any.
+func (srv *Server) capabilityValue(name string) string {
+	capability, exists := srv.capabilities.lookup(name)
+	if !exists || capability.Value == nil {
+		return ""
+	}
+	return capability.Value()
+}
+
+// requestCaps returns the capabilities enabled by the client with the changes of a CAP
+// REQ, eg: "echo-message -sasl", reporting false if any is not available or would be
+// enabled without the capabilities it requires.
+func (srv *Server) requestCaps(enabled CapSet, changes string) (CapSet, bool) {
+	for _, name := range strings.Fields(changes) {
+		capability, available := srv.capabilities.lookup(strings.ToLower(strings.TrimPrefix(name, "-")))
+		if !available {
+			return enabled, false
+		}
+		if strings.HasPrefix(name, "-") {
+			enabled = enabled.Without(capability.flag)
+		} else {
+			enabled = enabled.With(capability.flag)
+		}
+	}
+
+	for _, capability := range srv.capabilities.list(true) {
+		if !enabled.Has(capability.flag) {
+			continue
+		}
+		for _, required := range capability.Requires {
+			if flag, available := srv.capabilityFlag(required); !available || !enabled.Has(flag) {
+				return enabled, false
+			}
+		}
+	}
+	return enabled, true
+}
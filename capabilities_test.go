@@ -0,0 +1,104 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapSet(t *testing.T) {
+	var set CapSet
+	assert.False(t, set.Has(EchoMessage))
+
+	set = set.With(EchoMessage).With(SASL)
+	assert.True(t, set.Has(EchoMessage))
+	assert.True(t, set.Has(EchoMessage|SASL))
+	assert.False(t, set.Has(EchoMessage|ServerTime))
+
+	set = set.Without(EchoMessage)
+	assert.False(t, set.Has(EchoMessage))
+	assert.True(t, set.Has(SASL))
+}
+
+func TestCapNegotiation(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("CAP LS 302")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("CAP REQ :echo-message sasl")
+	expect(" CAP bob ACK :echo-message sasl")
+	assert.True(t, conn.HasCap(EchoMessage|SASL))
+	assert.Equal(t, capNegotiating, conn.capState)
+
+	// Requests are applied atomically.
+	route("CAP REQ :-sasl unknown")
+	expect(" CAP bob NAK :-sasl unknown")
+	assert.True(t, conn.HasCap(SASL))
+
+	route("CAP END")
+	expect(" 001 bob ")
+	assert.Equal(t, capNegotiated, conn.capState)
+}
+
+func TestCapRegistry(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithAlwaysOn(time.Hour, 10))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	var enabled, disabled int
+	flag, err := srv.capabilities.register(Capability{
+		Name:      "Example.org/Test",
+		Value:     func() string { return "v1" },
+		Requires:  []string{"echo-message"},
+		OnEnable:  func(*Conn) { enabled++ },
+		OnDisable: func(*Conn) { disabled++ },
+	})
+	require.NoError(t, err)
+	_, err = srv.capabilities.register(Capability{Name: "sasl"})
+	assert.Error(t, err)
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("CAP LS 302")
+	expect(" example.org/test=v1 ")
+	assert.True(t, conn.HasCap(CapNotify))
+
+	// Capabilities may not be enabled without those they require.
+	route("CAP REQ :example.org/test")
+	expect(" CAP * NAK :example.org/test")
+	route("CAP REQ :draft/event-playback")
+	expect(" CAP * NAK :draft/event-playback")
+	route("CAP REQ :echo-message example.org/test")
+	expect(" CAP * ACK :echo-message example.org/test")
+	assert.True(t, conn.HasCap(flag))
+	assert.Equal(t, 1, enabled)
+
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("CAP END")
+	expect(" 001 bob ")
+
+	// Capabilities toggled at runtime are announced with cap-notify.
+	require.NoError(t, srv.SetCapabilityAvailable("example.org/test", false))
+	expect(" CAP bob DEL :example.org/test")
+	assert.False(t, conn.HasCap(flag))
+	assert.Equal(t, 1, disabled)
+	route("CAP REQ :example.org/test")
+	expect(" CAP bob NAK :example.org/test")
+
+	require.NoError(t, srv.SetCapabilityAvailable("example.org/test", true))
+	expect(" CAP bob NEW :example.org/test=v1")
+	assert.Error(t, srv.SetCapabilityAvailable("unknown", true))
+}
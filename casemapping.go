@@ -0,0 +1,70 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Casemapping defines which characters of nicks and channel names are considered
+// equivalent, as advertised to clients in the CASEMAPPING ISUPPORT token.
+type Casemapping uint8
+
+// Casemappings
+const (
+	CasemapASCII   Casemapping = iota // A-Z are equivalent to a-z.
+	CasemapRFC1459                    // As ascii, and []\~ are equivalent to {}|^.
+)
+
+// rfc1459Folder folds the additional characters of the rfc1459 casemapping.
+var rfc1459Folder = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+
+// String returns the name of the casemapping advertised to clients.
+func (cm Casemapping) String() string {
+	switch cm {
+	case CasemapASCII:
+		return "ascii"
+	case CasemapRFC1459:
+		return "rfc1459"
+	}
+	return fmt.Sprintf("Casemapping(%d)", uint8(cm))
+}
+
+// Casefold returns the name folded to lower case by the casemapping, for comparing and
+// keying nicks and channel names.
+func Casefold(mapping Casemapping, name string) string {
+	folded := strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+
+	if mapping == CasemapRFC1459 {
+		folded = rfc1459Folder.Replace(folded)
+	}
+	return folded
+}
+
+// WithCasemapping sets the casemapping the server compares nicks and channel names by.
+// Defaults to ascii.
+func WithCasemapping(mapping Casemapping) ServerOption {
+	return option(func(s *Server) error {
+		if mapping > CasemapRFC1459 {
+			return fmt.Errorf("invalid casemapping %d", mapping)
+		}
+		s.casemapping = mapping
+		return nil
+	})
+}
+
+// Casefold returns the name folded by the casemapping of the server.
+func (srv *Server) Casefold(name string) string {
+	return Casefold(srv.casemapping, name)
+}
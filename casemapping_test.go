@@ -0,0 +1,55 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCasefold(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping Casemapping
+		input   string
+		folded  string
+	}{
+		{name: "ascii", mapping: CasemapASCII, input: "Nick[Away]", folded: "nick[away]"},
+		{name: "ascii non-ascii", mapping: CasemapASCII, input: "ÄNick", folded: "Änick"},
+		{name: "rfc1459", mapping: CasemapRFC1459, input: "Nick[Away]\\~", folded: "nick{away}|^"},
+		{name: "rfc1459 channel", mapping: CasemapRFC1459, input: "#Chan", folded: "#chan"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.folded, Casefold(test.mapping, test.input))
+		})
+	}
+}
+
+func TestCasefoldedMaps(t *testing.T) {
+	srv, err := NewServer(WithCasemapping(CasemapRFC1459))
+	assert.NoError(t, err)
+
+	user := &User{nick: "Nick[Away]"}
+	srv.Nicks.Set(user.nick, user)
+	found, exists := srv.Nicks.Get("NICK{away}")
+	assert.True(t, exists)
+	assert.Same(t, user, found)
+
+	assert.True(t, srv.Nicks.ChangeKey("nick[away]", "Nick{AWAY}"))
+	assert.True(t, srv.Nicks.ChangeKey("nick{away}", "Other"))
+	assert.False(t, srv.Nicks.Exists("Nick[Away]"))
+	assert.True(t, srv.Nicks.Exists("OTHER"))
+
+	channel := NewChannel("#Chan", user, srv.casemapping)
+	channel.Nicks.Set(user.nick, user)
+	assert.True(t, channel.Nicks.Exists("nick{away}"))
+	assert.Equal(t, []string{"~Nick[Away]"}, channel.GetNicks())
+}
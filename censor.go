@@ -0,0 +1,215 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultCensorReplacement replaces censored words without a replacement of their own.
+const defaultCensorReplacement = "<censored>"
+
+// CensorWord is a word censored in messages to or from censored users, and in censored
+// channels, matched case-insensitively as a whole word.
+type CensorWord struct {
+	Word        string
+	Replacement string // Replaces the word, or defaultCensorReplacement if empty.
+	Block       bool   // Blocks messages containing the word rather than replacing it.
+}
+
+// Censor holds the censored words, which may be changed at runtime. It is safe for
+// concurrent use.
+type Censor struct {
+	mu      sync.RWMutex
+	words   map[string]CensorWord
+	pattern *regexp.Regexp // Matches any of the words, nil without any.
+}
+
+func newCensor() *Censor {
+	return &Censor{words: make(map[string]CensorWord)}
+}
+
+// Set censors the word, replacing any existing entry for it.
+func (c *Censor) Set(word CensorWord) error {
+	if len(word.Word) == 0 || strings.ContainsAny(word.Word, " \r\n") {
+		return fmt.Errorf("invalid censored word [%s]", word.Word)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.words[strings.ToLower(word.Word)] = word
+	c.compile()
+	return nil
+}
+
+// Remove stops censoring the word, reporting whether it was censored.
+func (c *Censor) Remove(word string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.ToLower(word)
+	if _, exists := c.words[key]; !exists {
+		return false
+	}
+	delete(c.words, key)
+	c.compile()
+	return true
+}
+
+// Words returns the censored words sorted alphabetically.
+func (c *Censor) Words() []CensorWord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	words := make([]CensorWord, 0, len(c.words))
+	for _, word := range c.words {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return strings.ToLower(words[i].Word) < strings.ToLower(words[j].Word)
+	})
+	return words
+}
+
+// compile rebuilds the pattern matching the words, which the caller must hold the lock for.
+func (c *Censor) compile() {
+	if len(c.words) == 0 {
+		c.pattern = nil
+		return
+	}
+
+	quoted := make([]string, 0, len(c.words))
+	for key := range c.words {
+		quoted = append(quoted, regexp.QuoteMeta(key))
+	}
+	c.pattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// apply returns the text with the censored words replaced, reporting whether it must be
+// blocked instead.
+func (c *Censor) apply(text string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.pattern == nil {
+		return text, false
+	}
+
+	blocked := false
+	censored := c.pattern.ReplaceAllStringFunc(text, func(match string) string {
+		word := c.words[strings.ToLower(match)]
+		blocked = blocked || word.Block
+		if len(word.Replacement) > 0 {
+			return word.Replacement
+		}
+		return defaultCensorReplacement
+	})
+	return censored, blocked
+}
+
+// WithCensorWords sets the words censored in messages to or from censored users, and in
+// censored channels.
+func WithCensorWords(words ...CensorWord) ServerOption {
+	return option(func(s *Server) error {
+		for _, word := range words {
+			if err := s.censor.Set(word); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Censor returns the words censored by the server, which may be changed at runtime.
+func (srv *Server) Censor() *Censor {
+	return srv.censor
+}
+
+// checkCensor censors the text of a message from the user if they or the target user are
+// censored, or it is to a censored channel, reporting whether it must be dropped as it
+// contains a word which blocks it, in which case the user is notified unless it is a NOTICE.
+func (conn *Conn) checkCensor(msg *Message, targetUser *User, targetChannel *Channel) bool {
+	censored := conn.user.ModeIsSet(UModeCensored) ||
+		(targetUser != nil && targetUser.ModeIsSet(UModeCensored)) ||
+		(targetChannel != nil && targetChannel.ModeIsSet(CModeCensored))
+	if !censored {
+		return false
+	}
+
+	text, blocked := conn.server.censor.apply(msg.Trailing)
+	if !blocked {
+		msg.Trailing = text
+		return false
+	}
+
+	if msg.Command != CmdNotice {
+		conn.ReplyCannotSendToChan(msg.Params[0], "Message contains a censored word")
+	}
+	return true
+}
+
+// doCensor lists, adds, or removes censored words.
+func (conn *Conn) doCensor(subcommand string, params []string) {
+	censor := conn.server.censor
+
+	switch strings.ToUpper(subcommand) {
+	case "LIST":
+		words := censor.Words()
+		for _, word := range words {
+			switch {
+			case word.Block:
+				conn.ReplyServerNotice(fmt.Sprintf("%s: blocked", word.Word))
+			case len(word.Replacement) > 0:
+				conn.ReplyServerNotice(fmt.Sprintf("%s: replaced with %s", word.Word, word.Replacement))
+			default:
+				conn.ReplyServerNotice(fmt.Sprintf("%s: replaced with %s", word.Word, defaultCensorReplacement))
+			}
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("End of censored words (%d words)", len(words)))
+
+	case "ADD":
+		if len(params) < 1 {
+			conn.ReplyNeedMoreParams(CmdCensor)
+			return
+		}
+
+		word := CensorWord{Word: params[0]}
+		if len(params) > 1 {
+			if strings.EqualFold(params[1], "BLOCK") {
+				word.Block = true
+			} else {
+				word.Replacement = params[1]
+			}
+		}
+		if err := censor.Set(word); err != nil {
+			conn.ReplyServerNotice(err.Error())
+			return
+		}
+		conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdCensor + " ADD", Target: word.Word})
+		conn.ReplyServerNotice(fmt.Sprintf("Censored [%s]", word.Word))
+
+	case "DEL":
+		if len(params) < 1 {
+			conn.ReplyNeedMoreParams(CmdCensor)
+			return
+		}
+		if !censor.Remove(params[0]) {
+			conn.ReplyServerNotice(fmt.Sprintf("[%s] is not censored", params[0]))
+			return
+		}
+		conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdCensor + " DEL", Target: params[0]})
+		conn.ReplyServerNotice(fmt.Sprintf("Removed censored word [%s]", params[0]))
+
+	default:
+		conn.ReplyServerNotice("Unknown CENSOR subcommand, expected LIST, ADD, or DEL")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCensor(t *testing.T) {
+	srv, err := NewServer(WithCensorWords(
+		CensorWord{Word: "darn"},
+		CensorWord{Word: "heck", Replacement: "h*ck"},
+		CensorWord{Word: "spam", Block: true},
+	))
+	assert.NoError(t, err)
+	censor := srv.Censor()
+
+	tests := []struct {
+		name     string
+		text     string
+		censored string
+		blocked  bool
+	}{
+		{"no words", "hello there", "hello there", false},
+		{"default replacement", "oh DARN it", "oh <censored> it", false},
+		{"replacement", "what the heck, darn", "what the h*ck, <censored>", false},
+		{"whole words only", "darned hecking", "darned hecking", false},
+		{"blocked", "buy spam now", "buy <censored> now", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			censored, blocked := censor.apply(tt.text)
+			assert.Equal(t, tt.censored, censored)
+			assert.Equal(t, tt.blocked, blocked)
+		})
+	}
+
+	assert.True(t, censor.Remove("Darn"))
+	assert.False(t, censor.Remove("darn"))
+	censored, _ := censor.apply("darn")
+	assert.Equal(t, "darn", censored)
+	assert.Len(t, censor.Words(), 2)
+
+	assert.Error(t, censor.Set(CensorWord{Word: "two words"}))
+}
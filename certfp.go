@@ -0,0 +1,184 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tlsState returns the state of the TLS layer of the connection, unwrapping any
+// connection wrappers to find it, reporting whether there is one.
+func tlsState(sock net.Conn) (tls.ConnectionState, bool) {
+	for sock != nil {
+		switch wrapped := sock.(type) {
+		case *tls.Conn:
+			return wrapped.ConnectionState(), true
+		case interface{ NetConn() net.Conn }:
+			sock = wrapped.NetConn()
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
+// certFingerprint returns the hex encoded SHA-256 fingerprint of the client certificate
+// presented on the connection, unwrapping any connection wrappers to find the TLS layer.
+// An empty string is returned if the connection is not TLS or no certificate was presented.
+func certFingerprint(sock net.Conn) string {
+	state, _ := tlsState(sock)
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint lowercases a hex fingerprint and strips any colon separators,
+// returning ErrBadFingerprint if it is not a SHA-256 fingerprint.
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+		return "", ErrBadFingerprint
+	}
+	return fingerprint, nil
+}
+
+// CertFP returns the fingerprint of the TLS client certificate presented on the
+// connection in a concurrency-safe manner, or an empty string if none was presented.
+func (conn *Conn) CertFP() string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.certfp
+}
+
+func (conn *Conn) setCertFP(fingerprint string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.certfp = fingerprint
+	if fingerprint != "" {
+		conn.logger.Debugf("client certificate fingerprint: %s", fingerprint)
+	}
+}
+
+// setTLS records whether the connection is over TLS once its handshake is complete,
+// with the cipher negotiated and the fingerprint of any client certificate presented.
+func (conn *Conn) setTLS(sock net.Conn) {
+	state, secure := tlsState(sock)
+	conn.mu.Lock()
+	conn.secure = secure
+	if secure {
+		conn.cipher = tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+	}
+	conn.mu.Unlock()
+	conn.setCertFP(certFingerprint(sock))
+}
+
+// Secure reports whether the connection is over TLS in a concurrency-safe manner,
+// including connections to listeners configured with ListenerTLS.
+func (conn *Conn) Secure() bool {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.secure || conn.listener.tls
+}
+
+// Cipher returns the TLS version and cipher suite negotiated on the connection in a
+// concurrency-safe manner, or an empty string if it is not over TLS.
+func (conn *Conn) Cipher() string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.cipher
+}
+
+// doCertFP lists, links, or unlinks the certificate fingerprints of the account
+// the user is logged in to.
+func (conn *Conn) doCertFP(ctx context.Context, msg *Message) {
+	logger := conn.logger.WithField("operation", "certfp")
+
+	account := conn.user.Account()
+	if account == "" {
+		conn.ReplyServerNotice(ErrNotLoggedIn.String())
+		return
+	}
+
+	subcommand := "LIST"
+	if len(msg.Params) > 0 {
+		subcommand = strings.ToUpper(msg.Params[0])
+	}
+
+	switch subcommand {
+	case "LIST":
+		linked, err := conn.server.accounts.get(ctx, account)
+		if err != nil {
+			logger.Error(fmt.Errorf("error loading account [%s]: %w", account, err))
+			conn.ReplyServerNotice("Unable to load certificate fingerprints")
+			return
+		}
+
+		if current := conn.CertFP(); current != "" {
+			conn.ReplyServerNotice(fmt.Sprintf("Your current certificate fingerprint is %s", current))
+		}
+		for _, fingerprint := range linked.Fingerprints {
+			conn.ReplyServerNotice(fmt.Sprintf("Linked to %s: %s", linked.Name, fingerprint))
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("End of certificate fingerprints (%d linked)", len(linked.Fingerprints)))
+
+	case "ADD", "DEL":
+		if subcommand == "DEL" && !enoughParams(msg, 2) {
+			conn.ReplyNeedMoreParams(msg.Command)
+			return
+		}
+
+		// ADD defaults to the fingerprint of the certificate presented on this connection.
+		fingerprint := conn.CertFP()
+		if len(msg.Params) > 1 {
+			fingerprint = msg.Params[1]
+		}
+		if fingerprint == "" {
+			conn.ReplyServerNotice(ErrNoCertificate.String())
+			return
+		}
+
+		fingerprint, err := normalizeFingerprint(fingerprint)
+		if err != nil {
+			conn.ReplyServerNotice(ErrBadFingerprint.String())
+			return
+		}
+
+		if subcommand == "ADD" {
+			err = conn.server.accounts.addFingerprint(ctx, account, fingerprint)
+		} else {
+			err = conn.server.accounts.delFingerprint(ctx, account, fingerprint)
+		}
+
+		var reason Error
+		switch {
+		case err == nil:
+			if subcommand == "ADD" {
+				conn.ReplyServerNotice(fmt.Sprintf("Certificate fingerprint %s linked to %s", fingerprint, account))
+			} else {
+				conn.ReplyServerNotice(fmt.Sprintf("Certificate fingerprint %s unlinked from %s", fingerprint, account))
+			}
+		case errors.As(err, &reason):
+			conn.ReplyServerNotice(reason.String())
+		default:
+			logger.Error(fmt.Errorf("error updating certificate fingerprints for account [%s]: %w", account, err))
+			conn.ReplyServerNotice("Unable to update certificate fingerprints")
+		}
+
+	default:
+		conn.ReplyServerNotice("Usage: CERTFP [LIST | ADD [fingerprint] | DEL <fingerprint>]")
+	}
+}
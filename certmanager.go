@@ -0,0 +1,193 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certReloadInterval sets how often certificate files are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// certManager serves a TLS certificate loaded from disk via GetCertificate, and
+// reloads it whenever the certificate or key file is modified, so that renewed
+// certificates are picked up without restarting the server.
+type certManager struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertManager(certFile, keyFile string) (*certManager, error) {
+	cm := &certManager{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if _, err := cm.reload(); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// GetCertificate returns the currently loaded certificate, satisfying tls.Config.GetCertificate.
+func (cm *certManager) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.cert, nil
+}
+
+// reload loads the key pair from disk if either file has been modified since it was
+// last loaded, reporting whether a new certificate was loaded.
+func (cm *certManager) reload() (bool, error) {
+	certInfo, certErr := os.Stat(cm.certFile)
+	keyInfo, keyErr := os.Stat(cm.keyFile)
+	if err := errors.Join(certErr, keyErr); err != nil {
+		return false, fmt.Errorf("error checking TLS key pair: %w", err)
+	}
+
+	cm.mu.RLock()
+	unchanged := cm.cert != nil && certInfo.ModTime().Equal(cm.certMod) && keyInfo.ModTime().Equal(cm.keyMod)
+	cm.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cm.certFile, cm.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading TLS key pair: %w", err)
+	}
+
+	cm.mu.Lock()
+	cm.cert = &cert
+	cm.certMod = certInfo.ModTime()
+	cm.keyMod = keyInfo.ModTime()
+	cm.mu.Unlock()
+
+	return true, nil
+}
+
+// watch polls the certificate files for changes until the server shuts down.
+func (cm *certManager) watch(srv *Server) {
+	logger := srv.logger.WithField("sub-component", "certificates")
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if srv.shuttingDown() {
+			return
+		}
+
+		reloaded, err := cm.reload()
+		if err != nil {
+			// Keep serving the previous certificate, the files may be mid-rotation.
+			logger.Warn(fmt.Errorf("certificate reload failed, keeping current certificate: %w", err))
+			continue
+		}
+
+		if reloaded {
+			logger.Infof("reloaded TLS certificate from [%s]", cm.certFile)
+		}
+	}
+}
+
+// WithCertificateFiles sets the TLS certificate and key to be loaded from the given files,
+// which are watched and hot-reloaded whenever they change on disk.
+func WithCertificateFiles(certFile, keyFile string) ServerOption {
+	return option(func(s *Server) error {
+		cm, err := newCertManager(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		s.certManager = cm
+		return nil
+	})
+}
+
+// WithACME sets the TLS certificate for the server hostname to be obtained and renewed
+// automatically from Let's Encrypt, accepting its terms of service. Certificates are
+// cached in cacheDir, and email is used as the account contact.
+//
+// If challengeAddr is not empty, an HTTP listener is started on it (typically ":80")
+// to answer HTTP-01 challenges, otherwise the TLS-ALPN-01 challenge is used, which
+// requires a TLS listener reachable on port 443.
+func WithACME(cacheDir, email, challengeAddr string) ServerOption {
+	return option(func(s *Server) error {
+		manager := &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(cacheDir),
+			Email:  email,
+			HostPolicy: func(_ context.Context, host string) error {
+				if host != s.Hostname() {
+					return fmt.Errorf("acme: host [%s] is not the configured server hostname", host)
+				}
+				return nil
+			},
+		}
+
+		s.acmeManager = manager
+
+		if challengeAddr != "" {
+			s.acmeChallenge = &http.Server{
+				Addr:              challengeAddr,
+				Handler:           manager.HTTPHandler(nil),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+		}
+		return nil
+	})
+}
+
+// startCertificateManagement starts watching certificate files and serving ACME
+// challenges, as configured.
+func (srv *Server) startCertificateManagement() {
+	logger := srv.logger.WithField("sub-component", "certificates")
+
+	if srv.certManager != nil {
+		go srv.certManager.watch(srv)
+	}
+
+	if srv.acmeChallenge != nil {
+		challenge := srv.acmeChallenge
+		srv.registerOnShutdown(func() {
+			_ = challenge.Close()
+		})
+		go func() {
+			logger.Infof("serving ACME HTTP-01 challenges at [%s]", challenge.Addr)
+			if err := challenge.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error(fmt.Errorf("ACME challenge listener terminated: %w", err))
+			}
+		}()
+	}
+}
+
+// ReloadCertificates immediately reloads the TLS certificate files configured with
+// WithCertificateFiles, if they have changed.
+func (srv *Server) ReloadCertificates() error {
+	if srv.certManager == nil {
+		return nil
+	}
+	_, err := srv.certManager.reload()
+	return err
+}
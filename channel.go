@@ -11,60 +11,130 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btnmasher/dircd/shared/safemap"
+	"github.com/btnmasher/dircd/shared/stringutils"
 )
 
+// accountMaskPrefix prefixes the entries of the lists of a channel which match the account
+// a user is logged in to rather than their hostmask, eg: $a:alice.
+const accountMaskPrefix = "$a:"
+
+// channelPrefixes are the characters the names of channels begin with.
+const channelPrefixes = "#&"
+
+// isChannelName reports whether the name is that of a channel rather than a nick.
+func isChannelName(name string) bool {
+	return len(name) > 0 && strings.IndexByte(channelPrefixes, name[0]) >= 0
+}
+
 // Channel represents an IRC channel
 type Channel struct {
 	mu sync.RWMutex
 
-	name      string
-	topic     string
-	modes     uint64
-	createdAt time.Time
-
-	owner      *User
-	savedOwner string // Owner username
+	name        string
+	topic       string
+	topicSetter string    // Hostmask or nick of who set the topic.
+	topicSetAt  time.Time // When the topic was set.
+	key         string    // Key required to join, if set.
+	limit       int       // Number of members beyond which no more may join, if set.
+	invited     map[*User]struct{}
+	modes       uint64
+	createdAt   time.Time
+	casemapping Casemapping // Casemapping its members are keyed by.
+	clock       Clock       // Clock list entries are timed and expired with.
+	fanOut      *fanOutPool // Workers the messages sent to many members are delivered by.
+
+	// members is a snapshot of the members of the channel, replaced whenever they change
+	// but never modified, so that it may be iterated without holding any locks.
+	// membersMu serializes its replacement.
+	members   atomic.Pointer[[]channelMember]
+	membersMu sync.Mutex
 
 	// Active Lists
 	Nicks   UserMap
+	Owners  UserMap
+	Admins  UserMap
 	Ops     UserMap
 	HalfOps UserMap
 	Voiced  UserMap
 
 	// Persisted Lists
-	// map[hostPattern]setter
-	OpList     safemap.SafeMap[string, string]
-	HalfOpList safemap.SafeMap[string, string]
-	VoiceList  safemap.SafeMap[string, string]
-	BanList    safemap.SafeMap[string, string]
-	InviteList safemap.SafeMap[string, string]
+	// map[hostPattern]entry
+	OpList     safemap.SafeMap[string, ListEntry]
+	HalfOpList safemap.SafeMap[string, ListEntry]
+	VoiceList  safemap.SafeMap[string, ListEntry]
+	BanList    safemap.SafeMap[string, ListEntry]
+	ExceptList safemap.SafeMap[string, ListEntry]
+	InviteList safemap.SafeMap[string, ListEntry]
+}
+
+// ListEntry is an entry of a list of a channel, eg: a ban, keyed by its mask.
+type ListEntry struct {
+	Setter  string    // Hostmask or nick of who set the entry.
+	SetAt   time.Time // When the entry was set.
+	Expires time.Time // When the entry expires, or zero if it does not.
+}
+
+// channelMember is a member of a channel in a membership snapshot, with their nick as
+// folded by the casemapping of the channel.
+type channelMember struct {
+	key  string
+	user *User
 }
 
-type ChanMap safemap.SafeMap[string, *Channel]
+// expired reports whether the entry expired by now.
+func (entry ListEntry) expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
+
+// ChanMap is a concurrency safe map of channels.
+type ChanMap = safemap.SafeMap[string, *Channel]
 
-// NewChannel initializes a Channel with the given name and owner.
-func NewChannel(cname string, creator *User) *Channel {
+// NewChannel initializes a Channel with the given name and owner, if any, keying its
+// members by nick folded with the casemapping.
+func NewChannel(cname string, creator *User, casemapping Casemapping) *Channel {
+	fold := func(nick string) string { return Casefold(casemapping, nick) }
 	channel := &Channel{
-		name:       cname,
-		owner:      creator,
-		Nicks:      safemap.NewMutexMap[string, *User](),
-		Ops:        safemap.NewMutexMap[string, *User](),
-		HalfOps:    safemap.NewMutexMap[string, *User](),
-		Voiced:     safemap.NewMutexMap[string, *User](),
-		OpList:     safemap.NewMutexMap[string, string](),
-		HalfOpList: safemap.NewMutexMap[string, string](),
-		VoiceList:  safemap.NewMutexMap[string, string](),
-		BanList:    safemap.NewMutexMap[string, string](),
-		InviteList: safemap.NewMutexMap[string, string](),
+		name:        cname,
+		createdAt:   time.Now(),
+		casemapping: casemapping,
+		clock:       systemClock{},
+		Nicks:       safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		Owners:      safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		Admins:      safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		Ops:         safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		HalfOps:     safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		Voiced:      safemap.NewFoldedMap(safemap.NewMutexMap[string, *User](), fold),
+		OpList:      safemap.NewMutexMap[string, ListEntry](),
+		HalfOpList:  safemap.NewMutexMap[string, ListEntry](),
+		VoiceList:   safemap.NewMutexMap[string, ListEntry](),
+		BanList:     safemap.NewMutexMap[string, ListEntry](),
+		ExceptList:  safemap.NewMutexMap[string, ListEntry](),
+		InviteList:  safemap.NewMutexMap[string, ListEntry](),
+	}
+
+	if creator != nil {
+		channel.Owners.Set(creator.Nick(), creator)
 	}
 
 	return channel
 }
 
+// newChannel returns a new channel of the server with the given name and owner, if any,
+// keyed by its casemapping and timed by its clock.
+func (srv *Server) newChannel(name string, creator *User) *Channel {
+	channel := NewChannel(name, creator, srv.casemapping)
+	channel.clock = srv.clock
+	channel.fanOut = srv.fanOut
+	channel.createdAt = srv.clock.Now()
+	return channel
+}
+
 // Name returns the name of the channel in a currency safe manner
 func (channel *Channel) Name() string {
 	channel.mu.RLock()
@@ -73,6 +143,14 @@ func (channel *Channel) Name() string {
 	return channel.name
 }
 
+// CreatedAt returns the time the channel was created.
+func (channel *Channel) CreatedAt() time.Time {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
+	return channel.createdAt
+}
+
 // SetName sets the name of the channel in a currency safe manner
 func (channel *Channel) SetName(new string) {
 	channel.mu.Lock()
@@ -91,60 +169,229 @@ func (channel *Channel) Topic() string {
 
 // SetTopic sets the topic of the channel in a currency safe manner
 func (channel *Channel) SetTopic(new string) {
+	channel.SetTopicBy(new, "")
+}
+
+// SetTopicBy sets the topic of the channel, recording the hostmask or nick of the setter
+// and the time it was set.
+func (channel *Channel) SetTopicBy(new, setter string) {
 	channel.mu.Lock()
 	defer channel.mu.Unlock()
 
 	channel.topic = new
+	channel.topicSetter = setter
+	channel.topicSetAt = channel.clock.Now()
 }
 
-// Owner returns the owner of the channel in a currency safe manner
-func (channel *Channel) Owner() *User {
+// TopicSetBy returns who set the topic of the channel, and when.
+func (channel *Channel) TopicSetBy() (string, time.Time) {
 	channel.mu.RLock()
 	defer channel.mu.RUnlock()
 
-	return channel.owner
+	return channel.topicSetter, channel.topicSetAt
 }
 
-// SetOwner sets the owner of the channel in a currency safe manner
-func (channel *Channel) SetOwner(new *User) {
+// statusModes are the channel membership modes, from highest to lowest, and the
+// prefixes shown for them in NAMES replies.
+const (
+	statusModes    = "qaohv"
+	statusPrefixes = "~&@%+"
+)
+
+// statusList returns the members of the channel holding the membership mode, one of
+// statusModes, or nil for any other mode.
+func (channel *Channel) statusList(mode byte) UserMap {
+	switch mode {
+	case 'q':
+		return channel.Owners
+	case 'a':
+		return channel.Admins
+	case 'o':
+		return channel.Ops
+	case 'h':
+		return channel.HalfOps
+	case 'v':
+		return channel.Voiced
+	}
+	return nil
+}
+
+// statusPrefix returns the prefix of the highest membership mode the member of the channel
+// holds, or "" if they hold none.
+func (channel *Channel) statusPrefix(nick string) string {
+	for i := range statusModes {
+		if channel.statusList(statusModes[i]).Exists(nick) {
+			return statusPrefixes[i : i+1]
+		}
+	}
+	return ""
+}
+
+// ModeIsSet checks if a given channel mode is currently set in a concurrency-safe manner.
+func (channel *Channel) ModeIsSet(cmode uint64) bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.modes&cmode == cmode
+}
+
+// AddMode appends the specified mode flag to the channel in a concurrency-safe manner.
+func (channel *Channel) AddMode(cmode uint64) {
 	channel.mu.Lock()
 	defer channel.mu.Unlock()
+	channel.modes |= cmode
+}
 
-	channel.owner = new
-	channel.savedOwner = new.Name()
+// DelMode removes the specified mode flag from the channel in a concurrency-safe manner.
+func (channel *Channel) DelMode(cmode uint64) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.modes &^= cmode
 }
 
 // TODO: channel modes
 
 // Send takes a message, then iterates the list of Users joined to the channel stored
 // in the Nicks map, and sends the message to each of the User's underlying connection.
+// Users introduced by a services link are skipped, as the link relays channel activity
+// through the server event bus.
 func (channel *Channel) Send(msg *Message, exclude string) {
+	// TODO: Check if sender is allowed to send
+
 	channel.mu.RLock()
-	defer channel.mu.RUnlock()
+	channel.sanitize(msg)
+	channel.mu.RUnlock()
+
+	// The message is rendered once, each member being sent their own copy, as buffers
+	// are recycled once written.
+	buffer := msg.RenderBuffer()
+	defer bufPool.Recycle(buffer)
+
+	// The members are read from their snapshot, so that no lock is held while the
+	// message is queued to each of them.
+	exclude = Casefold(channel.casemapping, exclude)
+	members := channel.snapshot()
+	recipients := make([]*User, 0, len(members))
+	for _, member := range members {
+		if member.key != exclude && member.user.conn != nil {
+			recipients = append(recipients, member.user)
+		}
+	}
+	channel.fanOut.deliver(recipients, buffer.Bytes())
+}
 
-	// TODO: Check if sender is allowed to send
+// snapshot returns the current snapshot of the members of the channel, which must not
+// be modified.
+func (channel *Channel) snapshot() []channelMember {
+	if members := channel.members.Load(); members != nil {
+		return *members
+	}
+	return nil
+}
 
-	buf := msg.RenderBuffer()
+// refreshMembers replaces the snapshot of the members of the channel with a copy of its
+// current members, once they have changed.
+func (channel *Channel) refreshMembers() {
+	channel.membersMu.Lock()
+	defer channel.membersMu.Unlock()
 
-	_ = channel.Nicks.ForEach(func(nick string, user *User) error {
-		if nick != exclude {
-			user.conn.Write(buf)
-		}
+	members := make([]channelMember, 0, channel.Nicks.Length())
+	_ = channel.Nicks.ForEach(func(key string, user *User) error {
+		members = append(members, channelMember{key: key, user: user})
 		return nil
 	})
+	channel.members.Store(&members)
 }
 
-// Join adds the user to the channel and alerts all channel members of the event.
-func (channel *Channel) Join(user *User, msg *Message) bool {
-	channel.mu.RLock()
-	defer channel.mu.RUnlock()
+// Join adds the user to the channel, if they may join it with the key, and alerts all
+// channel members of the event. It returns ErrBannedFromChan, ErrInviteOnlyChan,
+// ErrBadChannelKey or ErrChannelIsFull if they may not.
+func (channel *Channel) Join(user *User, key string, msg *Message) error {
+	if err := channel.admit(user, key); err != nil {
+		return err
+	}
+	channel.join(user, msg)
+	return nil
+}
 
-	// TODO: Check if sender is allowed to send
+// join adds the user to the channel, whether or not they may join it, and alerts all
+// channel members of the event.
+func (channel *Channel) join(user *User, msg *Message) {
+	channel.mu.Lock()
+	delete(channel.invited, user)
+	channel.mu.Unlock()
 
 	channel.Nicks.Set(user.Nick(), user)
+	channel.refreshMembers()
+	user.addChannel(channel)
 	channel.Send(msg, "")
+}
+
+// admit returns why the user may not join the channel with the key, or nil if they may.
+// Users banned by the ban list may not join, unless an entry of the exception list matches
+// them. Users invited to the channel may join it regardless of its invite-only mode, key
+// and limit, and others matching the invite list regardless of its invite-only mode.
+func (channel *Channel) admit(user *User, key string) error {
+	channel.mu.RLock()
+	_, invited := channel.invited[user]
+	inviteOnly := channel.modes&CModeInviteOnly != 0
+	channelKey, limit := channel.key, channel.limit
+	channel.mu.RUnlock()
+
+	switch {
+	case channel.listMatches(channel.BanList, user) && !channel.listMatches(channel.ExceptList, user):
+		return ErrBannedFromChan
+	case invited:
+		return nil
+	case inviteOnly && !channel.listMatches(channel.InviteList, user):
+		return ErrInviteOnlyChan
+	case len(channelKey) > 0 && key != channelKey:
+		return ErrBadChannelKey
+	case limit > 0 && channel.Nicks.Length() >= limit:
+		return ErrChannelIsFull
+	}
+	return nil
+}
+
+// Invite lets the user join the channel once, regardless of its invite-only mode, key and
+// limit.
+func (channel *Channel) Invite(user *User) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.invited == nil {
+		channel.invited = make(map[*User]struct{})
+	}
+	channel.invited[user] = struct{}{}
+}
+
+// Key returns the key required to join the channel, or "" if none is.
+func (channel *Channel) Key() string {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.key
+}
+
+// SetKey sets the key required to join the channel, or removes it if empty.
+func (channel *Channel) SetKey(key string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.key = key
+}
 
-	return true
+// Limit returns the number of members beyond which no more may join the channel, or
+// zero if it is unlimited.
+func (channel *Channel) Limit() int {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.limit
+}
+
+// SetLimit sets the number of members beyond which no more may join the channel, or
+// removes the limit if zero.
+func (channel *Channel) SetLimit(limit int) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.limit = limit
 }
 
 // RemoveUser removes the user from the channel and alerts all channel members of the event.
@@ -153,42 +400,199 @@ func (channel *Channel) RemoveUser(nick string, msg *Message) error {
 		return fmt.Errorf("nick [%s] not present in channel [%s]", nick, channel.Name())
 	}
 	channel.Send(msg, nick)
+	return channel.removeMember(nick)
+}
+
+// removeMember removes the user from the channel without alerting the channel members,
+// for departures announced to each user sharing a channel with them only once, such as QUIT.
+func (channel *Channel) removeMember(nick string) error {
+	user, exists := channel.Nicks.Get(nick)
+	if !exists {
+		return fmt.Errorf("nick [%s] not present in channel [%s]", nick, channel.Name())
+	}
+	user.removeChannel(channel)
 	channel.Nicks.Delete(nick)
-	channel.Ops.Delete(nick)
-	channel.HalfOps.Delete(nick)
-	channel.Voiced.Delete(nick)
+	channel.refreshMembers()
+	for i := range statusModes {
+		channel.statusList(statusModes[i]).Delete(nick)
+	}
 	return nil
 }
 
-func (channel *Channel) ChangeNick(oldNick, newNick string, msg *Message) error {
+// ChangeNick rekeys the member of the channel by their new nick. The channel members are
+// not alerted, as the NICK is sent only once to each user sharing a channel with them.
+func (channel *Channel) ChangeNick(oldNick, newNick string) error {
 	if !channel.Nicks.ChangeKey(oldNick, newNick) {
 		return errors.New("nickname not present in channel")
 	}
-	channel.Ops.ChangeKey(oldNick, newNick)
-	channel.HalfOps.ChangeKey(oldNick, newNick)
-	channel.Voiced.ChangeKey(oldNick, newNick)
-	channel.Send(msg, newNick)
+	channel.refreshMembers()
+	for i := range statusModes {
+		channel.statusList(statusModes[i]).ChangeKey(oldNick, newNick)
+	}
 
 	return nil
 }
 
+// matchesEntry reports whether the entry of a list of the channel matches the user, by
+// their visible or real hostmask, or by their account for $a:<account> entries.
+func matchesEntry(entry string, user *User) bool {
+	if account, isAccount := strings.CutPrefix(entry, accountMaskPrefix); isAccount {
+		return len(user.Account()) > 0 && strings.EqualFold(account, user.Account())
+	}
+	return stringutils.MatchMask(entry, user.Hostmask()) || stringutils.MatchMask(entry, user.RealHostmask())
+}
+
+// listStatus returns the status mode the first of the op, halfop and voice lists of the
+// channel with an entry matching the user grants them, eg: "+o", or "" if none does.
+func (channel *Channel) listStatus(user *User) string {
+	lists := []struct {
+		list safemap.SafeMap[string, ListEntry]
+		mode string
+	}{{channel.OpList, "+o"}, {channel.HalfOpList, "+h"}, {channel.VoiceList, "+v"}}
+
+	for _, status := range lists {
+		if channel.listMatches(status.list, user) {
+			return status.mode
+		}
+	}
+	return ""
+}
+
+// listMatches reports whether an entry of the list of the channel matches the user.
+func (channel *Channel) listMatches(list safemap.SafeMap[string, ListEntry], user *User) bool {
+	matched := false
+	now := channel.clock.Now()
+	_ = list.ForEach(func(mask string, entry ListEntry) error {
+		matched = matched || (!entry.expired(now) && matchesEntry(mask, user))
+		return nil
+	})
+	return matched
+}
+
+// modeList returns the list of the channel set with the list mode, eg: 'b' for the ban
+// list, or nil if the mode is not that of a list.
+func (channel *Channel) modeList(mode byte) safemap.SafeMap[string, ListEntry] {
+	switch mode {
+	case 'b':
+		return channel.BanList
+	case 'e':
+		return channel.ExceptList
+	case 'I':
+		return channel.InviteList
+	}
+	return nil
+}
+
+// addListEntry adds the mask to the list of the channel set with the list mode, set by
+// the setter, expiring after the duration if not zero, reporting whether it was not
+// already on it. It returns ErrChanListFull if the list holds max entries.
+func (channel *Channel) addListEntry(mode byte, mask, setter string, duration time.Duration, max int) (bool, error) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	list := channel.modeList(mode)
+	if list.Exists(mask) {
+		return false, nil
+	}
+	if list.Length() >= max {
+		return false, ErrChanListFull
+	}
+	entry := ListEntry{Setter: setter, SetAt: channel.clock.Now().UTC()}
+	if duration > 0 {
+		entry.Expires = entry.SetAt.Add(duration)
+	}
+	list.Set(mask, entry)
+	return true, nil
+}
+
+// expireListEntries removes the entries of the ban, exception and invite lists of the
+// channel which expired by now, announcing their removal from the source in MODE
+// messages of up to max changes each.
+func (channel *Channel) expireListEntries(source string, now time.Time, max int) {
+	var modes []byte
+	var masks []string
+
+	channel.mu.Lock()
+	for _, mode := range []byte("beI") {
+		list := channel.modeList(mode)
+		var expired []string
+		_ = list.ForEach(func(mask string, entry ListEntry) error {
+			if entry.expired(now) {
+				expired = append(expired, mask)
+			}
+			return nil
+		})
+		for _, mask := range expired {
+			list.Delete(mask)
+			modes = append(modes, mode)
+			masks = append(masks, mask)
+		}
+	}
+	channel.mu.Unlock()
+
+	for start := 0; start < len(modes); start += max {
+		end := min(start+max, len(modes))
+		msg := msgPool.New()
+		generation := msg.Generation()
+		msg.Source = source
+		msg.Command = CmdMode
+		msg.Params = append([]string{channel.Name(), "-" + string(modes[start:end])}, masks[start:end]...)
+		channel.Send(msg, "")
+		msgPool.Recycle(msg, generation)
+	}
+}
+
+// checkSend returns why the user may not send messages to the channel, or nil if they
+// may. Users banned from the channel may not, unless excepted or given a status on it.
+func (channel *Channel) checkSend(user *User) error {
+	if len(channel.statusPrefix(user.Nick())) > 0 {
+		return nil
+	}
+	if channel.listMatches(channel.BanList, user) && !channel.listMatches(channel.ExceptList, user) {
+		return ErrCannotSendBanned
+	}
+	return nil
+}
+
+// applyAccessLists grants the member joining the channel the status the op, halfop and
+// voice lists of the channel give them, announcing it from the source.
+func (channel *Channel) applyAccessLists(source string, user *User) {
+	if mode := channel.listStatus(user); len(mode) > 0 {
+		channel.setStatus(source, user, mode)
+	}
+}
+
+// setStatus sets or unsets the status of the member by the mode, eg: +o or -v, one of
+// the statusModes, announcing the change to the channel from the source. Nothing is
+// announced if the member already has, or has not, the status.
+func (channel *Channel) setStatus(source string, user *User, mode string) {
+	nick := user.Nick()
+	status := channel.statusList(mode[1])
+	if (mode[0] == '+') == status.Exists(nick) {
+		return
+	}
+	if mode[0] == '+' {
+		status.Set(nick, user)
+	} else {
+		status.Delete(nick)
+	}
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = source
+	msg.Command = CmdMode
+	msg.Params = []string{channel.Name(), mode, nick}
+	channel.Send(msg, "")
+}
+
 // GetNicks returns an array of the current nicknames of the users in the channel.
 func (channel *Channel) GetNicks() []string {
 	var buffer bytes.Buffer
 	nicks := make([]string, 0, channel.Nicks.Length())
 
-	channel.Nicks.ForEach(func(nick string, user *User) error {
-		switch {
-		case channel.owner.Nick() == nick:
-			buffer.WriteRune('~')
-		case channel.Ops.Exists(nick):
-			buffer.WriteRune('@')
-		case channel.HalfOps.Exists(nick):
-			buffer.WriteRune('%')
-		case channel.Voiced.Exists(nick):
-			buffer.WriteRune('+')
-		}
-
+	channel.Nicks.ForEach(func(_ string, user *User) error {
+		nick := user.Nick()
+		buffer.WriteString(channel.statusPrefix(nick))
 		buffer.WriteString(nick)
 
 		nicks = append(nicks, buffer.String())
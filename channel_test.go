@@ -0,0 +1,213 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelListStatus(t *testing.T) {
+	channel := NewChannel("#dircd", nil, CasemapRFC1459)
+	alice := &User{nick: "alice", name: "alice", host: "example.org", account: "alice"}
+	bob := &User{nick: "bob", name: "bob", host: "bob.example.net"}
+
+	assert.Empty(t, channel.listStatus(alice))
+
+	channel.VoiceList.Set("*!*@*.example.net", ListEntry{Setter: "op"})
+	channel.OpList.Set("$a:ALICE", ListEntry{Setter: "op"})
+	assert.Equal(t, "+o", channel.listStatus(alice))
+	assert.Equal(t, "+v", channel.listStatus(bob))
+
+	// The op list is preferred to the others.
+	channel.OpList.Set("bob!*@*", ListEntry{Setter: "op"})
+	assert.Equal(t, "+o", channel.listStatus(bob))
+
+	bob.account = ""
+	channel.OpList.Delete("bob!*@*")
+	channel.HalfOpList.Set("$a:bob", ListEntry{Setter: "op"})
+	assert.Equal(t, "+v", channel.listStatus(bob))
+}
+
+func TestChannelAccessListsOnJoin(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	channel.OpList.Set("$a:alice", ListEntry{Setter: "bob"})
+
+	alice, routeAlice, expectAlice := connectClient(t, srv, "alice")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(":irc.example.net MODE #dircd +o alice")
+	expectBob(":irc.example.net MODE #dircd +o alice")
+	assert.True(t, isChanOp(channel, alice.user))
+}
+
+func TestJoinChannelState(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 324 bob #dircd :+")
+	expectBob(" 329 bob #dircd :")
+	expectBob(" 366 bob #dircd ")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	channel.SetTopicBy("Welcome", "bob!bob@example.org")
+	channel.AddMode(CModeNoCTCP | CModeNoColors)
+	_, setAt := channel.TopicSetBy()
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 332 alice #dircd :Welcome")
+	expectAlice(fmt.Sprintf(" 333 alice #dircd bob!bob@example.org :%d", setAt.Unix()))
+	expectAlice(" 324 alice #dircd :+Cc")
+	expectAlice(fmt.Sprintf(" 329 alice #dircd :%d", channel.CreatedAt().Unix()))
+	expectAlice(" 353 alice = #dircd :")
+}
+
+func TestChannelAdmit(t *testing.T) {
+	channel := NewChannel("#dircd", nil, CasemapRFC1459)
+	alice := &User{nick: "alice", name: "alice", host: "example.org", account: "alice"}
+	bob := &User{nick: "bob", name: "bob", host: "bob.example.net"}
+	assert.NoError(t, channel.admit(alice, ""))
+
+	channel.BanList.Set("*!*@*.example.net", ListEntry{Setter: "op"})
+	assert.ErrorIs(t, channel.admit(bob, ""), ErrBannedFromChan)
+	channel.ExceptList.Set("bob!*@*", ListEntry{Setter: "op"})
+	assert.NoError(t, channel.admit(bob, ""))
+
+	channel.AddMode(CModeInviteOnly)
+	assert.ErrorIs(t, channel.admit(bob, ""), ErrInviteOnlyChan)
+	channel.InviteList.Set("bob!*@*", ListEntry{Setter: "op"})
+	assert.ErrorIs(t, channel.admit(alice, ""), ErrInviteOnlyChan)
+	assert.NoError(t, channel.admit(bob, ""))
+
+	channel.SetKey("secret")
+	assert.ErrorIs(t, channel.admit(bob, "wrong"), ErrBadChannelKey)
+	assert.NoError(t, channel.admit(bob, "secret"))
+
+	channel.SetLimit(1)
+	channel.Nicks.Set("carol", &User{nick: "carol"})
+	assert.ErrorIs(t, channel.admit(bob, "secret"), ErrChannelIsFull)
+
+	// Invited users may join regardless of the modes, key and limit, once.
+	channel.Invite(alice)
+	assert.NoError(t, channel.admit(alice, ""))
+	channel.join(alice, &Message{Command: CmdJoin, Params: []string{"#dircd"}})
+	assert.ErrorIs(t, channel.admit(alice, ""), ErrInviteOnlyChan)
+}
+
+func TestJoinRejected(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	channel.SetKey("secret")
+
+	alice, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 475 alice #dircd :" + ErrBadChannelKey.String())
+	assert.False(t, channel.Nicks.Exists("alice"))
+
+	routeAlice("JOIN #dircd secret")
+	expectAlice(" 324 alice #dircd +k :secret")
+	assert.Len(t, alice.user.Channels(), 1)
+}
+
+func TestChannelStatusPrefixes(t *testing.T) {
+	alice := &User{nick: "alice"}
+	bob := &User{nick: "bob"}
+	carol := &User{nick: "carol"}
+	channel := NewChannel("#dircd", alice, CasemapRFC1459)
+	for _, user := range []*User{alice, bob, carol} {
+		channel.Nicks.Set(user.nick, user)
+	}
+	channel.Owners.Set("bob", bob)
+	channel.Admins.Set("bob", bob)
+	channel.Admins.Set("carol", carol)
+
+	assert.ElementsMatch(t, []string{"~alice", "~bob", "&carol"}, channel.GetNicks())
+
+	// Owners leaving are no longer tracked.
+	require.NoError(t, channel.removeMember("alice"))
+	assert.False(t, channel.Owners.Exists("alice"))
+	assert.ElementsMatch(t, []string{"~bob", "&carol"}, channel.GetNicks())
+
+	require.NoError(t, channel.ChangeNick("bob", "robert"))
+	bob.nick = "robert"
+	assert.Equal(t, "~", channel.statusPrefix("robert"))
+}
+
+func TestChannelListExpiry(t *testing.T) {
+	channel := NewChannel("#dircd", nil, CasemapRFC1459)
+	bob := &User{nick: "bob", name: "bob", host: "bob.example.net"}
+
+	added, err := channel.addListEntry('b', "*!*@*.example.net", "op", time.Minute, 10)
+	require.NoError(t, err)
+	require.True(t, added)
+	channel.BanList.Set("bob!*@*", ListEntry{Setter: "op", Expires: time.Now().Add(-time.Second)})
+	assert.True(t, channel.listMatches(channel.BanList, bob))
+
+	// Expired entries no longer match, even before they are removed.
+	channel.BanList.Delete("*!*@*.example.net")
+	assert.False(t, channel.listMatches(channel.BanList, bob))
+
+	channel.expireListEntries("irc.example.net", time.Now(), 6)
+	assert.Zero(t, channel.BanList.Length())
+}
+
+func TestChannelMemberSnapshot(t *testing.T) {
+	channel := NewChannel("#dircd", nil, CasemapRFC1459)
+	alice := &User{nick: "Alice"}
+	bob := &User{nick: "bob"}
+	channel.join(alice, &Message{Command: CmdJoin, Params: []string{"#dircd"}})
+	channel.join(bob, &Message{Command: CmdJoin, Params: []string{"#dircd"}})
+
+	before := channel.snapshot()
+	assert.ElementsMatch(t, []channelMember{{key: "alice", user: alice}, {key: "bob", user: bob}}, before)
+
+	// Changes replace the snapshot, leaving those being iterated untouched.
+	require.NoError(t, channel.ChangeNick("bob", "Robert"))
+	assert.Equal(t, []*User{alice}, bob.Audience())
+	require.NoError(t, channel.removeMember("alice"))
+	assert.Equal(t, []channelMember{{key: "robert", user: bob}}, channel.snapshot())
+	assert.Len(t, before, 2)
+	assert.Empty(t, bob.Audience())
+}
@@ -6,3 +6,434 @@
 */
 
 package dircd
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// Chanmode Bitmasks
+const (
+	CModeNoColors     uint64 = 1 << iota // c: Colors are stripped from messages to the channel.
+	CModeNoFormatting                    // S: All formatting is stripped from messages to the channel.
+	CModeNoCTCP                          // C: CTCP messages other than ACTION are blocked.
+	CModeCensored                        // G: Censored words are replaced in messages to the channel.
+	CModeInviteOnly                      // i: Only invited users, or those on the invite list, may join the channel.
+)
+
+// chanModeLetters are the letters of the built-in channel modes.
+var chanModeLetters = map[byte]uint64{
+	'c': CModeNoColors,
+	'S': CModeNoFormatting,
+	'C': CModeNoCTCP,
+	'G': CModeCensored,
+	'i': CModeInviteOnly,
+}
+
+// channelModes returns the modes set on the channel, eg: "+CSkl", including those
+// registered by modules, or "+" if none are, followed by the key and limit if set.
+func (srv *Server) channelModes(channel *Channel) []string {
+	letters := make([]byte, 0, len(chanModeLetters))
+	for _, modes := range []map[byte]uint64{chanModeLetters, srv.modules.channelModes} {
+		for letter, flag := range modes {
+			if channel.ModeIsSet(flag) {
+				letters = append(letters, letter)
+			}
+		}
+	}
+	slices.Sort(letters)
+
+	var params []string
+	if key := channel.Key(); len(key) > 0 {
+		letters = append(letters, 'k')
+		params = append(params, key)
+	}
+	if limit := channel.Limit(); limit > 0 {
+		letters = append(letters, 'l')
+		params = append(params, strconv.Itoa(limit))
+	}
+	return append([]string{"+" + string(letters)}, params...)
+}
+
+// listNumerics are the numerics of the entries and end of each channel list, by the
+// letter of its mode, and the name of the list.
+var listNumerics = map[byte]struct {
+	entry, end uint16
+	name       string
+}{
+	'b': {ReplyBanList, ReplyEndOfBanList, "ban"},
+	'e': {ReplyExceptList, ReplyEndOfExceptList, "exception"},
+	'I': {ReplyInviteList, ReplyEndOfInviteList, "invite"},
+}
+
+// HandleMode processes a MODE command originated from the client.
+//
+// Given the nick of the user, their own modes are returned, or changed with doUserMode.
+// Without modes, the modes of the channel are returned. List modes given without a
+// mask return the entries of the list instead of changing it, with who set each and
+// when. Changes are only made by channel operators, and only the owners of the channel
+// may give or take owner and admin status. Each list holds up to the ListItems limit,
+// and entries given as "~t:<seconds>:<mask>" expire after the seconds.
+func HandleMode(ctx *MessageContext) {
+	ctx.Handled()
+	conn := ctx.Conn
+	srv := conn.server
+	target := ctx.Msg.Params[0]
+
+	args := ctx.Msg.Params[1:]
+	if !ctx.Msg.trailingImplied && len(ctx.Msg.Trailing) > 0 {
+		args = append(args, ctx.Msg.Trailing)
+	}
+
+	if !isChannelName(target) {
+		if srv.Casefold(target) != srv.Casefold(conn.user.Nick()) {
+			conn.ReplyNumeric(ReplyUsersDontMatch)
+			return
+		}
+		if len(args) == 0 {
+			conn.ReplyNumeric(ReplyUserModeIs, srv.userModeString(conn.user))
+			return
+		}
+		conn.doUserMode(args[0])
+		return
+	}
+
+	channel, exists := srv.Channels.Get(target)
+	if !exists {
+		conn.ReplyNoSuchChan(target)
+		return
+	}
+
+	if len(args) == 0 {
+		conn.ReplyChannelModes(channel)
+		conn.ReplyCreationTime(channel)
+		return
+	}
+	conn.doChannelMode(channel, args[0], args[1:])
+}
+
+// doChannelMode applies the mode changes of the user to the channel, with the params
+// of those which take one, announcing those made to the channel in a single MODE.
+func (conn *Conn) doChannelMode(channel *Channel, modes string, params []string) {
+	srv := conn.server
+	limits := srv.Limits()
+	nick := conn.user.Nick()
+	op := isChanOp(channel, conn.user)
+	owner := channel.Owners.Exists(nick)
+
+	var changes strings.Builder
+	var changed []string
+	sign, lastSign := byte('+'), byte(0)
+	change := func(letter byte, param ...string) {
+		if sign != lastSign {
+			changes.WriteByte(sign)
+			lastSign = sign
+		}
+		changes.WriteByte(letter)
+		changed = append(changed, param...)
+	}
+
+	// Modes taking a parameter are limited to the ModeChange limit per command.
+	taken := 0
+	param := func() (string, bool) {
+		if len(params) == 0 || taken >= limits.ModeChange {
+			return "", false
+		}
+		taken++
+		next := params[0]
+		params = params[1:]
+		return next, len(next) > 0
+	}
+
+	denied := false
+	deny := func() {
+		if !denied {
+			conn.ReplyNumeric(ReplyChanOpPrivsNeeded, channel.Name())
+			denied = true
+		}
+	}
+
+	for i := 0; i < len(modes); i++ {
+		letter := modes[i]
+		adding := sign == '+'
+
+		switch {
+		case letter == '+' || letter == '-':
+			sign = letter
+
+		case channel.modeList(letter) != nil:
+			if len(params) == 0 {
+				if letter != 'b' && !op {
+					deny()
+					continue
+				}
+				conn.replyModeList(channel, letter)
+				continue
+			}
+			mask, ok := param()
+			if !ok {
+				continue
+			}
+			if !op {
+				deny()
+				continue
+			}
+			mask, duration, ok := cutTimedMask(mask)
+			if !ok {
+				continue
+			}
+			mask = canonicalMask(mask)
+			if !adding {
+				if list := channel.modeList(letter); list.Exists(mask) {
+					list.Delete(mask)
+					change(letter, mask)
+				}
+				continue
+			}
+			added, err := channel.addListEntry(letter, mask, conn.user.Hostmask(), duration, limits.ListItems)
+			if err != nil {
+				conn.ReplyNumeric(ReplyBanListFUll, channel.Name(), string(letter), err.Error())
+				continue
+			}
+			if added {
+				change(letter, mask)
+			}
+
+		case strings.IndexByte(statusModes, letter) >= 0:
+			target, ok := param()
+			if !ok {
+				continue
+			}
+			if !op || (strings.IndexByte("qa", letter) >= 0 && !owner) {
+				deny()
+				continue
+			}
+			user, member := channel.Nicks.Get(target)
+			if !member {
+				conn.ReplyNumeric(ReplyUserNotInChannel, target, channel.Name())
+				continue
+			}
+			status := channel.statusList(letter)
+			if adding == status.Exists(user.Nick()) {
+				continue
+			}
+			if adding {
+				status.Set(user.Nick(), user)
+			} else {
+				status.Delete(user.Nick())
+			}
+			change(letter, user.Nick())
+
+		case letter == 'k':
+			key, ok := "", true
+			if adding {
+				key, ok = param()
+			} else if len(params) > 0 {
+				_, _ = param()
+			}
+			if !ok {
+				continue
+			}
+			if !op {
+				deny()
+				continue
+			}
+			if !adding && len(channel.Key()) == 0 {
+				continue
+			}
+			channel.SetKey(key)
+			if adding {
+				change(letter, key)
+			} else {
+				change(letter, "*")
+			}
+
+		case letter == 'l':
+			limit := 0
+			if adding {
+				arg, ok := param()
+				if !ok {
+					continue
+				}
+				if limit, _ = strconv.Atoi(arg); limit <= 0 {
+					continue
+				}
+			}
+			if !op {
+				deny()
+				continue
+			}
+			if !adding && channel.Limit() == 0 {
+				continue
+			}
+			channel.SetLimit(limit)
+			if adding {
+				change(letter, strconv.Itoa(limit))
+			} else {
+				change(letter)
+			}
+
+		default:
+			flag, known := chanModeLetters[letter]
+			if !known {
+				flag, known = srv.modules.channelModes[letter]
+			}
+			if !known {
+				conn.ReplyNumeric(ReplyUnknownMode, string(letter))
+				continue
+			}
+			if !op {
+				deny()
+				continue
+			}
+			if adding == channel.ModeIsSet(flag) {
+				continue
+			}
+			if adding {
+				channel.AddMode(flag)
+			} else {
+				channel.DelMode(flag)
+			}
+			change(letter)
+		}
+	}
+
+	if changes.Len() == 0 {
+		return
+	}
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = conn.user.Hostmask()
+	msg.Command = CmdMode
+	msg.Params = append([]string{channel.Name(), changes.String()}, changed...)
+	channel.Send(msg, "")
+}
+
+// replyModeList returns the entries of the list of the channel set with the list mode
+// to the user, oldest first, with who set each and when.
+func (conn *Conn) replyModeList(channel *Channel, mode byte) {
+	type entry struct {
+		mask string
+		ListEntry
+	}
+	var entries []entry
+	_ = channel.modeList(mode).ForEach(func(mask string, listEntry ListEntry) error {
+		entries = append(entries, entry{mask, listEntry})
+		return nil
+	})
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := a.SetAt.Compare(b.SetAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.mask, b.mask)
+	})
+
+	numerics := listNumerics[mode]
+	for _, e := range entries {
+		conn.ReplyNumeric(numerics.entry, channel.Name(), e.mask, e.Setter, strconv.FormatInt(e.SetAt.Unix(), 10))
+	}
+	conn.ReplyNumeric(numerics.end, channel.Name(), "End of channel "+numerics.name+" list")
+}
+
+// listSweepInterval is how often the expired entries of the channel lists are removed.
+const listSweepInterval = 5 * time.Second
+
+// startListSweeper starts removing the expired entries of the lists of each channel,
+// announced from the server, until the server shuts down.
+func (srv *Server) startListSweeper() {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.registerOnShutdown(cancel)
+	ticker := srv.clock.NewTicker(listSweepInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				srv.sweepLists(srv.clock.Now())
+			}
+		}
+	}()
+}
+
+// sweepLists removes the entries of the lists of each channel which expired by now.
+func (srv *Server) sweepLists(now time.Time) {
+	source, max := srv.Hostname(), srv.Limits().ModeChange
+	_ = srv.Channels.ForEach(func(_ string, channel *Channel) error {
+		channel.expireListEntries(source, now, max)
+		return nil
+	})
+}
+
+// timedMaskPrefix prefixes the masks of list entries which expire, followed by the
+// seconds until they do and the mask, eg: "~t:60:*!*@*.example.net".
+const timedMaskPrefix = "~t:"
+
+// cutTimedMask returns the mask of a list entry without the prefix of a timed entry, and
+// the duration until it expires, zero if not timed. It reports false if the mask is of a
+// timed entry without a positive number of seconds or a mask.
+func cutTimedMask(mask string) (string, time.Duration, bool) {
+	timed, isTimed := strings.CutPrefix(mask, timedMaskPrefix)
+	if !isTimed {
+		return mask, 0, true
+	}
+	seconds, mask, found := strings.Cut(timed, ":")
+	duration, err := strconv.Atoi(seconds)
+	if !found || err != nil || duration <= 0 || len(mask) == 0 {
+		return "", 0, false
+	}
+	return mask, time.Duration(duration) * time.Second, true
+}
+
+// canonicalMask completes the mask of a list entry to the nick!user@host form, eg:
+// "bob" to "bob!*@*" and "*.example.net" to "*!*@*.example.net". Extended masks, eg:
+// of an account, are kept as they are.
+func canonicalMask(mask string) string {
+	switch {
+	case strings.HasPrefix(mask, "$"):
+		return mask
+	case !strings.ContainsAny(mask, "!@"):
+		if strings.ContainsAny(mask, ".:") {
+			return "*!*@" + mask
+		}
+		return mask + "!*@*"
+	case !strings.Contains(mask, "!"):
+		return "*!" + mask
+	case !strings.Contains(mask, "@"):
+		return mask + "@*"
+	}
+	return mask
+}
+
+// sanitizedCommands are the commands whose text is stripped of formatting when relayed to
+// a channel, as required by its modes.
+var sanitizedCommands = map[string]struct{}{
+	CmdPrivMsg: {},
+	CmdNotice:  {},
+	CmdPart:    {},
+	CmdTopic:   {},
+	CmdKick:    {},
+}
+
+// sanitize strips the formatting of the text of the message as required by the modes of
+// the channel, which the caller must hold at least a read lock on.
+func (channel *Channel) sanitize(msg *Message) {
+	if _, sanitized := sanitizedCommands[msg.Command]; !sanitized {
+		return
+	}
+
+	switch {
+	case channel.modes&CModeNoFormatting != 0:
+		msg.Trailing = stringutils.StripFormatting(msg.Trailing)
+	case channel.modes&CModeNoColors != 0:
+		msg.Trailing = stringutils.StripColors(msg.Trailing)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalMask(t *testing.T) {
+	assert.Equal(t, "bob!*@*", canonicalMask("bob"))
+	assert.Equal(t, "*!*@*.example.net", canonicalMask("*.example.net"))
+	assert.Equal(t, "*!bob@*", canonicalMask("bob@*"))
+	assert.Equal(t, "bob!*@*", canonicalMask("bob!*"))
+	assert.Equal(t, "$a:alice", canonicalMask("$a:alice"))
+}
+
+func TestCutTimedMask(t *testing.T) {
+	mask, duration, ok := cutTimedMask("~t:60:*!*@*.example.net")
+	assert.True(t, ok)
+	assert.Equal(t, "*!*@*.example.net", mask)
+	assert.Equal(t, time.Minute, duration)
+
+	mask, duration, ok = cutTimedMask("bob")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", mask)
+	assert.Zero(t, duration)
+
+	for _, invalid := range []string{"~t:0:bob", "~t:soon:bob", "~t:60", "~t:60:"} {
+		_, _, ok = cutTimedMask(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestChannelModeLists(t *testing.T) {
+	limits := DefaultLimits()
+	limits.ListItems = 2
+	srv, err := NewServer(WithHostname("irc.example.net"), WithLimits(limits))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 366 alice #dircd ")
+
+	routeBob("MODE #dircd +bi *.example.net")
+	expectAlice(" MODE #dircd +bi *!*@*.example.net")
+
+	// Anyone may query the ban list, but only operators the others.
+	routeAlice("MODE #dircd +b")
+	expectAlice(" 367 alice #dircd *!*@*.example.net bob!")
+	expectAlice(" 368 alice #dircd :End of channel ban list")
+	routeAlice("MODE #dircd e")
+	expectAlice(" 482 alice #dircd :" + ErrChanOpPrivsNeeded.String())
+	routeAlice("MODE #dircd -b *.example.net")
+	expectAlice(" 482 alice #dircd :" + ErrChanOpPrivsNeeded.String())
+
+	routeBob("MODE #dircd +bb mallory eve")
+	expectBob(" 478 bob #dircd b :" + ErrChanListFull.String())
+	expectBob(" MODE #dircd +b mallory!*@*")
+
+	routeBob("MODE #dircd -b+o *.example.net alice")
+	expectAlice(" MODE #dircd -b+o *!*@*.example.net alice")
+	routeAlice("MODE #dircd +e bob")
+	expectBob(" MODE #dircd +e bob!*@*")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	assert.True(t, channel.ModeIsSet(CModeInviteOnly))
+	assert.Equal(t, 1, channel.BanList.Length())
+	entry, exists := channel.ExceptList.Get("bob!*@*")
+	require.True(t, exists)
+	assert.Contains(t, entry.Setter, "alice!")
+	assert.False(t, entry.SetAt.IsZero())
+
+	routeBob("MODE #dircd +X")
+	expectBob(" 472 bob X :" + ErrUnknownMode.String())
+	routeBob("MODE alice")
+	expectBob(" 502 bob :" + ErrUsersDontMatch.String())
+}
+
+func TestTimedBans(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+
+	routeBob("MODE #dircd +b ~t:60:mallory")
+	expectBob(" MODE #dircd +b mallory!*@*")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	entry, exists := channel.BanList.Get("mallory!*@*")
+	require.True(t, exists)
+	assert.Equal(t, time.Minute, entry.Expires.Sub(entry.SetAt))
+
+	// Expired entries are removed and their removal announced to the channel.
+	srv.sweepLists(time.Now().Add(time.Minute))
+	expectBob(":irc.example.net MODE #dircd -b mallory!*@*")
+	assert.Zero(t, channel.BanList.Length())
+}
@@ -0,0 +1,574 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chanServ is the nick of the built-in channel service.
+const chanServ = "ChanServ"
+
+// channelRegsBucket is the storage bucket channel registrations are persisted in.
+const channelRegsBucket = "chanserv"
+
+// Channel access flags, held by accounts on the access list of a registered channel.
+const (
+	ChanFlagFounder    = 'F' // Founder of the channel, holding every other flag.
+	ChanFlagAccess     = 'f' // May change the access list.
+	ChanFlagSet        = 's' // May change the settings of the channel, eg: TOPICLOCK.
+	ChanFlagTopic      = 't' // May change the topic, even while it is locked.
+	ChanFlagInvite     = 'i' // May invite themselves with INVITE.
+	ChanFlagOp         = 'o' // May op and deop themselves and others with OP and DEOP.
+	ChanFlagAutoOp     = 'O' // Is opped on joining.
+	ChanFlagHalfOp     = 'h' // May be halfopped.
+	ChanFlagAutoHalfOp = 'H' // Is halfopped on joining.
+	ChanFlagVoice      = 'v' // May be voiced.
+	ChanFlagAutoVoice  = 'V' // Is voiced on joining.
+)
+
+// chanFlags are the channel access flags, in the order they are listed.
+const chanFlags = "FfstioOhHvV"
+
+// chanLevels are the access flags granted by the AOP, HOP and VOP levels.
+var chanLevels = map[string]string{
+	"AOP": "ioOt",
+	"HOP": "hHt",
+	"VOP": "vV",
+}
+
+// WithChanServ enables the built-in ChanServ, which handles the messages sent to it while
+// no user holds the nick, such as those of services linked to the server. Channels are
+// registered to accounts, whose flags on the access list of a channel grant them modes on
+// joining it and the use of its commands, persisted in the server storage. Local users
+// may not take the nick ChanServ.
+func WithChanServ() ServerOption {
+	return option(func(s *Server) error {
+		s.chanServ = true
+		return nil
+	})
+}
+
+// RegisteredChannel is a channel registered with the built-in ChanServ.
+type RegisteredChannel struct {
+	Name       string            `json:"name"`
+	Founder    string            `json:"founder"`
+	Registered time.Time         `json:"registered"`
+	Access     map[string]string `json:"access"` // The flags of each account, keyed by account name.
+	Topic      string            `json:"topic"`  // The topic restored when the channel is created.
+	TopicLock  bool              `json:"topic_lock"`
+}
+
+// flags returns the access flags of the account on the channel.
+func (reg *RegisteredChannel) flags(account string) string {
+	if len(account) == 0 {
+		return ""
+	}
+	for name, flags := range reg.Access {
+		if strings.EqualFold(name, account) {
+			return flags
+		}
+	}
+	return ""
+}
+
+// has reports whether the account holds the access flag on the channel, which the founder
+// holds every one of.
+func (reg *RegisteredChannel) has(account string, flag rune) bool {
+	flags := reg.flags(account)
+	return strings.ContainsRune(flags, flag) || strings.ContainsRune(flags, ChanFlagFounder)
+}
+
+// setFlags changes the flags of the account on the channel by the change, eg: "+oO-v",
+// removing the account from the access list once it holds none. Unknown flags are ignored.
+func (reg *RegisteredChannel) setFlags(account, change string) {
+	current := reg.flags(account)
+	for name := range reg.Access {
+		if strings.EqualFold(name, account) {
+			delete(reg.Access, name)
+		}
+	}
+
+	adding := true
+	for _, flag := range change {
+		switch {
+		case flag == '+':
+			adding = true
+		case flag == '-':
+			adding = false
+		case !strings.ContainsRune(chanFlags, flag):
+		case adding && !strings.ContainsRune(current, flag):
+			current += string(flag)
+		case !adding:
+			current = strings.ReplaceAll(current, string(flag), "")
+		}
+	}
+
+	if len(current) > 0 {
+		reg.Access[account] = sortFlags(current)
+	}
+}
+
+// hasFlags reports whether the flags include each of the wanted flags.
+func hasFlags(flags, wanted string) bool {
+	for _, flag := range wanted {
+		if !strings.ContainsRune(flags, flag) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortFlags returns the flags in the order they are listed.
+func sortFlags(flags string) string {
+	sorted := []rune(flags)
+	slices.SortFunc(sorted, func(a, b rune) int {
+		return strings.IndexRune(chanFlags, a) - strings.IndexRune(chanFlags, b)
+	})
+	return string(sorted)
+}
+
+// channelRegStore holds the channels registered with the built-in ChanServ, persisted in
+// the server storage.
+type channelRegStore struct {
+	mu       sync.RWMutex
+	storage  Storage
+	fold     func(string) string
+	channels map[string]*RegisteredChannel
+}
+
+// newChannelRegStore returns a channel registration store loaded with the registrations
+// persisted in storage, keyed by channel name folded with the function.
+func newChannelRegStore(storage Storage, fold func(string) string) (*channelRegStore, error) {
+	cs := &channelRegStore{
+		storage:  storage,
+		fold:     fold,
+		channels: make(map[string]*RegisteredChannel),
+	}
+
+	stored, err := storage.List(channelRegsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("error loading channel registrations: %w", err)
+	}
+
+	for key, data := range stored {
+		reg := &RegisteredChannel{}
+		if err = json.Unmarshal(data, reg); err != nil {
+			return nil, fmt.Errorf("error decoding channel registration [%s]: %w", key, err)
+		}
+		if reg.Access == nil {
+			reg.Access = make(map[string]string)
+		}
+		cs.channels[fold(reg.Name)] = reg
+	}
+
+	return cs, nil
+}
+
+// get returns a copy of the registration of the channel, if it is registered.
+func (cs *channelRegStore) get(name string) (*RegisteredChannel, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	reg, exists := cs.channels[cs.fold(name)]
+	if !exists {
+		return nil, false
+	}
+	copied := *reg
+	copied.Access = maps.Clone(reg.Access)
+	return &copied, true
+}
+
+// register registers the channel to the account as its founder, keeping its topic.
+func (cs *channelRegStore) register(name, account, topic string) error {
+	key := cs.fold(name)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, exists := cs.channels[key]; exists {
+		return fmt.Errorf("%s is already registered", name)
+	}
+
+	reg := &RegisteredChannel{
+		Name:       name,
+		Founder:    account,
+		Registered: time.Now().UTC(),
+		Access:     map[string]string{account: string(ChanFlagFounder)},
+		Topic:      topic,
+	}
+	if err := storeJSON(cs.storage, channelRegsBucket, key, reg); err != nil {
+		return err
+	}
+	cs.channels[key] = reg
+	return nil
+}
+
+// update applies the change to a copy of the registration of the channel, persisting and
+// keeping it, or returns ErrNotFound if it is not registered.
+func (cs *channelRegStore) update(name string, change func(reg *RegisteredChannel)) error {
+	key := cs.fold(name)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	reg, exists := cs.channels[key]
+	if !exists {
+		return ErrNotFound
+	}
+
+	updated := *reg
+	updated.Access = maps.Clone(reg.Access)
+	change(&updated)
+	if err := storeJSON(cs.storage, channelRegsBucket, key, &updated); err != nil {
+		return err
+	}
+	cs.channels[key] = &updated
+	return nil
+}
+
+// drop removes the registration of the channel, or returns ErrNotFound.
+func (cs *channelRegStore) drop(name string) error {
+	key := cs.fold(name)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, exists := cs.channels[key]; !exists {
+		return ErrNotFound
+	}
+	if err := cs.storage.Delete(channelRegsBucket, key); err != nil {
+		return err
+	}
+	delete(cs.channels, key)
+	return nil
+}
+
+// channelRegistration returns the registration of the channel with the built-in ChanServ,
+// if it is enabled and the channel registered.
+func (srv *Server) channelRegistration(name string) (*RegisteredChannel, bool) {
+	if !srv.chanServ {
+		return nil, false
+	}
+	return srv.channelRegs.get(name)
+}
+
+// creatorOf returns the user creating the channel by joining it, who owns it unless it is
+// registered to an account other than theirs.
+func (srv *Server) creatorOf(name string, user *User) *User {
+	reg, registered := srv.channelRegistration(name)
+	if registered && !strings.EqualFold(reg.Founder, user.Account()) {
+		return nil
+	}
+	return user
+}
+
+// restoreChannel restores the kept topic of the registered channel once it is created.
+func (srv *Server) restoreChannel(channel *Channel) {
+	if reg, registered := srv.channelRegistration(channel.Name()); registered && len(reg.Topic) > 0 {
+		channel.SetTopicBy(reg.Topic, srv.serviceMask(chanServ))
+	}
+}
+
+// applyAutoModes grants the user joining the registered channel the modes their account's
+// flags on it give them on joining, announcing them from ChanServ.
+func (srv *Server) applyAutoModes(channel *Channel, user *User) {
+	reg, registered := srv.channelRegistration(channel.Name())
+	if !registered {
+		return
+	}
+
+	account := user.Account()
+	switch {
+	case reg.has(account, ChanFlagAutoOp):
+		channel.setStatus(srv.serviceMask(chanServ), user, "+o")
+	case reg.has(account, ChanFlagAutoHalfOp):
+		channel.setStatus(srv.serviceMask(chanServ), user, "+h")
+	case reg.has(account, ChanFlagAutoVoice):
+		channel.setStatus(srv.serviceMask(chanServ), user, "+v")
+	}
+}
+
+// isChanOp reports whether the user is an operator, admin or owner of the channel.
+func isChanOp(channel *Channel, user *User) bool {
+	nick := user.Nick()
+	return channel.Owners.Exists(nick) || channel.Admins.Exists(nick) || channel.Ops.Exists(nick)
+}
+
+// doChanServ handles the commands of the built-in ChanServ:
+//
+//	REGISTER <#channel>                      Registers the channel, which the user is an operator of, to their account.
+//	DROP <#channel>                          Drops the registration of the channel, by its founder.
+//	FLAGS <#channel> [account [+-flags]]     Lists, shows or changes the access flags of accounts.
+//	ACCESS <#channel> LIST|ADD|DEL [account] [flags]
+//	AOP|HOP|VOP <#channel> LIST|ADD|DEL [account]
+//	SET <#channel> TOPICLOCK ON|OFF          Locks the topic to those with the t flag.
+//	TOPIC <#channel> <text>                  Sets the topic, which is kept for the channel.
+//	OP|DEOP <#channel> [nick]                Ops or deops the user, or the nick.
+//	INVITE <#channel>                        Invites the user to the channel.
+func (conn *Conn) doChanServ(text string) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		conn.serviceNotice(chanServ, "Commands: REGISTER, DROP, FLAGS, ACCESS, AOP, HOP, VOP, SET, TOPIC, OP, DEOP, INVITE")
+		return
+	}
+
+	srv := conn.server
+	command, name, args := strings.ToUpper(fields[0]), fields[1], fields[2:]
+	account := conn.user.Account()
+	if len(account) == 0 {
+		conn.serviceNotice(chanServ, "You must be logged in to an account to use ChanServ.")
+		return
+	}
+
+	if command == "REGISTER" {
+		conn.chanServRegister(name, account)
+		return
+	}
+
+	reg, registered := srv.channelRegs.get(name)
+	if !registered {
+		conn.serviceNotice(chanServ, fmt.Sprintf("%s is not registered.", name))
+		return
+	}
+	allowed := func(flag rune) bool {
+		if reg.has(account, flag) {
+			return true
+		}
+		conn.serviceNotice(chanServ, fmt.Sprintf("You are not authorized to use %s on %s.", command, reg.Name))
+		return false
+	}
+
+	switch command {
+	case "DROP":
+		if allowed(ChanFlagFounder) {
+			conn.chanServResult(srv.channelRegs.drop(name), fmt.Sprintf("%s has been dropped.", reg.Name))
+		}
+
+	case "FLAGS":
+		switch {
+		case len(args) == 0:
+			conn.chanServList(reg, "")
+		case len(args) == 1:
+			conn.serviceNotice(chanServ, fmt.Sprintf("Flags of %s on %s: %s", args[0], reg.Name, reg.flags(args[0])))
+		case allowed(ChanFlagAccess):
+			conn.chanServFlags(reg, account, args[0], args[1])
+		}
+
+	case "ACCESS", "AOP", "HOP", "VOP":
+		conn.chanServAccess(reg, account, command, args)
+
+	case "SET":
+		if len(args) < 2 || strings.ToUpper(args[0]) != "TOPICLOCK" {
+			conn.serviceNotice(chanServ, "Syntax: SET <#channel> TOPICLOCK ON|OFF")
+			return
+		}
+		if !allowed(ChanFlagSet) {
+			return
+		}
+		locked := strings.EqualFold(args[1], "ON")
+		conn.chanServResult(srv.channelRegs.update(name, func(reg *RegisteredChannel) {
+			reg.TopicLock = locked
+		}), fmt.Sprintf("The topic lock of %s is now %s.", reg.Name, map[bool]string{true: "on", false: "off"}[locked]))
+
+	case "TOPIC":
+		conn.chanServTopic(reg, account, strings.Join(args, " "))
+
+	case "OP", "DEOP":
+		if !allowed(ChanFlagOp) {
+			return
+		}
+		nick := conn.user.Nick()
+		if len(args) > 0 {
+			nick = args[0]
+		}
+		channel, exists := srv.Channels.Get(name)
+		var target *User
+		if exists {
+			target, exists = channel.Nicks.Get(nick)
+		}
+		switch {
+		case !exists:
+			conn.serviceNotice(chanServ, fmt.Sprintf("%s is not on %s.", nick, reg.Name))
+		case command == "OP":
+			channel.setStatus(srv.serviceMask(chanServ), target, "+o")
+		default:
+			channel.setStatus(srv.serviceMask(chanServ), target, "-o")
+		}
+
+	case "INVITE":
+		if !allowed(ChanFlagInvite) {
+			return
+		}
+		if channel, exists := srv.Channels.Get(name); exists {
+			channel.Invite(conn.user)
+		}
+		msg := msgPool.New()
+		defer msgPool.Recycle(msg, msg.Generation())
+		msg.Source = srv.serviceMask(chanServ)
+		msg.Command = CmdInvite
+		msg.Params = []string{conn.user.Nick(), reg.Name}
+		conn.user.Write(msg.RenderBuffer())
+
+	default:
+		conn.serviceNotice(chanServ, fmt.Sprintf("Unknown command %s.", command))
+	}
+}
+
+// chanServRegister registers the channel to the account of the user, who must be an
+// operator of it.
+func (conn *Conn) chanServRegister(name, account string) {
+	channel, exists := conn.server.Channels.Get(name)
+	if !exists || !channel.Nicks.Exists(conn.user.Nick()) {
+		conn.serviceNotice(chanServ, fmt.Sprintf("You must be on %s to register it.", name))
+		return
+	}
+	if !isChanOp(channel, conn.user) {
+		conn.serviceNotice(chanServ, fmt.Sprintf("You must be an operator of %s to register it.", name))
+		return
+	}
+
+	if err := conn.server.channelRegs.register(channel.Name(), account, channel.Topic()); err != nil {
+		conn.serviceNotice(chanServ, err.Error())
+		return
+	}
+	conn.serviceNotice(chanServ, fmt.Sprintf("%s is now registered to %s.", channel.Name(), account))
+}
+
+// chanServFlags changes the flags of the target account on the channel. Only the founder
+// may grant or revoke the founder flag.
+func (conn *Conn) chanServFlags(reg *RegisteredChannel, account, target, change string) {
+	if !hasFlags("+-"+chanFlags, change) {
+		conn.serviceNotice(chanServ, fmt.Sprintf("Unknown flags %s, the flags are: %s", change, chanFlags))
+		return
+	}
+	if strings.ContainsRune(change, ChanFlagFounder) && !reg.has(account, ChanFlagFounder) {
+		conn.serviceNotice(chanServ, "Only the founder may change the founder flag.")
+		return
+	}
+	if strings.EqualFold(target, reg.Founder) && !strings.EqualFold(account, reg.Founder) {
+		conn.serviceNotice(chanServ, "Only the founder may change their own flags.")
+		return
+	}
+
+	var flags string
+	err := conn.server.channelRegs.update(reg.Name, func(reg *RegisteredChannel) {
+		reg.setFlags(target, change)
+		flags = reg.flags(target)
+	})
+	conn.chanServResult(err, fmt.Sprintf("Flags of %s on %s are now: %s", target, reg.Name, flags))
+}
+
+// chanServAccess handles ACCESS, and the AOP, HOP and VOP levels, which add and remove
+// the flags of the level.
+func (conn *Conn) chanServAccess(reg *RegisteredChannel, account, command string, args []string) {
+	if len(args) == 0 {
+		args = []string{"LIST"}
+	}
+
+	level := chanLevels[command]
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		conn.chanServList(reg, level)
+	case "ADD", "DEL":
+		if len(args) < 2 || (len(level) == 0 && strings.EqualFold(args[0], "ADD") && len(args) < 3) {
+			conn.serviceNotice(chanServ, fmt.Sprintf("Syntax: %s <#channel> ADD|DEL <account>%s",
+				command, map[bool]string{true: " <flags>", false: ""}[len(level) == 0]))
+			return
+		}
+		if !reg.has(account, ChanFlagAccess) {
+			conn.serviceNotice(chanServ, fmt.Sprintf("You are not authorized to use %s on %s.", command, reg.Name))
+			return
+		}
+
+		change := "-" + level
+		switch {
+		case len(level) == 0 && strings.EqualFold(args[0], "DEL"):
+			change = "-" + strings.ReplaceAll(chanFlags, string(ChanFlagFounder), "")
+		case len(level) == 0:
+			change = "+" + strings.TrimPrefix(args[2], "+")
+		case strings.EqualFold(args[0], "ADD"):
+			change = "+" + level
+		}
+		conn.chanServFlags(reg, account, args[1], change)
+	default:
+		conn.serviceNotice(chanServ, fmt.Sprintf("Syntax: %s <#channel> LIST|ADD|DEL [account]", command))
+	}
+}
+
+// chanServList lists the access flags of the accounts on the channel, only those holding
+// each of the level flags if given.
+func (conn *Conn) chanServList(reg *RegisteredChannel, level string) {
+	accounts := make([]string, 0, len(reg.Access))
+	for name, flags := range reg.Access {
+		if hasFlags(flags, level) {
+			accounts = append(accounts, name)
+		}
+	}
+	sort.Strings(accounts)
+
+	conn.serviceNotice(chanServ, fmt.Sprintf("Access list of %s:", reg.Name))
+	for _, name := range accounts {
+		conn.serviceNotice(chanServ, fmt.Sprintf("  %s %s", name, reg.Access[name]))
+	}
+	conn.serviceNotice(chanServ, fmt.Sprintf("End of access list of %s.", reg.Name))
+}
+
+// chanServTopic sets the topic of the channel, which is kept for it. While the topic is
+// locked only users with the t flag may change it, and otherwise operators of the channel
+// may too.
+func (conn *Conn) chanServTopic(reg *RegisteredChannel, account, topic string) {
+	channel, exists := conn.server.Channels.Get(reg.Name)
+	permitted := reg.has(account, ChanFlagTopic) || (!reg.TopicLock && exists && isChanOp(channel, conn.user))
+	if !permitted {
+		conn.serviceNotice(chanServ, fmt.Sprintf("You are not authorized to change the topic of %s.", reg.Name))
+		return
+	}
+
+	if err := conn.server.channelRegs.update(reg.Name, func(reg *RegisteredChannel) {
+		reg.Topic = topic
+	}); err != nil {
+		conn.chanServResult(err, "")
+		return
+	}
+	if !exists {
+		return
+	}
+
+	channel.SetTopicBy(topic, conn.server.serviceMask(chanServ))
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = conn.server.serviceMask(chanServ)
+	msg.Command = CmdTopic
+	msg.Params = []string{channel.Name()}
+	msg.Trailing = topic
+	channel.Send(msg, "")
+}
+
+// chanServResult notifies the user of the result of a change to a registration, logging
+// errors of the storage.
+func (conn *Conn) chanServResult(err error, done string) {
+	if err == nil {
+		conn.serviceNotice(chanServ, done)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		conn.serviceNotice(chanServ, "The channel is not registered.")
+		return
+	}
+	conn.logger.WithField("operation", "chanserv").Error(fmt.Errorf("error updating channel registration: %w", err))
+	conn.serviceNotice(chanServ, err.Error())
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisteredChannelFlags(t *testing.T) {
+	reg := &RegisteredChannel{Access: map[string]string{"bob": "F"}}
+
+	reg.setFlags("Alice", "+Vot")
+	assert.Equal(t, "toV", reg.flags("alice"))
+	assert.True(t, reg.has("alice", ChanFlagOp))
+	assert.False(t, reg.has("alice", ChanFlagAccess))
+	assert.True(t, reg.has("bob", ChanFlagAccess))
+
+	reg.setFlags("alice", "-o+i")
+	assert.Equal(t, "tiV", reg.flags("alice"))
+
+	reg.setFlags("alice", "-tiV")
+	assert.Empty(t, reg.flags("alice"))
+	assert.Len(t, reg.Access, 1)
+}
+
+func TestChanServ(t *testing.T) {
+	storage := NewMemoryStorage()
+	srv, err := NewServer(WithHostname("irc.example.net"), WithStorage(storage), WithChanServ(),
+		WithServiceAliases(map[string]string{"CS": "ChanServ"}))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeBob, expectBob := connectClient(t, srv, "bob")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	expectBob(" 001 bob ")
+
+	routeBob("CS register #dircd")
+	expectBob(" NOTICE bob :You must be on #dircd to register it.")
+
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+	routeBob("CS register #dircd")
+	expectBob(" NOTICE bob :#dircd is now registered to bob.")
+
+	routeBob("CS aop #dircd add alice")
+	expectBob(" NOTICE bob :Flags of alice on #dircd are now: tioO")
+	routeBob("PRIVMSG ChanServ :flags #dircd carol +V")
+	expectBob(" NOTICE bob :Flags of carol on #dircd are now: V")
+	routeBob("CS flags #dircd carol +X")
+	expectBob(" NOTICE bob :Unknown flags +X")
+
+	routeBob("CS set #dircd topiclock on")
+	expectBob(" NOTICE bob :The topic lock of #dircd is now on.")
+	routeBob("CS topic #dircd Welcome to dircd")
+	expectBob(":ChanServ!ChanServ@irc.example.net TOPIC #dircd :Welcome to dircd")
+
+	// Accounts on the access list are given their modes on joining.
+	_, routeAlice, expectAlice := connectClient(t, srv, "alice")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(":ChanServ!ChanServ@irc.example.net MODE #dircd +o alice")
+	expectBob(":ChanServ!ChanServ@irc.example.net MODE #dircd +o alice")
+
+	// Without the t flag, operators may not change the locked topic.
+	routeBob("CS flags #dircd alice -t")
+	expectBob(" NOTICE bob :Flags of alice on #dircd are now: ioO")
+	routeAlice("CS topic #dircd mine now")
+	expectAlice(" NOTICE alice :You are not authorized to change the topic of #dircd.")
+
+	routeAlice("CS op #dircd bob")
+	expectBob(":ChanServ!ChanServ@irc.example.net MODE #dircd +o bob")
+	routeAlice("CS deop #dircd bob")
+	expectBob(":ChanServ!ChanServ@irc.example.net MODE #dircd -o bob")
+
+	_, routeMallory, expectMallory := connectClient(t, srv, "mallory")
+	routeMallory("NICK mallory")
+	routeMallory("USER mallory 0 * :Mallory")
+	routeMallory("CS op #dircd")
+	expectMallory(" NOTICE mallory :You are not authorized to use OP on #dircd.")
+	routeMallory("NICK ChanServ")
+	expectMallory(" 432 mallory ChanServ :" + ErrNickRestricted.String())
+
+	// Registrations are persisted in storage.
+	regs, err := newChannelRegStore(storage, srv.Casefold)
+	require.NoError(t, err)
+	reg, registered := regs.get("#DIRCD")
+	require.True(t, registered)
+	assert.Equal(t, "bob", reg.Founder)
+	assert.Equal(t, "Welcome to dircd", reg.Topic)
+	assert.True(t, reg.TopicLock)
+	assert.Equal(t, "ioO", reg.flags("alice"))
+}
+
+func TestChanServRestoresChannel(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithChanServ())
+	require.NoError(t, err)
+	srv.registerHandlers()
+	require.NoError(t, srv.channelRegs.register("#dircd", "bob", "kept topic"))
+
+	// Users other than the founder do not own the registered channel they create.
+	conn, route, expect := connectClient(t, srv, "alice")
+	route("NICK alice")
+	route("USER alice 0 * :Alice")
+	route("JOIN #dircd")
+	expect(" 366 alice #dircd ")
+
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	assert.Zero(t, channel.Owners.Length())
+	assert.False(t, isChanOp(channel, conn.user))
+	assert.Equal(t, "kept topic", channel.Topic())
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newChatConn returns a connection to a server with the built-in handlers, routing the
+// lines it is given, and a scanner reading the lines it is sent.
+func newChatConn(t *testing.T) (*Conn, func(line string), *bufio.Scanner) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+	go conn.writeLoop()
+
+	route := func(line string) {
+		msg, err := Parse(line)
+		require.NoError(t, err)
+		srv.Router.RouteMessage(conn, msg)
+	}
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	return conn, route, bufio.NewScanner(client)
+}
+
+func TestNoticeNeverReplied(t *testing.T) {
+	conn, route, lines := newChatConn(t)
+
+	route("NOTICE nobody :not registered")
+
+	conn.user.SetNick("bob")
+	conn.registered.Store(true)
+	route("NOTICE nobody :no such nick")
+	route("NOTICE")
+	route("NOTICE :no recipient")
+	route("NOTICE nobody")
+	route("PRIVMSG nobody :no such nick")
+
+	require.True(t, lines.Scan())
+	assert.Contains(t, lines.Text(), " 401 bob nobody ")
+}
+
+func TestChatMessageNumerics(t *testing.T) {
+	conn, route, lines := newChatConn(t)
+	conn.user.SetNick("bob")
+	conn.registered.Store(true)
+	banned := NewChannel("#banned", nil, CasemapRFC1459)
+	banned.BanList.Set("bob!*@*", ListEntry{Setter: "op"})
+	conn.server.Channels.Set("#banned", banned)
+
+	tests := []struct {
+		line  string
+		reply string
+	}{
+		{line: "PRIVMSG", reply: ":irc.example.net 411 bob :No recipient given (PRIVMSG)"},
+		{line: "PRIVMSG :hello", reply: ":irc.example.net 411 bob :No recipient given (PRIVMSG)"},
+		{line: "PRIVMSG nobody", reply: ":irc.example.net 412 bob :No text to send"},
+		{line: "PRIVMSG nobody :", reply: ":irc.example.net 412 bob :No text to send"},
+		{line: "PRIVMSG nobody hello", reply: ":irc.example.net 401 bob nobody :Nick not found"},
+		{line: "PRIVMSG #nowhere hello", reply: ":irc.example.net 403 bob #nowhere :Channel not found"},
+		{line: "PRIVMSG #banned hello", reply: ":irc.example.net 404 bob #banned :Cannot send to channel (+b)"},
+	}
+
+	for _, test := range tests {
+		route(test.line)
+		require.True(t, lines.Scan(), test.line)
+		assert.Equal(t, test.reply, lines.Text(), test.line)
+	}
+}
+
+func TestSelfMessage(t *testing.T) {
+	conn, route, lines := newChatConn(t)
+	conn.user.SetNick("bob")
+	conn.registered.Store(true)
+	conn.server.Nicks.Set("bob", conn.user)
+
+	for _, echo := range []bool{false, true} {
+		if echo {
+			conn.EnableCap(EchoMessage)
+		}
+		route("PRIVMSG bob :hello me")
+		route("PRIVMSG bob :hello again")
+
+		require.True(t, lines.Scan())
+		assert.Contains(t, lines.Text(), " PRIVMSG bob :hello me")
+		require.True(t, lines.Scan())
+		assert.Contains(t, lines.Text(), " PRIVMSG bob :hello again")
+	}
+}
+
+func TestEchoMessage(t *testing.T) {
+	conn, route, lines := newChatConn(t)
+	conn.user.SetNick("bob")
+	conn.registered.Store(true)
+	conn.server.Nicks.Set("alice", &User{nick: "alice"})
+
+	route("PRIVMSG alice :not echoed")
+	conn.EnableCap(EchoMessage)
+	route("PRIVMSG alice :echoed")
+	route("NOTICE alice :echoed notice")
+
+	require.True(t, lines.Scan())
+	assert.Contains(t, lines.Text(), " PRIVMSG alice :echoed")
+	require.True(t, lines.Scan())
+	assert.Contains(t, lines.Text(), " NOTICE alice :echoed notice")
+}
@@ -0,0 +1,261 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// defaultClassName is the name of the connection class assigned to users matching no other class.
+const defaultClassName = "default"
+
+// ConnClass is a class of client connections sharing resource limits. Users are assigned
+// the first class they match when they register: the class named by the listener they
+// connected to with ListenerClass, or else the first configured class whose criteria
+// they meet, or else the class named "default".
+type ConnClass struct {
+	Name             string
+	Hosts            []string      // user@host masks or CIDR ranges matched by the class. Matches any host if empty.
+	TLSOnly          bool          // Only matches connections over TLS.
+	MaxClients       int           // Maximum number of users in the class. Unlimited if zero.
+	SendQ            int           // Maximum bytes queued for writing to a user before they are disconnected. Unlimited if zero.
+	RecvQ            int           // Maximum bytes a user may send beyond the flood limits before they are disconnected. Unlimited if zero.
+	FloodInterval    time.Duration // Interval between messages allowed after a burst, delaying messages sent faster. Unlimited if zero.
+	FloodBurst       int           // Number of messages allowed in a burst before the flood interval applies.
+	IdleTimeout      time.Duration // How long a user may be idle before they are sent a PING, and disconnected if they do not reply. Server timeout if zero.
+	KeepAliveTimeout time.Duration // How long a user may send nothing before they are disconnected. Server timeout if zero.
+	WriteTimeout     time.Duration // How long a write to a user may block before they are disconnected. Server timeout if zero.
+	AllowOper        bool          // Allows users in the class to use the OPER command.
+}
+
+// connClass is a configured connection class and the number of users assigned to it.
+type connClass struct {
+	ConnClass
+	clients atomic.Int64
+}
+
+// WithConnClass adds a connection class, replacing the default class if named "default".
+func WithConnClass(class ConnClass) ServerOption {
+	return option(func(s *Server) error {
+		if len(class.Name) == 0 || strings.ContainsAny(class.Name, " ,") {
+			return fmt.Errorf("invalid connection class name [%s]", class.Name)
+		}
+		if class.MaxClients < 0 || class.SendQ < 0 || class.RecvQ < 0 || class.FloodInterval < 0 ||
+			class.IdleTimeout < 0 || class.KeepAliveTimeout < 0 || class.WriteTimeout < 0 {
+			return fmt.Errorf("connection class [%s] limits must not be negative", class.Name)
+		}
+		if class.FloodInterval > 0 && class.FloodBurst < 1 {
+			return fmt.Errorf("connection class [%s] flood burst must be at least 1", class.Name)
+		}
+		for _, host := range class.Hosts {
+			_, hostMask := splitUserhost(host)
+			if !strings.Contains(hostMask, "/") {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(hostMask); err != nil {
+				return fmt.Errorf("invalid CIDR range [%s] in connection class [%s]: %w", host, class.Name, err)
+			}
+		}
+		if s.connClass(class.Name) != nil {
+			return fmt.Errorf("duplicate connection class: %s", class.Name)
+		}
+
+		s.classes = append(s.classes, &connClass{ConnClass: class})
+		return nil
+	})
+}
+
+// setupClasses adds the default connection class unless one was configured, and checks the
+// classes named by listeners exist.
+func (srv *Server) setupClasses() error {
+	if srv.connClass(defaultClassName) == nil {
+		srv.classes = append(srv.classes, &connClass{ConnClass: ConnClass{
+			Name:      defaultClassName,
+			AllowOper: true,
+		}})
+	}
+
+	var errs error
+	for _, cfg := range srv.listenConfigs {
+		if len(cfg.class) > 0 && srv.connClass(cfg.class) == nil {
+			errs = errors.Join(errs, fmt.Errorf("listener [%s] has unknown connection class [%s]", cfg, cfg.class))
+		}
+	}
+	return errs
+}
+
+// connClass returns the connection class with the name, or nil if there is none.
+func (srv *Server) connClass(name string) *connClass {
+	idx := slices.IndexFunc(srv.classes, func(class *connClass) bool {
+		return class.Name == name
+	})
+	if idx < 0 {
+		return nil
+	}
+	return srv.classes[idx]
+}
+
+// ConnClasses returns the connection classes of the server, and the number of users in each.
+func (srv *Server) ConnClasses() ([]ConnClass, []int) {
+	classes := make([]ConnClass, len(srv.classes))
+	clients := make([]int, len(srv.classes))
+	for i, class := range srv.classes {
+		classes[i] = class.ConnClass
+		classes[i].Hosts = slices.Clone(class.Hosts)
+		clients[i] = int(class.clients.Load())
+	}
+	return classes, clients
+}
+
+// matches reports whether the user@host and IP address of a connection, which is over TLS
+// if secure, meet the criteria of the class.
+func (class *ConnClass) matches(userhost string, ip net.IP, secure bool) bool {
+	if class.TLSOnly && !secure {
+		return false
+	}
+	if len(class.Hosts) == 0 {
+		return true
+	}
+
+	for _, host := range class.Hosts {
+		userMask, hostMask := splitUserhost(host)
+		if _, cidr, err := net.ParseCIDR(hostMask); err == nil {
+			user, _ := splitUserhost(userhost)
+			if ip != nil && cidr.Contains(ip) && stringutils.MatchMask(userMask, user) {
+				return true
+			}
+			continue
+		}
+		if stringutils.MatchMask(userMask+AT+hostMask, userhost) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchClass returns the connection class of the user registering on the connection.
+func (conn *Conn) matchClass() *connClass {
+	if len(conn.listener.class) > 0 {
+		if class := conn.server.connClass(conn.listener.class); class != nil {
+			return class
+		}
+	}
+
+	host, _, err := net.SplitHostPort(conn.remAddr)
+	if err != nil {
+		host = conn.remAddr
+	}
+	ip := net.ParseIP(host)
+	_, secure := conn.socket().(*tls.Conn)
+	secure = secure || conn.listener.tls
+
+	userhost := conn.userhost()
+	for _, class := range conn.server.classes {
+		if class.Name != defaultClassName && class.matches(userhost, ip, secure) {
+			return class
+		}
+	}
+	return conn.server.connClass(defaultClassName)
+}
+
+// assignClass assigns the user registering on the connection to their connection class,
+// disconnecting them if it is full, reporting whether they were.
+func (conn *Conn) assignClass() bool {
+	class := conn.matchClass()
+	for {
+		clients := class.clients.Load()
+		if class.MaxClients > 0 && clients >= int64(class.MaxClients) {
+			conn.logger.WithField("operation", "class").
+				Infof("disconnecting [%s]: connection class [%s] is full", conn.userhost(), class.Name)
+			conn.doKill("No more connections allowed in your connection class", "")
+			return true
+		}
+		if class.clients.CompareAndSwap(clients, clients+1) {
+			break
+		}
+	}
+
+	conn.class.Store(class)
+	conn.logger.WithField("operation", "class").Debugf("assigned [%s] to connection class [%s]", conn.userhost(), class.Name)
+	return false
+}
+
+// releaseClass removes the user of the closed connection from their connection class.
+func (conn *Conn) releaseClass() {
+	if class := conn.class.Swap(nil); class != nil {
+		class.clients.Add(-1)
+	}
+}
+
+// Class returns the name of the connection class of the user, or an empty string if they
+// have not registered.
+func (conn *Conn) Class() string {
+	if class := conn.class.Load(); class != nil {
+		return class.Name
+	}
+	return ""
+}
+
+// sendQExceeded reports whether queueing the bytes would exceed the SendQ of the class of
+// the connection, disconnecting the user the first time it does.
+func (conn *Conn) sendQExceeded(size int) bool {
+	class := conn.class.Load()
+	if class == nil || class.SendQ == 0 || conn.sendQueue.Load()+int64(size) <= int64(class.SendQ) {
+		return false
+	}
+
+	if conn.sendQFull.CompareAndSwap(false, true) {
+		conn.logger.WithField("operation", "class").Infof("disconnecting [%s]: max SendQ exceeded", conn.userhost())
+		// Disconnecting relays the QUIT to the user's channels, which must not happen
+		// while whoever is sending to the user holds any locks.
+		go conn.doKill("Max SendQ exceeded", "")
+	}
+	return true
+}
+
+// throttle delays handling a message from the user until it is within the flood limits of
+// their class, disconnecting them if they have sent more than their RecvQ beyond the limits,
+// reporting whether they were. Operators and flood immune users are exempt.
+func (conn *Conn) throttle(size int) bool {
+	class := conn.class.Load()
+	if class == nil || class.FloodInterval == 0 || conn.user.IsOper() || conn.user.ModeIsSet(UModeFloodImmune) {
+		return false
+	}
+
+	if conn.recvFlood.allowRate(time.Now(), class.FloodInterval, class.FloodBurst) {
+		conn.recvExcess = 0
+		return false
+	}
+
+	conn.recvExcess += size
+	if class.RecvQ > 0 && conn.recvExcess > class.RecvQ {
+		conn.logger.WithField("operation", "class").Infof("disconnecting [%s]: excess flood", conn.userhost())
+		conn.doKill("Excess Flood", "")
+		return true
+	}
+
+	for !conn.recvFlood.allowRate(time.Now(), class.FloodInterval, class.FloodBurst) {
+		timer := time.NewTimer(conn.recvFlood.delay(class.FloodInterval))
+		select {
+		case <-conn.ctx.Done():
+			timer.Stop()
+			return true
+		case <-timer.C:
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchClass(t *testing.T) {
+	srv, err := NewServer(
+		WithConnClass(ConnClass{Name: "secure", TLSOnly: true, AllowOper: true}),
+		WithConnClass(ConnClass{Name: "local", Hosts: []string{"10.0.0.0/8", "*@*.example"}, SendQ: 1024}),
+		WithConnClass(ConnClass{Name: "bots", Hosts: []string{"bot*@192.168.0.0/16"}, MaxClients: 1}),
+		WithConnClass(ConnClass{Name: "webirc", Hosts: []string{"*@gateway.invalid"}}),
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		user     string
+		host     string
+		remAddr  string
+		listener *listenerConfig
+		expected string
+	}{
+		{name: "default", user: "alice", host: "172.16.0.1", remAddr: "172.16.0.1:5000", listener: &listenerConfig{}, expected: defaultClassName},
+		{name: "tls listener", user: "alice", host: "172.16.0.1", remAddr: "172.16.0.1:5000", listener: &listenerConfig{tls: true}, expected: "secure"},
+		{name: "cidr", user: "alice", host: "10.1.2.3", remAddr: "10.1.2.3:5000", listener: &listenerConfig{}, expected: "local"},
+		{name: "hostmask", user: "alice", host: "host.example", remAddr: "172.16.0.1:5000", listener: &listenerConfig{}, expected: "local"},
+		{name: "user and cidr", user: "bot1", host: "192.168.1.1", remAddr: "192.168.1.1:5000", listener: &listenerConfig{}, expected: "bots"},
+		{name: "user mismatch", user: "alice", host: "192.168.1.1", remAddr: "192.168.1.1:5000", listener: &listenerConfig{}, expected: defaultClassName},
+		{name: "listener class", user: "alice", host: "10.1.2.3", remAddr: "10.1.2.3:5000", listener: &listenerConfig{class: "webirc"}, expected: "webirc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &User{name: test.user, host: test.host}
+			conn := &Conn{server: srv, user: user, remAddr: test.remAddr, listener: test.listener}
+			user.conn = conn
+			assert.Equal(t, test.expected, conn.matchClass().Name)
+		})
+	}
+}
+
+func TestAssignClass(t *testing.T) {
+	srv, err := NewServer(WithConnClass(ConnClass{Name: defaultClassName, MaxClients: 2, IdleTimeout: time.Minute}))
+	assert.NoError(t, err)
+
+	user := &User{name: "alice", host: "host.example"}
+	conn := &Conn{server: srv, user: user, listener: &listenerConfig{}, logger: srv.logger}
+	user.conn = conn
+
+	assert.Equal(t, DefaultTimeouts().Ping, conn.idleTimeout())
+	assert.False(t, conn.assignClass())
+	assert.Equal(t, defaultClassName, conn.Class())
+	assert.Equal(t, time.Minute, conn.idleTimeout())
+
+	_, clients := srv.ConnClasses()
+	assert.Equal(t, []int{1}, clients)
+
+	conn.releaseClass()
+	conn.releaseClass()
+	_, clients = srv.ConnClasses()
+	assert.Equal(t, []int{0}, clients)
+	assert.Empty(t, conn.Class())
+}
+
+func TestConnClassOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ServerOption
+	}{
+		{name: "empty name", options: []ServerOption{WithConnClass(ConnClass{})}},
+		{name: "duplicate", options: []ServerOption{WithConnClass(ConnClass{Name: "a"}), WithConnClass(ConnClass{Name: "a"})}},
+		{name: "negative limit", options: []ServerOption{WithConnClass(ConnClass{Name: "a", SendQ: -1})}},
+		{name: "flood without burst", options: []ServerOption{WithConnClass(ConnClass{Name: "a", FloodInterval: time.Second})}},
+		{name: "bad cidr", options: []ServerOption{WithConnClass(ConnClass{Name: "a", Hosts: []string{"10.0.0.0/99"}})}},
+		{name: "unknown listener class", options: []ServerOption{WithListener("127.0.0.1:0", ListenerClass("missing"))}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewServer(test.options...)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates the timers of the server, so that tests may control
+// the passing of time, see WithClock and FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer of a Clock, see time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Ticker is a ticker of a Clock, see time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WithClock sets the clock of the server, used by the heartbeats of connections and the
+// expiry of channel list entries. The system clock is used by default.
+func WithClock(clock Clock) ServerOption {
+	return option(func(s *Server) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+		s.clock = clock
+		return nil
+	})
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTimer struct{ *time.Timer }
+
+func (timer systemTimer) C() <-chan time.Time { return timer.Timer.C }
+
+type systemTicker struct{ *time.Ticker }
+
+func (ticker systemTicker) C() <-chan time.Time { return ticker.Ticker.C }
+
+// FakeClock is a Clock whose time only passes when advanced, firing the timers and
+// tickers due by then, for deterministic tests of timeouts.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock set to the time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// NewTimer returns a timer firing once the clock is advanced by the duration.
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	return clock.schedule(d, 0)
+}
+
+// NewTicker returns a ticker firing each time the clock is advanced by the duration.
+func (clock *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{clock.schedule(d, d)}
+}
+
+// Advance moves the time of the clock forward by the duration, firing the timers and
+// tickers due by then, in order. As with those of the time package, the fires of a
+// timer or ticker whose previous fire was not yet received are dropped.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	end := clock.now.Add(d)
+	for {
+		due := clock.nextDue(end)
+		if due == nil {
+			break
+		}
+		clock.now = due.when
+		select {
+		case due.c <- due.when:
+		default:
+		}
+		if due.period > 0 {
+			due.when = due.when.Add(due.period)
+		} else {
+			clock.remove(due)
+		}
+	}
+	clock.now = end
+}
+
+// schedule adds a timer firing after the duration, then every period if not zero.
+func (clock *FakeClock) schedule(d, period time.Duration) *fakeTimer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	timer := &fakeTimer{clock: clock, c: make(chan time.Time, 1), when: clock.now.Add(d), period: period}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// nextDue returns the timer due first by the time, or nil if none is. The caller must
+// hold the lock of the clock.
+func (clock *FakeClock) nextDue(by time.Time) *fakeTimer {
+	var next *fakeTimer
+	for _, timer := range clock.timers {
+		if !timer.when.After(by) && (next == nil || timer.when.Before(next.when)) {
+			next = timer
+		}
+	}
+	return next
+}
+
+// remove removes the timer, reporting whether it was scheduled. The caller must hold the
+// lock of the clock.
+func (clock *FakeClock) remove(timer *fakeTimer) bool {
+	index := slices.Index(clock.timers, timer)
+	if index < 0 {
+		return false
+	}
+	clock.timers = slices.Delete(clock.timers, index, index+1)
+	return true
+}
+
+// fakeTimer is a timer or ticker of a FakeClock.
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (timer *fakeTimer) C() <-chan time.Time { return timer.c }
+
+func (timer *fakeTimer) Reset(d time.Duration) bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	active := clock.remove(timer)
+	timer.when = clock.now.Add(d)
+	clock.timers = append(clock.timers, timer)
+	return active
+}
+
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.remove(timer)
+}
+
+// fakeTicker is a ticker of a FakeClock.
+type fakeTicker struct{ *fakeTimer }
+
+func (ticker fakeTicker) Stop() { ticker.fakeTimer.Stop() }
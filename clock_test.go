@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	timer := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(20 * time.Second)
+
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, start.Add(59*time.Second), clock.Now())
+	assert.Empty(t, timer.C())
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C())
+
+	// Ticks not received in time are dropped, as with time.Ticker.
+	assert.Empty(t, ticker.C())
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-timer.C())
+	assert.Equal(t, start.Add(time.Minute), <-ticker.C())
+
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	assert.Empty(t, timer.C())
+	assert.Empty(t, ticker.C())
+
+	_, err := NewServer(WithClock(nil))
+	assert.Error(t, err)
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(WithHostname("irc.example.net"), WithClock(clock))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	clock.Advance(srv.Timeouts().Ping)
+	expect("PING :")
+
+	// Without a PONG by the next heartbeat, the connection is timed out.
+	clock.Advance(conn.idleTimeout())
+	select {
+	case <-conn.ctx.Done():
+		assert.EqualError(t, context.Cause(conn.ctx), "heartbeat timeout")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not timed out")
+	}
+}
+
+func TestListSweeper(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(WithHostname("irc.example.net"), WithClock(clock))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+	expectBob(" 366 bob #dircd ")
+	routeBob("MODE #dircd +b ~t:60:mallory")
+	expectBob(" MODE #dircd +b mallory!*@*")
+
+	srv.startListSweeper()
+	clock.Advance(time.Minute + listSweepInterval)
+	expectBob(":irc.example.net MODE #dircd -b mallory!*@*")
+}
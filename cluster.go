@@ -0,0 +1,601 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Cluster settings
+const (
+	clusterQueueSize         = 8192
+	clusterTimeout           = 5 * time.Second
+	clusterHeartbeatInterval = 10 * time.Second
+	clusterNodeTTL           = 3 * clusterHeartbeatInterval
+	clusterInitialBackoff    = 500 * time.Millisecond
+	clusterMaxBackoff        = 30 * time.Second
+)
+
+// Cluster message types which are only exchanged between nodes, not published on the event bus.
+const (
+	clusterNodeDown EventType = "cluster.node_down"
+	clusterKill     EventType = "cluster.kill"
+)
+
+// ClusterBackend shares the nick and channel membership indexes of a network between
+// the dircd nodes serving it, and fans out messages between them, such as the Redis
+// backend in the cluster/redis package.
+//
+// Nicks and channels are given casefolded with the casemapping of the server, so that
+// backends compare them as given. Nicks are claimed by owners of the form
+// "<node>/<connection>", so that the nicks of a node can be released when it leaves the
+// cluster.
+type ClusterBackend interface {
+	// ClaimNick claims the nick for the owner, reporting whether it was unclaimed or
+	// already claimed by the owner.
+	ClaimNick(ctx context.Context, nick, owner string) (bool, error)
+
+	// ReleaseNick releases the nick, and the user registered with it, if it is claimed by the owner.
+	ReleaseNick(ctx context.Context, nick, owner string) error
+
+	// SaveUser stores the user registered with the nick.
+	SaveUser(ctx context.Context, nick string, user ClusterUser) error
+
+	// Users returns the registered users of every node.
+	Users(ctx context.Context) ([]ClusterUser, error)
+
+	// AddMember adds the nick to the members of the channel, which is shown with the name.
+	AddMember(ctx context.Context, channel, name, nick string) error
+
+	// RemoveMember removes the nick from the members of every channel.
+	RemoveMember(ctx context.Context, nick string) error
+
+	// RenameMember renames the nick in the members of every channel.
+	RenameMember(ctx context.Context, oldNick, newNick string) error
+
+	// Members returns the casefolded nicks of the members of every channel, by channel name.
+	Members(ctx context.Context) (map[string][]string, error)
+
+	// Heartbeat marks the node as alive for the ttl.
+	Heartbeat(ctx context.Context, node string, ttl time.Duration) error
+
+	// ExpiredNodes returns the nodes whose last heartbeat has expired.
+	ExpiredNodes(ctx context.Context) ([]string, error)
+
+	// RemoveNode removes the node, releasing its nicks and their channel memberships.
+	RemoveNode(ctx context.Context, node string) error
+
+	// Publish sends the payload to every node subscribed, including this one.
+	Publish(ctx context.Context, payload []byte) error
+
+	// Subscribe calls the handler with each payload published, in order, until the
+	// context is cancelled or the subscription fails.
+	Subscribe(ctx context.Context, handler func(payload []byte)) error
+
+	// Close releases the backend connections.
+	Close() error
+}
+
+// ClusterUser is a registered user as stored by a ClusterBackend.
+type ClusterUser struct {
+	Node     string `json:"node"`
+	Nick     string `json:"nick"`
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Realname string `json:"realname,omitempty"`
+	Account  string `json:"account,omitempty"`
+}
+
+// clusterMessage is an event fanned out from the node it occurred on to the rest of the cluster.
+type clusterMessage struct {
+	Node     string `json:"node"`
+	Realname string `json:"realname,omitempty"`
+	Event
+}
+
+// cluster links the server with other nodes serving the same network through a ClusterBackend.
+type cluster struct {
+	server  *Server
+	backend ClusterBackend
+	node    string
+	ctx     context.Context
+	queue   chan func(ctx context.Context) error
+	logger  Logger
+}
+
+// WithCluster sets the server to run as a node of a cluster sharing one nick namespace,
+// eg: behind a load balancer. Nicks, users, channel membership, and messages are shared
+// between the nodes through the backend, while each node serves its own connections:
+//
+//	backend, err := redis.New("redis://localhost:6379/0")
+//	...
+//	srv, err := dircd.NewServer(dircd.WithCluster(backend))
+//
+// Only membership is shared of channels: their topics, modes, bans, and operators are
+// kept by each node for its own users, so the nodes should run with the same channel
+// registrations, and channel moderation only applies on the node it is set on. Every
+// node must use the same casemapping. Nicks can't be claimed while the backend can't be
+// reached. Nodes which stop without shutting down are removed from the cluster once
+// their heartbeat expires.
+func WithCluster(backend ClusterBackend) ServerOption {
+	return option(func(s *Server) error {
+		if backend == nil {
+			return errors.New("cluster backend must not be nil")
+		}
+
+		id := make([]byte, 4)
+		if _, err := rand.Read(id); err != nil {
+			return fmt.Errorf("error generating cluster node ID: %w", err)
+		}
+
+		s.cluster = &cluster{
+			server:  s,
+			backend: backend,
+			node:    hex.EncodeToString(id),
+			queue:   make(chan func(ctx context.Context) error, clusterQueueSize),
+		}
+		return nil
+	})
+}
+
+// startCluster joins the cluster, if configured, loading the users and channel memberships
+// of the other nodes, then starts relaying local events to them and theirs to the server.
+func (srv *Server) startCluster() {
+	c := srv.cluster
+	if c == nil {
+		return
+	}
+
+	c.node = srv.Hostname() + "-" + c.node
+	c.logger = srv.logger.WithFields(Fields{
+		"sub-component": "cluster",
+		"node":          c.node,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+	srv.registerOnShutdown(func() {
+		cancel()
+		c.leave()
+	})
+
+	c.heartbeat(ctx)
+	if err := c.synchronize(ctx); err != nil {
+		c.logger.Error(fmt.Errorf("error loading cluster state: %w", err))
+	}
+
+	go c.subscribe(ctx)
+	go c.run(ctx)
+	go c.maintain(ctx)
+
+	srv.Subscribe(c.relay,
+		EventUserRegistered, EventNickChange, EventChannelJoin,
+		EventMessage, EventUserQuit, EventUserKilled)
+
+	c.logger.Info("joined cluster")
+}
+
+// owner returns the nick claim owner for the connection.
+func (c *cluster) owner(conn *Conn) string {
+	return c.node + "/" + conn.remAddr
+}
+
+// claimNick claims the nick across the cluster for the connection, returning ErrNickInUse
+// if it is claimed by another. The nick is refused with ErrTryAgain if the backend can't
+// be reached, rather than risk two users on different nodes holding it.
+func (c *cluster) claimNick(conn *Conn, nick string) error {
+	ctx, cancel := context.WithTimeout(conn.ctx, clusterTimeout)
+	defer cancel()
+
+	claimed, err := c.backend.ClaimNick(ctx, c.server.Casefold(nick), c.owner(conn))
+	if err != nil {
+		c.logger.Warn(fmt.Errorf("error claiming nick [%s]: %w", nick, err))
+		return ErrTryAgain
+	}
+	if !claimed {
+		return ErrNickInUse
+	}
+	return nil
+}
+
+// releaseNick releases the claim of the connection on the nick, and the channel
+// memberships of the nick.
+func (c *cluster) releaseNick(conn *Conn, nick string) {
+	if len(nick) == 0 {
+		return
+	}
+
+	key := c.server.Casefold(nick)
+	owner := c.owner(conn)
+	c.enqueue(func(ctx context.Context) error {
+		if err := c.backend.RemoveMember(ctx, key); err != nil {
+			return err
+		}
+		return c.backend.ReleaseNick(ctx, key, owner)
+	})
+}
+
+// killRemote asks the node the remote user is connected to to kill them.
+func (c *cluster) killRemote(user *User, reason, source string) {
+	message := clusterMessage{Node: c.node}
+	message.Type = clusterKill
+	message.Time = time.Now()
+	message.Target = user.Nick()
+	message.Reason = reason
+	message.Actor = source
+
+	c.enqueue(func(ctx context.Context) error {
+		return c.publish(ctx, message)
+	})
+}
+
+// relay updates the cluster indexes with the local event, then fans it out to the other nodes.
+func (c *cluster) relay(event Event) {
+	user, exists := c.server.Nicks.Get(event.Nick)
+	if !exists || user.conn == nil {
+		return
+	}
+
+	srv := c.server
+	owner := c.owner(user.conn)
+	nick, oldNick := srv.Casefold(event.Nick), srv.Casefold(event.Target)
+	message := clusterMessage{Node: c.node, Event: event}
+	info := ClusterUser{
+		Node:     c.node,
+		Nick:     user.Nick(),
+		Name:     user.Name(),
+		Host:     user.VisibleHost(),
+		Realname: user.Realname(),
+		Account:  user.Account(),
+	}
+
+	c.enqueue(func(ctx context.Context) error {
+		switch event.Type {
+		case EventUserRegistered:
+			message.Realname = info.Realname
+			if err := c.backend.SaveUser(ctx, nick, info); err != nil {
+				return err
+			}
+
+		case EventNickChange:
+			// Nick changes forced by services aren't claimed beforehand.
+			claimed, err := c.backend.ClaimNick(ctx, nick, owner)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				c.logger.Warnf("nick [%s] is claimed by another node", event.Nick)
+			}
+			if oldNick != nick {
+				if err = c.backend.RenameMember(ctx, oldNick, nick); err != nil {
+					return err
+				}
+				if err = c.backend.ReleaseNick(ctx, oldNick, owner); err != nil {
+					return err
+				}
+			}
+			if err = c.backend.SaveUser(ctx, nick, info); err != nil {
+				return err
+			}
+
+		case EventChannelJoin:
+			if err := c.backend.AddMember(ctx, srv.Casefold(event.Channel), event.Channel, nick); err != nil {
+				return err
+			}
+		}
+
+		return c.publish(ctx, message)
+	})
+}
+
+// publish fans out the message to the other nodes.
+func (c *cluster) publish(ctx context.Context, message clusterMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return c.backend.Publish(ctx, payload)
+}
+
+// enqueue queues the backend operation, dropping it if the queue is full.
+func (c *cluster) enqueue(operation func(ctx context.Context) error) {
+	if c.ctx.Err() != nil {
+		return // Left the cluster.
+	}
+
+	select {
+	case c.queue <- operation:
+	default:
+		c.logger.Error("cluster queue full, dropping update")
+	}
+}
+
+// run performs queued backend operations in order, retrying each with backoff until it
+// succeeds or the context is cancelled.
+func (c *cluster) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case operation := <-c.queue:
+			backoff := clusterInitialBackoff
+			for {
+				err := operation(ctx)
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+
+				c.logger.Warn(fmt.Errorf("cluster update failed, retrying in %v: %w", backoff, err))
+				select {
+				case <-ctx.Done():
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, clusterMaxBackoff)
+			}
+		}
+	}
+}
+
+// subscribe receives the messages of the other nodes until the context is cancelled,
+// resubscribing with backoff, and resynchronizing after any messages missed, on failure.
+func (c *cluster) subscribe(ctx context.Context) {
+	backoff := clusterInitialBackoff
+	for {
+		subscribed := time.Now()
+		err := c.backend.Subscribe(ctx, c.receive)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(subscribed) > clusterMaxBackoff {
+			backoff = clusterInitialBackoff
+		}
+
+		c.logger.Warn(fmt.Errorf("cluster subscription failed, retrying in %v: %w", backoff, err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, clusterMaxBackoff)
+
+		if err = c.synchronize(ctx); err != nil {
+			c.logger.Warn(fmt.Errorf("error resynchronizing cluster state: %w", err))
+		}
+	}
+}
+
+// maintain sends the heartbeat of this node, and removes expired nodes, until the context is cancelled.
+func (c *cluster) maintain(ctx context.Context) {
+	ticker := time.NewTicker(clusterHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.heartbeat(ctx)
+
+		opCtx, cancel := context.WithTimeout(ctx, clusterTimeout)
+		expired, err := c.backend.ExpiredNodes(opCtx)
+		if err != nil {
+			c.logger.Warn(fmt.Errorf("error checking for expired nodes: %w", err))
+		}
+		for _, node := range expired {
+			if node == c.node {
+				continue
+			}
+			c.logger.Warnf("removing expired node [%s]", node)
+			if err = c.backend.RemoveNode(opCtx, node); err != nil {
+				c.logger.Warn(fmt.Errorf("error removing expired node [%s]: %w", node, err))
+			}
+			c.removeNode(node)
+		}
+		cancel()
+	}
+}
+
+// heartbeat marks this node as alive.
+func (c *cluster) heartbeat(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+
+	if err := c.backend.Heartbeat(ctx, c.node, clusterNodeTTL); err != nil {
+		c.logger.Warn(fmt.Errorf("error sending cluster heartbeat: %w", err))
+	}
+}
+
+// leave removes this node from the cluster, notifying the other nodes, and closes the backend.
+func (c *cluster) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+
+	if err := c.backend.RemoveNode(ctx, c.node); err != nil {
+		c.logger.Warn(fmt.Errorf("error leaving cluster: %w", err))
+	}
+
+	message := clusterMessage{Node: c.node}
+	message.Type = clusterNodeDown
+	message.Time = time.Now()
+	if err := c.publish(ctx, message); err != nil {
+		c.logger.Warn(fmt.Errorf("error announcing cluster departure: %w", err))
+	}
+
+	if err := c.backend.Close(); err != nil {
+		c.logger.Warn(fmt.Errorf("error closing cluster backend: %w", err))
+	}
+}
+
+// synchronize loads the users and channel memberships of the other nodes, removing any
+// remote users which are no longer registered.
+func (c *cluster) synchronize(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+
+	users, err := c.backend.Users(ctx)
+	if err != nil {
+		return err
+	}
+	members, err := c.backend.Members(ctx)
+	if err != nil {
+		return err
+	}
+
+	registered := make(map[string]ClusterUser, len(users))
+	for _, info := range users {
+		if info.Node != c.node {
+			registered[c.server.Casefold(info.Nick)] = info
+			c.addUser(info)
+		}
+	}
+
+	c.server.Nicks.ForEach(func(nick string, user *User) error {
+		if info, exists := registered[nick]; len(user.node) > 0 && (!exists || info.Node != user.node) {
+			c.server.quitRemote(user, "Left the cluster")
+		}
+		return nil
+	})
+
+	for channel, nicks := range members {
+		for _, nick := range nicks {
+			if info, exists := registered[c.server.Casefold(nick)]; exists {
+				if user := c.remoteUser(info.Node, info.Nick); user != nil {
+					c.server.joinRemote(user, channel)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// receive applies a message from another node.
+func (c *cluster) receive(payload []byte) {
+	var message clusterMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		c.logger.Warn(fmt.Errorf("invalid cluster message: %w", err))
+		return
+	}
+	if message.Node == c.node {
+		return
+	}
+
+	srv := c.server
+	switch message.Type {
+	case EventUserRegistered:
+		c.addUser(ClusterUser{
+			Node:     message.Node,
+			Nick:     message.Nick,
+			Name:     message.User,
+			Host:     message.Host,
+			Realname: message.Realname,
+			Account:  message.Account,
+		})
+
+	case EventNickChange:
+		if user := c.remoteUser(message.Node, message.Target); user != nil {
+			srv.renameRemote(user, message.Nick)
+		}
+
+	case EventChannelJoin:
+		if user := c.remoteUser(message.Node, message.Nick); user != nil {
+			srv.joinRemote(user, message.Channel)
+		}
+
+	case EventMessage:
+		c.deliver(message)
+
+	case EventUserQuit:
+		if user := c.remoteUser(message.Node, message.Nick); user != nil {
+			srv.quitRemote(user, message.Reason)
+		}
+
+	case EventUserKilled:
+		if user := c.remoteUser(message.Node, message.Nick); user != nil {
+			srv.quitRemote(user, fmt.Sprintf("Killed: [%s [%s]]", message.Actor, message.Reason))
+		}
+
+	case clusterNodeDown:
+		c.removeNode(message.Node)
+
+	case clusterKill:
+		if user, exists := srv.Nicks.Get(message.Target); exists && user.conn != nil {
+			user.kill(message.Reason, message.Actor)
+		}
+	}
+}
+
+// deliver delivers a PRIVMSG or NOTICE from a remote user to the local users it was sent to.
+func (c *cluster) deliver(message clusterMessage) {
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = fmt.Sprintf("%s!%s@%s", message.Nick, message.User, message.Host)
+	msg.Command = message.Action
+	msg.Trailing = message.Text
+
+	if len(message.Channel) > 0 {
+		if channel, exists := c.server.Channels.Get(message.Channel); exists {
+			msg.Params = []string{channel.Name()}
+			channel.Send(msg, message.Nick)
+		}
+		return
+	}
+
+	if user, exists := c.server.Nicks.Get(message.Target); exists && user.conn != nil {
+		msg.Params = []string{user.Nick()}
+		user.Write(msg.RenderBuffer())
+	}
+}
+
+// addUser adds a remote user registered on another node, unless their nick is taken.
+func (c *cluster) addUser(info ClusterUser) {
+	srv := c.server
+	if existing, exists := srv.Nicks.Get(info.Nick); exists {
+		if existing.node != info.Node {
+			c.logger.Warnf("nick [%s] of node [%s] is already in use", info.Nick, info.Node)
+		}
+		return
+	}
+
+	srv.Nicks.Set(info.Nick, &User{
+		nick:    info.Nick,
+		name:    info.Name,
+		host:    info.Host,
+		real:    info.Realname,
+		account: info.Account,
+		nickTS:  time.Now().Unix(),
+		perm:    UPermUser,
+		node:    info.Node,
+	})
+}
+
+// remoteUser returns the remote user with the nick connected to the node, if any.
+func (c *cluster) remoteUser(node, nick string) *User {
+	if user, exists := c.server.Nicks.Get(nick); exists && user.node == node {
+		return user
+	}
+	return nil
+}
+
+// removeNode removes the remote users connected to the node, as in a netsplit.
+func (c *cluster) removeNode(node string) {
+	reason := c.server.Hostname() + SPACE + node
+	c.server.Nicks.ForEach(func(_ string, user *User) error {
+		if user.node == node {
+			c.server.quitRemote(user, reason)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,378 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package redis provides a dircd cluster backend which shares the nicks, users, and
+// channel memberships of the cluster nodes in Redis, and fans out messages between them
+// with Redis pub/sub, using the go-redis client.
+//
+// Nicks and channels are stored by the casefolded names given by the server, so that
+// they compare as the casemapping of the network does. All keys are stored under a
+// prefix, "dircd:" by default:
+//
+//	<prefix>nicks            hash of nick to claim owner
+//	<prefix>users            hash of nick to registered user JSON
+//	<prefix>node:<node>      set of the nicks claimed on a node
+//	<prefix>channels         hash of channel to channel name
+//	<prefix>members:<chan>   set of the member nicks of a channel
+//	<prefix>joined:<nick>    set of the channels a nick is a member of
+//	<prefix>nodes            sorted set of nodes by heartbeat expiry
+//	<prefix>events           pub/sub channel of cluster messages
+//
+// Updates spanning several keys are made atomically with Lua scripts and transactions,
+// given every key they touch, so Redis Cluster is not supported; use a single primary,
+// optionally with Sentinel failover.
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/btnmasher/dircd"
+)
+
+// maxAttempts is the most times an update watching a key is attempted if the key is
+// changed before it is made.
+const maxAttempts = 5
+
+// Lua scripts for updates spanning several keys.
+var (
+	// KEYS: nicks, node nicks; ARGV: nick, owner
+	claimScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if current and current ~= ARGV[2] then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1`)
+
+	// KEYS: nicks, users, node nicks; ARGV: nick, owner
+	releaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+  redis.call('HDEL', KEYS[1], ARGV[1])
+  redis.call('HDEL', KEYS[2], ARGV[1])
+  redis.call('SREM', KEYS[3], ARGV[1])
+end
+return 0`)
+
+	// KEYS: joined, channels, members of each channel; ARGV: nick, each channel
+	removeMemberScript = redis.NewScript(`
+for i = 3, #KEYS do
+  if redis.call('SREM', KEYS[i], ARGV[1]) == 1 and redis.call('SCARD', KEYS[i]) == 0 then
+    redis.call('HDEL', KEYS[2], ARGV[i - 1])
+  end
+end
+redis.call('DEL', KEYS[1])
+return 0`)
+
+	// KEYS: old joined, new joined, members of each channel; ARGV: old nick, new nick, each channel
+	renameMemberScript = redis.NewScript(`
+for i = 3, #KEYS do
+  if redis.call('SREM', KEYS[i], ARGV[1]) == 1 then
+    redis.call('SADD', KEYS[i], ARGV[2])
+    redis.call('SADD', KEYS[2], ARGV[i])
+  end
+end
+redis.call('DEL', KEYS[1])
+return 0`)
+)
+
+// Backend shares cluster state in Redis, implementing dircd.ClusterBackend.
+type Backend struct {
+	client    *redis.Client
+	tlsConfig *tls.Config
+	prefix    string
+}
+
+// Option configures a Backend.
+type Option func(*Backend)
+
+// WithPrefix sets the prefix of the keys and pub/sub channel used, eg: to run several
+// networks on one Redis server.
+func WithPrefix(prefix string) Option {
+	return func(b *Backend) {
+		b.prefix = prefix
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for URLs with the rediss:// scheme.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(b *Backend) {
+		b.tlsConfig = config
+	}
+}
+
+// New returns a backend for the Redis server at the URL, eg: "redis://:password@localhost:6379/0",
+// or "rediss://" for TLS. Connections are established on first use, and re-established after any error.
+func New(redisURL string, options ...Option) (*Backend, error) {
+	config, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL [%s]: %w", redisURL, err)
+	}
+
+	backend := &Backend{prefix: "dircd:"}
+	for _, option := range options {
+		option(backend)
+	}
+
+	if config.TLSConfig != nil && backend.tlsConfig != nil {
+		serverName := config.TLSConfig.ServerName
+		config.TLSConfig = backend.tlsConfig.Clone()
+		if config.TLSConfig.ServerName == "" {
+			config.TLSConfig.ServerName = serverName
+		}
+	}
+	config.ContextTimeoutEnabled = true
+
+	backend.client = redis.NewClient(config)
+	return backend, nil
+}
+
+// ClaimNick claims the nick for the owner, reporting whether it was unclaimed or already claimed by the owner.
+func (b *Backend) ClaimNick(ctx context.Context, nick, owner string) (bool, error) {
+	claimed, err := claimScript.Run(ctx, b.client, []string{b.key("nicks"), b.nodeKey(owner)}, nick, owner).Int()
+	return claimed == 1, err
+}
+
+// ReleaseNick releases the nick, and the user registered with it, if it is claimed by the owner.
+func (b *Backend) ReleaseNick(ctx context.Context, nick, owner string) error {
+	keys := []string{b.key("nicks"), b.key("users"), b.nodeKey(owner)}
+	return releaseScript.Run(ctx, b.client, keys, nick, owner).Err()
+}
+
+// SaveUser stores the user registered with the nick.
+func (b *Backend) SaveUser(ctx context.Context, nick string, user dircd.ClusterUser) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return b.client.HSet(ctx, b.key("users"), nick, data).Err()
+}
+
+// Users returns the registered users of every node.
+func (b *Backend) Users(ctx context.Context) ([]dircd.ClusterUser, error) {
+	values, err := b.client.HVals(ctx, b.key("users")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]dircd.ClusterUser, 0, len(values))
+	for _, value := range values {
+		var user dircd.ClusterUser
+		if err = json.Unmarshal([]byte(value), &user); err != nil {
+			return nil, fmt.Errorf("invalid stored user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// AddMember adds the nick to the members of the channel, which is shown with the name.
+func (b *Backend) AddMember(ctx context.Context, channel, name, nick string) error {
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, b.key("channels"), channel, name)
+		pipe.SAdd(ctx, b.key("members:"+channel), nick)
+		pipe.SAdd(ctx, b.key("joined:"+nick), channel)
+		return nil
+	})
+	return err
+}
+
+// RemoveMember removes the nick from the members of the channels it is a member of.
+func (b *Backend) RemoveMember(ctx context.Context, nick string) error {
+	joined := b.key("joined:" + nick)
+	return b.watch(ctx, joined, func(tx *redis.Tx, channels []string) error {
+		keys := append([]string{joined, b.key("channels")}, b.memberKeys(channels)...)
+		args := append([]any{nick}, toArgs(channels)...)
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			removeMemberScript.Eval(ctx, pipe, keys, args...)
+			return nil
+		})
+		return err
+	})
+}
+
+// RenameMember renames the nick in the members of the channels it is a member of.
+func (b *Backend) RenameMember(ctx context.Context, oldNick, newNick string) error {
+	if oldNick == newNick {
+		return nil
+	}
+
+	joined := b.key("joined:" + oldNick)
+	return b.watch(ctx, joined, func(tx *redis.Tx, channels []string) error {
+		keys := append([]string{joined, b.key("joined:" + newNick)}, b.memberKeys(channels)...)
+		args := append([]any{oldNick, newNick}, toArgs(channels)...)
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			renameMemberScript.Eval(ctx, pipe, keys, args...)
+			return nil
+		})
+		return err
+	})
+}
+
+// Members returns the nicks of the members of every channel, by channel name.
+func (b *Backend) Members(ctx context.Context) (map[string][]string, error) {
+	channels, err := b.client.HGetAll(ctx, b.key("channels")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(map[string]*redis.StringSliceCmd, len(channels))
+	_, err = b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for channel, name := range channels {
+			replies[name] = pipe.SMembers(ctx, b.key("members:"+channel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string][]string, len(replies))
+	for name, reply := range replies {
+		members[name] = reply.Val()
+	}
+	return members, nil
+}
+
+// Heartbeat marks the node as alive for the ttl.
+func (b *Backend) Heartbeat(ctx context.Context, node string, ttl time.Duration) error {
+	expiry := float64(time.Now().Add(ttl).UnixMilli())
+	return b.client.ZAdd(ctx, b.key("nodes"), redis.Z{Score: expiry, Member: node}).Err()
+}
+
+// ExpiredNodes returns the nodes whose last heartbeat has expired.
+func (b *Backend) ExpiredNodes(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return b.client.ZRangeByScore(ctx, b.key("nodes"), &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+}
+
+// RemoveNode removes the node, releasing its nicks and their channel memberships.
+func (b *Backend) RemoveNode(ctx context.Context, node string) error {
+	nodeKey := b.key("node:" + node)
+	nicks, err := b.client.SMembers(ctx, nodeKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, nick := range nicks {
+		owner, err := b.client.HGet(ctx, b.key("nicks"), nick).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if owned, _, _ := strings.Cut(owner, "/"); owned != node {
+			continue // Claimed by another node since.
+		}
+
+		if err = b.RemoveMember(ctx, nick); err != nil {
+			return err
+		}
+		if err = b.ReleaseNick(ctx, nick, owner); err != nil {
+			return err
+		}
+	}
+
+	_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, nodeKey)
+		pipe.ZRem(ctx, b.key("nodes"), node)
+		return nil
+	})
+	return err
+}
+
+// Publish sends the payload to every node subscribed.
+func (b *Backend) Publish(ctx context.Context, payload []byte) error {
+	return b.client.Publish(ctx, b.key("events"), payload).Err()
+}
+
+// Subscribe calls the handler with each payload published, on a dedicated connection,
+// until the context is cancelled or the connection fails.
+func (b *Backend) Subscribe(ctx context.Context, handler func(payload []byte)) error {
+	pubsub := b.client.Subscribe(ctx, b.key("events"))
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed, so that a failure is reported at once.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = pubsub.Close() })
+	defer stop()
+
+	for {
+		message, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		handler([]byte(message.Payload))
+	}
+}
+
+// Close closes the connections of the client.
+func (b *Backend) Close() error {
+	return b.client.Close()
+}
+
+// key returns the prefixed key.
+func (b *Backend) key(name string) string {
+	return b.prefix + name
+}
+
+// nodeKey returns the key of the set of nicks claimed on the node of the owner.
+func (b *Backend) nodeKey(owner string) string {
+	node, _, _ := strings.Cut(owner, "/")
+	return b.key("node:" + node)
+}
+
+// memberKeys returns the keys of the members of the channels.
+func (b *Backend) memberKeys(channels []string) []string {
+	keys := make([]string, len(channels))
+	for i, channel := range channels {
+		keys[i] = b.key("members:" + channel)
+	}
+	return keys
+}
+
+// watch calls the update with the channels in the joined set, in a transaction which fails
+// if the set is changed before the update is made, attempting it again if so.
+func (b *Backend) watch(ctx context.Context, joined string, update func(tx *redis.Tx, channels []string) error) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err := b.client.Watch(ctx, func(tx *redis.Tx) error {
+			channels, err := tx.SMembers(ctx, joined).Result()
+			if err != nil {
+				return err
+			}
+			return update(tx, channels)
+		}, joined)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s was changed by %d concurrent updates", joined, maxAttempts)
+}
+
+// toArgs returns the strings as script arguments.
+func toArgs(values []string) []any {
+	args := make([]any, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+var _ dircd.ClusterBackend = (*Backend)(nil)
@@ -0,0 +1,57 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// claimBackend is a ClusterBackend whose nick claims are answered by the claim function.
+type claimBackend struct {
+	ClusterBackend
+	claim  func(nick string) (bool, error)
+	claims []string
+}
+
+func (b *claimBackend) ClaimNick(_ context.Context, nick, _ string) (bool, error) {
+	b.claims = append(b.claims, nick)
+	return b.claim(nick)
+}
+
+func TestClusterClaimNick(t *testing.T) {
+	backend := &claimBackend{claim: func(nick string) (bool, error) {
+		switch nick {
+		case "taken":
+			return false, nil
+		case "down":
+			return false, errors.New("connection refused")
+		}
+		return true, nil
+	}}
+
+	srv, err := NewServer(WithHostname("irc.example.net"), WithCasemapping(CasemapRFC1459), WithCluster(backend))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	srv.cluster.logger = srv.logger
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK Taken")
+	expect(" 433 * Taken ")
+	route("NICK Down")
+	expect(" 263 * NICK :Please wait a while and try again")
+	route("NICK Nick[")
+	route("USER nick 0 * :Nick")
+	expect(" 001 Nick[ ")
+
+	assert.Equal(t, []string{"taken", "down", "nick{"}, backend.claims, "nicks are claimed casefolded")
+}
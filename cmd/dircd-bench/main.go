@@ -0,0 +1,111 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Command dircd-bench loads an IRC server with clients joined to channels exchanging
+// messages at a configured rate, and reports the throughput, latency and allocations
+// measured.
+//
+// Without -addr, a dircd server is started in the process and served on a loopback
+// socket, so that the allocations reported are those of the server and of the clients.
+// With -addr, the server at the address is loaded instead, and only the allocations of
+// the clients are reported.
+//
+//	dircd-bench -clients 1000 -channels 50 -rate 2 -duration 30s
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	irc "github.com/btnmasher/dircd"
+	"github.com/btnmasher/dircd/irctest"
+)
+
+func main() {
+	var cfg irctest.LoadConfig
+	addr := flag.String("addr", "", "address of the server to load, eg: localhost:6667; a server is started in-process if empty")
+	flag.IntVar(&cfg.Clients, "clients", 100, "number of clients")
+	flag.IntVar(&cfg.Channels, "channels", 10, "number of channels the clients are spread across")
+	flag.Float64Var(&cfg.Rate, "rate", 1, "messages sent per second by each client, unthrottled if zero")
+	flag.DurationVar(&cfg.Duration, "duration", 10*time.Second, "how long the clients send messages, unlimited if zero")
+	flag.IntVar(&cfg.Messages, "messages", 0, "messages sent by all the clients in total, unlimited if zero")
+	flag.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "how long to wait for registration, and for messages to be delivered")
+	flag.Parse()
+
+	if err := run(*addr, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "dircd-bench:", err)
+		os.Exit(1)
+	}
+}
+
+func run(addr string, cfg irctest.LoadConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if len(addr) == 0 {
+		serverAddr, closeServer, err := startServer()
+		if err != nil {
+			return err
+		}
+		defer closeServer()
+		addr = serverAddr
+	}
+
+	load, err := irctest.NewLoad(cfg, func() (net.Conn, error) { return net.Dial("tcp", addr) })
+	if err != nil {
+		return err
+	}
+	defer load.Close()
+
+	fmt.Printf("connecting %d clients to %s across %d channels\n", cfg.Clients, addr, cfg.Channels)
+	if err := load.Connect(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println("sending messages")
+	report, err := load.Run(ctx)
+	fmt.Println(report)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// startServer starts a server in the process, listening on a loopback address, returning
+// the address and a function closing the server.
+func startServer() (string, func(), error) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	server, err := irc.NewServer(
+		irc.WithHostname("irc.localhost.net"),
+		irc.WithNetwork("dircd.net"),
+		irc.WithLogger(logger),
+		irc.WithLogLevel(logrus.WarnLevel),
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := server.Start(); err != nil {
+		return "", nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go func() { _ = server.Serve(listener) }()
+	return listener.Addr().String(), func() { _ = server.Close() }, nil
+}
@@ -38,6 +38,10 @@ func main() {
 	server, cfgErr := irc.NewServer(
 		irc.WithHostname("irc.localhost.net"),
 		irc.WithNetwork("dircd.net"),
+		irc.WithListener("localhost:6667"),
+		//irc.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		//irc.WithListener("localhost:6697", irc.ListenerTLS()),
+		//irc.WithListener("localhost:8097", irc.ListenerTLS(), irc.ListenerWebSocket()),
 		irc.WithLogger(logger),
 		irc.WithLogLevel(logrus.DebugLevel),
 		irc.WithDefaultLogFormatter(),
@@ -57,6 +61,22 @@ func main() {
 	killSignals := make(chan os.Signal, 1)
 	signal.Notify(killSignals, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGUSR2 restarts the server in place, eg: after upgrading the binary, handing the
+	// listening sockets over to the new process and draining connections from this one.
+	restart := make(chan os.Signal, 1)
+	if len(restartSignals) > 0 {
+		signal.Notify(restart, restartSignals...)
+	}
+
+	go func() {
+		for sig := range restart {
+			log.Infof("restarting server, received signal: %s", sig)
+			if err := server.Restart(shutdownTimeout); err != nil {
+				log.Error(fmt.Errorf("failed to restart server: %w", err))
+			}
+		}
+	}()
+
 	go func() {
 		sig := <-killSignals
 		log.Infof("initializing server shutdown, received signal: %s", sig)
@@ -0,0 +1,16 @@
+//go:build !unix
+
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package main
+
+import "os"
+
+// restartSignals are the signals which trigger a graceful restart of the server.
+// Listener handover is not supported on this platform.
+var restartSignals []os.Signal
@@ -13,23 +13,53 @@ const (
 	CmdAny = "*"
 
 	// RFC 1459
-	CmdPrivMsg  = "PRIVMSG"
-	CmdNotice   = "NOTICE"
-	CmdUserhost = "USERHOST"
-	CmdPass     = "PASS"
-	CmdPing     = "PING"
-	CmdPong     = "PONG"
-	CmdTopic    = "TOPIC"
-	CmdJoin     = "JOIN"
-	CmdPart     = "PART"
-	CmdKick     = "KICK"
-	CmdQuit     = "QUIT"
-	CmdNick     = "NICK"
-	CmdUser     = "USER"
-	CmdMode     = "MODE"
-	CmdWallops  = "WALLOPS"
-	CmdInvite   = "INVITE"
-	CmdKill     = "KILL"
+	CmdPrivMsg   = "PRIVMSG"
+	CmdNotice    = "NOTICE"
+	CmdUserhost  = "USERHOST"
+	CmdPass      = "PASS"
+	CmdPing      = "PING"
+	CmdPong      = "PONG"
+	CmdTopic     = "TOPIC"
+	CmdJoin      = "JOIN"
+	CmdPart      = "PART"
+	CmdKick      = "KICK"
+	CmdQuit      = "QUIT"
+	CmdNick      = "NICK"
+	CmdUser      = "USER"
+	CmdMode      = "MODE"
+	CmdWallops   = "WALLOPS"
+	CmdInvite    = "INVITE"
+	CmdKill      = "KILL"
+	CmdWhois     = "WHOIS"
+	CmdOper      = "OPER"
+	CmdChallenge = "CHALLENGE"
+	CmdStats     = "STATS"
+	CmdKLine     = "KLINE"
+	CmdUnKLine   = "UNKLINE"
+	CmdBanInfo   = "BANINFO"
+	CmdShun      = "SHUN"
+	CmdUnShun    = "UNSHUN"
+	CmdAdmin     = "ADMIN"
+	CmdInfo      = "INFO"
+	CmdVersion   = "VERSION"
+	CmdTime      = "TIME"
+	CmdHelp      = "HELP"
+	CmdLinks     = "LINKS"
+	CmdList      = "LIST"
+
+	// Operator
+	CmdLockdown     = "LOCKDOWN"
+	CmdGlobops      = "GLOBOPS"
+	CmdGlobalNotice = "GLOBALNOTICE"
+	CmdAudit        = "AUDIT"
+	CmdFilter       = "FILTER"
+	CmdCensor       = "CENSOR"
+	CmdDebug        = "DEBUG"
+	CmdDrain        = "DRAIN"
+	CmdRehash       = "REHASH"
+	CmdConnect      = "CONNECT"
+	CmdSquit        = "SQUIT"
+	CmdMap          = "MAP"
 
 	// CTCP
 	CmdCTCPPing       = "CTCP PING"
@@ -41,6 +71,7 @@ const (
 	CmdCTCPError      = "CTCP ERRMSG"
 	CmdCTCPFinger     = "CTCP FINGER"
 	CmdCTCPAction     = "CTCP ACTION"
+	CmdCTCPDCC        = "CTCP DCC"
 
 	// IRCv3 Base
 	CmdCap      = "CAP"
@@ -54,9 +85,23 @@ const (
 	CmdMetadata = "METADATA"
 	CmdError    = "ERROR"
 
+	// IRCv3 tls
+	CmdStartTLS = "STARTTLS"
+
+	// Account certificate fingerprints
+	CmdCertFP = "CERTFP"
+
 	// IRCv3 account-notify
 	CmdAccount = "ACCOUNT"
 
 	// IRCv3 away-notify
 	CmdAway = "AWAY"
+
+	// IRCv3 batch
+	CmdBatch = "BATCH"
+
+	// IRCv3 standard replies
+	CmdFail = "FAIL"
+	CmdWarn = "WARN"
+	CmdNote = "NOTE"
 )
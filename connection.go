@@ -11,7 +11,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -20,24 +19,23 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/sourcegraph/conc/panics"
 
-	"github.com/btnmasher/dircd/shared/safemap"
-
 	"github.com/btnmasher/dircd/shared/random"
 )
 
 // Conn represents the server side of an IRC connection.
 type Conn struct {
 	mu            sync.RWMutex
-	logger        *logrus.Entry
+	logger        Logger
 	ctx           context.Context
 	cancel        context.CancelCauseFunc
 	curState      atomic.Uint64
 	registered    atomic.Bool
 	shuttingDown  atomic.Bool
 	timeoutForced atomic.Bool
+	departed      atomic.Bool // The quit or kill of the user has been published as an event.
+	nickLost      atomic.Bool // Registration awaits a new nick, the one given having been claimed first by another user.
 
 	// server is the server on which the connection arrived.
 	// Immutable; never nil.
@@ -51,53 +49,162 @@ type Conn struct {
 	// *tls.Conn.
 	sock net.Conn
 
+	// sockMu guards sock and outgoing, which are replaced in place when
+	// the connection is upgraded with STARTTLS.
+	sockMu sync.Mutex
+
+	// listener is the configuration of the listener on which the connection arrived.
+	// Immutable; never nil.
+	listener *listenerConfig
+
 	// remAddr is sock.RemoteAddr().String(). It is not populated synchronously
 	// inside the Listener's Accept goroutine, as some implementations block.
 	// It is populated immediately inside the (*Conn).serve goroutine.
 	remAddr string
 
-	user     *User
-	channels ChanMap
+	user *User
+
+	// caps is the CapSet of the capabilities enabled by the client, read from any
+	// goroutine relaying messages to the connection.
+	caps atomic.Uint64
+
+	// capState is the state of the capability negotiation, only accessed from the read
+	// loop goroutine.
+	capState capNegotiation
+
+	// certfp is the SHA-256 fingerprint of the TLS client certificate, if one was presented.
+	certfp string
+
+	// secure is whether the connection is over TLS, and cipher the version and cipher
+	// suite negotiated, eg: "TLS 1.3 TLS_AES_128_GCM_SHA256".
+	secure bool
+	cipher string
+
+	// lastBroadcast is when the operator last sent a global notice or GLOBOPS.
+	// It is only accessed from the read loop goroutine.
+	lastBroadcast time.Time
+
+	// challenge is the CHALLENGE the user was last sent, awaiting their signature.
+	// It is only accessed from the read loop goroutine.
+	challenge *operChallenge
+
+	// listCancel cancels the LIST being sent to the user, if any.
+	// It is only accessed from the read loop goroutine.
+	listCancel context.CancelFunc
+
+	// flood limits the rate of messages during a flood lockdown.
+	flood floodBucket
+
+	// class is the connection class of the user, assigned when they register.
+	class atomic.Pointer[connClass]
 
-	capabilities  int
-	capRequested  bool
-	capNegotiated bool
+	// recvFlood delays messages sent faster than the flood limits of the connection class,
+	// and recvExcess counts the bytes of the messages delayed since the user last sent one
+	// within them. They are only accessed from the read loop goroutine.
+	recvFlood  floodBucket
+	recvExcess int
 
-	incoming *bufio.Scanner
-	outgoing *bufio.Writer
+	// sessionReplay is set when the connection has been attached to an existing user
+	// with WithMultiSession, until it has been sent the channels of the user, and the
+	// history kept for them while they had no sessions, see WithAlwaysOn.
+	sessionReplay  bool
+	sessionHistory [][]byte
 
-	writeQueue chan *bytes.Buffer
+	// persisted is set once the user has been kept connected after the connection closed,
+	// or killed, so that they are not kept again, see WithAlwaysOn.
+	persisted atomic.Bool
 
-	heartbeat *time.Timer
+	// rateBuckets limit the rate of commands of each rate class. They are only accessed
+	// from the read loop goroutine.
+	rateBuckets [rateClasses]floodBucket
+
+	// sendQFull is set once the SendQ of the connection class has been exceeded.
+	sendQFull atomic.Bool
+
+	// geo is the location and network of the remote address, if the server has a GeoIP resolver.
+	geo atomic.Pointer[GeoInfo]
+
+	// shun is the shun matching the user, whose commands are ignored while it is set.
+	shun atomic.Pointer[KLine]
+
+	// sasl holds the state of an in-progress SASL AUTHENTICATE exchange.
+	sasl saslSession
+
+	// incoming reads lines into readBuffer, and outgoing buffers the messages written to
+	// the socket, both pooled by the server and released when the connection closes.
+	incoming   *bufio.Scanner
+	outgoing   *bufio.Writer
+	readBuffer *[]byte
+
+	// writeQueue holds the rendered messages waiting to be sent, in a lane per priority.
+	// queueMu guards queueClosed, set once the connection is torn down, after which
+	// nothing more is queued.
+	writeQueue  [writeLanes]chan *bytes.Buffer
+	queueMu     sync.RWMutex
+	queueClosed bool
+
+	heartbeat Timer
 
 	lastPingSent string
 	lastPingRecv string
-}
 
-// pingTimeout sets the PING/PONG timeout duration on the client IRC connections.
-const pingTimeout = 30 * time.Second
+	// Traffic statistics, as reported by STATS l.
+	connected    time.Time
+	sendQueue    atomic.Int64
+	sentMessages atomic.Uint64
+	sentBytes    atomic.Uint64
+	recvMessages atomic.Uint64
+	recvBytes    atomic.Uint64
+}
 
-// writeQueueLength sets the length of each connection's write queue channel.
+// writeQueueLength sets the length of each lane of a connection's write queue.
 const writeQueueLength = 10
 
+// writeLane is a lane of a connection's write queue. The lanes are sent in order of
+// priority, so that control traffic is never starved behind a burst of bulk traffic,
+// which yields to the other lanes after every message.
+type writeLane uint8
+
+// Write queue lanes
+const (
+	laneControl writeLane = iota // PING/PONG and ERROR.
+	laneNormal                   // Replies, messages relayed from users, and server notices.
+	laneBulk                     // Bursts of many replies, such as NAMES.
+	writeLanes
+)
+
+// laneFor returns the write queue lane the message is sent in. Only keepalives and
+// ERROR jump the queue: replies are sent in the normal lane with the messages they
+// follow, such as the JOIN a topic reply is sent after, so that they keep their order.
+func laneFor(msg *Message) writeLane {
+	if msg.Code == 0 && (msg.Command == CmdPing || msg.Command == CmdPong || msg.Command == CmdError) {
+		return laneControl
+	}
+	return laneNormal
+}
+
 // NewConn initializes a new instance of Conn
-func NewConn(ctx context.Context, srv *Server, sck net.Conn, logger *logrus.Entry) *Conn {
+func NewConn(ctx context.Context, srv *Server, sck net.Conn, logger Logger) *Conn {
 	connCtx, cancel := context.WithCancelCause(ctx)
 	conn := &Conn{
-		ctx:        connCtx,
-		cancel:     cancel,
-		logger:     logger.WithField("component", "connection"),
-		server:     srv,
-		sock:       sck,
-		hostname:   srv.Hostname(),
-		heartbeat:  time.NewTimer(pingTimeout),
-		channels:   safemap.NewMutexMap[string, *Channel](),
-		incoming:   bufio.NewScanner(sck),
-		outgoing:   bufio.NewWriter(sck),
-		writeQueue: make(chan *bytes.Buffer, writeQueueLength),
+		ctx:       connCtx,
+		cancel:    cancel,
+		logger:    logger.WithField("component", "connection"),
+		server:    srv,
+		sock:      sck,
+		listener:  &listenerConfig{},
+		hostname:  srv.Hostname(),
+		heartbeat: srv.clock.NewTimer(srv.Timeouts().Ping),
+		outgoing:  srv.buffers.writer(sck),
+	}
+	conn.readBuffer = srv.buffers.readBuffer()
+	conn.incoming = srv.buffers.scanner(sck, conn.readBuffer)
+	for lane := range conn.writeQueue {
+		conn.writeQueue[lane] = make(chan *bytes.Buffer, writeQueueLength)
 	}
 	conn.user = &User{
 		conn: conn,
+		perm: UPermUser,
 	}
 	// TODO: implement test hooks/debug like stdlib?
 	// if debugServerConnections {
@@ -106,6 +213,12 @@ func NewConn(ctx context.Context, srv *Server, sck net.Conn, logger *logrus.Entr
 	return conn
 }
 
+// handshaker is implemented by connection wrappers which must complete a handshake
+// before IRC traffic can flow, such as *tls.Conn and WebSocket connections.
+type handshaker interface {
+	Handshake() error
+}
+
 type ConnState int
 
 const (
@@ -123,7 +236,7 @@ func (conn *Conn) setState(state ConnState) {
 		conn.server.trackConn(conn, false)
 	}
 	if state > 0xff || state < 0 {
-		conn.logger.Panicln("attempted to set invalid connection state")
+		conn.logger.Panic("attempted to set invalid connection state")
 	}
 	packedState := uint64(time.Now().Unix()<<8) | uint64(state)
 	conn.curState.Store(packedState)
@@ -141,16 +254,20 @@ func serve(conn *Conn) {
 	logger.Info("client connection established")
 
 	recovered := panics.Try(func() {
-		if tlsConn, ok := conn.sock.(*tls.Conn); ok {
+		if hsConn, ok := conn.sock.(handshaker); ok {
 			conn.setDeadlines()
 
 			conn.setState(StateHandshake)
-			if tlsErr := tlsConn.Handshake(); tlsErr != nil {
-				logger.Error(fmt.Errorf("error occurred during TLS handshake: %w", tlsErr))
+			if hsErr := hsConn.Handshake(); hsErr != nil {
+				logger.Error(fmt.Errorf("error occurred during connection handshake: %w", hsErr))
 				return
 			}
+			conn.setTLS(conn.sock)
 		}
 		conn.setState(StateConnected)
+		if conn.checkLockdownConnect() || conn.checkGeoConnect() {
+			return
+		}
 
 		logger.Debug("starting reade/write routines")
 		go conn.writeLoop() // Runs until context is cancelled or socket error occurs
@@ -177,16 +294,13 @@ func (conn *Conn) start() {
 
 	//This can block until the address is acquired, so just wait.
 	conn.remAddr = conn.sock.RemoteAddr().String()
+	conn.connected = time.Now()
 
 	conn.setState(StateNew)
 	conn.logger.Debugf("new connection from remote address: [%s]", conn.remAddr)
 	conn.logger = conn.logger.WithField("address", conn.remAddr)
 }
 
-func (conn *Conn) shutdown() {
-	conn.doQuit("Server shutting down.")
-}
-
 func (conn *Conn) isForceTimedOut() bool {
 	return conn.timeoutForced.Load()
 }
@@ -247,16 +361,25 @@ func (conn *Conn) readLoop() {
 			}
 
 			data := conn.incoming.Text()
-			logger.Debugf("received: [%s]", data)
+			conn.logWire(logger, "received", data)
+			conn.recvMessages.Add(1)
+			conn.recvBytes.Add(uint64(len(data) + len(CRLF)))
 
-			msg, parseErr := Parse(data)
+			msg, parseErr := parse(data, conn.maxTagsLength())
 			if parseErr != nil {
-				msgPool.Recycle(msg)
+				if errors.Is(parseErr, ErrMessageTooLong) {
+					conn.ReplyInputTooLong()
+				}
 				logger.Warn(fmt.Errorf("error parsing message from client: %w", parseErr))
 				continue
 			}
 
-			conn.heartbeat.Reset(pingTimeout)
+			conn.heartbeat.Reset(conn.idleTimeout())
+
+			if conn.throttle(len(data) + len(CRLF)) {
+				msgPool.Recycle(msg, msg.Generation())
+				return
+			}
 
 			conn.server.Router.RouteMessage(conn, msg)
 		}
@@ -266,43 +389,196 @@ func (conn *Conn) readLoop() {
 func (conn *Conn) writeLoop() {
 	logger := conn.logger.WithField("sub-component", "writer")
 	defer logger.Debug("writer terminated")
+
+	// The buffered writer is only flushed once nothing more is queued, so that a burst
+	// of messages is sent to the socket in as few writes as the buffer size allows.
+	send := func(buf *bytes.Buffer) {
+		conn.sendQueue.Add(-int64(buf.Len()))
+		conn.writeBuffered(buf, conn.queued() == 0)
+	}
+
 	for {
+		// Higher priority lanes are drained first, a message at a time, so that a burst
+		// in a lower lane yields to anything queued ahead of it between each message.
+		select {
+		case buf := <-conn.writeQueue[laneControl]:
+			send(buf)
+			continue
+		default:
+		}
+
+		select {
+		case buf := <-conn.writeQueue[laneNormal]:
+			send(buf)
+			continue
+		default:
+		}
+
 		select {
 		case <-conn.ctx.Done():
 			conn.setState(StateClosed)
 			logger.Debug("connection context cancelled, closing writer")
 			conn.forceTimeout()
+			conn.closeQueue()
 			return
 
-		case buf := <-conn.writeQueue:
-			conn.write(buf)
+		case buf := <-conn.writeQueue[laneControl]:
+			send(buf)
+
+		case buf := <-conn.writeQueue[laneNormal]:
+			send(buf)
 
-		case <-conn.heartbeat.C:
+		case buf := <-conn.writeQueue[laneBulk]:
+			send(buf)
+
+		case <-conn.heartbeat.C():
 			conn.doHeartbeat()
 		}
 	}
 }
 
+// User returns the user of the connection.
+func (conn *Conn) User() *User {
+	return conn.user
+}
+
+// Caps returns the set of the capabilities enabled by the client.
+func (conn *Conn) Caps() CapSet {
+	return CapSet(conn.caps.Load())
+}
+
+// HasCap checks if the client has enabled the capability with the given flag.
+func (conn *Conn) HasCap(flag int) bool {
+	return conn.Caps().Has(flag)
+}
+
+// EnableCap enables the capability with the given flag for the client.
+func (conn *Conn) EnableCap(flag int) {
+	conn.applyCaps(conn.Caps().With(flag))
+}
+
+// applyCaps replaces the set of the capabilities enabled by the client, calling the
+// hooks of those it enables or disables.
+func (conn *Conn) applyCaps(caps CapSet) {
+	previous := CapSet(conn.caps.Swap(uint64(caps)))
+	if previous == caps {
+		return
+	}
+	for _, capability := range conn.server.capabilities.list(false) {
+		switch enabled := caps.Has(capability.flag); {
+		case enabled && !previous.Has(capability.flag) && capability.OnEnable != nil:
+			capability.OnEnable(conn)
+		case !enabled && previous.Has(capability.flag) && capability.OnDisable != nil:
+			capability.OnDisable(conn)
+		}
+	}
+}
+
+// maxTagsLength returns the maximum length of the tags of a line accepted from the user,
+// which is larger once they have negotiated message-tags.
+func (conn *Conn) maxTagsLength() int {
+	if conn.HasCap(MessageTags) {
+		return MaxMessageTagsLength
+	}
+	return MaxTagsLength
+}
+
+// Write queues the rendered message to be sent to the user with normal priority.
 func (conn *Conn) Write(buffer *bytes.Buffer) {
+	conn.queue(buffer, laneNormal)
+}
+
+// WriteMessage renders and queues the message to be sent to the user, prioritizing
+// keepalives and ERROR.
+func (conn *Conn) WriteMessage(msg *Message) {
+	conn.queue(msg.RenderBuffer(), laneFor(msg))
+}
+
+// queue hands the rendered message to the write loop in the given lane. Once the
+// connection has been torn down, the message is dropped.
+func (conn *Conn) queue(buffer *bytes.Buffer, lane writeLane) {
+	conn.queueMu.RLock()
+	defer conn.queueMu.RUnlock()
+
+	if conn.queueClosed {
+		bufPool.Recycle(buffer)
+		return
+	}
+
 	if buffer.Len() > MaxMsgLength {
 		conn.logger.Error("error rendering message to buffer, message too long")
+		bufPool.Recycle(buffer)
 		return
 	}
 
 	if !conn.isConnected() {
 		conn.logger.Error("attempted write on unready connection")
+		bufPool.Recycle(buffer)
+		return
+	}
+
+	if conn.sendQExceeded(buffer.Len()) {
+		bufPool.Recycle(buffer)
 		return
 	}
 
-	conn.writeQueue <- buffer // Hand message context over to the write loop goroutine here.
+	conn.sendQueue.Add(int64(buffer.Len()))
+	select {
+	case conn.writeQueue[lane] <- buffer: // Hand message context over to the write loop goroutine here.
+	case <-conn.ctx.Done():
+		// The write loop is exiting, or never ran, and may never receive from a full lane.
+		conn.sendQueue.Add(-int64(buffer.Len()))
+		bufPool.Recycle(buffer)
+	}
+}
+
+// closeQueue closes the write queue, once the connection context has been cancelled,
+// recycling the messages left in it. Queuing a message afterwards is a no-op. The lanes
+// themselves are left open, as the write loop may still be receiving from them.
+func (conn *Conn) closeQueue() {
+	// Writers blocked on a full lane return once the context is cancelled, releasing
+	// their read locks.
+	conn.queueMu.Lock()
+	defer conn.queueMu.Unlock()
+	if conn.queueClosed {
+		return
+	}
+	conn.queueClosed = true
+
+	for _, lane := range conn.writeQueue {
+		for drained := false; !drained; {
+			select {
+			case buffer := <-lane:
+				conn.sendQueue.Add(-int64(buffer.Len()))
+				bufPool.Recycle(buffer)
+			default:
+				drained = true
+			}
+		}
+	}
 }
 
+// write sends the rendered message to the socket immediately.
 func (conn *Conn) write(buffer *bytes.Buffer) {
+	conn.writeBuffered(buffer, true)
+}
+
+// writeBuffered writes the rendered message through the buffered writer, flushing it to
+// the socket if requested. Once the connection has released its buffers, the message is
+// dropped.
+func (conn *Conn) writeBuffered(buffer *bytes.Buffer, flush bool) {
 	defer bufPool.Recycle(buffer)
 	logger := conn.logger.WithField("sub-component", "writer")
 
+	conn.sockMu.Lock()
+	defer conn.sockMu.Unlock()
+
+	if conn.outgoing == nil {
+		return
+	}
+
 	recovered := panics.Try(func() {
-		conn.setWriteDeadline()
+		_ = conn.sock.SetWriteDeadline(time.Now().Add(conn.writeTimeout()))
 
 		if _, writeErr := conn.outgoing.Write(buffer.Bytes()); writeErr != nil {
 			conn.setState(StateClosed)
@@ -311,14 +587,18 @@ func (conn *Conn) write(buffer *bytes.Buffer) {
 			return
 		}
 
-		if flushErr := conn.outgoing.Flush(); flushErr != nil {
-			conn.setState(StateClosed)
-			logger.Error(fmt.Errorf("error writing to socket: %w", flushErr))
-			conn.doQuit("Socket Error.")
-			return
+		if flush {
+			if flushErr := conn.outgoing.Flush(); flushErr != nil {
+				conn.setState(StateClosed)
+				logger.Error(fmt.Errorf("error writing to socket: %w", flushErr))
+				conn.doQuit("Socket Error.")
+				return
+			}
 		}
 
-		logger.Debugf("sent: [%s]", strings.TrimSpace(buffer.String()))
+		conn.sentMessages.Add(1)
+		conn.sentBytes.Add(uint64(buffer.Len()))
+		conn.logWire(logger, "sent", strings.TrimSpace(buffer.String()))
 	})
 
 	panicErr := recovered.AsError()
@@ -345,49 +625,151 @@ func (conn *Conn) doHeartbeat() {
 
 	str := random.String(10)
 	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
 	msg.Command = CmdPing
 	msg.Trailing = str
 	conn.lastPingSent = str
-	conn.heartbeat.Reset(pingTimeout)
-	conn.Write(msg.RenderBuffer())
+	conn.heartbeat.Reset(conn.idleTimeout())
+	conn.WriteMessage(msg)
 }
 
+// replyCannotSend replies that the message the user sent to the target user, if any,
+// or else the target channel, was rejected, with the reason it was rejected.
+func (conn *Conn) replyCannotSend(targetUser *User, target, reason string) {
+	if targetUser != nil {
+		conn.ReplyCannotSendToUser(targetUser.Nick(), reason)
+		return
+	}
+	conn.ReplyCannotSendToChan(target, reason)
+}
+
+// doChatMessage delivers a PRIVMSG or NOTICE to its target user or channel. A PRIVMSG
+// which cannot be delivered is replied to with the reason, while a NOTICE is silently
+// dropped, as notices must never be automatically replied to.
 func (conn *Conn) doChatMessage(msg *Message) {
-	if !enoughParams(msg, 1) || len(msg.Trailing) == 0 {
-		conn.ReplyNeedMoreParams(msg.Command)
+	notice := msg.Command == CmdNotice
+
+	// The trailing-only form, eg: "PRIVMSG :text", has no recipient, and a lone target,
+	// eg: "PRIVMSG nick", no text, the parser having copied the target to the trailing.
+	if len(msg.Params) == 0 {
+		if !notice {
+			conn.ReplyNoRecipient(msg.Command)
+		}
+		return
+	}
+
+	if len(msg.Trailing) == 0 || (msg.trailingImplied && len(msg.Params) == 1) {
+		if !notice {
+			conn.ReplyNoTextToSend()
+		}
+		return
+	}
+
+	if conn.checkUTF8(msg) || conn.checkLockdownFlood(msg) {
 		return
 	}
 
 	// TODO: Send Message permission check
-	target := strings.ToLower(msg.Params[0])
+	target := msg.Params[0]
+
+	if target == playbackTarget && conn.HasCap(ZNCPlayback) {
+		conn.doPlayback(msg.Trailing)
+		return
+	}
 
 	targetUser, userExists := conn.server.Nicks.Get(target)
 	var targetChannel *Channel
 	var chanExists bool
 	if !userExists {
-		// Check if the target is a channel first in the user's connection context (most common path)
-		// to avoid a contentious read on the server's map
-		targetChannel, chanExists = conn.channels.Get(target)
-
-		if !chanExists {
-			// Didn't find it on the user's context, try the server's
-			targetChannel, chanExists = conn.server.Channels.Get(target)
-		}
+		targetChannel, chanExists = conn.server.Channels.Get(target)
 	}
 
 	if !userExists && !chanExists {
+		if !notice && conn.doInternalService(target, msg.Trailing) {
+			return
+		}
 		conn.logger.WithField("operation", "doChat").Debug("did not find target")
-		conn.ReplyNoSuchNick(msg.Params[0])
+		if notice {
+			return
+		}
+		if isChannelName(target) {
+			conn.ReplyNoSuchChan(target)
+		} else {
+			conn.ReplyNoSuchNick(target)
+		}
+		return
+	}
+
+	if targetChannel != nil {
+		if sendErr := targetChannel.checkSend(conn.user); sendErr != nil {
+			if !notice {
+				conn.ReplyCannotSendToChan(targetChannel.Name(), sendErr.Error())
+			}
+			return
+		}
+	}
+
+	if targetUser != nil && targetUser.ModeIsSet(UModeSecureOnly) && !conn.Secure() {
+		if !notice {
+			conn.ReplyCannotSendToUser(targetUser.Nick(), ErrSecureOnly.Error())
+		}
 		return
 	}
 
 	msg.Params = msg.Params[0:1] // Strip erroneous parameters.
 	msg.Source = conn.user.Hostmask()
 
+	if conn.checkCTCP(msg, targetUser, targetChannel) {
+		return
+	}
+
+	if rule := conn.checkFilter(FilterText, msg.Trailing); rule != nil {
+		if rule.Action == FilterBlock && !notice {
+			conn.replyCannotSend(targetUser, msg.Params[0], rule.Reason)
+		}
+		return
+	}
+
+	if conn.checkCensor(msg, targetUser, targetChannel) {
+		return
+	}
+
+	if hookErr := conn.server.runPreMessage(conn, msg); hookErr != nil {
+		if !notice {
+			conn.replyCannotSend(targetUser, msg.Params[0], hookErr.Error())
+		}
+		return
+	}
+
+	event := userEvent(EventMessage, conn.user)
+	event.Action = msg.Command
+	event.Target = msg.Params[0]
+	event.Text = msg.Trailing
+
+	self := targetUser == conn.user
 	if targetUser != nil {
-		targetUser.conn.Write(msg.RenderBuffer())
+		if targetUser.conn != nil && !self { // Remote users receive it from the event.
+			targetUser.Write(msg.RenderBuffer())
+		}
 	} else {
 		targetChannel.Send(msg, conn.user.Nick())
+		event.Channel = targetChannel.Name()
+	}
+
+	// A message to oneself is delivered once, whether or not it is also their echo.
+	conn.echo(msg, self)
+
+	conn.server.publish(event)
+}
+
+// echo sends the user a copy of a message they sent, as delivered to its target: to the
+// connection it was sent from if the message was to themself or they negotiated
+// echo-message, and always to their other sessions, see WithMultiSession.
+func (conn *Conn) echo(msg *Message, self bool) {
+	for _, session := range conn.user.Sessions() {
+		if session != conn || self || conn.HasCap(EchoMessage) {
+			session.Write(msg.RenderBuffer())
+		}
 	}
 }
 
@@ -403,22 +785,34 @@ func (conn *Conn) doKill(reason, source string) {
 
 	if !conn.isClosed() {
 		reply := conn.newMessage()
+		generation := reply.Generation()
 		reply.Command = CmdError
 		reply.Trailing = fmt.Sprintf("Closing link: %s [Killed: [%s [%s]]]", conn.server.Hostname(), source, reason)
-		conn.Write(reply.RenderBuffer())
+		conn.WriteMessage(reply)
+		msgPool.Recycle(reply, generation)
+	}
+
+	// Killed users are not kept always-on, only connected through their other sessions.
+	conn.persisted.Store(true)
+	if conn.user.detach(conn) {
+		conn.cancel(fmt.Errorf("kill called with reason: %s", reason))
+		return
 	}
 
-	if conn.channels.Length() > 0 && conn.isRegistered() {
+	if channels := conn.user.Channels(); len(channels) > 0 && conn.isRegistered() {
 		logger.Debug("quitting user from joined channels")
 		msg := msgPool.New()
+		generation := msg.Generation()
 		msg.Source = conn.user.Hostmask()
 		msg.Command = CmdQuit
 		msg.Trailing = fmt.Sprintf("Killed: [%s [%s]]", source, reason)
 		nick := conn.user.Nick()
-		chanErr := conn.channels.ForEach(func(name string, channel *Channel) error {
-			return channel.RemoveUser(nick, msg)
-		})
-		conn.channels.Clear()
+		conn.server.sendQuit(conn.user, msg)
+		msgPool.Recycle(msg, generation)
+		var chanErr error
+		for _, channel := range channels {
+			chanErr = errors.Join(chanErr, channel.removeMember(nick))
+		}
 		logger.Debug("user channels cleared")
 		if chanErr != nil {
 			errs := chanErr.(interface{ Unwrap() []error }).Unwrap()
@@ -428,6 +822,13 @@ func (conn *Conn) doKill(reason, source string) {
 		}
 	}
 
+	if conn.departed.CompareAndSwap(false, true) {
+		event := userEvent(EventUserKilled, conn.user)
+		event.Actor = source
+		event.Reason = reason
+		conn.server.publish(event)
+	}
+
 	conn.cancel(fmt.Errorf("kill called with reason: %s", reason))
 }
 
@@ -441,23 +842,34 @@ func (conn *Conn) doQuit(reason string) {
 
 	if !conn.isClosed() {
 		reply := conn.newMessage()
+		generation := reply.Generation()
 		reply.Command = CmdError
 		reply.Trailing = fmt.Sprintf("Closing link: %s [Quit: %s]", conn.user.Hostmask(), reason)
 		conn.write(reply.RenderBuffer())
+		msgPool.Recycle(reply, generation)
 		conn.shuttingDown.Store(true)
 	}
 
-	if conn.channels.Length() > 0 && conn.isRegistered() {
+	// The user stays connected through their other sessions, or if always-on.
+	if conn.user.detach(conn) || conn.persist() {
+		conn.cancel(fmt.Errorf("quit called with reason: %s", reason))
+		return
+	}
+
+	if channels := conn.user.Channels(); len(channels) > 0 && conn.isRegistered() {
 		msg := msgPool.New()
+		generation := msg.Generation()
 		msg.Source = conn.user.Hostmask()
 		msg.Command = CmdQuit
 		msg.Trailing = reason
 
 		nick := conn.user.Nick()
-		chanErr := conn.channels.ForEach(func(name string, channel *Channel) error {
-			return channel.RemoveUser(nick, msg)
-		})
-		conn.channels.Clear()
+		conn.server.sendQuit(conn.user, msg)
+		msgPool.Recycle(msg, generation)
+		var chanErr error
+		for _, channel := range channels {
+			chanErr = errors.Join(chanErr, channel.removeMember(nick))
+		}
 		if chanErr != nil {
 			errs := chanErr.(interface{ Unwrap() []error }).Unwrap()
 			for i := range errs {
@@ -466,50 +878,143 @@ func (conn *Conn) doQuit(reason string) {
 		}
 	}
 
+	if conn.isRegistered() && conn.departed.CompareAndSwap(false, true) {
+		event := userEvent(EventUserQuit, conn.user)
+		event.Reason = reason
+		conn.server.publish(event)
+	}
+
 	conn.cancel(fmt.Errorf("quit called with reason: %s", reason))
 }
 
-func (conn *Conn) registerUser() {
+// changeNick changes the nick of the registered user, announcing it to the user and
+// the members of their channels. The user keeps their nick if it cannot be changed.
+func (conn *Conn) changeNick(newNick string) error {
+	oldNick, err := conn.server.Registry.Rename(conn.user, newNick)
+	if err != nil && !errors.Is(err, ErrNickInUse) {
+		conn.logger.WithField("operation", "nick").
+			Error(fmt.Errorf("error changing nick [%s] to [%s]: %w", oldNick, newNick, err))
+	}
+	return err
+}
+
+// registerUser registers the user by their nick, reporting false, with the user left
+// unregistered, if another user claimed the nick first.
+func (conn *Conn) registerUser() bool {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
-	conn.registered.Store(true)
 	name := conn.user.Name()
 	nick := conn.user.Nick()
+	if err := conn.server.Registry.Claim(conn.user); err != nil {
+		return false
+	}
+	conn.registered.Store(true)
+	uid := conn.server.newUID()
+
+	conn.user.mu.Lock()
+	conn.user.uid = uid
+	if conn.secure || conn.listener.tls {
+		conn.user.mode |= UModeSecured
+	}
+	conn.user.mu.Unlock()
+
 	conn.server.Users.Set(name, conn.user)
-	conn.server.Nicks.Set(nick, conn.user)
+	conn.server.uids.Set(uid, conn.user)
 	conn.logger.Debugf("registered user: %s - %s", name, nick)
+	conn.server.publish(userEvent(EventUserRegistered, conn.user))
+	return true
+}
+
+// completeRegistration registers the user, and welcomes them unless capability
+// negotiation is in progress. If another user claimed their nick first, the user is
+// told so, and registration is completed once they choose another nick, unless they are
+// given a guest nick with WithGuestNicks.
+func (conn *Conn) completeRegistration() {
+	if !conn.attachSession() {
+		// With multi-session, the username may have been let through for a user the
+		// connection was not attached to after all.
+		if holder, exists := conn.server.Users.Get(conn.user.Name()); exists && holder != conn.user {
+			conn.ReplyNumeric(ReplyAlreadyRegistered, ErrUserInUse.String())
+			return
+		}
+		for attempt := 0; !conn.registerUser(); attempt++ {
+			if attempt == guestNickAttempts || !conn.assignGuestNick(ErrNickInUse.Error()) {
+				conn.nickLost.Store(true)
+				conn.ReplyNumeric(ReplyNicknameInUse, conn.user.Nick())
+				return
+			}
+		}
+	}
+
+	if conn.capState != capNegotiating {
+		conn.welcome()
+	}
+}
+
+// welcome welcomes the registered user, unless they are turned away by a lockdown or
+// their location, sending a session attached to an existing user its channels.
+func (conn *Conn) welcome() {
+	if conn.checkLockdownRegister() || conn.checkGeoRegister() {
+		return
+	}
+	conn.ReplyWelcome()
+	conn.ReplyISupport()
+	conn.replaySession()
+	conn.deliverMemos()
 }
 
 func (conn *Conn) cleanup() {
 	defer func() {
-		closeErr := conn.sock.Close()
+		closeErr := conn.socket().Close()
 		if closeErr != nil {
 			conn.logger.Error(fmt.Errorf("error occurred closing socket: %w", closeErr))
 		}
+		conn.releaseBuffers()
 	}()
 	conn.setState(StateClosed)
+	conn.cancel(errors.New("connection closed"))
+	conn.closeQueue()
 	conn.logger.Debug("cleaning up connection state from server")
+	conn.releaseClass()
+	if conn.user.detach(conn) || conn.persist() {
+		conn.logger.Debugf("detached session from user: %s", conn.user.Nick())
+		return
+	}
+	conn.unregister()
+}
+
+// unregister removes the user of the connection from the server.
+func (conn *Conn) unregister() {
 	name := conn.user.Name()
 	nick := conn.user.Nick()
 	conn.server.Users.Delete(name)
 	conn.server.Nicks.Delete(nick)
+	conn.server.uids.Delete(conn.user.UID())
+	if conn.server.cluster != nil {
+		conn.server.cluster.releaseNick(conn, nick)
+	}
 	conn.logger.Debugf("cleaned up user: %s - %s", name, nick)
 }
 
-// writeTimeout sets the write timeout duration on the client IRC connections.
-const writeTimeout = 5 * time.Second
+// socket returns the current underlying network connection, which may have
+// been replaced by a STARTTLS upgrade.
+func (conn *Conn) socket() net.Conn {
+	conn.sockMu.Lock()
+	defer conn.sockMu.Unlock()
+	return conn.sock
+}
 
 func (conn *Conn) setWriteDeadline() {
-	_ = conn.sock.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_ = conn.socket().SetWriteDeadline(time.Now().Add(conn.writeTimeout()))
 }
 
 func (conn *Conn) setReadDeadline() {
-	_ = conn.sock.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+	_ = conn.socket().SetReadDeadline(time.Now().Add(conn.keepAliveTimeout()))
 }
 
 func (conn *Conn) forceTimeout() {
 	conn.timeoutForced.Store(true)
-	_ = conn.sock.SetReadDeadline(time.Now().Add(time.Microsecond))
+	_ = conn.socket().SetReadDeadline(time.Now().Add(time.Microsecond))
 }
 
 func (conn *Conn) setDeadlines() {
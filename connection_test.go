@@ -0,0 +1,133 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAfterTeardown(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+
+	newBuffer := func() {
+		buffer := bufPool.New()
+		buffer.WriteString("PING :dircd\r\n")
+		conn.Write(buffer)
+	}
+
+	// Without a write loop, the lane fills up and the next write blocks.
+	for i := 0; i < writeQueueLength; i++ {
+		newBuffer()
+	}
+	blocked := make(chan struct{})
+	go func() {
+		newBuffer()
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("write to a full lane did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Tearing the connection down releases the blocked write and drains the queue.
+	conn.cancel(errors.New("closed"))
+	conn.closeQueue()
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not released by the teardown")
+	}
+	assert.Zero(t, conn.sendQueue.Load())
+	assert.Empty(t, conn.writeQueue[laneNormal])
+
+	// Writes after the teardown are dropped.
+	newBuffer()
+	assert.Empty(t, conn.writeQueue[laneNormal])
+	assert.Zero(t, conn.sendQueue.Load())
+	conn.closeQueue()
+}
+
+func TestLaneFor(t *testing.T) {
+	for command, lane := range map[string]writeLane{
+		CmdPing:    laneControl,
+		CmdPong:    laneControl,
+		CmdError:   laneControl,
+		CmdFail:    laneNormal,
+		CmdJoin:    laneNormal,
+		CmdPrivMsg: laneNormal,
+	} {
+		assert.Equal(t, lane, laneFor(&Message{Command: command}), command)
+	}
+	assert.Equal(t, laneNormal, laneFor(&Message{Code: ReplyChanTopic}))
+}
+
+func TestLaneOrder(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeAlice, _ := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	channel.SetTopicBy("IRC daemon", "alice")
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+	go conn.writeLoop()
+
+	route := func(line string) {
+		msg, err := Parse(line)
+		require.NoError(t, err)
+		srv.Router.RouteMessage(conn, msg)
+	}
+	reader := bufio.NewReader(client)
+	readLine := func() string {
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		return strings.TrimSuffix(line, "\r\n")
+	}
+
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	assert.Contains(t, readLine(), " 001 bob ")
+
+	// While the client isn't reading, the write loop is stuck sending the PONG, and the
+	// replies to the JOIN queue up behind it.
+	route("PING :stall")
+	require.Eventually(t, func() bool { return conn.queued() == 0 }, 5*time.Second, time.Millisecond)
+	route("JOIN #dircd")
+
+	assert.Contains(t, readLine(), " PONG ")
+	expected := []string{" JOIN #dircd", " 332 bob #dircd :IRC daemon", " 333 bob #dircd alice ",
+		" 324 bob #dircd ", " 329 bob #dircd ", " 353 bob ", " 366 bob #dircd "}
+	for _, reply := range expected {
+		assert.Contains(t, readLine(), reply)
+	}
+}
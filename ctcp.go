@@ -0,0 +1,99 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"strings"
+	"time"
+)
+
+// ctcpDelim delimits a CTCP message within the text of a PRIVMSG or NOTICE.
+const ctcpDelim = "\x01"
+
+// ctcpPrefix prefixes the names of CTCP commands to distinguish them from IRC commands,
+// as in the CmdCTCP constants.
+const ctcpPrefix = "CTCP "
+
+// WithCTCPReplies sets the server to answer CTCP VERSION, TIME, and PING requests sent to
+// users itself rather than relaying them, so that the client software and local time of
+// users cannot be fingerprinted by others.
+func WithCTCPReplies() ServerOption {
+	return option(func(s *Server) error {
+		s.ctcpReplies = true
+		return nil
+	})
+}
+
+// parseCTCP returns the command of the CTCP message in the text, prefixed like the
+// CmdCTCP constants, and its parameters, reporting whether the text is a CTCP message.
+// The closing delimiter is optional, as some clients omit it.
+func parseCTCP(text string) (command, params string, ok bool) {
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return "", "", false
+	}
+
+	text = strings.TrimSuffix(text[len(ctcpDelim):], ctcpDelim)
+	command, params, _ = strings.Cut(text, SPACE)
+	if len(command) == 0 {
+		return "", "", false
+	}
+	return ctcpPrefix + strings.ToUpper(command), params, true
+}
+
+// checkCTCP reports whether a CTCP message from the user must not be relayed to its
+// target, either because the DCC policy or the channel blocks it, or because the server
+// has answered it on behalf of the target user.
+func (conn *Conn) checkCTCP(msg *Message, targetUser *User, targetChannel *Channel) bool {
+	command, params, isCTCP := parseCTCP(msg.Trailing)
+	if !isCTCP || command == CmdCTCPAction {
+		return false
+	}
+
+	if command == CmdCTCPDCC && conn.checkDCC(msg, params, targetUser) {
+		return true
+	}
+
+	if targetChannel != nil {
+		if !targetChannel.ModeIsSet(CModeNoCTCP) {
+			return false
+		}
+		if msg.Command != CmdNotice {
+			conn.ReplyCannotSendToChan(msg.Params[0], "Cannot send CTCP to channel (+C)")
+		}
+		return true
+	}
+
+	// Only requests are answered, CTCP replies are sent with NOTICE.
+	if !conn.server.ctcpReplies || msg.Command != CmdPrivMsg {
+		return false
+	}
+
+	switch command {
+	case CmdCTCPVersion:
+		params = "dircd-" + Version
+	case CmdCTCPTime:
+		params = time.Now().UTC().Format(time.RFC1123)
+	case CmdCTCPPing:
+	default:
+		return false
+	}
+
+	text := strings.TrimPrefix(command, ctcpPrefix)
+	if len(params) > 0 {
+		text += SPACE + params
+	}
+
+	reply := conn.newMessage()
+	defer msgPool.Recycle(reply, reply.Generation())
+	reply.Source = targetUser.Hostmask()
+	reply.Command = CmdNotice
+	reply.Params = []string{conn.user.Nick()}
+	reply.Trailing = ctcpDelim + text + ctcpDelim
+	conn.WriteMessage(reply)
+	return true
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCTCP(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		command string
+		params  string
+		ok      bool
+	}{
+		{"action", "\x01ACTION waves\x01", CmdCTCPAction, "waves", true},
+		{"without parameters", "\x01VERSION\x01", CmdCTCPVersion, "", true},
+		{"lowercase", "\x01ping 12345\x01", CmdCTCPPing, "12345", true},
+		{"missing closing delimiter", "\x01TIME", CmdCTCPTime, "", true},
+		{"empty", "\x01\x01", "", "", false},
+		{"plain text", "hello \x01there\x01", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, params, ok := parseCTCP(tt.text)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.command, command)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
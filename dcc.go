@@ -0,0 +1,86 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DCCPolicy configures which DCC offers sent by users are relayed to their target.
+type DCCPolicy struct {
+	BlockAll          bool     // Blocks all DCC offers.
+	BlockedExtensions []string // Blocks DCC SEND offers of files with any of the extensions, eg: "exe".
+	AccountsOnly      bool     // Only relays DCC offers from users logged in to an account to another.
+}
+
+// WithDCCPolicy sets the policy filtering DCC offers sent by users.
+func WithDCCPolicy(policy DCCPolicy) ServerOption {
+	return option(func(s *Server) error {
+		extensions := make([]string, 0, len(policy.BlockedExtensions))
+		for _, ext := range policy.BlockedExtensions {
+			ext = strings.TrimPrefix(ext, ".")
+			if len(ext) == 0 || strings.ContainsAny(ext, "./ ") {
+				return fmt.Errorf("invalid DCC file extension [%s]", ext)
+			}
+			extensions = append(extensions, "."+strings.ToLower(ext))
+		}
+		policy.BlockedExtensions = extensions
+		s.dcc = policy
+		return nil
+	})
+}
+
+// blocks returns the reason the DCC offer from the user to the target user, which is nil
+// if sent to a channel, must not be relayed, or an empty string if it may be.
+func (policy *DCCPolicy) blocks(params string, sender, target *User) string {
+	if policy.BlockAll {
+		return "DCC is disabled on this server"
+	}
+
+	if policy.AccountsOnly && (len(sender.Account()) == 0 || target == nil || len(target.Account()) == 0) {
+		return "DCC is only allowed between users logged in to an account"
+	}
+
+	dccType, args, _ := strings.Cut(params, SPACE)
+	if len(policy.BlockedExtensions) > 0 && strings.EqualFold(dccType, "SEND") {
+		ext := strings.ToLower(path.Ext(dccFilename(args)))
+		for _, blocked := range policy.BlockedExtensions {
+			if ext == blocked {
+				return fmt.Sprintf("DCC SEND of %s files is not allowed", blocked)
+			}
+		}
+	}
+	return ""
+}
+
+// dccFilename returns the filename at the start of the arguments of a DCC SEND, which is
+// quoted if it contains spaces.
+func dccFilename(args string) string {
+	if quoted, ok := strings.CutPrefix(args, `"`); ok {
+		filename, _, _ := strings.Cut(quoted, `"`)
+		return filename
+	}
+	filename, _, _ := strings.Cut(args, SPACE)
+	return filename
+}
+
+// checkDCC reports whether a DCC offer from the user must not be relayed to its target
+// by the DCC policy, notifying them of the reason if so.
+func (conn *Conn) checkDCC(msg *Message, params string, targetUser *User) bool {
+	reason := conn.server.dcc.blocks(params, conn.user, targetUser)
+	if len(reason) == 0 {
+		return false
+	}
+
+	if msg.Command != CmdNotice {
+		conn.ReplyCannotSendToChan(msg.Params[0], reason)
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDCCPolicy(t *testing.T) {
+	alice, bob := &User{nick: "alice", account: "alice"}, &User{nick: "bob"}
+
+	srv, err := NewServer(WithDCCPolicy(DCCPolicy{BlockedExtensions: []string{"EXE", ".scr"}}))
+	assert.NoError(t, err)
+	extensions := srv.dcc
+
+	tests := []struct {
+		name    string
+		policy  DCCPolicy
+		params  string
+		target  *User
+		blocked bool
+	}{
+		{"no policy", DCCPolicy{}, "SEND virus.exe 2130706433 5000 1024", bob, false},
+		{"block all", DCCPolicy{BlockAll: true}, "CHAT chat 2130706433 5000", bob, true},
+		{"blocked extension", extensions, "SEND virus.EXE 2130706433 5000 1024", bob, true},
+		{"blocked quoted extension", extensions, `SEND "my screen.scr" 2130706433 5000 1024`, bob, true},
+		{"allowed extension", extensions, "SEND photo.png 2130706433 5000 1024", bob, false},
+		{"chat ignores extensions", extensions, "CHAT chat.exe 2130706433 5000", bob, false},
+		{"accounts only without account", DCCPolicy{AccountsOnly: true}, "SEND photo.png 2130706433 5000 1024", bob, true},
+		{"accounts only with accounts", DCCPolicy{AccountsOnly: true}, "SEND photo.png 2130706433 5000 1024", alice, false},
+		{"accounts only to channel", DCCPolicy{AccountsOnly: true}, "SEND photo.png 2130706433 5000 1024", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.blocked, len(tt.policy.blocks(tt.params, alice, tt.target)) > 0)
+		})
+	}
+
+	_, err = NewServer(WithDCCPolicy(DCCPolicy{BlockedExtensions: []string{"tar.gz"}}))
+	assert.Error(t, err)
+}
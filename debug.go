@@ -0,0 +1,114 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// debugVarsName is the name under which server state is published with expvar.
+const debugVarsName = "dircd"
+
+// WithDebugEndpoint sets the server to expose the net/http/pprof profiling handlers
+// under /debug/pprof/ and the expvar variables under /debug/vars on an HTTP listener
+// at the given address, which must be a loopback address, eg: "127.0.0.1:6060".
+func WithDebugEndpoint(address string) ServerOption {
+	return option(func(s *Server) error {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return fmt.Errorf("error resolving debug endpoint address [%s]: %w", address, err)
+		}
+
+		if addr.IP == nil || !addr.IP.IsLoopback() {
+			return fmt.Errorf("debug endpoint address [%s] must be a loopback address", address)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+
+		s.debugServer = &http.Server{
+			Addr:              addr.String(),
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		return nil
+	})
+}
+
+// startDebugEndpoint starts serving the debug endpoint, if configured.
+func (srv *Server) startDebugEndpoint() {
+	if srv.debugServer == nil {
+		return
+	}
+
+	logger := srv.logger.WithField("sub-component", "debug")
+
+	if expvar.Get(debugVarsName) == nil {
+		expvar.Publish(debugVarsName, expvar.Func(srv.debugVars))
+	}
+
+	debugServer := srv.debugServer
+	srv.registerOnShutdown(func() {
+		_ = debugServer.Close()
+	})
+
+	go func() {
+		logger.Infof("serving debug endpoint at [http://%s/debug/pprof/]", debugServer.Addr)
+		if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(fmt.Errorf("debug endpoint terminated: %w", err))
+		}
+	}()
+}
+
+// debugVars returns a snapshot of the server state for publishing with expvar.
+func (srv *Server) debugVars() any {
+	srv.mu.Lock()
+	connections := len(srv.activeConn)
+	srv.mu.Unlock()
+
+	commands := make(map[string]any)
+	for _, stats := range srv.Router.Snapshot() {
+		commands[stats.Command] = map[string]any{
+			"count":           stats.Count,
+			"latency_count":   stats.Latency.Count,
+			"latency_mean_us": stats.Latency.Mean().Microseconds(),
+			"latency_buckets": stats.Latency.Buckets,
+		}
+	}
+
+	pools := make(map[string]any)
+	for name, stats := range PoolStats() {
+		pools[name] = map[string]any{
+			"hits":      stats.Hits,
+			"misses":    stats.Misses,
+			"overflows": stats.Overflows,
+			"in_use":    stats.InUse,
+			"reserved":  stats.Reserved,
+			"target":    stats.Target,
+		}
+	}
+
+	return map[string]any{
+		"connections": connections,
+		"users":       srv.Users.Length(),
+		"channels":    srv.Channels.Length(),
+		"commands":    commands,
+		"pools":       pools,
+	}
+}
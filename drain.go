@@ -0,0 +1,49 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import "errors"
+
+// Drain stops the server accepting new connections by closing its listeners, while the
+// existing connections are served until they disconnect, however long that takes. It is
+// meant for blue/green deployments behind a load balancer, where new connections go to
+// another server while users move over in their own time.
+//
+// Unlike Shutdown and Restart, connections are never closed by the server; call Shutdown
+// or Close to end those remaining. Serve returns ErrServerClosed once the listeners have
+// closed. It returns an error if the server is already draining or shut down.
+func (srv *Server) Drain() error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	if !srv.draining.CompareAndSwap(false, true) {
+		return errors.New("server is already draining")
+	}
+
+	srv.logger.WithField("operation", "drain").Info("no longer accepting connections, serving existing connections until they disconnect")
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closeListenersLocked()
+}
+
+// Draining reports whether the server has stopped accepting connections with Drain.
+func (srv *Server) Draining() bool {
+	return srv.draining.Load()
+}
+
+// doDrain drains the server on behalf of the operator.
+func (conn *Conn) doDrain() {
+	if err := conn.server.Drain(); err != nil {
+		conn.ReplyServerNotice(err.Error())
+		return
+	}
+
+	conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdDrain})
+	conn.ReplyServerNotice("Server is draining, no longer accepting connections")
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	srv, err := NewServer()
+	require.NoError(t, err)
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serve(listen, &listenerConfig{})
+	}()
+
+	client, err := net.Dial("tcp", listen.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.activeConn) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, srv.Drain())
+	assert.True(t, srv.Draining())
+	assert.Error(t, srv.Drain())
+	select {
+	case err := <-served:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not close")
+	}
+
+	_, err = net.DialTimeout("tcp", listen.Addr().String(), time.Second)
+	assert.Error(t, err)
+
+	// The existing connection is still served.
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = client.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+
+	_ = srv.Close()
+}
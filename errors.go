@@ -21,32 +21,77 @@ func (err Error) String() string {
 
 // Immutable error strings
 const (
-	ErrServerClosed      Error = "Server has closed"
-	ErrMessageTooShort   Error = "Did not receive enough data from the client"
-	ErrMessageTooLong    Error = "Received data from the client is too long"
-	ErrCRLF              Error = "No CRLF"
-	ErrWhitespace        Error = "All Whitepace"
-	ErrInvalidMessage    Error = "Invalid message format"
-	ErrPrefixed          Error = "Prefixed message from client"
-	ErrInvalidCapCmd     Error = "Invalid CAP command"
-	ErrMissingParams     Error = "Missing parameters"
-	ErrTooManyParams     Error = "Too many parameters"
-	ErrUserInUse         Error = "This username is currently in use"
-	ErrUserRestricted    Error = "This username is restricted"
-	ErrUserAreadySet     Error = "You have already registered"
-	ErrNickInUse         Error = "This nickname is currently in use"
-	ErrNickRestricted    Error = "This nickname is restricted"
-	ErrErroneousNickname Error = "This nickname is invalid"
-	ErrNickAlreadySet    Error = "You already have that nickname"
-	ErrNotImplemented    Error = "That command is not yet implemented"
-	ErrNotRegistered     Error = "You must register first"
-	ErrNoNickGiven       Error = "No nickname given"
-	ErrNoSuchNick        Error = "Nick not found"
-	ErrNoSuchChan        Error = "Channel not found"
-	ErrInsuffPerms       Error = "Insufficient permissions"
-	ErrUnknownMode       Error = "Unknown mode"
-	ErrModeAlreadySet    Error = "Mode already set"
-	ErrModeNotSet        Error = "Mode is not set"
+	ErrServerClosed       Error = "Server has closed"
+	ErrMessageTooShort    Error = "Did not receive enough data from the client"
+	ErrMessageTooLong     Error = "Received data from the client is too long"
+	ErrInputTooLong       Error = "Input line was too long"
+	ErrCRLF               Error = "No CRLF"
+	ErrWhitespace         Error = "All Whitepace"
+	ErrInvalidMessage     Error = "Invalid message format"
+	ErrPrefixed           Error = "Prefixed message from client"
+	ErrControlChars       Error = "Message contains NUL, CR, or LF characters"
+	ErrInvalidCapCmd      Error = "Invalid CAP command"
+	ErrMissingParams      Error = "Missing parameters"
+	ErrTooManyParams      Error = "Too many parameters"
+	ErrUserInUse          Error = "This username is currently in use"
+	ErrUserRestricted     Error = "This username is restricted"
+	ErrUserAreadySet      Error = "You have already registered"
+	ErrNickInUse          Error = "This nickname is currently in use"
+	ErrNickRestricted     Error = "This nickname is restricted"
+	ErrServicesDown       Error = "Services are currently unavailable"
+	ErrErroneousNickname  Error = "This nickname is invalid"
+	ErrNickAlreadySet     Error = "You already have that nickname"
+	ErrNotImplemented     Error = "That command is not yet implemented"
+	ErrNotRegistered      Error = "You must register first"
+	ErrTryAgain           Error = "Please wait a while and try again"
+	ErrNoNickGiven        Error = "No nickname given"
+	ErrNoRecipient        Error = "No recipient given"
+	ErrNoTextToSend       Error = "No text to send"
+	ErrNoSuchNick         Error = "Nick not found"
+	ErrNoSuchChan         Error = "Channel not found"
+	ErrTooManyChans       Error = "You have joined too many channels"
+	ErrChannelIsFull      Error = "Cannot join channel (+l)"
+	ErrInviteOnlyChan     Error = "Cannot join channel (+i)"
+	ErrBannedFromChan     Error = "Cannot join channel (+b)"
+	ErrBadChannelKey      Error = "Cannot join channel (+k)"
+	ErrCannotSendBanned   Error = "Cannot send to channel (+b)"
+	ErrInsuffPerms        Error = "Insufficient permissions"
+	ErrUnknownMode        Error = "Unknown mode"
+	ErrModeAlreadySet     Error = "Mode already set"
+	ErrModeNotSet         Error = "Mode is not set"
+	ErrChanOpPrivsNeeded  Error = "You're not a channel operator"
+	ErrUserNotInChannel   Error = "They aren't on that channel"
+	ErrChanListFull       Error = "Channel list is full"
+	ErrUsersDontMatch     Error = "Can't change mode for other users"
+	ErrUModeUnknownFlag   Error = "Unknown MODE flag"
+	ErrSecureOnly         Error = "You must be connected with TLS to message this user (+z)"
+	ErrProxyHeader        Error = "Invalid PROXY protocol header"
+	ErrWebSocketUpgrade   Error = "Invalid WebSocket upgrade request"
+	ErrWebSocketFrame     Error = "Invalid WebSocket frame"
+	ErrStartTLSFailed     Error = "STARTTLS failed"
+	ErrStartTLSSecure     Error = "STARTTLS failed (connection is already secure)"
+	ErrStartTLSRegistered Error = "STARTTLS failed (already registered)"
+	ErrStartTLSDisabled   Error = "STARTTLS failed (not available on this listener)"
+	ErrNotFound           Error = "Not found"
+	ErrAccountExists      Error = "That account name is already registered"
+	ErrAccountInvalid     Error = "That account name is invalid"
+	ErrRegistrationClosed Error = "Account registration is disabled at this time"
+	ErrBadCredentials     Error = "Invalid account credentials"
+	ErrMemoQuota          Error = "The account has too many memos"
+	ErrNotLoggedIn        Error = "You must be logged in to an account"
+	ErrNoCertificate      Error = "You have not presented a TLS client certificate"
+	ErrBadFingerprint     Error = "That certificate fingerprint is invalid"
+	ErrFingerprintInUse   Error = "That certificate fingerprint is already linked to an account"
+	ErrSASLFailed         Error = "SASL authentication failed"
+	ErrSASLTooLong        Error = "SASL message too long"
+	ErrSASLAborted        Error = "SASL authentication aborted"
+	ErrSASLAlready        Error = "You have already authenticated using SASL"
+	ErrNoOperHost         Error = "No O-lines for your host"
+	ErrPasswordMismatch   Error = "Password incorrect"
+	ErrNoPrivileges       Error = "Permission Denied- You're not an IRC operator"
+	ErrYoureBanned        Error = "You are banned from this server"
+	ErrNoAdminInfo        Error = "No administrative info available"
+	ErrHelpNotFound       Error = "No help available on this topic"
 )
 
 const panicLogTemplate = "panic recovered:\n------ PANIC -----\n%s\n------------------"
@@ -0,0 +1,159 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/conc/panics"
+)
+
+// EventType identifies the kind of an Event published on the server event bus.
+type EventType string
+
+// EventAny matches every event type in an event export topic mapping.
+const EventAny EventType = "*"
+
+// Server event types
+const (
+	EventUserRegistered EventType = "user.registered"
+	EventUserQuit       EventType = "user.quit"
+	EventNickChange     EventType = "user.nick"
+	EventUserKilled     EventType = "user.killed"
+	EventChannelCreated EventType = "channel.created"
+	EventChannelJoin    EventType = "channel.join"
+	EventMessage        EventType = "message" // Only sent to subscribers naming it, see optInEvents.
+	EventOperUp         EventType = "oper.up"
+	EventOperAction     EventType = "oper.action"
+	EventFloodTriggered EventType = "flood.triggered"
+)
+
+// optInEvents are the event types only sent to subscribers naming them, rather than to
+// every subscriber of all events, as messages carry the private conversations of users.
+var optInEvents = []EventType{EventMessage}
+
+// Event describes something which happened on the server. Fields which do not
+// apply to the event type are left empty.
+type Event struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+
+	// The user the event concerns.
+	Nick    string `json:"nick,omitempty"`
+	User    string `json:"user,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Account string `json:"account,omitempty"`
+
+	Channel string `json:"channel,omitempty"`
+	Actor   string `json:"actor,omitempty"`  // Who caused the event, eg: the oper setting a K-line.
+	Action  string `json:"action,omitempty"` // The command of an action, eg: KLINE or PRIVMSG.
+	Target  string `json:"target,omitempty"` // What an action applied to, eg: a K-line mask or old nick.
+	Reason  string `json:"reason,omitempty"`
+	Text    string `json:"text,omitempty"` // The content of a message.
+}
+
+// EventHandler is a function which receives events from the server event bus.
+//
+// Handlers are called synchronously by the goroutine publishing the event, so
+// they must not block; handlers with slow work to do should queue it elsewhere.
+type EventHandler func(Event)
+
+// eventSubscription is a handler subscribed to the event bus.
+type eventSubscription struct {
+	handler EventHandler
+	types   []EventType // Every event type but optInEvents if empty.
+}
+
+// eventBus dispatches published events to their subscribed handlers.
+type eventBus struct {
+	mu            sync.RWMutex
+	subscriptions []*eventSubscription
+}
+
+// subscribe adds the handler for the given event types, or all events but optInEvents if
+// none are given, returning a function which removes it.
+func (bus *eventBus) subscribe(handler EventHandler, types ...EventType) func() {
+	sub := &eventSubscription{handler: handler, types: types}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		bus.subscriptions = slices.DeleteFunc(bus.subscriptions, func(s *eventSubscription) bool {
+			return s == sub
+		})
+	}
+}
+
+// publish calls every handler subscribed to the event type, returning any handler panics.
+func (bus *eventBus) publish(event Event) []error {
+	bus.mu.RLock()
+	subs := bus.subscriptions
+	bus.mu.RUnlock()
+
+	var errs []error
+	for _, sub := range subs {
+		if len(sub.types) == 0 && slices.Contains(optInEvents, event.Type) {
+			continue
+		}
+		if len(sub.types) > 0 && !slices.Contains(sub.types, event.Type) {
+			continue
+		}
+		recovered := panics.Try(func() { sub.handler(event) })
+		if err := recovered.AsError(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Subscribe registers the handler to receive the given event types from the server,
+// or every event if none are given, except EventMessage, which carries the text of
+// private messages and must be given to be received. It returns a function which
+// unsubscribes it.
+func (srv *Server) Subscribe(handler EventHandler, types ...EventType) (unsubscribe func()) {
+	return srv.events.subscribe(handler, types...)
+}
+
+// WithEventHandler subscribes the handler to the given event types from the server,
+// or every event but EventMessage if none are given.
+func WithEventHandler(handler EventHandler, types ...EventType) ServerOption {
+	return option(func(s *Server) error {
+		s.events.subscribe(handler, types...)
+		return nil
+	})
+}
+
+// publish stamps the event with the time and server name and dispatches it to subscribers.
+func (srv *Server) publish(event Event) {
+	event.Time = time.Now().UTC()
+	event.Server = srv.Hostname()
+
+	for _, err := range srv.events.publish(event) {
+		srv.logger.WithField("sub-component", "events").
+			Error(fmt.Errorf("event handler panicked handling [%s]: %w", event.Type, err))
+	}
+}
+
+// userEvent returns an event of the given type populated with the details of the user.
+func userEvent(eventType EventType, user *User) Event {
+	return Event{
+		Type:    eventType,
+		Nick:    user.Nick(),
+		User:    user.Name(),
+		Host:    user.Hostname(),
+		Account: user.Account(),
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	tests := []struct {
+		name      string
+		types     []EventType
+		published []EventType
+		received  []EventType
+	}{
+		{
+			name:      "all events",
+			published: []EventType{EventUserRegistered, EventOperUp},
+			received:  []EventType{EventUserRegistered, EventOperUp},
+		},
+		{
+			name:      "filtered events",
+			types:     []EventType{EventOperUp, EventUserKilled},
+			published: []EventType{EventUserRegistered, EventOperUp, EventChannelCreated, EventUserKilled},
+			received:  []EventType{EventOperUp, EventUserKilled},
+		},
+		{
+			name:      "messages are opt-in",
+			published: []EventType{EventMessage, EventOperUp},
+			received:  []EventType{EventOperUp},
+		},
+		{
+			name:      "messages subscribed to",
+			types:     []EventType{EventMessage},
+			published: []EventType{EventMessage, EventOperUp},
+			received:  []EventType{EventMessage},
+		},
+		{
+			name:      "no matching events",
+			types:     []EventType{EventFloodTriggered},
+			published: []EventType{EventUserRegistered},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := &eventBus{}
+			var received []EventType
+			unsubscribe := bus.subscribe(func(event Event) {
+				received = append(received, event.Type)
+			}, test.types...)
+
+			for _, eventType := range test.published {
+				assert.Empty(t, bus.publish(Event{Type: eventType}))
+			}
+			assert.Equal(t, test.received, received)
+
+			unsubscribe()
+			assert.Empty(t, bus.subscriptions)
+		})
+	}
+}
+
+func TestEventBusPanic(t *testing.T) {
+	bus := &eventBus{}
+	called := false
+	bus.subscribe(func(Event) { panic("handler failure") })
+	bus.subscribe(func(Event) { called = true })
+
+	errs := bus.publish(Event{Type: EventUserRegistered})
+	assert.Len(t, errs, 1)
+	assert.True(t, called, "handlers after a panicking handler must still be called")
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Event export delivery settings
+const (
+	exportQueueSize      = 8192
+	exportInitialBackoff = 500 * time.Millisecond
+	exportMaxBackoff     = 30 * time.Second
+	exportFlushTimeout   = 5 * time.Second
+)
+
+// EventExporter publishes events to a message broker, such as the NATS and Kafka
+// backends in the exporters packages.
+type EventExporter interface {
+	// Export publishes the payload to the topic, partitioned by key where the broker
+	// supports it. It must only return nil once the broker has acknowledged the payload.
+	Export(ctx context.Context, topic, key string, payload []byte) error
+
+	// Close releases the broker connection.
+	Close() error
+}
+
+// eventExport delivers events from the server event bus to an EventExporter.
+type eventExport struct {
+	exporter EventExporter
+	topics   map[EventType]string
+	queue    chan Event
+	logger   Logger
+}
+
+// WithEventExport sets the server to publish events as JSON to the exporter, mapping
+// each event type to a topic. Event types missing from the mapping are published to
+// the topic mapped to EventAny, if any, otherwise they are not exported. EventMessage is
+// only exported if mapped itself, as it carries the text of private messages, eg:
+//
+//	dircd.WithEventExport(exporter, map[dircd.EventType]string{
+//		dircd.EventMessage:     "irc.messages",
+//		dircd.EventChannelJoin: "irc.membership",
+//		dircd.EventUserQuit:    "irc.membership",
+//	})
+//
+// Events are published in order, and retried with backoff until the broker acknowledges
+// them, for at-least-once delivery while the server is running. Events are partitioned
+// by channel, or by nick for events without one.
+func WithEventExport(exporter EventExporter, topics map[EventType]string) ServerOption {
+	return option(func(s *Server) error {
+		if exporter == nil {
+			return errors.New("event exporter must not be nil")
+		}
+		if len(topics) == 0 {
+			return errors.New("event export topic mapping must not be empty")
+		}
+
+		s.exports = append(s.exports, &eventExport{
+			exporter: exporter,
+			topics:   topics,
+			queue:    make(chan Event, exportQueueSize),
+		})
+		return nil
+	})
+}
+
+// startEventExports subscribes the configured event exports to the event bus and starts
+// their delivery goroutines, which flush any queued events when the server shuts down.
+func (srv *Server) startEventExports() {
+	if len(srv.exports) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.registerOnShutdown(cancel)
+
+	for _, export := range srv.exports {
+		export.logger = srv.logger.WithField("sub-component", "event-export")
+
+		types := make([]EventType, 0, len(export.topics))
+		if _, all := export.topics[EventAny]; all {
+			srv.events.subscribe(export.enqueue)
+			// The opt-in events are only exported if mapped themselves.
+			for _, eventType := range optInEvents {
+				if _, mapped := export.topics[eventType]; mapped {
+					types = append(types, eventType)
+				}
+			}
+		} else {
+			for eventType := range export.topics {
+				types = append(types, eventType)
+			}
+		}
+		if len(types) > 0 {
+			srv.events.subscribe(export.enqueue, types...)
+		}
+		go export.run(ctx)
+	}
+}
+
+// topic returns the topic the event type is mapped to.
+func (export *eventExport) topic(eventType EventType) string {
+	if topic, exists := export.topics[eventType]; exists {
+		return topic
+	}
+	return export.topics[EventAny]
+}
+
+// enqueue queues the event for export, dropping it if the queue is full.
+func (export *eventExport) enqueue(event Event) {
+	select {
+	case export.queue <- event:
+	default:
+		export.logger.Errorf("event export queue full, dropping [%s] event", event.Type)
+	}
+}
+
+// run exports queued events in order until the context is cancelled, then makes a
+// final attempt to flush the queue before closing the exporter.
+func (export *eventExport) run(ctx context.Context) {
+	defer func() {
+		if err := export.exporter.Close(); err != nil {
+			export.logger.Warn(fmt.Errorf("error closing event exporter: %w", err))
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			export.flush()
+			return
+		case event := <-export.queue:
+			if !export.deliver(ctx, event) {
+				export.flush(event) // Interrupted by shutdown mid-retry.
+				return
+			}
+		}
+	}
+}
+
+// flush exports the pending events followed by those remaining in the queue,
+// giving up after exportFlushTimeout.
+func (export *eventExport) flush(pending ...Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportFlushTimeout)
+	defer cancel()
+
+	for i, event := range pending {
+		if !export.deliver(ctx, event) {
+			export.logger.Warnf("event export flush timed out, dropping %d queued events", len(export.queue)+len(pending)-i)
+			return
+		}
+	}
+
+	for {
+		select {
+		case event := <-export.queue:
+			if !export.deliver(ctx, event) {
+				export.logger.Warnf("event export flush timed out, dropping %d queued events", len(export.queue)+1)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliver exports the event, retrying with exponential backoff until it is acknowledged
+// or the context is cancelled, reporting whether it was delivered.
+func (export *eventExport) deliver(ctx context.Context, event Event) bool {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		export.logger.Error(fmt.Errorf("error encoding [%s] event: %w", event.Type, err))
+		return true // Undeliverable, don't hold up the queue.
+	}
+
+	key := event.Channel
+	if len(key) == 0 {
+		key = event.Nick
+	}
+	topic := export.topic(event.Type)
+
+	backoff := exportInitialBackoff
+	for {
+		err = export.exporter.Export(ctx, topic, key, payload)
+		if err == nil {
+			return true
+		}
+
+		export.logger.Warn(fmt.Errorf("error exporting [%s] event to [%s], retrying in %v: %w", event.Type, topic, backoff, err))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, exportMaxBackoff)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// topicExporter records the topics of the events exported to it.
+type topicExporter struct {
+	topics chan string
+}
+
+func (exporter *topicExporter) Export(_ context.Context, topic, _ string, _ []byte) error {
+	exporter.topics <- topic
+	return nil
+}
+
+func (exporter *topicExporter) Close() error {
+	return nil
+}
+
+func TestEventExportMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		topics   map[EventType]string
+		exported []string
+	}{
+		{
+			name:     "catch-all leaves out messages",
+			topics:   map[EventType]string{EventAny: "irc.all"},
+			exported: []string{"irc.all"},
+		},
+		{
+			name:     "messages mapped with the catch-all",
+			topics:   map[EventType]string{EventAny: "irc.all", EventMessage: "irc.messages"},
+			exported: []string{"irc.messages", "irc.all"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := &topicExporter{topics: make(chan string, 2)}
+			srv, err := NewServer(WithHostname("irc.example.net"), WithEventExport(exporter, test.topics))
+			require.NoError(t, err)
+			srv.startEventExports()
+
+			srv.publish(Event{Type: EventMessage, Nick: "alice", Target: "bob", Text: "secret"})
+			srv.publish(Event{Type: EventOperUp, Nick: "alice"})
+
+			for _, topic := range test.exported {
+				select {
+				case exported := <-exporter.topics:
+					assert.Equal(t, topic, exported)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no event exported to [%s]", topic)
+				}
+			}
+			select {
+			case exported := <-exporter.topics:
+				t.Errorf("unexpected event exported to [%s]", exported)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
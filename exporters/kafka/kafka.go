@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package kafka provides a dircd event exporter which publishes events to Kafka topics.
+//
+// Records are produced with acks=all and idempotent writes, and an event is only
+// considered delivered once every in-sync replica has acknowledged it, giving
+// at-least-once delivery.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Exporter publishes dircd events to Kafka, implementing dircd.EventExporter.
+// Events with the same key are written to the same partition.
+type Exporter struct {
+	clientID  string
+	tlsConfig *tls.Config
+	username  string
+	password  string
+
+	client *kgo.Client
+}
+
+// Option configures an Exporter.
+type Option func(*Exporter)
+
+// WithTLSConfig sets the TLS configuration used to connect to the brokers.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(e *Exporter) {
+		e.tlsConfig = config
+	}
+}
+
+// WithPlainAuth sets the credentials used to authenticate to the brokers with SASL/PLAIN.
+func WithPlainAuth(username, password string) Option {
+	return func(e *Exporter) {
+		e.username = username
+		e.password = password
+	}
+}
+
+// WithClientID sets the client ID reported to the brokers.
+func WithClientID(id string) Option {
+	return func(e *Exporter) {
+		e.clientID = id
+	}
+}
+
+// New returns an exporter for the Kafka cluster reachable through the seed brokers,
+// eg: "localhost:9092". Connections are established on the first export.
+func New(brokers []string, options ...Option) (*Exporter, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("no Kafka seed brokers provided")
+	}
+
+	exporter := &Exporter{clientID: "dircd"}
+	for _, option := range options {
+		option(exporter)
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ClientID(exporter.clientID),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+	}
+	if exporter.tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(exporter.tlsConfig))
+	}
+	if len(exporter.username) > 0 {
+		opts = append(opts, kgo.SASL(plain.Auth{User: exporter.username, Pass: exporter.password}.AsMechanism()))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kafka client configuration: %w", err)
+	}
+	exporter.client = client
+	return exporter, nil
+}
+
+// Export writes the payload to the topic, returning once it has been acknowledged.
+func (e *Exporter) Export(ctx context.Context, topic, key string, payload []byte) error {
+	record := &kgo.Record{Topic: topic, Value: payload}
+	if len(key) > 0 {
+		record.Key = []byte(key)
+	}
+
+	if err := e.client.ProduceSync(ctx, record).FirstErr(); err != nil {
+		return fmt.Errorf("error writing to Kafka topic [%s]: %w", topic, err)
+	}
+	return nil
+}
+
+// Close flushes any buffered records and closes the connections to the brokers.
+func (e *Exporter) Close() error {
+	e.client.Close()
+	return nil
+}
+
+var _ dircd.EventExporter = (*Exporter)(nil)
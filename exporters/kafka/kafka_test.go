@@ -0,0 +1,64 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestExport(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(8, "irc.messages"))
+	assert.NoError(t, err)
+	defer cluster.Close()
+
+	_, err = New(nil)
+	assert.Error(t, err)
+
+	exporter, err := New(cluster.ListenAddrs())
+	assert.NoError(t, err)
+	defer exporter.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, payload := range []string{`{"type":"message","seq":1}`, `{"type":"message","seq":2}`} {
+		assert.NoError(t, exporter.Export(ctx, "irc.messages", "#chan", []byte(payload)))
+	}
+	assert.NoError(t, exporter.Export(ctx, "irc.messages", "", []byte(`{"type":"unkeyed"}`)))
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics("irc.messages"),
+	)
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	var keyed []*kgo.Record
+	for len(keyed) < 2 && ctx.Err() == nil {
+		consumer.PollRecords(ctx, 10).EachRecord(func(record *kgo.Record) {
+			if string(record.Key) == "#chan" {
+				keyed = append(keyed, record)
+			}
+		})
+	}
+	if assert.Len(t, keyed, 2) {
+		assert.Equal(t, keyed[0].Partition, keyed[1].Partition, "records with the same key share a partition")
+		assert.JSONEq(t, `{"type":"message","seq":1}`, string(keyed[0].Value))
+		assert.JSONEq(t, `{"type":"message","seq":2}`, string(keyed[1].Value))
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelShort()
+	assert.Error(t, exporter.Export(short, "irc.unknown", "", []byte(`{}`)), "writing to a missing topic fails")
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+)
+
+// runServer starts an embedded NATS server with JetStream enabled and a stream
+// capturing the irc.stream subject, returning its URL.
+func runServer(t *testing.T) string {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	assert.NoError(t, err)
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	conn, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	defer conn.Close()
+	js, err := jetstream.New(conn)
+	assert.NoError(t, err)
+	_, err = js.CreateStream(context.Background(), jetstream.StreamConfig{Name: "IRC", Subjects: []string{"irc.stream"}})
+	assert.NoError(t, err)
+
+	return srv.ClientURL()
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("http://localhost:4222")
+	assert.Error(t, err)
+
+	exporter, err := New("nats://127.0.0.1:1")
+	assert.NoError(t, err, "the connection is not established until the first export")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Error(t, exporter.Export(ctx, "irc.messages", "", []byte(`{}`)))
+}
+
+func TestExport(t *testing.T) {
+	url := runServer(t)
+
+	tests := []struct {
+		name      string
+		jetStream bool
+		subject   string
+		err       bool
+	}{
+		{
+			name:    "core",
+			subject: "irc.core",
+		},
+		{
+			name:      "jetstream acknowledged",
+			jetStream: true,
+			subject:   "irc.stream",
+		},
+		{
+			name:      "jetstream without a stream",
+			jetStream: true,
+			subject:   "irc.nostream",
+			err:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscriber, err := nats.Connect(url)
+			assert.NoError(t, err)
+			defer subscriber.Close()
+			sub, err := subscriber.SubscribeSync(test.subject)
+			assert.NoError(t, err)
+			assert.NoError(t, subscriber.Flush())
+
+			var options []Option
+			if test.jetStream {
+				options = append(options, WithJetStream())
+			}
+			exporter, err := New(url, options...)
+			assert.NoError(t, err)
+			defer exporter.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			err = exporter.Export(ctx, test.subject, "", []byte(`{"type":"message"}`))
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			msg, err := sub.NextMsg(time.Second)
+			if assert.NoError(t, err) {
+				assert.Equal(t, `{"type":"message"}`, string(msg.Data))
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// filtersBucket is the storage bucket filter rules are persisted in.
+const filtersBucket = "filters"
+
+// filterKLineDuration is how long the K-line set by a filter rule with the kline action lasts.
+const filterKLineDuration = 24 * time.Hour
+
+// FilterField is what a filter rule matches against.
+type FilterField string
+
+// Filter fields
+const (
+	FilterText  FilterField = "text"  // The text of a PRIVMSG or NOTICE.
+	FilterNick  FilterField = "nick"  // The nick a user registers with or changes to.
+	FilterGecos FilterField = "gecos" // The realname a user registers with.
+)
+
+// FilterAction is what is done to a user matching a filter rule. Operators are notified of
+// every match, whatever the action.
+type FilterAction string
+
+// Filter actions, from the least to the most severe
+const (
+	FilterNotify FilterAction = "notify" // Operators are notified, and nothing else is done.
+	FilterBlock  FilterAction = "block"  // The message or nick is refused, or the user disconnected if registering.
+	FilterKill   FilterAction = "kill"   // The user is disconnected.
+	FilterKLine  FilterAction = "kline"  // The host of the user is K-lined for filterKLineDuration.
+)
+
+// severity ranks the action by how severe it is, so that the most severe action is taken
+// when several rules match.
+func (action FilterAction) severity() int {
+	switch action {
+	case FilterBlock:
+		return 1
+	case FilterKill:
+		return 2
+	case FilterKLine:
+		return 3
+	}
+	return 0
+}
+
+// FilterRule is a rule matching the text of messages, or the nicks or realnames of users,
+// against a glob or regular expression pattern, and the action taken when it matches.
+type FilterRule struct {
+	Name    string       `json:"name"`
+	Field   FilterField  `json:"field"`
+	Action  FilterAction `json:"action"`
+	Pattern string       `json:"pattern"`
+	Regex   bool         `json:"regex"` // The pattern is a regular expression, otherwise a case-insensitive glob.
+	Reason  string       `json:"reason"`
+	Setter  string       `json:"setter"`
+	Origin  string       `json:"origin,omitempty"` // The name of the server the rule was set on.
+	Created time.Time    `json:"created"`
+
+	compiled *regexp.Regexp
+}
+
+// compile validates the rule, compiling its pattern if it is a regular expression.
+func (rule *FilterRule) compile() error {
+	switch rule.Field {
+	case FilterText, FilterNick, FilterGecos:
+	default:
+		return fmt.Errorf("unknown filter field [%s]", rule.Field)
+	}
+
+	switch rule.Action {
+	case FilterBlock, FilterKill, FilterKLine, FilterNotify:
+	default:
+		return fmt.Errorf("unknown filter action [%s]", rule.Action)
+	}
+
+	if len(rule.Name) == 0 || strings.ContainsAny(rule.Name, " ,") {
+		return fmt.Errorf("invalid filter name [%s]", rule.Name)
+	}
+	if len(rule.Pattern) == 0 {
+		return fmt.Errorf("filter [%s] pattern must not be empty", rule.Name)
+	}
+
+	if rule.Regex {
+		compiled, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid filter [%s] pattern: %w", rule.Name, err)
+		}
+		rule.compiled = compiled
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches the text.
+func (rule *FilterRule) Matches(text string) bool {
+	if rule.compiled != nil {
+		return rule.compiled.MatchString(text)
+	}
+	return stringutils.MatchMask(rule.Pattern, text)
+}
+
+// filterStore holds the filter rules, persisted in the server storage.
+type filterStore struct {
+	mu      sync.RWMutex
+	storage Storage
+	rules   map[string]*FilterRule
+}
+
+// newFilterStore returns a filter store loaded with the rules persisted in storage.
+func newFilterStore(storage Storage) (*filterStore, error) {
+	fs := &filterStore{
+		storage: storage,
+		rules:   make(map[string]*FilterRule),
+	}
+
+	stored, err := storage.List(filtersBucket)
+	if err != nil {
+		return nil, fmt.Errorf("error loading filters: %w", err)
+	}
+
+	for key, data := range stored {
+		rule := &FilterRule{}
+		if err = json.Unmarshal(data, rule); err != nil {
+			return nil, fmt.Errorf("error decoding filter [%s]: %w", key, err)
+		}
+		if err = rule.compile(); err != nil {
+			return nil, err
+		}
+		fs.rules[key] = rule
+	}
+
+	return fs, nil
+}
+
+// add sets the rule, replacing any existing rule with the same name.
+func (fs *filterStore) add(rule *FilterRule) error {
+	key := strings.ToLower(rule.Name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := storeJSON(fs.storage, filtersBucket, key, rule); err != nil {
+		return err
+	}
+	fs.rules[key] = rule
+	return nil
+}
+
+// merge sets the rule received from another server, unless the rule with the same name
+// takes precedence over it, reporting whether it was set.
+func (fs *filterStore) merge(rule *FilterRule) (bool, error) {
+	key := strings.ToLower(rule.Name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if existing, exists := fs.rules[key]; exists &&
+		!supersedes(rule.Created, rule.Origin, existing.Created, existing.Origin) {
+		return false, nil
+	}
+	if err := storeJSON(fs.storage, filtersBucket, key, rule); err != nil {
+		return false, err
+	}
+	fs.rules[key] = rule
+	return true, nil
+}
+
+// get returns the rule with the given name, if any.
+func (fs *filterStore) get(name string) *FilterRule {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.rules[strings.ToLower(name)]
+}
+
+// removeBefore deletes the rule with the given name if it was set no later than the
+// removal, rather than set again since on another server, reporting whether it was.
+func (fs *filterStore) removeBefore(name string, removed time.Time) (bool, error) {
+	key := strings.ToLower(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	existing, exists := fs.rules[key]
+	if !exists || existing.Created.After(removed) {
+		return false, nil
+	}
+	if err := fs.storage.Delete(filtersBucket, key); err != nil {
+		return false, err
+	}
+	delete(fs.rules, key)
+	return true, nil
+}
+
+// remove deletes the rule with the given name, returning ErrNotFound if there is none.
+func (fs *filterStore) remove(name string) error {
+	key := strings.ToLower(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, exists := fs.rules[key]; !exists {
+		return ErrNotFound
+	}
+	if err := fs.storage.Delete(filtersBucket, key); err != nil {
+		return err
+	}
+	delete(fs.rules, key)
+	return nil
+}
+
+// match returns every rule on the field matching the text, the rules with the most severe
+// action first, then by name.
+func (fs *filterStore) match(field FilterField, text string) []*FilterRule {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var matched []*FilterRule
+	for _, rule := range fs.rules {
+		if rule.Field == field && rule.Matches(text) {
+			matched = append(matched, rule)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if severity, other := matched[i].Action.severity(), matched[j].Action.severity(); severity != other {
+			return severity > other
+		}
+		return matched[i].Name < matched[j].Name
+	})
+	return matched
+}
+
+// list returns the rules sorted by name.
+func (fs *filterStore) list() []*FilterRule {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	rules := make([]*FilterRule, 0, len(fs.rules))
+	for _, rule := range fs.rules {
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+// AddFilter sets the filter rule, replacing any existing rule with the same name. The
+// setter of the rule is reported to event subscribers as the actor, and the rule
+// propagated to the linked servers.
+func (srv *Server) AddFilter(rule *FilterRule) error {
+	if err := rule.compile(); err != nil {
+		return err
+	}
+	if len(rule.Reason) == 0 {
+		rule.Reason = "Matched a spam filter"
+	}
+	rule.Origin = srv.Hostname()
+	rule.Created = time.Now().UTC().Truncate(time.Second)
+
+	if err := srv.filters.add(rule); err != nil {
+		return fmt.Errorf("error adding filter [%s]: %w", rule.Name, err)
+	}
+	srv.propagate(nil, srv.filterLine(rule))
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  rule.Setter,
+		Action: CmdFilter + " ADD",
+		Target: rule.Name,
+		Reason: fmt.Sprintf("%s %s %s", rule.Field, rule.Action, rule.Pattern),
+	})
+	return nil
+}
+
+// RemoveFilter removes the filter rule with the given name, returning ErrNotFound if there
+// is none. The remover is reported to event subscribers as the actor, and the removal
+// propagated to the linked servers.
+func (srv *Server) RemoveFilter(name, remover string) error {
+	if err := srv.filters.remove(name); err != nil {
+		return err
+	}
+	srv.propagate(nil, srv.unbanLine(banTypeFilter, name, remover))
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  remover,
+		Action: CmdFilter + " DEL",
+		Target: name,
+	})
+	return nil
+}
+
+// Filters returns the filter rules sorted by name.
+func (srv *Server) Filters() []*FilterRule {
+	return srv.filters.list()
+}
+
+// checkFilter matches the field of the user against the filter rules, unless they are an
+// operator, notifying operators of every match and taking the most severe action of the
+// rules matched. It returns the rule of the action if the message, nick, or registration
+// must be refused, in which case the user may have been disconnected.
+func (conn *Conn) checkFilter(field FilterField, text string) *FilterRule {
+	if conn.user.IsOper() {
+		return nil
+	}
+
+	matched := conn.server.filters.match(field, text)
+	if len(matched) == 0 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(conn.remAddr)
+	if err != nil {
+		host = conn.remAddr
+	}
+
+	for _, rule := range matched {
+		conn.logger.WithField("operation", "filter").Infof("[%s] from [%s] matched filter [%s]: %s", field, host, rule.Name, conn.server.logText(text))
+		conn.server.noticeUsers(fmt.Sprintf("*** Filter -- %s (%s) matched filter [%s] on %s, action %s: %s",
+			conn.replyNick(), host, rule.Name, field, rule.Action, text), true)
+	}
+
+	rule := matched[0]
+	switch rule.Action {
+	case FilterNotify:
+		return nil
+	case FilterKill:
+		conn.doKill("Filtered: "+rule.Reason, "")
+	case FilterKLine:
+		// Registered users matching the K-line are disconnected when it is added.
+		if _, klineErr := conn.server.AddKLine("*@"+host, rule.Reason, "filter "+rule.Name, filterKLineDuration); klineErr != nil {
+			conn.logger.WithField("operation", "filter").Error(klineErr)
+			conn.doKill("Filtered: "+rule.Reason, "")
+		} else if !conn.isRegistered() {
+			conn.ReplyYoureBanned(rule.Reason)
+			conn.doKill("K-lined: "+rule.Reason, "")
+		}
+	}
+	return rule
+}
+
+// doFilter lists, adds, or removes filter rules.
+func (conn *Conn) doFilter(subcommand string, params []string) {
+	switch strings.ToUpper(subcommand) {
+	case "LIST":
+		rules := conn.server.Filters()
+		for _, rule := range rules {
+			kind := "glob"
+			if rule.Regex {
+				kind = "regex"
+			}
+			conn.ReplyServerNotice(fmt.Sprintf("%s: %s %s %s [%s] set by %s: %s",
+				rule.Name, rule.Field, rule.Action, kind, rule.Pattern, rule.Setter, rule.Reason))
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("End of filter list (%d rules)", len(rules)))
+
+	case "ADD":
+		if len(params) < 6 || (params[3] != "glob" && params[3] != "regex") {
+			conn.ReplyServerNotice("Usage: FILTER ADD <name> <text|nick|gecos> <block|kill|kline|notify> <glob|regex> <reason|-> :<pattern>")
+			return
+		}
+
+		// The reason is a single parameter with underscores for spaces, as the pattern
+		// may contain spaces itself.
+		reason := strings.ReplaceAll(params[4], "_", SPACE)
+		if reason == "-" {
+			reason = ""
+		}
+
+		rule := &FilterRule{
+			Name:    params[0],
+			Field:   FilterField(strings.ToLower(params[1])),
+			Action:  FilterAction(strings.ToLower(params[2])),
+			Regex:   params[3] == "regex",
+			Reason:  reason,
+			Pattern: params[5],
+			Setter:  conn.user.Hostmask(),
+		}
+		if err := conn.server.AddFilter(rule); err != nil {
+			conn.logger.WithField("operation", "filter").Warn(err)
+			conn.ReplyServerNotice(fmt.Sprintf("Unable to add filter [%s]: %v", rule.Name, err))
+			return
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("Added filter [%s]", rule.Name))
+
+	case "DEL":
+		if len(params) < 1 {
+			conn.ReplyNeedMoreParams(CmdFilter)
+			return
+		}
+		switch err := conn.server.RemoveFilter(params[0], conn.user.Hostmask()); err {
+		case nil:
+			conn.ReplyServerNotice(fmt.Sprintf("Removed filter [%s]", params[0]))
+		case ErrNotFound:
+			conn.ReplyServerNotice(fmt.Sprintf("No filter [%s]", params[0]))
+		default:
+			conn.logger.WithField("operation", "filter").Error(fmt.Errorf("error removing filter [%s]: %w", params[0], err))
+			conn.ReplyServerNotice("Unable to remove filter " + params[0])
+		}
+
+	default:
+		conn.ReplyServerNotice("Unknown FILTER subcommand, expected LIST, ADD, or DEL")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterRules(t *testing.T) {
+	storage := NewMemoryStorage()
+	srv, err := NewServer(WithStorage(storage))
+	assert.NoError(t, err)
+
+	assert.NoError(t, srv.AddFilter(&FilterRule{Name: "spam", Field: FilterText, Action: FilterBlock, Pattern: "*free money*"}))
+	assert.NoError(t, srv.AddFilter(&FilterRule{Name: "bots", Field: FilterNick, Action: FilterKill, Pattern: `^bot[0-9]+$`, Regex: true}))
+
+	assert.Error(t, srv.AddFilter(&FilterRule{Name: "bad", Field: FilterText, Action: FilterBlock, Pattern: "(", Regex: true}))
+	assert.Error(t, srv.AddFilter(&FilterRule{Name: "bad", Field: "host", Action: FilterBlock, Pattern: "*"}))
+	assert.Error(t, srv.AddFilter(&FilterRule{Name: "bad", Field: FilterText, Action: "ban", Pattern: "*"}))
+
+	tests := []struct {
+		name    string
+		field   FilterField
+		text    string
+		matched string
+	}{
+		{"glob matches case-insensitively", FilterText, "Get FREE MONEY now", "spam"},
+		{"glob does not match", FilterText, "hello there", ""},
+		{"regex matches", FilterNick, "bot123", "bots"},
+		{"regex does not match", FilterNick, "robot123", ""},
+		{"field must match", FilterGecos, "free money", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := ""
+			if matched := srv.filters.match(tt.field, tt.text); len(matched) > 0 {
+				name = matched[0].Name
+			}
+			assert.Equal(t, tt.matched, name)
+		})
+	}
+
+	reloaded, err := newFilterStore(storage)
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.list(), 2)
+	assert.Len(t, reloaded.match(FilterNick, "bot1"), 1)
+
+	assert.NoError(t, srv.RemoveFilter("SPAM", "oper"))
+	assert.Equal(t, ErrNotFound, srv.RemoveFilter("spam", "oper"))
+	assert.Len(t, srv.Filters(), 1)
+}
+
+func TestFilterSeverity(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	require.NoError(t, srv.AddFilter(&FilterRule{Name: "a-watch", Field: FilterText, Action: FilterNotify, Pattern: "*money*"}))
+	require.NoError(t, srv.AddFilter(&FilterRule{Name: "spam", Field: FilterText, Action: FilterBlock, Pattern: "*free money*", Reason: "No spam"}))
+	require.NoError(t, srv.AddFilter(&FilterRule{Name: "z-watch", Field: FilterText, Action: FilterNotify, Pattern: "*free*"}))
+
+	var names []string
+	for _, rule := range srv.filters.match(FilterText, "free money") {
+		names = append(names, rule.Name)
+	}
+	assert.Equal(t, []string{"spam", "a-watch", "z-watch"}, names, "the most severe action is taken, whatever the order of the rules")
+
+	_, routeBob, _ := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	routeBob("JOIN #dircd")
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK alice")
+	route("USER alice 0 * :Alice")
+	route("JOIN #dircd")
+	route("PRIVMSG bob :free money")
+	expect(" 531 alice bob :No spam")
+	route("PRIVMSG #dircd :free money")
+	expect(" 404 alice #dircd :No spam")
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// GeoInfo is the location and network of the address a user connected from.
+type GeoInfo struct {
+	Country string // ISO 3166-1 alpha-2 country code, eg: "US". Empty if unknown.
+	ASN     uint   // Autonomous system number. Zero if unknown.
+	ASOrg   string // Organization of the autonomous system.
+}
+
+// String describes the country and autonomous system, eg: "US, AS15169 (Google LLC)".
+func (info GeoInfo) String() string {
+	country := info.Country
+	if len(country) == 0 {
+		country = "unknown country"
+	}
+	if info.ASN == 0 {
+		return country + ", unknown AS"
+	}
+	if len(info.ASOrg) == 0 {
+		return fmt.Sprintf("%s, AS%d", country, info.ASN)
+	}
+	return fmt.Sprintf("%s, AS%d (%s)", country, info.ASN, info.ASOrg)
+}
+
+// GeoIPResolver looks up the location and network of IP addresses, such as the MaxMind
+// database resolver in the geoip/maxmind package.
+//
+// Implementations must be safe for concurrent use. Implementations which also have a
+// Reload() error method are reloaded when the server is rehashed.
+type GeoIPResolver interface {
+	// Lookup returns what is known of the address, which is empty if nothing is.
+	Lookup(ip net.IP) (GeoInfo, error)
+}
+
+// GeoAction is the action taken on users matching a GeoPolicy.
+type GeoAction string
+
+// Geo policy actions
+const (
+	GeoDeny        GeoAction = "deny"         // Connections are refused.
+	GeoRequireSASL GeoAction = "require-sasl" // Users must log in with SASL before registering.
+)
+
+// GeoPolicy applies an action to users connecting from any of the countries or
+// autonomous systems.
+type GeoPolicy struct {
+	Countries []string // ISO 3166-1 alpha-2 country codes.
+	ASNs      []uint   // Autonomous system numbers.
+	Action    GeoAction
+	Reason    string // Reason given to users the action is taken on.
+}
+
+// matches reports whether the policy applies to users connecting from the location.
+func (policy *GeoPolicy) matches(info GeoInfo) bool {
+	if info.ASN != 0 && slices.Contains(policy.ASNs, info.ASN) {
+		return true
+	}
+	return len(info.Country) > 0 && slices.ContainsFunc(policy.Countries, func(country string) bool {
+		return strings.EqualFold(country, info.Country)
+	})
+}
+
+// geoIP holds the GeoIP resolver of the server and its policies.
+type geoIP struct {
+	resolver GeoIPResolver
+	policies []GeoPolicy
+}
+
+// WithGeoIP sets the server to look up the location and network of users when they
+// connect, which is shown to operators in WHOIS and connection notices, and applies the
+// first of the policies each user matches.
+func WithGeoIP(resolver GeoIPResolver, policies ...GeoPolicy) ServerOption {
+	return option(func(s *Server) error {
+		if resolver == nil {
+			return errors.New("GeoIP resolver must not be nil")
+		}
+		for _, policy := range policies {
+			if policy.Action != GeoDeny && policy.Action != GeoRequireSASL {
+				return fmt.Errorf("invalid GeoIP policy action [%s]", policy.Action)
+			}
+			if len(policy.Countries) == 0 && len(policy.ASNs) == 0 {
+				return fmt.Errorf("GeoIP policy [%s] must match a country or ASN", policy.Action)
+			}
+		}
+
+		s.geoIP = &geoIP{resolver: resolver, policies: policies}
+		if reloader, ok := resolver.(interface{ Reload() error }); ok {
+			s.onRehash = append(s.onRehash, reloader.Reload)
+		}
+		return nil
+	})
+}
+
+// geoPolicy returns the first GeoIP policy matching the location, or nil if none do.
+func (srv *Server) geoPolicy(info GeoInfo) *GeoPolicy {
+	for i := range srv.geoIP.policies {
+		if srv.geoIP.policies[i].matches(info) {
+			return &srv.geoIP.policies[i]
+		}
+	}
+	return nil
+}
+
+// Geo returns the location and network of the address the user connected from, and
+// whether it was looked up.
+func (conn *Conn) Geo() (GeoInfo, bool) {
+	if info := conn.geo.Load(); info != nil {
+		return *info, true
+	}
+	return GeoInfo{}, false
+}
+
+// checkGeoConnect looks up the location of the new connection, if the server has a GeoIP
+// resolver, and refuses it if it matches a deny policy, reporting whether it did.
+func (conn *Conn) checkGeoConnect() bool {
+	if conn.server.geoIP == nil {
+		return false
+	}
+	logger := conn.logger.WithField("operation", "geoip")
+
+	host, _, err := net.SplitHostPort(conn.remAddr)
+	if err != nil {
+		host = conn.remAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	info, err := conn.server.geoIP.resolver.Lookup(ip)
+	if err != nil {
+		logger.Error(fmt.Errorf("error looking up [%s]: %w", host, err))
+		return false
+	}
+	conn.geo.Store(&info)
+
+	policy := conn.server.geoPolicy(info)
+	if policy == nil || policy.Action != GeoDeny {
+		return false
+	}
+
+	msg := conn.newMessage()
+	generation := msg.Generation()
+	msg.Command = CmdError
+	msg.Trailing = fmt.Sprintf("Closing link: %s [%s]", conn.server.Hostname(), policy.Reason)
+	conn.write(msg.RenderBuffer())
+	msgPool.Recycle(msg, generation)
+
+	logger.Infof("refused connection from [%s] (%s) by policy", host, info)
+	return true
+}
+
+// checkGeoRegister disconnects the user completing registration if they match a policy
+// requiring SASL and have not logged in, reporting whether they were. Otherwise operators
+// are notified of the user connecting and where from.
+func (conn *Conn) checkGeoRegister() bool {
+	info, ok := conn.Geo()
+	if !ok {
+		return false
+	}
+
+	if policy := conn.server.geoPolicy(info); policy != nil && policy.Action == GeoRequireSASL && len(conn.user.Account()) == 0 {
+		conn.logger.WithField("operation", "geoip").Infof("disconnecting user without SASL from (%s) by policy", info)
+		conn.ReplyYoureBanned("You must log in with SASL to connect from your network: " + policy.Reason)
+		conn.doKill("SASL required: "+policy.Reason, "")
+		return true
+	}
+
+	conn.server.noticeUsers(fmt.Sprintf("*** Connect -- %s (%s) [%s]", conn.replyNick(), conn.userhost(), info), true)
+	return false
+}
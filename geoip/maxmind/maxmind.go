@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package maxmind provides a dircd GeoIP resolver which looks up addresses in MaxMind
+// databases, such as GeoLite2-Country and GeoLite2-ASN. The databases are reopened when
+// the server is rehashed, so they may be replaced by an updater while it is running.
+package maxmind
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Resolver looks up addresses in MaxMind databases, implementing dircd.GeoIPResolver.
+type Resolver struct {
+	countryPath string
+	asnPath     string
+
+	mu      sync.RWMutex
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Option configures a Resolver.
+type Option func(*Resolver)
+
+// WithASNDatabase sets the path of a database of autonomous systems, such as
+// GeoLite2-ASN, to look up the network of addresses in.
+func WithASNDatabase(path string) Option {
+	return func(r *Resolver) {
+		r.asnPath = path
+	}
+}
+
+// countryRecord holds the fields of a country, city, or enterprise database record used
+// by the resolver.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// asnRecord holds the fields of an ASN database record.
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// New returns a resolver which looks up the country of addresses in the database at the
+// path, such as GeoLite2-Country or GeoLite2-City.
+func New(countryPath string, options ...Option) (*Resolver, error) {
+	r := &Resolver{countryPath: countryPath}
+	for _, option := range options {
+		option(r)
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the database at the path, or returns nil if the path is empty.
+func open(path string) (*maxminddb.Reader, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening MaxMind database [%s]: %w", path, err)
+	}
+	return reader, nil
+}
+
+// Reload reopens the databases, keeping the open ones if either cannot be.
+func (r *Resolver) Reload() error {
+	country, err := open(r.countryPath)
+	if err != nil {
+		return err
+	}
+	asn, err := open(r.asnPath)
+	if err != nil {
+		if country != nil {
+			_ = country.Close()
+		}
+		return err
+	}
+
+	r.mu.Lock()
+	oldCountry, oldASN := r.country, r.asn
+	r.country, r.asn = country, asn
+	r.mu.Unlock()
+
+	return closeAll(oldCountry, oldASN)
+}
+
+// Close closes the databases.
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := closeAll(r.country, r.asn)
+	r.country, r.asn = nil, nil
+	return err
+}
+
+// closeAll closes the open databases.
+func closeAll(readers ...*maxminddb.Reader) error {
+	var errs error
+	for _, reader := range readers {
+		if reader != nil {
+			errs = errors.Join(errs, reader.Close())
+		}
+	}
+	return errs
+}
+
+// Lookup returns the country, and autonomous system if configured, of the address.
+func (r *Resolver) Lookup(ip net.IP) (dircd.GeoInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var info dircd.GeoInfo
+	if r.country != nil {
+		var record countryRecord
+		if err := r.country.Lookup(ip, &record); err != nil {
+			return info, fmt.Errorf("error looking up country: %w", err)
+		}
+		info.Country = record.Country.ISOCode
+		if len(info.Country) == 0 {
+			info.Country = record.RegisteredCountry.ISOCode
+		}
+	}
+
+	if r.asn != nil {
+		var record asnRecord
+		if err := r.asn.Lookup(ip, &record); err != nil {
+			return info, fmt.Errorf("error looking up ASN: %w", err)
+		}
+		info.ASN = record.Number
+		info.ASOrg = record.Organization
+	}
+	return info, nil
+}
@@ -0,0 +1,39 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package maxmind
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestResolver(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.mmdb")
+	assert.NoError(t, os.WriteFile(invalid, []byte("not a database"), 0o600))
+	_, err = New(invalid)
+	assert.Error(t, err)
+
+	resolver, err := New("")
+	assert.NoError(t, err)
+	info, err := resolver.Lookup(net.ParseIP("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, dircd.GeoInfo{}, info)
+
+	resolver.asnPath = invalid
+	assert.Error(t, resolver.Reload())
+	assert.NoError(t, resolver.Close())
+}
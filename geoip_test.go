@@ -0,0 +1,62 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testGeoResolver resolves every address to the same location, counting reloads.
+type testGeoResolver struct {
+	info    GeoInfo
+	reloads int
+}
+
+func (r *testGeoResolver) Lookup(net.IP) (GeoInfo, error) {
+	return r.info, nil
+}
+
+func (r *testGeoResolver) Reload() error {
+	r.reloads++
+	return nil
+}
+
+func TestGeoPolicy(t *testing.T) {
+	resolver := &testGeoResolver{info: GeoInfo{Country: "NL", ASN: 64500, ASOrg: "Example"}}
+	srv, err := NewServer(WithGeoIP(resolver,
+		GeoPolicy{ASNs: []uint{64501}, Action: GeoDeny, Reason: "denied"},
+		GeoPolicy{Countries: []string{"nl"}, Action: GeoRequireSASL, Reason: "sasl"},
+	))
+	assert.NoError(t, err)
+
+	conn := &Conn{server: srv, remAddr: "192.0.2.1:5000", logger: srv.logger}
+	assert.False(t, conn.checkGeoConnect())
+	info, ok := conn.Geo()
+	assert.True(t, ok)
+	assert.Equal(t, "NL, AS64500 (Example)", info.String())
+	assert.Equal(t, GeoRequireSASL, srv.geoPolicy(info).Action)
+
+	assert.Equal(t, GeoDeny, srv.geoPolicy(GeoInfo{Country: "NL", ASN: 64501}).Action)
+	assert.Nil(t, srv.geoPolicy(GeoInfo{Country: "US", ASN: 64500}))
+	assert.Equal(t, "unknown country, unknown AS", GeoInfo{}.String())
+
+	assert.NoError(t, srv.Rehash())
+	assert.Equal(t, 1, resolver.reloads)
+}
+
+func TestGeoIPOptions(t *testing.T) {
+	_, err := NewServer(WithGeoIP(nil))
+	assert.Error(t, err)
+	_, err = NewServer(WithGeoIP(&testGeoResolver{}, GeoPolicy{Countries: []string{"NL"}, Action: "ignore"}))
+	assert.Error(t, err)
+	_, err = NewServer(WithGeoIP(&testGeoResolver{}, GeoPolicy{Action: GeoDeny}))
+	assert.Error(t, err)
+}
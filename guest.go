@@ -0,0 +1,74 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// guestNickAttempts is the number of guest nicks tried before giving up on finding one
+// that is not in use.
+const guestNickAttempts = 10
+
+// WithGuestNicks sets the server to assign unregistered users whose nick is invalid or in
+// use a unique nick of the prefix followed by five digits, eg: "Guest01234", informing
+// them with numeric 043, rather than leaving them unregistered until they choose another.
+// The prefix defaults to "Guest" if empty.
+func WithGuestNicks(prefix string) ServerOption {
+	return option(func(s *Server) error {
+		if len(prefix) == 0 {
+			prefix = "Guest"
+		}
+		if err, _ := s.ValidateName(prefix); err != nil {
+			return fmt.Errorf("invalid guest nick prefix [%s]: %w", prefix, err)
+		}
+		if prefix[0] >= '0' && prefix[0] <= '9' {
+			return errors.New("guest nick prefix must not start with a digit")
+		}
+		s.guestPrefix = prefix
+		return nil
+	})
+}
+
+// guestNick returns a random guest nick.
+func (srv *Server) guestNick() string {
+	return fmt.Sprintf("%s%05d", srv.guestPrefix, rand.Intn(100000))
+}
+
+// assignGuestNick gives the unregistered user a unique guest nick, telling them the
+// reason their nick could not be used, reporting false if guest nicks are not enabled,
+// the user is registered, or no guest nick could be found.
+func (conn *Conn) assignGuestNick(reason string) bool {
+	srv := conn.server
+	if len(srv.guestPrefix) == 0 || conn.isRegistered() {
+		return false
+	}
+
+	for attempt := 0; attempt < guestNickAttempts; attempt++ {
+		nick := srv.guestNick()
+		if err, _ := srv.ValidateName(nick); err != nil {
+			continue
+		}
+		if srv.cluster != nil {
+			if srv.cluster.claimNick(conn, nick) != nil {
+				continue
+			}
+			srv.cluster.releaseNick(conn, conn.user.Nick())
+		}
+
+		conn.ReplyNumeric(ReplyNickForceChanged, nick, fmt.Sprintf("%s, your nick has been changed", reason))
+		conn.user.SetNick(nick)
+		return true
+	}
+
+	conn.logger.WithField("operation", "nick").
+		Warnf("no unused guest nick found after %d attempts", guestNickAttempts)
+	return false
+}
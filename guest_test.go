@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuestNicks(t *testing.T) {
+	srv, err := NewServer(WithGuestNicks(""))
+	assert.NoError(t, err)
+
+	srv.Nicks.Set("alice", &User{nick: "alice"})
+	conn := &Conn{server: srv, listener: &listenerConfig{}, logger: srv.logger}
+	conn.user = &User{conn: conn, nick: "alice", name: "alice"}
+
+	conn.completeRegistration()
+	assert.True(t, conn.isRegistered())
+	assert.Regexp(t, `^Guest\d{5}$`, conn.user.Nick())
+	holder, _ := srv.Nicks.Get(conn.user.Nick())
+	assert.Same(t, conn.user, holder)
+
+	// Registered users are not given guest nicks.
+	assert.False(t, conn.assignGuestNick("in use"))
+
+	_, err = NewServer(WithGuestNicks("1guest"))
+	assert.Error(t, err)
+	_, err = NewServer(WithGuestNicks("bad guest"))
+	assert.Error(t, err)
+}
+
+func TestGuestNicksDisabled(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+
+	srv.Nicks.Set("alice", &User{nick: "alice"})
+	conn := &Conn{server: srv, listener: &listenerConfig{}, logger: srv.logger}
+	conn.user = &User{conn: conn, nick: "alice", name: "alice"}
+
+	conn.completeRegistration()
+	assert.False(t, conn.isRegistered())
+	assert.True(t, conn.nickLost.Load())
+	assert.Equal(t, "alice", conn.user.Nick())
+}
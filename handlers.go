@@ -9,8 +9,13 @@ package dircd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // All command handler functions do not return an error. Instead, it
@@ -53,48 +58,69 @@ func HandleNick(ctx *MessageContext) {
 		}
 	}
 
-	reply := ctx.Conn.newMessage()
-	defer msgPool.Recycle(reply)
+	nick := ctx.Msg.Params[0]
 
-	if ctx.Conn.user.Nick() == ctx.Msg.Params[0] {
-		reply.Trailing = ErrNickAlreadySet.String()
-		reply.Code = ReplyNicknameInUse
-		ctx.Conn.Write(reply.RenderBuffer())
+	if ctx.Conn.user.Nick() == nick {
+		ctx.ReplyNumeric(ReplyNicknameInUse, nick, ErrNickAlreadySet.String())
 		return
 	}
 
-	if validationErr, code := ctx.Conn.server.ValidateName(ctx.Msg.Params[0]); validationErr != nil {
-		reply.Trailing = validationErr.Error()
-		reply.Code = code
-		ctx.Conn.Write(reply.RenderBuffer())
-		return
+	// Users may change the case of their own nick, which is otherwise already in use, and
+	// with multi-session, take the nick of a user they may be attached to.
+	attaching := false
+	if validationErr, code := ctx.Conn.server.ValidateName(nick); validationErr != nil {
+		holder, _ := ctx.Conn.server.Nicks.Get(nick)
+		attaching = code == ReplyNicknameInUse && ctx.Conn.mayAttach(holder)
+		if code != ReplyNicknameInUse || (holder != ctx.Conn.user && !attaching) {
+			if !ctx.Conn.assignGuestNick(validationErr.Error()) {
+				ctx.ReplyNumeric(code, nick, validationErr.Error())
+			}
+			return
+		}
 	}
 
-	reply.Source = ctx.Conn.user.Hostmask()
-	oldNick := ctx.Conn.user.Nick()
-	newNick := ctx.Msg.Params[0]
-	ctx.Conn.user.SetNick(newNick)
+	if rule := ctx.Conn.checkFilter(FilterNick, nick); rule != nil {
+		if rule.Action == FilterBlock {
+			ctx.ReplyNumeric(ReplyErroneusNickname, nick, rule.Reason)
+		}
+		return
+	}
 
-	if !ctx.Conn.isRegistered() {
+	if hookErr := ctx.Conn.server.runPreNick(ctx.Conn, ctx.Conn.user.Nick(), nick); hookErr != nil {
+		ctx.ReplyNumeric(ReplyErroneusNickname, nick, hookErr.Error())
 		return
 	}
 
-	ctx.Conn.server.Nicks.ChangeKey(oldNick, newNick)
-	reply.Code = ReplyNone
-	reply.Command = CmdNick
-	reply.Params = ctx.Msg.Params[0:1]
-	reply.Trailing = ""
+	if cluster := ctx.Conn.server.cluster; cluster != nil && !attaching {
+		if err := cluster.claimNick(ctx.Conn, nick); errors.Is(err, ErrNickInUse) {
+			if !ctx.Conn.assignGuestNick(ErrNickInUse.Error()) {
+				ctx.ReplyNumeric(ReplyNicknameInUse, nick)
+			}
+			return
+		} else if err != nil {
+			ctx.Conn.ReplyTryAgain(ctx.Msg.Command)
+			return
+		}
+		if !ctx.Conn.isRegistered() && ctx.Conn.server.Casefold(ctx.Conn.user.Nick()) != ctx.Conn.server.Casefold(nick) {
+			cluster.releaseNick(ctx.Conn, ctx.Conn.user.Nick())
+		}
+	}
 
-	ctx.Conn.Write(reply.RenderBuffer())
+	if !ctx.Conn.isRegistered() {
+		ctx.Conn.user.SetNick(nick)
+		if ctx.Conn.nickLost.CompareAndSwap(true, false) {
+			ctx.Conn.completeRegistration()
+		}
+		return
+	}
 
-	if ctx.Conn.channels.Length() > 0 {
-		changeErr := ctx.Conn.channels.ForEach(func(name string, channel *Channel) error {
-			return channel.ChangeNick(oldNick, newNick, reply)
-		})
-		if changeErr != nil {
-			ctx.Conn.logger.WithField("handler", "NICK").
-				Error(fmt.Errorf("error encountered attempting to change nick for channel: %w", changeErr))
-			// TODO: this is real bad cause then state is gonna be all fuckered, need some reconciliation
+	if err := ctx.Conn.changeNick(nick); err != nil {
+		srv := ctx.Conn.server
+		if srv.cluster != nil && srv.Casefold(ctx.Conn.user.Nick()) != srv.Casefold(nick) {
+			srv.cluster.releaseNick(ctx.Conn, nick)
+		}
+		if errors.Is(err, ErrNickInUse) {
+			ctx.ReplyNumeric(ReplyNicknameInUse, nick)
 		}
 	}
 }
@@ -111,31 +137,19 @@ func HandleNick(ctx *MessageContext) {
 //	Parameters: <username> <modemask> -0(unused)- :[realname]
 func HandleUser(ctx *MessageContext) {
 	ctx.Handled()
-	if !enoughParams(ctx.Msg, 3) {
-		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
-		return
-	}
 
 	if len(ctx.Conn.user.Nick()) == 0 {
 		ctx.Conn.ReplyNoNicknameGiven()
 		return
 	}
 
-	reply := ctx.Conn.newMessage()
-	defer msgPool.Recycle(reply)
-
-	reply.Params = []string{ctx.Conn.user.Nick()}
-	reply.Code = ReplyAlreadyRegistered
-
 	if ctx.Conn.isRegistered() {
-		reply.Trailing = ErrUserAreadySet.String()
-		ctx.Conn.Write(reply.RenderBuffer())
+		ctx.ReplyNumeric(ReplyAlreadyRegistered, ErrUserAreadySet.String())
 		return
 	}
 
-	if ctx.Conn.server.Users.Exists(ctx.Msg.Params[0]) {
-		reply.Trailing = ErrUserInUse.String()
-		ctx.Conn.Write(reply.RenderBuffer())
+	if holder, exists := ctx.Conn.server.Users.Get(ctx.Msg.Params[0]); exists && !ctx.Conn.mayAttach(holder) {
+		ctx.ReplyNumeric(ReplyAlreadyRegistered, ErrUserInUse.String())
 		return
 	}
 
@@ -149,42 +163,99 @@ func HandleUser(ctx *MessageContext) {
 
 	ctx.Conn.user.SetName(ctx.Msg.Params[0])
 	ctx.Conn.user.SetRealname(ctx.Msg.Trailing)
-	ctx.Conn.user.SetHostname(ctx.Conn.remAddr)
-	ctx.Conn.registerUser()
+	host, _, err := net.SplitHostPort(ctx.Conn.remAddr)
+	if err != nil {
+		host = ctx.Conn.remAddr
+	}
+	ctx.Conn.user.SetHostname(host)
+
+	if ctx.Conn.checkKLined() {
+		return
+	}
+	ctx.Conn.checkShunned()
 
-	if !ctx.Conn.capRequested || ctx.Conn.capNegotiated {
-		ctx.Conn.ReplyWelcome()
-		ctx.Conn.ReplyISupport()
+	if rule := ctx.Conn.checkFilter(FilterGecos, ctx.Msg.Trailing); rule != nil {
+		if rule.Action == FilterBlock {
+			ctx.Conn.ReplyYoureBanned(rule.Reason)
+			ctx.Conn.doKill("Filtered: "+rule.Reason, "")
+		}
+		return
+	}
+
+	if ctx.Conn.assignClass() {
+		return
 	}
+	ctx.Conn.completeRegistration()
 }
 
 // HandleCap processes the CAP command and sub commands for
 // negotiating capabilities per the IRCv3.2 spec.
 //
+// Registration is suspended from the first CAP LS or REQ until CAP END
+// is received, so that capabilities such as SASL can be used beforehand.
+//
 //	Command: CAP
 //	Parameters: <subcommand> [param] :[capability] [capability]
 func HandleCap(ctx *MessageContext) {
 	ctx.Handled()
-	if !enoughParams(ctx.Msg, 2) || !ctx.Conn.capNegotiated { // TODO: see what the spec says about CAP after end
+	if !enoughParams(ctx.Msg, 1) {
 		ctx.Conn.ReplyInvalidCapCommand(ctx.Msg.Command)
 		return
 	}
 
-	switch ctx.Msg.Params[0] {
+	subcommand := strings.ToUpper(ctx.Msg.Params[0])
+
+	if (subcommand == "LS" || subcommand == "REQ") && !ctx.Conn.isRegistered() && ctx.Conn.capState == capNotRequested {
+		ctx.Conn.capState = capNegotiating
+	}
+
+	switch subcommand {
 	case "LS":
-		fallthrough
+		version := 0
+		if len(ctx.Msg.Params) > 1 {
+			version, _ = strconv.Atoi(ctx.Msg.Params[1])
+		}
+		// Clients negotiating version 302 implicitly enable cap-notify.
+		if version >= 302 {
+			ctx.Conn.EnableCap(CapNotify)
+		}
+		available := ctx.Conn.server.capabilities.list(true)
+		caps := make([]string, 0, len(available))
+		for _, capability := range available {
+			caps = append(caps, capability.advertised(version >= 302))
+		}
+		ctx.Conn.ReplyCap(subcommand, strings.Join(caps, SPACE))
 	case "LIST":
-		// ctx.Conn.ListCapabilities() // TODO: List capabilities
+		available := ctx.Conn.server.capabilities.list(true)
+		caps := make([]string, 0, len(available))
+		enabled := ctx.Conn.Caps()
+		for _, capability := range available {
+			if enabled.Has(capability.flag) {
+				caps = append(caps, capability.Name)
+			}
+		}
+		ctx.Conn.ReplyCap(subcommand, strings.Join(caps, SPACE))
 	case "REQ":
-		if !enoughParams(ctx.Msg, 3) {
+		if len(ctx.Msg.Trailing) == 0 {
 			ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
+			return
 		}
-		// ctx.Conn.HandleCapRequest(msg.Params[2]) // TODO: Capability request handler
+
+		// The request is applied atomically, either all changes are acknowledged or none are.
+		enabled, ok := ctx.Conn.server.requestCaps(ctx.Conn.Caps(), ctx.Msg.Trailing)
+		if !ok {
+			ctx.Conn.ReplyCap("NAK", ctx.Msg.Trailing)
+			return
+		}
+		ctx.Conn.applyCaps(enabled)
+		ctx.Conn.ReplyCap("ACK", ctx.Msg.Trailing)
 	case "END":
-		ctx.Conn.capNegotiated = true
+		if ctx.Conn.capState == capNegotiated {
+			return
+		}
+		ctx.Conn.capState = capNegotiated
 		if ctx.Conn.isRegistered() {
-			ctx.Conn.ReplyWelcome()
-			ctx.Conn.ReplyISupport()
+			ctx.Conn.welcome()
 		}
 	default:
 		ctx.Conn.ReplyInvalidCapCommand(ctx.Msg.Command)
@@ -192,6 +263,65 @@ func HandleCap(ctx *MessageContext) {
 	}
 }
 
+// HandleAuthenticate processes an AUTHENTICATE command for SASL
+// authentication per the IRCv3.1 SASL spec.
+//
+// The PLAIN mechanism authenticates with an account name and password,
+// and the EXTERNAL mechanism with the fingerprint of the TLS client
+// certificate presented on the connection, which must first have been
+// linked to the account with the CERTFP command.
+//
+//	Command: AUTHENTICATE
+//	Parameters: <mechanism> | <base64 data> | + | *
+func HandleAuthenticate(ctx *MessageContext) {
+	ctx.Handled()
+
+	param := ctx.Msg.Trailing
+	if len(ctx.Msg.Params) > 0 {
+		param = ctx.Msg.Params[0]
+	}
+
+	if len(param) == 0 {
+		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
+		return
+	}
+
+	if !ctx.Conn.HasCap(SASL) {
+		ctx.Conn.ReplySASL(ReplySASLFail, ErrSASLFailed)
+		return
+	}
+
+	ctx.Conn.doAuthenticate(ctx.Context(), param)
+}
+
+// HandleCertFP processes a CERTFP command, which manages the TLS client
+// certificate fingerprints linked to the account the user is logged in
+// to, for passwordless login with SASL EXTERNAL.
+//
+// With no fingerprint given, ADD links the fingerprint of the certificate
+// presented on the current connection.
+//
+//	Command: CERTFP
+//	Parameters: [LIST | ADD [fingerprint] | DEL <fingerprint>]
+func HandleCertFP(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doCertFP(ctx.Context(), ctx.Msg)
+}
+
+// HandleStartTLS processes a STARTTLS command.
+//
+// If the connection arrived on a plaintext listener and the server has a TLS
+// configuration, the server replies with RPL_STARTTLS and upgrades the
+// connection to TLS in place before any further messages are processed.
+// It must be issued before registration completes.
+//
+//	Command: STARTTLS
+//	Parameters: None
+func HandleStartTLS(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doStartTLS()
+}
+
 // HandlePrivmsg processes a PRIVMSG command.
 //
 // First, it checks if the specified nickname or channel exists; then
@@ -231,26 +361,58 @@ func HandleNotice(ctx *MessageContext) {
 //	Parameters: <channel>
 func HandleJoin(ctx *MessageContext) {
 	ctx.Handled()
-	if !enoughParams(ctx.Msg, 1) {
-		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
-		return
-	}
 
+	var key string
+	if len(ctx.Msg.Params) > 1 {
+		key = ctx.Msg.Params[1]
+	}
 	ctx.Msg.Source = ctx.Conn.user.Hostmask()
 	ctx.Msg.Params = ctx.Msg.Params[0:1]
 
-	channel, exists := ctx.Conn.server.Channels.Get(strings.ToLower(ctx.Msg.Params[0]))
+	if hookErr := ctx.Conn.server.runPreJoin(ctx.Conn, ctx.Msg.Params[0]); hookErr != nil {
+		ctx.Conn.ReplyBannedFromChan(ctx.Msg.Params[0], hookErr.Error())
+		return
+	}
+
+	limits := ctx.Conn.server.Limits()
+	if len(ctx.Conn.user.Channels()) >= limits.JoinedChans {
+		ctx.Conn.ReplyTooManyChannels(ctx.Msg.Params[0])
+		return
+	}
+
+	channel, exists := ctx.Conn.server.Channels.Get(ctx.Msg.Params[0])
 
 	if !exists {
-		channel = NewChannel(ctx.Msg.Params[0], ctx.Conn.user)
-		ctx.Conn.server.Channels.Set(strings.ToLower(ctx.Msg.Params[0]), channel)
+		if len(ctx.Msg.Params[0]) > limits.ChanLength {
+			ctx.Conn.ReplyNoSuchChan(ctx.Msg.Params[0])
+			return
+		}
+
+		if ctx.Conn.server.lockedDown(LockdownChannels) && !ctx.Conn.user.IsOper() {
+			ctx.Conn.ReplyBannedFromChan(ctx.Msg.Params[0], "Channel creation is restricted to operators during lockdown")
+			return
+		}
+
+		channel = ctx.Conn.server.newChannel(ctx.Msg.Params[0], ctx.Conn.server.creatorOf(ctx.Msg.Params[0], ctx.Conn.user))
+		ctx.Conn.server.Channels.Set(ctx.Msg.Params[0], channel)
+		ctx.Conn.server.restoreChannel(channel)
+
+		event := userEvent(EventChannelCreated, ctx.Conn.user)
+		event.Channel = channel.Name()
+		ctx.Conn.server.publish(event)
 	}
 
-	if !channel.Join(ctx.Conn.user, ctx.Msg) {
-		// TODO: channel join error
+	if joinErr := channel.Join(ctx.Conn.user, key, ctx.Msg); joinErr != nil {
+		ctx.Conn.ReplyCannotJoin(channel.Name(), joinErr)
 	} else {
-		ctx.Conn.channels.Set(channel.Name(), channel)
-		ctx.Conn.ReplyChannelNames(channel)
+		channel.applyAccessLists(ctx.Conn.server.Hostname(), ctx.Conn.user)
+		ctx.Conn.server.applyAutoModes(channel, ctx.Conn.user)
+		ctx.Conn.ReplyChannelJoined(channel)
+		ctx.Conn.server.runPostJoin(ctx.Conn, channel)
+
+		event := userEvent(EventChannelJoin, ctx.Conn.user)
+		event.Channel = channel.Name()
+		ctx.Conn.server.publish(event)
 	}
 }
 
@@ -267,7 +429,7 @@ func HandleUserhost(ctx *MessageContext) {
 	var buffer bytes.Buffer
 
 	for _, nick := range ctx.Msg.Params {
-		host, exists := ctx.Conn.server.Nicks.Get(strings.ToLower(nick))
+		host, exists := ctx.Conn.server.Nicks.Get(nick)
 		if !exists {
 			ctx.Conn.ReplyNoSuchNick(nick)
 			return
@@ -282,13 +444,432 @@ func HandleUserhost(ctx *MessageContext) {
 
 	}
 
-	ctx.Msg.Source = ctx.Conn.hostname
-	ctx.Msg.Command = ""
-	ctx.Msg.Code = ReplyUserHost
-	ctx.Msg.Params = []string{ctx.Conn.user.Nick()}
-	ctx.Msg.Trailing = strings.Join(hosts, " ")
+	ctx.ReplyNumeric(ReplyUserHost, strings.Join(hosts, " "))
+}
 
-	ctx.Conn.Write(ctx.Msg.RenderBuffer())
+// HandleWhois processes a WHOIS command.
+//
+// The server will respond with the information of the requested nick,
+// including the account they are logged in to. The TLS client certificate
+// fingerprint is only included for the user themself and operators, and the
+// country and network they connected from only for operators.
+//
+//	Command: WHOIS
+//	Parameters: [server] <nickname>
+func HandleWhois(ctx *MessageContext) {
+	ctx.Handled()
+	if !enoughParams(ctx.Msg, 1) {
+		ctx.Conn.ReplyNoNicknameGiven()
+		return
+	}
+
+	nick := ctx.Msg.Params[len(ctx.Msg.Params)-1]
+	target, exists := ctx.Conn.server.Nicks.Get(nick)
+	if !exists {
+		ctx.Conn.ReplyNoSuchNick(nick)
+		return
+	}
+
+	ctx.Conn.ReplyWhois(target)
+}
+
+// HandleOper processes an OPER command.
+//
+// If an oper block exists by the given name which allows the user's host,
+// and the password matches, the user is granted its permission level.
+//
+//	Command: OPER
+//	Parameters: <name> <password>
+func HandleOper(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doOper(ctx.Msg.Params[0], ctx.Msg.Params[1])
+}
+
+// HandleChallenge processes a CHALLENGE command.
+//
+// Given the name of an oper block with a public key, the server will respond with a
+// base64 encoded nonce, and given the base64 encoded signature of the nonce by its
+// private key prefixed with +, will grant the user the privileges of the oper block.
+//
+//	Command: CHALLENGE
+//	Parameters: <name> | +<signature>
+func HandleChallenge(ctx *MessageContext) {
+	ctx.Handled()
+
+	if response, ok := strings.CutPrefix(ctx.Msg.Params[0], "+"); ok {
+		ctx.Conn.doChallengeResponse(response)
+		return
+	}
+	ctx.Conn.doChallenge(ctx.Msg.Params[0])
+}
+
+// HandleStats processes a STATS command.
+//
+// The server will respond with the report for the given query letter:
+// u (uptime), m (command usage), l (connection traffic), k (K-lines),
+// or o (oper blocks). All but u and m are restricted to operators.
+//
+//	Command: STATS
+//	Parameters: <query> [target]
+func HandleStats(ctx *MessageContext) {
+	ctx.Handled()
+
+	target := ""
+	if len(ctx.Msg.Params) > 1 {
+		target = ctx.Msg.Params[1]
+	}
+
+	ctx.Conn.doStats(ctx.Msg.Params[0], target)
+}
+
+// HandleAdmin processes an ADMIN command.
+//
+// The server will respond with its configured administrative contact details.
+//
+//	Command: ADMIN
+//	Parameters: [server]
+func HandleAdmin(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doAdmin()
+}
+
+// HandleInfo processes an INFO command.
+//
+// The server will respond with its version, build, and runtime information.
+//
+//	Command: INFO
+//	Parameters: [server]
+func HandleInfo(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doInfo()
+}
+
+// HandleVersion processes a VERSION command.
+//
+// The server will respond with its version, followed by its ISUPPORT tokens.
+//
+//	Command: VERSION
+//	Parameters: [server]
+func HandleVersion(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doVersion()
+}
+
+// HandleTime processes a TIME command.
+//
+// The server will respond with its local time.
+//
+//	Command: TIME
+//	Parameters: [server]
+func HandleTime(ctx *MessageContext) {
+	ctx.Handled()
+	ctx.Conn.doTime()
+}
+
+// HandleHelp processes a HELP command, returning the help text of the command, or
+// listing the commands available to the user if none is given.
+//
+//	Command: HELP
+//	Parameters: [command]
+func HandleHelp(ctx *MessageContext) {
+	ctx.Handled()
+
+	subject := ctx.Msg.Trailing
+	if len(ctx.Msg.Params) > 0 {
+		subject = ctx.Msg.Params[0]
+	}
+
+	ctx.Conn.doHelp(subject)
+}
+
+// HandleKill processes a KILL command, disconnecting the user with the given nick.
+//
+//	Command: KILL
+//	Parameters: <nick> [:<reason>]
+func HandleKill(ctx *MessageContext) {
+	ctx.Handled()
+
+	// Without a reason, the trailing parameter falls back to the nick itself.
+	reason := ctx.Msg.Trailing
+	if reason == ctx.Msg.Params[0] {
+		reason = ""
+	}
+
+	ctx.Conn.doKillUser(ctx.Msg.Params[0], reason)
+}
+
+// HandleKLine processes a KLINE command.
+//
+// The server will ban users matching the user@host mask from connecting,
+// for the given number of minutes, or permanently if omitted, and disconnect
+// any matching users already connected.
+//
+//	Command: KLINE
+//	Parameters: [minutes] <user@host> :<reason>
+func HandleKLine(ctx *MessageContext) {
+	ctx.Handled()
+
+	params := ctx.Msg.Params
+	var duration time.Duration
+	if minutes, err := strconv.Atoi(params[0]); err == nil && len(params) > 1 {
+		duration = time.Duration(minutes) * time.Minute
+		params = params[1:]
+	}
+
+	// Without a reason, the trailing parameter falls back to the mask itself.
+	reason := ctx.Msg.Trailing
+	if reason == params[0] {
+		reason = ""
+	}
+
+	ctx.Conn.doKLine(params[0], duration, reason)
+}
+
+// HandleLockdown processes a LOCKDOWN command, reporting the lockdown level of the
+// server, or setting it from OFF (0) to 5, each level adding a restriction:
+//
+//	1: new account registrations are disabled
+//	2: new connections must log in with SASL before registering
+//	3: only operators may create channels
+//	4: messages are strictly rate limited, except for operators and flood immune users
+//	5: new connections are refused
+//
+//	Command: LOCKDOWN
+//	Parameters: [level] [:reason]
+func HandleLockdown(ctx *MessageContext) {
+	ctx.Handled()
+
+	// Without a reason, the trailing parameter falls back to the level itself.
+	reason := ctx.Msg.Trailing
+	if len(ctx.Msg.Params) > 0 && reason == ctx.Msg.Params[0] {
+		reason = ""
+	}
+
+	ctx.Conn.doLockdown(ctx.Msg.Params, reason)
+}
+
+// HandleBroadcast processes a GLOBALNOTICE command, sending a server notice to every
+// connected user, or a GLOBOPS command, sending it to every operator.
+//
+//	Command: GLOBALNOTICE | GLOBOPS
+//	Parameters: :<text>
+func HandleBroadcast(ctx *MessageContext) {
+	ctx.Handled()
+	if len(ctx.Msg.Trailing) == 0 {
+		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
+		return
+	}
+
+	ctx.Conn.doBroadcast(ctx.Msg.Command, ctx.Msg.Trailing)
+}
+
+// HandleAudit processes an AUDIT command, listing the most recent entries of the audit
+// log of operator actions, optionally only those whose actor, action, or target match a mask.
+//
+//	Command: AUDIT
+//	Parameters: [count] [mask]
+func HandleAudit(ctx *MessageContext) {
+	ctx.Handled()
+
+	params := ctx.Msg.Params
+	if trailing := ctx.Msg.Trailing; len(trailing) > 0 && (len(params) == 0 || params[len(params)-1] != trailing) {
+		params = append(params, trailing)
+	}
+
+	ctx.Conn.doAudit(params)
+}
+
+// HandleFilter processes a FILTER command, listing, adding, or removing the rules
+// filtering the text of messages, or the nicks and realnames of users.
+//
+//	Command: FILTER
+//	Parameters: LIST | ADD <name> <field> <action> <glob|regex> <reason|-> :<pattern> | DEL <name>
+func HandleFilter(ctx *MessageContext) {
+	ctx.Handled()
+
+	params := ctx.Msg.Params[1:]
+	if trailing := ctx.Msg.Trailing; len(trailing) > 0 && (len(params) == 0 || params[len(params)-1] != trailing) {
+		params = append(params, trailing)
+	}
+
+	ctx.Conn.doFilter(ctx.Msg.Params[0], params)
+}
+
+// HandleCensor processes a CENSOR command, listing, adding, or removing censored words.
+//
+//	Command: CENSOR
+//	Parameters: LIST | ADD <word> [replacement|BLOCK] | DEL <word>
+func HandleCensor(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doCensor(ctx.Msg.Params[0], ctx.Msg.Params[1:])
+}
+
+// HandleDebug processes a DEBUG command, reporting or setting the log levels of the server,
+// or the debug snomask of the operator.
+//
+//	Command: DEBUG
+//	Parameters: LOGLEVEL [[category] level] | SNOMASK [+d|-d]
+func HandleDebug(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doDebug(ctx.Msg.Params[0], ctx.Msg.Params[1:])
+}
+
+// HandleLinks processes a LINKS command.
+//
+// The server will respond with the servers of the network whose name matches the mask,
+// or all of them without one. Querying a remote server is not supported, the mask is
+// always matched against the servers known to this one.
+//
+//	Command: LINKS
+//	Parameters: [[server] <mask>]
+func HandleLinks(ctx *MessageContext) {
+	ctx.Handled()
+
+	mask := ""
+	if params := ctx.Msg.Params; len(params) > 0 {
+		mask = params[len(params)-1]
+	}
+	ctx.Conn.ReplyLinks(mask)
+}
+
+// HandleList processes a LIST command.
+//
+// The server will respond with the channels matching the comma separated masks and ELIST
+// conditions, or all of them without any. Querying a remote server is not supported.
+//
+//	Command: LIST
+//	Parameters: [<channel|condition>{,<channel|condition>}] [<server>]
+func HandleList(ctx *MessageContext) {
+	ctx.Handled()
+
+	param := ""
+	if params := ctx.Msg.Params; len(params) > 0 {
+		param = params[0]
+	}
+	ctx.Conn.doList(param)
+}
+
+// HandleConnect processes a CONNECT command, linking the server to the server of the
+// named connect block.
+//
+//	Command: CONNECT
+//	Parameters: <server>
+func HandleConnect(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doConnect(ctx.Msg.Params[0])
+}
+
+// HandleSquit processes a SQUIT command, unlinking the named server.
+//
+//	Command: SQUIT
+//	Parameters: <server> [:<reason>]
+func HandleSquit(ctx *MessageContext) {
+	ctx.Handled()
+
+	// Without a reason, the trailing parameter falls back to the server itself.
+	reason := ctx.Msg.Trailing
+	if reason == ctx.Msg.Params[0] {
+		reason = ""
+	}
+
+	ctx.Conn.doSquit(ctx.Msg.Params[0], reason)
+}
+
+// HandleMap processes a MAP command.
+//
+// The server will respond with the servers of the network as a tree, starting from this
+// one, with the number of users on each and their share of the network.
+//
+//	Command: MAP
+//	Parameters: none
+func HandleMap(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.ReplyMap()
+}
+
+// HandleDrain processes a DRAIN command, closing the listeners of the server while
+// existing connections are served until they disconnect.
+//
+//	Command: DRAIN
+//	Parameters: none
+func HandleDrain(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doDrain()
+}
+
+// HandleRehash processes a REHASH command, reloading the reloadable configuration of
+// the server.
+//
+//	Command: REHASH
+//	Parameters: none
+func HandleRehash(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doRehash()
+}
+
+// HandleShun processes a SHUN command.
+//
+// The server will silently ignore all commands but PING, PONG, and QUIT from users
+// matching the user@host mask, for the given number of minutes, or permanently if
+// omitted, including those already connected.
+//
+//	Command: SHUN
+//	Parameters: [minutes] <user@host> :<reason>
+func HandleShun(ctx *MessageContext) {
+	ctx.Handled()
+
+	params := ctx.Msg.Params
+	var duration time.Duration
+	if minutes, err := strconv.Atoi(params[0]); err == nil && len(params) > 1 {
+		duration = time.Duration(minutes) * time.Minute
+		params = params[1:]
+	}
+
+	// Without a reason, the trailing parameter falls back to the mask itself.
+	reason := ctx.Msg.Trailing
+	if reason == params[0] {
+		reason = ""
+	}
+
+	ctx.Conn.doShun(params[0], duration, reason)
+}
+
+// HandleUnShun processes an UNSHUN command, removing the shun on the mask.
+//
+//	Command: UNSHUN
+//	Parameters: <user@host>
+func HandleUnShun(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doUnShun(ctx.Msg.Params[0])
+}
+
+// HandleUnKLine processes an UNKLINE command, removing the K-line on the mask.
+//
+//	Command: UNKLINE
+//	Parameters: <user@host>
+func HandleUnKLine(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doUnKLine(ctx.Msg.Params[0])
+}
+
+// HandleBanInfo processes a BANINFO command, replying with the server the K-line on the
+// mask, or filter rule with the name, was set on.
+//
+//	Command: BANINFO
+//	Parameters: <user@host | filter>
+func HandleBanInfo(ctx *MessageContext) {
+	ctx.Handled()
+
+	ctx.Conn.doBanInfo(ctx.Msg.Params[0])
 }
 
 // HandlePing processes a PING command originated from the client.
@@ -299,9 +880,12 @@ func HandleUserhost(ctx *MessageContext) {
 //	Parameters: :<token>
 func HandlePing(ctx *MessageContext) {
 	ctx.Handled()
-	ctx.Msg.Source = ctx.Conn.hostname
-	ctx.Msg.Command = CmdPong
-	ctx.Conn.Write(ctx.Msg.RenderBuffer())
+	reply := ctx.Conn.newMessage()
+	defer msgPool.Recycle(reply, reply.Generation())
+	reply.Command = CmdPong
+	reply.Params = ctx.Msg.Params
+	reply.Trailing = ctx.Msg.Trailing
+	ctx.Conn.WriteMessage(reply)
 }
 
 // HandlePong processes a PONG command in reply to a server sent PING command.
@@ -322,9 +906,56 @@ func HandlePong(ctx *MessageContext) {
 	ctx.Conn.lastPingRecv = ctx.Msg.Trailing
 }
 
+// MustBeRegistered is a middleware which rejects the command unless the connection has
+// completed registration. The router already refuses commands from unregistered
+// connections unless they are allowed with AllowUnregistered.
 func MustBeRegistered(ctx *MessageContext) {
 	if !ctx.Conn.isRegistered() {
 		ctx.Handled()
 		ctx.Conn.ReplyNotRegistered()
 	}
 }
+
+// MustBeOper is a middleware which rejects the command unless the user is an operator.
+func MustBeOper(ctx *MessageContext) {
+	if !ctx.Conn.user.IsOper() {
+		ctx.Handled()
+		ctx.Conn.ReplyNoPrivileges()
+	}
+}
+
+// RequirePrivilege returns a middleware which rejects the command unless the user is an
+// operator holding all of the given privileges.
+func RequirePrivilege(priv OperPrivilege) MessageHandler {
+	return func(ctx *MessageContext) {
+		if !ctx.Conn.user.HasPrivilege(priv) {
+			ctx.Handled()
+			ctx.Conn.ReplyNoPrivileges()
+		}
+	}
+}
+
+// Recover is a middleware which recovers from a panic in the rest of the handler chain,
+// logging it as an error and sending an ERROR to the user rather than crashing the server.
+func Recover(ctx *MessageContext) {
+	defer func() {
+		if r := recover(); r != nil {
+			ctx.Handled()
+			ctx.log.WithField("handler", ctx.handler).Errorf("panic handling command: %v\n%s", r, debug.Stack())
+			if ctx.Conn != nil {
+				ctx.ReplyCommand(CmdError, fmt.Sprintf("Internal error handling %s", ctx.Msg.Command))
+			}
+		}
+	}()
+	ctx.Next()
+}
+
+// Timing is a middleware which records how long the rest of the handler chain takes in
+// the latency histogram of the command.
+func (router *Router) Timing(ctx *MessageContext) {
+	start := time.Now()
+	ctx.Next()
+	if histogram, exists := router.latencies[ctx.Msg.Command]; exists {
+		histogram.observe(time.Since(start))
+	}
+}
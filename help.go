@@ -0,0 +1,64 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// helpIndex is the HELP subject listing the available commands.
+const helpIndex = "index"
+
+// doHelp returns the help text of the command, or lists the commands available to
+// the user if none is given.
+func (conn *Conn) doHelp(subject string) {
+	if len(subject) == 0 || strings.EqualFold(subject, helpIndex) {
+		var commands []string
+		for command, spec := range conn.server.Router.specs {
+			if spec.available(conn.user) {
+				commands = append(commands, command)
+			}
+		}
+		sort.Strings(commands)
+
+		lines := []string{"Available commands:"}
+		lines = append(lines, stringutils.ChunkJoinStrings(MaxMsgLength-64-len(conn.user.Nick()), SPACE, commands...)...)
+		lines = append(lines, "Use /HELP <command> for the help text of a command.")
+		conn.ReplyHelp(helpIndex, lines)
+		return
+	}
+
+	command := conn.server.Router.resolve(subject)
+	spec, exists := conn.server.Router.Spec(command)
+	if !exists || !spec.available(conn.user) {
+		conn.ReplyHelpNotFound(subject)
+		return
+	}
+
+	usage := command
+	if len(spec.Help.Usage) > 0 {
+		usage += SPACE + spec.Help.Usage
+	}
+	lines := append([]string{usage}, spec.Help.Text...)
+
+	var aliases []string
+	for alias, aliased := range conn.server.Router.aliases {
+		if aliased == command {
+			aliases = append(aliases, alias)
+		}
+	}
+	if len(aliases) > 0 {
+		sort.Strings(aliases)
+		lines = append(lines, "Aliases: "+strings.Join(aliases, ", "))
+	}
+
+	conn.ReplyHelp(command, lines)
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// Build information, set at compile time with linker flags, eg:
+//
+//	go build -ldflags "-X github.com/btnmasher/dircd.Version=1.0.0 \
+//		-X github.com/btnmasher/dircd.Commit=$(git rev-parse --short HEAD) \
+//		-X github.com/btnmasher/dircd.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// adminInfo holds the administrative contact details returned by the ADMIN command.
+type adminInfo struct {
+	location    string
+	description string
+	email       string
+}
+
+// WithAdminInfo sets the administrative contact details returned by the ADMIN command:
+// the location of the server, a description of the organization running it, and the
+// email address of the administrator.
+func WithAdminInfo(location, description, email string) ServerOption {
+	return option(func(s *Server) error {
+		s.admin = adminInfo{
+			location:    location,
+			description: description,
+			email:       email,
+		}
+		return nil
+	})
+}
+
+// doAdmin replies with the administrative contact details of the server.
+func (conn *Conn) doAdmin() {
+	admin := conn.server.admin
+	if admin == (adminInfo{}) {
+		msg := conn.newMessage()
+		defer msgPool.Recycle(msg, msg.Generation())
+
+		msg.Code = ReplyNoAdminInfo
+		msg.Params = []string{conn.user.Nick(), conn.server.Hostname()}
+		msg.Trailing = ErrNoAdminInfo.Error()
+		conn.WriteMessage(msg)
+		return
+	}
+
+	conn.writeNumerics([]numericLine{
+		{ReplyAdminInfoStart, []string{conn.server.Hostname()}, "Administrative info"},
+		{ReplyAdminInfo1, nil, admin.location},
+		{ReplyAdminInfo2, nil, admin.description},
+		{ReplyAdminEmail, nil, admin.email},
+	})
+}
+
+// doVersion replies with the version of the server, followed by its ISUPPORT tokens.
+func (conn *Conn) doVersion() {
+	conn.writeNumerics([]numericLine{
+		{ReplyVersion, []string{"dircd-" + Version, conn.server.Hostname()}, "commit " + Commit},
+	})
+	conn.ReplyISupport()
+}
+
+// doInfo replies with the build and runtime information of the server.
+func (conn *Conn) doInfo() {
+	lines := []numericLine{
+		{ReplyInfo, nil, "dircd " + Version},
+		{ReplyInfo, nil, "Commit: " + Commit},
+		{ReplyInfo, nil, "Compiled: " + BuildDate},
+		{ReplyInfo, nil, fmt.Sprintf("Go: %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)},
+	}
+	if uptime := conn.server.Uptime(); uptime > 0 {
+		started := time.Now().Add(-uptime).UTC().Format(time.RFC1123)
+		lines = append(lines, numericLine{ReplyInfo, nil, "On-line since " + started})
+	}
+	lines = append(lines, numericLine{ReplyEndOfInfo, nil, "End of /INFO list"})
+
+	conn.writeNumerics(lines)
+}
+
+// doTime replies with the local time of the server.
+func (conn *Conn) doTime() {
+	conn.writeNumerics([]numericLine{
+		{ReplyTime, []string{conn.server.Hostname()}, time.Now().Format(time.RFC1123Z)},
+	})
+}
+
+// numericLine is a single numeric reply, addressed to the user, in a multi-line response.
+type numericLine struct {
+	code     uint16
+	params   []string
+	trailing string
+}
+
+// writeNumerics renders and writes the numeric replies to the user in order.
+func (conn *Conn) writeNumerics(lines []numericLine) {
+	nick := conn.user.Nick()
+	var batch messageBatch
+	defer batch.recycle()
+
+	for _, line := range lines {
+		msg := conn.newMessage()
+		msg.Code = line.code
+		msg.Params = append([]string{nick}, line.params...)
+		msg.Trailing = line.trailing
+		batch.add(msg)
+	}
+
+	for i := range batch.messages {
+		conn.WriteMessage(batch.messages[i])
+	}
+}
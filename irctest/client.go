@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package irctest provides an in-memory IRC client for integration tests of a dircd
+// Server, connected to it with net.Pipe rather than real sockets.
+//
+// A Client drives registration, sends lines and waits for the replies expected of the
+// server, failing the test if they are not received in time:
+//
+//	srv, _ := dircd.NewServer(dircd.WithHostname("irc.example.net"))
+//	_ = srv.Start()
+//
+//	client := irctest.NewClient(t, srv)
+//	client.Register("bob")
+//	client.Send("JOIN #dircd")
+//	client.ExpectNumeric(366)
+package irctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btnmasher/dircd"
+)
+
+// DefaultTimeout is how long a Client waits for an expected line by default.
+const DefaultTimeout = 5 * time.Second
+
+// Line is a line received by a Client from the server.
+type Line struct {
+	Raw     string
+	Tags    map[string]string
+	Source  string
+	Command string   // The command, or the three digits of a numeric reply.
+	Params  []string // The parameters, the trailing one last.
+}
+
+// ParseLine parses a line sent by a server, eg: ":irc.example.net 001 bob :Welcome".
+func ParseLine(raw string) (Line, error) {
+	line := Line{Raw: raw}
+	rest := strings.TrimRight(raw, "\r\n")
+
+	if tags, found := strings.CutPrefix(rest, "@"); found {
+		var rawTags string
+		rawTags, rest, _ = strings.Cut(tags, " ")
+		line.Tags = make(map[string]string)
+		for _, tag := range strings.Split(rawTags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			line.Tags[key] = value
+		}
+	}
+
+	if source, found := strings.CutPrefix(rest, ":"); found {
+		line.Source, rest, _ = strings.Cut(source, " ")
+	}
+
+	middle, trailing, hasTrailing := strings.Cut(rest, " :")
+	fields := strings.Fields(middle)
+	if len(fields) == 0 {
+		return Line{}, fmt.Errorf("line [%s] has no command", raw)
+	}
+	line.Command = strings.ToUpper(fields[0])
+	line.Params = fields[1:]
+	if hasTrailing {
+		line.Params = append(line.Params, trailing)
+	}
+	return line, nil
+}
+
+// Numeric returns the numeric of the reply, or zero if the line is not a numeric reply.
+func (line Line) Numeric() uint16 {
+	if len(line.Command) != 3 {
+		return 0
+	}
+	code, err := strconv.ParseUint(line.Command, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(code)
+}
+
+// Param returns the parameter at the index, or an empty string if there is none.
+func (line Line) Param(index int) string {
+	if index < 0 || index >= len(line.Params) {
+		return ""
+	}
+	return line.Params[index]
+}
+
+// Trailing returns the last parameter of the line, or an empty string if it has none.
+func (line Line) Trailing() string {
+	return line.Param(len(line.Params) - 1)
+}
+
+// Client is an IRC client connected to a Server in memory.
+type Client struct {
+	Timeout time.Duration // How long to wait for an expected line.
+
+	t      testing.TB
+	conn   net.Conn
+	lines  chan Line
+	served chan error
+	closed sync.Once
+
+	mu       sync.Mutex
+	received []Line
+	nick     string
+}
+
+// NewClient connects a new client to the server, which must have been started, and is
+// disconnected when the test ends.
+func NewClient(t testing.TB, srv *dircd.Server) *Client {
+	t.Helper()
+	server, conn := net.Pipe()
+	client := &Client{
+		Timeout: DefaultTimeout,
+		t:       t,
+		conn:    conn,
+		lines:   make(chan Line, 1024),
+		served:  make(chan error, 1),
+	}
+
+	go func() { client.served <- srv.ServeConn(server) }()
+	go client.readLoop()
+	t.Cleanup(client.Close)
+	return client
+}
+
+// readLoop reads the lines sent by the server until the connection is closed.
+func (client *Client) readLoop() {
+	defer close(client.lines)
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		line, err := ParseLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+		client.mu.Lock()
+		client.received = append(client.received, line)
+		client.mu.Unlock()
+		client.lines <- line
+	}
+}
+
+// Send sends the line, formatted with the args if any, to the server.
+func (client *Client) Send(format string, args ...any) {
+	client.t.Helper()
+	line := format
+	if len(args) > 0 {
+		line = fmt.Sprintf(format, args...)
+	}
+	if err := client.conn.SetWriteDeadline(time.Now().Add(client.Timeout)); err != nil {
+		client.t.Fatalf("irctest: error sending [%s]: %v", line, err)
+	}
+	if _, err := client.conn.Write([]byte(line + "\r\n")); err != nil {
+		client.t.Fatalf("irctest: error sending [%s]: %v", line, err)
+	}
+}
+
+// Register registers the client with the nick, returning the welcome reply.
+func (client *Client) Register(nick string) Line {
+	client.t.Helper()
+	client.Send("NICK %s", nick)
+	client.Send("USER %s 0 * :%s", nick, nick)
+	welcome := client.ExpectNumeric(dircd.ReplyWelcome)
+	client.mu.Lock()
+	client.nick = nick
+	client.mu.Unlock()
+	return welcome
+}
+
+// Nick returns the nick the client registered with.
+func (client *Client) Nick() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.nick
+}
+
+// ExpectFunc returns the next line for which the match returns true, skipping the
+// others, failing the test if none is received in time.
+func (client *Client) ExpectFunc(description string, match func(Line) bool) Line {
+	client.t.Helper()
+	timeout := time.After(client.Timeout)
+	for {
+		select {
+		case line, open := <-client.lines:
+			if !open {
+				client.t.Fatalf("irctest: connection closed while waiting for %s", description)
+				return Line{}
+			}
+			if match(line) {
+				return line
+			}
+		case <-timeout:
+			client.t.Fatalf("irctest: did not receive %s", description)
+			return Line{}
+		}
+	}
+}
+
+// Expect returns the next line with the command, eg: "JOIN" or "001".
+func (client *Client) Expect(command string) Line {
+	client.t.Helper()
+	command = strings.ToUpper(command)
+	return client.ExpectFunc(command, func(line Line) bool { return line.Command == command })
+}
+
+// ExpectNumeric returns the next numeric reply with the code.
+func (client *Client) ExpectNumeric(code uint16) Line {
+	client.t.Helper()
+	return client.ExpectFunc(fmt.Sprintf("numeric %03d", code), func(line Line) bool { return line.Numeric() == code })
+}
+
+// ExpectContains returns the next line containing the text.
+func (client *Client) ExpectContains(text string) Line {
+	client.t.Helper()
+	return client.ExpectFunc(fmt.Sprintf("a line containing [%s]", text), func(line Line) bool {
+		return strings.Contains(line.Raw, text)
+	})
+}
+
+// Received returns every line received so far, including those skipped while waiting.
+func (client *Client) Received() []Line {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return append([]Line(nil), client.received...)
+}
+
+// Numerics returns the codes of the numeric replies received so far, in order.
+func (client *Client) Numerics() []uint16 {
+	var codes []uint16
+	for _, line := range client.Received() {
+		if code := line.Numeric(); code > 0 {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// Close disconnects the client, waiting for the server to end its session.
+func (client *Client) Close() {
+	client.closed.Do(func() {
+		_ = client.conn.Close()
+		select {
+		case <-client.served:
+		case <-time.After(client.Timeout):
+		}
+	})
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package irctest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestParseLine(t *testing.T) {
+	line, err := ParseLine("@time=2023-01-01T00:00:00.000Z;bot :irc.example.net 332 bob #dircd :Welcome to dircd\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"time": "2023-01-01T00:00:00.000Z", "bot": ""}, line.Tags)
+	assert.Equal(t, "irc.example.net", line.Source)
+	assert.Equal(t, uint16(332), line.Numeric())
+	assert.Equal(t, []string{"bob", "#dircd", "Welcome to dircd"}, line.Params)
+	assert.Equal(t, "Welcome to dircd", line.Trailing())
+
+	line, err = ParseLine("PING token")
+	require.NoError(t, err)
+	assert.Empty(t, line.Source)
+	assert.Zero(t, line.Numeric())
+	assert.Equal(t, "token", line.Trailing())
+	assert.Empty(t, line.Param(1))
+
+	_, err = ParseLine(":irc.example.net")
+	assert.Error(t, err)
+}
+
+func newServer(t testing.TB, options ...dircd.ServerOption) *dircd.Server {
+	srv, err := dircd.NewServer(append([]dircd.ServerOption{dircd.WithHostname("irc.example.net")}, options...)...)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start())
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv
+}
+
+func TestClientChannel(t *testing.T) {
+	srv := newServer(t)
+
+	bob := NewClient(t, srv)
+	welcome := bob.Register("bob")
+	assert.Equal(t, "irc.example.net", welcome.Source)
+	assert.Equal(t, "bob", bob.Nick())
+
+	bob.Send("JOIN #dircd")
+	join := bob.Expect("JOIN")
+	assert.Equal(t, "#dircd", join.Param(0))
+	names := bob.ExpectNumeric(dircd.ReplyNames)
+	assert.Equal(t, "~bob", names.Trailing())
+	bob.ExpectNumeric(dircd.ReplyEndOfNames)
+
+	alice := NewClient(t, srv)
+	alice.Register("alice")
+	alice.Send("JOIN #dircd")
+	alice.ExpectNumeric(dircd.ReplyEndOfNames)
+
+	alice.Send("PRIVMSG #dircd :hello %s", "bob")
+	message := bob.Expect("PRIVMSG")
+	assert.Contains(t, message.Source, "alice!")
+	assert.Equal(t, []string{"#dircd", "hello bob"}, message.Params)
+
+	alice.Send("MODE #dircd +b mallory")
+	reply := alice.ExpectNumeric(dircd.ReplyChanOpPrivsNeeded)
+	assert.Equal(t, "#dircd", reply.Param(1))
+	assert.Contains(t, alice.Numerics(), dircd.ReplyWelcome)
+}
+
+func TestClientClose(t *testing.T) {
+	srv := newServer(t)
+
+	bob := NewClient(t, srv)
+	bob.Register("bob")
+	require.True(t, srv.Nicks.Exists("bob"))
+
+	bob.Close()
+	assert.False(t, srv.Nicks.Exists("bob"))
+	bob.Close()
+}
@@ -0,0 +1,439 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package irctest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btnmasher/dircd"
+)
+
+// loadPayload prefixes the text of the messages sent by a Load, followed by the time
+// they were sent, from which their latency is measured when they are received.
+const loadPayload = "load "
+
+// LoadConfig is the configuration of a Load.
+type LoadConfig struct {
+	Clients  int           // Number of clients connected.
+	Channels int           // Number of channels the clients are spread across, each client joining one.
+	Rate     float64       // Messages sent per second by each client. Unthrottled if zero.
+	Duration time.Duration // How long the clients send messages. Unlimited if zero.
+	Messages int           // Messages sent by all the clients in total. Unlimited if zero.
+	Timeout  time.Duration // How long to wait for registration, and for the messages sent to be delivered.
+}
+
+// validate checks the config describes a load which ends.
+func (cfg LoadConfig) validate() error {
+	var errs []error
+	if cfg.Clients < 1 || cfg.Channels < 1 {
+		errs = append(errs, errors.New("load must have at least one client and channel"))
+	}
+	if cfg.Rate < 0 || cfg.Duration < 0 || cfg.Messages < 0 || cfg.Timeout < 0 {
+		errs = append(errs, errors.New("load rate, duration, messages and timeout must not be negative"))
+	}
+	if cfg.Duration == 0 && cfg.Messages == 0 {
+		errs = append(errs, errors.New("load must be limited by a duration or a number of messages"))
+	}
+	return errors.Join(errs...)
+}
+
+// LoadReport is the result of a Load.
+type LoadReport struct {
+	Sent       int64         // Messages sent.
+	Expected   int64         // Messages which should have been delivered, to every other member of the channels.
+	Received   int64         // Messages delivered.
+	Elapsed    time.Duration // From the first message sent to the last delivered.
+	P50        time.Duration // Median latency of the messages delivered.
+	P99        time.Duration // 99th percentile latency of the messages delivered.
+	Max        time.Duration // Highest latency of the messages delivered.
+	Mallocs    uint64        // Heap allocations of the process during the load.
+	AllocBytes uint64        // Bytes allocated by the process during the load.
+}
+
+// Throughput returns the messages delivered per second.
+func (report LoadReport) Throughput() float64 {
+	if report.Elapsed <= 0 {
+		return 0
+	}
+	return float64(report.Received) / report.Elapsed.Seconds()
+}
+
+// AllocsPerMessage returns the heap allocations of the process per message delivered.
+func (report LoadReport) AllocsPerMessage() float64 {
+	if report.Received == 0 {
+		return 0
+	}
+	return float64(report.Mallocs) / float64(report.Received)
+}
+
+// String returns a summary of the report, eg: for printing.
+func (report LoadReport) String() string {
+	return fmt.Sprintf("sent %d, delivered %d/%d in %s: %.0f msg/s, latency p50 %s p99 %s max %s, %.1f allocs/msg (%.0f B/msg)",
+		report.Sent, report.Received, report.Expected, report.Elapsed.Round(time.Millisecond),
+		report.Throughput(), report.P50, report.P99, report.Max,
+		report.AllocsPerMessage(), float64(report.AllocBytes)/float64(max(report.Received, 1)))
+}
+
+// Dialer returns a dial function connecting to the server in memory, for NewLoad. The
+// server must have been started.
+func Dialer(srv *dircd.Server) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		server, conn := net.Pipe()
+		go func() { _ = srv.ServeConn(server) }()
+		return conn, nil
+	}
+}
+
+// Load is a number of clients spread across channels, exchanging messages through a
+// server to measure its throughput, latency and allocations. It is used by the
+// benchmarks of the server and by cmd/dircd-bench.
+type Load struct {
+	cfg     LoadConfig
+	dial    func() (net.Conn, error)
+	clients []*loadClient
+	members []int // Number of clients in each channel.
+
+	start    time.Time // The time the payloads of messages are measured from.
+	sent     atomic.Int64
+	expected atomic.Int64
+	received atomic.Int64
+	last     atomic.Int64 // Time since start of the last delivery, in nanoseconds.
+}
+
+// NewLoad returns a load of the config, connecting its clients with the dial function.
+func NewLoad(cfg LoadConfig, dial func() (net.Conn, error)) (*Load, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &Load{cfg: cfg, dial: dial, members: make([]int, cfg.Channels), start: time.Now()}, nil
+}
+
+// Connect connects and registers the clients, and joins each to its channel.
+func (load *Load) Connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, load.cfg.Timeout)
+	defer cancel()
+
+	for i := 0; i < load.cfg.Clients; i++ {
+		sock, err := load.dial()
+		if err != nil {
+			return fmt.Errorf("error connecting client %d: %w", i, err)
+		}
+		client := &loadClient{
+			load:    load,
+			conn:    sock,
+			channel: i % load.cfg.Channels,
+			replies: make(chan Line, 64),
+			done:    make(chan struct{}),
+		}
+		load.clients = append(load.clients, client)
+		load.members[client.channel]++
+		go client.readLoop()
+	}
+
+	// Clients register concurrently, as registering one at a time over a network would
+	// take a round trip each.
+	errs := make(chan error, len(load.clients))
+	for i, client := range load.clients {
+		go func(i int, client *loadClient) { errs <- client.register(ctx, i) }(i, client)
+	}
+	var joinErr error
+	for range load.clients {
+		joinErr = errors.Join(joinErr, <-errs)
+	}
+	return joinErr
+}
+
+// Run sends messages from every client to its channel, at the rate until the duration
+// elapses or the number of messages is sent, then waits for them to be delivered.
+func (load *Load) Run(ctx context.Context) (LoadReport, error) {
+	if len(load.clients) == 0 {
+		return LoadReport{}, errors.New("load is not connected")
+	}
+
+	runCtx := ctx
+	if load.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, load.cfg.Duration)
+		defer cancel()
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	begin := time.Since(load.start)
+
+	var senders sync.WaitGroup
+	for _, client := range load.clients {
+		senders.Add(1)
+		go func(client *loadClient) {
+			defer senders.Done()
+			client.sendLoop(runCtx)
+		}(client)
+	}
+	senders.Wait()
+
+	err := load.drain(ctx)
+	runtime.ReadMemStats(&after)
+
+	report := LoadReport{
+		Sent:       load.sent.Load(),
+		Expected:   load.expected.Load(),
+		Received:   load.received.Load(),
+		Elapsed:    time.Duration(max(load.last.Load(), int64(begin))) - begin,
+		Mallocs:    after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}
+	report.P50, report.P99, report.Max = load.latencies()
+	return report, err
+}
+
+// Close disconnects the clients.
+func (load *Load) Close() {
+	for _, client := range load.clients {
+		_ = client.conn.Close()
+	}
+	for _, client := range load.clients {
+		<-client.done
+	}
+}
+
+// take reports whether another message may be sent within the limit of messages.
+func (load *Load) take() bool {
+	if load.cfg.Messages == 0 {
+		load.sent.Add(1)
+		return true
+	}
+	for {
+		sent := load.sent.Load()
+		if sent >= int64(load.cfg.Messages) {
+			return false
+		}
+		if load.sent.CompareAndSwap(sent, sent+1) {
+			return true
+		}
+	}
+}
+
+// delivered counts a message delivered at the time since the start of the load.
+func (load *Load) delivered(now int64) {
+	load.received.Add(1)
+	for {
+		last := load.last.Load()
+		if now <= last || load.last.CompareAndSwap(last, now) {
+			return
+		}
+	}
+}
+
+// drain waits for the messages sent to be delivered, or the timeout to elapse.
+func (load *Load) drain(ctx context.Context) error {
+	deadline := time.NewTimer(load.cfg.Timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(time.Millisecond)
+	defer poll.Stop()
+
+	for load.received.Load() < load.expected.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("%d of %d messages delivered before the timeout", load.received.Load(), load.expected.Load())
+		case <-poll.C:
+		}
+	}
+	return nil
+}
+
+// latencies returns the median, 99th percentile and highest latencies of the messages
+// delivered to every client.
+func (load *Load) latencies() (p50, p99, highest time.Duration) {
+	var all []time.Duration
+	for _, client := range load.clients {
+		client.mu.Lock()
+		all = append(all, client.latencies...)
+		client.mu.Unlock()
+	}
+	if len(all) == 0 {
+		return 0, 0, 0
+	}
+	slices.Sort(all)
+	percentile := func(p float64) time.Duration {
+		return all[min(int(float64(len(all))*p), len(all)-1)]
+	}
+	return percentile(0.50), percentile(0.99), all[len(all)-1]
+}
+
+// loadClient is a client of a Load.
+type loadClient struct {
+	load    *Load
+	conn    net.Conn
+	channel int
+	replies chan Line // The lines received other than messages and PINGs, while registering.
+	done    chan struct{}
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+// register registers the client as the nth, and joins it to its channel.
+func (client *loadClient) register(ctx context.Context, n int) error {
+	nick := fmt.Sprintf("load%d", n)
+	channel := fmt.Sprintf("#load%d", client.channel)
+	if err := client.send("NICK %s\r\nUSER %s 0 * :%s\r\n", nick, nick, nick); err != nil {
+		return err
+	}
+	if err := client.expect(ctx, dircd.ReplyWelcome); err != nil {
+		return fmt.Errorf("error registering %s: %w", nick, err)
+	}
+	if err := client.send("JOIN %s\r\n", channel); err != nil {
+		return err
+	}
+	if err := client.expect(ctx, dircd.ReplyEndOfNames); err != nil {
+		return fmt.Errorf("error joining %s to %s: %w", nick, channel, err)
+	}
+	return nil
+}
+
+// expect waits for the numeric reply, failing on an ERROR from the server.
+func (client *loadClient) expect(ctx context.Context, code uint16) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("did not receive numeric %03d: %w", code, ctx.Err())
+		case line, open := <-client.replies:
+			switch {
+			case !open:
+				return fmt.Errorf("connection closed while waiting for numeric %03d", code)
+			case line.Command == "ERROR":
+				return fmt.Errorf("server closed the connection: %s", line.Trailing())
+			case line.Numeric() == code:
+				return nil
+			}
+		}
+	}
+}
+
+// send writes the lines, formatted with the args.
+func (client *loadClient) send(format string, args ...any) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	_, err := fmt.Fprintf(client.conn, format, args...)
+	return err
+}
+
+// sendLoop sends messages to the channel of the client at the rate of the load, until
+// the context is done or the limit of messages is reached.
+func (client *loadClient) sendLoop(ctx context.Context) {
+	load := client.load
+	var tick <-chan time.Time
+	if load.cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / load.cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	line := []byte(fmt.Sprintf("PRIVMSG #load%d :%s", client.channel, loadPayload))
+	recipients := int64(load.members[client.channel] - 1)
+	for {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		if !load.take() {
+			return
+		}
+
+		load.expected.Add(recipients)
+		message := strconv.AppendInt(line, int64(time.Since(load.start)), 10)
+		client.writeMu.Lock()
+		_, err := client.conn.Write(append(message, '\r', '\n'))
+		client.writeMu.Unlock()
+		if err != nil {
+			load.expected.Add(-recipients)
+			return
+		}
+	}
+}
+
+// readLoop reads the lines sent by the server until the connection is closed, measuring
+// the latency of the messages and answering PINGs.
+func (client *loadClient) readLoop() {
+	defer close(client.done)
+	defer close(client.replies)
+
+	load := client.load
+	privmsg := []byte(" PRIVMSG ")
+	payload := []byte(" :" + loadPayload)
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		raw := scanner.Bytes()
+
+		// Messages are parsed only as far as their payload, so the allocations of the
+		// clients don't drown those of the server, when they share a process.
+		if bytes.Contains(raw, privmsg) {
+			if index := bytes.LastIndex(raw, payload); index >= 0 {
+				if sent, valid := parseNanos(raw[index+len(payload):]); valid {
+					now := int64(time.Since(load.start))
+					client.mu.Lock()
+					client.latencies = append(client.latencies, time.Duration(now-sent))
+					client.mu.Unlock()
+					load.delivered(now)
+				}
+			}
+			continue
+		}
+
+		line, err := ParseLine(string(raw))
+		if err != nil {
+			continue
+		}
+		if line.Command == "PING" {
+			_ = client.send("PONG :%s\r\n", line.Trailing())
+			continue
+		}
+		select {
+		case client.replies <- line:
+		default:
+		}
+	}
+}
+
+// parseNanos parses the time a message was sent from its payload, without allocating.
+func parseNanos(digits []byte) (int64, bool) {
+	if len(digits) == 0 || len(digits) > 18 {
+		return 0, false
+	}
+	var nanos int64
+	for _, digit := range digits {
+		if digit < '0' || digit > '9' {
+			return 0, false
+		}
+		nanos = nanos*10 + int64(digit-'0')
+	}
+	return nanos, true
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package irctest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestLoadConfig(t *testing.T) {
+	_, err := NewLoad(LoadConfig{Clients: 0, Channels: 1, Messages: 1}, nil)
+	assert.Error(t, err)
+	_, err = NewLoad(LoadConfig{Clients: 1, Channels: 1}, nil)
+	assert.Error(t, err, "unlimited load")
+	_, err = NewLoad(LoadConfig{Clients: 1, Channels: 1, Rate: -1, Duration: time.Second}, nil)
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	srv := newServer(t)
+	load, err := NewLoad(LoadConfig{Clients: 6, Channels: 2, Messages: 60}, Dialer(srv))
+	require.NoError(t, err)
+	t.Cleanup(load.Close)
+	require.NoError(t, load.Connect(context.Background()))
+
+	report, err := load.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), report.Sent)
+	assert.Equal(t, int64(120), report.Expected, "each message is delivered to the other 2 members of its channel")
+	assert.Equal(t, report.Expected, report.Received)
+	assert.Positive(t, report.Throughput())
+	assert.LessOrEqual(t, report.P50, report.P99)
+	assert.LessOrEqual(t, report.P99, report.Max)
+}
+
+func TestLoadDuration(t *testing.T) {
+	srv := newServer(t)
+	load, err := NewLoad(LoadConfig{Clients: 2, Channels: 1, Rate: 100, Duration: 100 * time.Millisecond}, Dialer(srv))
+	require.NoError(t, err)
+	t.Cleanup(load.Close)
+	require.NoError(t, load.Connect(context.Background()))
+
+	report, err := load.Run(context.Background())
+	require.NoError(t, err)
+	assert.InDelta(t, 20, report.Sent, 10, "2 clients at 100 msg/s for 100ms")
+	assert.Equal(t, report.Sent, report.Received)
+}
+
+// BenchmarkServerLoad measures the delivery of messages sent by clients to the other
+// members of their channels, through a server in memory. Each op is a message sent.
+func BenchmarkServerLoad(b *testing.B) {
+	for _, shape := range []struct{ clients, channels int }{{10, 1}, {100, 10}, {1000, 10}, {1000, 100}} {
+		b.Run(fmt.Sprintf("clients=%d/channels=%d", shape.clients, shape.channels), func(b *testing.B) {
+			srv := newServer(b, dircd.WithLogLevel(logrus.WarnLevel))
+			load, err := NewLoad(LoadConfig{
+				Clients:  shape.clients,
+				Channels: shape.channels,
+				Messages: b.N,
+				Timeout:  time.Minute,
+			}, Dialer(srv))
+			require.NoError(b, err)
+			b.Cleanup(load.Close)
+			require.NoError(b, load.Connect(context.Background()))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			report, err := load.Run(context.Background())
+			b.StopTimer()
+			require.NoError(b, err)
+
+			b.ReportMetric(report.Throughput(), "deliveries/s")
+			b.ReportMetric(float64(report.P99.Nanoseconds()), "p99-ns")
+		})
+	}
+}
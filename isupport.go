@@ -0,0 +1,231 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Limits of ISUPPORT tokens
+const (
+	maxISupportNameLength = 20
+	maxISupportTokens     = MaxMsgParams - 2 // Tokens per reply, leaving room for the nick and trailing text.
+	isupportTrailing      = "are supported by this server"
+)
+
+// ISupport holds the tokens advertised to clients in RPL_ISUPPORT replies, caching the
+// tokens chunked into reply lines until they change. It is safe for concurrent use.
+type ISupport struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+
+	lines    [][]string      // Cached reply lines, nil when a token has changed.
+	budget   int             // Length available to the tokens of each cached line.
+	rendered []renderedReply // Cached rendered reply lines, nil when a token has changed.
+	source   string          // Server the cached lines were rendered from.
+}
+
+func newISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// Get returns the value of the token, and whether it is set.
+func (is *ISupport) Get(name string) (string, bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	value, exists := is.tokens[strings.ToUpper(name)]
+	return value, exists
+}
+
+// Set sets the token to the value, which may be empty for tokens without a value.
+func (is *ISupport) Set(name, value string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.tokens[strings.ToUpper(name)] = value
+	is.lines = nil
+	is.rendered = nil
+}
+
+// setDefault sets the token to the value unless it is already set.
+func (is *ISupport) setDefault(name, value string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	name = strings.ToUpper(name)
+	if _, exists := is.tokens[name]; !exists {
+		is.tokens[name] = value
+		is.lines = nil
+		is.rendered = nil
+	}
+}
+
+// Unset removes the token.
+func (is *ISupport) Unset(name string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	delete(is.tokens, strings.ToUpper(name))
+	is.lines = nil
+	is.rendered = nil
+}
+
+// Network sets the NETWORK token to the name of the network.
+func (is *ISupport) Network(name string) {
+	is.Set("NETWORK", name)
+}
+
+// ChanModes sets the CHANMODES token to the channel modes of each type: modes which add
+// or remove an address from a list, modes which always take a parameter, modes which only
+// take a parameter when set, and modes which never take a parameter.
+func (is *ISupport) ChanModes(list, always, whenSet, never string) {
+	is.Set("CHANMODES", strings.Join([]string{list, always, whenSet, never}, ","))
+}
+
+// Prefix sets the PREFIX token to the channel membership modes, from highest to lowest,
+// and the prefixes shown for them in NAMES replies.
+func (is *ISupport) Prefix(modes, prefixes string) {
+	is.Set("PREFIX", fmt.Sprintf("(%s)%s", modes, prefixes))
+}
+
+// Tokens returns the tokens formatted as NAME=value, or NAME for tokens without a value,
+// sorted by name.
+func (is *ISupport) Tokens() []string {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return is.formatted()
+}
+
+func (is *ISupport) formatted() []string {
+	tokens := make([]string, 0, len(is.tokens))
+	for name, value := range is.tokens {
+		if len(value) > 0 {
+			name += EQUAL + value
+		}
+		tokens = append(tokens, name)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// replyLines returns the tokens chunked into the lines of RPL_ISUPPORT replies, each
+// with at most maxISupportTokens tokens whose total length, including the spaces between
+// them, fits within the budget.
+func (is *ISupport) replyLines(budget int) [][]string {
+	is.mu.RLock()
+	if is.lines != nil && is.budget == budget {
+		defer is.mu.RUnlock()
+		return is.lines
+	}
+	is.mu.RUnlock()
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.chunk(budget)
+}
+
+// renderedLines returns the RPL_ISUPPORT reply lines from the source rendered but for the
+// nick they are addressed to, see replyLines.
+func (is *ISupport) renderedLines(source string, budget int) []renderedReply {
+	is.mu.RLock()
+	if is.rendered != nil && is.budget == budget && is.source == source {
+		defer is.mu.RUnlock()
+		return is.rendered
+	}
+	is.mu.RUnlock()
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	lines := is.lines
+	if lines == nil || is.budget != budget {
+		lines = is.chunk(budget)
+	}
+	rendered := make([]renderedReply, 0, len(lines))
+	for _, tokens := range lines {
+		rendered = append(rendered, renderReply(source, ReplyISupport, tokens, isupportTrailing))
+	}
+
+	is.rendered, is.source = rendered, source
+	return rendered
+}
+
+// chunk chunks the tokens into reply lines within the budget, caching them. The caller
+// must hold the write lock.
+func (is *ISupport) chunk(budget int) [][]string {
+	lines := [][]string{}
+	var line []string
+	length := 0
+	for _, token := range is.formatted() {
+		if len(line) == maxISupportTokens || (len(line) > 0 && length+1+len(token) > budget) {
+			lines = append(lines, line)
+			line, length = nil, 0
+		}
+		if len(line) > 0 {
+			length++
+		}
+		line = append(line, token)
+		length += len(token)
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+
+	is.lines, is.budget, is.rendered = lines, budget, nil
+	return lines
+}
+
+// validISupportToken checks the name and value of an ISUPPORT token are valid.
+func validISupportToken(name, value string) error {
+	if len(name) == 0 || len(name) > maxISupportNameLength {
+		return fmt.Errorf("ISUPPORT token name [%s] must be 1-%d characters", name, maxISupportNameLength)
+	}
+	for _, r := range name {
+		if !('A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+			return fmt.Errorf("ISUPPORT token name [%s] must only contain letters and digits", name)
+		}
+	}
+	if strings.ContainsAny(value, " \r\n\x00") {
+		return fmt.Errorf("ISUPPORT token [%s] value must not contain spaces or control characters", name)
+	}
+	return nil
+}
+
+// WithISupportToken sets the server to advertise the ISUPPORT token, which may have an
+// empty value, overriding the default value of a token advertised by the server itself.
+func WithISupportToken(name, value string) ServerOption {
+	return option(func(s *Server) error {
+		if err := validISupportToken(name, value); err != nil {
+			return err
+		}
+		s.support.Set(name, value)
+		return nil
+	})
+}
+
+// ISupport returns the ISUPPORT tokens advertised by the server, which may be changed at
+// runtime. Clients receive the changes when they next request them, eg: with VERSION.
+func (srv *Server) ISupport() *ISupport {
+	return srv.support
+}
+
+func (srv *Server) populateISupport() {
+	srv.support.setDefault("chanmodes", "beI,kp,lLMT,ACcEFGHimNnPRrSstV")
+	srv.support.setDefault("prefix", fmt.Sprintf("(%s)%s", statusModes, statusPrefixes))
+	srv.support.setDefault("maxpara", fmt.Sprint(MaxMsgParams))
+	srv.support.setDefault("safelist", "")
+	srv.support.setDefault("elist", elistConditions)
+
+	// The casemapping and limits always reflect how the server behaves.
+	srv.support.Set("casemapping", srv.casemapping.String())
+	srv.advertiseLimits()
+
+	if srv.utf8Only {
+		srv.support.Set("utf8only", "")
+	}
+}
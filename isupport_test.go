@@ -0,0 +1,104 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestISupportReplyLines(t *testing.T) {
+	support := newISupport()
+	for i := 0; i < 20; i++ {
+		support.Set(fmt.Sprintf("TOKEN%02d", i), "value")
+	}
+
+	lines := support.replyLines(512)
+	assert.Len(t, lines, 2)
+	assert.Len(t, lines[0], maxISupportTokens)
+	assert.Equal(t, "TOKEN00=value", lines[0][0])
+
+	lines = support.replyLines(30)
+	assert.Len(t, lines, 10)
+	assert.Equal(t, []string{"TOKEN00=value", "TOKEN01=value"}, lines[0])
+
+	support.Unset("token19")
+	support.Set("flag", "")
+	lines = support.replyLines(30)
+	assert.Len(t, lines, 10)
+	assert.Equal(t, []string{"FLAG", "TOKEN00=value"}, lines[0])
+}
+
+func TestISupportOptions(t *testing.T) {
+	srv, err := NewServer(WithISupportToken("CHANMODES", "b,k,l,imnpst"), WithISupportToken("EXCEPTS", ""))
+	assert.NoError(t, err)
+	srv.populateISupport()
+
+	assert.Contains(t, srv.ISupport().Tokens(), "CHANMODES=b,k,l,imnpst")
+	assert.Contains(t, srv.ISupport().Tokens(), "EXCEPTS")
+	assert.Equal(t, srv.Hostname(), srv.Network())
+
+	srv.ISupport().Network("ExampleNet")
+	assert.Equal(t, "ExampleNet", srv.Network())
+
+	_, err = NewServer(WithISupportToken("BAD TOKEN", ""))
+	assert.Error(t, err)
+	_, err = NewServer(WithNetwork("Example Net"))
+	assert.Error(t, err)
+}
+
+func TestISupportUTF8Only(t *testing.T) {
+	srv, err := NewServer(WithUTF8Only())
+	assert.NoError(t, err)
+	srv.populateISupport()
+	assert.Contains(t, srv.ISupport().Tokens(), "UTF8ONLY")
+
+	assert.True(t, validUTF8(&Message{Params: []string{"#chan"}, Trailing: "héllo"}))
+	assert.False(t, validUTF8(&Message{Params: []string{"#chan"}, Trailing: "h\xe9llo"}))
+}
+
+func TestISupportRenderedLines(t *testing.T) {
+	support := newISupport()
+	support.Set("NETWORK", "ExampleNet")
+	support.Set("EXCEPTS", "")
+
+	rendered := support.renderedLines("irc.example.net", 400)
+	require.Len(t, rendered, 1)
+	msg := &Message{
+		Source:   "irc.example.net",
+		Code:     ReplyISupport,
+		Params:   []string{"bob", "EXCEPTS", "NETWORK=ExampleNet"},
+		Trailing: isupportTrailing,
+	}
+	line := string(rendered[0].prefix) + "bob" + string(rendered[0].suffix)
+	assert.Equal(t, msg.Render(), line)
+	assert.Equal(t, &rendered[0], &support.renderedLines("irc.example.net", 400)[0])
+
+	// Changing a token renders the lines again.
+	support.Set("NETWORK", "OtherNet")
+	rendered = support.renderedLines("irc.example.net", 400)
+	assert.Contains(t, string(rendered[0].suffix), "NETWORK=OtherNet")
+	assert.Len(t, support.replyLines(400), 1)
+	assert.Contains(t, string(support.renderedLines("irc.example.net", 400)[0].suffix), "NETWORK=OtherNet")
+}
+
+func TestWelcomeBurst(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithWelcome("Welcome to dircd"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	srv.populateISupport()
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(":irc.example.net 001 bob :Welcome to dircd")
+	expect(":irc.example.net 005 bob ")
+}
@@ -0,0 +1,331 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// klinesBucket is the storage bucket K-lines are persisted in.
+const klinesBucket = "klines"
+
+// KLine is a server ban on user@host masks, preventing matching users from connecting.
+type KLine struct {
+	Mask    string    `json:"mask"`
+	Reason  string    `json:"reason"`
+	Setter  string    `json:"setter"`
+	Origin  string    `json:"origin,omitempty"` // The name of the server the K-line was set on.
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // Zero for a permanent K-line.
+
+	configured bool // Set with WithKLine, so kept to this server rather than propagated.
+}
+
+// Expired reports whether the K-line has expired.
+func (kl *KLine) Expired() bool {
+	return !kl.Expires.IsZero() && time.Now().After(kl.Expires)
+}
+
+// Matches reports whether the K-line applies to the given user@host.
+func (kl *KLine) Matches(userhost string) bool {
+	return !kl.Expired() && stringutils.MatchMask(kl.Mask, userhost)
+}
+
+// klineStore holds the active K-lines, or lines of the same form such as shuns, persisted
+// in a bucket of the server storage.
+type klineStore struct {
+	mu      sync.RWMutex
+	storage Storage
+	bucket  string
+	lines   map[string]*KLine
+}
+
+// newKLineStore returns a K-line store loaded with the K-lines persisted in the bucket.
+func newKLineStore(storage Storage, bucket string) (*klineStore, error) {
+	ks := &klineStore{
+		storage: storage,
+		bucket:  bucket,
+		lines:   make(map[string]*KLine),
+	}
+
+	stored, err := storage.List(bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %w", bucket, err)
+	}
+
+	for key, data := range stored {
+		kline := &KLine{}
+		if err = json.Unmarshal(data, kline); err != nil {
+			return nil, fmt.Errorf("error decoding K-line [%s]: %w", key, err)
+		}
+		ks.lines[key] = kline
+	}
+
+	return ks, nil
+}
+
+// add sets the K-line, replacing any existing K-line with the same mask.
+func (ks *klineStore) add(kline *KLine) error {
+	key := strings.ToLower(kline.Mask)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := storeJSON(ks.storage, ks.bucket, key, kline); err != nil {
+		return err
+	}
+	ks.lines[key] = kline
+	return nil
+}
+
+// merge sets the K-line received from another server, unless the K-line on the same
+// mask takes precedence over it, reporting whether it was set.
+func (ks *klineStore) merge(kline *KLine) (bool, error) {
+	key := strings.ToLower(kline.Mask)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if existing, exists := ks.lines[key]; exists && (existing.configured || !existing.Expired() &&
+		!supersedes(kline.Created, kline.Origin, existing.Created, existing.Origin)) {
+		return false, nil
+	}
+	if err := storeJSON(ks.storage, ks.bucket, key, kline); err != nil {
+		return false, err
+	}
+	ks.lines[key] = kline
+	return true, nil
+}
+
+// get returns the K-line with the given mask, if any.
+func (ks *klineStore) get(mask string) *KLine {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.lines[strings.ToLower(mask)]
+}
+
+// removeBefore deletes the K-line with the given mask if it was set no later than the
+// removal, rather than set again since on another server, reporting whether it was.
+func (ks *klineStore) removeBefore(mask string, removed time.Time) (bool, error) {
+	key := strings.ToLower(mask)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	existing, exists := ks.lines[key]
+	if !exists || existing.configured || existing.Created.After(removed) {
+		return false, nil
+	}
+	if err := ks.storage.Delete(ks.bucket, key); err != nil {
+		return false, err
+	}
+	delete(ks.lines, key)
+	return true, nil
+}
+
+// remove deletes the K-line with the given mask, returning ErrNotFound if there is none.
+func (ks *klineStore) remove(mask string) error {
+	key := strings.ToLower(mask)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, exists := ks.lines[key]; !exists {
+		return ErrNotFound
+	}
+	if err := ks.storage.Delete(ks.bucket, key); err != nil {
+		return err
+	}
+	delete(ks.lines, key)
+	return nil
+}
+
+// match returns the first active K-line matching the given user@host, if any.
+func (ks *klineStore) match(userhost string) *KLine {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, kline := range ks.lines {
+		if kline.Matches(userhost) {
+			return kline
+		}
+	}
+	return nil
+}
+
+// list returns the active K-lines sorted by mask, pruning any which have expired.
+func (ks *klineStore) list() []*KLine {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	active := make([]*KLine, 0, len(ks.lines))
+	for key, kline := range ks.lines {
+		if kline.Expired() {
+			_ = ks.storage.Delete(ks.bucket, key)
+			delete(ks.lines, key)
+			continue
+		}
+		active = append(active, kline)
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Mask < active[j].Mask
+	})
+	return active
+}
+
+// WithKLine adds a permanent K-line banning users matching the user@host mask from the server.
+func WithKLine(mask, reason string) ServerOption {
+	return option(func(s *Server) error {
+		if !strings.Contains(mask, AT) {
+			return fmt.Errorf("invalid K-line mask, expected user@host: %s", mask)
+		}
+		s.configKLines = append(s.configKLines, &KLine{
+			Mask:       mask,
+			Reason:     reason,
+			Setter:     "config",
+			Created:    time.Now().UTC(),
+			configured: true,
+		})
+		return nil
+	})
+}
+
+// userhost returns the user@host of the connection used for matching K-lines and oper blocks.
+func (conn *Conn) userhost() string {
+	return conn.user.Name() + AT + conn.user.Hostname()
+}
+
+// checkKLined disconnects the user if they match an active K-line, reporting whether they did.
+func (conn *Conn) checkKLined() bool {
+	kline := conn.server.klines.match(conn.userhost())
+	if kline == nil {
+		return false
+	}
+
+	conn.logger.WithField("operation", "kline").
+		Infof("disconnecting [%s] matching K-line [%s]", conn.userhost(), kline.Mask)
+	conn.ReplyYoureBanned(kline.Reason)
+	conn.doKill("K-lined: "+kline.Reason, "")
+	return true
+}
+
+// AddKLine sets a K-line on the user@host mask for the given duration (permanent if zero),
+// replacing any existing K-line on the same mask, and disconnects any connected users it
+// matches. The K-line is propagated to the linked servers.
+func (srv *Server) AddKLine(mask, reason, setter string, duration time.Duration) (*KLine, error) {
+	if !strings.Contains(mask, AT) {
+		mask = "*@" + mask
+	}
+	if len(reason) == 0 {
+		reason = "No reason given"
+	}
+
+	// Linked servers are sent the times in seconds, so they are kept in seconds to
+	// resolve conflicting K-lines the same way on every server.
+	kline := &KLine{
+		Mask:    mask,
+		Reason:  reason,
+		Setter:  setter,
+		Origin:  srv.Hostname(),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if duration > 0 {
+		kline.Expires = kline.Created.Add(duration)
+	}
+
+	if err := srv.klines.add(kline); err != nil {
+		return nil, fmt.Errorf("error adding K-line [%s]: %w", mask, err)
+	}
+	srv.propagate(nil, srv.klineLine(kline))
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  setter,
+		Action: CmdKLine,
+		Target: mask,
+		Reason: reason,
+	})
+
+	srv.enforceKLine(kline)
+	return kline, nil
+}
+
+// enforceKLine disconnects the connected users matching the K-line.
+func (srv *Server) enforceKLine(kline *KLine) {
+	srv.Users.ForEach(func(_ string, user *User) error {
+		if user.conn != nil && kline.Matches(user.conn.userhost()) {
+			user.conn.checkKLined()
+		}
+		return nil
+	})
+}
+
+// RemoveKLine removes the K-line on the user@host mask, returning ErrNotFound if there is none.
+// The remover is reported to event subscribers as the actor, and the removal propagated
+// to the linked servers.
+func (srv *Server) RemoveKLine(mask, remover string) error {
+	if !strings.Contains(mask, AT) {
+		mask = "*@" + mask
+	}
+	if err := srv.klines.remove(mask); err != nil {
+		return err
+	}
+	srv.propagate(nil, srv.unbanLine(banTypeKLine, mask, remover))
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  remover,
+		Action: CmdUnKLine,
+		Target: mask,
+	})
+	return nil
+}
+
+// KLines returns the active K-lines sorted by mask.
+func (srv *Server) KLines() []*KLine {
+	return srv.klines.list()
+}
+
+// doKLine sets a K-line on the mask, for the given duration (permanent if zero),
+// and disconnects any connected users it matches.
+func (conn *Conn) doKLine(mask string, duration time.Duration, reason string) {
+	kline, err := conn.server.AddKLine(mask, reason, conn.user.Hostmask(), duration)
+	if err != nil {
+		conn.logger.WithField("operation", "kline").Error(err)
+		conn.ReplyServerNotice("Unable to add K-line for " + mask)
+		return
+	}
+
+	if duration > 0 {
+		conn.ReplyServerNotice(fmt.Sprintf("Added K-line for [%s] expiring in %v: %s", kline.Mask, duration, kline.Reason))
+	} else {
+		conn.ReplyServerNotice(fmt.Sprintf("Added permanent K-line for [%s]: %s", kline.Mask, kline.Reason))
+	}
+}
+
+// doUnKLine removes the K-line on the mask.
+func (conn *Conn) doUnKLine(mask string) {
+	switch err := conn.server.RemoveKLine(mask, conn.user.Hostmask()); err {
+	case nil:
+		conn.ReplyServerNotice(fmt.Sprintf("Removed K-line for [%s]", mask))
+	case ErrNotFound:
+		conn.ReplyServerNotice(fmt.Sprintf("No K-line for [%s]", mask))
+	default:
+		conn.logger.WithField("operation", "kline").Error(fmt.Errorf("error removing K-line [%s]: %w", mask, err))
+		conn.ReplyServerNotice("Unable to remove K-line for " + mask)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits are the protocol limits of channels and users, enforced by the server and
+// advertised to clients in ISUPPORT.
+type Limits struct {
+	// Channels
+	ChanLength  int // Maximum length of a channel name.
+	KickLength  int // Maximum length of a kick reason.
+	TopicLength int // Maximum length of a channel topic.
+	ListItems   int // Maximum number of entries in each channel list mode, eg: bans.
+	ModeChange  int // Maximum number of modes with a parameter in a single MODE command.
+
+	// Users
+	NickLength  int // Maximum length of a nick.
+	UserLength  int // Maximum length of a username.
+	VHostLength int // Maximum length of a vanity host.
+	JoinedChans int // Maximum number of channels a user may join.
+	AwayLength  int // Maximum length of an away message.
+}
+
+// DefaultLimits returns the limits used unless configured with WithLimits.
+func DefaultLimits() Limits {
+	return Limits{
+		ChanLength:  16,
+		KickLength:  400,
+		TopicLength: 400,
+		ListItems:   256,
+		ModeChange:  6,
+
+		NickLength:  16,
+		UserLength:  16,
+		VHostLength: 64,
+		JoinedChans: 32,
+		AwayLength:  100,
+	}
+}
+
+// validate checks every limit is positive, and those of names fit in a message.
+func (l Limits) validate() error {
+	var errs []error
+	for name, limit := range map[string]int{
+		"channel length": l.ChanLength, "kick length": l.KickLength, "topic length": l.TopicLength,
+		"list items": l.ListItems, "mode changes": l.ModeChange, "nick length": l.NickLength,
+		"user length": l.UserLength, "vhost length": l.VHostLength, "joined channels": l.JoinedChans,
+		"away length": l.AwayLength,
+	} {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("%s limit must be positive, got %d", name, limit))
+		}
+	}
+	if l.NickLength > MaxMsgLength/8 || l.ChanLength > MaxMsgLength/8 {
+		errs = append(errs, fmt.Errorf("nick and channel length limits must not exceed %d", MaxMsgLength/8))
+	}
+	return errors.Join(errs...)
+}
+
+// WithLimits sets the protocol limits of the server.
+func WithLimits(limits Limits) ServerOption {
+	return option(func(s *Server) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		s.limits.Store(&limits)
+		return nil
+	})
+}
+
+// Limits returns the protocol limits of the server.
+func (srv *Server) Limits() Limits {
+	if limits := srv.limits.Load(); limits != nil {
+		return *limits
+	}
+	return DefaultLimits()
+}
+
+// SetLimits changes the protocol limits of the server, eg: from a rehash hook, and
+// advertises them in ISUPPORT. Users and channels already exceeding the new limits are
+// left as they are.
+func (srv *Server) SetLimits(limits Limits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	srv.limits.Store(&limits)
+	srv.advertiseLimits()
+	srv.logger.WithField("operation", "limits").Infof("protocol limits changed: %+v", limits)
+	return nil
+}
+
+// advertiseLimits sets the ISUPPORT tokens of the protocol limits.
+func (srv *Server) advertiseLimits() {
+	limits := srv.Limits()
+	srv.support.Set("modes", fmt.Sprint(limits.ModeChange))
+	srv.support.Set("chanlimit", fmt.Sprintf("#!:%v", limits.JoinedChans))
+	srv.support.Set("nicklen", fmt.Sprint(limits.NickLength))
+	srv.support.Set("maxlist", fmt.Sprintf("beI:%v", limits.ListItems))
+	srv.support.Set("topiclen", fmt.Sprint(limits.TopicLength))
+	srv.support.Set("kicklen", fmt.Sprint(limits.KickLength))
+	srv.support.Set("chanlen", fmt.Sprint(limits.ChanLength))
+	srv.support.Set("awaylen", fmt.Sprint(limits.AwayLength))
+}
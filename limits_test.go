@@ -0,0 +1,43 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+	limits := DefaultLimits()
+	limits.NickLength = 30
+
+	srv, err := NewServer(WithLimits(limits), WithISupportToken("NICKLEN", "9"))
+	assert.NoError(t, err)
+	srv.populateISupport()
+
+	assert.Equal(t, 30, srv.Limits().NickLength)
+	assert.Contains(t, srv.ISupport().Tokens(), "NICKLEN=30")
+	err, _ = srv.ValidateName("abcdefghijklmnopqrstuvwxyz")
+	assert.NoError(t, err)
+
+	limits.NickLength = 9
+	limits.TopicLength = 300
+	assert.NoError(t, srv.SetLimits(limits))
+	assert.Contains(t, srv.ISupport().Tokens(), "NICKLEN=9")
+	assert.Contains(t, srv.ISupport().Tokens(), "TOPICLEN=300")
+	err, _ = srv.ValidateName("abcdefghij")
+	assert.Error(t, err)
+
+	limits.JoinedChans = 0
+	assert.Error(t, srv.SetLimits(limits))
+	assert.Equal(t, 9, srv.Limits().NickLength)
+
+	_, err = NewServer(WithLimits(Limits{}))
+	assert.Error(t, err)
+}
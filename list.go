@@ -0,0 +1,246 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+const (
+	// listBacklog is the most bytes queued for writing to a user before sending them the
+	// next LIST reply waits for the backlog to be written, or half their SendQ if less.
+	listBacklog = 16 * 1024
+
+	// listPollInterval is how often a LIST waiting for the backlog of a user checks it.
+	listPollInterval = 25 * time.Millisecond
+
+	// elistConditions are the ELIST conditions LIST supports, advertised in ISUPPORT:
+	// channel creation time, masks, negated masks, topic time, and user count.
+	elistConditions = "CMNTU"
+)
+
+// listedChannel is a channel as shown by LIST, taken when the list was requested.
+type listedChannel struct {
+	name    string
+	users   int
+	topic   string
+	created time.Time
+	topicAt time.Time
+}
+
+// listFilter is the masks and ELIST conditions a channel must match to be listed, eg:
+//
+//	LIST #dircd*,!*-dev,>10,C<60,T>1440
+//
+// Lists the channels beginning with #dircd, other than those ending in -dev, with more
+// than 10 users, created less than an hour ago, whose topic was set more than a day ago.
+type listFilter struct {
+	masks    []string
+	excluded []string
+	minUsers int // The user count must be above, if not negative.
+	maxUsers int // The user count must be below, if above zero.
+
+	createdAfter, createdBefore time.Time
+	topicAfter, topicBefore     time.Time
+}
+
+// parseListFilter returns the filter of the comma separated masks and conditions of a
+// LIST command, relative to now. Conditions with an invalid number are ignored.
+func parseListFilter(param string, now time.Time) listFilter {
+	filter := listFilter{minUsers: -1}
+
+	minutesAgo := func(value string) (time.Time, bool) {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(-time.Duration(minutes) * time.Minute), true
+	}
+
+	for _, term := range strings.Split(param, ",") {
+		switch {
+		case len(term) == 0:
+		case term[0] == '>':
+			if users, err := strconv.Atoi(term[1:]); err == nil {
+				filter.minUsers = users
+			}
+		case term[0] == '<':
+			if users, err := strconv.Atoi(term[1:]); err == nil {
+				filter.maxUsers = users
+			}
+		case term[0] == '!':
+			filter.excluded = append(filter.excluded, term[1:])
+		case len(term) > 1 && (term[0] == 'C' || term[0] == 'T') && (term[1] == '<' || term[1] == '>'):
+			at, valid := minutesAgo(term[2:])
+			if !valid {
+				continue
+			}
+			// Less than n minutes ago is after the time n minutes ago, and more is before it.
+			switch term[:2] {
+			case "C<":
+				filter.createdAfter = at
+			case "C>":
+				filter.createdBefore = at
+			case "T<":
+				filter.topicAfter = at
+			case "T>":
+				filter.topicBefore = at
+			}
+		default:
+			filter.masks = append(filter.masks, term)
+		}
+	}
+	return filter
+}
+
+// matches reports whether the channel is to be listed.
+func (filter listFilter) matches(entry listedChannel) bool {
+	if filter.minUsers >= 0 && entry.users <= filter.minUsers {
+		return false
+	}
+	if filter.maxUsers > 0 && entry.users >= filter.maxUsers {
+		return false
+	}
+	if !filter.createdAfter.IsZero() && !entry.created.After(filter.createdAfter) {
+		return false
+	}
+	if !filter.createdBefore.IsZero() && !entry.created.Before(filter.createdBefore) {
+		return false
+	}
+	if !filter.topicAfter.IsZero() && !entry.topicAt.After(filter.topicAfter) {
+		return false
+	}
+	// Channels without a topic have never had it set, which is before any time.
+	if !filter.topicBefore.IsZero() && !entry.topicAt.IsZero() && !entry.topicAt.Before(filter.topicBefore) {
+		return false
+	}
+
+	for _, mask := range filter.excluded {
+		if stringutils.MatchMask(mask, entry.name) {
+			return false
+		}
+	}
+	if len(filter.masks) == 0 {
+		return true
+	}
+	for _, mask := range filter.masks {
+		if stringutils.MatchMask(mask, entry.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listSnapshot returns the channels of the server matching the filter, sorted by name.
+// Each channel is only locked while it is copied, so that a LIST of a large network does
+// not hold up the channels while the replies are sent.
+func (srv *Server) listSnapshot(filter listFilter) []listedChannel {
+	var entries []listedChannel
+	srv.Channels.ForEach(func(_ string, channel *Channel) error {
+		_, topicAt := channel.TopicSetBy()
+		entry := listedChannel{
+			name:    channel.Name(),
+			users:   channel.Nicks.Length(),
+			topic:   channel.Topic(),
+			created: channel.CreatedAt(),
+			topicAt: topicAt,
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	slices.SortFunc(entries, func(a, b listedChannel) int {
+		return cmp.Compare(a.name, b.name)
+	})
+	return entries
+}
+
+// listBudget returns the most bytes queued for writing to the user before LIST waits
+// for them to be written.
+func (conn *Conn) listBudget() int64 {
+	budget := int64(listBacklog)
+	if class := conn.class.Load(); class != nil && class.SendQ > 0 {
+		budget = min(budget, int64(class.SendQ/2))
+	}
+	return budget
+}
+
+// awaitBacklog waits until the bytes queued for writing to the user are within the
+// budget, reporting false if the list was cancelled or the connection closed first.
+func (conn *Conn) awaitBacklog(ctx context.Context, budget int64) bool {
+	if conn.sendQueue.Load() <= budget {
+		return true
+	}
+
+	ticker := time.NewTicker(listPollInterval)
+	defer ticker.Stop()
+
+	for conn.sendQueue.Load() > budget {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-conn.ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// doList sends the channels matching the masks and ELIST conditions to the user.
+//
+// The channels are copied when the list is requested, and the replies are sent from
+// another goroutine as the user reads them, waiting whenever their backlog exceeds the
+// listBudget, so that a LIST of tens of thousands of channels neither holds up the read
+// loop of the user nor exceeds their SendQ. A LIST cancels any the user sent before it.
+func (conn *Conn) doList(param string) {
+	if conn.listCancel != nil {
+		conn.listCancel()
+	}
+	ctx, cancel := context.WithCancel(conn.ctx)
+	conn.listCancel = cancel
+
+	entries := conn.server.listSnapshot(parseListFilter(param, time.Now()))
+	budget := conn.listBudget()
+
+	go func() {
+		defer cancel()
+
+		conn.replyList(ReplyListStart)
+		for _, entry := range entries {
+			if !conn.awaitBacklog(ctx, budget) {
+				return
+			}
+			conn.replyList(ReplyList, entry.name, strconv.Itoa(entry.users), entry.topic)
+		}
+
+		if conn.awaitBacklog(ctx, budget) {
+			conn.replyList(ReplyEndOfList)
+		}
+	}()
+}
+
+// replyList sends the numeric reply to the user in the bulk lane, so that a long LIST
+// yields to the other messages sent to the user.
+func (conn *Conn) replyList(code uint16, params ...string) {
+	msg := conn.newReply("")
+	defer msgPool.Recycle(msg, msg.Generation())
+
+	msg.Code = code
+	setReplyParams(msg, append([]string{conn.replyNick()}, formatNumeric(code, params)...))
+	conn.queue(msg.RenderBuffer(), laneBulk)
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListFilter(t *testing.T) {
+	now := time.Now()
+	channel := listedChannel{name: "#dircd", users: 5, created: now.Add(-time.Hour), topicAt: now.Add(-10 * time.Minute)}
+
+	assert.True(t, parseListFilter("", now).matches(channel))
+	assert.True(t, parseListFilter("#DIRCD", now).matches(channel), "masks are case insensitive")
+	assert.True(t, parseListFilter("#other,#dir*", now).matches(channel))
+	assert.False(t, parseListFilter("#other", now).matches(channel))
+	assert.False(t, parseListFilter("!#dir*", now).matches(channel))
+
+	assert.True(t, parseListFilter(">4,<6", now).matches(channel))
+	assert.False(t, parseListFilter(">5", now).matches(channel))
+	assert.False(t, parseListFilter("<5", now).matches(channel))
+
+	assert.True(t, parseListFilter("C>30,C<90", now).matches(channel))
+	assert.False(t, parseListFilter("C<30", now).matches(channel))
+	assert.True(t, parseListFilter("T<15", now).matches(channel))
+	assert.False(t, parseListFilter("T>15", now).matches(channel))
+	assert.True(t, parseListFilter("T>15", now).matches(listedChannel{name: "#empty"}), "channels without a topic never had it set")
+	assert.True(t, parseListFilter("C<x,>y", now).matches(channel), "invalid conditions are ignored")
+}
+
+func TestList(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	srv.populateISupport()
+
+	_, routeAlice, _ := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	routeAlice("JOIN #go")
+	routeAlice("JOIN #random")
+	channel, exists := srv.Channels.Get("#dircd")
+	require.True(t, exists)
+	channel.SetTopicBy("IRC daemon", "alice")
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" SAFELIST ")
+	route("JOIN #go")
+
+	route("LIST")
+	expect(" 321 bob Channel :Users  Name")
+	expect(" 322 bob #dircd 1 :IRC daemon")
+	expect(" 322 bob #go 2 :")
+	expect(" 322 bob #random 1 :")
+	expect(" 323 bob :End of /LIST")
+
+	route("LIST >1")
+	expect(" 322 bob #go 2 :")
+	expect(" 323 bob ")
+	route("LIST #*,!#go,!#random")
+	expect(" 322 bob #dircd 1 ")
+	expect(" 323 bob ")
+}
+
+func TestListBacklog(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	// While the backlog of the user exceeds the budget, the list waits for it to be written.
+	conn.sendQueue.Add(listBacklog + 1)
+	route("LIST")
+	expect(" 321 bob ")
+
+	done := make(chan struct{})
+	go func() {
+		expect(" 323 bob ")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the list was sent beyond the backlog")
+	case <-time.After(5 * listPollInterval):
+	}
+
+	conn.sendQueue.Add(-listBacklog - 1)
+	<-done
+}
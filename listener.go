@@ -0,0 +1,232 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sourcegraph/conc"
+)
+
+// listenerConfig holds the settings of a single address the server accepts connections on.
+type listenerConfig struct {
+	address       *net.TCPAddr
+	tls           bool
+	webSocket     bool
+	proxyProtocol bool
+	class         string
+}
+
+// ListenerOption configures an individual listener registered with WithListener.
+type ListenerOption func(*listenerConfig)
+
+// ListenerTLS sets the listener to serve connections over TLS using the server's TLS config.
+func ListenerTLS() ListenerOption {
+	return func(cfg *listenerConfig) {
+		cfg.tls = true
+	}
+}
+
+// ListenerWebSocket sets the listener to serve IRC over WebSocket per the IRCv3 WebSocket spec.
+func ListenerWebSocket() ListenerOption {
+	return func(cfg *listenerConfig) {
+		cfg.webSocket = true
+	}
+}
+
+// ListenerProxyProtocol sets the listener to expect a HAProxy PROXY protocol (v1 or v2)
+// header at the start of every accepted connection, and to use the address it carries
+// as the remote address of the client.
+func ListenerProxyProtocol() ListenerOption {
+	return func(cfg *listenerConfig) {
+		cfg.proxyProtocol = true
+	}
+}
+
+// ListenerClass sets the name of the connection class assigned to clients accepted by the listener.
+func ListenerClass(name string) ListenerOption {
+	return func(cfg *listenerConfig) {
+		cfg.class = name
+	}
+}
+
+// WithListener adds an address for the server to accept connections on. It may be
+// specified multiple times, and all configured listeners are served concurrently.
+func WithListener(address string, options ...ListenerOption) ServerOption {
+	return option(func(s *Server) error {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return fmt.Errorf("error resolving listener address [%s]: %w", address, err)
+		}
+
+		cfg := &listenerConfig{address: addr}
+		for i := range options {
+			options[i](cfg)
+		}
+
+		s.listenConfigs = append(s.listenConfigs, cfg)
+		return nil
+	})
+}
+
+// String returns a short description of the listener for logging purposes.
+func (cfg *listenerConfig) String() string {
+	scheme := "irc"
+	if cfg.tls {
+		scheme = "ircs"
+	}
+	if cfg.webSocket {
+		scheme = "ws"
+		if cfg.tls {
+			scheme = "wss"
+		}
+	}
+	if cfg.proxyProtocol {
+		scheme += "+proxy"
+	}
+	return fmt.Sprintf("%s://%s", scheme, cfg.address)
+}
+
+// bindListener creates the TCP listener for the given configuration, or adopts the one
+// inherited from a parent process, and wraps it with the PROXY protocol, TLS, and
+// WebSocket layers as configured, in that order.
+func (srv *Server) bindListener(cfg *listenerConfig) (net.Listener, error) {
+	tcpListener := srv.takeInheritedListener(cfg.address)
+	if tcpListener == nil {
+		var err error
+		tcpListener, err = net.ListenTCP("tcp", cfg.address)
+		if err != nil {
+			return nil, fmt.Errorf("error attempting to create TCP listener at [%s]: %w", cfg.address, err)
+		}
+	}
+
+	srv.mu.Lock()
+	srv.bound = append(srv.bound, tcpListener)
+	srv.mu.Unlock()
+
+	var listener net.Listener = &tcpKeepAliveListener{*tcpListener, srv.Timeouts().KeepAlive}
+
+	if cfg.proxyProtocol {
+		listener = &proxyListener{Listener: listener}
+	}
+
+	if cfg.tls {
+		if !srv.hasTLSCertificates() {
+			_ = listener.Close()
+			return nil, fmt.Errorf("listener [%s] requires TLS but no certificates are configured", cfg.address)
+		}
+		listener = tls.NewListener(listener, srv.cloneTLSConfig())
+	}
+
+	if cfg.webSocket {
+		listener = &webSocketListener{Listener: listener}
+	}
+
+	return listener, nil
+}
+
+// listenAndServe binds every given listener configuration before serving any of them, so
+// that a bad address fails fast, then serves them concurrently until all have returned.
+func (srv *Server) listenAndServe(configs []*listenerConfig) error {
+	logger := srv.logger.WithField("sub-component", "listener")
+
+	listeners := make([]net.Listener, 0, len(configs))
+	for i := range configs {
+		listener, err := srv.bindListener(configs[i])
+		if err != nil {
+			for j := range listeners {
+				_ = listeners[j].Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	srv.closeInheritedListeners()
+	srv.notifyReady()
+
+	serveErrs := make([]error, len(listeners))
+	var group conc.WaitGroup
+	for i := range listeners {
+		i := i
+		group.Go(func() {
+			serveErrs[i] = srv.serve(listeners[i], configs[i])
+			if serveErrs[i] != nil && !errors.Is(serveErrs[i], ErrServerClosed) {
+				logger.Error(fmt.Errorf("listener [%s] terminated: %w", configs[i], serveErrs[i]))
+			}
+		})
+	}
+	group.Wait()
+
+	logger.Debug("waiting for connections to terminate")
+	srv.connectionGroup.Wait()
+
+	var errs error
+	for i := range serveErrs {
+		if serveErrs[i] != nil && !errors.Is(serveErrs[i], ErrServerClosed) {
+			errs = errors.Join(errs, serveErrs[i])
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return ErrServerClosed
+}
+
+// listenerConfigs returns the configured listeners, or the given fallback if none were configured.
+func (srv *Server) listenerConfigs(fallback string, options ...ListenerOption) ([]*listenerConfig, error) {
+	srv.rwm.RLock()
+	configs := make([]*listenerConfig, len(srv.listenConfigs))
+	copy(configs, srv.listenConfigs)
+	srv.rwm.RUnlock()
+
+	if len(configs) > 0 {
+		return configs, nil
+	}
+
+	// Serve sockets passed in by socket activation when no listeners are configured.
+	srv.mu.Lock()
+	for _, listener := range srv.inherited {
+		configs = append(configs, &listenerConfig{address: listener.Addr().(*net.TCPAddr)})
+	}
+	srv.mu.Unlock()
+
+	if len(configs) > 0 {
+		return configs, nil
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", fallback)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("error attempting to use fallback default address"))
+	}
+
+	cfg := &listenerConfig{address: addr}
+	for i := range options {
+		options[i](cfg)
+	}
+
+	srv.logger.WithField("sub-component", "listener").
+		Infof("no listeners specified, defaulting to [%v]", cfg)
+
+	return []*listenerConfig{cfg}, nil
+}
+
+// sameAddress reports whether two TCP addresses refer to the same listening address,
+// treating an empty IP as equivalent to the unspecified address.
+func sameAddress(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	if a.IP.Equal(b.IP) {
+		return true
+	}
+	return (len(a.IP) == 0 || a.IP.IsUnspecified()) && (len(b.IP) == 0 || b.IP.IsUnspecified())
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockdownLevel progressively restricts the server during spam or flood attacks. Each
+// level includes the restrictions of the levels below it.
+type LockdownLevel uint8
+
+// Lockdown levels
+const (
+	LockdownOff          LockdownLevel = iota
+	LockdownRegistration               // New account registrations are disabled.
+	LockdownSASL                       // New connections must log in with SASL before registering.
+	LockdownChannels                   // Only operators may create channels.
+	LockdownFlood                      // Messages are strictly rate limited, except for operators and flood immune users.
+	LockdownConnections                // New connections are refused.
+)
+
+// Strict rate limit of messages from a connection during a flood lockdown
+const (
+	lockdownFloodInterval = 2 * time.Second
+	lockdownFloodBurst    = 5
+)
+
+// lockdownDescriptions describes the restriction added by each level.
+var lockdownDescriptions = map[LockdownLevel]string{
+	LockdownOff:          "no restrictions",
+	LockdownRegistration: "account registration disabled",
+	LockdownSASL:         "SASL required for new connections",
+	LockdownChannels:     "channel creation restricted to operators",
+	LockdownFlood:        "strict flood limits",
+	LockdownConnections:  "new connections refused",
+}
+
+// lockdownState is the current lockdown level, and why and by whom it was set.
+type lockdownState struct {
+	level  LockdownLevel
+	reason string
+	setter string
+	since  time.Time
+}
+
+// floodBucket limits the rate of messages from a connection, allowing a burst of messages
+// and then one per interval. It is only accessed from the read loop goroutine.
+type floodBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a message may be sent now within the strict flood limits of a
+// lockdown, consuming a token if so.
+func (fb *floodBucket) allow(now time.Time) bool {
+	return fb.allowRate(now, lockdownFloodInterval, lockdownFloodBurst)
+}
+
+// allowRate reports whether a message may be sent now within a burst of messages and
+// then one per interval, consuming a token if so.
+func (fb *floodBucket) allowRate(now time.Time, interval time.Duration, burst int) bool {
+	if fb.last.IsZero() {
+		fb.tokens = float64(burst)
+	} else {
+		fb.tokens += float64(now.Sub(fb.last)) / float64(interval)
+		if fb.tokens > float64(burst) {
+			fb.tokens = float64(burst)
+		}
+	}
+	fb.last = now
+
+	if fb.tokens < 1 {
+		return false
+	}
+	fb.tokens--
+	return true
+}
+
+// delay returns how long until the next token is available at one per interval.
+func (fb *floodBucket) delay(interval time.Duration) time.Duration {
+	if fb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - fb.tokens) * float64(interval))
+}
+
+// String describes the restrictions of the level.
+func (level LockdownLevel) String() string {
+	descriptions := make([]string, 0, level)
+	for l := LockdownRegistration; l <= level && l <= LockdownConnections; l++ {
+		descriptions = append(descriptions, lockdownDescriptions[l])
+	}
+	if len(descriptions) == 0 {
+		return lockdownDescriptions[LockdownOff]
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// SetLockdown sets the lockdown level of the server, with the reason given to users it
+// turns away. The setter is reported to event subscribers as the actor.
+func (srv *Server) SetLockdown(level LockdownLevel, reason, setter string) error {
+	if level > LockdownConnections {
+		return fmt.Errorf("invalid lockdown level %d", level)
+	}
+	if len(reason) == 0 {
+		reason = "The server is under attack, please try again later"
+	}
+
+	srv.lockdown.Store(&lockdownState{level: level, reason: reason, setter: setter, since: time.Now().UTC()})
+	srv.logger.WithField("operation", "lockdown").Warnf("lockdown level set to %d (%s) by [%s]: %s", level, level, setter, reason)
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  setter,
+		Action: CmdLockdown,
+		Target: strconv.Itoa(int(level)),
+		Reason: reason,
+	})
+	return nil
+}
+
+// Lockdown returns the lockdown level of the server, and the reason it was set.
+func (srv *Server) Lockdown() (LockdownLevel, string) {
+	state := srv.lockdown.Load()
+	if state == nil {
+		return LockdownOff, ""
+	}
+	return state.level, state.reason
+}
+
+// lockedDown reports whether the server is at or above the lockdown level.
+func (srv *Server) lockedDown(level LockdownLevel) bool {
+	current, _ := srv.Lockdown()
+	return current >= level
+}
+
+// checkLockdownConnect refuses the new connection if the server is refusing new
+// connections, reporting whether it did.
+func (conn *Conn) checkLockdownConnect() bool {
+	if !conn.server.lockedDown(LockdownConnections) {
+		return false
+	}
+
+	_, reason := conn.server.Lockdown()
+	msg := conn.newMessage()
+	generation := msg.Generation()
+	msg.Command = CmdError
+	msg.Trailing = fmt.Sprintf("Closing link: %s [%s]", conn.server.Hostname(), reason)
+	conn.write(msg.RenderBuffer())
+	msgPool.Recycle(msg, generation)
+
+	conn.logger.WithField("operation", "lockdown").Info("refused connection during lockdown")
+	return true
+}
+
+// checkLockdownRegister disconnects the user completing registration if the server
+// requires SASL and they have not logged in, reporting whether they were.
+func (conn *Conn) checkLockdownRegister() bool {
+	if !conn.server.lockedDown(LockdownSASL) || len(conn.user.Account()) > 0 {
+		return false
+	}
+
+	_, reason := conn.server.Lockdown()
+	conn.logger.WithField("operation", "lockdown").Info("disconnecting user without SASL during lockdown")
+	conn.ReplyYoureBanned("You must log in with SASL to connect at this time: " + reason)
+	conn.doKill("SASL required: "+reason, "")
+	return true
+}
+
+// checkLockdownFlood reports whether a message from the user must be dropped by the strict
+// flood limits, notifying them and event subscribers if so.
+func (conn *Conn) checkLockdownFlood(msg *Message) bool {
+	if !conn.server.lockedDown(LockdownFlood) || conn.user.IsOper() || conn.user.ModeIsSet(UModeFloodImmune) {
+		return false
+	}
+	if conn.flood.allow(time.Now()) {
+		return false
+	}
+
+	if msg.Command != CmdNotice {
+		conn.ReplyCannotSendToChan(msg.Params[0], "Message rate limited during lockdown")
+	}
+
+	event := userEvent(EventFloodTriggered, conn.user)
+	event.Action = msg.Command
+	event.Target = msg.Params[0]
+	conn.server.publish(event)
+	return true
+}
+
+// doLockdown reports or sets the lockdown level of the server.
+func (conn *Conn) doLockdown(params []string, reason string) {
+	if len(params) == 0 {
+		state := conn.server.lockdown.Load()
+		if state == nil || state.level == LockdownOff {
+			conn.ReplyServerNotice("Lockdown is off")
+			return
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("Lockdown level %d (%s) set by [%s] at %s: %s",
+			state.level, state.level, state.setter, state.since.Format(time.RFC3339), state.reason))
+		return
+	}
+
+	level, err := strconv.Atoi(params[0])
+	if strings.EqualFold(params[0], "OFF") {
+		level, err = int(LockdownOff), nil
+	}
+	if err != nil || level < int(LockdownOff) || level > int(LockdownConnections) {
+		conn.ReplyServerNotice(fmt.Sprintf("Invalid lockdown level [%s], must be OFF or 0-%d", params[0], LockdownConnections))
+		return
+	}
+
+	if err = conn.server.SetLockdown(LockdownLevel(level), reason, conn.user.Hostmask()); err != nil {
+		conn.ReplyServerNotice(err.Error())
+		return
+	}
+	conn.ReplyServerNotice(fmt.Sprintf("Lockdown level set to %d (%s)", level, LockdownLevel(level)))
+}
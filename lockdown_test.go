@@ -0,0 +1,43 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFloodBucket(t *testing.T) {
+	var bucket floodBucket
+	now := time.Now()
+
+	for i := 0; i < lockdownFloodBurst; i++ {
+		assert.True(t, bucket.allow(now))
+	}
+	assert.False(t, bucket.allow(now))
+	assert.False(t, bucket.allow(now.Add(lockdownFloodInterval/2)))
+	assert.True(t, bucket.allow(now.Add(lockdownFloodInterval)))
+}
+
+func TestSetLockdown(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+
+	assert.NoError(t, srv.SetLockdown(LockdownChannels, "", "oper"))
+	level, reason := srv.Lockdown()
+	assert.Equal(t, LockdownChannels, level)
+	assert.NotEmpty(t, reason)
+	assert.Equal(t, "account registration disabled, SASL required for new connections, channel creation restricted to operators", level.String())
+	assert.Equal(t, ErrRegistrationClosed, srv.RegisterAccount("alice", "hunter2"))
+
+	assert.Error(t, srv.SetLockdown(LockdownConnections+1, "", "oper"))
+	assert.NoError(t, srv.SetLockdown(LockdownOff, "", "oper"))
+	assert.NoError(t, srv.RegisterAccount("alice", "hunter2"))
+}
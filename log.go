@@ -0,0 +1,267 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LevelTrace is the level of the most verbose log entries, such as the lines sent and
+// received on connections with privacy logging, below slog.LevelDebug.
+const LevelTrace = slog.LevelDebug - 4
+
+// Fields are the structured fields of a log entry.
+type Fields map[string]any
+
+// Logger is the structured logger used throughout the server, implemented by adapters
+// for logrus and log/slog, see WithLogger and WithSlogLogger.
+//
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	// WithField returns a logger adding the field to its entries.
+	WithField(key string, value any) Logger
+	// WithFields returns a logger adding the fields to its entries.
+	WithFields(fields Fields) Logger
+	// Enabled reports whether entries at the level are logged.
+	Enabled(level slog.Level) bool
+
+	Trace(args ...any)
+	Tracef(format string, args ...any)
+	Debug(args ...any)
+	Debugf(format string, args ...any)
+	Info(args ...any)
+	Infof(format string, args ...any)
+	Warn(args ...any)
+	Warnf(format string, args ...any)
+	Error(args ...any)
+	Errorf(format string, args ...any)
+	// Panic logs the entry at the error level, or logrus panic level, and then panics.
+	Panic(args ...any)
+}
+
+// WithSlogLogger sets the server to log with the standard library logger, instead of
+// logrus. The logrus specific options WithLogLevel, WithLogFormatter, and WithLogOutput
+// are ignored, as the level and output are configured by the handler of the logger.
+func WithSlogLogger(logger *slog.Logger) ServerOption {
+	return option(func(s *Server) error {
+		if logger == nil {
+			return errors.New("slog logger must not be nil")
+		}
+		s.logrus = nil
+		s.logger = NewSlogLogger(logger).WithField("component", "irc-server")
+		return nil
+	})
+}
+
+// logrusLogger adapts a logrus entry to the Logger interface.
+type logrusLogger struct {
+	entry *logrus.Entry
+	gate  *levelGate
+}
+
+// callerKey is the context key the logrus adapter passes the caller of an entry with.
+type callerKey struct{}
+
+// callerHook sets the caller of logrus entries logged by the adapter to the caller of
+// the adapter, rather than the adapter itself, which logrus would report.
+type callerHook struct{}
+
+func (callerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (callerHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if frame, ok := entry.Context.Value(callerKey{}).(*runtime.Frame); ok {
+		entry.Caller = frame
+	}
+	return nil
+}
+
+// NewLogrusLogger returns a Logger writing to the logrus logger, adding a hook to it so
+// that the callers it reports are those of the Logger.
+func NewLogrusLogger(logger *logrus.Logger) Logger {
+	if logger.Hooks == nil {
+		logger.ReplaceHooks(make(logrus.LevelHooks))
+	}
+	if !slices.Contains(logger.Hooks[logrus.PanicLevel], logrus.Hook(callerHook{})) {
+		logger.AddHook(callerHook{})
+	}
+	return &logrusLogger{entry: logrus.NewEntry(logger)}
+}
+
+func (l *logrusLogger) WithField(key string, value any) Logger {
+	return &logrusLogger{entry: l.entry.WithField(key, value), gate: l.gate.withField(key, value)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields)), gate: l.gate.withFields(fields)}
+}
+
+func (l *logrusLogger) Enabled(level slog.Level) bool {
+	return l.gate.allows(level) && l.entry.Logger.IsLevelEnabled(logrusLevel(level))
+}
+
+// logrusLevel returns the logrus level of the slog level.
+func logrusLevel(level slog.Level) logrus.Level {
+	switch {
+	case level <= LevelTrace:
+		return logrus.TraceLevel
+	case level <= slog.LevelDebug:
+		return logrus.DebugLevel
+	case level <= slog.LevelInfo:
+		return logrus.InfoLevel
+	case level <= slog.LevelWarn:
+		return logrus.WarnLevel
+	default:
+		return logrus.ErrorLevel
+	}
+}
+
+// slogLevel returns the slog level of the logrus level, above slog.LevelError for the
+// panic and fatal levels.
+func slogLevel(level logrus.Level) slog.Level {
+	switch level {
+	case logrus.TraceLevel:
+		return LevelTrace
+	case logrus.DebugLevel:
+		return slog.LevelDebug
+	case logrus.InfoLevel:
+		return slog.LevelInfo
+	case logrus.WarnLevel:
+		return slog.LevelWarn
+	case logrus.ErrorLevel:
+		return slog.LevelError
+	default:
+		return slog.LevelError + 4
+	}
+}
+
+// log logs the message with the caller of the method of the adapter which called it.
+func (l *logrusLogger) log(level logrus.Level, msg string) {
+	if !l.gate.allows(slogLevel(level)) || !l.entry.Logger.IsLevelEnabled(level) {
+		return
+	}
+
+	entry := l.entry
+	var pcs [1]uintptr
+	if runtime.Callers(3, pcs[:]) > 0 {
+		frame, _ := runtime.CallersFrames(pcs[:]).Next()
+		entry = entry.WithContext(context.WithValue(context.Background(), callerKey{}, &frame))
+	}
+	entry.Log(level, msg)
+}
+
+func (l *logrusLogger) Trace(args ...any) { l.log(logrus.TraceLevel, fmt.Sprint(args...)) }
+func (l *logrusLogger) Tracef(format string, args ...any) {
+	l.log(logrus.TraceLevel, fmt.Sprintf(format, args...))
+}
+func (l *logrusLogger) Debug(args ...any) { l.log(logrus.DebugLevel, fmt.Sprint(args...)) }
+func (l *logrusLogger) Debugf(format string, args ...any) {
+	l.log(logrus.DebugLevel, fmt.Sprintf(format, args...))
+}
+func (l *logrusLogger) Info(args ...any) { l.log(logrus.InfoLevel, fmt.Sprint(args...)) }
+func (l *logrusLogger) Infof(format string, args ...any) {
+	l.log(logrus.InfoLevel, fmt.Sprintf(format, args...))
+}
+func (l *logrusLogger) Warn(args ...any) { l.log(logrus.WarnLevel, fmt.Sprint(args...)) }
+func (l *logrusLogger) Warnf(format string, args ...any) {
+	l.log(logrus.WarnLevel, fmt.Sprintf(format, args...))
+}
+func (l *logrusLogger) Error(args ...any) { l.log(logrus.ErrorLevel, fmt.Sprint(args...)) }
+func (l *logrusLogger) Errorf(format string, args ...any) {
+	l.log(logrus.ErrorLevel, fmt.Sprintf(format, args...))
+}
+func (l *logrusLogger) Panic(args ...any) {
+	msg := fmt.Sprint(args...)
+	l.log(logrus.PanicLevel, msg)
+	// The level may be disabled, in which case logrus does not panic.
+	panic(msg)
+}
+
+// slogLogger adapts a standard library logger to the Logger interface.
+type slogLogger struct {
+	logger *slog.Logger
+	gate   *levelGate
+}
+
+// NewSlogLogger returns a Logger writing to the standard library logger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+func (l *slogLogger) WithField(key string, value any) Logger {
+	return &slogLogger{logger: l.logger.With(key, value), gate: l.gate.withField(key, value)}
+}
+
+func (l *slogLogger) WithFields(fields Fields) Logger {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	args := make([]any, 0, len(fields)*2)
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return &slogLogger{logger: l.logger.With(args...), gate: l.gate.withFields(fields)}
+}
+
+func (l *slogLogger) Enabled(level slog.Level) bool {
+	return l.gate.allows(level) && l.logger.Enabled(context.Background(), level)
+}
+
+// log logs the message with the caller of the method of the adapter which called it.
+func (l *slogLogger) log(level slog.Level, msg string) {
+	ctx := context.Background()
+	if !l.gate.allows(level) || !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	_ = l.logger.Handler().Handle(ctx, record)
+}
+
+func (l *slogLogger) Trace(args ...any) { l.log(LevelTrace, fmt.Sprint(args...)) }
+func (l *slogLogger) Tracef(format string, args ...any) {
+	l.log(LevelTrace, fmt.Sprintf(format, args...))
+}
+func (l *slogLogger) Debug(args ...any) { l.log(slog.LevelDebug, fmt.Sprint(args...)) }
+func (l *slogLogger) Debugf(format string, args ...any) {
+	l.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+}
+func (l *slogLogger) Info(args ...any) { l.log(slog.LevelInfo, fmt.Sprint(args...)) }
+func (l *slogLogger) Infof(format string, args ...any) {
+	l.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+func (l *slogLogger) Warn(args ...any) { l.log(slog.LevelWarn, fmt.Sprint(args...)) }
+func (l *slogLogger) Warnf(format string, args ...any) {
+	l.log(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+func (l *slogLogger) Error(args ...any) { l.log(slog.LevelError, fmt.Sprint(args...)) }
+func (l *slogLogger) Errorf(format string, args ...any) {
+	l.log(slog.LevelError, fmt.Sprintf(format, args...))
+}
+func (l *slogLogger) Panic(args ...any) {
+	msg := fmt.Sprint(args...)
+	l.log(slog.LevelError, msg)
+	panic(msg)
+}
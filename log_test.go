@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	var out bytes.Buffer
+	base := logrus.New()
+	base.SetOutput(&out)
+	base.SetFormatter(&logrus.JSONFormatter{})
+	base.SetReportCaller(true)
+
+	logger := NewLogrusLogger(base).WithFields(Fields{"component": "test"}).WithField("operation", "log")
+	NewLogrusLogger(base)
+	assert.Len(t, base.Hooks[logrus.InfoLevel], 1)
+
+	logger.Infof("hello %s", "world")
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "hello world", entry["msg"])
+	assert.Equal(t, "test", entry["component"])
+	assert.Equal(t, "log", entry["operation"])
+	assert.Equal(t, "github.com/btnmasher/dircd.TestLogrusLogger", entry["func"])
+
+	out.Reset()
+	logger.Debug("hidden")
+	assert.Empty(t, out.String())
+	assert.False(t, logger.Enabled(slog.LevelDebug))
+	assert.True(t, logger.Enabled(slog.LevelWarn))
+	assert.Panics(t, func() { logger.Panic("failed") })
+}
+
+func TestSlogLogger(t *testing.T) {
+	var out bytes.Buffer
+	handler := slog.NewJSONHandler(&out, &slog.HandlerOptions{AddSource: true, Level: LevelTrace})
+	srv, err := NewServer(WithSlogLogger(slog.New(handler)), WithLogLevel(logrus.ErrorLevel))
+	assert.NoError(t, err)
+	assert.Nil(t, srv.logrus)
+
+	srv.logger.WithField("operation", "log").Tracef("hello %s", "world")
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "hello world", entry["msg"])
+	assert.Equal(t, "DEBUG-4", entry["level"])
+	assert.Equal(t, "irc-server", entry["component"])
+	assert.Equal(t, "log", entry["operation"])
+	assert.Equal(t, "github.com/btnmasher/dircd.TestSlogLogger", entry["source"].(map[string]any)["function"])
+	assert.True(t, srv.logger.Enabled(LevelTrace))
+	assert.Panics(t, func() { srv.logger.Panic("failed") })
+
+	_, err = NewServer(WithSlogLogger(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,273 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LogCategories are the categories of log entries, by their sub-component, whose level
+// can be set apart from the level of the server logger with SetLogLevel.
+var LogCategories = []string{"listener", "reader", "writer", "router"}
+
+// logLevelDefault is the level name which clears the level of a category, so that it
+// follows the level of the server logger.
+const logLevelDefault = "default"
+
+// ParseLogLevel returns the level with the name: trace, debug, info, warn, or error.
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+// logLevelName returns the name of the level, as accepted by ParseLogLevel.
+func logLevelName(level slog.Level) string {
+	if level == LevelTrace {
+		return "trace"
+	}
+	return strings.ToLower(level.String())
+}
+
+// logLevels holds the levels of the server logger and of the categories of its entries,
+// which can be changed at runtime.
+type logLevels struct {
+	mu         sync.Mutex // Serializes changes.
+	level      atomic.Int64
+	categories map[string]*atomic.Pointer[slog.Level] // Nil if the category follows level.
+
+	// setFloor sets the level of the underlying logger to the most verbose of the levels,
+	// or is nil if the level of the underlying logger is configured by its handler.
+	setFloor func(slog.Level)
+}
+
+// startLogLevels sets up the runtime levels of the server logger, starting at the level
+// it is configured with.
+func (srv *Server) startLogLevels() {
+	levels := &logLevels{
+		categories: make(map[string]*atomic.Pointer[slog.Level], len(LogCategories)),
+	}
+	for _, category := range LogCategories {
+		levels.categories[category] = &atomic.Pointer[slog.Level]{}
+	}
+
+	switch logger := srv.logger.(type) {
+	case *logrusLogger:
+		base := logger.entry.Logger
+		levels.level.Store(int64(slogLevel(base.GetLevel())))
+		levels.setFloor = func(level slog.Level) {
+			base.SetLevel(logrusLevel(level))
+		}
+		srv.logger = &logrusLogger{entry: logger.entry, gate: levels.gate(logger.gate)}
+
+	case *slogLogger:
+		// The level of the handler is fixed, so start at the most verbose level it logs.
+		level := slog.LevelError
+		for _, candidate := range []slog.Level{LevelTrace, slog.LevelDebug, slog.LevelInfo, slog.LevelWarn} {
+			if logger.logger.Enabled(context.Background(), candidate) {
+				level = candidate
+				break
+			}
+		}
+		levels.level.Store(int64(level))
+		srv.logger = &slogLogger{logger: logger.logger, gate: levels.gate(logger.gate)}
+	}
+
+	srv.logLevels = levels
+}
+
+// gate returns a gate filtering entries by the levels, for the category of the gate.
+func (levels *logLevels) gate(from *levelGate) *levelGate {
+	gate := &levelGate{levels: levels}
+	if from != nil {
+		gate.category = from.category
+	}
+	return gate
+}
+
+// set sets the level, or the level of the category if not empty, clearing it if level is
+// nil, and updates the level of the underlying logger.
+func (levels *logLevels) set(category string, level *slog.Level) error {
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+
+	if len(category) == 0 {
+		if level == nil {
+			return errors.New("log level is required")
+		}
+		levels.level.Store(int64(*level))
+	} else {
+		categoryLevel, exists := levels.categories[strings.ToLower(category)]
+		if !exists {
+			return fmt.Errorf("unknown log category: %s, expected one of: %s", category, strings.Join(LogCategories, ", "))
+		}
+		categoryLevel.Store(level)
+	}
+
+	if levels.setFloor != nil {
+		floor := slog.Level(levels.level.Load())
+		for _, categoryLevel := range levels.categories {
+			if level := categoryLevel.Load(); level != nil && *level < floor {
+				floor = *level
+			}
+		}
+		levels.setFloor(floor)
+	}
+
+	return nil
+}
+
+// LogLevels returns the name of the level of the server logger, and of the level of each
+// of the LogCategories, or "default" for those following the level of the server logger.
+func (srv *Server) LogLevels() (level string, categories map[string]string) {
+	if srv.logLevels == nil {
+		return "", nil
+	}
+
+	categories = make(map[string]string, len(LogCategories))
+	for _, category := range LogCategories {
+		categories[category] = logLevelDefault
+		if level := srv.logLevels.categories[category].Load(); level != nil {
+			categories[category] = logLevelName(*level)
+		}
+	}
+	return logLevelName(slog.Level(srv.logLevels.level.Load())), categories
+}
+
+// SetLogLevel sets the level of the server logger by name, as accepted by ParseLogLevel,
+// or the level of one of the LogCategories if category is not empty. Setting a category
+// to "default" has it follow the level of the server logger again.
+//
+// With WithSlogLogger, entries are still filtered by the level of the handler, so levels
+// more verbose than that of the handler have no effect.
+func (srv *Server) SetLogLevel(category, level string) error {
+	if srv.logLevels == nil {
+		return errors.New("log levels cannot be changed for this logger")
+	}
+
+	if len(category) > 0 && strings.EqualFold(level, logLevelDefault) {
+		return srv.logLevels.set(category, nil)
+	}
+
+	parsed, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	return srv.logLevels.set(category, &parsed)
+}
+
+// levelGate filters the entries of a logger adapter by the runtime levels of the server,
+// using the level of the category of its entries, if set. A nil gate allows all entries.
+type levelGate struct {
+	levels   *logLevels
+	category *atomic.Pointer[slog.Level]
+}
+
+// withField returns the gate for a logger with the field added, whose category is that
+// of the sub-component field, if it is one of the LogCategories.
+func (g *levelGate) withField(key string, value any) *levelGate {
+	if g == nil || key != "sub-component" {
+		return g
+	}
+	name, ok := value.(string)
+	if !ok {
+		return g
+	}
+	category, exists := g.levels.categories[strings.ToLower(name)]
+	if !exists {
+		return g
+	}
+	return &levelGate{levels: g.levels, category: category}
+}
+
+// withFields returns the gate for a logger with the fields added.
+func (g *levelGate) withFields(fields Fields) *levelGate {
+	if value, exists := fields["sub-component"]; exists {
+		return g.withField("sub-component", value)
+	}
+	return g
+}
+
+// allows reports whether entries at the level pass the gate.
+func (g *levelGate) allows(level slog.Level) bool {
+	if g == nil {
+		return true
+	}
+	if g.category != nil {
+		if categoryLevel := g.category.Load(); categoryLevel != nil {
+			return level >= *categoryLevel
+		}
+	}
+	return level >= slog.Level(g.levels.level.Load())
+}
+
+// doDebug processes the subcommands of a DEBUG command.
+func (conn *Conn) doDebug(subcommand string, params []string) {
+	switch strings.ToUpper(subcommand) {
+	case "LOGLEVEL":
+		var category, level string
+		switch len(params) {
+		case 0:
+			conn.replyLogLevels()
+			return
+		case 1:
+			level = params[0]
+		default:
+			category, level = params[0], params[1]
+		}
+
+		if err := conn.server.SetLogLevel(category, level); err != nil {
+			conn.ReplyServerNotice(err.Error())
+			return
+		}
+
+		target := strings.ToLower(level)
+		if len(category) > 0 {
+			target = strings.ToLower(category) + " " + target
+		}
+		conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdDebug + " LOGLEVEL", Target: target})
+		conn.replyLogLevels()
+
+	case "SNOMASK":
+		conn.doSnomask(params)
+
+	default:
+		conn.ReplyServerNotice("Unknown DEBUG subcommand, expected LOGLEVEL or SNOMASK")
+	}
+}
+
+// replyLogLevels replies with the levels of the server logger and its categories.
+func (conn *Conn) replyLogLevels() {
+	level, categories := conn.server.LogLevels()
+	if len(level) == 0 {
+		conn.ReplyServerNotice("Log levels cannot be changed for this logger")
+		return
+	}
+
+	conn.ReplyServerNotice(fmt.Sprintf("Log level: %s", level))
+	for _, category := range LogCategories {
+		conn.ReplyServerNotice(fmt.Sprintf("Log level of %s: %s", category, categories[category]))
+	}
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	base := logrus.New()
+	base.SetOutput(&out)
+	srv, err := NewServer(WithLogger(base))
+	assert.NoError(t, err)
+
+	reader := srv.logger.WithField("component", "connection").WithField("sub-component", "reader")
+	writer := srv.logger.WithFields(Fields{"sub-component": "Writer"})
+
+	level, categories := srv.LogLevels()
+	assert.Equal(t, "info", level)
+	assert.Equal(t, "default", categories["reader"])
+
+	assert.NoError(t, srv.SetLogLevel("reader", "trace"))
+	assert.Equal(t, logrus.TraceLevel, base.GetLevel())
+	assert.True(t, reader.Enabled(LevelTrace))
+	assert.False(t, writer.Enabled(slog.LevelDebug))
+	assert.False(t, srv.logger.Enabled(slog.LevelDebug))
+
+	reader.Trace("read line")
+	srv.logger.Debug("hidden")
+	assert.Contains(t, out.String(), "read line")
+	assert.NotContains(t, out.String(), "hidden")
+
+	assert.NoError(t, srv.SetLogLevel("", "warn"))
+	assert.False(t, srv.logger.Enabled(slog.LevelInfo))
+	assert.True(t, reader.Enabled(slog.LevelInfo))
+
+	assert.NoError(t, srv.SetLogLevel("READER", "default"))
+	assert.False(t, reader.Enabled(slog.LevelInfo))
+	assert.Equal(t, logrus.WarnLevel, base.GetLevel())
+	level, categories = srv.LogLevels()
+	assert.Equal(t, "warn", level)
+	assert.Equal(t, "default", categories["reader"])
+
+	assert.Error(t, srv.SetLogLevel("", "loud"))
+	assert.Error(t, srv.SetLogLevel("", "default"))
+	assert.Error(t, srv.SetLogLevel("parser", "debug"))
+}
+
+func TestSetLogLevelSlog(t *testing.T) {
+	handler := slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelDebug})
+	srv, err := NewServer(WithSlogLogger(slog.New(handler)))
+	assert.NoError(t, err)
+
+	level, _ := srv.LogLevels()
+	assert.Equal(t, "debug", level)
+
+	assert.NoError(t, srv.SetLogLevel("", "error"))
+	assert.False(t, srv.logger.Enabled(slog.LevelWarn))
+	assert.NoError(t, srv.SetLogLevel("router", "trace"))
+	assert.False(t, srv.logger.WithField("sub-component", "router").Enabled(LevelTrace))
+	assert.True(t, srv.logger.WithField("sub-component", "router").Enabled(slog.LevelDebug))
+}
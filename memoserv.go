@@ -0,0 +1,188 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoServ is the nick of the built-in memo service.
+const memoServ = "MemoServ"
+
+// memosBucket is the storage bucket the memos left for each account are persisted in.
+const memosBucket = "memos"
+
+// memoMaxLength is the maximum length of the text of a memo.
+const memoMaxLength = 300
+
+// WithMemoServ enables the built-in MemoServ, which handles the messages sent to it while
+// no user holds the nick. Users logged in to an account may leave memos for other
+// accounts, which are delivered once a user next logs in to the account, or at once if
+// one already is. Up to quota memos are kept for each account, each for up to the expiry
+// if not zero, persisted in the server storage. Local users may not take the nick MemoServ.
+func WithMemoServ(quota int, expiry time.Duration) ServerOption {
+	return option(func(s *Server) error {
+		if quota <= 0 {
+			return errors.New("memo quota must be positive")
+		}
+		if expiry < 0 {
+			return errors.New("memo expiry must not be negative")
+		}
+		s.memoQuota = quota
+		s.memoExpiry = expiry
+		return nil
+	})
+}
+
+// Memo is a message left for an account with the built-in MemoServ.
+type Memo struct {
+	From string    `json:"from"` // The account of the sender.
+	Text string    `json:"text"`
+	Sent time.Time `json:"sent"`
+}
+
+// memoStore holds the memos left for each account, persisted in the server storage.
+type memoStore struct {
+	mu      sync.Mutex
+	storage Storage
+}
+
+// load returns the memos left for the account which have not expired.
+func (ms *memoStore) load(account string, expiry time.Duration) ([]Memo, error) {
+	var memos []Memo
+	if err := loadJSON(ms.storage, memosBucket, accountKey(account), &memos); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if expiry > 0 {
+		live := memos[:0]
+		for _, memo := range memos {
+			if time.Since(memo.Sent) < expiry {
+				live = append(live, memo)
+			}
+		}
+		memos = live
+	}
+	return memos, nil
+}
+
+// add leaves the memo for the account, or returns ErrMemoQuota if the account has as
+// many memos as the quota.
+func (ms *memoStore) add(account string, memo Memo, quota int, expiry time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	memos, err := ms.load(account, expiry)
+	if err != nil {
+		return err
+	}
+	if len(memos) >= quota {
+		return ErrMemoQuota
+	}
+	return storeJSON(ms.storage, memosBucket, accountKey(account), append(memos, memo))
+}
+
+// take returns the memos left for the account which have not expired, oldest first,
+// removing them all.
+func (ms *memoStore) take(account string, expiry time.Duration) ([]Memo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	memos, err := ms.load(account, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return memos, ms.storage.Delete(memosBucket, accountKey(account))
+}
+
+// doMemoServ handles the commands of the built-in MemoServ:
+//
+//	SEND <account> <text>  Leaves the memo for the account.
+func (conn *Conn) doMemoServ(text string) {
+	fields := strings.SplitN(strings.TrimSpace(text), " ", 3)
+	if !strings.EqualFold(fields[0], "SEND") || len(fields) < 3 {
+		conn.serviceNotice(memoServ, "Syntax: SEND <account> <text>")
+		return
+	}
+
+	srv := conn.server
+	from := conn.user.Account()
+	if len(from) == 0 {
+		conn.serviceNotice(memoServ, "You must be logged in to an account to send memos.")
+		return
+	}
+
+	target, memoText := fields[1], strings.TrimSpace(fields[2])
+	if len(memoText) == 0 || len(memoText) > memoMaxLength {
+		conn.serviceNotice(memoServ, fmt.Sprintf("Memos must be between 1 and %d characters.", memoMaxLength))
+		return
+	}
+
+	// Accounts of an auth provider are not held in the account store.
+	if srv.authProvider == nil {
+		if _, err := srv.accounts.get(conn.ctx, target); err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				conn.logger.WithField("operation", "memoserv").
+					Error(fmt.Errorf("error looking up account [%s]: %w", target, err))
+			}
+			conn.serviceNotice(memoServ, fmt.Sprintf("%s is not a registered account.", target))
+			return
+		}
+	}
+
+	memo := Memo{From: from, Text: memoText, Sent: time.Now().UTC()}
+	if err := srv.memos.add(target, memo, srv.memoQuota, srv.memoExpiry); err != nil {
+		if !errors.Is(err, ErrMemoQuota) {
+			conn.logger.WithField("operation", "memoserv").
+				Error(fmt.Errorf("error leaving memo for account [%s]: %w", target, err))
+		}
+		conn.serviceNotice(memoServ, fmt.Sprintf("Your memo to %s could not be sent: %s", target, err))
+		return
+	}
+	conn.serviceNotice(memoServ, fmt.Sprintf("Your memo to %s has been sent.", target))
+
+	// Users already logged in to the account receive it at once.
+	srv.Users.ForEach(func(_ string, user *User) error {
+		if user.conn != nil && strings.EqualFold(user.Account(), target) {
+			user.conn.deliverMemos()
+		}
+		return nil
+	})
+}
+
+// deliverMemos sends the registered user the memos left for the account they are logged
+// in to, if MemoServ is enabled.
+func (conn *Conn) deliverMemos() {
+	srv := conn.server
+	account := conn.user.Account()
+	if srv.memoQuota == 0 || len(account) == 0 || !conn.isRegistered() {
+		return
+	}
+
+	memos, err := srv.memos.take(account, srv.memoExpiry)
+	if err != nil {
+		conn.logger.WithField("operation", "memoserv").
+			Error(fmt.Errorf("error delivering memos of account [%s]: %w", account, err))
+		return
+	}
+
+	for _, memo := range memos {
+		msg := msgPool.New()
+		generation := msg.Generation()
+		msg.Source = srv.serviceMask(memoServ)
+		msg.Command = CmdNotice
+		msg.Params = []string{conn.user.Nick()}
+		msg.Trailing = fmt.Sprintf("Memo from %s (%s): %s", memo.From, memo.Sent.Format(time.RFC1123), memo.Text)
+		conn.user.Write(msg.RenderBuffer())
+		msgPool.Recycle(msg, generation)
+	}
+}
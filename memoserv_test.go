@@ -0,0 +1,70 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoStore(t *testing.T) {
+	memos := &memoStore{storage: NewMemoryStorage()}
+
+	old := Memo{From: "alice", Text: "old", Sent: time.Now().Add(-2 * time.Hour)}
+	require.NoError(t, memos.add("Bob", old, 2, 0))
+	require.NoError(t, memos.add("bob", Memo{From: "alice", Text: "new", Sent: time.Now()}, 2, time.Hour))
+	assert.ErrorIs(t, memos.add("bob", Memo{From: "alice", Text: "full"}, 1, 0), ErrMemoQuota)
+
+	// Expired memos are dropped.
+	taken, err := memos.take("BOB", time.Hour)
+	require.NoError(t, err)
+	require.Len(t, taken, 1)
+	assert.Equal(t, "new", taken[0].Text)
+
+	taken, err = memos.take("bob", 0)
+	require.NoError(t, err)
+	assert.Empty(t, taken)
+}
+
+func TestMemoServ(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithMemoServ(5, 0),
+		WithServiceAliases(map[string]string{"MS": "MemoServ", "NS": "NickServ"}))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	require.NoError(t, srv.RegisterAccount("bob", "hunter2"))
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "alice")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	expectAlice(" 001 alice ")
+
+	routeAlice("MS send nobody hello")
+	expectAlice(":MemoServ!MemoServ@irc.example.net NOTICE alice :nobody is not a registered account.")
+	routeAlice("MS send bob see you at the meeting")
+	expectAlice(" NOTICE alice :Your memo to bob has been sent.")
+
+	// The memo is delivered once the account is next logged in to.
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	expectBob(" 001 bob ")
+	routeBob("PRIVMSG NickServ :identify hunter2")
+	expectBob(" 900 bob ")
+	expectBob("): see you at the meeting")
+
+	// Memos to an account already logged in to are delivered at once.
+	routeAlice("MS send bob again")
+	expectBob("): again")
+
+	taken, err := srv.memos.take("bob", 0)
+	require.NoError(t, err)
+	assert.Empty(t, taken)
+}
@@ -12,6 +12,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync/atomic"
+
+	"github.com/btnmasher/dircd/shared/pool"
 )
 
 // Message is an object that represents the components of an IRC message.
@@ -23,6 +26,76 @@ type Message struct {
 	Code     uint16   `json:"code"`     // The IRC numeric code of the message (substituted as the command when replying).
 	Params   []string `json:"params"`   // The person of the message after prefix and command in array form.
 	Trailing string   `json:"trailing"` // The final parameter of a message, may contain spaces (eg: text of a PRIVMSG)
+
+	// trailingImplied is set when the message had no explicit trailing parameter, and its
+	// last middle parameter was copied to Trailing by the parser.
+	trailingImplied bool
+
+	// generation counts the times the message was recycled, atomically. It is odd while
+	// the message is held by msgPool, and even while it is handed out.
+	generation uint32
+}
+
+// Generation returns the generation of the message, which its owner must read when they
+// take it from msgPool, and give when they recycle it.
+func (msg *Message) Generation() uint32 {
+	return atomic.LoadUint32(&msg.generation)
+}
+
+// messagePool is a pool of messages guarding against messages being recycled by anyone
+// other than their current owner, which would hand them out to two owners at once.
+//
+// A message is owned by whoever took it from the pool, who must recycle it once, giving
+// the generation it was taken at, after which it must no longer be used. Recycling a
+// message with any other generation, either a second time or after it was handed out
+// again to a new owner, is ignored, and panics in builds with the dircd_debug tag, as do
+// messages rendered after being recycled. Messages routed to handlers are owned by the
+// router, and recycled once handled.
+type messagePool struct {
+	pool pool.Pool[*Message]
+}
+
+// New returns a message from the pool.
+func (p *messagePool) New() *Message {
+	msg := p.pool.New()
+	// Only the pool has access to the message, until it is returned.
+	if generation := atomic.LoadUint32(&msg.generation); generation%2 == 1 {
+		atomic.StoreUint32(&msg.generation, generation+1)
+	}
+	return msg
+}
+
+// Recycle resets the message and returns it to the pool, if it is still of the
+// generation its owner took it at.
+func (p *messagePool) Recycle(msg *Message, generation uint32) {
+	if generation%2 == 1 || !atomic.CompareAndSwapUint32(&msg.generation, generation, generation+1) {
+		if poolDebug {
+			panic(fmt.Sprintf("message [%s] recycled by a previous owner", msg.Command))
+		}
+		return
+	}
+	p.pool.Recycle(msg)
+}
+
+// messageBatch is messages taken from msgPool to be recycled together, such as the
+// lines of a reply, with the generations they were taken at.
+type messageBatch struct {
+	messages    []*Message
+	generations []uint32
+}
+
+// add adds the message, newly taken from msgPool, to the batch.
+func (batch *messageBatch) add(msg *Message) {
+	batch.messages = append(batch.messages, msg)
+	batch.generations = append(batch.generations, msg.Generation())
+}
+
+// recycle recycles the messages of the batch.
+func (batch *messageBatch) recycle() {
+	for i, msg := range batch.messages {
+		msgPool.Recycle(msg, batch.generations[i])
+	}
+	batch.messages, batch.generations = nil, nil
 }
 
 // Message represents an IRC protocol message.
@@ -82,6 +155,9 @@ func (msg *Message) String() string {
 
 // RenderBuffer returns the IRC-formatted byte buffer version of a message object.
 func (msg *Message) RenderBuffer() *bytes.Buffer {
+	if poolDebug && msg.Generation()%2 == 1 {
+		panic("message rendered after being recycled")
+	}
 	buffer := bufPool.New()
 
 	if len(msg.Tags) > 0 {
@@ -147,6 +223,7 @@ func (msg *Message) Reset() {
 	msg.Code = 0
 	msg.Params = nil
 	msg.Trailing = ""
+	msg.trailingImplied = false
 }
 
 func escapeTagString(str string) string {
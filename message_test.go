@@ -74,3 +74,36 @@ func TestMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestMessagePoolRecycle(t *testing.T) {
+	msg := msgPool.New()
+	generation := msg.Generation()
+	msg.Command = CmdPing
+	msgPool.Recycle(msg, generation)
+	assert.Empty(t, msg.Command)
+
+	if poolDebug {
+		assert.Panics(t, func() { msgPool.Recycle(msg, generation) })
+		assert.Panics(t, func() { msg.RenderBuffer() })
+		return
+	}
+
+	// Recycling a message twice is ignored, so that it is never handed out twice.
+	msg.Command = CmdPong
+	msgPool.Recycle(msg, generation)
+	assert.Equal(t, CmdPong, msg.Command)
+}
+
+func TestMessagePoolStaleOwner(t *testing.T) {
+	// A message taken at generation 0, recycled, and handed out again to a new owner.
+	msg := &Message{Command: CmdPing, generation: 2}
+
+	if poolDebug {
+		assert.Panics(t, func() { msgPool.Recycle(msg, 0) })
+		return
+	}
+	msgPool.Recycle(msg, 0)
+	assert.Equal(t, CmdPing, msg.Command, "the previous owner cannot recycle it")
+	msgPool.Recycle(msg, 2)
+	assert.Empty(t, msg.Command)
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/pool"
+)
+
+// poolAdaptInterval is how often the reserves of the message and buffer pools are
+// adapted to the demand observed.
+const poolAdaptInterval = time.Minute
+
+// LatencyBuckets are the upper bounds of the buckets of command latency histograms.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram is a snapshot of the latencies observed handling a command.
+type LatencyHistogram struct {
+	Buckets []uint64      // Number of observations in each of LatencyBuckets, followed by those above the last bound.
+	Count   uint64        // Total number of observations.
+	Sum     time.Duration // Total of all observations.
+}
+
+// Mean returns the mean latency observed, or zero without any observations.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// latencyHistogram counts the latencies observed handling a command. It is safe for
+// concurrent use.
+type latencyHistogram struct {
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]atomic.Uint64, len(LatencyBuckets)+1)}
+}
+
+// observe records the latency in the histogram.
+func (h *latencyHistogram) observe(latency time.Duration) {
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	h.buckets[bucket].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(latency))
+}
+
+// snapshot returns the current counts of the histogram.
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	snapshot := LatencyHistogram{
+		Buckets: make([]uint64, len(h.buckets)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.buckets {
+		snapshot.Buckets[i] = h.buckets[i].Load()
+	}
+	return snapshot
+}
+
+// PoolStats returns the counters of the message and buffer pools, shared by every server
+// of the process, keyed "messages" and "buffers".
+func PoolStats() map[string]pool.Stats {
+	return map[string]pool.Stats{
+		"messages": msgPool.pool.Stats(),
+		"buffers":  bufPool.Stats(),
+	}
+}
+
+// startPoolTuner periodically adapts the reserves of the message and buffer pools to the
+// demand observed, until the server shuts down.
+func (srv *Server) startPoolTuner() {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.registerOnShutdown(cancel)
+	ticker := srv.clock.NewTicker(poolAdaptInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				msgPool.pool.Adapt()
+				bufPool.Adapt()
+			}
+		}
+	}()
+}
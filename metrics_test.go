@@ -0,0 +1,41 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolTuner(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(WithHostname("irc.example.net"), WithClock(clock))
+	require.NoError(t, err)
+	srv.startPoolTuner()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	// Once the garbage collector has emptied the sync.Pool, messages are taken from the
+	// reserve or created, and the reserve grows to at least as many.
+	runtime.GC()
+	runtime.GC()
+	var held messageBatch
+	for i := 0; i < 64; i++ {
+		held.add(msgPool.New())
+	}
+
+	clock.Advance(poolAdaptInterval)
+	assert.Eventually(t, func() bool {
+		return PoolStats()["messages"].Target >= 64
+	}, 5*time.Second, 10*time.Millisecond)
+
+	held.recycle()
+}
@@ -0,0 +1,343 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+// Module is an extension of the server living outside of this package, loaded when the
+// server starts with WithModules. Modules implementing io.Closer are closed on shutdown.
+type Module interface {
+	// Name identifies the module in logs and errors.
+	Name() string
+
+	// Load registers the commands, capabilities, modes, and hooks of the module.
+	Load(ext *Extensions) error
+}
+
+// MessageHook is called before a PRIVMSG or NOTICE from a local user is delivered, and
+// may modify the message. Returning an error rejects the message, reporting the error
+// to the sender unless the message is a NOTICE.
+type MessageHook func(conn *Conn, msg *Message) error
+
+// PreJoinHook is called before a local user joins a channel, which may not exist yet.
+// Returning an error rejects the join, reporting the error to the user.
+type PreJoinHook func(conn *Conn, channel string) error
+
+// JoinHook is called after a local user joins a channel.
+type JoinHook func(conn *Conn, channel *Channel)
+
+// NickHook is called before a local user takes a nick, including their first.
+// Returning an error rejects the nick, reporting the error to the user.
+type NickHook func(conn *Conn, oldNick, newNick string) error
+
+// moduleState holds what the loaded modules registered with the server. It is only
+// modified while loading, before the server accepts connections.
+type moduleState struct {
+	modules      []Module
+	userModes    map[byte]uint64
+	channelModes map[byte]uint64
+	modeBits     uint64 // Mode flags allocated to modules, from the most significant bit down.
+	chanModeBits uint64
+	preMessage   []MessageHook
+	preJoin      []PreJoinHook
+	postJoin     []JoinHook
+	preNick      []NickHook
+}
+
+// Extensions is the registration API given to a module while it is loaded.
+type Extensions struct {
+	server *Server
+	module Module
+	logger Logger
+}
+
+// WithModules sets the modules to load when the server starts, in order.
+func WithModules(modules ...Module) ServerOption {
+	return option(func(s *Server) error {
+		for _, module := range modules {
+			if module == nil {
+				return errors.New("module must not be nil")
+			}
+		}
+		s.modules.modules = append(s.modules.modules, modules...)
+		return nil
+	})
+}
+
+// loadModules loads the configured modules, after the built-in command handlers
+// and ISUPPORT tokens are in place.
+func (srv *Server) loadModules() error {
+	state := &srv.modules
+	state.userModes = make(map[byte]uint64)
+	state.channelModes = make(map[byte]uint64)
+
+	for _, module := range state.modules {
+		ext := &Extensions{
+			server: srv,
+			module: module,
+			logger: srv.logger.WithFields(Fields{
+				"sub-component": "module",
+				"module":        module.Name(),
+			}),
+		}
+
+		if err := module.Load(ext); err != nil {
+			return fmt.Errorf("error loading module [%s]: %w", module.Name(), err)
+		}
+
+		if closer, ok := module.(io.Closer); ok {
+			srv.registerOnShutdown(func() {
+				if err := closer.Close(); err != nil {
+					ext.logger.Warn(fmt.Errorf("error closing module: %w", err))
+				}
+			})
+		}
+		ext.logger.Info("loaded module")
+	}
+
+	if len(state.channelModes) > 0 {
+		chanmodes, _ := srv.support.Get("chanmodes")
+		for letter := range state.channelModes {
+			chanmodes += string(letter)
+		}
+		srv.support.Set("chanmodes", chanmodes)
+	}
+	return nil
+}
+
+// Server returns the server the module is loaded into.
+func (ext *Extensions) Server() *Server {
+	return ext.server
+}
+
+// Logger returns a logger identifying the module.
+func (ext *Extensions) Logger() Logger {
+	return ext.logger
+}
+
+// Handle registers the handlers for a new command, which is only routed for registered
+// connections unless allowed with AllowUnregistered. Use the MustBeOper and RequirePrivilege
+// middleware to restrict who may use it, or HandleSpec, eg:
+//
+//	ext.Handle("HELLO", dircd.MustBeOper, handleHello)
+func (ext *Extensions) Handle(command string, handlers ...MessageHandler) error {
+	command = strings.ToUpper(command)
+	if len(command) == 0 || len(handlers) == 0 {
+		return errors.New("command and handlers must not be empty")
+	}
+	if _, exists := ext.server.Router.HandlerMap[command]; exists {
+		return fmt.Errorf("command [%s] is already registered", command)
+	}
+	if _, exists := ext.server.Router.aliases[command]; exists {
+		return fmt.Errorf("command [%s] is already registered as an alias", command)
+	}
+
+	ext.server.Router.Handle(command, handlers...)
+	return nil
+}
+
+// HandleSpec registers the handlers for a new command like Handle, along with the spec
+// of the command, which is enforced before the handlers are called, eg:
+//
+//	ext.HandleSpec("HELLO", dircd.CommandSpec{Registered: true, MinParams: 1}, handleHello)
+func (ext *Extensions) HandleSpec(command string, spec CommandSpec, handlers ...MessageHandler) error {
+	if err := ext.Handle(command, handlers...); err != nil {
+		return err
+	}
+	ext.server.Router.specs[strings.ToUpper(command)] = &spec
+	return nil
+}
+
+// AllowUnregistered allows the command to be used by connections which have not completed
+// registration, eg: a command used to negotiate before registering.
+func (ext *Extensions) AllowUnregistered(command string) error {
+	command = strings.ToUpper(command)
+	if _, exists := ext.server.Router.HandlerMap[command]; !exists {
+		return fmt.Errorf("command [%s] is not registered", command)
+	}
+	ext.server.Router.AllowUnregistered(command)
+	return nil
+}
+
+// Alias registers an alternative name for a command, which is routed to its handlers.
+func (ext *Extensions) Alias(alias, command string) error {
+	alias, command = strings.ToUpper(alias), strings.ToUpper(command)
+	if len(alias) == 0 {
+		return errors.New("alias must not be empty")
+	}
+	if _, exists := ext.server.Router.HandlerMap[command]; !exists {
+		return fmt.Errorf("command [%s] is not registered", command)
+	}
+	if _, exists := ext.server.Router.HandlerMap[alias]; exists {
+		return fmt.Errorf("alias [%s] is already registered as a command", alias)
+	}
+	if _, exists := ext.server.Router.aliases[alias]; exists {
+		return fmt.Errorf("alias [%s] is already registered", alias)
+	}
+
+	ext.server.Router.Alias(alias, command)
+	return nil
+}
+
+// OperAction records an action taken by an operator through a command of the module,
+// publishing it to event subscribers and the audit log. The actor is usually the
+// operator's hostmask.
+func (ext *Extensions) OperAction(actor, action, target, reason string) {
+	ext.server.publish(Event{
+		Type:   EventOperAction,
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Reason: reason,
+	})
+}
+
+// Capability registers a capability which clients may request with CAP REQ, advertised
+// with the value, if any, in CAP LS 302. It returns the flag to check for it with
+// Conn.HasCap.
+func (ext *Extensions) Capability(name, value string) (int, error) {
+	capability := Capability{Name: name}
+	if len(value) > 0 {
+		capability.Value = func() string { return value }
+	}
+	return ext.RegisterCapability(capability)
+}
+
+// RegisterCapability registers a capability which clients may request with CAP REQ,
+// with its value, the capabilities it requires and the hooks called when clients
+// enable or disable it. It returns the flag to check for it with Conn.HasCap.
+func (ext *Extensions) RegisterCapability(capability Capability) (int, error) {
+	return ext.server.capabilities.register(capability)
+}
+
+// UserMode registers a user mode letter, with the permission levels required to set it
+// and to receive it. It returns the flag to set and check with the User mode methods.
+func (ext *Extensions) UserMode(letter byte, setter, target uint8) (uint64, error) {
+	state := &ext.server.modules
+	if !isModeLetter(letter) {
+		return 0, fmt.Errorf("invalid user mode letter [%c]", letter)
+	}
+	if _, exists := state.userModes[letter]; exists {
+		return 0, fmt.Errorf("user mode [%c] is already registered", letter)
+	}
+	if _, exists := ts6UserModes[letter]; exists {
+		return 0, fmt.Errorf("user mode [%c] is reserved", letter)
+	}
+	if _, exists := userModeLetters[letter]; exists {
+		return 0, fmt.Errorf("user mode [%c] is reserved", letter)
+	}
+
+	flag, err := allocateModeBit(&state.modeBits, UModeSecureOnly)
+	if err != nil {
+		return 0, err
+	}
+	state.userModes[letter] = flag
+	uModeReqs[flag] = UModeReq{Setter: setter, Target: target}
+	return flag, nil
+}
+
+// ChannelMode registers a channel mode letter for a mode without a parameter, advertised
+// in ISUPPORT CHANMODES. It returns the flag to set and check with the Channel mode methods.
+func (ext *Extensions) ChannelMode(letter byte) (uint64, error) {
+	state := &ext.server.modules
+	if !isModeLetter(letter) {
+		return 0, fmt.Errorf("invalid channel mode letter [%c]", letter)
+	}
+
+	chanmodes, _ := ext.server.support.Get("chanmodes")
+	prefix, _ := ext.server.support.Get("prefix")
+	if _, exists := state.channelModes[letter]; exists || strings.IndexByte(chanmodes+prefix, letter) >= 0 {
+		return 0, fmt.Errorf("channel mode [%c] is already registered", letter)
+	}
+
+	flag, err := allocateModeBit(&state.chanModeBits, CModeInviteOnly)
+	if err != nil {
+		return 0, err
+	}
+	state.channelModes[letter] = flag
+	return flag, nil
+}
+
+// PreMessage registers a hook called before a PRIVMSG or NOTICE is delivered.
+func (ext *Extensions) PreMessage(hook MessageHook) {
+	ext.server.modules.preMessage = append(ext.server.modules.preMessage, hook)
+}
+
+// PreJoin registers a hook called before a user joins a channel.
+func (ext *Extensions) PreJoin(hook PreJoinHook) {
+	ext.server.modules.preJoin = append(ext.server.modules.preJoin, hook)
+}
+
+// PostJoin registers a hook called after a user joins a channel.
+func (ext *Extensions) PostJoin(hook JoinHook) {
+	ext.server.modules.postJoin = append(ext.server.modules.postJoin, hook)
+}
+
+// PreNick registers a hook called before a user takes a nick.
+func (ext *Extensions) PreNick(hook NickHook) {
+	ext.server.modules.preNick = append(ext.server.modules.preNick, hook)
+}
+
+// isModeLetter reports whether the character may be used as a mode letter.
+func isModeLetter(letter byte) bool {
+	return (letter >= 'a' && letter <= 'z') || (letter >= 'A' && letter <= 'Z')
+}
+
+// allocateModeBit allocates the most significant mode flag not yet allocated, which must
+// be above the highest built-in flag.
+func allocateModeBit(allocated *uint64, highestBuiltin uint64) (uint64, error) {
+	flag := uint64(1) << (63 - bits.OnesCount64(*allocated))
+	if *allocated == ^uint64(0) || flag <= highestBuiltin {
+		return 0, errors.New("no mode flags left")
+	}
+	*allocated |= flag
+	return flag, nil
+}
+
+// runPreMessage runs the message hooks, returning the first error.
+func (srv *Server) runPreMessage(conn *Conn, msg *Message) error {
+	for _, hook := range srv.modules.preMessage {
+		if err := hook(conn, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPreJoin runs the pre-join hooks, returning the first error.
+func (srv *Server) runPreJoin(conn *Conn, channel string) error {
+	for _, hook := range srv.modules.preJoin {
+		if err := hook(conn, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostJoin runs the join hooks.
+func (srv *Server) runPostJoin(conn *Conn, channel *Channel) {
+	for _, hook := range srv.modules.postJoin {
+		hook(conn, channel)
+	}
+}
+
+// runPreNick runs the nick hooks, returning the first error.
+func (srv *Server) runPreNick(conn *Conn, oldNick, newNick string) error {
+	for _, hook := range srv.modules.preNick {
+		if err := hook(conn, oldNick, newNick); err != nil {
+			return err
+		}
+	}
+	return nil
+}
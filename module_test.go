@@ -0,0 +1,121 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testModule is a Module which loads with the given function.
+type testModule func(ext *Extensions) error
+
+func (m testModule) Name() string {
+	return "test"
+}
+
+func (m testModule) Load(ext *Extensions) error {
+	return m(ext)
+}
+
+func TestLoadModules(t *testing.T) {
+	tests := []struct {
+		name string
+		load func(ext *Extensions) error
+		err  bool
+	}{
+		{
+			name: "new command",
+			load: func(ext *Extensions) error {
+				return ext.Handle("hello", MustBeRegistered, func(ctx *MessageContext) {})
+			},
+		},
+		{
+			name: "built-in command",
+			load: func(ext *Extensions) error {
+				return ext.Handle(CmdPrivMsg, func(ctx *MessageContext) {})
+			},
+			err: true,
+		},
+		{
+			name: "new capability",
+			load: func(ext *Extensions) error {
+				flag, err := ext.Capability("example.org/test", "v1")
+				assert.Equal(t, EventPlayback<<1, flag)
+				assert.Equal(t, "v1", ext.server.capabilityValue("example.org/test"))
+				return err
+			},
+		},
+		{
+			name: "built-in capability",
+			load: func(ext *Extensions) error {
+				_, err := ext.Capability("SASL", "")
+				return err
+			},
+			err: true,
+		},
+		{
+			name: "new modes",
+			load: func(ext *Extensions) error {
+				first, err := ext.UserMode('X', UPermUser, UPermUser)
+				assert.NoError(t, err)
+				second, err := ext.UserMode('Y', UPermNetOp, UPermUser)
+				assert.NoError(t, err)
+				assert.Equal(t, []uint64{1 << 63, 1 << 62}, []uint64{first, second})
+
+				_, err = ext.ChannelMode('K')
+				return err
+			},
+		},
+		{
+			name: "duplicate user mode",
+			load: func(ext *Extensions) error {
+				_, _ = ext.UserMode('X', UPermUser, UPermUser)
+				_, err := ext.UserMode('X', UPermUser, UPermUser)
+				return err
+			},
+			err: true,
+		},
+		{
+			name: "built-in channel mode",
+			load: func(ext *Extensions) error {
+				_, err := ext.ChannelMode('n')
+				return err
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, err := NewServer(WithModules(testModule(test.load)))
+			assert.NoError(t, err)
+
+			srv.registerHandlers()
+			srv.populateISupport()
+			err = srv.loadModules()
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAllocateModeBit(t *testing.T) {
+	var allocated uint64
+	for i := 0; i < 38; i++ {
+		_, err := allocateModeBit(&allocated, UModeWatch)
+		assert.NoError(t, err)
+	}
+
+	_, err := allocateModeBit(&allocated, UModeWatch)
+	assert.Error(t, err)
+}
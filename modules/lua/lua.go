@@ -0,0 +1,451 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package lua provides a dircd module which runs operator-provided Lua scripts to moderate
+// messages and joins, and a SCRIPT operator command to manage them at runtime.
+//
+// Scripts are loaded from the *.lua files of a directory, each into its own sandboxed
+// interpreter with only the base, string, table, and math libraries, and without file
+// or code loading functions. A script moderates by defining any of these functions:
+//
+//	-- msg: nick, user, host, account, command (PRIVMSG or NOTICE), target, text
+//	-- Return false and a reason to reject the message, a string to replace its
+//	-- text, or nothing to let it through.
+//	function on_message(msg) end
+//
+//	-- join: nick, user, host, account, channel
+//	-- Return false and a reason to reject the join, or nothing to let it through.
+//	function on_join(join) end
+//
+// Scripts run in name order, each seeing the text as modified by those before it. A script
+// which errors or exceeds its time limit is logged and lets the message or join through.
+//
+//	SCRIPT LIST
+//	SCRIPT LOAD <name>
+//	SCRIPT RELOAD [<name>]
+//	SCRIPT UNLOAD <name>
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	golua "github.com/yuin/gopher-lua"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Sandbox settings
+const (
+	defaultTimeout  = 50 * time.Millisecond
+	loadTimeout     = time.Second
+	callStackSize   = 64
+	registrySize    = 1024
+	registryMaxSize = 64 * 1024
+)
+
+// CmdScript is the command used by operators to manage scripts.
+const CmdScript = "SCRIPT"
+
+// scriptName matches the names of script files which may be loaded, without the extension.
+var scriptName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// unsafeGlobals are the base library functions removed from the sandbox.
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"}
+
+// scriptSpec is the spec of the SCRIPT command.
+var scriptSpec = dircd.CommandSpec{
+	Registered: true,
+	Oper:       true,
+	Privilege:  dircd.PrivAdmin,
+	MinParams:  1,
+	Help: dircd.CommandHelp{Usage: "<LIST|LOAD|RELOAD|UNLOAD> [name]", Text: []string{
+		"Manages the loaded scripts. LIST lists them, LOAD and RELOAD load the named one",
+		"from the scripts directory, RELOAD without a name reloads all of them, and UNLOAD unloads one.",
+	}},
+}
+
+// Engine is a dircd module running the Lua scripts of a directory.
+type Engine struct {
+	dir     string
+	timeout time.Duration
+	logger  dircd.Logger
+	ext     *dircd.Extensions
+
+	mu      sync.RWMutex
+	scripts map[string]*script
+}
+
+// script is a loaded script and its interpreter, which may only run one call at a time.
+type script struct {
+	name  string
+	mu    sync.Mutex
+	state *golua.LState
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithTimeout sets the time limit of each script function call, 50ms by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(e *Engine) {
+		e.timeout = timeout
+	}
+}
+
+// New returns a module running the scripts in the directory.
+func New(dir string, options ...Option) *Engine {
+	engine := &Engine{
+		dir:     dir,
+		timeout: defaultTimeout,
+		scripts: make(map[string]*script),
+	}
+	for _, option := range options {
+		option(engine)
+	}
+	return engine
+}
+
+// Name identifies the module.
+func (e *Engine) Name() string {
+	return "lua"
+}
+
+// Load loads every script in the directory, and registers the moderation hooks and SCRIPT command.
+func (e *Engine) Load(ext *dircd.Extensions) error {
+	e.logger = ext.Logger()
+	e.ext = ext
+
+	names, err := e.available()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = e.load(name); err != nil {
+			return err
+		}
+	}
+
+	ext.PreMessage(e.onMessage)
+	ext.PreJoin(e.onJoin)
+	return ext.HandleSpec(CmdScript, scriptSpec, e.handleScript)
+}
+
+// Close closes the interpreters of every script.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for name, loaded := range e.scripts {
+		loaded.close()
+		delete(e.scripts, name)
+	}
+	return nil
+}
+
+// available returns the names of the scripts in the directory.
+func (e *Engine) available() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(e.dir, "*.lua"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if name := strings.TrimSuffix(filepath.Base(path), ".lua"); scriptName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// load loads, or reloads, the named script, replacing any loaded version only once it
+// has loaded successfully.
+func (e *Engine) load(name string) error {
+	if !scriptName.MatchString(name) {
+		return fmt.Errorf("invalid script name [%s]", name)
+	}
+
+	source, err := os.ReadFile(filepath.Join(e.dir, name+".lua"))
+	if err != nil {
+		return fmt.Errorf("error reading script [%s]: %w", name, err)
+	}
+
+	loaded := &script{name: name, state: newSandbox(e.logger.WithField("script", name))}
+	fn, err := loaded.state.LoadString(string(source))
+	if err == nil {
+		err = loaded.call(loadTimeout, fn, 0)
+	}
+	if err != nil {
+		loaded.close()
+		return fmt.Errorf("error loading script [%s]: %w", name, err)
+	}
+
+	e.mu.Lock()
+	previous := e.scripts[name]
+	e.scripts[name] = loaded
+	e.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+	e.logger.Infof("loaded script [%s]", name)
+	return nil
+}
+
+// unload unloads the named script.
+func (e *Engine) unload(name string) error {
+	e.mu.Lock()
+	loaded, exists := e.scripts[name]
+	delete(e.scripts, name)
+	e.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("script [%s] is not loaded", name)
+	}
+	loaded.close()
+	e.logger.Infof("unloaded script [%s]", name)
+	return nil
+}
+
+// loaded returns the loaded scripts in name order.
+func (e *Engine) loaded() []*script {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	scripts := make([]*script, 0, len(e.scripts))
+	for _, loaded := range e.scripts {
+		scripts = append(scripts, loaded)
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].name < scripts[j].name })
+	return scripts
+}
+
+// onMessage runs the on_message function of each script on the message.
+func (e *Engine) onMessage(conn *dircd.Conn, msg *dircd.Message) error {
+	for _, loaded := range e.loaded() {
+		var rejected error
+		err := loaded.run(e.timeout, "on_message", func(state *golua.LState) *golua.LTable {
+			table := userTable(state, conn.User())
+			table.RawSetString("command", golua.LString(msg.Command))
+			table.RawSetString("target", golua.LString(msg.Params[0]))
+			table.RawSetString("text", golua.LString(msg.Trailing))
+			return table
+		}, func(result, reason golua.LValue) {
+			switch result.Type() {
+			case golua.LTString:
+				msg.Trailing = result.String()
+			case golua.LTBool:
+				if result == golua.LFalse {
+					rejected = rejection(reason, "Message rejected")
+				}
+			}
+		})
+		if err != nil {
+			e.logger.Warn(fmt.Errorf("error running on_message of script [%s]: %w", loaded.name, err))
+		}
+		if rejected != nil {
+			return rejected
+		}
+	}
+	return nil
+}
+
+// onJoin runs the on_join function of each script on the join.
+func (e *Engine) onJoin(conn *dircd.Conn, channel string) error {
+	for _, loaded := range e.loaded() {
+		var rejected error
+		err := loaded.run(e.timeout, "on_join", func(state *golua.LState) *golua.LTable {
+			table := userTable(state, conn.User())
+			table.RawSetString("channel", golua.LString(channel))
+			return table
+		}, func(result, reason golua.LValue) {
+			if result == golua.LFalse {
+				rejected = rejection(reason, "Join rejected")
+			}
+		})
+		if err != nil {
+			e.logger.Warn(fmt.Errorf("error running on_join of script [%s]: %w", loaded.name, err))
+		}
+		if rejected != nil {
+			return rejected
+		}
+	}
+	return nil
+}
+
+// handleScript processes a SCRIPT command.
+//
+//	Command: SCRIPT
+//	Parameters: <LIST|LOAD|RELOAD|UNLOAD> [name]
+func (e *Engine) handleScript(ctx *dircd.MessageContext) {
+	ctx.Handled()
+
+	name := ""
+	if len(ctx.Msg.Params) > 1 {
+		name = ctx.Msg.Params[1]
+	}
+	oper := ctx.Conn.User().Nick()
+
+	var err error
+	switch subcommand := strings.ToUpper(ctx.Msg.Params[0]); {
+	case subcommand == "LIST":
+		names := make([]string, 0)
+		for _, loaded := range e.loaded() {
+			names = append(names, loaded.name)
+		}
+		ctx.Conn.ReplyServerNotice(fmt.Sprintf("Loaded scripts: %s", strings.Join(names, ", ")))
+		return
+
+	case subcommand == "RELOAD" && len(name) == 0:
+		for _, loaded := range e.loaded() {
+			err = errors.Join(err, e.load(loaded.name))
+		}
+
+	case len(name) == 0:
+		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
+		return
+
+	case subcommand == "LOAD", subcommand == "RELOAD":
+		err = e.load(name)
+
+	case subcommand == "UNLOAD":
+		err = e.unload(name)
+
+	default:
+		ctx.Conn.ReplyServerNotice(fmt.Sprintf("Unknown SCRIPT subcommand: %s", subcommand))
+		return
+	}
+
+	if err != nil {
+		ctx.Conn.ReplyServerNotice(err.Error())
+		return
+	}
+	e.logger.Infof("SCRIPT %s %s by [%s]", strings.ToUpper(ctx.Msg.Params[0]), name, oper)
+	e.ext.OperAction(ctx.Conn.User().Hostmask(), CmdScript+" "+strings.ToUpper(ctx.Msg.Params[0]), name, "")
+	ctx.Conn.ReplyServerNotice(fmt.Sprintf("SCRIPT %s completed", strings.ToUpper(ctx.Msg.Params[0])))
+}
+
+// run calls the named function of the script, if defined, with the table built for the
+// call, passing its results to handle.
+func (s *script) run(timeout time.Duration, function string, build func(*golua.LState) *golua.LTable,
+	handle func(result, reason golua.LValue)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return nil // Unloaded while waiting.
+	}
+
+	fn, ok := s.state.GetGlobal(function).(*golua.LFunction)
+	if !ok {
+		return nil
+	}
+
+	if err := s.callLocked(timeout, fn, 2, build(s.state)); err != nil {
+		return err
+	}
+	result, reason := s.state.Get(-2), s.state.Get(-1)
+	s.state.Pop(2)
+	handle(result, reason)
+	return nil
+}
+
+// call calls the function with the time limit.
+func (s *script) call(timeout time.Duration, fn *golua.LFunction, results int, args ...golua.LValue) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.callLocked(timeout, fn, results, args...)
+}
+
+func (s *script) callLocked(timeout time.Duration, fn *golua.LFunction, results int, args ...golua.LValue) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.state.SetContext(ctx)
+	defer s.state.RemoveContext()
+
+	return s.state.CallByParam(golua.P{Fn: fn, NRet: results, Protect: true}, args...)
+}
+
+// close closes the interpreter of the script once any running call completes.
+func (s *script) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != nil {
+		s.state.Close()
+		s.state = nil
+	}
+}
+
+// newSandbox returns an interpreter with only the safe libraries opened, and print
+// redirected to the logger.
+func newSandbox(logger dircd.Logger) *golua.LState {
+	state := golua.NewState(golua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   callStackSize,
+		RegistrySize:    registrySize,
+		RegistryMaxSize: registryMaxSize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open golua.LGFunction
+	}{
+		{golua.BaseLibName, golua.OpenBase},
+		{golua.TabLibName, golua.OpenTable},
+		{golua.StringLibName, golua.OpenString},
+		{golua.MathLibName, golua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(golua.LString(lib.name))
+		state.Call(1, 0)
+	}
+
+	for _, name := range unsafeGlobals {
+		state.SetGlobal(name, golua.LNil)
+	}
+	state.SetGlobal("print", state.NewFunction(func(state *golua.LState) int {
+		parts := make([]string, state.GetTop())
+		for i := range parts {
+			parts[i] = state.ToStringMeta(state.Get(i + 1)).String()
+		}
+		logger.Info(strings.Join(parts, "\t"))
+		return 0
+	}))
+
+	return state
+}
+
+// userTable returns a table describing the user.
+func userTable(state *golua.LState, user *dircd.User) *golua.LTable {
+	table := state.NewTable()
+	table.RawSetString("nick", golua.LString(user.Nick()))
+	table.RawSetString("user", golua.LString(user.Name()))
+	table.RawSetString("host", golua.LString(user.VisibleHost()))
+	table.RawSetString("account", golua.LString(user.Account()))
+	return table
+}
+
+// rejection returns the rejection error with the reason returned by a script, or the default.
+func rejection(reason golua.LValue, fallback string) error {
+	if reason.Type() == golua.LTString && len(reason.String()) > 0 {
+		return errors.New(reason.String())
+	}
+	return errors.New(fallback)
+}
+
+var _ dircd.Module = (*Engine)(nil)
@@ -0,0 +1,101 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	golua "github.com/yuin/gopher-lua"
+
+	"github.com/btnmasher/dircd"
+)
+
+func TestScripts(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		result golua.LValue
+		reason golua.LValue
+		err    bool
+	}{
+		{
+			name:   "allow",
+			source: `function on_message(msg) end`,
+			result: golua.LNil,
+			reason: golua.LNil,
+		},
+		{
+			name:   "deny",
+			source: `function on_message(msg) if msg.text:find("spam") then return false, "No spam" end end`,
+			result: golua.LFalse,
+			reason: golua.LString("No spam"),
+		},
+		{
+			name:   "modify",
+			source: `function on_message(msg) return string.upper(msg.text) end`,
+			result: golua.LString("SPAM AND EGGS"),
+			reason: golua.LNil,
+		},
+		{
+			name:   "timeout",
+			source: `function on_message(msg) while true do end end`,
+			err:    true,
+		},
+		{
+			name:   "sandboxed",
+			source: `function on_message(msg) return loadstring("return 1")() end`,
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "test.lua"), []byte(test.source), 0o600))
+
+			engine := New(dir, WithTimeout(10*time.Millisecond))
+			engine.logger = dircd.NewLogrusLogger(logrus.New())
+			assert.NoError(t, engine.load("test"))
+			defer engine.Close()
+
+			var result, reason golua.LValue
+			err := engine.loaded()[0].run(engine.timeout, "on_message", func(state *golua.LState) *golua.LTable {
+				table := state.NewTable()
+				table.RawSetString("text", golua.LString("spam and eggs"))
+				return table
+			}, func(r, s golua.LValue) {
+				result, reason = r, s
+			})
+
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.result, result)
+			assert.Equal(t, test.reason, reason)
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.lua"), []byte(`function (`), 0o600))
+
+	engine := New(dir)
+	engine.logger = dircd.NewLogrusLogger(logrus.New())
+	assert.Error(t, engine.load("broken"))
+	assert.Error(t, engine.load("../broken"))
+	assert.Error(t, engine.unload("broken"))
+	assert.Empty(t, engine.loaded())
+}
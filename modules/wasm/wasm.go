@@ -0,0 +1,563 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package wasm provides a dircd module which runs WebAssembly filter plugins on messages,
+// joins, and nick changes, and a PLUGIN operator command to manage them at runtime.
+//
+// Plugins are loaded from the *.wasm files of a directory and run by the wazero runtime,
+// sandboxed from the host but for the functions below, with a time limit on each call and
+// a limit on the memory each plugin may use. A plugin must export its memory and:
+//
+//	alloc(size i32) -> i32 // Returns the address of a buffer of the size.
+//
+// and any of these filters, which are given the address and size of a JSON object
+// describing the action, and return 0 to allow it, 1 to reject it, or 2 to replace the
+// text of a message:
+//
+//	// nick, user, host, account, command (PRIVMSG or NOTICE), target, text
+//	on_message(ptr i32, len i32) -> i32
+//	// nick, user, host, account, channel
+//	on_join(ptr i32, len i32) -> i32
+//	// nick, user, host, account, new_nick
+//	on_nick(ptr i32, len i32) -> i32
+//
+// The rejection reason or replacement text is given by calling the imported function
+// dircd.set_result(ptr i32, len i32) before returning, and dircd.log(ptr i32, len i32)
+// logs a message. Plugins run in name order, each seeing the text as replaced by those
+// before it. A plugin which traps or runs out of time is logged, allows the action, and
+// is reinstantiated for its next call.
+//
+//	PLUGIN LIST
+//	PLUGIN LOAD <name>
+//	PLUGIN RELOAD [<name>]
+//	PLUGIN UNLOAD <name>
+package wasm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/btnmasher/dircd"
+)
+
+// Sandbox settings
+const (
+	defaultTimeout     = 50 * time.Millisecond
+	defaultMemoryPages = 16
+)
+
+// Filter results
+const (
+	resultAllow   = 0
+	resultReject  = 1
+	resultReplace = 2
+)
+
+// CmdPlugin is the command used by operators to manage plugins. It is not named FILTER,
+// which is the command managing the filter rules of the server.
+const CmdPlugin = "PLUGIN"
+
+// pluginName matches the names of plugin files which may be loaded, without the extension.
+var pluginName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Signatures of the functions exported by plugins.
+var (
+	allocParams  = []api.ValueType{api.ValueTypeI32}
+	filterParams = []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}
+	i32Result    = []api.ValueType{api.ValueTypeI32}
+)
+
+// filters are the names of the filters a plugin may export.
+var filters = []string{"on_message", "on_join", "on_nick"}
+
+// pluginKey is the context key of the plugin a host function is called by.
+type pluginKey struct{}
+
+// pluginSpec is the spec of the PLUGIN command.
+var pluginSpec = dircd.CommandSpec{
+	Registered: true,
+	Oper:       true,
+	Privilege:  dircd.PrivAdmin,
+	MinParams:  1,
+	Help: dircd.CommandHelp{Usage: "<LIST|LOAD|RELOAD|UNLOAD> [name]", Text: []string{
+		"Manages the loaded filter plugins. LIST lists them, LOAD and RELOAD load the named one",
+		"from the plugins directory, RELOAD without a name reloads all of them, and UNLOAD unloads one.",
+	}},
+}
+
+// Engine is a dircd module running the WebAssembly plugins of a directory.
+type Engine struct {
+	dir         string
+	timeout     time.Duration
+	memoryPages uint32
+	logger      dircd.Logger
+	ext         *dircd.Extensions
+
+	start      sync.Once
+	runtime    wazero.Runtime
+	runtimeErr error
+
+	mu      sync.RWMutex
+	plugins map[string]*plugin
+}
+
+// plugin is a loaded plugin and its instance, which may only run one call at a time.
+type plugin struct {
+	name     string
+	engine   *Engine
+	compiled wazero.CompiledModule
+	filters  map[string]bool // The filters the plugin exports.
+	logger   dircd.Logger
+
+	mu       sync.Mutex
+	instance api.Module
+	result   string
+	closed   bool
+}
+
+// event describes the action given to a filter.
+type event struct {
+	Nick    string `json:"nick"`
+	User    string `json:"user"`
+	Host    string `json:"host"`
+	Account string `json:"account"`
+	Command string `json:"command,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	NewNick string `json:"new_nick,omitempty"`
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithTimeout sets how long each filter call may run before it is aborted, 50ms by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(e *Engine) {
+		e.timeout = timeout
+	}
+}
+
+// WithMemoryLimit sets the number of 64KiB pages of memory each plugin may use, 16 by default.
+func WithMemoryLimit(pages uint32) Option {
+	return func(e *Engine) {
+		e.memoryPages = pages
+	}
+}
+
+// New returns a module running the plugins in the directory.
+func New(dir string, options ...Option) *Engine {
+	engine := &Engine{
+		dir:         dir,
+		timeout:     defaultTimeout,
+		memoryPages: defaultMemoryPages,
+		plugins:     make(map[string]*plugin),
+	}
+	for _, option := range options {
+		option(engine)
+	}
+	return engine
+}
+
+// Close unloads the plugins and releases the runtime.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	plugins := e.plugins
+	e.plugins = make(map[string]*plugin)
+	e.mu.Unlock()
+
+	for _, loaded := range plugins {
+		loaded.close()
+	}
+	if e.runtime == nil {
+		return nil
+	}
+	return e.runtime.Close(context.Background())
+}
+
+// wasmRuntime returns the runtime of the engine, creating it with the host functions on
+// first use.
+func (e *Engine) wasmRuntime() (wazero.Runtime, error) {
+	e.start.Do(func() {
+		ctx := context.Background()
+		config := wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(e.memoryPages).
+			WithCloseOnContextDone(true)
+		e.runtime = wazero.NewRuntimeWithConfig(ctx, config)
+
+		_, e.runtimeErr = e.runtime.NewHostModuleBuilder("dircd").
+			NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, ptr, size uint32) {
+			caller := ctx.Value(pluginKey{}).(*plugin)
+			caller.result = readString(mod, ptr, size)
+		}).Export("set_result").
+			NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, ptr, size uint32) {
+			caller := ctx.Value(pluginKey{}).(*plugin)
+			caller.logger.Info(readString(mod, ptr, size))
+		}).Export("log").
+			Instantiate(ctx)
+	})
+	return e.runtime, e.runtimeErr
+}
+
+// Name identifies the module.
+func (e *Engine) Name() string {
+	return "wasm"
+}
+
+// Load loads every plugin in the directory, and registers the filter hooks and PLUGIN command.
+func (e *Engine) Load(ext *dircd.Extensions) error {
+	e.logger = ext.Logger()
+	e.ext = ext
+
+	names, err := e.available()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = e.load(name); err != nil {
+			return err
+		}
+	}
+
+	ext.PreMessage(e.onMessage)
+	ext.PreJoin(e.onJoin)
+	ext.PreNick(e.onNick)
+	return ext.HandleSpec(CmdPlugin, pluginSpec, e.handlePlugin)
+}
+
+// available returns the names of the plugins in the directory.
+func (e *Engine) available() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(e.dir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if name := strings.TrimSuffix(filepath.Base(path), ".wasm"); pluginName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// load loads, or reloads, the named plugin, replacing any loaded version only once it
+// has been instantiated successfully.
+func (e *Engine) load(name string) error {
+	if !pluginName.MatchString(name) {
+		return fmt.Errorf("invalid plugin name [%s]", name)
+	}
+
+	binary, err := os.ReadFile(filepath.Join(e.dir, name+".wasm"))
+	if err != nil {
+		return fmt.Errorf("error reading plugin [%s]: %w", name, err)
+	}
+
+	runtime, err := e.wasmRuntime()
+	if err != nil {
+		return fmt.Errorf("error starting WebAssembly runtime: %w", err)
+	}
+
+	// Compiling validates the module, and that its memory is within the limit.
+	compiled, err := runtime.CompileModule(context.Background(), binary)
+	if err != nil {
+		return fmt.Errorf("error compiling plugin [%s]: %w", name, err)
+	}
+
+	loaded := &plugin{
+		name:     name,
+		engine:   e,
+		compiled: compiled,
+		filters:  make(map[string]bool),
+		logger:   e.logger.WithField("plugin", name),
+	}
+	if err = loaded.validate(); err != nil {
+		loaded.close()
+		return fmt.Errorf("plugin [%s] %w", name, err)
+	}
+
+	ctx, cancel := loaded.context()
+	defer cancel()
+	if loaded.instance, err = loaded.instantiate(ctx); err != nil {
+		loaded.close()
+		return fmt.Errorf("error instantiating plugin [%s]: %w", name, err)
+	}
+
+	e.mu.Lock()
+	replaced := e.plugins[name]
+	e.plugins[name] = loaded
+	e.mu.Unlock()
+
+	if replaced != nil {
+		replaced.close()
+	}
+
+	e.logger.Infof("loaded plugin [%s]", name)
+	return nil
+}
+
+// unload unloads the named plugin.
+func (e *Engine) unload(name string) error {
+	e.mu.Lock()
+	loaded, exists := e.plugins[name]
+	delete(e.plugins, name)
+	e.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("plugin [%s] is not loaded", name)
+	}
+	loaded.close()
+	e.logger.Infof("unloaded plugin [%s]", name)
+	return nil
+}
+
+// loaded returns the loaded plugins in name order.
+func (e *Engine) loaded() []*plugin {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	plugins := make([]*plugin, 0, len(e.plugins))
+	for _, loaded := range e.plugins {
+		plugins = append(plugins, loaded)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].name < plugins[j].name })
+	return plugins
+}
+
+// filter runs the filter of each plugin on the event, returning the rejection error, and
+// calling replace with the replacement text of plugins which replace it.
+func (e *Engine) filter(filter string, ev event, fallback string, replace func(text string)) error {
+	for _, loaded := range e.loaded() {
+		result, text, err := loaded.call(filter, ev)
+		if err != nil {
+			e.logger.Warn(fmt.Errorf("error running %s of plugin [%s]: %w", filter, loaded.name, err))
+			continue
+		}
+
+		switch {
+		case result == resultReject && len(text) > 0:
+			return errors.New(text)
+		case result == resultReject:
+			return errors.New(fallback)
+		case result == resultReplace && replace != nil:
+			ev.Text = text
+			replace(text)
+		}
+	}
+	return nil
+}
+
+// onMessage runs the on_message filter of each plugin on the message.
+func (e *Engine) onMessage(conn *dircd.Conn, msg *dircd.Message) error {
+	ev := userEvent(conn.User())
+	ev.Command, ev.Target, ev.Text = msg.Command, msg.Params[0], msg.Trailing
+	return e.filter("on_message", ev, "Message rejected", func(text string) {
+		msg.Trailing = text
+	})
+}
+
+// onJoin runs the on_join filter of each plugin on the join.
+func (e *Engine) onJoin(conn *dircd.Conn, channel string) error {
+	ev := userEvent(conn.User())
+	ev.Channel = channel
+	return e.filter("on_join", ev, "Join rejected", nil)
+}
+
+// onNick runs the on_nick filter of each plugin on the nick change.
+func (e *Engine) onNick(conn *dircd.Conn, oldNick, newNick string) error {
+	ev := userEvent(conn.User())
+	ev.Nick, ev.NewNick = oldNick, newNick
+	return e.filter("on_nick", ev, "Nick rejected", nil)
+}
+
+// handlePlugin processes a PLUGIN command.
+//
+//	Command: PLUGIN
+//	Parameters: <LIST|LOAD|RELOAD|UNLOAD> [name]
+func (e *Engine) handlePlugin(ctx *dircd.MessageContext) {
+	ctx.Handled()
+
+	name := ""
+	if len(ctx.Msg.Params) > 1 {
+		name = ctx.Msg.Params[1]
+	}
+	subcommand := strings.ToUpper(ctx.Msg.Params[0])
+
+	var err error
+	switch {
+	case subcommand == "LIST":
+		names := make([]string, 0)
+		for _, loaded := range e.loaded() {
+			names = append(names, loaded.name)
+		}
+		ctx.Conn.ReplyServerNotice(fmt.Sprintf("Loaded plugins: %s", strings.Join(names, ", ")))
+		return
+
+	case subcommand == "RELOAD" && len(name) == 0:
+		for _, loaded := range e.loaded() {
+			err = errors.Join(err, e.load(loaded.name))
+		}
+
+	case len(name) == 0:
+		ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command)
+		return
+
+	case subcommand == "LOAD", subcommand == "RELOAD":
+		err = e.load(name)
+
+	case subcommand == "UNLOAD":
+		err = e.unload(name)
+
+	default:
+		ctx.Conn.ReplyServerNotice(fmt.Sprintf("Unknown PLUGIN subcommand: %s", subcommand))
+		return
+	}
+
+	if err != nil {
+		ctx.Conn.ReplyServerNotice(err.Error())
+		return
+	}
+	e.logger.Infof("PLUGIN %s %s by [%s]", subcommand, name, ctx.Conn.User().Nick())
+	e.ext.OperAction(ctx.Conn.User().Hostmask(), CmdPlugin+" "+subcommand, name, "")
+	ctx.Conn.ReplyServerNotice(fmt.Sprintf("PLUGIN %s completed", subcommand))
+}
+
+// validate checks the plugin exports its memory, alloc, and filters with the signatures
+// of the host interface, noting the filters it exports.
+func (p *plugin) validate() error {
+	if _, exists := p.compiled.ExportedMemories()["memory"]; !exists {
+		return errors.New("does not export its memory")
+	}
+
+	functions := p.compiled.ExportedFunctions()
+	if alloc, exists := functions["alloc"]; !exists || !hasSignature(alloc, allocParams, i32Result) {
+		return errors.New("does not export alloc(i32) -> i32")
+	}
+	for _, filter := range filters {
+		if definition, exists := functions[filter]; exists {
+			if !hasSignature(definition, filterParams, i32Result) {
+				return fmt.Errorf("exports %s with the wrong signature", filter)
+			}
+			p.filters[filter] = true
+		}
+	}
+	return nil
+}
+
+// context returns the context of a call of the plugin, which is aborted once it runs
+// out of time.
+func (p *plugin) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithValue(context.Background(), pluginKey{}, p), p.engine.timeout)
+}
+
+// instantiate instantiates the plugin's module, linked to the host functions.
+func (p *plugin) instantiate(ctx context.Context) (api.Module, error) {
+	// Anonymous, so that the plugin can be instantiated again while the last instance closes.
+	return p.engine.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().WithName(""))
+}
+
+// call runs the named filter of the plugin, if exported, on the event, returning its
+// result and the string it set.
+func (p *plugin) call(filter string, ev event) (int32, string, error) {
+	if !p.filters[filter] {
+		return resultAllow, "", nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return resultAllow, "", nil // Unloaded while the filters were running.
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	var err error
+	if p.instance == nil {
+		if p.instance, err = p.instantiate(ctx); err != nil {
+			return 0, "", err
+		}
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return 0, "", err
+	}
+
+	p.result = ""
+	results, err := p.instance.ExportedFunction("alloc").Call(ctx, uint64(len(payload)))
+	if err == nil {
+		ptr := uint32(results[0])
+		if !p.instance.Memory().Write(ptr, payload) {
+			err = fmt.Errorf("alloc returned a buffer out of bounds: %d", ptr)
+		} else {
+			results, err = p.instance.ExportedFunction(filter).Call(ctx, uint64(ptr), uint64(len(payload)))
+		}
+	}
+	if err != nil {
+		// Its state can't be trusted after a trap.
+		_ = p.instance.Close(context.Background())
+		p.instance = nil
+		return 0, "", err
+	}
+	return int32(uint32(results[0])), p.result, nil
+}
+
+// close closes the instance and module of the plugin, once any call running finishes.
+func (p *plugin) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx := context.Background()
+	if p.instance != nil {
+		_ = p.instance.Close(ctx)
+		p.instance = nil
+	}
+	_ = p.compiled.Close(ctx)
+	p.closed = true
+}
+
+// readString returns the string at the address and size in the memory of the module,
+// aborting the call if it is out of bounds.
+func readString(mod api.Module, ptr, size uint32) string {
+	data, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		panic(fmt.Errorf("string out of bounds: %d+%d", ptr, size))
+	}
+	return string(data)
+}
+
+// hasSignature reports whether the function has the parameter and result types.
+func hasSignature(definition api.FunctionDefinition, params, results []api.ValueType) bool {
+	return slices.Equal(definition.ParamTypes(), params) && slices.Equal(definition.ResultTypes(), results)
+}
+
+// userEvent returns an event describing the user.
+func userEvent(user *dircd.User) event {
+	return event{
+		Nick:    user.Nick(),
+		User:    user.Name(),
+		Host:    user.VisibleHost(),
+		Account: user.Account(),
+	}
+}
+
+var _ dircd.Module = (*Engine)(nil)
@@ -0,0 +1,209 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package wasm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/btnmasher/dircd"
+)
+
+// WebAssembly binary encoding, for assembling test plugins.
+const (
+	magic = "\x00asm\x01\x00\x00\x00"
+
+	sectionType     = 1
+	sectionImport   = 2
+	sectionFunction = 3
+	sectionMemory   = 5
+	sectionExport   = 7
+	sectionCode     = 10
+	sectionData     = 11
+
+	typeFunc  = 0x60
+	typeI32   = 0x7f
+	typeEmpty = 0x40
+
+	kindFunc   = 0
+	kindMemory = 2
+
+	opUnreachable = 0x00
+	opLoop        = 0x03
+	opIf          = 0x04
+	opElse        = 0x05
+	opEnd         = 0x0b
+	opBr          = 0x0c
+	opCall        = 0x10
+	opLocalGet    = 0x20
+	opI32Const    = 0x41
+	opI32GtU      = 0x4b
+)
+
+// vec encodes the items as a vector.
+func vec(items ...[]byte) []byte {
+	out := []byte{byte(len(items))}
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+// section encodes a section.
+func section(id byte, contents []byte) []byte {
+	return append([]byte{id, byte(len(contents))}, contents...)
+}
+
+// str encodes a name.
+func str(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// body encodes a function body without locals.
+func body(code ...byte) []byte {
+	fn := append([]byte{0}, code...)
+	return append([]byte{byte(len(fn))}, fn...)
+}
+
+// assemble encodes a module of the sections.
+func assemble(sections ...[]byte) []byte {
+	out := []byte(magic)
+	for _, s := range sections {
+		out = append(out, s...)
+	}
+	return out
+}
+
+// filterPlugin encodes a plugin whose on_message rejects messages over 100 bytes with
+// the reason in its data, and whose on_join traps.
+func filterPlugin() []byte {
+	i32x2 := []byte{typeFunc, 2, typeI32, typeI32}
+	return assemble(
+		section(sectionType, vec(
+			append(append([]byte{}, i32x2...), 0),          // (i32, i32)
+			[]byte{typeFunc, 1, typeI32, 1, typeI32},       // (i32) -> i32
+			append(append([]byte{}, i32x2...), 1, typeI32), // (i32, i32) -> i32
+		)),
+		section(sectionImport, vec(append(append(str("dircd"), str("set_result")...), kindFunc, 0))),
+		section(sectionFunction, vec([]byte{1}, []byte{2}, []byte{2})),
+		section(sectionMemory, vec([]byte{0, 1})),
+		section(sectionExport, vec(
+			append(str("memory"), kindMemory, 0),
+			append(str("alloc"), kindFunc, 1),
+			append(str("on_message"), kindFunc, 2),
+			append(str("on_join"), kindFunc, 3),
+		)),
+		section(sectionCode, vec(
+			body(opI32Const, 0x80, 0x08, opEnd),
+			body(
+				opLocalGet, 1, opI32Const, 0xe4, 0x00, opI32GtU,
+				opIf, typeI32,
+				opI32Const, 0, opI32Const, 8, opCall, 0, opI32Const, resultReject,
+				opElse,
+				opI32Const, resultAllow,
+				opEnd,
+				opEnd),
+			body(opUnreachable, opEnd),
+		)),
+		section(sectionData, vec(append([]byte{0, opI32Const, 0, opEnd}, str("Too long")...))),
+	)
+}
+
+// onMessagePlugin encodes a plugin with memory of the pages, and an on_message of the
+// type with the body.
+func onMessagePlugin(pages byte, filterType []byte, filter []byte) []byte {
+	return assemble(
+		section(sectionType, vec(
+			[]byte{typeFunc, 1, typeI32, 1, typeI32}, // (i32) -> i32
+			filterType,
+		)),
+		section(sectionFunction, vec([]byte{0}, []byte{1})),
+		section(sectionMemory, vec([]byte{0, pages})),
+		section(sectionExport, vec(
+			append(str("memory"), kindMemory, 0),
+			append(str("alloc"), kindFunc, 0),
+			append(str("on_message"), kindFunc, 1),
+		)),
+		section(sectionCode, vec(
+			body(opI32Const, 0x80, 0x08, opEnd),
+			filter,
+		)),
+	)
+}
+
+// newTestEngine returns an engine of the plugins, by name, in a temporary directory.
+func newTestEngine(t *testing.T, plugins map[string][]byte, options ...Option) *Engine {
+	dir := t.TempDir()
+	for name, binary := range plugins {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".wasm"), binary, 0o600))
+	}
+
+	engine := New(dir, options...)
+	engine.logger = dircd.NewLogrusLogger(logrus.New())
+	t.Cleanup(func() { _ = engine.Close() })
+	return engine
+}
+
+func TestPlugin(t *testing.T) {
+	engine := newTestEngine(t, map[string][]byte{"filter": filterPlugin(), "broken": []byte("nope")})
+	assert.NoError(t, engine.load("filter"))
+	assert.Error(t, engine.load("broken"))
+	assert.Error(t, engine.load("../filter"))
+
+	long := make([]byte, 100)
+	assert.NoError(t, engine.filter("on_message", event{Nick: "nick", Text: "short"}, "Message rejected", nil))
+	assert.EqualError(t, engine.filter("on_message", event{Nick: "nick", Text: string(long)}, "Message rejected", nil), "Too long")
+
+	loaded := engine.loaded()[0]
+	_, _, err := loaded.call("on_join", event{Nick: "nick", Channel: "#chan"})
+	assert.ErrorContains(t, err, "unreachable")
+	assert.Nil(t, loaded.instance)
+	assert.NoError(t, engine.filter("on_join", event{Nick: "nick", Channel: "#chan"}, "Join rejected", nil))
+	assert.NoError(t, engine.filter("on_nick", event{Nick: "nick", NewNick: "other"}, "Nick rejected", nil))
+
+	assert.NoError(t, engine.load("filter"), "reloading replaces the plugin")
+	assert.Len(t, engine.loaded(), 1)
+	assert.NoError(t, engine.unload("filter"))
+	assert.Empty(t, engine.loaded())
+
+	// A plugin unloaded while the filters run allows the action.
+	result, _, err := loaded.call("on_message", event{Nick: "nick", Text: string(long)})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(resultAllow), result)
+}
+
+func TestPluginLimits(t *testing.T) {
+	i32x2 := []byte{typeFunc, 2, typeI32, typeI32}
+	filterType := append(append([]byte{}, i32x2...), 1, typeI32)
+	allow := body(opI32Const, resultAllow, opEnd)
+
+	engine := newTestEngine(t, map[string][]byte{
+		"spin":      onMessagePlugin(1, filterType, body(opLoop, typeEmpty, opBr, 0, opEnd, opI32Const, resultAllow, opEnd)),
+		"large":     onMessagePlugin(2, filterType, allow),
+		"signature": onMessagePlugin(1, append(append([]byte{}, i32x2...), 0), body(opEnd)),
+	}, WithTimeout(20*time.Millisecond), WithMemoryLimit(1))
+
+	assert.ErrorContains(t, engine.load("large"), "over limit")
+	assert.ErrorContains(t, engine.load("signature"), "exports on_message with the wrong signature")
+
+	require.NoError(t, engine.load("spin"))
+	loaded := engine.loaded()[0]
+	for i := 0; i < 2; i++ {
+		started := time.Now()
+		_, _, err := loaded.call("on_message", event{Nick: "nick", Text: "hello"})
+		assert.Error(t, err, "the call is aborted once it runs out of time")
+		assert.Less(t, time.Since(started), time.Second)
+		assert.Nil(t, loaded.instance)
+	}
+}
@@ -15,8 +15,10 @@ const (
 	ReplyCreated             uint16 = 003
 	ReplyMyInfo              uint16 = 004
 	ReplyISupport            uint16 = 005
-	ReplyBounce              uint16 = 010
-	ReplyNickForceChanged    uint16 = 043
+	ReplyMap                 uint16 = 15
+	ReplyMapEnd              uint16 = 17
+	ReplyBounce              uint16 = 10
+	ReplyNickForceChanged    uint16 = 43
 	ReplyTraceLink           uint16 = 200
 	ReplyTraceConnecting     uint16 = 201
 	ReplyTraceHandshake      uint16 = 202
@@ -58,6 +60,7 @@ const (
 	ReplyTraceLog            uint16 = 261
 	ReplyEndOfTrace          uint16 = 262
 	ReplyTryAgain            uint16 = 263
+	ReplyWhoisCertFP         uint16 = 276
 	ReplyAway                uint16 = 301
 	ReplyUserHost            uint16 = 302
 	ReplyIsOn                uint16 = 303
@@ -72,12 +75,16 @@ const (
 	ReplyWhoisIdle           uint16 = 317
 	ReplyEndOfWhois          uint16 = 318
 	ReplyWhoisChannels       uint16 = 319
+	ReplyWhoisSpecial        uint16 = 320
 	ReplyListStart           uint16 = 321
 	ReplyList                uint16 = 322
 	ReplyEndOfList           uint16 = 323
 	ReplyChannelModeIs       uint16 = 324
+	ReplyCreationTime        uint16 = 329
+	ReplyWhoisAccount        uint16 = 330
 	ReplyNoTopic             uint16 = 331
 	ReplyChanTopic           uint16 = 332
+	ReplyTopicWhoTime        uint16 = 333
 	ReplyInviting            uint16 = 341
 	ReplyInvited             uint16 = 345
 	ReplyInviteList          uint16 = 346
@@ -87,7 +94,7 @@ const (
 	ReplyVersion             uint16 = 351
 	ReplyWho                 uint16 = 352
 	ReplyNames               uint16 = 353
-	ReplyLinks               uint16 = 384
+	ReplyLinks               uint16 = 364
 	ReplyEndOfLinks          uint16 = 365
 	ReplyEndOfNames          uint16 = 366
 	ReplyBanList             uint16 = 367
@@ -122,6 +129,7 @@ const (
 	ReplyWildTopLevel        uint16 = 414
 	ReplyBadMask             uint16 = 415
 	ReplyTooManyMatches      uint16 = 416
+	ReplyInputTooLong        uint16 = 417
 	ReplyUnknownCommand      uint16 = 421
 	ReplyNoMOTD              uint16 = 422
 	ReplyNoAdminInfo         uint16 = 423
@@ -131,6 +139,7 @@ const (
 	ReplyNicknameInUse       uint16 = 433
 	ReplyNickCollision       uint16 = 436
 	ReplyResourceUnavailable uint16 = 437
+	ReplyServicesDown        uint16 = 440
 	ReplyUserNotInChannel    uint16 = 441
 	ReplyNotOnChannel        uint16 = 442
 	ReplyUserOnChannel       uint16 = 443
@@ -162,11 +171,23 @@ const (
 	ReplyNoServiceHost       uint16 = 492
 	ReplyUnknownUserMode     uint16 = 501
 	ReplyUsersDontMatch      uint16 = 502
+	ReplyHelpNotFound        uint16 = 524
+	ReplyCannotSendToUser    uint16 = 531
+	ReplyStartTLS            uint16 = 670
+	ReplyWhoisSecure         uint16 = 671
+	ReplyStartTLSFail        uint16 = 691
+	ReplyHelpStart           uint16 = 704
+	ReplyHelpText            uint16 = 705
+	ReplyEndOfHelp           uint16 = 706
+	ReplyRSAChallenge2       uint16 = 740
+	ReplyEndOfRSAChallenge2  uint16 = 741
 	ReplyLoggedIn            uint16 = 900
 	ReplyLoggedOut           uint16 = 901
+	ReplyNickLocked          uint16 = 902
 	ReplySASLSuccess         uint16 = 903
 	ReplySASLFail            uint16 = 904
 	ReplySASLTooLong         uint16 = 905
 	ReplySASLAborted         uint16 = 906
 	ReplySASLAlready         uint16 = 907
+	ReplySASLMechs           uint16 = 908
 )
@@ -0,0 +1,345 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+const (
+	// operChallengeSize is the size in bytes of the nonce operators sign with CHALLENGE.
+	operChallengeSize = 32
+
+	// operChallengeTimeout is how long a CHALLENGE nonce may be answered for.
+	operChallengeTimeout = time.Minute
+
+	// minOperRSABits is the smallest RSA key accepted for an oper block.
+	minOperRSABits = 2048
+
+	// operChallengeContext prefixes the message signed in answer to a CHALLENGE, so that
+	// a signature can't be replayed to another server or mistaken for one made for
+	// another purpose with the same key.
+	operChallengeContext = "dircd CHALLENGE"
+)
+
+// operBlock holds the credentials and granted privileges of an operator account, which
+// users may authenticate to with the OPER command, or the CHALLENGE command if it has a
+// public key rather than a password.
+type operBlock struct {
+	name         string
+	passwordHash []byte
+	publicKey    crypto.PublicKey // An *rsa.PublicKey or ed25519.PublicKey.
+	hostmask     string
+	privileges   OperPrivilege
+}
+
+// operChallenge is the nonce sent to a user with CHALLENGE, awaiting their signature.
+type operChallenge struct {
+	block   *operBlock
+	nonce   []byte
+	server  string
+	expires time.Time
+}
+
+// message returns the message an operator signs to answer the challenge: the context
+// string, the name of the server which sent it and the nonce, separated by NUL bytes.
+func (challenge *operChallenge) message() []byte {
+	message := make([]byte, 0, len(operChallengeContext)+len(challenge.server)+len(challenge.nonce)+2)
+	message = append(message, operChallengeContext...)
+	message = append(message, 0)
+	message = append(message, challenge.server...)
+	message = append(message, 0)
+	return append(message, challenge.nonce...)
+}
+
+// operModes maps operator permission levels to the user mode granted with them.
+var operModes = map[uint8]uint64{
+	UPermHelpOp: UModeHelpOp,
+	UPermNetOp:  UModeNetOp,
+	UPermAdmin:  UModeAdmin,
+}
+
+// permission returns the permission level granted by the oper block, which determines the
+// user modes the operator may set: admin for the admin privilege, network operator for any
+// other privilege, and help operator without privileges.
+func (block *operBlock) permission() uint8 {
+	switch {
+	case block.privileges.Has(PrivAdmin):
+		return UPermAdmin
+	case block.privileges != PrivNone:
+		return UPermNetOp
+	default:
+		return UPermHelpOp
+	}
+}
+
+// WithOper adds an operator block, allowing users whose user@host matches the hostmask
+// (which may contain * and ? wildcards) to gain the given privileges with the OPER
+// command. The password may be given as a bcrypt hash, or in plain text.
+func WithOper(name, password, hostmask string, privileges OperPrivilege) ServerOption {
+	return option(func(s *Server) error {
+		hash := []byte(password)
+		if _, err := bcrypt.Cost(hash); err != nil {
+			hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("error hashing password for oper block [%s]: %w", name, err)
+			}
+		}
+
+		return s.addOper(&operBlock{
+			name:         name,
+			passwordHash: hash,
+			hostmask:     hostmask,
+			privileges:   privileges,
+		})
+	})
+}
+
+// WithOperKey adds an operator block authenticated with the CHALLENGE command rather than
+// a password, allowing users whose user@host matches the hostmask to gain the given
+// privileges by signing a nonce sent by the server with the private key of the PEM
+// encoded public key, which must be an Ed25519 key, or an RSA key of at least 2048 bits
+// signing the SHA-256 digest with PKCS #1 v1.5. The signed message is "dircd CHALLENGE",
+// the server hostname and the decoded nonce, each separated by a NUL byte.
+func WithOperKey(name, publicKey, hostmask string, privileges OperPrivilege) ServerOption {
+	return option(func(s *Server) error {
+		key, err := parseOperKey([]byte(publicKey))
+		if err != nil {
+			return fmt.Errorf("invalid public key for oper block [%s]: %w", name, err)
+		}
+
+		return s.addOper(&operBlock{
+			name:       name,
+			publicKey:  key,
+			hostmask:   hostmask,
+			privileges: privileges,
+		})
+	})
+}
+
+// addOper adds the oper block, unless one of the same name exists.
+func (s *Server) addOper(block *operBlock) error {
+	if block.privileges&^PrivAll != 0 {
+		return fmt.Errorf("invalid privileges for oper block [%s]: %#x", block.name, uint16(block.privileges))
+	}
+
+	idx := slices.IndexFunc(s.opers, func(existing *operBlock) bool {
+		return existing.name == block.name
+	})
+	if idx >= 0 {
+		return fmt.Errorf("duplicate oper block: %s", block.name)
+	}
+
+	s.opers = append(s.opers, block)
+	return nil
+}
+
+// parseOperKey parses a PEM encoded PKIX or PKCS #1 public key, accepting only the key
+// types CHALLENGE signatures are verified with.
+func parseOperKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var key crypto.PublicKey
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minOperRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits is shorter than %d bits", key.N.BitLen(), minOperRSABits)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %T", key)
+	}
+}
+
+// verify reports whether the signature is that of the message by the key of the oper block.
+func (block *operBlock) verify(message, signature []byte) bool {
+	switch key := block.publicKey.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
+
+// doOper authenticates the user to the named oper block, granting its privileges.
+func (conn *Conn) doOper(name, password string) {
+	logger := conn.logger.WithField("operation", "oper")
+
+	block := conn.findOper(logger, CmdOper, name)
+	if block == nil {
+		return
+	}
+
+	if block.passwordHash == nil {
+		logger.Warnf("failed OPER attempt as [%s]: oper block requires CHALLENGE", name)
+		conn.ReplyPasswordMismatch()
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword(block.passwordHash, []byte(password)) != nil {
+		logger.Warnf("failed OPER attempt as [%s]: password mismatch", name)
+		conn.ReplyPasswordMismatch()
+		return
+	}
+
+	conn.grantOper(logger, block)
+}
+
+// doChallenge sends the user a nonce to sign with the private key of the named oper
+// block, replacing any challenge they have yet to answer.
+func (conn *Conn) doChallenge(name string) {
+	logger := conn.logger.WithField("operation", "challenge")
+	conn.challenge = nil
+
+	block := conn.findOper(logger, CmdChallenge, name)
+	if block == nil {
+		return
+	}
+
+	if block.publicKey == nil {
+		logger.Warnf("failed CHALLENGE attempt as [%s]: oper block has no public key", name)
+		conn.ReplyNoOperHost()
+		return
+	}
+
+	nonce := make([]byte, operChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		logger.Errorf("error generating CHALLENGE nonce: %s", err)
+		conn.ReplyNoOperHost()
+		return
+	}
+
+	conn.challenge = &operChallenge{
+		block:   block,
+		nonce:   nonce,
+		server:  conn.server.Hostname(),
+		expires: conn.server.clock.Now().Add(operChallengeTimeout),
+	}
+	conn.ReplyNumeric(ReplyRSAChallenge2, base64.StdEncoding.EncodeToString(nonce))
+	conn.ReplyNumeric(ReplyEndOfRSAChallenge2)
+}
+
+// doChallengeResponse authenticates the user to the oper block of the challenge they
+// were sent, if the base64 encoded signature is that of its message.
+func (conn *Conn) doChallengeResponse(response string) {
+	logger := conn.logger.WithField("operation", "challenge")
+	challenge := conn.challenge
+	conn.challenge = nil
+
+	if challenge == nil || !conn.server.clock.Now().Before(challenge.expires) {
+		logger.Warnf("failed CHALLENGE attempt: no challenge awaiting a response")
+		conn.ReplyPasswordMismatch()
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(response)
+	if err != nil || !challenge.block.verify(challenge.message(), signature) {
+		logger.Warnf("failed CHALLENGE attempt as [%s]: signature mismatch", challenge.block.name)
+		conn.ReplyPasswordMismatch()
+		return
+	}
+
+	conn.grantOper(logger, challenge.block)
+}
+
+// findOper returns the named oper block if it allows the user to authenticate to it,
+// otherwise replying that there is none and returning nil.
+func (conn *Conn) findOper(logger Logger, command, name string) *operBlock {
+	userhost := conn.userhost()
+
+	idx := slices.IndexFunc(conn.server.opers, func(block *operBlock) bool {
+		return block.name == name
+	})
+
+	if idx < 0 || !stringutils.MatchMask(conn.server.opers[idx].hostmask, userhost) {
+		logger.Warnf("failed %s attempt as [%s]: no matching oper block for [%s]", command, name, userhost)
+		conn.ReplyNoOperHost()
+		return nil
+	}
+
+	if class := conn.class.Load(); class != nil && !class.AllowOper {
+		logger.Warnf("failed %s attempt as [%s]: connection class [%s] does not allow operators", command, name, class.Name)
+		conn.ReplyNoOperHost()
+		return nil
+	}
+
+	return conn.server.opers[idx]
+}
+
+// grantOper grants the user the privileges of the oper block they authenticated to.
+func (conn *Conn) grantOper(logger Logger, block *operBlock) {
+	conn.user.SetPermission(block.permission())
+	conn.user.SetPrivileges(block.privileges)
+	conn.user.AddMode(operModes[block.permission()])
+	logger.Infof("[%s] is now an operator as [%s] with privileges [%s]", conn.user.Hostmask(), block.name, block.privileges)
+	conn.ReplyYoureOper()
+
+	event := userEvent(EventOperUp, conn.user)
+	event.Target = block.name
+	conn.server.publish(event)
+}
+
+// doKillUser disconnects the user with the given nick on behalf of the operator.
+func (conn *Conn) doKillUser(nick, reason string) {
+	if len(reason) == 0 {
+		reason = conn.user.Nick()
+	}
+
+	if errors.Is(conn.server.KillUser(nick, reason, conn.user.Nick()), ErrNoSuchNick) {
+		conn.ReplyNoSuchNick(nick)
+		return
+	}
+
+	conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdKill, Target: nick, Reason: reason})
+}
+
+// doRehash rehashes the server on behalf of the operator, reporting any errors.
+func (conn *Conn) doRehash() {
+	conn.ReplyRehashing()
+	if err := conn.server.Rehash(); err != nil {
+		conn.ReplyServerNotice(fmt.Sprintf("Rehash failed: %s", err))
+	}
+
+	conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdRehash})
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publicKeyPEM returns the public key PEM encoded in PKIX form.
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestOperChallenge(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithClock(clock),
+		WithOperKey("ed", publicKeyPEM(t, edPublic), "*@*", PrivKill),
+		WithOperKey("rsa", publicKeyPEM(t, &rsaPrivate.PublicKey), "*@*", PrivAdmin),
+		WithOper("pass", "hunter2", "*@*", PrivKill),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	challenge := func(name string) []byte {
+		t.Helper()
+		route("CHALLENGE " + name)
+		require.NotNil(t, conn.challenge)
+		nonce := conn.challenge.nonce
+		expect(" 740 bob :" + base64.StdEncoding.EncodeToString(nonce))
+		expect(" 741 bob :End of CHALLENGE")
+		return append([]byte("dircd CHALLENGE\x00irc.example.net\x00"), nonce...)
+	}
+	respond := func(signature []byte) {
+		route("CHALLENGE +" + base64.StdEncoding.EncodeToString(signature))
+	}
+
+	// Key blocks can't be authenticated to with a password, nor password blocks with a key.
+	route("OPER ed hunter2")
+	expect(" 464 bob ")
+	route("CHALLENGE pass")
+	expect(" 491 bob ")
+	route("CHALLENGE nobody")
+	expect(" 491 bob ")
+
+	// A signature of another message, such as the bare nonce, or one answering an
+	// expired challenge, is refused.
+	message := challenge("ed")
+	respond(ed25519.Sign(edPrivate, append(message, 0)))
+	expect(" 464 bob ")
+	message = challenge("ed")
+	respond(ed25519.Sign(edPrivate, message[len(message)-operChallengeSize:]))
+	expect(" 464 bob ")
+	respond(ed25519.Sign(edPrivate, message))
+	expect(" 464 bob ")
+	message = challenge("ed")
+	clock.Advance(operChallengeTimeout)
+	respond(ed25519.Sign(edPrivate, message))
+	expect(" 464 bob ")
+	assert.False(t, conn.user.IsOper())
+
+	message = challenge("ed")
+	respond(ed25519.Sign(edPrivate, message))
+	expect(" 381 bob ")
+	assert.True(t, conn.user.HasPrivilege(PrivKill))
+
+	message = challenge("rsa")
+	digest := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaPrivate, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	respond(signature)
+	expect(" 381 bob ")
+	assert.True(t, conn.user.HasPrivilege(PrivAdmin))
+}
+
+func TestWithOperKey(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = NewServer(WithOperKey("rsa", publicKeyPEM(t, &small.PublicKey), "*@*", PrivNone))
+	assert.Error(t, err, "RSA keys shorter than 2048 bits are refused")
+
+	_, err = NewServer(WithOperKey("none", "not a key", "*@*", PrivNone))
+	assert.Error(t, err)
+
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = NewServer(
+		WithOper("ed", "hunter2", "*@*", PrivNone),
+		WithOperKey("ed", publicKeyPEM(t, edPublic), "*@*", PrivNone),
+	)
+	assert.Error(t, err, "duplicate oper block")
+}
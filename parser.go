@@ -12,11 +12,17 @@ import "strings"
 // Parse takes IRC-formatted text into a message object.
 // Will return an error if the message doesn't fit the protocol.
 func Parse(line string) (*Message, error) {
-	if len(line) < 4 {
+	return parse(line, MaxTagsLength)
+}
+
+// parse is Parse, accepting tags of up to maxTags in length, which depends on the
+// capabilities negotiated by the client.
+func parse(line string, maxTags int) (*Message, error) {
+	if len(line) < 3 { // The shortest command, eg: MAP.
 		return nil, ErrMessageTooShort
 	}
 
-	if len(line) > MaxTagsLength+MaxMsgLength {
+	if len(line) > maxTags+MaxMsgLength {
 		return nil, ErrMessageTooLong
 	}
 
@@ -25,20 +31,33 @@ func Parse(line string) (*Message, error) {
 		return nil, ErrWhitespace
 	}
 
+	// Lines are split on CRLF before parsing, so any left would be injected into the
+	// parameters, and NUL is never valid.
+	if strings.ContainsAny(line, "\x00\r\n") {
+		return nil, ErrControlChars
+	}
+
 	if line[0] == ':' { // Clients shouldn't be sending prefixed messages, so we're going to just error
 		return nil, ErrPrefixed
 	}
 
 	msg := msgPool.New()
+	generation := msg.Generation()
 
 	if line[0] == '@' {
 		parts := strings.SplitN(line[1:], SPACE, 2)
 		if len(parts) < 2 {
+			msgPool.Recycle(msg, generation)
 			return nil, ErrInvalidMessage
 		}
 		rawTags := parts[0]
 		line = parts[1] // the remainder of the message for later processing
 
+		if len(rawTags)+len("@ ") > maxTags {
+			msgPool.Recycle(msg, generation)
+			return nil, ErrMessageTooLong
+		}
+
 		// Parse tags
 		tags := strings.Split(rawTags, SEMICOLON)
 		msg.Tags = make(map[string]string)
@@ -52,34 +71,44 @@ func Parse(line string) (*Message, error) {
 		}
 	}
 
-	if len(line) > MaxMsgLength {
-		msgPool.Recycle(msg)
+	if len(line) > MaxMsgLength-len(CRLF) {
+		msgPool.Recycle(msg, generation)
 		return nil, ErrMessageTooLong
 	}
 
 	if line[0] == ':' { // Clients shouldn't be sending prefixed messages, so we're going to just error
-		msgPool.Recycle(msg)
+		msgPool.Recycle(msg, generation)
 		return nil, ErrPrefixed
 	}
 
-	split := strings.SplitN(line, COLON, 2)
-	args := strings.Fields(split[0])
+	// The trailing parameter starts at the first " :", middle parameters may contain colons.
+	middle, trailing, hasTrailing := strings.Cut(line, SPACE+COLON)
+	args := strings.Fields(middle)
+	if len(args) == 0 {
+		msgPool.Recycle(msg, generation)
+		return nil, ErrInvalidMessage
+	}
 
 	msg.Command = strings.ToUpper(args[0])
 
-	if len(split) > 1 {
-		msg.Trailing = split[1]
-	}
-
 	if len(args) > 1 {
 		msg.Params = args[1:]
-		msg.Trailing = args[len(args)-1]
 
 		if len(msg.Params) > MaxMsgParams {
-			msgPool.Recycle(msg)
+			msgPool.Recycle(msg, generation)
 			return nil, ErrTooManyParams
 		}
 	}
 
+	if hasTrailing {
+		msg.Trailing = trailing
+	} else if len(msg.Params) > 0 {
+		// Without an explicit trailing parameter, the last middle parameter doubles
+		// as the trailing one, so handlers may read single-argument commands such
+		// as "PONG token" from either.
+		msg.Trailing = msg.Params[len(msg.Params)-1]
+		msg.trailingImplied = true
+	}
+
 	return msg, nil
 }
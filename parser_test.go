@@ -38,7 +38,7 @@ func TestParser(t *testing.T) {
 		},
 		{
 			name:     "too small",
-			input:    "abc",
+			input:    "ab",
 			expected: ErrMessageTooShort,
 		},
 		{
@@ -46,6 +46,16 @@ func TestParser(t *testing.T) {
 			input:    fmt.Sprint(strings.Repeat("a", MaxMsgLength), "\r\n"),
 			expected: ErrMessageTooLong,
 		},
+		{
+			name:     "embedded carriage return",
+			input:    "PRIVMSG #chan :hello\rQUIT :injected\r\n",
+			expected: ErrControlChars,
+		},
+		{
+			name:     "embedded NUL",
+			input:    "PRIVMSG #chan :hello\x00there\r\n",
+			expected: ErrControlChars,
+		},
 		{
 			name:     "all whitespace",
 			input:    "   \r\n",
@@ -60,3 +70,66 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func TestParserParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		command  string
+		params   []string
+		trailing string
+	}{
+		{
+			name:     "trailing with spaces",
+			input:    "PRIVMSG #chan :hello there\r\n",
+			command:  CmdPrivMsg,
+			params:   []string{"#chan"},
+			trailing: "hello there",
+		},
+		{
+			name:     "trailing containing colon",
+			input:    "PRIVMSG #chan :look: a colon :)\r\n",
+			command:  CmdPrivMsg,
+			params:   []string{"#chan"},
+			trailing: "look: a colon :)",
+		},
+		{
+			name:     "trailing only",
+			input:    "PING :token\r\n",
+			command:  CmdPing,
+			params:   nil,
+			trailing: "token",
+		},
+		{
+			name:     "no trailing uses last param",
+			input:    "cap req sasl\r\n",
+			command:  CmdCap,
+			params:   []string{"req", "sasl"},
+			trailing: "sasl",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Parse(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.command, msg.Command)
+			assert.Equal(t, tt.params, msg.Params)
+			assert.Equal(t, tt.trailing, msg.Trailing)
+		})
+	}
+}
+
+func TestParserTagsLength(t *testing.T) {
+	tags := "@+example=" + strings.Repeat("a", MaxTagsLength) + " "
+
+	_, err := Parse(tags + "PRIVMSG #chan :hello\r\n")
+	assert.Equal(t, ErrMessageTooLong, err)
+
+	msg, err := parse(tags+"PRIVMSG #chan :hello\r\n", MaxMessageTagsLength)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", MaxTagsLength), msg.Tags["+example"])
+
+	_, err = parse("@+example=value PRIVMSG #chan :"+strings.Repeat("a", MaxMsgLength)+"\r\n", MaxMessageTagsLength)
+	assert.Equal(t, ErrMessageTooLong, err)
+}
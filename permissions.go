@@ -7,7 +7,14 @@
 
 package dircd
 
-// User permission levels on the server.
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// User permission levels on the server. These only gate the user modes a user may set and
+// have set on them; the commands available to operators are gated by OperPrivilege.
 const (
 	UPermBan uint8 = iota
 	UPermNone
@@ -17,3 +24,68 @@ const (
 	UPermAdmin
 	UPermServer
 )
+
+// OperPrivilege is a set of flags granting operators the capabilities of their oper block.
+type OperPrivilege uint16
+
+// Operator privileges
+const (
+	PrivKill    OperPrivilege = 1 << iota // Disconnect users from the server.
+	PrivKLine                             // Add and remove K-lines.
+	PrivRehash                            // Reload the server configuration.
+	PrivDie                               // Shut down or restart the server.
+	PrivSpy                               // View connection details and server statistics.
+	PrivRouting                           // Link and unlink servers.
+	PrivAdmin                             // Server administration, such as lockdowns and global notices.
+
+	PrivNone OperPrivilege = 0
+	PrivAll                = PrivKill | PrivKLine | PrivRehash | PrivDie | PrivSpy | PrivRouting | PrivAdmin
+)
+
+// privilegeNames maps the names of privileges in configuration to their flags.
+var privilegeNames = map[string]OperPrivilege{
+	"kill":    PrivKill,
+	"kline":   PrivKLine,
+	"rehash":  PrivRehash,
+	"die":     PrivDie,
+	"spy":     PrivSpy,
+	"routing": PrivRouting,
+	"admin":   PrivAdmin,
+}
+
+// ParsePrivileges returns the set of privileges with the given names, or all privileges for "*".
+func ParsePrivileges(names ...string) (OperPrivilege, error) {
+	var privileges OperPrivilege
+	for _, name := range names {
+		if name == "*" {
+			privileges |= PrivAll
+			continue
+		}
+		priv, exists := privilegeNames[strings.ToLower(name)]
+		if !exists {
+			return PrivNone, fmt.Errorf("unknown operator privilege: %s", name)
+		}
+		privileges |= priv
+	}
+	return privileges, nil
+}
+
+// Has checks if all of the given privileges are in the set.
+func (privileges OperPrivilege) Has(priv OperPrivilege) bool {
+	return privileges&priv == priv
+}
+
+// String returns the names of the privileges in the set.
+func (privileges OperPrivilege) String() string {
+	names := make([]string, 0, len(privilegeNames))
+	for name, priv := range privilegeNames {
+		if privileges.Has(priv) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrivileges(t *testing.T) {
+	tests := []struct {
+		name       string
+		names      []string
+		privileges OperPrivilege
+		text       string
+		err        bool
+	}{
+		{name: "none", privileges: PrivNone, text: "none"},
+		{name: "single", names: []string{"kline"}, privileges: PrivKLine, text: "kline"},
+		{name: "multiple", names: []string{"KILL", "spy", "kill"}, privileges: PrivKill | PrivSpy, text: "kill,spy"},
+		{name: "all", names: []string{"*"}, privileges: PrivAll, text: "admin,die,kill,kline,rehash,routing,spy"},
+		{name: "unknown", names: []string{"kline", "god"}, err: true, text: "none"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			privileges, err := ParsePrivileges(test.names...)
+			assert.Equal(t, test.err, err != nil)
+			assert.Equal(t, test.privileges, privileges)
+			assert.Equal(t, test.text, privileges.String())
+		})
+	}
+}
+
+func TestHasPrivilege(t *testing.T) {
+	user := &User{perm: UPermNetOp, privileges: PrivKill | PrivKLine}
+	assert.True(t, user.HasPrivilege(PrivKLine))
+	assert.True(t, user.HasPrivilege(PrivKill|PrivKLine))
+	assert.False(t, user.HasPrivilege(PrivKLine|PrivAdmin))
+
+	user.SetPermission(UPermUser)
+	assert.False(t, user.HasPrivilege(PrivKLine))
+}
+
+func TestPrivilegedCommands(t *testing.T) {
+	rehashed := 0
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithOper("killer", "hunter2", "*@*", PrivKill),
+		WithOper("rehasher", "hunter2", "*@*", PrivRehash),
+		WithRehashHook(func() error {
+			rehashed++
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	expectAlice(" 001 alice ")
+
+	// KILL and REHASH each require their own privilege.
+	route("OPER rehasher hunter2")
+	expect(" 381 bob ")
+	route("KILL alice")
+	expect(" 481 bob ")
+	route("REHASH")
+	expect(" 382 bob irc.example.net :Rehashing")
+	assert.Equal(t, 1, rehashed)
+
+	route("OPER killer hunter2")
+	expect(" 381 bob ")
+	route("REHASH")
+	expect(" 481 bob ")
+	assert.Equal(t, 1, rehashed)
+	route("KILL nobody")
+	expect(" 401 bob nobody ")
+	route("KILL alice :Spamming")
+	expectAlice("ERROR :Closing link: irc.example.net [Killed: [bob [Spamming]]]")
+}
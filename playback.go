@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// playbackTarget is the pseudo-user clients negotiating znc.in/playback send their
+	// playback requests to.
+	playbackTarget = "*playback"
+
+	// playbackSource is the source of the replies to playback requests.
+	playbackSource = "*playback!znc@znc.in"
+)
+
+// doPlayback processes a request of a client negotiating znc.in/playback, sent to
+// *playback, for the history kept for the always-on user:
+//
+//	PLAY <target|*> <from> [to]  Replays the lines for the target after from and up to to,
+//	                             given as Unix timestamps, tagged with the time they were sent.
+//	CLEAR [target|*]             Forgets the lines for the target.
+//
+// The lines of a target are the messages and events of a channel, or of a private
+// conversation with a nick, only messages being replayed unless the client negotiated
+// draft/event-playback.
+func (conn *Conn) doPlayback(text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		conn.playbackNotice("Expected PLAY or CLEAR")
+		return
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAY":
+		if len(fields) < 3 {
+			conn.playbackNotice("Usage: PLAY <target|*> <from> [to]")
+			return
+		}
+
+		from, fromErr := parsePlaybackTime(fields[2])
+		to := time.Now()
+		var toErr error
+		if len(fields) > 3 {
+			to, toErr = parsePlaybackTime(fields[3])
+		}
+		if fromErr != nil || toErr != nil {
+			conn.playbackNotice("Timestamps must be Unix times, eg: 1700000000.5")
+			return
+		}
+
+		events := conn.HasCap(EventPlayback)
+		for _, entry := range conn.user.keptHistory() {
+			if !entry.at.After(from) || entry.at.After(to) {
+				continue
+			}
+			command, lineTarget := conn.historyTarget(entry.line)
+			if !conn.playbackMatches(fields[1], lineTarget) {
+				continue
+			}
+			if !events && command != CmdPrivMsg && command != CmdNotice {
+				continue
+			}
+			conn.Write(timeTagged(entry))
+		}
+
+	case "CLEAR":
+		target := "*"
+		if len(fields) > 1 {
+			target = fields[1]
+		}
+		conn.user.forgetHistory(func(entry historyLine) bool {
+			_, lineTarget := conn.historyTarget(entry.line)
+			return conn.playbackMatches(target, lineTarget)
+		})
+
+	default:
+		conn.playbackNotice("Unknown playback command, expected PLAY or CLEAR")
+	}
+}
+
+// playbackNotice replies to a playback request with a notice from *playback.
+func (conn *Conn) playbackNotice(text string) {
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = playbackSource
+	msg.Command = CmdNotice
+	msg.Params = []string{conn.replyNick()}
+	msg.Trailing = text
+	conn.WriteMessage(msg)
+}
+
+// playbackMatches reports whether the target of a line matches the target of a playback
+// request, which is either * for all, or a comma separated list of targets.
+func (conn *Conn) playbackMatches(requested, target string) bool {
+	if requested == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(requested, ",") {
+		if conn.server.Casefold(candidate) == conn.server.Casefold(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyTarget returns the command of the rendered line and the target of the history
+// it belongs to: the channel it was sent to, or the nick of its source otherwise.
+func (conn *Conn) historyTarget(line []byte) (command, target string) {
+	text := strings.TrimRight(string(line), CRLF)
+	if strings.HasPrefix(text, "@") {
+		_, text, _ = strings.Cut(text, SPACE)
+	}
+
+	var source string
+	if strings.HasPrefix(text, COLON) {
+		source, text, _ = strings.Cut(text[1:], SPACE)
+	}
+	command, text, _ = strings.Cut(text, SPACE)
+
+	param, _, _ := strings.Cut(text, SPACE)
+	param = strings.TrimPrefix(param, COLON)
+	if isChannelName(param) {
+		return command, param
+	}
+	nick, _, _ := strings.Cut(source, "!")
+	return command, nick
+}
+
+// timeTagged returns the line in a buffer with the time it was sent added to its tags.
+func timeTagged(entry historyLine) *bytes.Buffer {
+	buffer := bufPool.New()
+	buffer.WriteString("@time=")
+	buffer.WriteString(entry.at.UTC().Format(serverTimeFormat))
+	if bytes.HasPrefix(entry.line, []byte("@")) {
+		buffer.WriteString(SEMICOLON)
+		buffer.Write(entry.line[1:])
+	} else {
+		buffer.WriteString(SPACE)
+		buffer.Write(entry.line)
+	}
+	return buffer
+}
+
+// parsePlaybackTime parses a Unix timestamp with an optional fraction of a second.
+func parsePlaybackTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", value)
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+}
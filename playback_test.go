@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlayback(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithAlwaysOn(time.Hour, 10))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	first, routeFirst, expectFirst := connectClient(t, srv, "bob")
+	routeFirst("NICK bob")
+	routeFirst("USER bob 0 * :Bob")
+	expectFirst(" 001 bob ")
+	routeFirst("JOIN #dircd")
+	expectFirst(" JOIN #dircd")
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	expectAlice(" 001 alice ")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 366 alice #dircd ")
+
+	first.doQuit("gone")
+	routeAlice("PRIVMSG bob :private")
+	routeAlice("PRIVMSG #dircd :public")
+
+	_, routeSecond, expectSecond := connectClient(t, srv, "bob")
+	routeSecond("CAP REQ :znc.in/playback")
+	routeSecond("NICK bob")
+	routeSecond("USER bob 0 * :Bob")
+	routeSecond("CAP END")
+	expectSecond(" 001 bob ")
+
+	routeSecond("PRIVMSG *playback :PLAY alice 0")
+	expectSecond(":alice!alice@ PRIVMSG bob :private")
+	routeSecond("PRIVMSG *playback :PLAY #dircd 0")
+	expectSecond(":alice!alice@ PRIVMSG #dircd :public")
+
+	routeSecond("PRIVMSG *playback :CLEAR")
+	user, _ := srv.Nicks.Get("bob")
+	assert.Empty(t, user.keptHistory())
+
+	routeSecond("PRIVMSG *playback :PLAY")
+	expectSecond(":*playback!znc@znc.in NOTICE bob :Usage:")
+}
+
+func TestHistoryTarget(t *testing.T) {
+	srv, err := NewServer()
+	require.NoError(t, err)
+	conn := &Conn{server: srv}
+
+	tests := []struct {
+		line    string
+		command string
+		target  string
+	}{
+		{line: ":alice!a@host PRIVMSG bob :hi\r\n", command: CmdPrivMsg, target: "alice"},
+		{line: ":alice!a@host PRIVMSG #dircd :hi\r\n", command: CmdPrivMsg, target: "#dircd"},
+		{line: "@account=alice :alice!a@host JOIN :#dircd\r\n", command: CmdJoin, target: "#dircd"},
+	}
+	for _, test := range tests {
+		command, target := conn.historyTarget([]byte(test.line))
+		assert.Equal(t, test.command, command, test.line)
+		assert.Equal(t, test.target, target, test.line)
+	}
+}
+
+func TestTimeTagged(t *testing.T) {
+	at := time.Date(2023, 1, 2, 3, 4, 5, 600_000_000, time.UTC)
+	assert.Equal(t, "@time=2023-01-02T03:04:05.600Z :a PRIVMSG b :c\r\n",
+		timeTagged(historyLine{at: at, line: []byte(":a PRIVMSG b :c\r\n")}).String())
+	assert.Equal(t, "@time=2023-01-02T03:04:05.600Z;account=a :a PRIVMSG b :c\r\n",
+		timeTagged(historyLine{at: at, line: []byte("@account=a :a PRIVMSG b :c\r\n")}).String())
+
+	parsed, err := parsePlaybackTime("1672628645.5")
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1672628645, 500_000_000), parsed)
+	_, err = parsePlaybackTime("yesterday")
+	assert.Error(t, err)
+}
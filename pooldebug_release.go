@@ -0,0 +1,13 @@
+//go:build !dircd_debug
+
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+// poolDebug panics on misuse of the message pool, see messagePool.
+const poolDebug = false
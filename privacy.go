@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"strings"
+)
+
+// redacted replaces the content of messages omitted from logs.
+const redacted = "<redacted>"
+
+// redactedParams holds the commands whose content is redacted from logs by the privacy
+// logging policy, and how many leading parameters of each are kept.
+var redactedParams = map[string]int{
+	CmdPrivMsg: 1, // The target is kept.
+	CmdNotice:  1,
+	CmdAuth:    0,
+	CmdPass:    0,
+	CmdOper:    1, // The oper block name is kept.
+}
+
+// WithPrivacyLogging sets the server to redact the content of private messages, notices,
+// and credentials from its logs, and to log the lines sent and received on connections at
+// the trace level rather than debug, so that user content is not retained by deployments
+// logging at debug.
+func WithPrivacyLogging() ServerOption {
+	return option(func(s *Server) error {
+		s.privacyLogging = true
+		return nil
+	})
+}
+
+// logWire logs a line sent or received on the connection, redacted by the logging policy
+// of the server.
+func (conn *Conn) logWire(logger Logger, direction, line string) {
+	if !conn.server.privacyLogging {
+		logger.Debugf("%s: [%s]", direction, line)
+		return
+	}
+	if logger.Enabled(LevelTrace) {
+		logger.Tracef("%s: [%s]", direction, redactLine(line))
+	}
+}
+
+// logText returns the user supplied text to log, which is redacted by the privacy logging
+// policy of the server.
+func (srv *Server) logText(text string) string {
+	if srv.privacyLogging {
+		return redacted
+	}
+	return text
+}
+
+// redactLine returns the raw line with the content of the commands in redactedParams
+// replaced, keeping its tags, source, command, and leading parameters.
+func redactLine(line string) string {
+	rest := line
+	for len(rest) > 0 && (rest[0] == '@' || rest[0] == ':') {
+		idx := strings.IndexByte(rest, ' ')
+		if idx < 0 {
+			return line
+		}
+		rest = strings.TrimLeft(rest[idx+1:], " ")
+	}
+
+	command, params, _ := strings.Cut(rest, " ")
+	keep, ok := redactedParams[strings.ToUpper(command)]
+	if !ok || len(params) == 0 {
+		return line
+	}
+
+	prefix := line[:len(line)-len(params)]
+	for ; keep > 0; keep-- {
+		params = strings.TrimLeft(params, " ")
+		if len(params) == 0 || params[0] == ':' {
+			break
+		}
+		param, remainder, found := strings.Cut(params, " ")
+		if !found {
+			return line
+		}
+		prefix += param + " "
+		params = remainder
+	}
+	return prefix + redacted
+}
@@ -0,0 +1,46 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{line: "PRIVMSG #chan :hello there", expected: "PRIVMSG #chan <redacted>"},
+		{line: "@time=now :nick!user@host PRIVMSG bob :secret", expected: "@time=now :nick!user@host PRIVMSG bob <redacted>"},
+		{line: "notice bob word", expected: "notice bob <redacted>"},
+		{line: "PRIVMSG :no target", expected: "PRIVMSG <redacted>"},
+		{line: "PRIVMSG #chan", expected: "PRIVMSG #chan"},
+		{line: "AUTHENTICATE dXNlcgB1c2VyAHBhc3M=", expected: "AUTHENTICATE <redacted>"},
+		{line: "PASS hunter2", expected: "PASS <redacted>"},
+		{line: "OPER admin hunter2", expected: "OPER admin <redacted>"},
+		{line: "JOIN #chan", expected: "JOIN #chan"},
+		{line: ":server.example", expected: ":server.example"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, redactLine(test.line), test.line)
+	}
+}
+
+func TestPrivacyLogging(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+	assert.Equal(t, "text", srv.logText("text"))
+
+	srv, err = NewServer(WithPrivacyLogging())
+	assert.NoError(t, err)
+	assert.Equal(t, redacted, srv.logText("text"))
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout sets how long a client has to send the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1MaxLength is the maximum length of a PROXY protocol v1 header, including CRLF.
+const proxyV1MaxLength = 107
+
+// proxyV2Signature is the fixed 12 byte preamble of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps a net.Listener, handing out connections which
+// strip the PROXY protocol header sent by a load balancer.
+type proxyListener struct {
+	net.Listener
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a net.Conn which lazily reads the PROXY protocol header on the first
+// call to Read or RemoteAddr, and reports the client address carried in the header.
+type proxyConn struct {
+	net.Conn
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	headerErr  error
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		_ = pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pc.remoteAddr, pc.localAddr, pc.headerErr = readProxyHeader(pc.reader)
+		_ = pc.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.readHeader()
+	if pc.headerErr != nil {
+		return 0, pc.headerErr
+	}
+	return pc.reader.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.readHeader()
+	if pc.localAddr != nil {
+		return pc.localAddr
+	}
+	return pc.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from the reader, returning the
+// source and destination addresses it describes. Both addresses are nil if the header
+// does not carry address information (v1 UNKNOWN or v2 LOCAL).
+func readProxyHeader(reader *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	preamble, err := reader.Peek(len(proxyV2Signature))
+	if err != nil && len(preamble) < 6 {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	switch {
+	case bytes.HasPrefix(preamble, []byte("PROXY ")):
+		return readProxyHeaderV1(reader)
+	case bytes.Equal(preamble, proxyV2Signature):
+		return readProxyHeaderV2(reader)
+	default:
+		return nil, nil, fmt.Errorf("%w: unrecognized preamble", ErrProxyHeader)
+	}
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte(CRLF)) {
+		return nil, nil, fmt.Errorf("%w: v1 header not terminated by CRLF", ErrProxyHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: malformed v1 header", ErrProxyHeader)
+	}
+
+	src, srcErr := parseProxyAddr(fields[2], fields[4])
+	dst, dstErr := parseProxyAddr(fields[3], fields[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("%w: malformed v1 address", ErrProxyHeader)
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", host)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	if header[12]>>4 != 0x2 {
+		return nil, nil, fmt.Errorf("%w: unsupported v2 version", ErrProxyHeader)
+	}
+
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	// LOCAL command, the connection was established by the proxy itself (eg: health checks)
+	if command == 0x0 {
+		return nil, nil, nil
+	}
+
+	if command != 0x1 {
+		return nil, nil, fmt.Errorf("%w: unsupported v2 command", ErrProxyHeader)
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLength = net.IPv6len
+	default: // UDP and UNIX families carry no usable TCP address
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLength*2+4 {
+		return nil, nil, fmt.Errorf("%w: v2 address block too short", ErrProxyHeader)
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLength*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLength : ipLength*2]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLength*2+2:])),
+	}
+
+	return src, dst, nil
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v2IPv4 := append([]byte{}, proxyV2Signature...)
+	v2IPv4 = append(v2IPv4, 0x21, 0x11, 0x00, 0x0c)
+	v2IPv4 = append(v2IPv4, 192, 0, 2, 1, 198, 51, 100, 1, 0xc3, 0x50, 0x1a, 0x0b)
+
+	v2Local := append([]byte{}, proxyV2Signature...)
+	v2Local = append(v2Local, 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name      string
+		input     []byte
+		remote    string
+		remaining string
+		err       bool
+	}{
+		{
+			name:      "v1 tcp4",
+			input:     []byte("PROXY TCP4 192.0.2.1 198.51.100.1 50000 6667\r\nNICK test\r\n"),
+			remote:    "192.0.2.1:50000",
+			remaining: "NICK test\r\n",
+		},
+		{
+			name:      "v1 tcp6",
+			input:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 50000 6667\r\nNICK test\r\n"),
+			remote:    "[2001:db8::1]:50000",
+			remaining: "NICK test\r\n",
+		},
+		{
+			name:      "v1 unknown",
+			input:     []byte("PROXY UNKNOWN\r\nNICK test\r\n"),
+			remaining: "NICK test\r\n",
+		},
+		{
+			name:      "v2 tcp4",
+			input:     append(v2IPv4, []byte("NICK test\r\n")...),
+			remote:    "192.0.2.1:50000",
+			remaining: "NICK test\r\n",
+		},
+		{
+			name:      "v2 local",
+			input:     append(v2Local, []byte("NICK test\r\n")...),
+			remaining: "NICK test\r\n",
+		},
+		{
+			name:  "missing header",
+			input: []byte("NICK test\r\n"),
+			err:   true,
+		},
+		{
+			name:  "malformed v1",
+			input: []byte("PROXY TCP4 192.0.2.1\r\n"),
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(tt.input))
+			src, _, err := readProxyHeader(reader)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrProxyHeader)
+				return
+			}
+
+			assert.NoError(t, err)
+			if tt.remote == "" {
+				assert.Nil(t, src)
+			} else {
+				assert.Equal(t, tt.remote, src.String())
+			}
+
+			rest, _ := reader.ReadString('\n')
+			assert.Equal(t, tt.remaining, rest)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// batchNetsplit is the type of the batches QUITs are sent in, see
+	// https://ircv3.net/specs/batches/netsplit
+	batchNetsplit = "netsplit"
+
+	// maxQuitHoldPeriods is how many quiet periods a batch of QUITs is held at most, so
+	// that a steady stream of users quitting doesn't hold it indefinitely.
+	maxQuitHoldPeriods = 10
+)
+
+// WithQuitBatching holds the QUITs of users once the threshold of users quit within the
+// quiet period, eg: when a listener fails or a KLINE disconnects many users at once, and
+// sends them together once no user has quit for the quiet period, in a netsplit BATCH to
+// clients with the batch capability, rather than as they happen.
+func WithQuitBatching(threshold int, quiet time.Duration) ServerOption {
+	return option(func(s *Server) error {
+		if threshold < 2 {
+			return errors.New("quit batching threshold must be at least 2")
+		}
+		if quiet <= 0 {
+			return errors.New("quit batching quiet period must be positive")
+		}
+		s.quitThreshold = threshold
+		s.quitQuiet = quiet
+		return nil
+	})
+}
+
+// heldQuit is a QUIT held to be sent in a batch.
+type heldQuit struct {
+	line       []byte // The QUIT, rendered.
+	recipients []*User
+}
+
+// quitBatcher holds the QUITs of users while many quit at once, see WithQuitBatching.
+type quitBatcher struct {
+	srv *Server
+
+	mu     sync.Mutex
+	recent []time.Time // When users quit in the last quiet period.
+	held   []heldQuit
+	nicks  map[string]struct{} // The folded nicks of the held QUITs.
+	timer  Timer
+	opened time.Time // When the first of the held QUITs was held.
+	seq    uint64    // Numbers the references of the batches.
+}
+
+// newQuitBatcher returns a batcher of the QUITs of the users of the server.
+func newQuitBatcher(srv *Server) *quitBatcher {
+	return &quitBatcher{srv: srv, nicks: make(map[string]struct{})}
+}
+
+// sendQuit sends the QUIT of the user to the users sharing a channel with them, or holds
+// it to be sent in a batch while many users are quitting.
+func (srv *Server) sendQuit(user *User, msg *Message) {
+	if !srv.quits.hold(user, msg) {
+		srv.sendToAudience(user, msg)
+	}
+}
+
+// hold holds the QUIT of the user, reporting whether it was held rather than left to be
+// sent now, as when fewer than the threshold of users quit within the quiet period.
+func (batcher *quitBatcher) hold(user *User, msg *Message) bool {
+	srv := batcher.srv
+	if srv.quitThreshold == 0 {
+		return false
+	}
+
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+
+	now := srv.clock.Now()
+	since := now.Add(-srv.quitQuiet)
+	kept := batcher.recent[:0]
+	for _, at := range batcher.recent {
+		if at.After(since) {
+			kept = append(kept, at)
+		}
+	}
+	batcher.recent = append(kept, now)
+	if len(batcher.recent) < srv.quitThreshold && len(batcher.held) == 0 {
+		return false
+	}
+
+	var recipients []*User
+	for _, member := range user.Audience() {
+		if member.conn != nil {
+			recipients = append(recipients, member)
+		}
+	}
+	buffer := msg.RenderBuffer()
+	batcher.held = append(batcher.held, heldQuit{
+		line:       bytes.Clone(buffer.Bytes()),
+		recipients: recipients,
+	})
+	bufPool.Recycle(buffer)
+	batcher.nicks[srv.Casefold(user.Nick())] = struct{}{}
+
+	switch {
+	case batcher.timer == nil:
+		batcher.opened = now
+		batcher.timer = srv.clock.NewTimer(srv.quitQuiet)
+		go batcher.await(batcher.timer)
+	case now.Before(batcher.opened.Add(maxQuitHoldPeriods * srv.quitQuiet)):
+		batcher.timer.Reset(srv.quitQuiet)
+	}
+	return true
+}
+
+// await flushes the held QUITs once the timer fires.
+func (batcher *quitBatcher) await(timer Timer) {
+	<-timer.C()
+	batcher.flush()
+}
+
+// release sends the held QUITs now if one is of the nick, so that the users sharing a
+// channel with whoever takes the nick next see it quit before they see it again.
+func (batcher *quitBatcher) release(nick string) {
+	batcher.mu.Lock()
+	_, held := batcher.nicks[batcher.srv.Casefold(nick)]
+	batcher.mu.Unlock()
+	if held {
+		batcher.flush()
+	}
+}
+
+// flush sends the held QUITs to their recipients, in a batch to the sessions with the
+// batch capability which are sent more than one.
+func (batcher *quitBatcher) flush() {
+	batcher.mu.Lock()
+	held := batcher.held
+	batcher.held = nil
+	clear(batcher.nicks)
+	if batcher.timer != nil {
+		batcher.timer.Stop()
+		batcher.timer = nil
+	}
+	batcher.seq++
+	ref := "q" + strconv.FormatUint(batcher.seq, 36)
+	batcher.mu.Unlock()
+
+	if len(held) == 0 {
+		return
+	}
+
+	// Each recipient is sent the QUITs of those they shared a channel with, in the order
+	// they quit.
+	var order []*User
+	quits := make(map[*User][]int)
+	for i := range held {
+		for _, recipient := range held[i].recipients {
+			if _, seen := quits[recipient]; !seen {
+				order = append(order, recipient)
+			}
+			quits[recipient] = append(quits[recipient], i)
+		}
+	}
+
+	for _, recipient := range order {
+		indexes := quits[recipient]
+		for _, session := range recipient.Sessions() {
+			if len(indexes) > 1 && session.HasCap(Batch) {
+				batcher.sendBatch(session, ref, held, indexes)
+				continue
+			}
+			for _, i := range indexes {
+				buffer := bufPool.New()
+				buffer.Write(held[i].line)
+				session.Write(buffer)
+			}
+		}
+	}
+}
+
+// sendBatch sends the QUITs at the indexes to the session in a netsplit batch with the
+// reference.
+func (batcher *quitBatcher) sendBatch(session *Conn, ref string, held []heldQuit, indexes []int) {
+	srv := batcher.srv
+
+	start := session.newMessage()
+	startGeneration := start.Generation()
+	start.Command = CmdBatch
+	start.Params = []string{"+" + ref, batchNetsplit, srv.Hostname(), srv.Network()}
+	session.Write(start.RenderBuffer())
+	msgPool.Recycle(start, startGeneration)
+
+	for _, i := range indexes {
+		buffer := bufPool.New()
+		if line, tagged := bytes.CutPrefix(held[i].line, []byte(AT)); tagged {
+			buffer.WriteString(AT + "batch=" + ref + SEMICOLON)
+			buffer.Write(line)
+		} else {
+			buffer.WriteString(AT + "batch=" + ref + SPACE)
+			buffer.Write(held[i].line)
+		}
+		session.Write(buffer)
+	}
+
+	end := session.newMessage()
+	endGeneration := end.Generation()
+	end.Command = CmdBatch
+	end.Params = []string{"-" + ref}
+	session.Write(end.RenderBuffer())
+	msgPool.Recycle(end, endGeneration)
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuitBatching(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(WithHostname("irc.example.net"), WithClock(clock), WithQuitBatching(2, time.Second))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	alice, routeAlice, expectAlice := connectClient(t, srv, "")
+	alice.EnableCap(Batch)
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 366 alice ")
+
+	_, routeCarol, expectCarol := connectClient(t, srv, "")
+	routeCarol("NICK carol")
+	routeCarol("USER carol 0 * :Carol")
+	routeCarol("JOIN #dircd")
+	expectCarol(" 366 carol ")
+
+	routes := make([]func(string), 3)
+	for i := range routes {
+		var expect func(string)
+		_, routes[i], expect = connectClient(t, srv, "")
+		routes[i](fmt.Sprintf("NICK user%d", i))
+		routes[i](fmt.Sprintf("USER user%d 0 * :User", i))
+		routes[i]("JOIN #dircd")
+		expect(" 366 ")
+	}
+
+	// The first QUIT is sent as it happens, those past the threshold are held.
+	routes[0]("QUIT :bye")
+	expectAlice(":user0!user0@")
+	routes[1]("QUIT :bye")
+	routes[2]("QUIT :bye")
+	srv.quits.mu.Lock()
+	assert.Len(t, srv.quits.held, 2)
+	srv.quits.mu.Unlock()
+
+	clock.Advance(time.Second)
+	expectAlice("BATCH +q1 netsplit irc.example.net")
+	expectAlice("@batch=q1 :user1!user1@")
+	expectAlice("@batch=q1 :user2!user2@")
+	expectAlice("BATCH -q1")
+	expectCarol(":user1!user1@")
+	expectCarol(":user2!user2@")
+
+	srv.quits.mu.Lock()
+	assert.Empty(t, srv.quits.held)
+	srv.quits.mu.Unlock()
+}
+
+func TestQuitBatchRelease(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	srv, err := NewServer(WithHostname("irc.example.net"), WithClock(clock), WithQuitBatching(2, time.Minute))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("JOIN #dircd")
+	expectAlice(" 366 alice ")
+
+	for _, nick := range []string{"bob", "carol"} {
+		_, route, expect := connectClient(t, srv, "")
+		route("NICK " + nick)
+		route("USER " + nick + " 0 * :User")
+		route("JOIN #dircd")
+		expect(" 366 ")
+		route("QUIT :bye")
+	}
+	expectAlice(":bob!bob@")
+
+	// The held QUIT of carol is sent before anyone else may take the nick.
+	_, route, _ := connectClient(t, srv, "")
+	route("NICK carol")
+	route("USER carol 0 * :Carol")
+	expectAlice(":carol!carol@")
+
+	_, err = NewServer(WithQuitBatching(1, time.Second))
+	assert.Error(t, err)
+	_, err = NewServer(WithQuitBatching(2, 0))
+	assert.Error(t, err)
+}
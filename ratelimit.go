@@ -0,0 +1,95 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RateClass is the class of a command by its cost, each of which is given its own budget
+// of commands per connection, see WithRateBudget.
+type RateClass uint8
+
+const (
+	RateNormal    RateClass = iota // Commands limited only by the flood limits of the connection class.
+	RateExpensive                  // Commands replying with many lines or searching all users, eg: LIST, WHO, WHOIS.
+	RateOper                       // Commands requiring operator privileges, which all are in this class.
+
+	rateClasses = iota
+)
+
+// RateBudget is the number of commands of a rate class a connection may send in a burst,
+// after which it may send one per interval. A zero burst leaves the class unlimited.
+type RateBudget struct {
+	Interval time.Duration
+	Burst    int
+}
+
+// defaultRateBudgets are the budgets of the rate classes, unless set with WithRateBudget.
+var defaultRateBudgets = [rateClasses]RateBudget{
+	RateNormal:    {},
+	RateExpensive: {Interval: 5 * time.Second, Burst: 5},
+	RateOper:      {Interval: time.Second, Burst: 10},
+}
+
+// String returns the name of the rate class.
+func (class RateClass) String() string {
+	switch class {
+	case RateNormal:
+		return "normal"
+	case RateExpensive:
+		return "expensive"
+	case RateOper:
+		return "oper"
+	default:
+		return fmt.Sprintf("RateClass(%d)", class)
+	}
+}
+
+// WithRateBudget sets the budget of commands of the rate class each connection may send,
+// beyond which they are refused with ERR_TRYAGAIN. A zero burst leaves the class unlimited.
+func WithRateBudget(class RateClass, interval time.Duration, burst int) ServerOption {
+	return option(func(s *Server) error {
+		if class >= rateClasses {
+			return fmt.Errorf("unknown rate class: %s", class)
+		}
+		if burst < 0 {
+			return errors.New("rate budget burst must not be negative")
+		}
+		if burst > 0 && interval <= 0 {
+			return fmt.Errorf("rate budget interval of class %s must be positive", class)
+		}
+		s.rateBudgets[class] = RateBudget{Interval: interval, Burst: burst}
+		return nil
+	})
+}
+
+// rateClass returns the rate class of the command, which is RateOper for any command
+// requiring operator privileges.
+func (spec *CommandSpec) rateClass() RateClass {
+	if spec.Oper || spec.Privilege != PrivNone {
+		return RateOper
+	}
+	return spec.Rate
+}
+
+// allowCommand reports whether the user may send a command of the rate class now within
+// its budget, consuming from it if so. Flood immune users are exempt.
+func (conn *Conn) allowCommand(class RateClass) bool {
+	if conn.server == nil || class >= rateClasses || conn.user.ModeIsSet(UModeFloodImmune) {
+		return true
+	}
+
+	budget := conn.server.rateBudgets[class]
+	if budget.Burst == 0 {
+		return true
+	}
+	return conn.rateBuckets[class].allowRate(time.Now(), budget.Interval, budget.Burst)
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateClass(t *testing.T) {
+	tests := map[string]RateClass{
+		CmdWhois:   RateExpensive,
+		CmdPrivMsg: RateNormal,
+		CmdKLine:   RateOper,
+		CmdGlobops: RateOper,
+	}
+
+	for command, class := range tests {
+		spec := builtinSpecs[command]
+		assert.Equal(t, class, spec.rateClass(), command)
+	}
+}
+
+func TestAllowCommand(t *testing.T) {
+	srv, err := NewServer(WithRateBudget(RateExpensive, time.Hour, 2))
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+
+	assert.True(t, conn.allowCommand(RateExpensive))
+	assert.True(t, conn.allowCommand(RateExpensive))
+	assert.False(t, conn.allowCommand(RateExpensive))
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, conn.allowCommand(RateNormal))
+	}
+
+	conn.user.AddMode(UModeFloodImmune)
+	assert.True(t, conn.allowCommand(RateExpensive))
+}
+
+func TestRateBudgetOptions(t *testing.T) {
+	_, err := NewServer(WithRateBudget(rateClasses, time.Second, 1))
+	assert.Error(t, err)
+	_, err = NewServer(WithRateBudget(RateExpensive, time.Second, -1))
+	assert.Error(t, err)
+	_, err = NewServer(WithRateBudget(RateExpensive, 0, 1))
+	assert.Error(t, err)
+	_, err = NewServer(WithRateBudget(RateNormal, 0, 0))
+	assert.NoError(t, err)
+}
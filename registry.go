@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// UserRegistry registers the users of a server by their nick, and renames them, rekeying
+// them in the nicks of the server and the members of their channels, and notifying those
+// who see the change, as a single operation. Nicks are claimed atomically, so that two
+// users cannot claim the same nick, and a rename failing part way is rolled back rather
+// than leaving the user keyed under both nicks.
+type UserRegistry struct {
+	mu     sync.Mutex
+	server *Server
+}
+
+// newUserRegistry returns a registry registering and renaming the users of the server.
+func newUserRegistry(srv *Server) *UserRegistry {
+	return &UserRegistry{server: srv}
+}
+
+// Claim registers the user by their nick, unless another user holds it, in which case
+// ErrNickInUse is returned. Checking the nick and registering the user are one operation,
+// so that of two users registering the same nick at once, only one succeeds.
+func (reg *UserRegistry) Claim(user *User) error {
+	nick := user.Nick()
+	if reg.server.Nicks.SetIfAbsent(nick, user) {
+		reg.server.quits.release(nick)
+		return nil
+	}
+	if holder, _ := reg.server.Nicks.Get(nick); holder == user {
+		return nil
+	}
+	return ErrNickInUse
+}
+
+// Rename changes the nick of the user to the new nick, returning their old nick.
+//
+// The user is rekeyed in the nicks of the server and each of their channels, and only
+// then is their nick set, the NICK sent to them and the users sharing a channel with
+// them, and for local users, EventNickChange published. If the nick is held by another
+// user, ErrNickInUse is returned. If the user cannot be rekeyed anywhere, the rekeying
+// already done is undone and the error returned, leaving the user under their old nick.
+func (reg *UserRegistry) Rename(user *User, newNick string) (string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	srv := reg.server
+	oldNick := user.Nick()
+	source := user.Hostmask()
+
+	if holder, exists := srv.Nicks.Get(newNick); exists && holder != user {
+		return oldNick, ErrNickInUse
+	}
+
+	if !srv.Nicks.ChangeKey(oldNick, newNick) {
+		// Another user may have claimed the nick since it was checked.
+		if srv.Nicks.Exists(newNick) {
+			return oldNick, ErrNickInUse
+		}
+		return oldNick, fmt.Errorf("user [%s] is not registered by their nick", oldNick)
+	}
+
+	channels := user.Channels()
+	for i, channel := range channels {
+		if err := channel.ChangeNick(oldNick, newNick); err != nil {
+			rollbackErr := reg.rollback(channels[:i], oldNick, newNick)
+			return oldNick, errors.Join(fmt.Errorf("error renaming [%s] in channel [%s]: %w", oldNick, channel.Name(), err), rollbackErr)
+		}
+	}
+
+	srv.quits.release(newNick)
+	user.SetNick(newNick)
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = source
+	msg.Command = CmdNick
+	msg.Params = []string{newNick}
+
+	if user.conn != nil {
+		user.Write(msg.RenderBuffer())
+	}
+	srv.sendToAudience(user, msg)
+
+	if user.conn != nil {
+		event := userEvent(EventNickChange, user)
+		event.Target = oldNick
+		srv.publish(event)
+	}
+
+	return oldNick, nil
+}
+
+// rollback rekeys the user back under their old nick in the server and the channels.
+func (reg *UserRegistry) rollback(channels []*Channel, oldNick, newNick string) error {
+	var rollbackErr error
+	for _, channel := range channels {
+		if err := channel.ChangeNick(newNick, oldNick); err != nil {
+			rollbackErr = errors.Join(rollbackErr, fmt.Errorf("error restoring [%s] in channel [%s]: %w", oldNick, channel.Name(), err))
+		}
+	}
+	if !reg.server.Nicks.ChangeKey(newNick, oldNick) {
+		rollbackErr = errors.Join(rollbackErr, fmt.Errorf("error restoring [%s] in server nicks", oldNick))
+	}
+	return rollbackErr
+}
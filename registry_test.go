@@ -0,0 +1,93 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserRegistryRename(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+
+	alice, bob := &User{nick: "alice"}, &User{nick: "bob"}
+	srv.Nicks.Set("alice", alice)
+	srv.Nicks.Set("bob", bob)
+
+	first := NewChannel("#first", alice, srv.casemapping)
+	second := NewChannel("#second", alice, srv.casemapping)
+	for _, channel := range []*Channel{first, second} {
+		msg := msgPool.New()
+		generation := msg.Generation()
+		channel.Join(alice, "", msg)
+		msgPool.Recycle(msg, generation)
+	}
+	first.Ops.Set("alice", alice)
+
+	oldNick, err := srv.Registry.Rename(alice, "carol")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", oldNick)
+	assert.Equal(t, "carol", alice.Nick())
+	assert.False(t, srv.Nicks.Exists("alice"))
+	assert.True(t, srv.Nicks.Exists("carol"))
+	assert.True(t, first.Nicks.Exists("carol"))
+	assert.True(t, first.Ops.Exists("carol"))
+	assert.True(t, second.Nicks.Exists("carol"))
+
+	_, err = srv.Registry.Rename(alice, "BOB")
+	assert.ErrorIs(t, err, ErrNickInUse)
+	assert.Equal(t, "carol", alice.Nick())
+
+	_, err = srv.Registry.Rename(alice, "Carol")
+	assert.NoError(t, err)
+	assert.Equal(t, "Carol", alice.Nick())
+
+	// A channel which has lost track of the user fails the rename, which is rolled back.
+	second.Nicks.Delete("carol")
+	_, err = srv.Registry.Rename(alice, "dave")
+	assert.Error(t, err)
+	assert.Equal(t, "Carol", alice.Nick())
+	assert.True(t, srv.Nicks.Exists("carol"))
+	assert.False(t, srv.Nicks.Exists("dave"))
+	assert.True(t, first.Nicks.Exists("carol"))
+	assert.False(t, first.Nicks.Exists("dave"))
+}
+
+func TestUserRegistryClaim(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+
+	alice, impostor := &User{nick: "alice"}, &User{nick: "ALICE"}
+	assert.NoError(t, srv.Registry.Claim(alice))
+	assert.NoError(t, srv.Registry.Claim(alice))
+	assert.ErrorIs(t, srv.Registry.Claim(impostor), ErrNickInUse)
+
+	holder, _ := srv.Nicks.Get("alice")
+	assert.Same(t, alice, holder)
+
+	_, err = srv.Registry.Rename(impostor, "alice")
+	assert.ErrorIs(t, err, ErrNickInUse)
+
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if srv.Registry.Claim(&User{nick: "bob"}) == nil {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), claimed.Load())
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import "fmt"
+
+// Remote users are users without a connection to this server, introduced by a services
+// link or another node of a cluster. They are tracked in the same maps as local users,
+// and their activity is announced to the local members of their channels.
+
+// joinRemote joins the remote user to the channel, creating it if it doesn't exist,
+// returning the channel and whether the user joined it.
+func (srv *Server) joinRemote(user *User, name string) (*Channel, bool) {
+	channel, exists := srv.Channels.Get(name)
+	if !exists {
+		channel = srv.newChannel(name, user)
+		srv.Channels.Set(name, channel)
+	}
+
+	if channel.Nicks.Exists(user.Nick()) {
+		return channel, false
+	}
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = user.Hostmask()
+	msg.Command = CmdJoin
+	msg.Params = []string{channel.Name()}
+	channel.join(user, msg)
+	return channel, true
+}
+
+// quitRemote removes the remote user from the server and their channels.
+func (srv *Server) quitRemote(user *User, reason string) {
+	nick := user.Nick()
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = user.Hostmask()
+	msg.Command = CmdQuit
+	msg.Trailing = reason
+
+	srv.sendQuit(user, msg)
+	for _, channel := range user.Channels() {
+		_ = channel.removeMember(nick)
+	}
+
+	if current, exists := srv.Nicks.Get(nick); exists && current == user {
+		srv.Nicks.Delete(nick)
+	}
+	if uid := user.UID(); len(uid) > 0 {
+		srv.uids.Delete(uid)
+	}
+}
+
+// renameRemote changes the nick of the remote user, announcing it to their channels.
+func (srv *Server) renameRemote(user *User, newNick string) {
+	if oldNick, err := srv.Registry.Rename(user, newNick); err != nil {
+		srv.logger.WithField("operation", "nick").
+			Warn(fmt.Errorf("error changing nick of remote user [%s] to [%s]: %w", oldNick, newNick, err))
+	}
+}
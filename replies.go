@@ -8,164 +8,306 @@
 package dircd
 
 import (
-	"github.com/btnmasher/dircd/shared/sliceutils"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/btnmasher/dircd/shared/stringutils"
 )
 
-// ReplyWelcome returns the configured welcome message to the user.
-// This is sent when a client first connects and registers successfully.
-func (conn *Conn) ReplyWelcome() {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
-
-	msg.Code = ReplyWelcome
-	msg.Params = []string{conn.user.Nick()}
-	msg.Trailing = conn.server.Welcome()
+// serverTimeFormat is the format of the time tag added to replies for clients which
+// have enabled the server-time capability.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
 
-	conn.Write(msg.RenderBuffer())
+// replyNick returns the nick replies are addressed to, or * if the user has not yet
+// set one.
+func (conn *Conn) replyNick() string {
+	if nick := conn.user.Nick(); len(nick) > 0 {
+		return nick
+	}
+	return "*"
 }
 
-// ReplyInvalidCapCommand returns an error message to the user in the event that
-// a CAP command issued by the user is not  a valid subcommand per the IRCv3 CAP
-// specifications.
-func (conn *Conn) ReplyInvalidCapCommand(cmd string) {
+// newReply returns a new message from the server to the user, tagged with the time it
+// was sent if the user has enabled server-time, and with the label of the request it
+// replies to if given.
+func (conn *Conn) newReply(label string) *Message {
 	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
 
-	nick := conn.user.Nick()
+	if conn.HasCap(ServerTime) {
+		if msg.Tags == nil {
+			msg.Tags = make(map[string]string)
+		}
+		msg.Tags["time"] = time.Now().UTC().Format(serverTimeFormat)
+	}
 
-	if len(nick) == 0 {
-		nick = "*"
+	if len(label) > 0 {
+		if msg.Tags == nil {
+			msg.Tags = make(map[string]string)
+		}
+		msg.Tags["label"] = label
 	}
 
-	params := []string{nick}
+	return msg
+}
 
-	if cmd != "" {
-		params = append(params, cmd)
-	}
+// sendReply sends the reply to the user with the given parameters, the last of which is
+// sent as the trailing parameter even when empty, then recycles it.
+func (conn *Conn) sendReply(msg *Message, params []string) {
+	defer msgPool.Recycle(msg, msg.Generation())
 
-	msg.Code = ReplyInvalidCapCmd
-	msg.Params = params
-	msg.Trailing = ErrInvalidCapCmd.Error()
+	setReplyParams(msg, params)
+	conn.WriteMessage(msg)
+}
 
-	conn.Write(msg.RenderBuffer())
+// setReplyParams sets the parameters of the reply, the last being the trailing parameter.
+func setReplyParams(msg *Message, params []string) {
+	if len(params) > 0 {
+		msg.Params = params[:len(params)-1]
+		msg.Trailing = params[len(params)-1]
+
+		// An empty trailing parameter must still be sent, which Render omits.
+		if len(msg.Trailing) == 0 {
+			msg.Params = append(msg.Params, COLON)
+		}
+	}
 }
 
-// ReplyNeedMoreParams returns an error message to the user in the event that
-// a command issued by the user that does not satisfy the minimum number of
-// parameters expected of the particular command.
-func (conn *Conn) ReplyNeedMoreParams(cmd string) {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
+// renderedReply is a numeric reply rendered ahead of time but for the nick it is addressed
+// to, as it is otherwise the same for every user, such as the lines of RPL_ISUPPORT.
+type renderedReply struct {
+	prefix []byte // The source and numeric, up to the nick.
+	suffix []byte // The parameters following the nick, and the CRLF.
+}
 
-	nick := conn.user.Nick()
+// renderReply renders the numeric reply from the source with the middle parameters and
+// trailing text following the nick, as Message.RenderBuffer would.
+func renderReply(source string, code uint16, middle []string, trailing string) renderedReply {
+	prefix := fmt.Sprintf(":%s %03d ", source, code)
 
-	if len(nick) == 0 {
-		nick = "*"
+	var suffix strings.Builder
+	for _, param := range middle {
+		suffix.WriteString(SPACE)
+		suffix.WriteString(param)
 	}
+	if len(trailing) > 0 {
+		suffix.WriteString(SPACE + COLON)
+		suffix.WriteString(trailing)
+	}
+	suffix.WriteString(CRLF)
 
-	params := []string{nick}
+	return renderedReply{prefix: []byte(prefix), suffix: []byte(suffix.String())}
+}
 
-	if cmd != "" {
-		params = append(params, cmd)
+// writeRendered sends the pre-rendered reply to the user, tagged with the time it was sent
+// if they have enabled server-time.
+func (conn *Conn) writeRendered(reply renderedReply) {
+	buffer := bufPool.New()
+	if conn.HasCap(ServerTime) {
+		buffer.WriteString(AT + "time" + EQUAL)
+		buffer.WriteString(time.Now().UTC().Format(serverTimeFormat))
+		buffer.WriteString(SPACE)
 	}
+	buffer.Write(reply.prefix)
+	buffer.WriteString(conn.replyNick())
+	buffer.Write(reply.suffix)
+	conn.queue(buffer, laneNormal)
+}
 
-	msg.Code = ReplyNeedMoreParams
-	msg.Params = params
-	msg.Trailing = ErrMissingParams.Error()
+// replyNumeric sends the numeric reply to the user, labelled if a label is given.
+func (conn *Conn) replyNumeric(label string, code uint16, params []string) {
+	msg := conn.newReply(label)
+	msg.Code = code
+	conn.sendReply(msg, append([]string{conn.replyNick()}, formatNumeric(code, params)...))
+}
 
-	conn.Write(msg.RenderBuffer())
+// replyCommand sends the command to the user from the server, labelled if a label is given.
+func (conn *Conn) replyCommand(label string, command string, params []string) {
+	msg := conn.newReply(label)
+	msg.Command = command
+	conn.sendReply(msg, params)
 }
 
-// ReplyNoNicknameGiven returns an error message to the user in the event that
-// a command issued by the user that does not satisfy the requirement of specifying
-// a nickname.
-func (conn *Conn) ReplyNoNicknameGiven() {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
+// ReplyNumeric sends the numeric reply to the user, addressed to their nick, or * if
+// they have not yet set one. The last parameter is sent as the trailing parameter.
+func (conn *Conn) ReplyNumeric(code uint16, params ...string) {
+	conn.replyNumeric("", code, params)
+}
 
-	nick := conn.user.Nick()
+// ReplyCommand sends the command to the user from the server. The last parameter is
+// sent as the trailing parameter.
+func (conn *Conn) ReplyCommand(command string, params ...string) {
+	conn.replyCommand("", command, params)
+}
 
-	if len(nick) == 0 {
-		nick = "*"
-	}
+// ReplyFail sends a FAIL standard reply to the user, reporting the command failed with
+// the machine readable code, followed by any context parameters and the description,
+// which is sent as the trailing parameter.
+func (conn *Conn) ReplyFail(command, code string, params ...string) {
+	conn.ReplyCommand(CmdFail, append([]string{command, code}, params...)...)
+}
+
+// ReplyWelcome returns the configured welcome message to the user.
+// This is sent when a client first connects and registers successfully.
+func (conn *Conn) ReplyWelcome() {
+	conn.writeRendered(conn.server.welcomeReply())
+}
+
+// ReplyInvalidCapCommand returns an error message to the user in the event that
+// a CAP command issued by the user is not  a valid subcommand per the IRCv3 CAP
+// specifications.
+func (conn *Conn) ReplyInvalidCapCommand(cmd string) {
+	conn.ReplyNumeric(ReplyInvalidCapCmd, cmd)
+}
+
+// ReplyNeedMoreParams returns an error message to the user in the event that
+// a command issued by the user that does not satisfy the minimum number of
+// parameters expected of the particular command.
+func (conn *Conn) ReplyNeedMoreParams(cmd string) {
+	conn.ReplyNumeric(ReplyNeedMoreParams, cmd)
+}
 
-	msg.Params = []string{nick}
-	msg.Code = ReplyNoNicknameGiven
-	msg.Trailing = ErrNoNickGiven.Error()
+// ReplyNoRecipient returns an error message to the user in the event that
+// a message was sent without a target.
+func (conn *Conn) ReplyNoRecipient(cmd string) {
+	conn.ReplyNumeric(ReplyNoRecipient, cmd)
+}
 
-	conn.Write(msg.RenderBuffer())
+// ReplyNoTextToSend returns an error message to the user in the event that
+// a message was sent without any text.
+func (conn *Conn) ReplyNoTextToSend() {
+	conn.ReplyNumeric(ReplyNoTextToSend)
+}
+
+// ReplyNoNicknameGiven returns an error message to the user in the event that
+// a command issued by the user that does not satisfy the requirement of specifying
+// a nickname.
+func (conn *Conn) ReplyNoNicknameGiven() {
+	conn.ReplyNumeric(ReplyNoNicknameGiven)
 }
 
 // ReplyNoSuchNick returns an error message to the user in the event that a command
 // is issued by the user with a target nickname which cannot be found by the server or
 // if the issuing user is unable to know of the target's existence due to permissions.
 func (conn *Conn) ReplyNoSuchNick(nick string) {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
+	conn.ReplyNumeric(ReplyNoSuchNick, nick)
+}
 
-	msg.Params = []string{conn.user.Nick(), nick}
-	msg.Code = ReplyNoSuchNick
-	msg.Trailing = ErrNoSuchNick.Error()
+// ReplyCannotSendToChan returns an error message to the user in the event that a
+// message they sent to the target was rejected, with the reason it was rejected.
+func (conn *Conn) ReplyCannotSendToChan(target, reason string) {
+	conn.ReplyNumeric(ReplyCannotSendToChan, target, reason)
+}
 
-	conn.Write(msg.RenderBuffer())
+// ReplyCannotSendToUser returns an error message to the user in the event that a
+// message they sent to the nick was rejected, with the reason it was rejected.
+func (conn *Conn) ReplyCannotSendToUser(nick, reason string) {
+	conn.ReplyNumeric(ReplyCannotSendToUser, nick, reason)
+}
+
+// ReplyBannedFromChan returns an error message to the user in the event that they
+// were refused entry to the channel, with the reason they were refused.
+func (conn *Conn) ReplyBannedFromChan(channel, reason string) {
+	conn.ReplyNumeric(ReplyBannedFromChan, channel, reason)
+}
+
+// joinNumerics are the numerics replied to users who may not join a channel, by the
+// reason they may not.
+var joinNumerics = map[error]uint16{
+	ErrChannelIsFull:  ReplyChannelIsFull,
+	ErrInviteOnlyChan: ReplyInviteOnlyChan,
+	ErrBannedFromChan: ReplyBannedFromChan,
+	ErrBadChannelKey:  ReplyBadChannelPass,
+}
+
+// ReplyCannotJoin returns an error message to the user in the event that they may not
+// join the channel, with the numeric of the reason they may not.
+func (conn *Conn) ReplyCannotJoin(channel string, reason error) {
+	code, known := joinNumerics[reason]
+	if !known {
+		code = ReplyBannedFromChan
+	}
+	conn.ReplyNumeric(code, channel, reason.Error())
 }
 
 // ReplyNoSuchChan returns an error message to the user in the event that a command
 // is issued by the user with a target channel which cannot be found by the server or
 // if the issuing user is unable to know of the target's existence due to permissions.
 func (conn *Conn) ReplyNoSuchChan(channel string) {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
+	conn.ReplyNumeric(ReplyNoSuchChannel, channel)
+}
 
-	msg.Params = []string{conn.user.Nick(), channel}
-	msg.Code = ReplyNoSuchChannel
-	msg.Trailing = ErrNoSuchChan.Error()
+// ReplyTooManyChannels returns an error message to the user when they attempt to join
+// a channel after joining the maximum number of channels allowed by the server.
+func (conn *Conn) ReplyTooManyChannels(channel string) {
+	conn.ReplyNumeric(ReplyTooManyChannels, channel)
+}
 
-	conn.Write(msg.RenderBuffer())
+// ReplyInputTooLong returns an error message to the user when they send a line longer
+// than the server accepts, which is otherwise dropped.
+func (conn *Conn) ReplyInputTooLong() {
+	conn.ReplyNumeric(ReplyInputTooLong)
 }
 
 // ReplyNotImplemented returns an error message to the user in the event the given
 // command is not a part of the handlers defined for use by RouteMessage()
 func (conn *Conn) ReplyNotImplemented(cmd string) {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
-
-	msg.Code = ReplyUnknownCommand
-	msg.Params = []string{conn.user.Nick(), cmd}
-	msg.Trailing = ErrNotImplemented.Error()
-	conn.Write(msg.RenderBuffer())
+	conn.ReplyNumeric(ReplyUnknownCommand, cmd)
 }
 
 // ReplyNotRegistered returns an error message to the user when they attempt to use
 // a command which requires the user to first be registered with the server.
 func (conn *Conn) ReplyNotRegistered() {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
-
-	nick := conn.user.Nick()
+	conn.ReplyNumeric(ReplyNotRegistered)
+}
 
-	if len(nick) == 0 {
-		nick = "*"
-	}
+// ReplyTryAgain returns an error message to the user when a command issued by the user
+// has been refused for exceeding the rate budget of its class.
+func (conn *Conn) ReplyTryAgain(cmd string) {
+	conn.ReplyNumeric(ReplyTryAgain, cmd)
+}
 
-	msg.Code = ReplyNotRegistered
-	msg.Params = []string{nick}
-	msg.Trailing = ErrNotRegistered.Error()
+// ReplyServicesDown returns an error message to the user when a service alias command
+// was sent while the service is unavailable.
+func (conn *Conn) ReplyServicesDown(service string) {
+	conn.ReplyNumeric(ReplyServicesDown, service)
+}
 
-	conn.Write(msg.RenderBuffer())
+// ReplyStartTLSFail returns an error message to the user when a STARTTLS
+// command could not be honored, with the given reason.
+func (conn *Conn) ReplyStartTLSFail(reason Error) {
+	conn.ReplyNumeric(ReplyStartTLSFail, reason.Error())
 }
 
 // ReplyChannelTopic returns the topic reply to the user for
-// the given channel.
+// the given channel, followed by who set it and when.
 func (conn *Conn) ReplyChannelTopic(channel *Channel) {
-	msg := conn.newMessage()
-	defer msgPool.Recycle(msg)
+	conn.ReplyNumeric(ReplyChanTopic, channel.Name(), channel.Topic())
+	if setter, at := channel.TopicSetBy(); len(setter) > 0 {
+		conn.ReplyNumeric(ReplyTopicWhoTime, channel.Name(), setter, strconv.FormatInt(at.Unix(), 10))
+	}
+}
+
+// ReplyChannelModes returns the modes set on the given channel to the user.
+func (conn *Conn) ReplyChannelModes(channel *Channel) {
+	conn.ReplyNumeric(ReplyChannelModeIs, append([]string{channel.Name()}, conn.server.channelModes(channel)...)...)
+}
 
-	msg.Code = ReplyChanTopic
-	msg.Params = []string{conn.user.Nick(), channel.Name()}
-	msg.Trailing = channel.Topic()
-	conn.Write(msg.RenderBuffer())
+// ReplyCreationTime returns the time the given channel was created to the user.
+func (conn *Conn) ReplyCreationTime(channel *Channel) {
+	conn.ReplyNumeric(ReplyCreationTime, channel.Name(), strconv.FormatInt(channel.CreatedAt().Unix(), 10))
+}
+
+// ReplyChannelJoined returns the state of the given channel to the user who joined it:
+// its topic, if set, its modes and creation time, and its names.
+func (conn *Conn) ReplyChannelJoined(channel *Channel) {
+	if len(channel.Topic()) > 0 {
+		conn.ReplyChannelTopic(channel)
+	}
+	conn.ReplyChannelModes(channel)
+	conn.ReplyCreationTime(channel)
+	conn.ReplyChannelNames(channel)
 }
 
 // ReplyChannelNames returns the topic reply to the user for
@@ -177,82 +319,225 @@ func (conn *Conn) ReplyChannelNames(channel *Channel) {
 	params := []string{userNick, "=", channelName}
 
 	temp := conn.newMessage()
+	generation := temp.Generation()
 	temp.Code = ReplyNames
 	temp.Params = params
 
 	joined := stringutils.ChunkJoinStrings(MaxMsgLength-len(temp.String()), SPACE, nickList...)
-	msgPool.Recycle(temp)
+	msgPool.Recycle(temp, generation)
 
-	messages := make([]*Message, 0, len(joined)+1)
+	var batch messageBatch
+	defer batch.recycle()
 
 	for _, line := range joined {
-		msg := conn.newMessage()
+		msg := conn.newReply("")
 		msg.Code = ReplyNames
 		msg.Params = params
 		msg.Trailing = line
-		messages = append(messages, msg)
+		batch.add(msg)
 	}
 
-	end := conn.newMessage()
+	end := conn.newReply("")
 	end.Code = ReplyEndOfNames
 	end.Params = []string{userNick, channelName}
 	end.Trailing = "End of NAMES list."
-	messages = append(messages, end)
-
-	defer func() {
-		for i := range messages {
-			msgPool.Recycle(messages[i])
-		}
-	}()
+	batch.add(end)
 
-	for i := range messages {
-		conn.Write(messages[i].RenderBuffer())
+	for i := range batch.messages {
+		conn.queue(batch.messages[i].RenderBuffer(), laneBulk)
 	}
 }
 
 // ReplyISupport returns the ISupport information about the server
 func (conn *Conn) ReplyISupport() {
+	// The lines are cached for the longest nick, so the budget doesn't vary by user.
+	budget := MaxMsgLength - len(fmt.Sprintf(":%s %03d %s  :%s\r\n", conn.hostname, ReplyISupport, strings.Repeat("*", conn.server.Limits().NickLength), isupportTrailing))
+	for _, line := range conn.server.support.renderedLines(conn.hostname, budget) {
+		conn.writeRendered(line)
+	}
+}
 
-	support := conn.server.ISupport()
-	params := []string{conn.user.Nick()}
+// ReplyServerNotice sends a NOTICE from the server to the user with the given text.
+func (conn *Conn) ReplyServerNotice(text string) {
+	conn.ReplyCommand(CmdNotice, conn.replyNick(), text)
+}
 
-	temp := conn.newMessage()
-	defer msgPool.Recycle(temp)
-	temp.Code = ReplyISupport
-	temp.Params = params
+// ReplyCap returns a CAP subcommand reply to the user with the given capability list.
+func (conn *Conn) ReplyCap(subcommand, caps string) {
+	conn.ReplyCommand(CmdCap, conn.replyNick(), subcommand, caps)
+}
+
+// ReplyAuthenticate sends an AUTHENTICATE challenge to the user during a SASL exchange.
+func (conn *Conn) ReplyAuthenticate(data string) {
+	msg := conn.newMessage()
+	defer msgPool.Recycle(msg, msg.Generation())
+
+	msg.Source = ""
+	msg.Command = CmdAuth
+	msg.Params = []string{data}
+
+	conn.WriteMessage(msg)
+}
+
+// ReplySASL returns the given SASL result numeric to the user with the given reason.
+func (conn *Conn) ReplySASL(code uint16, reason Error) {
+	conn.ReplyNumeric(code, reason.Error())
+}
+
+// ReplySASLMechanisms returns the list of supported SASL mechanisms to the user.
+func (conn *Conn) ReplySASLMechanisms() {
+	conn.ReplyNumeric(ReplySASLMechs, strings.Join(conn.server.saslMechanisms(), ","))
+}
+
+// ReplyLoggedIn notifies the user that they are now logged in to the given account.
+func (conn *Conn) ReplyLoggedIn(account string) {
+	conn.ReplyNumeric(ReplyLoggedIn, conn.user.Hostmask(), account)
+}
+
+// ReplyLoggedOut returns a message to the user confirming they have been logged out of their account.
+func (conn *Conn) ReplyLoggedOut() {
+	conn.ReplyNumeric(ReplyLoggedOut, conn.user.Hostmask())
+}
 
-	var paramLines []string
+// ReplyWhois returns the WHOIS information of the target user to the user.
+//
+// The certificate fingerprint of the target, and the cipher of their secure
+// connection, are only included when the user is querying themself, or is an operator.
+func (conn *Conn) ReplyWhois(target *User) {
+	nick := conn.user.Nick()
+	targetNick := target.Nick()
+
+	var batch messageBatch
+	defer batch.recycle()
 
-	// Spec only allows for 15 max parameters, with two parameters being taken up by the client host and message text
-	if len(support) <= MaxMsgParams-2 {
-		paramLines = stringutils.ChunkJoinStrings(MaxMsgLength-len(temp.String()), SPACE, support...)
+	reply := func(code uint16, trailing string, params ...string) {
+		msg := conn.newReply("")
+		msg.Code = code
+		msg.Params = append([]string{nick, targetNick}, params...)
+		msg.Trailing = trailing
+		batch.add(msg)
+	}
+
+	reply(ReplyWhoisUser, target.Realname(), target.Name(), target.VisibleHost(), "*")
+	if target.link != nil {
+		reply(ReplyWhoisServer, target.link.description, target.link.name)
 	} else {
-		// We have more parameters than can fit onto a single message, chunk them into groups of 13
-		supportChunks := sliceutils.ChunkBy(support, MaxMsgParams-2)
-		for i := range supportChunks {
-			joinedPartial := stringutils.ChunkJoinStrings(MaxMsgLength-len(temp.String()), SPACE, supportChunks[i]...)
-			paramLines = append(paramLines, joinedPartial...)
+		reply(ReplyWhoisServer, conn.server.Network(), conn.hostname)
+	}
+
+	if target.IsOper() {
+		reply(ReplyWhoisOperator, "is an IRC operator")
+	}
+
+	if joined := target.Channels(); len(joined) > 0 {
+		channels := make([]string, 0, len(joined))
+		for _, channel := range joined {
+			channels = append(channels, channel.Name())
+		}
+		for _, line := range stringutils.ChunkJoinStrings(MaxMsgLength-len(nick)-len(targetNick)-64, SPACE, channels...) {
+			reply(ReplyWhoisChannels, line)
+		}
+	}
+
+	if account := target.Account(); account != "" {
+		reply(ReplyWhoisAccount, "is logged in as", account)
+	}
+
+	if target.ModeIsSet(UModeSecured) {
+		text := "is using a secure connection"
+		if target.conn != nil && (target == conn.user || conn.user.HasPrivilege(PrivSpy)) {
+			if cipher := target.conn.Cipher(); cipher != "" {
+				text += " [" + cipher + "]"
+			}
 		}
+		reply(ReplyWhoisSecure, text)
 	}
 
-	messages := make([]*Message, 0, len(paramLines))
+	if target.conn != nil && (target == conn.user || conn.user.HasPrivilege(PrivSpy)) {
+		if fingerprint := target.conn.CertFP(); fingerprint != "" {
+			reply(ReplyWhoisCertFP, "has client certificate fingerprint "+fingerprint)
+		}
+	}
 
-	for i := range paramLines {
-		msg := conn.newMessage()
+	if target.conn != nil && conn.user.IsOper() {
+		if info, ok := target.conn.Geo(); ok {
+			reply(ReplyWhoisSpecial, "is connecting from "+info.String())
+		}
+	}
 
-		msg.Code = ReplyISupport
-		msg.Params = append(params, paramLines[i])
+	reply(ReplyEndOfWhois, "End of /WHOIS list.")
 
-		messages = append(messages, msg)
+	for i := range batch.messages {
+		conn.WriteMessage(batch.messages[i])
 	}
+}
 
-	defer func() {
-		for i := range messages {
-			msgPool.Recycle(messages[i])
+// ReplyYoureOper returns a message to the user confirming they are now an IRC operator.
+func (conn *Conn) ReplyYoureOper() {
+	conn.ReplyNumeric(ReplyYoureOper)
+}
+
+// ReplyRehashing returns a message to the operator confirming the server is rehashing.
+func (conn *Conn) ReplyRehashing() {
+	conn.ReplyNumeric(ReplyRehashing, conn.server.Hostname())
+}
+
+// ReplyNoOperHost returns an error message to the user when there is no oper block
+// by the given name which allows their host.
+func (conn *Conn) ReplyNoOperHost() {
+	conn.ReplyNumeric(ReplyNoOperHost)
+}
+
+// ReplyPasswordMismatch returns an error message to the user when they supply an
+// incorrect password.
+func (conn *Conn) ReplyPasswordMismatch() {
+	conn.ReplyNumeric(ReplyPasswordMistmatch)
+}
+
+// ReplyNoPrivileges returns an error message to the user when they attempt to use
+// a command which requires them to be an IRC operator.
+func (conn *Conn) ReplyNoPrivileges() {
+	conn.ReplyNumeric(ReplyNoPrivileges)
+}
+
+// ReplyHelp returns the lines of help text on the subject to the user, the first line
+// starting the reply.
+func (conn *Conn) ReplyHelp(subject string, lines []string) {
+	nick := conn.user.Nick()
+
+	var batch messageBatch
+	defer batch.recycle()
+
+	for i, line := range lines {
+		msg := conn.newReply("")
+		msg.Code = ReplyHelpText
+		if i == 0 {
+			msg.Code = ReplyHelpStart
 		}
-	}()
+		msg.Params = []string{nick, subject}
+		msg.Trailing = line
+		batch.add(msg)
+	}
+
+	end := conn.newReply("")
+	end.Code = ReplyEndOfHelp
+	end.Params = []string{nick, subject}
+	end.Trailing = "End of /HELP"
+	batch.add(end)
 
-	for _, m := range messages {
-		conn.Write(m.RenderBuffer())
+	for i := range batch.messages {
+		conn.WriteMessage(batch.messages[i])
 	}
 }
+
+// ReplyHelpNotFound returns an error message to the user when there is no help
+// available on the subject.
+func (conn *Conn) ReplyHelpNotFound(subject string) {
+	conn.ReplyNumeric(ReplyHelpNotFound, subject)
+}
+
+// ReplyYoureBanned returns an error message to the user when they are banned from
+// the server, with the given reason.
+func (conn *Conn) ReplyYoureBanned(reason string) {
+	conn.ReplyNumeric(ReplyYoureBanned, fmt.Sprintf("%s: %s", ErrYoureBanned, reason))
+}
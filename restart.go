@@ -0,0 +1,251 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Environment variables used to hand listening sockets over to a restarted process.
+const (
+	envRestartFDs   = "DIRCD_RESTART_FDS"   // Number of inherited listener descriptors, starting at fd 3.
+	envRestartReady = "DIRCD_RESTART_READY" // Descriptor of the pipe used to signal readiness to the parent.
+)
+
+// restartReadyTimeout sets how long the new process has to report that it is ready
+// before the restart is abandoned and the current process continues serving.
+const restartReadyTimeout = 30 * time.Second
+
+// inheritedListeners returns the listening sockets handed over by a parent process
+// during a restart, along with the pipe used to report readiness to it, if any.
+//
+// The environment variables are cleared so they are not passed on to any further
+// children started by this process.
+func inheritedListeners() ([]*net.TCPListener, *os.File, error) {
+	count, readyFD := os.Getenv(envRestartFDs), os.Getenv(envRestartReady)
+	if count == "" {
+		return nil, nil, nil
+	}
+	_ = os.Unsetenv(envRestartFDs)
+	_ = os.Unsetenv(envRestartReady)
+
+	fds, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s value [%s]: %w", envRestartFDs, count, err)
+	}
+
+	listeners, err := fileListeners(3, fds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ready *os.File
+	if fd, atoiErr := strconv.Atoi(readyFD); atoiErr == nil {
+		ready = os.NewFile(uintptr(fd), "restart-ready")
+	}
+
+	return listeners, ready, nil
+}
+
+// fileListeners adopts count consecutive inherited listening socket descriptors starting at first.
+func fileListeners(first, count int) ([]*net.TCPListener, error) {
+	listeners := make([]*net.TCPListener, 0, count)
+	for fd := first; fd < first+count; fd++ {
+		file := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error adopting inherited listener fd [%d]: %w", fd, err)
+		}
+
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			_ = listener.Close()
+			return nil, fmt.Errorf("inherited listener fd [%d] is not a TCP socket", fd)
+		}
+		listeners = append(listeners, tcpListener)
+	}
+	return listeners, nil
+}
+
+// takeInheritedListener returns and removes the inherited listener bound to the given address, if any.
+func (srv *Server) takeInheritedListener(address *net.TCPAddr) *net.TCPListener {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for i, listener := range srv.inherited {
+		if sameAddress(listener.Addr().(*net.TCPAddr), address) {
+			srv.inherited = slices.Delete(srv.inherited, i, i+1)
+			return listener
+		}
+	}
+	return nil
+}
+
+// closeInheritedListeners closes any inherited listeners which no configured listener claimed.
+func (srv *Server) closeInheritedListeners() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, listener := range srv.inherited {
+		srv.logger.WithField("sub-component", "listener").
+			Warnf("closing inherited listener at [%s] which matches no configured listener", listener.Addr())
+		_ = listener.Close()
+	}
+	srv.inherited = nil
+}
+
+// notifyReady reports to the service manager and to the parent process, if the server
+// was started by Restart, that all listeners are bound and it is now accepting connections.
+func (srv *Server) notifyReady() {
+	srv.notifyService(fmt.Sprintf("%s\nMAINPID=%d\nSTATUS=Accepting connections", sdReady, os.Getpid()))
+
+	srv.mu.Lock()
+	ready := srv.restartReady
+	srv.restartReady = nil
+	srv.mu.Unlock()
+
+	if ready != nil {
+		_, _ = ready.Write([]byte{1})
+		_ = ready.Close()
+	}
+}
+
+// Restart starts a new instance of the running executable with the same arguments and
+// hands the listening sockets over to it, so that the binary can be upgraded without
+// refusing any connections.
+//
+// Once the new process reports that it is accepting connections, this server stops
+// accepting new connections and drains the existing ones, which are served until they
+// disconnect, or until drainTimeout elapses if it is non-zero, after which they are
+// closed. ListenAndServe then returns ErrServerClosed as it would after Shutdown.
+//
+// If the new process fails to start or become ready, it is killed and this server
+// carries on serving as before.
+//
+// When running under a systemd Type=notify unit, the unit must set NotifyAccess=all so
+// that the new process may report itself as the main process of the service.
+func (srv *Server) Restart(drainTimeout time.Duration) error {
+	logger := srv.logger.WithField("operation", "restart")
+
+	srv.mu.Lock()
+	listeners := slices.Clone(srv.bound)
+	srv.mu.Unlock()
+
+	if len(listeners) == 0 || srv.shuttingDown() {
+		return errors.New("restart requires the server to be listening")
+	}
+
+	srv.notifyService(sdReloading)
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			srv.notifyService(sdReady)
+		}
+	}()
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for i := range files {
+			_ = files[i].Close()
+		}
+	}()
+
+	for i := range listeners {
+		file, err := listeners[i].File()
+		if err != nil {
+			return fmt.Errorf("error duplicating listener [%s]: %w", listeners[i].Addr(), err)
+		}
+		files = append(files, file)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error creating restart readiness pipe: %w", err)
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envRestartFDs, len(listeners)),
+		fmt.Sprintf("%s=%d", envRestartReady, 3+len(listeners)),
+	)
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("error starting new process: %w", err)
+	}
+	logger.Infof("started new process [%d], handing over %d listener(s)", cmd.Process.Pid, len(listeners))
+
+	// Close our copy of the write end so the read fails if the child exits without reporting.
+	_ = readyWrite.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := readyRead.Read(buf)
+		ready <- n == 1
+	}()
+
+	timer := time.NewTimer(restartReadyTimeout)
+	defer timer.Stop()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			_ = cmd.Process.Kill()
+			return errors.New("new process exited before becoming ready")
+		}
+	case exitErr := <-exited:
+		return fmt.Errorf("new process exited before becoming ready: %w", exitErr)
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process did not become ready within %v", restartReadyTimeout)
+	}
+
+	logger.Info("new process is ready, no longer accepting connections and draining existing connections")
+
+	handedOver = true
+	srv.handedOver.Store(true)
+
+	srv.inShutdown.Store(true)
+	srv.mu.Lock()
+	closeErr := srv.closeListenersLocked()
+	srv.mu.Unlock()
+
+	if drainTimeout > 0 {
+		go func() {
+			if waitTimeout(&srv.connectionGroup, drainTimeout) {
+				logger.Infof("connections did not drain within %v, closing remaining connections", drainTimeout)
+				_ = srv.Close()
+			}
+		}()
+	}
+
+	return closeErr
+}
@@ -8,22 +8,42 @@
 package dircd
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MessageContext struct {
-	Conn    *Conn
-	Msg     *Message
-	handler string
-	handled bool
-	abort   bool
-	err     error
+	Conn     *Conn
+	Msg      *Message
+	ctx      context.Context
+	log      Logger
+	handlers HandlersChain
+	index    int
+	handler  string
+	handled  bool
+	abort    bool
+	err      error
+
+	// called holds the names of the handlers called, when the span of the command is
+	// being recorded.
+	called []string
+}
+
+// Context returns the context of handling the command, which carries its trace span and
+// is cancelled when the connection is closed.
+func (c *MessageContext) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // Handled signals to the router to not call the next MessageHandler in the chain if applicable
@@ -38,6 +58,54 @@ func (c *MessageContext) AbortWithError(err error) {
 	c.err = err
 }
 
+// Next calls the remaining handlers in the chain, returning once they have all been called
+// or the chain has been stopped. It is for middleware which must act after the handlers,
+// and is otherwise called by the router.
+func (c *MessageContext) Next() {
+	for c.index++; c.index < len(c.handlers); c.index++ {
+		c.handler = nameOfFunction(c.handlers[c.index])
+		if c.called != nil {
+			c.called = append(c.called, c.handler)
+		}
+		c.handlers[c.index](c)
+		if c.handled {
+			c.index = len(c.handlers)
+			return
+		}
+		if c.err != nil {
+			c.log.Warn(fmt.Errorf("error encounterd handling command with handler [%s]: %w", c.handler, c.err))
+		}
+		if c.abort && len(c.handlers) > 1 {
+			c.log.Debugf("command handler chain aborted at: %s", c.handler)
+			c.index = len(c.handlers)
+			return
+		}
+	}
+}
+
+// ReplyNumeric sends the numeric reply to the user, addressed to their nick, or * if they
+// have not yet set one. The last parameter is sent as the trailing parameter. The reply is
+// labelled with the label of the message if the user has enabled labeled-response.
+func (c *MessageContext) ReplyNumeric(code uint16, params ...string) {
+	c.Conn.replyNumeric(c.label(), code, params)
+}
+
+// ReplyCommand sends the command to the user from the server. The last parameter is sent
+// as the trailing parameter. The reply is labelled with the label of the message if the
+// user has enabled labeled-response.
+func (c *MessageContext) ReplyCommand(command string, params ...string) {
+	c.Conn.replyCommand(c.label(), command, params)
+}
+
+// label returns the label of the message to add to replies, or an empty string if it has
+// none or the user has not enabled labeled-response.
+func (c *MessageContext) label() string {
+	if c.Msg == nil || !c.Conn.HasCap(LabeledResponse) {
+		return ""
+	}
+	return c.Msg.Tags["label"]
+}
+
 // MessageHandler defines the function signature of a handler used to process IRC messages.
 type MessageHandler func(*MessageContext)
 
@@ -51,6 +119,7 @@ type IRouter interface {
 type IRoutes interface {
 	Use(...MessageHandler) IRoutes
 	Handle(string, ...MessageHandler) IRoutes
+	HandleSpec(string, CommandSpec, ...MessageHandler) IRoutes
 }
 
 // HandlersChain defines a HandlerFunc slice.
@@ -65,12 +134,25 @@ func (c HandlersChain) Last() MessageHandler {
 }
 
 type Router struct {
-	logger *logrus.Entry
+	logger Logger
+	tracer trace.Tracer
 	RouterGroup
 	HandlerMap map[string]HandlersChain
+	specs      map[string]*CommandSpec
+	aliases    map[string]string
+
+	// unregistered holds the commands routed for connections which have not completed
+	// registration, any other command is refused with ERR_NOTREGISTERED.
+	unregistered map[string]struct{}
+
+	// counts holds the number of times each registered command has been routed, and
+	// latencies how long its handler chain took when timed by the Timing middleware.
+	// Entries are only added at registration, so the maps themselves need no locking.
+	counts    map[string]*atomic.Uint64
+	latencies map[string]*latencyHistogram
 }
 
-func NewRouter(logger *logrus.Entry) *Router {
+func NewRouter(logger Logger) *Router {
 	if logger == nil {
 		panic("must provide a logger to NewRouter")
 	}
@@ -78,7 +160,16 @@ func NewRouter(logger *logrus.Entry) *Router {
 	log := logger.WithField("sub-component", "router")
 	r := &Router{
 		logger:     log,
+		tracer:     defaultTracer(),
 		HandlerMap: make(map[string]HandlersChain),
+		specs:      make(map[string]*CommandSpec),
+		aliases:    make(map[string]string),
+		unregistered: map[string]struct{}{
+			CmdCap: {}, CmdPass: {}, CmdNick: {}, CmdUser: {}, CmdAuth: {},
+			CmdPing: {}, CmdPong: {}, CmdQuit: {}, CmdStartTLS: {},
+		},
+		counts:    make(map[string]*atomic.Uint64),
+		latencies: make(map[string]*latencyHistogram),
 	}
 	r.root = true
 	r.router = r
@@ -87,18 +178,127 @@ func NewRouter(logger *logrus.Entry) *Router {
 
 func (router *Router) addHandler(command string, handlers HandlersChain) {
 	if command == "" {
-		router.logger.Panicln("command must not be an empty string")
+		router.logger.Panic("command must not be an empty string")
 	}
+	command = strings.ToUpper(command)
 
 	if len(handlers) == 0 {
-		router.logger.Panicln("there must be at least one handler")
+		router.logger.Panic("there must be at least one handler")
 	}
 
 	if _, exists := router.HandlerMap[command]; exists {
-		router.logger.Panicln(fmt.Sprintf("handler(s) already registered for command: %s", command))
+		router.logger.Panic(fmt.Sprintf("handler(s) already registered for command: %s", command))
+	}
+
+	if _, exists := router.aliases[command]; exists {
+		router.logger.Panic(fmt.Sprintf("command is already registered as an alias: %s", command))
 	}
 
 	router.HandlerMap[command] = handlers
+	router.counts[command] = &atomic.Uint64{}
+	router.latencies[command] = newLatencyHistogram()
+}
+
+// Alias registers an alternative name for the command, eg: MSG for PRIVMSG, which is
+// routed to the handlers of the command.
+func (router *Router) Alias(alias, command string) {
+	alias, command = strings.ToUpper(alias), strings.ToUpper(command)
+	if alias == "" {
+		router.logger.Panic("alias must not be an empty string")
+	}
+
+	if _, exists := router.HandlerMap[command]; !exists {
+		router.logger.Panic(fmt.Sprintf("no handler(s) registered for aliased command: %s", command))
+	}
+
+	if _, exists := router.HandlerMap[alias]; exists {
+		router.logger.Panic(fmt.Sprintf("alias is already registered as a command: %s", alias))
+	}
+
+	if _, exists := router.aliases[alias]; exists {
+		router.logger.Panic(fmt.Sprintf("alias already registered: %s", alias))
+	}
+
+	router.aliases[alias] = command
+}
+
+// resolve returns the registered command named by the command or one of its aliases,
+// compared case-insensitively.
+func (router *Router) resolve(command string) string {
+	command = strings.ToUpper(command)
+	if aliased, exists := router.aliases[command]; exists {
+		return aliased
+	}
+	return command
+}
+
+// AllowUnregistered adds the commands to those routed for connections which have not
+// completed registration, eg: those used to negotiate before registering.
+func (router *Router) AllowUnregistered(commands ...string) {
+	for _, command := range commands {
+		router.unregistered[strings.ToUpper(command)] = struct{}{}
+	}
+}
+
+// allowedUnregistered reports whether the command is routed for connections which have
+// not completed registration.
+func (router *Router) allowedUnregistered(command string) bool {
+	_, allowed := router.unregistered[command]
+	return allowed
+}
+
+// Spec returns the spec registered for the command.
+func (router *Router) Spec(command string) (CommandSpec, bool) {
+	spec, exists := router.specs[router.resolve(command)]
+	if !exists {
+		return CommandSpec{}, false
+	}
+	return *spec, true
+}
+
+// CommandCounts returns the number of times each registered command has been handled.
+func (router *Router) CommandCounts() map[string]uint64 {
+	counts := make(map[string]uint64, len(router.counts))
+	for command, count := range router.counts {
+		counts[command] = count.Load()
+	}
+	return counts
+}
+
+// CommandLatencies returns the histogram of the latencies of each registered command which
+// has been timed by the Timing middleware.
+func (router *Router) CommandLatencies() map[string]LatencyHistogram {
+	latencies := make(map[string]LatencyHistogram, len(router.latencies))
+	for command, histogram := range router.latencies {
+		if snapshot := histogram.snapshot(); snapshot.Count > 0 {
+			latencies[command] = snapshot
+		}
+	}
+	return latencies
+}
+
+// CommandStats is a snapshot of the usage of a command.
+type CommandStats struct {
+	Command string
+	Count   uint64           // Number of times the command has been routed to its handlers.
+	Latency LatencyHistogram // Latencies of its handler chain, when timed by the Timing middleware.
+}
+
+// Snapshot returns the usage of each registered command which has been routed, sorted by
+// command, for reporting by embedders.
+func (router *Router) Snapshot() []CommandStats {
+	stats := make([]CommandStats, 0, len(router.counts))
+	for command, count := range router.counts {
+		if count := count.Load(); count > 0 {
+			stats = append(stats, CommandStats{
+				Command: command,
+				Count:   count,
+				Latency: router.latencies[command].snapshot(),
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Command < stats[j].Command })
+	return stats
 }
 
 // Use attaches a global middleware to the router. i.e. the middleware attached through Use() will be
@@ -143,6 +343,14 @@ func (group *RouterGroup) Handle(command string, handlers ...MessageHandler) IRo
 	return group.returnRouter()
 }
 
+// HandleSpec registers a new request handle and middleware with the given name, along with
+// the spec of the command, which is enforced before the handler chain is called.
+func (group *RouterGroup) HandleSpec(command string, spec CommandSpec, handlers ...MessageHandler) IRoutes {
+	routes := group.Handle(command, handlers...)
+	group.router.specs[strings.ToUpper(command)] = &spec
+	return routes
+}
+
 // Use adds middleware to the group
 func (group *RouterGroup) Use(middleware ...MessageHandler) IRoutes {
 	group.Handlers = append(group.Handlers, middleware...)
@@ -168,7 +376,7 @@ func (group *RouterGroup) returnRouter() IRouter {
 // For example, all the routes that use a common middleware for authorization could be grouped.
 func (group *RouterGroup) Group(handlers ...MessageHandler) *RouterGroup {
 	if len(handlers) == 0 {
-		group.router.logger.Panicln("a group must have at least one handler")
+		group.router.logger.Panic("a group must have at least one handler")
 	}
 
 	newGroup := &RouterGroup{
@@ -227,32 +435,51 @@ func nameOfFunction(f any) string {
 }
 
 // RouteMessage accepts an IRC message and matches it to a function in which is
-// configured to process the command specified in the message
+// configured to process the command specified in the message. The router takes ownership
+// of the message, recycling it once handled, so handlers must not keep it, or any of its
+// fields which the pool reuses, such as its tags, beyond their return.
 func (router *Router) RouteMessage(conn *Conn, msg *Message) {
-	defer msgPool.Recycle(msg)
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Command = router.resolve(msg.Command)
 	log := router.logger.WithField("command", msg.Command)
+
+	spanCtx, span := router.startCommandSpan(conn, msg)
+	ctx := &MessageContext{Conn: conn, Msg: msg, ctx: spanCtx, log: log, index: -1}
+	if span.IsRecording() {
+		ctx.called = make([]string, 0, 4)
+	}
+	outcome := ""
+	defer func() { ctx.endCommandSpan(span, outcome) }()
+
+	if conn != nil && !conn.isRegistered() && !router.allowedUnregistered(msg.Command) {
+		outcome = outcomeNotRegistered
+		if spec, exists := router.specs[msg.Command]; !exists || !spec.Silent {
+			conn.ReplyNotRegistered()
+		}
+		return
+	}
+
+	if conn != nil && conn.shunned(msg.Command) {
+		outcome = outcomeShunned
+		log.Debug("ignoring command from shunned user")
+		return
+	}
+
 	handlers, exists := router.HandlerMap[msg.Command]
 	if !exists {
+		outcome = outcomeNotImplemented
 		conn.ReplyNotImplemented(msg.Command)
-		defer msgPool.Recycle(msg)
 		log.Warnf("command not implemented encountered for: %s", msg.Command)
 		return
 	}
 
-	ctx := &MessageContext{Conn: conn, Msg: msg}
+	router.counts[msg.Command].Add(1)
+	ctx.handlers = handlers
 
-	for i := range handlers {
-		ctx.handler = nameOfFunction(handlers[i])
-		handlers[i](ctx)
-		if ctx.handled {
-			return
-		}
-		if ctx.err != nil {
-			log.Warn(fmt.Errorf("error encounterd handling command with handler [%s]: %w", ctx.handler, ctx.err))
-		}
-		if ctx.abort && len(handlers) > 1 {
-			log.Debugf("command handler chain aborted at: %s", ctx.handler)
-			return
-		}
+	if spec, exists := router.specs[msg.Command]; exists && !spec.enforce(ctx) {
+		outcome = outcomeRefused
+		return
 	}
+
+	ctx.Next()
 }
@@ -0,0 +1,105 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteAliases(t *testing.T) {
+	router := NewRouter(NewLogrusLogger(logrus.New()))
+
+	var routed []string
+	router.Handle(CmdPrivMsg, func(ctx *MessageContext) {
+		routed = append(routed, ctx.Msg.Command)
+	})
+	router.Alias("msg", CmdPrivMsg)
+
+	for _, command := range []string{"PRIVMSG", "privmsg", "MSG", "Msg"} {
+		msg := msgPool.New()
+		msg.Command = command
+		router.RouteMessage(nil, msg)
+	}
+	assert.Equal(t, []string{CmdPrivMsg, CmdPrivMsg, CmdPrivMsg, CmdPrivMsg}, routed)
+	assert.Equal(t, uint64(4), router.CommandCounts()[CmdPrivMsg])
+
+	assert.Panics(t, func() { router.Alias("MSG", CmdPrivMsg) })
+	assert.Panics(t, func() { router.Alias("NOTICE", "UNKNOWN") })
+	assert.Panics(t, func() { router.Handle("MSG", func(ctx *MessageContext) {}) })
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	router := NewRouter(NewLogrusLogger(logrus.New()))
+	router.Use(Recover, router.Timing)
+
+	var order []string
+	router.Use(func(ctx *MessageContext) {
+		order = append(order, "before")
+		ctx.Next()
+		order = append(order, "after")
+	})
+	router.Handle(CmdPrivMsg, func(ctx *MessageContext) {
+		ctx.Handled()
+		order = append(order, "handler")
+	})
+	router.Handle(CmdNotice, func(ctx *MessageContext) {
+		panic("handler failed")
+	})
+
+	for _, command := range []string{CmdPrivMsg, CmdNotice, CmdPrivMsg} {
+		msg := msgPool.New()
+		msg.Command = command
+		assert.NotPanics(t, func() { router.RouteMessage(nil, msg) })
+	}
+	assert.Equal(t, []string{"before", "handler", "after", "before", "before", "handler", "after"}, order)
+
+	latencies := router.CommandLatencies()
+	assert.Equal(t, uint64(2), latencies[CmdPrivMsg].Count)
+	assert.NotContains(t, latencies, CmdNotice)
+}
+
+func TestRouterSnapshot(t *testing.T) {
+	router := NewRouter(NewLogrusLogger(logrus.New()))
+	router.Use(router.Timing)
+	router.Handle(CmdPrivMsg, func(ctx *MessageContext) { ctx.Handled() })
+	router.Handle(CmdNotice, func(ctx *MessageContext) { ctx.Handled() })
+	router.Handle(CmdPing, func(ctx *MessageContext) { ctx.Handled() })
+
+	for _, command := range []string{CmdPrivMsg, CmdPing, CmdPrivMsg} {
+		msg := msgPool.New()
+		msg.Command = command
+		router.RouteMessage(nil, msg)
+	}
+
+	snapshot := router.Snapshot()
+	require.Len(t, snapshot, 2)
+	assert.Equal(t, CmdPing, snapshot[0].Command)
+	assert.Equal(t, uint64(1), snapshot[0].Count)
+	assert.Equal(t, CmdPrivMsg, snapshot[1].Command)
+	assert.Equal(t, uint64(2), snapshot[1].Count)
+	assert.Equal(t, uint64(2), snapshot[1].Latency.Count)
+	assert.Len(t, snapshot[1].Latency.Buckets, len(LatencyBuckets)+1)
+}
+
+func TestRouteUnregistered(t *testing.T) {
+	router := NewRouter(NewLogrusLogger(logrus.New()))
+
+	for _, command := range []string{CmdCap, CmdNick, CmdUser, CmdAuth, CmdPing, CmdPong, CmdQuit} {
+		assert.True(t, router.allowedUnregistered(command), command)
+	}
+	for _, command := range []string{CmdJoin, CmdPrivMsg, CmdWhois, CmdOper} {
+		assert.False(t, router.allowedUnregistered(command), command)
+	}
+
+	router.AllowUnregistered("webirc")
+	assert.True(t, router.allowedUnregistered("WEBIRC"))
+}
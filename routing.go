@@ -0,0 +1,402 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// linkedServer is a server on the network reached through a link, either the peer of
+// the link or a server introduced by it with SID.
+type linkedServer struct {
+	name        string
+	sid         string
+	description string
+	hops        int
+	uplink      string // The name of the server it is linked to.
+}
+
+// WithConnectBlock adds a connect block for the TS6 server with the given name and link
+// password, which operators with the routing privilege may link to at runtime with the
+// CONNECT command, dialing the address, and unlink from with SQUIT. The server must be
+// configured to accept the link with the same password for both directions.
+//
+// The linked server is treated as a services link, introducing its users as remote
+// users, and those of the servers behind it, which are shown by LINKS.
+func WithConnectBlock(name, address, password string) ServerOption {
+	return option(func(s *Server) error {
+		if len(name) == 0 || !strings.Contains(name, ".") {
+			return fmt.Errorf("invalid connect block server name [%s]: must contain a dot", name)
+		}
+		if len(password) == 0 || strings.ContainsAny(password, " :") {
+			return errors.New("connect block password must not be empty, or contain spaces or colons")
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid connect block address [%s]: %w", address, err)
+		}
+
+		for _, link := range s.connectBlocks {
+			if strings.EqualFold(link.name, name) {
+				return fmt.Errorf("duplicate connect block: %s", name)
+			}
+		}
+
+		s.connectBlocks = append(s.connectBlocks, &servicesLink{
+			server:   s,
+			address:  address,
+			name:     name,
+			password: password,
+			outbound: true,
+		})
+		return nil
+	})
+}
+
+// startConnectBlocks prepares the connect blocks to be linked with CONNECT.
+func (srv *Server) startConnectBlocks() {
+	for _, link := range srv.connectBlocks {
+		link.logger = srv.logger.WithFields(Fields{
+			"sub-component": "server-link",
+			"link":          link.name,
+		})
+		srv.registerOnShutdown(link.close)
+	}
+}
+
+// serverLinks returns the links of the server, the services link included.
+func (srv *Server) serverLinks() []*servicesLink {
+	links := slices.Clone(srv.connectBlocks)
+	if srv.servicesLink != nil {
+		links = append(links, srv.servicesLink)
+	}
+	return links
+}
+
+// findLink returns the link to the server with the name, if any.
+func (srv *Server) findLink(name string) *servicesLink {
+	for _, link := range srv.serverLinks() {
+		if strings.EqualFold(link.name, name) {
+			return link
+		}
+	}
+	return nil
+}
+
+// serverMap returns the servers of the network, this server first, then those reached
+// through its established links, nearest first.
+func (srv *Server) serverMap() []linkedServer {
+	var servers []linkedServer
+	for _, link := range srv.serverLinks() {
+		link.mu.Lock()
+		for _, server := range link.servers {
+			servers = append(servers, *server)
+		}
+		link.mu.Unlock()
+	}
+
+	slices.SortFunc(servers, func(a, b linkedServer) int {
+		if a.hops != b.hops {
+			return cmp.Compare(a.hops, b.hops)
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	local := linkedServer{
+		name:        srv.Hostname(),
+		sid:         srv.sid,
+		description: ts6ServerDescription,
+		uplink:      srv.Hostname(),
+	}
+	return append([]linkedServer{local}, servers...)
+}
+
+// connect dials the address of the outbound link and serves it, returning an error if
+// the link is already established or being established, or the address can't be reached.
+func (link *servicesLink) connect() error {
+	link.mu.Lock()
+	if link.conn != nil || link.connecting {
+		link.mu.Unlock()
+		return errors.New("already linked")
+	}
+	link.connecting = true
+	link.mu.Unlock()
+
+	defer func() {
+		link.mu.Lock()
+		link.connecting = false
+		link.mu.Unlock()
+	}()
+
+	conn, err := net.DialTimeout("tcp", link.address, ts6HandshakeTimeout)
+	if err != nil {
+		return err
+	}
+
+	established := make(chan error, 1)
+	go link.serve(conn, established)
+	return <-established
+}
+
+// squit closes the established link, once the SQUIT of the peer with the reason has been
+// sent to it, returning an error if it is not established.
+func (link *servicesLink) squit(reason string) error {
+	link.mu.Lock()
+	sid, established := link.sid, link.conn != nil
+	link.mu.Unlock()
+
+	if !established {
+		return errors.New("not linked")
+	}
+
+	link.send(fmt.Sprintf(":%s SQUIT %s :%s", link.server.sid, sid, reason))
+	link.send("")
+	return nil
+}
+
+// addServer adds a server introduced behind the peer with SID, returning an error if the
+// SID collides with this server, or a server already known on any link, in which case the
+// link must be dropped, as the network state can no longer be trusted.
+//
+//	:<uplink sid> SID <name> <hops> <sid> :<description>
+func (link *servicesLink) addServer(source string, params []string) error {
+	if len(params) < 4 || !serverIDPattern.MatchString(params[2]) {
+		link.logger.Warn("ignoring malformed SID")
+		return nil
+	}
+
+	sid := params[2]
+	if sid == link.server.sid || link.server.knownSID(sid, link) {
+		return fmt.Errorf("SID collision: %s (%s)", sid, params[0])
+	}
+
+	hops, _ := strconv.Atoi(params[1])
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if _, exists := link.servers[sid]; exists {
+		return fmt.Errorf("SID collision: %s (%s)", sid, params[0])
+	}
+
+	uplink := link.name
+	if server, exists := link.servers[source]; exists {
+		uplink = server.name
+		hops = max(hops, server.hops+1)
+	}
+	link.servers[sid] = &linkedServer{
+		name:        params[0],
+		sid:         sid,
+		description: params[3],
+		hops:        max(hops, 2),
+		uplink:      uplink,
+	}
+	return nil
+}
+
+// knownSID reports whether a server with the SID is reached through any link of the
+// server other than the given one.
+func (srv *Server) knownSID(sid string, except *servicesLink) bool {
+	for _, link := range srv.serverLinks() {
+		if link == except {
+			continue
+		}
+		link.mu.Lock()
+		_, exists := link.servers[sid]
+		link.mu.Unlock()
+		if exists {
+			return true
+		}
+	}
+	return false
+}
+
+// splitServer removes the server behind the peer with the SID or name, the servers behind
+// it, and the remote users on them, as in a netsplit. It reports whether the server was
+// found behind the peer, rather than being the peer, this server, or unknown.
+func (link *servicesLink) splitServer(target string) bool {
+	link.mu.Lock()
+	var split *linkedServer
+	for _, server := range link.servers {
+		if server.sid == target || strings.EqualFold(server.name, target) {
+			split = server
+		}
+	}
+	if split == nil || split.sid == link.sid {
+		link.mu.Unlock()
+		return false
+	}
+
+	removed := map[string]string{split.name: split.sid}
+	for found := true; found; {
+		found = false
+		for _, server := range link.servers {
+			if _, behind := removed[server.uplink]; behind {
+				if _, seen := removed[server.name]; !seen {
+					removed[server.name] = server.sid
+					found = true
+				}
+			}
+		}
+	}
+
+	sids := make(map[string]bool, len(removed))
+	for _, sid := range removed {
+		sids[sid] = true
+		delete(link.servers, sid)
+	}
+	link.mu.Unlock()
+
+	reason := split.uplink + SPACE + split.name
+	link.server.uids.ForEach(func(_ string, user *User) error {
+		if uid := user.UID(); user.link == link && len(uid) > 3 && sids[uid[:3]] {
+			link.server.quitRemote(user, reason)
+		}
+		return nil
+	})
+
+	link.logger.Infof("server [%s] split from [%s]", split.name, split.uplink)
+	return true
+}
+
+// doConnect links the server to the server of the named connect block on behalf of the operator.
+func (conn *Conn) doConnect(name string) {
+	link := conn.server.findLink(name)
+	if link == nil || !link.outbound {
+		conn.ReplyNumeric(ReplyNoSuchServer, name)
+		return
+	}
+
+	conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdConnect, Target: link.name})
+	conn.ReplyServerNotice(fmt.Sprintf("Connecting to %s [%s]", link.name, link.address))
+
+	go func() {
+		if err := link.connect(); err != nil {
+			link.logger.Warn(fmt.Errorf("error linking to [%s]: %w", link.name, err))
+			conn.ReplyServerNotice(fmt.Sprintf("Link with %s failed: %s", link.name, err))
+			return
+		}
+		conn.ReplyServerNotice(fmt.Sprintf("Link with %s established", link.name))
+	}()
+}
+
+// doSquit unlinks the named server on behalf of the operator.
+func (conn *Conn) doSquit(name, reason string) {
+	link := conn.server.findLink(name)
+	if link == nil {
+		conn.ReplyNumeric(ReplyNoSuchServer, name)
+		return
+	}
+
+	if len(reason) == 0 {
+		reason = conn.user.Nick()
+	}
+	if err := link.squit(reason); err != nil {
+		conn.ReplyServerNotice(fmt.Sprintf("Cannot unlink %s: %s", link.name, err))
+		return
+	}
+
+	conn.server.publish(Event{Type: EventOperAction, Actor: conn.user.Hostmask(), Action: CmdSquit, Target: link.name, Reason: reason})
+	conn.ReplyServerNotice(fmt.Sprintf("Unlinking %s: %s", link.name, reason))
+}
+
+// serverUsers returns the number of users on each server of the network, by SID.
+// Users of other nodes of a cluster are not counted, the cluster being a single server.
+func (srv *Server) serverUsers() map[string]int {
+	users := make(map[string]int)
+	srv.Nicks.ForEach(func(_ string, user *User) error {
+		switch uid := user.UID(); {
+		case user.link != nil && len(uid) > 3:
+			users[uid[:3]]++
+		case user.link == nil && len(user.node) == 0:
+			users[srv.sid]++
+		}
+		return nil
+	})
+	return users
+}
+
+// ReplyMap returns the servers of the network to the user as a tree, with the number of
+// users on each, eg:
+//
+//	irc.example.net[0DC] -------- | Users:    12 (60.0%)
+//	`- hub.example.net[1HB] ----- | Users:     0 (0.0%)
+//	   `- leaf.example.net[2LF] - | Users:     8 (40.0%)
+func (conn *Conn) ReplyMap() {
+	servers := conn.server.serverMap()
+	users := conn.server.serverUsers()
+
+	total := 0
+	for _, count := range users {
+		total += count
+	}
+
+	children := make(map[string][]linkedServer)
+	for _, server := range servers[1:] {
+		children[server.uplink] = append(children[server.uplink], server)
+	}
+
+	type entry struct {
+		label string
+		sid   string
+	}
+	var entries []entry
+	var walk func(server linkedServer, indent, branch string)
+	walk = func(server linkedServer, indent, branch string) {
+		entries = append(entries, entry{indent + branch + server.name + "[" + server.sid + "]", server.sid})
+		switch branch {
+		case "`- ":
+			indent += "   "
+		case "|- ":
+			indent += "|  "
+		}
+		below := children[server.name]
+		for i, child := range below {
+			if i == len(below)-1 {
+				walk(child, indent, "`- ")
+			} else {
+				walk(child, indent, "|- ")
+			}
+		}
+	}
+	walk(servers[0], "", "")
+
+	width := 0
+	for _, entry := range entries {
+		width = max(width, len(entry.label))
+	}
+	for _, entry := range entries {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(users[entry.sid]) / float64(total)
+		}
+		conn.ReplyNumeric(ReplyMap, fmt.Sprintf("%s %s | Users: %5d (%.1f%%)",
+			entry.label, strings.Repeat("-", width-len(entry.label)+1), users[entry.sid], share))
+	}
+	conn.ReplyNumeric(ReplyMapEnd)
+}
+
+// ReplyLinks returns the servers of the network whose name matches the mask to the user.
+func (conn *Conn) ReplyLinks(mask string) {
+	if len(mask) == 0 {
+		mask = "*"
+	}
+
+	for _, server := range conn.server.serverMap() {
+		if stringutils.MatchMask(mask, server.name) {
+			conn.ReplyNumeric(ReplyLinks, server.name, server.uplink, strconv.Itoa(server.hops), server.description)
+		}
+	}
+	conn.ReplyNumeric(ReplyEndOfLinks, mask)
+}
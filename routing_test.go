@@ -0,0 +1,262 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectSquit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithConnectBlock("hub.example.net", listener.Addr().String(), "secret"),
+		WithOper("admin", "hunter2", "*@*", PrivRouting),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+	srv.startConnectBlocks()
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("OPER admin hunter2")
+	expect(" 381 bob ")
+
+	route("LINKS")
+	expect(" 364 bob irc.example.net irc.example.net :0 " + ts6ServerDescription)
+	expect(" 365 bob * :End of LINKS list")
+	route("CONNECT nowhere.example.net")
+	expect(" 402 bob nowhere.example.net :No such server")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	route("CONNECT hub.example.net")
+	expect("Connecting to hub.example.net")
+
+	var peer net.Conn
+	select {
+	case peer = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not connect")
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+
+	scanner := bufio.NewScanner(peer)
+	readUntil := func(prefix string) {
+		t.Helper()
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), prefix) {
+				return
+			}
+		}
+		t.Fatalf("did not receive: %s", prefix)
+	}
+
+	// The initiator of the link introduces itself first.
+	readUntil("PASS secret TS 6 :" + defaultServerID)
+	readUntil("SERVER irc.example.net 1 ")
+	_, err = peer.Write([]byte("PASS secret TS 6 :1HB\r\n" +
+		"CAPAB :QS ENCAP EUID\r\n" +
+		"SERVER hub.example.net 1 :Hub server\r\n" +
+		":1HB SID leaf.example.net 2 2LF :Leaf server\r\n" +
+		":2LF EUID carol 2 123 +i carol host.example.net 0 2LFAAAAAA * * :Carol\r\n"))
+	require.NoError(t, err)
+	expect("Link with hub.example.net established")
+
+	require.Eventually(t, func() bool {
+		return srv.Nicks.Exists("carol")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	route("LINKS")
+	expect(" 364 bob irc.example.net irc.example.net :0 ")
+	expect(" 364 bob hub.example.net irc.example.net :1 Hub server")
+	expect(" 364 bob leaf.example.net hub.example.net :2 Leaf server")
+	route("LINKS leaf.*")
+	expect(" 365 bob leaf.* :End of LINKS list")
+
+	// The split of a server behind the peer removes its users, and it from the map.
+	_, err = peer.Write([]byte(":1HB SQUIT 2LF :Ping timeout\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return !srv.Nicks.Exists("carol")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, srv.serverMap(), 2)
+
+	route("SQUIT hub.example.net :maintenance")
+	expect("Unlinking hub.example.net: maintenance")
+	readUntil(":" + defaultServerID + " SQUIT 1HB :maintenance")
+	assert.False(t, scanner.Scan(), "the link is closed once the SQUIT is sent")
+
+	require.Eventually(t, func() bool {
+		return len(srv.serverMap()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	route("SQUIT hub.example.net")
+	expect("Cannot unlink hub.example.net: not linked")
+}
+
+func TestWithConnectBlock(t *testing.T) {
+	_, err := NewServer(WithConnectBlock("hub", "127.0.0.1:6666", "secret"))
+	assert.Error(t, err, "server names must contain a dot")
+	_, err = NewServer(WithConnectBlock("hub.example.net", "127.0.0.1", "secret"))
+	assert.Error(t, err, "addresses must have a port")
+	_, err = NewServer(WithConnectBlock("hub.example.net", "127.0.0.1:6666", "bad secret"))
+	assert.Error(t, err)
+	_, err = NewServer(
+		WithConnectBlock("hub.example.net", "127.0.0.1:6666", "secret"),
+		WithConnectBlock("HUB.example.net", "127.0.0.1:6667", "secret"),
+	)
+	assert.Error(t, err, "duplicate connect block")
+}
+
+func TestMap(t *testing.T) {
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithConnectBlock("hub.example.net", "127.0.0.1:6666", "secret"),
+		WithOper("admin", "hunter2", "*@*", PrivNone),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	// A hub linked with a leaf and a services server behind it, the leaf serving a user.
+	link := srv.connectBlocks[0]
+	link.sid = "1HB"
+	link.servers = map[string]*linkedServer{
+		"1HB": {name: "hub.example.net", sid: "1HB", hops: 1, uplink: "irc.example.net"},
+		"2LF": {name: "leaf.example.net", sid: "2LF", hops: 2, uplink: "hub.example.net"},
+		"3SV": {name: "services.example.net", sid: "3SV", hops: 2, uplink: "hub.example.net"},
+	}
+	carol := &User{nick: "carol", uid: "2LFAAAAAA", link: link}
+	srv.Nicks.Set(carol.nick, carol)
+	srv.uids.Set(carol.uid, carol)
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	route("MAP")
+	expect(" 481 bob ")
+
+	route("OPER admin hunter2")
+	route("MAP")
+	expect(" 015 bob :irc.example.net[0DC] ------------ | Users:     1 (50.0%)")
+	expect(" 015 bob :`- hub.example.net[1HB] --------- | Users:     0 (0.0%)")
+	expect(" 015 bob :   |- leaf.example.net[2LF] ----- | Users:     1 (50.0%)")
+	expect(" 015 bob :   `- services.example.net[3SV] - | Users:     0 (0.0%)")
+	expect(" 017 bob :End of MAP")
+}
+
+func TestSIDCollision(t *testing.T) {
+	tests := []struct {
+		name  string
+		burst string
+	}{
+		{
+			name:  "this server",
+			burst: ":1HB SID impostor.example.net 2 " + defaultServerID + " :Impostor\r\n",
+		},
+		{
+			name:  "another link",
+			burst: ":1HB SID leaf.example.net 2 2LF :Leaf server\r\n",
+		},
+		{
+			name: "the same link",
+			burst: ":1HB SID leaf.example.net 2 3LF :Leaf server\r\n" +
+				":1HB SID other.example.net 2 3LF :Other server\r\n",
+		},
+		{
+			name:  "peer of another link",
+			burst: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = listener.Close() })
+
+			srv, err := NewServer(
+				WithHostname("irc.example.net"),
+				WithConnectBlock("hub.example.net", listener.Addr().String(), "secret"),
+				WithConnectBlock("other.example.net", "127.0.0.1:6666", "secret"),
+			)
+			require.NoError(t, err)
+			srv.startConnectBlocks()
+
+			// Another link already reaches 2LF, and 4OT as its peer.
+			other := srv.connectBlocks[1]
+			other.sid = "4OT"
+			other.servers = map[string]*linkedServer{
+				"4OT": {name: "other.example.net", sid: "4OT", hops: 1, uplink: "irc.example.net"},
+				"2LF": {name: "leaf.example.net", sid: "2LF", hops: 2, uplink: "other.example.net"},
+			}
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+
+			link := srv.connectBlocks[0]
+			go func() { _ = link.connect() }()
+
+			var peer net.Conn
+			select {
+			case peer = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the server did not connect")
+			}
+			t.Cleanup(func() { _ = peer.Close() })
+
+			sid := "1HB"
+			if len(test.burst) == 0 {
+				sid = "4OT"
+			}
+			_, err = peer.Write([]byte("PASS secret TS 6 :" + sid + "\r\n" +
+				"CAPAB :QS ENCAP EUID\r\n" +
+				"SERVER hub.example.net 1 :Hub server\r\n" +
+				test.burst))
+			require.NoError(t, err)
+
+			// The link is dropped with an ERROR, keeping the servers known before it.
+			var last string
+			_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			scanner := bufio.NewScanner(peer)
+			for scanner.Scan() {
+				last = scanner.Text()
+			}
+			assert.True(t, strings.HasPrefix(last, "ERROR :Closing Link: "), last)
+			assert.Contains(t, last, "SID collision")
+
+			require.Eventually(t, func() bool {
+				link.mu.Lock()
+				defer link.mu.Unlock()
+				return link.conn == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Len(t, srv.serverMap(), 3)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SASL mechanism names.
+const (
+	saslMechPlain       = "PLAIN"
+	saslMechExternal    = "EXTERNAL"
+	saslMechOAuthBearer = "OAUTHBEARER"
+	saslMechIRCv3Bearer = "IRCV3BEARER"
+)
+
+// TokenValidator validates bearer tokens for the SASL OAUTHBEARER and IRCV3BEARER
+// mechanisms, such as the JWT validator in the auth packages.
+//
+// Implementations must be safe for concurrent use.
+type TokenValidator interface {
+	// ValidateToken returns the account name the token authenticates to, or
+	// ErrBadCredentials if it is invalid.
+	ValidateToken(ctx context.Context, token string) (string, error)
+}
+
+// WithTokenValidator sets the server to offer the SASL OAUTHBEARER and IRCV3BEARER
+// mechanisms, validating bearer tokens with the validator.
+func WithTokenValidator(validator TokenValidator) ServerOption {
+	return option(func(s *Server) error {
+		if validator == nil {
+			return errors.New("token validator must not be nil")
+		}
+		s.tokens = validator
+		return nil
+	})
+}
+
+// saslMechanisms returns the supported SASL mechanisms, as advertised in the sasl capability.
+func (srv *Server) saslMechanisms() []string {
+	if srv.tokens != nil {
+		return []string{saslMechPlain, saslMechExternal, saslMechOAuthBearer, saslMechIRCv3Bearer}
+	}
+	return []string{saslMechPlain, saslMechExternal}
+}
+
+// saslChunkLength is the maximum length of a single AUTHENTICATE payload line.
+const saslChunkLength = 400
+
+// saslMaxLength limits the total length of a reassembled AUTHENTICATE payload.
+const saslMaxLength = 8192
+
+// saslSession holds the state of an in-progress SASL exchange on a connection.
+// It is only accessed from the read loop goroutine.
+type saslSession struct {
+	mechanism string
+	buffer    bytes.Buffer
+}
+
+func (ss *saslSession) reset() {
+	ss.mechanism = ""
+	ss.buffer.Reset()
+}
+
+// doAuthenticate processes a single AUTHENTICATE line, either selecting a mechanism
+// to begin a new exchange, or carrying (a chunk of) the client response.
+func (conn *Conn) doAuthenticate(ctx context.Context, param string) {
+	session := &conn.sasl
+
+	if conn.user.Account() != "" {
+		conn.ReplySASL(ReplySASLAlready, ErrSASLAlready)
+		return
+	}
+
+	if param == "*" {
+		session.reset()
+		conn.ReplySASL(ReplySASLAborted, ErrSASLAborted)
+		return
+	}
+
+	if session.mechanism == "" {
+		mechanism := strings.ToUpper(param)
+		switch {
+		case !slices.Contains(conn.server.saslMechanisms(), mechanism):
+			conn.ReplySASLMechanisms()
+			conn.ReplySASL(ReplySASLFail, ErrSASLFailed)
+		case mechanism == saslMechExternal && conn.CertFP() == "":
+			conn.ReplySASL(ReplySASLFail, ErrNoCertificate)
+		default:
+			session.mechanism = mechanism
+			conn.ReplyAuthenticate("+")
+		}
+		return
+	}
+
+	if len(param) > saslChunkLength || session.buffer.Len()+len(param) > saslMaxLength {
+		session.reset()
+		conn.ReplySASL(ReplySASLTooLong, ErrSASLTooLong)
+		return
+	}
+
+	if param != "+" {
+		session.buffer.WriteString(param)
+	}
+
+	// A chunk of exactly the maximum length means more is to follow.
+	if len(param) == saslChunkLength {
+		return
+	}
+
+	mechanism := session.mechanism
+	response, decodeErr := base64.StdEncoding.DecodeString(session.buffer.String())
+	session.reset()
+	if decodeErr != nil {
+		conn.ReplySASL(ReplySASLFail, ErrSASLFailed)
+		return
+	}
+
+	ctx, span := conn.server.startSpan(ctx, "sasl.authenticate", attrSASLMech.String(mechanism))
+	account, authErr := conn.saslAuthenticate(ctx, mechanism, response)
+	if errors.Is(authErr, ErrBadCredentials) {
+		span.End()
+	} else {
+		endSpan(span, authErr)
+	}
+	if authErr != nil {
+		if !errors.Is(authErr, ErrBadCredentials) {
+			conn.logger.WithField("operation", "sasl").
+				Error(fmt.Errorf("error authenticating with mechanism [%s]: %w", mechanism, authErr))
+		}
+		conn.ReplySASL(ReplySASLFail, ErrSASLFailed)
+		return
+	}
+
+	conn.loginAccount(account)
+	conn.ReplySASL(ReplySASLSuccess, "SASL authentication successful")
+}
+
+// saslAuthenticate verifies the decoded client response for the mechanism,
+// returning the account authenticated to.
+func (conn *Conn) saslAuthenticate(ctx context.Context, mechanism string, response []byte) (*Account, error) {
+	switch mechanism {
+	case saslMechPlain:
+		// authzid NUL authcid NUL passwd
+		fields := bytes.Split(response, []byte{0})
+		if len(fields) != 3 {
+			return nil, ErrBadCredentials
+		}
+
+		authzid, authcid, password := string(fields[0]), string(fields[1]), string(fields[2])
+		if authzid != "" && !strings.EqualFold(authzid, authcid) {
+			return nil, ErrBadCredentials
+		}
+
+		return conn.server.authenticatePlain(ctx, authcid, password)
+
+	case saslMechExternal:
+		account, err := conn.server.accounts.byFingerprint(ctx, conn.CertFP())
+		if err != nil {
+			return nil, err
+		}
+
+		// The optional authzid must name the account the certificate is linked to.
+		if authzid := string(response); authzid != "" && !strings.EqualFold(authzid, account.Name) {
+			return nil, ErrBadCredentials
+		}
+
+		return account, nil
+
+	case saslMechOAuthBearer, saslMechIRCv3Bearer:
+		parse := parseOAuthBearer
+		if mechanism == saslMechIRCv3Bearer {
+			parse = parseIRCv3Bearer
+		}
+
+		authzid, token, err := parse(response)
+		if err != nil {
+			return nil, err
+		}
+		return conn.server.authenticateToken(ctx, authzid, token)
+	}
+
+	return nil, ErrBadCredentials
+}
+
+// authenticateToken returns the account the bearer token authenticates to, which the
+// optional authzid must name, or ErrBadCredentials.
+func (srv *Server) authenticateToken(ctx context.Context, authzid, token string) (*Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+
+	ctx, span := srv.startSpan(ctx, "auth.validate-token")
+	name, err := srv.tokens.ValidateToken(ctx, token)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if authzid != "" && !strings.EqualFold(authzid, name) {
+		return nil, ErrBadCredentials
+	}
+	return externalAccount(name)
+}
+
+// parseOAuthBearer parses an OAUTHBEARER client response (RFC 7628), returning the authzid
+// and token, eg: "n,a=alice,\x01auth=Bearer <token>\x01\x01".
+func parseOAuthBearer(response []byte) (string, string, error) {
+	fields := strings.Split(string(response), "\x01")
+	if len(fields) < 3 || fields[len(fields)-1] != "" || fields[len(fields)-2] != "" {
+		return "", "", ErrBadCredentials
+	}
+
+	// gs2-header: channel binding flag, optional authzid, and a trailing comma.
+	header := strings.Split(fields[0], ",")
+	if len(header) != 3 || header[0] != "n" || header[2] != "" {
+		return "", "", ErrBadCredentials
+	}
+	authzid := strings.TrimPrefix(header[1], "a=")
+	if authzid == header[1] && header[1] != "" {
+		return "", "", ErrBadCredentials
+	}
+
+	for _, pair := range fields[1 : len(fields)-2] {
+		key, value, _ := strings.Cut(pair, "=")
+		if scheme, token, ok := strings.Cut(value, " "); key == "auth" && ok && strings.EqualFold(scheme, "Bearer") {
+			return authzid, token, nil
+		}
+	}
+	return "", "", ErrBadCredentials
+}
+
+// parseIRCv3Bearer parses an IRCV3BEARER client response, returning the authzid and token,
+// eg: "alice\x00jwt\x00<token>".
+func parseIRCv3Bearer(response []byte) (string, string, error) {
+	fields := strings.Split(string(response), "\x00")
+	if len(fields) != 3 || (fields[1] != "jwt" && fields[1] != "oauth2") || len(fields[2]) == 0 {
+		return "", "", ErrBadCredentials
+	}
+	return fields[0], fields[2], nil
+}
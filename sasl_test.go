@@ -0,0 +1,73 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBearer(t *testing.T) {
+	tests := []struct {
+		name     string
+		parse    func([]byte) (string, string, error)
+		response string
+		authzid  string
+		token    string
+		err      error
+	}{
+		{
+			name:     "oauthbearer",
+			parse:    parseOAuthBearer,
+			response: "n,a=alice,\x01host=irc.example.com\x01auth=Bearer abc.def.ghi\x01\x01",
+			authzid:  "alice",
+			token:    "abc.def.ghi",
+		},
+		{
+			name:     "oauthbearer without authzid",
+			parse:    parseOAuthBearer,
+			response: "n,,\x01auth=bearer abc.def.ghi\x01\x01",
+			token:    "abc.def.ghi",
+		},
+		{
+			name:     "oauthbearer channel binding",
+			parse:    parseOAuthBearer,
+			response: "p=tls-unique,,\x01auth=Bearer abc.def.ghi\x01\x01",
+			err:      ErrBadCredentials,
+		},
+		{
+			name:     "oauthbearer without token",
+			parse:    parseOAuthBearer,
+			response: "n,,\x01host=irc.example.com\x01\x01",
+			err:      ErrBadCredentials,
+		},
+		{
+			name:     "ircv3bearer",
+			parse:    parseIRCv3Bearer,
+			response: "alice\x00jwt\x00abc.def.ghi",
+			authzid:  "alice",
+			token:    "abc.def.ghi",
+		},
+		{
+			name:     "ircv3bearer unknown type",
+			parse:    parseIRCv3Bearer,
+			response: "\x00saml\x00abc",
+			err:      ErrBadCredentials,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authzid, token, err := test.parse([]byte(test.response))
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.authzid, authzid)
+			assert.Equal(t, test.token, token)
+		})
+	}
+}
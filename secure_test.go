@@ -0,0 +1,118 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCertificate returns a certificate for irc.example.net signed by its own key.
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"irc.example.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSetTLS(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	tlsServer := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}})
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	go func() { _ = tlsClient.Handshake() }()
+	require.NoError(t, tlsServer.Handshake())
+
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	assert.False(t, conn.Secure())
+	conn.setTLS(tlsServer)
+	assert.True(t, conn.Secure())
+	assert.Contains(t, conn.Cipher(), "TLS 1.3 ")
+	assert.Empty(t, conn.CertFP(), "no client certificate was presented")
+}
+
+func TestUserMode(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	route("MODE bob")
+	expect(" 221 bob :+")
+	route("MODE bob +z")
+	expect(":bob MODE bob :+z")
+	route("MODE bob +s-Q")
+	expect(" 501 bob :" + ErrUModeUnknownFlag.Error())
+	route("MODE bob")
+	expect(" 221 bob :+z")
+	route("MODE alice +z")
+	expect(" 502 bob ")
+}
+
+func TestSecureOnly(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	_, routeAlice, expectAlice := connectClient(t, srv, "")
+	routeAlice("NICK alice")
+	routeAlice("USER alice 0 * :Alice")
+	routeAlice("MODE alice +z")
+	expectAlice(":alice MODE alice :+z")
+
+	_, routeBob, expectBob := connectClient(t, srv, "")
+	routeBob("NICK bob")
+	routeBob("USER bob 0 * :Bob")
+	expectBob(" 001 bob ")
+	routeBob("PRIVMSG alice :hello")
+	expectBob(" 531 bob alice :" + ErrSecureOnly.Error())
+
+	carol, routeCarol, expectCarol := connectClient(t, srv, "")
+	carol.mu.Lock()
+	carol.secure, carol.cipher = true, "TLS 1.3 TLS_AES_128_GCM_SHA256"
+	carol.mu.Unlock()
+	routeCarol("NICK carol")
+	routeCarol("USER carol 0 * :Carol")
+	expectCarol(" 001 carol ")
+	assert.True(t, carol.user.ModeIsSet(UModeSecured), "secure users are set +s when they register")
+
+	routeCarol("PRIVMSG alice :hello")
+	expectAlice(":carol!carol@")
+
+	// The cipher is only shown to the user themself.
+	routeCarol("WHOIS carol")
+	expectCarol(" 671 carol carol :is using a secure connection [TLS 1.3 TLS_AES_128_GCM_SHA256]")
+	routeBob("WHOIS carol")
+	expectBob(" 671 bob carol :is using a secure connection")
+	expectBob(" 318 bob carol ")
+}
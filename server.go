@@ -13,8 +13,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -22,17 +25,16 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/sourcegraph/conc"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/btnmasher/dircd/shared/logfmt"
 	"github.com/btnmasher/dircd/shared/pool"
 	"github.com/btnmasher/dircd/shared/safemap"
 )
 
-// keepAliveTimeout sets the connection timeout duration on the client IRC connections.
-const keepAliveTimeout = 2 * time.Minute
-
 // Reference to the global Message object pool.
-var msgPool = pool.New(NewMessage)
+var msgPool = messagePool{pool: pool.New(NewMessage)}
 
 // Reference to the global bytes.Buffer object pool.
 var bufPool = pool.New(func() *bytes.Buffer {
@@ -59,30 +61,107 @@ var defaultFormatter = logfmt.New(
 type Server struct {
 
 	// Configuration
-	hostname     string
-	motd         string
-	welcome      string
-	logger       *logrus.Entry
-	logLevel     logrus.Level
-	logFormatter logrus.Formatter
-	support      safemap.SafeMap[string, string]
-	listenAddr   *net.TCPAddr
-	tlsConfig    *tls.Config
+	hostname       string
+	motd           string
+	welcome        string
+	logger         Logger
+	logrus         *logrus.Logger
+	logLevel       logrus.Level
+	logFormatter   logrus.Formatter
+	logOutput      io.Writer
+	syslog         *syslogConfig
+	logLevels      *logLevels
+	snomask        *snomaskHook
+	support        *ISupport
+	censor         *Censor
+	casemapping    Casemapping
+	utf8Only       bool
+	ctcpReplies    bool
+	dcc            DCCPolicy
+	timeouts       *Timeouts
+	bufferSizes    *BufferSizes
+	geoIP          *geoIP
+	privacyLogging bool
+	tracer         trace.Tracer
+	clock          Clock
+	classes        []*connClass
+	listenConfigs  []*listenerConfig
+	tlsConfig      *tls.Config
+	tls            tlsSettings
+	certManager    *certManager
+	acmeManager    *autocert.Manager
+	acmeChallenge  *http.Server
+	storage        Storage
+	authProvider   AuthProvider
+	tokens         TokenValidator
+	debugServer    *http.Server
+	adminServer    *http.Server
+	opers          []*operBlock
+	configKLines   []*KLine
+	admin          adminInfo
+	webhooks       []*webhook
+	exports        []*eventExport
+	sid            string
+	guestPrefix    string
+	servicesLink   *servicesLink
+	connectBlocks  []*servicesLink
+	cluster        *cluster
+	modules        moduleState
+
+	shutdownMessage  string
+	shutdownDrain    time.Duration
+	alternateServers []string
+	rateBudgets      [rateClasses]RateBudget
+	multiSession     bool
+	alwaysOnTimeout  time.Duration
+	alwaysOnHistory  int
+	serviceAliases   map[string]string
+	chanServ         bool
+	memoQuota        int
+	memoExpiry       time.Duration
+	quitThreshold    int
+	quitQuiet        time.Duration
 
 	// Active State
-	Users    UserMap
-	Nicks    UserMap
-	Channels ChanMap
-	Router   *Router
+	Users        UserMap
+	Nicks        UserMap
+	Registry     *UserRegistry
+	Channels     ChanMap
+	Router       *Router
+	accounts     *accountStore
+	klines       *klineStore
+	shuns        *klineStore
+	filters      *filterStore
+	channelRegs  *channelRegStore
+	memos        *memoStore
+	capabilities *capRegistry
+	buffers      *connBuffers
+	quits        *quitBatcher
+	fanOut       *fanOutPool
+	welcomed     atomic.Pointer[renderedReply] // RPL_WELCOME, rendered on first use.
+	started      time.Time
+	events       eventBus
+	uids         UserMap
+	lockdown     atomic.Pointer[lockdownState]
+	limits       atomic.Pointer[Limits]
+	audit        auditLog
+	uidSeq       atomic.Uint64
 
 	// Synchronization
 	mu              sync.Mutex
 	rwm             sync.RWMutex
 	listener        net.Listener
 	listeners       map[*net.Listener]struct{}
+	bound           []*net.TCPListener
+	inherited       []*net.TCPListener
+	restartReady    *os.File
 	activeConn      map[*Conn]struct{}
 	onShutdown      []func()
+	onRehash        []func() error
 	inShutdown      atomic.Bool // true when server is in shutdown
+	warmedUp        atomic.Bool // true once the server has been started
+	handedOver      atomic.Bool // true when listeners have been handed over to a restarted process
+	draining        atomic.Bool // true when listeners have been closed by Drain
 	listenerGroup   sync.WaitGroup
 	connectionGroup conc.WaitGroup
 }
@@ -101,15 +180,28 @@ func (o option) apply(s *Server) error {
 func NewServer(options ...ServerOption) (*Server, error) {
 	server := &Server{
 		logLevel: logrus.InfoLevel,
-		Users:    safemap.NewSyncMap[string, *User](),
-		Nicks:    safemap.NewSyncMap[string, *User](),
-		Channels: safemap.NewSyncMap[string, *Channel](),
-		support:  safemap.NewSyncMap[string, string](),
+		support:  newISupport(),
+		censor:   newCensor(),
+		uids:     safemap.NewSyncMap[string, *User](),
+		sid:      defaultServerID,
+		tracer:   defaultTracer(),
+		clock:    systemClock{},
+
+		shutdownMessage: defaultShutdownMessage,
+		shutdownDrain:   defaultShutdownDrain,
+		rateBudgets:     defaultRateBudgets,
 	}
+	server.Users = safemap.NewFoldedMap(safemap.NewSyncMap[string, *User](), server.Casefold)
+	server.Nicks = safemap.NewFoldedMap(safemap.NewSyncMap[string, *User](), server.Casefold)
+	server.Channels = safemap.NewFoldedMap(safemap.NewSyncMap[string, *Channel](), server.Casefold)
+	server.Registry = newUserRegistry(server)
 
-	server.registerOnShutdown(server.broadcastShutdownNotice)
+	inherited, ready, inheritErr := inheritedListeners()
+	activated, activateErr := systemdListeners()
+	optionErrors := errors.Join(inheritErr, activateErr)
+	server.inherited = append(inherited, activated...)
+	server.restartReady = ready
 
-	var optionErrors error
 	for i := range options {
 		err := options[i].apply(server)
 		if err != nil {
@@ -121,51 +213,201 @@ func NewServer(options ...ServerOption) (*Server, error) {
 		return nil, optionErrors
 	}
 
+	if err := server.setupClasses(); err != nil {
+		return nil, err
+	}
+
+	server.applyTLSSettings()
+
+	if server.storage == nil {
+		server.storage = NewMemoryStorage()
+	}
+	server.accounts = newAccountStore(server.storage, server.tracer)
+
+	klines, klineErr := newKLineStore(server.storage, klinesBucket)
+	if klineErr != nil {
+		return nil, klineErr
+	}
+	for _, kline := range server.configKLines {
+		klines.lines[strings.ToLower(kline.Mask)] = kline
+	}
+	server.klines = klines
+
+	shuns, shunErr := newKLineStore(server.storage, shunsBucket)
+	if shunErr != nil {
+		return nil, shunErr
+	}
+	server.shuns = shuns
+
+	filters, filterErr := newFilterStore(server.storage)
+	if filterErr != nil {
+		return nil, filterErr
+	}
+	server.filters = filters
+
+	channelRegs, channelRegErr := newChannelRegStore(server.storage, server.Casefold)
+	if channelRegErr != nil {
+		return nil, channelRegErr
+	}
+	server.channelRegs = channelRegs
+	server.memos = &memoStore{storage: server.storage}
+	server.capabilities = newCapRegistry(server)
+	server.buffers = newConnBuffers(server.BufferSizes())
+	server.quits = newQuitBatcher(server)
+	server.fanOut = newFanOutPool()
+	server.registerOnShutdown(server.fanOut.close)
+
 	if server.logger == nil {
 		_ = WithDefaultLogger().apply(server)
 	}
 
-	if server.logFormatter != nil {
-		server.logger.Logger.SetFormatter(server.logFormatter)
+	if server.logrus != nil {
+		if server.logFormatter != nil {
+			server.logrus.SetFormatter(server.logFormatter)
+		}
+
+		if server.logOutput != nil {
+			server.logrus.SetOutput(server.logOutput)
+		}
+
+		if server.logLevel != logrus.InfoLevel {
+			server.logrus.SetLevel(server.logLevel)
+		}
+	}
+
+	server.startLogLevels()
+
+	if err := server.startSyslog(); err != nil {
+		return nil, err
 	}
 
-	if server.logLevel != logrus.InfoLevel {
-		server.logger.Logger.SetLevel(server.logLevel)
+	if err := server.startLogSnomask(); err != nil {
+		return nil, err
+	}
+
+	if err := server.startAudit(); err != nil {
+		return nil, err
 	}
 
 	server.Router = NewRouter(server.logger)
+	server.Router.tracer = server.tracer
 
 	return server, nil
 }
 
-func (srv *Server) warmup() {
+// Start prepares the server to serve sessions, as ListenAndServe does before listening:
+// it registers the command handlers, loads the modules and starts the background tasks.
+// Start must be called before Serve or ServeConn, and does nothing if the server was
+// already started.
+func (srv *Server) Start() error {
+	return srv.warmup()
+}
+
+func (srv *Server) warmup() error {
+	if !srv.warmedUp.CompareAndSwap(false, true) {
+		return nil
+	}
 	logger := srv.logger.WithField("operation", "warmup")
 	logger.Info("registering message handlers")
 	srv.registerHandlers()
 
 	logger.Info("populating ISupport")
 	srv.populateISupport()
+
+	if len(srv.modules.modules) > 0 {
+		logger.Info("loading modules")
+	}
+	if err := srv.loadModules(); err != nil {
+		return err
+	}
+
+	srv.startCertificateManagement()
+	srv.startDebugEndpoint()
+	srv.startAdminAPI()
+	srv.startWebhooks()
+	srv.startEventExports()
+	srv.startServicesLink()
+	srv.startConnectBlocks()
+	srv.startCluster()
+	srv.startListSweeper()
+	srv.startPoolTuner()
+
+	srv.mu.Lock()
+	srv.started = time.Now()
+	srv.mu.Unlock()
+	return nil
 }
 
-func (srv *Server) broadcastShutdownNotice() {
+// GlobalNotice sends a NOTICE from the server with the given text to every registered user.
+func (srv *Server) GlobalNotice(text string) {
 	msg := msgPool.New()
-	msg.Source = srv.hostname
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = srv.Hostname()
 	msg.Command = CmdNotice
-	msg.Trailing = "The server is shutting down soon"
+	msg.Trailing = text
 
 	srv.Users.ForEach(func(_ string, user *User) error {
-		user.conn.Write(msg.RenderBuffer())
+		msg.Params = []string{user.Nick()}
+		user.Write(msg.RenderBuffer())
 		return nil
 	})
 }
 
-// Network returns the configured network name of the server in a concurrent safe manner
+// KillUser disconnects the user with the given nick, returning ErrNoSuchNick if there is none.
+// The source is reported to the user and their channels as the origin of the kill.
+func (srv *Server) KillUser(nick, reason, source string) error {
+	user, exists := srv.Nicks.Get(nick)
+	if !exists {
+		return ErrNoSuchNick
+	}
+
+	srv.logger.WithField("operation", "kill").Infof("killing [%s] by [%s]: %s", user.Hostmask(), source, reason)
+	if user.link != nil {
+		user.link.killRemote(user, reason, source)
+		return nil
+	}
+	if len(user.node) > 0 {
+		srv.cluster.killRemote(user, reason, source)
+		return nil
+	}
+	user.kill(reason, source)
+	return nil
+}
+
+// Rehash reloads the server's reloadable configuration: the certificate files configured
+// with WithCertificateFiles, followed by any hooks registered with WithRehashHook.
+func (srv *Server) Rehash() error {
+	srv.notifyService(sdReloading)
+	defer srv.notifyService(sdReady)
+
+	logger := srv.logger.WithField("operation", "rehash")
+	logger.Info("rehashing server")
+
+	errs := make([]error, 0)
+	if err := srv.ReloadCertificates(); err != nil {
+		errs = append(errs, err)
+	}
+
+	srv.mu.Lock()
+	hooks := srv.onRehash
+	srv.mu.Unlock()
+
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Network returns the configured network name of the server in a concurrent safe manner,
+// or the hostname of the server if none is configured.
 func (srv *Server) Network() string {
-	val, ok := srv.support.Get("network")
-	if ok {
-		return srv.Hostname()
+	if network, ok := srv.support.Get("network"); ok && len(network) > 0 {
+		return network
 	}
-	return val
+	return srv.Hostname()
 }
 
 func WithDefaultLogger() ServerOption {
@@ -173,7 +415,8 @@ func WithDefaultLogger() ServerOption {
 		logger := logrus.New()
 		logger.SetFormatter(defaultFormatter)
 		logger.SetReportCaller(true)
-		s.logger = logger.WithField("component", "irc-server")
+		s.logrus = logger
+		s.logger = NewLogrusLogger(logger).WithField("component", "irc-server")
 		return nil
 	})
 }
@@ -199,12 +442,25 @@ func WithDefaultLogFormatter() ServerOption {
 	})
 }
 
+// WithLogOutput sets the writer the server logger writes to, such as a rotating log file
+// from the shared/logrotate package, instead of stderr.
+func WithLogOutput(output io.Writer) ServerOption {
+	return option(func(s *Server) error {
+		if output == nil {
+			return errors.New("log output must not be nil")
+		}
+		s.logOutput = output
+		return nil
+	})
+}
+
 // WithLogger sets the configured logger for the server.
 // If logger is nil, then the default logger will be used at level INFO
 func WithLogger(logger *logrus.Logger) ServerOption {
 	return option(func(s *Server) error {
 		if logger != nil {
-			s.logger = logger.WithField("component", "irc-server")
+			s.logrus = logger
+			s.logger = NewLogrusLogger(logger).WithField("component", "irc-server")
 		}
 		return nil
 	})
@@ -213,32 +469,29 @@ func WithLogger(logger *logrus.Logger) ServerOption {
 // WithNetwork sets the configured network name of the server
 func WithNetwork(network string) ServerOption {
 	return option(func(s *Server) error {
-		s.support.Set("network", network)
+		if err := validISupportToken("NETWORK", network); err != nil {
+			return err
+		}
+		s.support.Network(network)
 		return nil
 	})
 }
 
-// Address returns the configured address string of the server
+// Address returns the configured address string of the first listener of the server
 func (srv *Server) Address() string {
 	srv.rwm.RLock()
 	defer srv.rwm.RUnlock()
 
-	if srv.listenAddr == nil {
+	if len(srv.listenConfigs) == 0 {
 		return ""
 	}
-	return srv.listenAddr.String()
+	return srv.listenConfigs[0].address.String()
 }
 
-// WithAddress sets the configured address of the server
+// WithAddress adds a plaintext listener at the given address to the server.
+// It is shorthand for WithListener(address).
 func WithAddress(address string) ServerOption {
-	return option(func(s *Server) error {
-		addr, err := net.ResolveTCPAddr("tcp", address)
-		if err != nil {
-			return err
-		}
-		s.listenAddr = addr
-		return nil
-	})
+	return WithListener(address)
 }
 
 // Hostname returns the configured hostname of the server in a concurrency safe manner
@@ -247,7 +500,10 @@ func (srv *Server) Hostname() string {
 	defer srv.rwm.RUnlock()
 
 	if len(srv.hostname) == 0 {
-		return fmt.Sprint(srv.listenAddr.IP)
+		if len(srv.listenConfigs) == 0 || srv.listenConfigs[0].address.IP == nil {
+			return "localhost"
+		}
+		return fmt.Sprint(srv.listenConfigs[0].address.IP)
 	}
 	return srv.hostname
 }
@@ -290,6 +546,16 @@ func (srv *Server) Welcome() string {
 	return srv.welcome
 }
 
+// welcomeReply returns the RPL_WELCOME reply of the server, rendered but for the nick.
+func (srv *Server) welcomeReply() renderedReply {
+	if reply := srv.welcomed.Load(); reply != nil {
+		return *reply
+	}
+	reply := renderReply(srv.Hostname(), ReplyWelcome, nil, srv.Welcome())
+	srv.welcomed.Store(&reply)
+	return reply
+}
+
 // WithWelcome sets the configured welcome message of the server
 func WithWelcome(msg string) ServerOption {
 	return option(func(s *Server) error {
@@ -336,6 +602,15 @@ func WithOnShutdownHook(hook func()) ServerOption {
 	})
 }
 
+// WithRehashHook registers a function to be called when the server is rehashed,
+// allowing embedders to reload their own configuration.
+func WithRehashHook(hook func() error) ServerOption {
+	return option(func(s *Server) error {
+		s.onRehash = append(s.onRehash, hook)
+		return nil
+	})
+}
+
 func waitTimeout(wg *conc.WaitGroup, timeout time.Duration) bool {
 	c := make(chan struct{})
 	go func() {
@@ -350,57 +625,61 @@ func waitTimeout(wg *conc.WaitGroup, timeout time.Duration) bool {
 	}
 }
 
-// ISupport returns a slice of formatted ISupport key=value pairs.
-func (srv *Server) ISupport() []string {
-	support := make([]string, 0, srv.support.Length())
-	var buffer bytes.Buffer
-
-	srv.support.ForEach(func(config, setting string) error {
-		buffer.WriteString(strings.ToUpper(config))
-
-		if len(setting) > 0 {
-			buffer.WriteString("=")
-			buffer.WriteString(setting)
-		}
-
-		support = append(support, buffer.String())
-		buffer.Reset()
-		return nil
-	})
-
-	return support
-}
-
-func (srv *Server) populateISupport() {
-	srv.support.Set("chanmodes", "bhoOv,p,LMT,AacEeFHIimNnPqRrstV")
-	srv.support.Set("prefix", "(Oohv)~@%+")
-	srv.support.Set("maxpara", fmt.Sprint(MaxMsgParams))
-	srv.support.Set("modes", fmt.Sprint(MaxModeChange))
-	srv.support.Set("chanlimit", fmt.Sprintf("#!:%v", MaxJoinedChans))
-	srv.support.Set("nicklen", fmt.Sprint(MaxNickLength))
-	srv.support.Set("maxlist", fmt.Sprintf("bhov:%v,O:1", MaxListItems))
-	srv.support.Set("casemapping", "ascii")
-	srv.support.Set("topiclen", fmt.Sprint(MaxTopicLength))
-	srv.support.Set("kicklen", fmt.Sprint(MaxKickLength))
-	srv.support.Set("chanlen", fmt.Sprint(MaxChanLength))
-	srv.support.Set("awaylen", fmt.Sprint(MaxAwayLength))
-}
-
 func (srv *Server) registerHandlers() {
-	srv.Router.Handle(CmdPing, HandlePing)
-	srv.Router.Handle(CmdPong, HandlePong)
-	srv.Router.Handle(CmdCap, HandleCap)
-	srv.Router.Handle(CmdNick, HandleNick)
-	srv.Router.Handle(CmdUser, HandleUser)
-	srv.Router.Handle(CmdQuit, HandleQuit)
+	srv.Router.Use(Recover, srv.Router.Timing)
+
+	srv.Router.HandleSpec(CmdPing, builtinSpecs[CmdPing], HandlePing)
+	srv.Router.HandleSpec(CmdPong, builtinSpecs[CmdPong], HandlePong)
+	srv.Router.HandleSpec(CmdCap, builtinSpecs[CmdCap], HandleCap)
+	srv.Router.HandleSpec(CmdNick, builtinSpecs[CmdNick], HandleNick)
+	srv.Router.HandleSpec(CmdUser, builtinSpecs[CmdUser], HandleUser)
+	srv.Router.HandleSpec(CmdQuit, builtinSpecs[CmdQuit], HandleQuit)
+	srv.Router.HandleSpec(CmdStartTLS, builtinSpecs[CmdStartTLS], HandleStartTLS)
+	srv.Router.HandleSpec(CmdAuth, builtinSpecs[CmdAuth], HandleAuthenticate)
 	//srv.Router.Handle(CmdPass, HandlePass)
 
-	registered := srv.Router.Group(MustBeRegistered)
-	{
-		registered.Handle(CmdJoin, HandleJoin)
-		registered.Handle(CmdPrivMsg, HandlePrivmsg)
-		registered.Handle(CmdNotice, HandleNotice)
-		registered.Handle(CmdUserhost, HandleUserhost)
+	srv.Router.HandleSpec(CmdJoin, builtinSpecs[CmdJoin], HandleJoin)
+	srv.Router.HandleSpec(CmdMode, builtinSpecs[CmdMode], HandleMode)
+	srv.Router.HandleSpec(CmdPrivMsg, builtinSpecs[CmdPrivMsg], HandlePrivmsg)
+	srv.Router.HandleSpec(CmdNotice, builtinSpecs[CmdNotice], HandleNotice)
+	srv.Router.HandleSpec(CmdUserhost, builtinSpecs[CmdUserhost], HandleUserhost)
+	srv.Router.HandleSpec(CmdWhois, builtinSpecs[CmdWhois], HandleWhois)
+	srv.Router.HandleSpec(CmdCertFP, builtinSpecs[CmdCertFP], HandleCertFP)
+	srv.Router.HandleSpec(CmdOper, builtinSpecs[CmdOper], HandleOper)
+	srv.Router.HandleSpec(CmdChallenge, builtinSpecs[CmdChallenge], HandleChallenge)
+	srv.Router.HandleSpec(CmdStats, builtinSpecs[CmdStats], HandleStats)
+	srv.Router.HandleSpec(CmdAdmin, builtinSpecs[CmdAdmin], HandleAdmin)
+	srv.Router.HandleSpec(CmdInfo, builtinSpecs[CmdInfo], HandleInfo)
+	srv.Router.HandleSpec(CmdVersion, builtinSpecs[CmdVersion], HandleVersion)
+	srv.Router.HandleSpec(CmdTime, builtinSpecs[CmdTime], HandleTime)
+	srv.Router.HandleSpec(CmdHelp, builtinSpecs[CmdHelp], HandleHelp)
+	srv.Router.HandleSpec(CmdLinks, builtinSpecs[CmdLinks], HandleLinks)
+	srv.Router.HandleSpec(CmdList, builtinSpecs[CmdList], HandleList)
+
+	srv.Router.HandleSpec(CmdKill, builtinSpecs[CmdKill], HandleKill)
+	srv.Router.HandleSpec(CmdKLine, builtinSpecs[CmdKLine], HandleKLine)
+	srv.Router.HandleSpec(CmdUnKLine, builtinSpecs[CmdUnKLine], HandleUnKLine)
+	srv.Router.HandleSpec(CmdBanInfo, builtinSpecs[CmdBanInfo], HandleBanInfo)
+	srv.Router.HandleSpec(CmdShun, builtinSpecs[CmdShun], HandleShun)
+	srv.Router.HandleSpec(CmdUnShun, builtinSpecs[CmdUnShun], HandleUnShun)
+	srv.Router.HandleSpec(CmdLockdown, builtinSpecs[CmdLockdown], HandleLockdown)
+	srv.Router.HandleSpec(CmdGlobops, builtinSpecs[CmdGlobops], HandleBroadcast)
+	srv.Router.HandleSpec(CmdGlobalNotice, builtinSpecs[CmdGlobalNotice], HandleBroadcast)
+	srv.Router.HandleSpec(CmdAudit, builtinSpecs[CmdAudit], HandleAudit)
+	srv.Router.HandleSpec(CmdFilter, builtinSpecs[CmdFilter], HandleFilter)
+	srv.Router.HandleSpec(CmdCensor, builtinSpecs[CmdCensor], HandleCensor)
+	srv.Router.HandleSpec(CmdDebug, builtinSpecs[CmdDebug], HandleDebug)
+	srv.Router.HandleSpec(CmdDrain, builtinSpecs[CmdDrain], HandleDrain)
+	srv.Router.HandleSpec(CmdRehash, builtinSpecs[CmdRehash], HandleRehash)
+	srv.Router.HandleSpec(CmdConnect, builtinSpecs[CmdConnect], HandleConnect)
+	srv.Router.HandleSpec(CmdSquit, builtinSpecs[CmdSquit], HandleSquit)
+	srv.Router.HandleSpec(CmdMap, builtinSpecs[CmdMap], HandleMap)
+
+	for alias, command := range builtinAliases {
+		srv.Router.Alias(alias, command)
+	}
+	for alias := range srv.serviceAliases {
+		srv.Router.HandleSpec(alias, serviceAliasSpec, HandleServiceAlias)
 	}
 
 	srv.Router.printHandlers()
@@ -421,6 +700,9 @@ func (srv *Server) registerOnShutdown(f func()) {
 // Returns any error returned from closing the Server's underlying Listener(s).
 func (srv *Server) Close() error {
 	srv.inShutdown.Store(true)
+	if !srv.handedOver.Load() {
+		srv.notifyService(sdStopping)
+	}
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	err := srv.closeListenersLocked()
@@ -471,6 +753,9 @@ const shutdownPollIntervalMax = 500 * time.Millisecond
 // future calls to methods such as Serve will return ErrServerClosed.
 func (srv *Server) Shutdown(ctx context.Context) error {
 	srv.inShutdown.Store(true)
+	if !srv.handedOver.Load() {
+		srv.notifyService(sdStopping)
+	}
 
 	srv.mu.Lock()
 	srv.logger.Debug("closing listeners")
@@ -552,7 +837,7 @@ func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
 		srv.listeners = make(map[*net.Listener]struct{})
 	}
 	if add {
-		if srv.shuttingDown() {
+		if srv.shuttingDown() || srv.Draining() {
 			return false
 		}
 		srv.listeners[ln] = struct{}{}
@@ -577,39 +862,27 @@ func (srv *Server) trackConn(conn *Conn, add bool) {
 	}
 }
 
-// ListenAndServe listens on the TCP network address srv.ListenAddr and
-// then calls Serve to handle the irc.Conn sessions.
+// ListenAndServe listens on every address configured with WithListener and
+// then calls Serve for each of them to handle the irc.Conn sessions.
 // Accepted connections are configured to enable TCP keep-alives.
 //
-// If srv.ListenAddr is blank, ":6667" is used.
+// If no listeners are configured, "localhost:6667" is used.
 //
 // ListenAndServe always returns a non-nil error.
 func (srv *Server) ListenAndServe() error {
-	srv.warmup()
-	logger := srv.logger.WithField("sub-component", "listener")
-	if srv.listenAddr == nil {
-		addr, addrErr := net.ResolveTCPAddr("tcp", "localhost:6667")
-		if addrErr != nil {
-			return errors.Join(addrErr, errors.New("error attempting to use fallback default address"))
-		}
-		logger.Infof("no address/port port specified, defaulting to [%v]", addr)
-		srv.listenAddr = addr
+	if err := srv.warmup(); err != nil {
+		return err
 	}
-
-	listener, listenErr := net.ListenTCP("tcp", srv.listenAddr)
-	if listenErr != nil {
-		return errors.Join(listenErr, errors.New("error attempting to create TCP listener"))
+	configs, err := srv.listenerConfigs("localhost:6667")
+	if err != nil {
+		return err
 	}
-
-	servErr := srv.serve(&tcpKeepAliveListener{*listener})
-
-	logger.Debug("waiting for connections to terminate")
-	srv.connectionGroup.Wait()
-	return servErr
+	return srv.listenAndServe(configs)
 }
 
-// ListenAndServeTLS listens on the TCP network address srv.Addr and
-// then calls Serve to handle the irc.Conn sessions on a TLS connection.
+// ListenAndServeTLS listens on every address configured with WithListener and
+// then calls Serve for each of them to handle the irc.Conn sessions on a TLS
+// connection, regardless of whether the listener was configured with ListenerTLS.
 // Accepted connections are configured to enable TCP keep-alive.
 //
 // Filenames containing a certificate and matching private key for the
@@ -619,41 +892,43 @@ func (srv *Server) ListenAndServe() error {
 // concatenation of the server's certificate, any intermediates, and
 // the CA's certificate.
 //
-// If the address of the Server is not configured, "localhost:6697" is used.
+// If no listeners are configured, "localhost:6697" is used.
 //
 // ListenAndServeTLS always returns a non-nil error.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
-	srv.warmup()
-	logger := srv.logger.WithField("sub-component", "listener")
-	if srv.listenAddr == nil {
-		addr, addrErr := net.ResolveTCPAddr("tcp", "localhost:6697")
-		if addrErr != nil {
-			return errors.Join(addrErr, errors.New("error attempting to use fallback default address"))
-		}
-		logger.Infof("no address/port port specified, defaulting to %v", addr)
+	if err := srv.warmup(); err != nil {
+		return err
 	}
 
-	config := srv.cloneTLSConfig()
-
-	if len(config.Certificates) == 0 && certFile != "" && keyFile != "" {
+	if certFile != "" && keyFile != "" {
 		cert, certErr := tls.LoadX509KeyPair(certFile, keyFile)
 		if certErr != nil {
 			return errors.Join(certErr, errors.New("error attempting to load TLS key pair"))
 		}
-		config.Certificates = append(config.Certificates, cert)
+
+		srv.rwm.Lock()
+		config := srv.cloneTLSConfig()
+		if len(config.Certificates) == 0 {
+			config.Certificates = append(config.Certificates, cert)
+		}
+		srv.tlsConfig = config
+		srv.rwm.Unlock()
 	}
 
-	listener, err := net.ListenTCP("tcp", srv.listenAddr)
+	configs, err := srv.listenerConfigs("localhost:6697", ListenerTLS())
 	if err != nil {
 		return err
 	}
 
-	tlsListener := tls.NewListener(&tcpKeepAliveListener{*listener}, config)
-	servErr := srv.serve(tlsListener)
+	for i := range configs {
+		if !configs[i].tls {
+			tlsConfig := *configs[i]
+			tlsConfig.tls = true
+			configs[i] = &tlsConfig
+		}
+	}
 
-	logger.Debug("waiting for connections to terminate")
-	srv.connectionGroup.Wait()
-	return servErr
+	return srv.listenAndServe(configs)
 }
 
 // Serve starts an IRC server which listens for connections on the given
@@ -661,12 +936,35 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 // instance of irc.Conn
 func (srv *Server) Serve(listen net.Listener) error {
 	logger := srv.logger.WithField("sub-component", "listener")
-	servErr := srv.serve(listen)
+	servErr := srv.serve(listen, &listenerConfig{})
 	logger.Debug("waiting for connections to terminate")
 	srv.connectionGroup.Wait()
 	return servErr
 }
 
+// ServeConn serves an IRC session on the given connection, obtained from any transport,
+// eg: an in-memory pipe, an SSH tunnel or a custom proxy, as though it was accepted by a
+// listener: it is tracked by the server and closed when it shuts down. ServeConn blocks
+// until the session ends, and closes the connection.
+//
+// ServeConn returns ErrServerClosed, closing the connection, if the server is shutting
+// down or draining.
+func (srv *Server) ServeConn(sock net.Conn) error {
+	if srv.shuttingDown() || srv.Draining() {
+		_ = sock.Close()
+		return ErrServerClosed
+	}
+
+	conn := NewConn(context.Background(), srv, sock, srv.logger)
+	done := make(chan struct{})
+	srv.connectionGroup.Go(func() {
+		defer close(done)
+		serve(conn)
+	})
+	<-done
+	return nil
+}
+
 const initialAcceptRetryDelay = 5 * time.Millisecond
 const maxAcceptRetryDelay = 1 * time.Second
 
@@ -687,8 +985,8 @@ func (oc *onceCloseListener) Close() error {
 	return oc.closeErr
 }
 
-func (srv *Server) serve(listen net.Listener) error {
-	logger := srv.logger.WithFields(logrus.Fields{"sub-component": "listener"})
+func (srv *Server) serve(listen net.Listener, cfg *listenerConfig) error {
+	logger := srv.logger.WithFields(Fields{"sub-component": "listener"})
 
 	listen = &onceCloseListener{Listener: listen}
 	defer func() {
@@ -703,20 +1001,23 @@ func (srv *Server) serve(listen net.Listener) error {
 	}
 	defer srv.trackListener(&listen, false)
 
-	logger.Printf("starting IRC server listener at local address [%s]", listen.Addr())
+	logger.Infof("starting IRC server listener at local address [%s]", listen.Addr())
+	if cfg.address != nil {
+		logger.Debugf("listener configuration: %s", cfg)
+	}
 
 	var retryDelay time.Duration // how long to sleep on accept failure
 	for {
 		logger.Debug("listening for connection...")
 		sock, acceptErr := listen.Accept()
-		if srv.shuttingDown() {
+		if srv.shuttingDown() || srv.Draining() {
 			logger.Debug("server shutting down, no longer accepting new connections")
 		} else {
 			logger.Debug("accepting connection...")
 		}
 
 		if acceptErr != nil {
-			if srv.shuttingDown() {
+			if srv.shuttingDown() || srv.Draining() {
 				return ErrServerClosed
 			}
 
@@ -745,10 +1046,19 @@ func (srv *Server) serve(listen net.Listener) error {
 
 		retryDelay = 0
 		conn := NewConn(context.Background(), srv, sock, srv.logger)
+		conn.listener = cfg
 		srv.connectionGroup.Go(func() { serve(conn) })
 	}
 }
 
+// hasTLSCertificates reports whether the server's TLS config is able to present a certificate.
+func (srv *Server) hasTLSCertificates() bool {
+	srv.rwm.RLock()
+	defer srv.rwm.RUnlock()
+
+	return srv.tlsConfig != nil && (len(srv.tlsConfig.Certificates) > 0 || srv.tlsConfig.GetCertificate != nil)
+}
+
 // Returns a shallow clone of the specified tls config. If cfg is nil, a new default tls.Config is returned.
 func (srv *Server) cloneTLSConfig() *tls.Config {
 	if srv.tlsConfig == nil {
@@ -768,6 +1078,7 @@ func (srv *Server) cloneTLSConfig() *tls.Config {
 // go away.
 type tcpKeepAliveListener struct {
 	net.TCPListener
+	period time.Duration
 }
 
 func (listen *tcpKeepAliveListener) Accept() (net.Conn, error) {
@@ -776,7 +1087,7 @@ func (listen *tcpKeepAliveListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 	_ = conn.SetKeepAlive(true)
-	_ = conn.SetKeepAlivePeriod(keepAliveTimeout)
+	_ = conn.SetKeepAlivePeriod(listen.period)
 	return conn, nil
 }
 
@@ -785,7 +1096,7 @@ func (srv *Server) ValidateName(name string) (error, uint16) {
 	switch {
 	case name == "":
 		return ErrNoNickGiven, ReplyNoNicknameGiven
-	case len(name) > MaxNickLength:
+	case len(name) > srv.Limits().NickLength:
 		fallthrough
 	case strings.HasPrefix(name, "#"):
 		fallthrough
@@ -793,6 +1104,8 @@ func (srv *Server) ValidateName(name string) (error, uint16) {
 		fallthrough
 	case strings.Contains(name, SPACE):
 		return ErrErroneousNickname, ReplyErroneusNickname
+	case srv.serviceNick(name):
+		return ErrNickRestricted, ReplyErroneusNickname
 	case srv.Nicks.Exists(name):
 		return ErrNickInUse, ReplyNicknameInUse
 	}
@@ -0,0 +1,57 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeConn(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	server, client := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeConn(server) }()
+
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = client.Write([]byte("NICK bob\r\nUSER bob 0 * :Bob\r\n"))
+	require.NoError(t, err)
+
+	lines := bufio.NewScanner(client)
+	welcomed := false
+	for !welcomed && lines.Scan() {
+		welcomed = strings.Contains(lines.Text(), " 001 bob ")
+	}
+	require.True(t, welcomed)
+	assert.True(t, srv.Nicks.Exists("bob"))
+
+	// The session ends, and the user quits, when the connection is closed.
+	require.NoError(t, client.Close())
+	select {
+	case err = <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+	assert.False(t, srv.Nicks.Exists("bob"))
+
+	// Connections are refused while the server drains.
+	require.NoError(t, srv.Drain())
+	server, client = net.Pipe()
+	defer client.Close()
+	assert.ErrorIs(t, srv.ServeConn(server), ErrServerClosed)
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// nickServ is the nick of the service handled by the server itself when no user holds it.
+const nickServ = "NickServ"
+
+// DefaultServiceAliases are the service commands other ircds commonly provide, mapped to
+// the nick of the service each is sent to, for use with WithServiceAliases.
+var DefaultServiceAliases = map[string]string{
+	"NS":       "NickServ",
+	"NICKSERV": "NickServ",
+	"CS":       "ChanServ",
+	"CHANSERV": "ChanServ",
+	"OS":       "OperServ",
+	"OPERSERV": "OperServ",
+	"HS":       "HostServ",
+	"HOSTSERV": "HostServ",
+	"MS":       "MemoServ",
+	"MEMOSERV": "MemoServ",
+	"BS":       "BotServ",
+	"BOTSERV":  "BotServ",
+}
+
+// WithServiceAliases adds commands which send their text to the service nick each is
+// mapped to, eg: "NS identify hunter2" as "PRIVMSG NickServ :identify hunter2", so that
+// users migrating from other ircds may keep using them. The messages are delivered to
+// the services linked to the server, see WithServicesLink, and while no user holds the
+// nick NickServ, its IDENTIFY and REGISTER commands are handled by the server itself with
+// the built-in account store. Local users may not take the nick of an aliased service.
+func WithServiceAliases(aliases map[string]string) ServerOption {
+	return option(func(s *Server) error {
+		for command, service := range aliases {
+			command = strings.ToUpper(command)
+			if len(command) == 0 || strings.ContainsAny(command, " :") {
+				return fmt.Errorf("service alias command [%s] is invalid", command)
+			}
+			if _, builtin := builtinSpecs[command]; builtin {
+				return fmt.Errorf("service alias command [%s] is a built-in command", command)
+			}
+			if _, builtin := builtinAliases[command]; builtin {
+				return fmt.Errorf("service alias command [%s] is a built-in alias", command)
+			}
+			if len(service) == 0 || strings.ContainsAny(service, " :#,") {
+				return fmt.Errorf("service nick [%s] of alias [%s] is invalid", service, command)
+			}
+
+			if s.serviceAliases == nil {
+				s.serviceAliases = make(map[string]string)
+			}
+			s.serviceAliases[command] = service
+		}
+		return nil
+	})
+}
+
+// serviceAliasSpec is the spec of each service alias command.
+var serviceAliasSpec = CommandSpec{Registered: true, Help: CommandHelp{Usage: "<text>", Text: []string{
+	"Sends the text to the service the command is an alias for.",
+}}}
+
+// HandleServiceAlias handles a service alias command by sending its text to the service.
+func HandleServiceAlias(ctx *MessageContext) {
+	ctx.Handled()
+	srv := ctx.Conn.server
+	service := srv.serviceAliases[ctx.Msg.Command]
+
+	text := strings.Join(ctx.Msg.Params, " ")
+	if !ctx.Msg.trailingImplied && len(ctx.Msg.Trailing) > 0 {
+		text = strings.TrimPrefix(text+" "+ctx.Msg.Trailing, " ")
+	}
+	if len(text) == 0 {
+		ctx.Conn.ReplyNoTextToSend()
+		return
+	}
+
+	if !srv.Nicks.Exists(service) && !srv.internalService(service) {
+		ctx.Conn.ReplyServicesDown(service)
+		return
+	}
+
+	ctx.Msg.Command = CmdPrivMsg
+	ctx.Msg.Params = []string{service}
+	ctx.Msg.Trailing = text
+	ctx.Msg.trailingImplied = false
+	ctx.Conn.doChatMessage(ctx.Msg)
+}
+
+// serviceNick reports whether the nick is that of an aliased service, or of the built-in
+// ChanServ or MemoServ while they are enabled.
+func (srv *Server) serviceNick(nick string) bool {
+	nick = srv.Casefold(nick)
+	if (srv.chanServ && nick == srv.Casefold(chanServ)) || (srv.memoQuota > 0 && nick == srv.Casefold(memoServ)) {
+		return true
+	}
+	for _, service := range srv.serviceAliases {
+		if srv.Casefold(service) == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// internalService reports whether messages to the service, held by no user, are handled
+// by the server itself.
+func (srv *Server) internalService(service string) bool {
+	switch srv.Casefold(service) {
+	case srv.Casefold(nickServ):
+		return srv.serviceNick(service)
+	case srv.Casefold(chanServ):
+		return srv.chanServ
+	case srv.Casefold(memoServ):
+		return srv.memoQuota > 0
+	}
+	return false
+}
+
+// doInternalService handles the text sent to a service held by no user, if the server
+// handles it itself, reporting whether it did.
+func (conn *Conn) doInternalService(service, text string) bool {
+	if !conn.server.internalService(service) {
+		return false
+	}
+	switch conn.server.Casefold(service) {
+	case conn.server.Casefold(chanServ):
+		conn.doChanServ(text)
+	case conn.server.Casefold(memoServ):
+		conn.doMemoServ(text)
+	default:
+		conn.doNickServ(text)
+	}
+	return true
+}
+
+// doNickServ handles the commands of the built-in NickServ:
+//
+//	IDENTIFY [account] <password>  Logs in to the account, named after the nick if not given.
+//	REGISTER <password>            Registers an account named after the nick, and logs in to it.
+func (conn *Conn) doNickServ(text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		fields = []string{""}
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "IDENTIFY", "ID", "LOGIN":
+		if account := conn.user.Account(); len(account) > 0 {
+			conn.serviceNotice(nickServ, fmt.Sprintf("You are already logged in as %s.", account))
+			return
+		}
+
+		var name, password string
+		switch len(fields) {
+		case 2:
+			name, password = conn.user.Nick(), fields[1]
+		case 3:
+			name, password = fields[1], fields[2]
+		default:
+			conn.serviceNotice(nickServ, "Syntax: IDENTIFY [account] <password>")
+			return
+		}
+
+		account, err := conn.server.authenticatePlain(conn.ctx, name, password)
+		if err != nil {
+			if !errors.Is(err, ErrBadCredentials) && !errors.Is(err, ErrNotFound) {
+				conn.logger.WithField("operation", "nickserv").
+					Error(fmt.Errorf("error identifying to account [%s]: %w", name, err))
+			}
+			conn.serviceNotice(nickServ, ErrBadCredentials.String())
+			return
+		}
+		conn.loginAccount(account)
+		conn.serviceNotice(nickServ, fmt.Sprintf("You are now identified for %s.", account.Name))
+
+	case "REGISTER":
+		if len(fields) < 2 {
+			conn.serviceNotice(nickServ, "Syntax: REGISTER <password>")
+			return
+		}
+		if account := conn.user.Account(); len(account) > 0 {
+			conn.serviceNotice(nickServ, fmt.Sprintf("You are already logged in as %s.", account))
+			return
+		}
+
+		name := conn.user.Nick()
+		if err := conn.server.RegisterAccount(name, fields[1]); err != nil {
+			var reason Error
+			if !errors.As(err, &reason) {
+				conn.logger.WithField("operation", "nickserv").
+					Error(fmt.Errorf("error registering account [%s]: %w", name, err))
+				reason = ErrRegistrationClosed
+			}
+			conn.serviceNotice(nickServ, reason.String())
+			return
+		}
+		conn.loginAccount(&Account{Name: name})
+		conn.serviceNotice(nickServ, fmt.Sprintf("The account %s has been registered, and you are now identified for it.", name))
+
+	default:
+		conn.serviceNotice(nickServ, "Commands: IDENTIFY [account] <password>, REGISTER <password>")
+	}
+}
+
+// serviceMask returns the hostmask of the service handled by the server itself.
+func (srv *Server) serviceMask(service string) string {
+	return service + "!" + service + "@" + srv.Hostname()
+}
+
+// serviceNotice sends a NOTICE from the service handled by the server itself to the user
+// with the text.
+func (conn *Conn) serviceNotice(service, text string) {
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = conn.server.serviceMask(service)
+	msg.Command = CmdNotice
+	msg.Params = []string{conn.replyNick()}
+	msg.Trailing = text
+	conn.WriteMessage(msg)
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAliasesOption(t *testing.T) {
+	_, err := NewServer(WithServiceAliases(map[string]string{"PRIVMSG": "NickServ"}))
+	assert.Error(t, err)
+	_, err = NewServer(WithServiceAliases(map[string]string{"NS": "#services"}))
+	assert.Error(t, err)
+
+	srv, err := NewServer(WithServiceAliases(DefaultServiceAliases))
+	require.NoError(t, err)
+	assert.Equal(t, "NickServ", srv.serviceAliases["NS"])
+
+	validationErr, code := srv.ValidateName("nickserv")
+	assert.ErrorIs(t, validationErr, ErrNickRestricted)
+	assert.Equal(t, ReplyErroneusNickname, code)
+}
+
+func TestServiceAliasInternalNickServ(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithServiceAliases(DefaultServiceAliases))
+	require.NoError(t, err)
+	srv.registerHandlers()
+	require.NoError(t, srv.RegisterAccount("bob", "hunter2"))
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+	expect(" 001 bob ")
+
+	route("NS identify wrong")
+	expect("NickServ!NickServ@irc.example.net NOTICE bob :" + ErrBadCredentials.String())
+	assert.Empty(t, conn.user.Account())
+
+	route("NS identify hunter2")
+	expect(" 900 bob ")
+	expect(" NOTICE bob :You are now identified for bob.")
+	assert.Equal(t, "bob", conn.user.Account())
+
+	route("PRIVMSG NickServ :identify bob hunter2")
+	expect(" NOTICE bob :You are already logged in as bob.")
+
+	// Services held by no user, and not handled by the server, are down.
+	route("CS info #dircd")
+	expect(" 440 bob ChanServ :" + ErrServicesDown.String())
+}
+
+func TestServiceAliasRegister(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithServiceAliases(map[string]string{"NS": "NickServ"}))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, route, expect := connectClient(t, srv, "")
+	route("NICK alice")
+	route("USER alice 0 * :Alice")
+	expect(" 001 alice ")
+
+	route("NS :register s3cret")
+	expect(" 900 alice ")
+	assert.Equal(t, "alice", conn.user.Account())
+
+	_, err = srv.authenticatePlain(conn.ctx, "alice", "s3cret")
+	assert.NoError(t, err)
+}
+
+func TestServiceAliasForwarded(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithServiceAliases(DefaultServiceAliases))
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	service, routeService, expectService := connectClient(t, srv, "")
+	routeService("NICK chanserv_")
+	routeService("USER chanserv 0 * :ChanServ")
+	expectService(" 001 chanserv_ ")
+
+	// Stand in for a service introduced by the services link.
+	srv.Nicks.Set("ChanServ", service.user)
+
+	_, route, _ := connectClient(t, srv, "")
+	route("NICK bob")
+	route("USER bob 0 * :Bob")
+
+	route("CS register #dircd")
+	expectService(" PRIVMSG ChanServ :register #dircd")
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// WithMultiSession lets connections authenticated to the same account share one user,
+// like a built-in bouncer. A connection registering while another user logged in to its
+// account is connected is attached to that user as another session, taking their nick,
+// rather than registering a user of its own. Everything sent to the user is sent to
+// each of their sessions, including the messages they send from another session, while
+// capabilities are negotiated by each session for itself. The user quits once their
+// last session disconnects.
+//
+// So that clients can reconnect with the nick they had, a connection which has not
+// registered may take the nick of a user logged in to an account, attaching to them if
+// it authenticates to the same account before registering, and otherwise being told the
+// nick is in use when it registers.
+func WithMultiSession() ServerOption {
+	return option(func(s *Server) error {
+		s.multiSession = true
+		return nil
+	})
+}
+
+// Sessions returns the connections of the local user, the first of which is their primary
+// connection, or nil if the user is not local, or is an always-on user without sessions.
+func (user *User) Sessions() []*Conn {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	if user.conn == nil || user.persist != nil {
+		return nil
+	}
+	return append([]*Conn{user.conn}, user.sessions...)
+}
+
+// Write queues the rendered message to be sent to each session of the local user, or
+// keeps it for an always-on user without sessions.
+func (user *User) Write(buffer *bytes.Buffer) {
+	sessions := user.Sessions()
+	if len(sessions) == 0 {
+		user.keep(buffer.Bytes())
+		bufPool.Recycle(buffer)
+		return
+	}
+
+	for _, session := range sessions[1:] {
+		copied := bufPool.New()
+		copied.Write(buffer.Bytes())
+		session.Write(copied)
+	}
+	sessions[0].Write(buffer)
+}
+
+// kill disconnects each session of the local user, or quits an always-on user without
+// sessions.
+func (user *User) kill(reason, source string) {
+	sessions := user.Sessions()
+	if len(sessions) == 0 && user.conn != nil {
+		user.conn.server.expirePersistent(user, fmt.Sprintf("Killed: [%s [%s]]", source, reason))
+		return
+	}
+	for _, session := range sessions {
+		session.doKill(reason, source)
+	}
+}
+
+// attach adds the connection to the sessions of the user.
+func (user *User) attach(conn *Conn) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.sessions = append(user.sessions, conn)
+}
+
+// detach removes the connection from the sessions of the user, making the next session
+// their primary connection if it was theirs. It reports whether the user has sessions
+// left, in which case they stay connected through them.
+func (user *User) detach(conn *Conn) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.conn == conn {
+		if len(user.sessions) == 0 {
+			return false
+		}
+		user.conn = user.sessions[0]
+		user.sessions = user.sessions[1:]
+		return true
+	}
+
+	user.sessions = slices.DeleteFunc(user.sessions, func(session *Conn) bool { return session == conn })
+	return user.conn != nil
+}
+
+// mayAttach reports whether the connection, not yet registered, may take the nick held
+// by the user, attaching to them once registering if it authenticates to their account.
+func (conn *Conn) mayAttach(holder *User) bool {
+	return conn.server.multiSession && !conn.isRegistered() && holder != nil &&
+		holder.conn != nil && len(holder.Account()) > 0
+}
+
+// attachSession attaches the connection, registering with multi-session enabled, to the
+// connected user logged in to the same account, if any, reporting whether it was. The
+// user holding the nick of the connection is preferred to any other of the account.
+func (conn *Conn) attachSession() bool {
+	srv := conn.server
+	account := conn.user.Account()
+	if !srv.multiSession || len(account) == 0 {
+		return false
+	}
+
+	nick := conn.user.Nick()
+	user, _ := srv.Nicks.Get(nick)
+	if user == nil || user.conn == nil || user.Account() != account {
+		user = nil
+		srv.Users.ForEach(func(_ string, candidate *User) error {
+			if user == nil && candidate.conn != nil && candidate != conn.user && candidate.Account() == account {
+				user = candidate
+			}
+			return nil
+		})
+	}
+	if user == nil {
+		return false
+	}
+
+	if srv.cluster != nil && srv.Casefold(nick) != srv.Casefold(user.Nick()) {
+		srv.cluster.releaseNick(conn, nick)
+	}
+
+	conn.mu.Lock()
+	conn.user = user
+	conn.registered.Store(true)
+	conn.sessionReplay = true
+	conn.mu.Unlock()
+	if history, resumed := user.resume(conn); resumed {
+		conn.sessionHistory = history
+	} else {
+		user.attach(conn)
+	}
+
+	conn.logger.Debugf("attached session to user: %s", user.Nick())
+	return true
+}
+
+// replaySession sends the session attached to a user the JOIN and names of each channel
+// the user is joined to, as though it had joined them, once it has been welcomed, then
+// the history kept for them while they had no sessions.
+func (conn *Conn) replaySession() {
+	if !conn.sessionReplay {
+		return
+	}
+	conn.sessionReplay = false
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = conn.user.Hostmask()
+	msg.Command = CmdJoin
+
+	for _, channel := range conn.user.Channels() {
+		msg.Params = []string{channel.Name()}
+		conn.Write(msg.RenderBuffer())
+		conn.ReplyChannelJoined(channel)
+	}
+
+	// Clients negotiating znc.in/playback request the history they missed themselves.
+	if conn.HasCap(ZNCPlayback) {
+		conn.sessionHistory = nil
+	}
+	for _, line := range conn.sessionHistory {
+		buffer := bufPool.New()
+		buffer.Write(line)
+		conn.Write(buffer)
+	}
+	conn.sessionHistory = nil
+}
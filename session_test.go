@@ -0,0 +1,121 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectClient returns a connection to the server with the account, routing the lines
+// it is given, and a function expecting a line containing the text to be sent to it.
+func connectClient(t *testing.T, srv *Server, account string) (*Conn, func(line string), func(contains string)) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+	conn.user.SetAccount(account)
+	go conn.writeLoop()
+
+	route := func(line string) {
+		msg, err := Parse(line)
+		require.NoError(t, err)
+		srv.Router.RouteMessage(conn, msg)
+	}
+
+	// The client is read continuously, so that the server is never blocked writing.
+	lines := make(chan string, 64)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	expect := func(contains string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if strings.Contains(line, contains) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("did not receive: %s", contains)
+			}
+		}
+	}
+	return conn, route, expect
+}
+
+func TestMultiSession(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithMultiSession())
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	first, routeFirst, expectFirst := connectClient(t, srv, "bob")
+	routeFirst("NICK bob")
+	routeFirst("USER bob 0 * :Bob")
+	expectFirst(" 001 bob ")
+	routeFirst("JOIN #dircd")
+	expectFirst(" JOIN #dircd")
+
+	second, routeSecond, expectSecond := connectClient(t, srv, "bob")
+	routeSecond("NICK bob")
+	routeSecond("USER bob 0 * :Bob")
+	expectSecond(" 001 bob ")
+	expectSecond("bob!bob@ JOIN #dircd")
+	expectSecond(" 353 bob = #dircd :")
+
+	require.Same(t, first.user, second.user)
+	assert.Len(t, first.user.Sessions(), 2)
+
+	// A message sent from one session is relayed to the other.
+	routeFirst("PRIVMSG #dircd :hello from first")
+	expectSecond(" PRIVMSG #dircd :hello from first")
+
+	// Everything sent to the user is sent to each session.
+	srv.GlobalNotice("to everyone")
+	expectFirst(" NOTICE bob :to everyone")
+	expectSecond(" NOTICE bob :to everyone")
+
+	// The user stays connected through the remaining session.
+	first.doQuit("gone")
+	assert.Equal(t, []*Conn{second}, second.user.Sessions())
+	holder, exists := srv.Nicks.Get("bob")
+	require.True(t, exists)
+	assert.Same(t, second.user, holder)
+	assert.Len(t, holder.Channels(), 1)
+}
+
+func TestMultiSessionOtherAccount(t *testing.T) {
+	srv, err := NewServer(WithHostname("irc.example.net"), WithMultiSession())
+	require.NoError(t, err)
+
+	bob := &User{nick: "bob", account: "bob"}
+	bob.conn = &Conn{user: bob}
+	srv.Nicks.Set("bob", bob)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	assert.True(t, conn.mayAttach(bob))
+
+	conn.user.SetNick("bob")
+	conn.user.SetAccount("alice")
+	assert.False(t, conn.attachSession())
+	assert.False(t, conn.registerUser())
+}
@@ -8,23 +8,15 @@
 package dircd
 
 // Limiter Constants
+//
+// The limits of channels and users are configurable, see Limits.
 const (
 	// Messages
-	MaxMsgLength  int = 512
-	MaxMsgParams      = 15
-	MaxTagsLength int = 4096
+	MaxMsgLength         int = 512  // Length of a message, excluding its tags, including the CRLF.
+	MaxMsgParams             = 15   // Number of parameters of a message.
+	MaxTagsLength        int = 4096 // Length of the tags of a message, including the @ and the space following them.
+	MaxMessageTagsLength int = 8191 // Length of the tags of a message from a client which negotiated message-tags.
 
-	// Channels
-	MaxChanLength  = 16
-	MaxKickLength  = 400
-	MaxTopicLength = 400
-	MaxListItems   = 256
-	MaxModeChange  = 6
-
-	// Users
-	MaxNickLength  = 16
-	MaxUserLength  = 16
-	MaxVHostLength = 64
-	MaxJoinedChans = 32
-	MaxAwayLength  = 100
+	// Accounts
+	MaxAccountLength = 16
 )
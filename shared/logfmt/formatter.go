@@ -32,6 +32,7 @@ type Formatter struct {
 	showFullLevel         bool
 	noUppercaseLevel      bool
 	trimMessages          bool
+	jsonOutput            bool
 	callerFirst           bool
 	styleConfig           *StyleConfig
 	customCallerFormatter func(*runtime.Frame) string
@@ -156,6 +157,10 @@ func WithStyleConfig(config StyleConfig) FormatOption {
 
 // Format an log entry
 func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if f.jsonOutput {
+		return f.formatJSON(entry)
+	}
+
 	loggerOut := entry.Logger.Out
 	profile := termenv.NewOutput(loggerOut).ColorProfile()
 	levelStyle := f.getStyleByLevel(entry.Level)
@@ -207,7 +212,7 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 func (f *Formatter) writeCaller(out io.Writer, entry *logrus.Entry) {
 	if entry.HasCaller() {
 		if f.customCallerFormatter != nil {
-			fmt.Sprintf(f.customCallerFormatter(entry.Caller))
+			fmt.Fprint(out, f.customCallerFormatter(entry.Caller))
 		} else {
 			fmt.Fprintf(
 				out,
@@ -0,0 +1,92 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package logfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Keys of the fields every JSON log entry has. Entry fields with the same keys are
+// written prefixed with "fields." instead.
+const (
+	KeyTime     = "time"
+	KeyLevel    = "level"
+	KeyMessage  = "msg"
+	KeyCaller   = "caller"
+	KeyFunction = "func"
+)
+
+// JSONOutput sets whether to write each entry as a single line JSON object instead of
+// styled text, for ingestion by log aggregators. Options which only affect styled text,
+// such as the field order and styles, are ignored.
+// default: false
+func JSONOutput(state bool) FormatOption {
+	return fmtopt(func(f *Formatter) {
+		f.jsonOutput = state
+	})
+}
+
+// formatJSON formats a log entry as a JSON object with the time, level, message, and
+// caller, if reported, followed by its fields.
+// The timestamp format defaults to time.RFC3339Nano.
+func (f *Formatter) formatJSON(entry *logrus.Entry) ([]byte, error) {
+	timestampFormat := f.timestampFormat
+	if timestampFormat == "" {
+		timestampFormat = time.RFC3339Nano
+	}
+
+	data := make(map[string]any, len(entry.Data)+5)
+	for key, value := range entry.Data {
+		switch key {
+		case KeyTime, KeyLevel, KeyMessage, KeyCaller, KeyFunction:
+			key = "fields." + key
+		}
+		if err, ok := value.(error); ok {
+			// Most errors have no exported fields and would otherwise be written as {}.
+			value = err.Error()
+		}
+		data[key] = value
+	}
+
+	data[KeyTime] = entry.Time.Format(timestampFormat)
+	data[KeyLevel] = entry.Level.String()
+	data[KeyMessage] = entry.Message
+	if f.trimMessages {
+		data[KeyMessage] = strings.TrimSpace(entry.Message)
+	}
+	if entry.HasCaller() {
+		data[KeyCaller] = f.formatCaller(entry.Caller)
+		if f.customCallerFormatter == nil {
+			data[KeyFunction] = entry.Caller.Function
+		}
+	}
+
+	buff := &bytes.Buffer{}
+	encoder := json.NewEncoder(buff)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		return nil, fmt.Errorf("failed to marshal log entry to JSON: %w", err)
+	}
+	return buff.Bytes(), nil
+}
+
+// formatCaller returns the caller info of a JSON log entry, formatted by the custom
+// caller formatter if set, or else as file:line.
+func (f *Formatter) formatCaller(frame *runtime.Frame) string {
+	if f.customCallerFormatter != nil {
+		return f.customCallerFormatter(frame)
+	}
+	return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+}
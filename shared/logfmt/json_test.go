@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package logfmt
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatJSON(t *testing.T) {
+	entry := &logrus.Entry{
+		Logger:  logrus.New(),
+		Time:    time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   logrus.WarnLevel,
+		Message: " something <happened> ",
+		Data: logrus.Fields{
+			"component": "irc-server",
+			"error":     errors.New("failed"),
+			"msg":       "clashing",
+		},
+	}
+
+	formatter := New(JSONOutput(true), TrimMessages(true))
+	out, err := formatter.Format(entry)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('\n'), out[len(out)-1])
+
+	var data map[string]any
+	assert.NoError(t, json.Unmarshal(out, &data))
+	assert.Equal(t, map[string]any{
+		"time":       "2023-01-02T03:04:05Z",
+		"level":      "warning",
+		"msg":        "something <happened>",
+		"component":  "irc-server",
+		"error":      "failed",
+		"fields.msg": "clashing",
+	}, data)
+
+	entry.Logger.SetReportCaller(true)
+	entry.Caller = &runtime.Frame{File: "/src/server.go", Line: 42, Function: "dircd.Serve"}
+	out, err = formatter.Format(entry)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(out, &data))
+	assert.Equal(t, "/src/server.go:42", data["caller"])
+	assert.Equal(t, "dircd.Serve", data["func"])
+
+	formatter = New(JSONOutput(true), WithCustomCallerFormatter(func(frame *runtime.Frame) string {
+		return "server.go"
+	}))
+	out, err = formatter.Format(entry)
+	assert.NoError(t, err)
+	data = nil
+	assert.NoError(t, json.Unmarshal(out, &data))
+	assert.Equal(t, "server.go", data["caller"])
+	assert.NotContains(t, data, "func")
+}
@@ -0,0 +1,271 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+// Package logrotate provides a log file writer which rotates the file when it grows too
+// large, keeping a limited number of backups, for deployments without a log manager.
+package logrotate
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writer defaults
+const (
+	defaultMaxSize = 100 * 1024 * 1024
+	backupFormat   = "2006-01-02T15-04-05.000"
+	gzipExt        = ".gz"
+)
+
+// Writer is an io.Writer appending to a log file, which is renamed with the time it was
+// rotated at, eg: "dircd.log.2023-01-02T15-04-05.000", and replaced by a new file once
+// writing to it would exceed the maximum size. Writer is safe for concurrent use.
+type Writer struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	// pruning waits for the backups being compressed and pruned after a rotation.
+	pruning sync.WaitGroup
+}
+
+// Option configures a Writer.
+type Option func(*Writer)
+
+// WithMaxSize sets the size in bytes the log file is rotated at, 100 MiB by default.
+func WithMaxSize(bytes int64) Option {
+	return func(w *Writer) {
+		w.maxSize = bytes
+	}
+}
+
+// WithMaxAge sets how long backups are kept after they are rotated. Backups are kept
+// regardless of age by default.
+func WithMaxAge(age time.Duration) Option {
+	return func(w *Writer) {
+		w.maxAge = age
+	}
+}
+
+// WithMaxBackups sets the number of backups kept, removing the oldest. Every backup is
+// kept by default.
+func WithMaxBackups(count int) Option {
+	return func(w *Writer) {
+		w.maxBackups = count
+	}
+}
+
+// WithCompress sets backups to be compressed with gzip after they are rotated.
+func WithCompress() Option {
+	return func(w *Writer) {
+		w.compress = true
+	}
+}
+
+// New returns a writer appending to the log file at the path, creating it and its
+// directory if they do not exist.
+func New(path string, options ...Option) (*Writer, error) {
+	w := &Writer{path: path, maxSize: defaultMaxSize}
+	for _, option := range options {
+		option(w)
+	}
+
+	if w.maxSize <= 0 || w.maxAge < 0 || w.maxBackups < 0 {
+		return nil, errors.New("log rotation limits must not be negative, and max size must be positive")
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the log file for appending.
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+		return fmt.Errorf("error creating log directory: %w", err)
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write writes to the log file, rotating it first if the write would exceed the maximum
+// size. Writes larger than the maximum size are written to a new file of their own.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the log file now, eg: from a rehash hook.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// rotate renames the log file to a backup and opens a new one, then compresses and
+// prunes the backups in the background.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("error closing log file: %w", err)
+	}
+	w.file = nil
+
+	backup := w.path + "." + time.Now().Format(backupFormat)
+	if err := os.Rename(w.path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error renaming log file: %w", err)
+	}
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	w.pruning.Add(1)
+	go func() {
+		defer w.pruning.Done()
+		if w.compress {
+			_ = compress(backup)
+		}
+		_ = w.prune()
+	}()
+	return nil
+}
+
+// Close closes the log file, after waiting for backups to be compressed and pruned.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pruning.Wait()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// compress writes the backup to a gzip file and removes it.
+func compress(backup string) error {
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(backup+gzipExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	err = errors.Join(err, gz.Close(), dst.Close())
+	if err != nil {
+		_ = os.Remove(backup + gzipExt)
+		return err
+	}
+	return os.Remove(backup)
+}
+
+// backup is a rotated log file, and the time it was rotated at.
+type backup struct {
+	path    string
+	rotated time.Time
+}
+
+// backups returns the backups of the log file, newest first.
+func (w *Writer) backups() ([]backup, error) {
+	entries, err := os.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(w.path) + "."
+	backups := make([]backup, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), gzipExt)
+		rotated, parseErr := time.ParseInLocation(backupFormat, stamp, time.Local)
+		if parseErr != nil {
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(filepath.Dir(w.path), name), rotated: rotated})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotated.After(backups[j].rotated)
+	})
+	return backups, nil
+}
+
+// prune removes the backups beyond the maximum count or age.
+func (w *Writer) prune() error {
+	if w.maxBackups == 0 && w.maxAge == 0 {
+		return nil
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for i, b := range backups {
+		if (w.maxBackups > 0 && i >= w.maxBackups) || (w.maxAge > 0 && time.Since(b.rotated) > w.maxAge) {
+			errs = errors.Join(errs, os.Remove(b.path))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package logrotate
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "dircd.log")
+	w, err := New(path, WithMaxSize(10), WithMaxBackups(2))
+	assert.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = w.Write([]byte(line))
+		assert.NoError(t, err)
+		// Backups are named by the millisecond they are rotated at.
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.NoError(t, w.Close())
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "fourth\n", string(content))
+
+	backups, err := w.backups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 2) {
+		content, err = os.ReadFile(backups[0].path)
+		assert.NoError(t, err)
+		assert.Equal(t, "third\n", string(content))
+	}
+
+	_, err = w.Write([]byte("closed\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestWriterCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dircd.log")
+	w, err := New(path, WithCompress())
+	assert.NoError(t, err)
+
+	_, err = w.Write([]byte("rotated\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Rotate())
+	assert.NoError(t, w.Close())
+
+	backups, err := w.backups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assert.True(t, strings.HasSuffix(backups[0].path, gzipExt))
+		file, err := os.Open(backups[0].path)
+		assert.NoError(t, err)
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.Equal(t, "rotated\n", string(content))
+	}
+
+	_, err = New(path, WithMaxSize(0))
+	assert.Error(t, err)
+}
@@ -9,6 +9,7 @@ package pool
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // Resettable is an interface which defines an item which has a Reset() method defined/
@@ -17,27 +18,130 @@ type Resettable interface {
 	Reset()
 }
 
+// MaxReserve is the most items the reserve of a pool holds, however high the demand.
+const MaxReserve = 4096
+
+// Stats are the counters of a Pool.
+type Stats struct {
+	Hits      uint64 // Items handed out which were recycled, rather than created.
+	Misses    uint64 // Items created as none was available to be reused.
+	Overflows uint64 // Items dropped from the reserve as it shrank, left to the garbage collector.
+	InUse     int64  // Items handed out and not yet recycled, or never recycled.
+	Reserved  int    // Items held in the reserve.
+	Target    int    // Size the reserve is adapted to.
+}
+
 // A Pool is a generic wrapper around a sync.Pool.
+//
+// Items are handed out from and recycled to the sync.Pool, which is lock free for each P.
+// When it is empty, such as after the garbage collector emptied it, items are handed out
+// from a reserve, which the garbage collector does not empty, before any are created. The
+// reserve is refilled, and its size adapted to the rate at which the sync.Pool fell short,
+// by Adapt.
 type Pool[T Resettable] struct {
-	pool sync.Pool
+	pool    sync.Pool
+	factory func() T
+	reserve chan T
+
+	taken     atomic.Uint64
+	recycled  atomic.Uint64
+	misses    atomic.Uint64
+	overflows atomic.Uint64
+	fallbacks atomic.Int64 // Items the sync.Pool could not hand out since the last Adapt.
+	target    atomic.Int64
 }
 
 // New creates a new Pool with the provided factory function.
 //
 // The equivalent sync.Pool construct is "sync.Pool{New: fn}"
 func New[T Resettable](factory func() T) Pool[T] {
-	return Pool[T]{
-		pool: sync.Pool{New: func() any { return factory() }},
-	}
+	return Pool[T]{factory: factory, reserve: make(chan T, MaxReserve)}
 }
 
 // New is a generic wrapper around sync.Pool's Get method.
 func (p *Pool[T]) New() T {
-	return p.pool.Get().(T)
+	p.taken.Add(1)
+
+	if item, reused := p.pool.Get().(T); reused {
+		return item
+	}
+
+	p.fallbacks.Add(1)
+	select {
+	case item := <-p.reserve:
+		return item
+	default:
+	}
+
+	p.misses.Add(1)
+	return p.factory()
 }
 
 // Recycle is a generic wrapper around sync.Pool's Put method, but it first calls .Reset() on the item
 func (p *Pool[T]) Recycle(item T) {
 	item.Reset()
+	p.recycled.Add(1)
 	p.pool.Put(item)
 }
+
+// Warmup sets the size of the reserve of the pool, pre-allocating items to fill it, up to
+// MaxReserve.
+func (p *Pool[T]) Warmup(size int) {
+	p.resize(size)
+}
+
+// Adapt resizes the reserve of the pool to the number of items the sync.Pool could not hand
+// out since it was last called, such as after the garbage collector emptied it, growing at
+// once to meet a higher demand but shrinking only by half the difference to a lower one,
+// so that it follows bursts without being emptied by a lull.
+func (p *Pool[T]) Adapt() {
+	demand := p.fallbacks.Swap(0)
+	current := p.target.Load()
+
+	target := demand
+	if demand < current {
+		target = current - (current-demand)/2
+	}
+	p.resize(int(target))
+}
+
+// resize sets the target size of the reserve, capped to MaxReserve, filling or draining it
+// to match. Items are created without holding any lock, the reserve only being locked to
+// add or take each one.
+func (p *Pool[T]) resize(target int) {
+	target = min(max(target, 0), MaxReserve)
+	p.target.Store(int64(target))
+
+	for len(p.reserve) < target {
+		select {
+		case p.reserve <- p.factory():
+		default:
+			return
+		}
+	}
+	for len(p.reserve) > target {
+		select {
+		case <-p.reserve:
+			p.overflows.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// Stats returns the current counters of the pool.
+func (p *Pool[T]) Stats() Stats {
+	// Recycled is read first, so that items recycled while reading are not counted as
+	// recycled without being counted as taken.
+	recycled := p.recycled.Load()
+	misses := p.misses.Load()
+	taken := p.taken.Load()
+	return Stats{
+		Hits:      taken - misses,
+		Misses:    misses,
+		Overflows: p.overflows.Load(),
+		InUse:     int64(taken - recycled),
+		Reserved:  len(p.reserve),
+		Target:    int(p.target.Load()),
+	}
+}
@@ -9,6 +9,8 @@ package pool
 
 import (
 	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,3 +68,84 @@ func TestItemPool(t *testing.T) {
 		}
 	}
 }
+
+func TestPoolStats(t *testing.T) {
+	pool := New[*mockItem](initItem)
+
+	first, second := pool.New(), pool.New()
+	assert.Equal(t, Stats{Misses: 2, InUse: 2}, pool.Stats())
+	pool.Recycle(first)
+	assert.Equal(t, int64(1), pool.Stats().InUse)
+
+	pool.Warmup(3)
+	assert.Equal(t, 3, pool.Stats().Reserved)
+	runtime.GC()
+	runtime.GC() // Empties the sync.Pool, and its victim cache.
+	item := pool.New()
+	assert.Equal(t, 2, pool.Stats().Reserved, "the reserve is used once the sync.Pool is empty")
+	pool.Recycle(item)
+	pool.Recycle(second)
+	stats := pool.Stats()
+	assert.Equal(t, 2, stats.Reserved, "recycled items go to the sync.Pool")
+	assert.Equal(t, int64(0), stats.InUse)
+	assert.Equal(t, uint64(1), stats.Hits)
+
+	pool.Warmup(1)
+	assert.Equal(t, uint64(1), pool.Stats().Overflows)
+	pool.Warmup(MaxReserve + 1)
+	assert.Equal(t, MaxReserve, pool.Stats().Target)
+}
+
+func TestPoolAdapt(t *testing.T) {
+	pool := New[*mockItem](initItem)
+
+	runtime.GC()
+	runtime.GC()
+	for i := 0; i < 8; i++ {
+		pool.New() // Never recycled, which must not grow the reserve beyond the demand.
+	}
+
+	// The reserve grows to the items the sync.Pool could not hand out at once.
+	pool.Adapt()
+	assert.Equal(t, 8, pool.Stats().Target)
+	assert.Equal(t, 8, pool.Stats().Reserved)
+
+	// Items taken from the reserve are replaced, and it shrinks by half the difference
+	// to a lower demand.
+	runtime.GC()
+	runtime.GC()
+	pool.New()
+	pool.New()
+	assert.Equal(t, 6, pool.Stats().Reserved)
+	pool.Adapt()
+	assert.Equal(t, 5, pool.Stats().Target)
+	assert.Equal(t, 5, pool.Stats().Reserved)
+	pool.Adapt()
+	assert.Equal(t, 3, pool.Stats().Target)
+	assert.Equal(t, 3, pool.Stats().Reserved)
+}
+
+// BenchmarkPool measures handing out and recycling items from every P at once, compared
+// with a bare sync.Pool.
+func BenchmarkPool(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		pool := New[*mockItem](initItem)
+		pool.Warmup(64)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				pool.Recycle(pool.New())
+			}
+		})
+	})
+
+	b.Run("sync.Pool", func(b *testing.B) {
+		pool := sync.Pool{New: func() any { return initItem() }}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				item := pool.Get().(*mockItem)
+				item.Reset()
+				pool.Put(item)
+			}
+		})
+	})
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package safemap
+
+// NewFoldedMap returns a generic SafeMap with string keys which folds every key passed to
+// it with the fold function before operating on the underlying map, so that keys which
+// fold to the same string, such as differently cased names, refer to the same entry.
+//
+// The keys returned by Keys, KeysIter, and ForEach are the folded keys.
+func NewFoldedMap[V any](inner SafeMap[string, V], fold func(string) string) SafeMap[string, V] {
+	return &foldedMap[V]{
+		inner: inner,
+		fold:  fold,
+	}
+}
+
+type foldedMap[V any] struct {
+	inner SafeMap[string, V]
+	fold  func(string) string
+}
+
+func (fm *foldedMap[V]) Length() int {
+	return fm.inner.Length()
+}
+
+func (fm *foldedMap[V]) Get(key string) (V, bool) {
+	return fm.inner.Get(fm.fold(key))
+}
+
+func (fm *foldedMap[V]) Set(key string, value V) {
+	fm.inner.Set(fm.fold(key), value)
+}
+
+func (fm *foldedMap[V]) SetIfAbsent(key string, value V) bool {
+	return fm.inner.SetIfAbsent(fm.fold(key), value)
+}
+
+func (fm *foldedMap[V]) ChangeKey(oldKey string, newKey string) bool {
+	oldKey, newKey = fm.fold(oldKey), fm.fold(newKey)
+	if oldKey == newKey {
+		return fm.inner.Exists(oldKey)
+	}
+	return fm.inner.ChangeKey(oldKey, newKey)
+}
+
+func (fm *foldedMap[V]) Delete(key string) {
+	fm.inner.Delete(fm.fold(key))
+}
+
+func (fm *foldedMap[V]) Exists(key string) bool {
+	return fm.inner.Exists(fm.fold(key))
+}
+
+func (fm *foldedMap[V]) Keys() []string {
+	return fm.inner.Keys()
+}
+
+func (fm *foldedMap[V]) Values() []V {
+	return fm.inner.Values()
+}
+
+func (fm *foldedMap[V]) KeysIter() <-chan string {
+	return fm.inner.KeysIter()
+}
+
+func (fm *foldedMap[V]) ValuesIter() <-chan V {
+	return fm.inner.ValuesIter()
+}
+
+func (fm *foldedMap[V]) ForEach(fn func(string, V) error) error {
+	return fm.inner.ForEach(fn)
+}
+
+func (fm *foldedMap[V]) Clear() {
+	fm.inner.Clear()
+}
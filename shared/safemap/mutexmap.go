@@ -41,6 +41,18 @@ func (cm *mutexMap[K, V]) Set(key K, value V) {
 	cm.m[key] = value
 }
 
+// SetIfAbsent sets the value of the key only if it is not already present, reporting
+// whether it was set.
+func (cm *mutexMap[K, V]) SetIfAbsent(key K, value V) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, exists := cm.m[key]; exists {
+		return false
+	}
+	cm.m[key] = value
+	return true
+}
+
 func (cm *mutexMap[K, V]) ChangeKey(oldKey K, newKey K) bool {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -11,6 +11,7 @@ type SafeMap[K comparable, V any] interface {
 	Length() int
 	Get(K) (V, bool)
 	Set(K, V)
+	SetIfAbsent(K, V) bool
 	ChangeKey(K, K) bool
 	Delete(K)
 	Exists(K) bool
@@ -41,6 +41,16 @@ func (sm *syncMap[K, V]) Set(key K, value V) {
 	}
 }
 
+// SetIfAbsent sets the value of the key only if it is not already present, reporting
+// whether it was set.
+func (sm *syncMap[K, V]) SetIfAbsent(key K, value V) bool {
+	if _, loaded := sm.m.LoadOrStore(key, value); loaded {
+		return false
+	}
+	sm.len.Add(1)
+	return true
+}
+
 func (sm *syncMap[K, V]) ChangeKey(oldKey K, newKey K) bool {
 	if value, exists := sm.m.LoadAndDelete(oldKey); exists {
 		if _, present := sm.m.LoadOrStore(newKey, value); present {
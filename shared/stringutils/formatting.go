@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package stringutils
+
+import "strings"
+
+// IRC formatting control codes
+const (
+	FormatBold          = '\x02'
+	FormatColor         = '\x03' // Followed by a foreground, and optionally a background, color of 1-2 digits.
+	FormatHexColor      = '\x04' // Followed by a foreground, and optionally a background, color of 6 hex digits.
+	FormatReset         = '\x0F'
+	FormatMonospace     = '\x11'
+	FormatReverse       = '\x16'
+	FormatItalic        = '\x1D'
+	FormatStrikethrough = '\x1E'
+	FormatUnderline     = '\x1F'
+)
+
+// formatCodes are the IRC formatting control codes.
+const formatCodes = "\x02\x03\x04\x0F\x11\x16\x1D\x1E\x1F"
+
+// StripColors returns the text without color codes, including the colors following them.
+func StripColors(text string) string {
+	return stripFormatting(text, false)
+}
+
+// StripFormatting returns the text without any formatting codes, including the colors
+// following color codes.
+func StripFormatting(text string) string {
+	return stripFormatting(text, true)
+}
+
+func stripFormatting(text string, all bool) string {
+	if !strings.ContainsAny(text, formatCodes) {
+		return text
+	}
+
+	var stripped strings.Builder
+	stripped.Grow(len(text))
+	for i := 0; i < len(text); i++ {
+		switch code := text[i]; {
+		case code == FormatColor:
+			i += colorLength(text[i+1:], 1, 2, isDigit)
+		case code == FormatHexColor:
+			i += colorLength(text[i+1:], 6, 6, isHexDigit)
+		case all && strings.IndexByte(formatCodes, code) >= 0:
+		default:
+			stripped.WriteByte(code)
+		}
+	}
+	return stripped.String()
+}
+
+// colorLength returns the length of the foreground and optional background color at the
+// start of the text, each of minDigits to maxDigits digits, or zero if there is no color.
+func colorLength(text string, minDigits, maxDigits int, valid func(byte) bool) int {
+	length := digitsLength(text, minDigits, maxDigits, valid)
+	if length > 0 && length+1 < len(text) && text[length] == ',' {
+		if background := digitsLength(text[length+1:], minDigits, maxDigits, valid); background > 0 {
+			length += 1 + background
+		}
+	}
+	return length
+}
+
+// digitsLength returns the number of valid digits at the start of the text, up to maxDigits,
+// or zero if there are fewer than minDigits.
+func digitsLength(text string, minDigits, maxDigits int, valid func(byte) bool) int {
+	length := 0
+	for length < maxDigits && length < len(text) && valid(text[length]) {
+		length++
+	}
+	if length < minDigits {
+		return 0
+	}
+	return length
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
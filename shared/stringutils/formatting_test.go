@@ -0,0 +1,40 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package stringutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		colors     string
+		formatting string
+	}{
+		{"plain", "hello there", "hello there", "hello there"},
+		{"foreground", "\x034hello\x03 there", "hello there", "hello there"},
+		{"foreground and background", "\x0304,12hello there", "hello there", "hello there"},
+		{"comma without background", "\x034,hello", ",hello", ",hello"},
+		{"three digits", "\x03123", "3", "3"},
+		{"hex color", "\x04FF00AA,000000hello", "hello", "hello"},
+		{"short hex color", "\x04FFhello", "FFhello", "FFhello"},
+		{"bold and color", "\x02\x033bold\x0F text", "\x02bold\x0F text", "bold text"},
+		{"all formatting", "\x11\x16\x1D\x1E\x1Ftext", "\x11\x16\x1D\x1E\x1Ftext", "text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.colors, StripColors(tt.text))
+			assert.Equal(t, tt.formatting, StripFormatting(tt.text))
+		})
+	}
+}
@@ -0,0 +1,43 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package stringutils
+
+import "strings"
+
+// MatchMask reports whether str matches the IRC style wildcard mask, where '*'
+// matches any sequence of characters (including none) and '?' matches exactly
+// one character. Matching is case-insensitive.
+func MatchMask(mask, str string) bool {
+	mask, str = strings.ToLower(mask), strings.ToLower(str)
+
+	// Iterative matching with single star backtracking.
+	m, s := 0, 0
+	star, mark := -1, 0
+	for s < len(str) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == str[s]):
+			m++
+			s++
+		case m < len(mask) && mask[m] == '*':
+			star, mark = m, s
+			m++
+		case star >= 0:
+			m = star + 1
+			mark++
+			s = mark
+		default:
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+
+	return m == len(mask)
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package stringutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		name     string
+		mask     string
+		str      string
+		expected bool
+	}{
+		{"exact", "user@host.example", "user@host.example", true},
+		{"case insensitive", "USER@Host.Example", "user@host.example", true},
+		{"star matches all", "*", "anything@goes", true},
+		{"star matches empty", "user@*host", "user@host", true},
+		{"star in middle", "*@*.example", "user@host.example", true},
+		{"star backtracking", "*a*b", "xaxxaxb", true},
+		{"question mark", "use?@host", "user@host", true},
+		{"question mark requires a char", "user?@host", "user@host", false},
+		{"mismatch", "*@other.example", "user@host.example", false},
+		{"trailing text", "user@host", "user@host.example", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, MatchMask(tt.mask, tt.str))
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// shunsBucket is the storage bucket shuns are persisted in.
+const shunsBucket = "shuns"
+
+// shunExempt holds the commands still routed for shunned users, so that their connection
+// is kept alive and they may leave.
+var shunExempt = map[string]struct{}{
+	CmdPing: {},
+	CmdPong: {},
+	CmdQuit: {},
+}
+
+// checkShunned matches the user@host of the connection against the active shuns, which
+// silently ignore its commands while one matches.
+func (conn *Conn) checkShunned() {
+	conn.shun.Store(conn.server.shuns.match(conn.userhost()))
+}
+
+// shunned reports whether the command from the user must be silently ignored as they are
+// shunned.
+func (conn *Conn) shunned(command string) bool {
+	shun := conn.shun.Load()
+	if shun == nil {
+		return false
+	}
+	if shun.Expired() {
+		conn.checkShunned()
+		if conn.shun.Load() == nil {
+			return false
+		}
+	}
+
+	_, exempt := shunExempt[command]
+	return !exempt
+}
+
+// AddShun shuns users matching the user@host mask for the given duration (permanent if
+// zero), silently ignoring all of their commands but PING, PONG, and QUIT, which is
+// useful when a kill or K-line would only cause them to reconnect. Any existing shun on
+// the same mask is replaced. Shuns have the same form as K-lines.
+func (srv *Server) AddShun(mask, reason, setter string, duration time.Duration) (*KLine, error) {
+	if !strings.Contains(mask, AT) {
+		mask = "*@" + mask
+	}
+	if len(reason) == 0 {
+		reason = "No reason given"
+	}
+
+	shun := &KLine{
+		Mask:    mask,
+		Reason:  reason,
+		Setter:  setter,
+		Created: time.Now().UTC(),
+	}
+	if duration > 0 {
+		shun.Expires = shun.Created.Add(duration)
+	}
+
+	if err := srv.shuns.add(shun); err != nil {
+		return nil, fmt.Errorf("error adding shun [%s]: %w", mask, err)
+	}
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  setter,
+		Action: CmdShun,
+		Target: mask,
+		Reason: reason,
+	})
+
+	srv.Users.ForEach(func(_ string, user *User) error {
+		if user.conn != nil && shun.Matches(user.conn.userhost()) {
+			user.conn.shun.Store(shun)
+		}
+		return nil
+	})
+
+	return shun, nil
+}
+
+// RemoveShun removes the shun on the user@host mask, returning ErrNotFound if there is
+// none. The remover is reported to event subscribers as the actor.
+func (srv *Server) RemoveShun(mask, remover string) error {
+	if !strings.Contains(mask, AT) {
+		mask = "*@" + mask
+	}
+	if err := srv.shuns.remove(mask); err != nil {
+		return err
+	}
+
+	srv.publish(Event{
+		Type:   EventOperAction,
+		Actor:  remover,
+		Action: CmdUnShun,
+		Target: mask,
+	})
+
+	srv.Users.ForEach(func(_ string, user *User) error {
+		if user.conn != nil && user.conn.shun.Load() != nil {
+			user.conn.checkShunned()
+		}
+		return nil
+	})
+	return nil
+}
+
+// Shuns returns the active shuns sorted by mask.
+func (srv *Server) Shuns() []*KLine {
+	return srv.shuns.list()
+}
+
+// doShun shuns the mask for the given duration (permanent if zero).
+func (conn *Conn) doShun(mask string, duration time.Duration, reason string) {
+	shun, err := conn.server.AddShun(mask, reason, conn.user.Hostmask(), duration)
+	if err != nil {
+		conn.logger.WithField("operation", "shun").Error(err)
+		conn.ReplyServerNotice("Unable to add shun for " + mask)
+		return
+	}
+
+	if duration > 0 {
+		conn.ReplyServerNotice(fmt.Sprintf("Added shun for [%s] expiring in %v: %s", shun.Mask, duration, shun.Reason))
+	} else {
+		conn.ReplyServerNotice(fmt.Sprintf("Added permanent shun for [%s]: %s", shun.Mask, shun.Reason))
+	}
+}
+
+// doUnShun removes the shun on the mask.
+func (conn *Conn) doUnShun(mask string) {
+	switch err := conn.server.RemoveShun(mask, conn.user.Hostmask()); err {
+	case nil:
+		conn.ReplyServerNotice(fmt.Sprintf("Removed shun for [%s]", mask))
+	case ErrNotFound:
+		conn.ReplyServerNotice(fmt.Sprintf("No shun for [%s]", mask))
+	default:
+		conn.logger.WithField("operation", "shun").Error(fmt.Errorf("error removing shun [%s]: %w", mask, err))
+		conn.ReplyServerNotice("Unable to remove shun for " + mask)
+	}
+}
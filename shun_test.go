@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShun(t *testing.T) {
+	storage := NewMemoryStorage()
+	srv, err := NewServer(WithStorage(storage))
+	assert.NoError(t, err)
+
+	user := &User{nick: "spammer", name: "spam", host: "bad.example"}
+	conn := &Conn{server: srv, user: user}
+	user.conn = conn
+	srv.Users.Set(user.Name(), user)
+
+	conn.checkShunned()
+	assert.False(t, conn.shunned(CmdPrivMsg))
+
+	_, err = srv.AddShun("*.example", "Spamming", "oper", 0)
+	assert.NoError(t, err)
+	for _, command := range []string{CmdPrivMsg, CmdJoin, CmdNick} {
+		assert.True(t, conn.shunned(command), command)
+	}
+	for _, command := range []string{CmdPing, CmdPong, CmdQuit} {
+		assert.False(t, conn.shunned(command), command)
+	}
+
+	reloaded, err := newKLineStore(storage, shunsBucket)
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.list(), 1)
+	assert.Empty(t, srv.KLines())
+
+	assert.NoError(t, srv.RemoveShun("*.example", "oper"))
+	assert.False(t, conn.shunned(CmdPrivMsg))
+	assert.Equal(t, ErrNotFound, srv.RemoveShun("*.example", "oper"))
+
+	conn.shun.Store(&KLine{Mask: "*@bad.example", Expires: time.Now().Add(-time.Minute)})
+	assert.False(t, conn.shunned(CmdPrivMsg))
+}
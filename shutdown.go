@@ -0,0 +1,112 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// defaultShutdownMessage is sent to users when the server shuts down, unless set
+	// with WithShutdownMessage.
+	defaultShutdownMessage = "Server shutting down."
+
+	// defaultShutdownDrain is how long the messages queued for a user are given to be sent
+	// when the server shuts down, unless set with WithShutdownDrain.
+	defaultShutdownDrain = 2 * time.Second
+
+	// drainPollInterval is how often the send queue is checked while draining.
+	drainPollInterval = 10 * time.Millisecond
+)
+
+// WithShutdownMessage sets the message users are sent in a NOTICE, and as the reason of
+// the ERROR closing their connection, when the server shuts down.
+func WithShutdownMessage(message string) ServerOption {
+	return option(func(s *Server) error {
+		if len(message) == 0 {
+			return errors.New("shutdown message must not be empty")
+		}
+		s.shutdownMessage = message
+		return nil
+	})
+}
+
+// WithAlternateServers sets the addresses of servers users are pointed to with
+// RPL_BOUNCE when the server shuts down, so that their clients can reconnect to one,
+// eg: "irc2.example.net:6697".
+func WithAlternateServers(addresses ...string) ServerOption {
+	return option(func(s *Server) error {
+		for _, address := range addresses {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("invalid alternate server address [%s]: %w", address, err)
+			}
+		}
+		s.alternateServers = append(s.alternateServers, addresses...)
+		return nil
+	})
+}
+
+// WithShutdownDrain sets how long the messages already queued for a user, including the
+// shutdown notice, are given to be sent before their connection is closed when the server
+// shuts down. Zero closes connections without waiting.
+func WithShutdownDrain(drain time.Duration) ServerOption {
+	return option(func(s *Server) error {
+		if drain < 0 {
+			return errors.New("shutdown drain must not be negative")
+		}
+		s.shutdownDrain = drain
+		return nil
+	})
+}
+
+// shutdown tells the user the server is shutting down, pointing them to any alternate
+// servers, and closes the connection once the messages queued for them are sent, or the
+// drain period expires. It returns immediately, and does nothing if called again.
+func (conn *Conn) shutdown() {
+	if !conn.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+
+	srv := conn.server
+	for _, address := range srv.alternateServers {
+		host, port, _ := net.SplitHostPort(address)
+		conn.ReplyNumeric(ReplyBounce, host, port)
+	}
+	conn.ReplyServerNotice(srv.shutdownMessage)
+
+	go func() {
+		conn.drain(srv.shutdownDrain)
+		conn.doQuit(srv.shutdownMessage)
+	}()
+}
+
+// drain waits until the messages queued for the user have been sent, the timeout
+// expires, or the connection is closed.
+func (conn *Conn) drain(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for conn.sendQueue.Load() > 0 {
+		select {
+		case <-deadline.C:
+			return
+		case <-conn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
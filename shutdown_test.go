@@ -0,0 +1,59 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnShutdown(t *testing.T) {
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithShutdownMessage("Upgrading, back soon"),
+		WithAlternateServers("irc2.example.net:6697"),
+	)
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	conn.setState(StateConnected)
+	go conn.writeLoop()
+
+	conn.shutdown()
+	conn.shutdown()
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	lines := bufio.NewScanner(client)
+	var received []string
+	for len(received) < 3 && lines.Scan() {
+		received = append(received, lines.Text())
+	}
+
+	require.Len(t, received, 3)
+	assert.Equal(t, ":irc.example.net 010 * irc2.example.net 6697 :Please reconnect to this server", received[0])
+	assert.Equal(t, ":irc.example.net NOTICE * :Upgrading, back soon", received[1])
+	assert.Contains(t, received[2], "ERROR :Closing link:")
+	assert.Contains(t, received[2], "[Quit: Upgrading, back soon]")
+}
+
+func TestShutdownOptions(t *testing.T) {
+	_, err := NewServer(WithAlternateServers("irc2.example.net"))
+	assert.Error(t, err)
+	_, err = NewServer(WithShutdownMessage(""))
+	assert.Error(t, err)
+	_, err = NewServer(WithShutdownDrain(-time.Second))
+	assert.Error(t, err)
+}
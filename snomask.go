@@ -0,0 +1,168 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// snomaskBurst is the number of log entries mirrored to operators per interval,
+	// further entries are counted and reported with the next one mirrored.
+	snomaskBurst    = 5
+	snomaskInterval = 10 * time.Second
+
+	// snomaskQueueLength is the number of mirrored entries waiting to be sent, beyond
+	// which they are dropped rather than holding up the logger.
+	snomaskQueueLength = 64
+)
+
+// WithLogSnomask mirrors the warning and error entries of the server logger, only of the
+// categories, by their sub-component, if any are given, to operators subscribed to the
+// debug snomask with DEBUG SNOMASK, so that problems can be seen from inside IRC. At
+// most five entries are mirrored every 10 seconds.
+//
+// The snomask requires the logrus logger, and is not supported with WithSlogLogger.
+func WithLogSnomask(categories ...string) ServerOption {
+	return option(func(s *Server) error {
+		hook := &snomaskHook{
+			lines: make(chan string, snomaskQueueLength),
+		}
+		for _, category := range categories {
+			hook.categories = append(hook.categories, strings.ToLower(category))
+		}
+		s.snomask = hook
+		return nil
+	})
+}
+
+// startLogSnomask adds the hook configured with WithLogSnomask, if any, to the logger,
+// and starts sending the entries it mirrors to the subscribed operators.
+func (srv *Server) startLogSnomask() error {
+	if srv.snomask == nil {
+		return nil
+	}
+	if srv.logrus == nil {
+		return errors.New("log snomask requires the logrus logger")
+	}
+
+	srv.logrus.AddHook(srv.snomask)
+
+	done := make(chan struct{})
+	srv.registerOnShutdown(func() {
+		close(done)
+	})
+
+	lines := srv.snomask.lines
+	go func() {
+		for {
+			select {
+			case line := <-lines:
+				srv.noticeMatching(line, func(user *User) bool {
+					return user.IsOper() && user.ModeIsSet(UModeDebug)
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// snomaskHook is a logrus hook queueing warning and error entries to be sent to the
+// operators subscribed to the debug snomask.
+type snomaskHook struct {
+	categories []string // All categories if empty.
+	lines      chan string
+
+	mu         sync.Mutex
+	window     time.Time // Start of the current rate limiting interval.
+	sent       int
+	suppressed int
+}
+
+func (h *snomaskHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel}
+}
+
+func (h *snomaskHook) Fire(entry *logrus.Entry) error {
+	category, _ := entry.Data["sub-component"].(string)
+	if len(h.categories) > 0 && !slices.Contains(h.categories, strings.ToLower(category)) {
+		return nil
+	}
+
+	allowed, suppressed := h.allow(entry.Time)
+	if !allowed {
+		return nil
+	}
+
+	if len(category) == 0 {
+		category, _ = entry.Data["component"].(string)
+	}
+	line := fmt.Sprintf("*** Debug -- %s [%s] %s", strings.ToUpper(entry.Level.String()), category, entry.Message)
+	if suppressed > 0 {
+		line += fmt.Sprintf(" (%d more entries suppressed)", suppressed)
+	}
+
+	select {
+	case h.lines <- line:
+	default:
+	}
+	return nil
+}
+
+// allow reports whether an entry logged at the time is within the rate limit, and the
+// number of entries suppressed since the last one allowed.
+func (h *snomaskHook) allow(now time.Time) (bool, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.window) >= snomaskInterval {
+		h.window = now
+		h.sent = 0
+	}
+	if h.sent >= snomaskBurst {
+		h.suppressed++
+		return false, 0
+	}
+
+	h.sent++
+	suppressed := h.suppressed
+	h.suppressed = 0
+	return true, suppressed
+}
+
+// doSnomask reports, or subscribes or unsubscribes the operator to or from the debug
+// snomask with "+d" or "-d".
+func (conn *Conn) doSnomask(params []string) {
+	if len(params) > 0 {
+		switch params[0] {
+		case "+d":
+			conn.user.AddMode(UModeDebug)
+		case "-d":
+			conn.user.DelMode(UModeDebug)
+		default:
+			conn.ReplyServerNotice("Unknown snomask, expected +d or -d")
+			return
+		}
+	}
+
+	if conn.user.ModeIsSet(UModeDebug) {
+		conn.ReplyServerNotice("Server notice mask: +d (debug)")
+	} else {
+		conn.ReplyServerNotice("Server notice mask: none")
+	}
+}
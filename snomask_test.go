@@ -0,0 +1,66 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSnomask(t *testing.T) {
+	base := logrus.New()
+	base.SetOutput(io.Discard)
+	srv := &Server{}
+	assert.NoError(t, WithLogSnomask("Reader").apply(srv))
+	hook := srv.snomask
+	base.AddHook(hook)
+	logger := NewLogrusLogger(base)
+
+	reader := logger.WithField("component", "connection").WithField("sub-component", "reader")
+	reader.Info("not mirrored")
+	logger.WithField("sub-component", "writer").Warn("other category")
+	reader.Error("read failed")
+	assert.Len(t, hook.lines, 1)
+	assert.Equal(t, "*** Debug -- ERROR [reader] read failed", <-hook.lines)
+
+	for i := 0; i < snomaskBurst+2; i++ {
+		reader.Warn("flood")
+	}
+	assert.Len(t, hook.lines, snomaskBurst-1)
+
+	hook.window = hook.window.Add(-snomaskInterval)
+	for len(hook.lines) > 0 {
+		<-hook.lines
+	}
+	reader.Warn("after")
+	assert.Equal(t, "*** Debug -- WARNING [reader] after (3 more entries suppressed)", <-hook.lines)
+
+	_, err := NewServer(WithSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))), WithLogSnomask())
+	assert.Error(t, err)
+}
+
+func TestSnomaskRateLimit(t *testing.T) {
+	var hook snomaskHook
+	now := time.Now()
+
+	for i := 0; i < snomaskBurst; i++ {
+		allowed, _ := hook.allow(now)
+		assert.True(t, allowed)
+	}
+	allowed, _ := hook.allow(now.Add(snomaskInterval / 2))
+	assert.False(t, allowed)
+
+	allowed, suppressed := hook.allow(now.Add(snomaskInterval))
+	assert.True(t, allowed)
+	assert.Equal(t, 1, suppressed)
+}
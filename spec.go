@@ -0,0 +1,221 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+// CommandSpec declares the requirements of a command, which the router enforces before
+// calling its handler chain, and its help text returned by the HELP command.
+type CommandSpec struct {
+	MinParams  int           // Minimum number of middle parameters, replying ERR_NEEDMOREPARAMS if fewer are given.
+	MaxParams  int           // Maximum number of middle parameters, any beyond it are dropped. Unlimited if zero.
+	Registered bool          // Requires the connection to have completed registration.
+	Oper       bool          // Requires the user to be an operator.
+	Privilege  OperPrivilege // Requires the user to be an operator holding all of the privileges.
+	Rate       RateClass     // Rate class whose budget limits the command, replying ERR_TRYAGAIN beyond it.
+	Silent     bool          // Refuses the command without replying, for commands which must never be replied to, eg: NOTICE.
+	Help       CommandHelp
+}
+
+// CommandHelp is the usage and help text of a command, returned by the HELP command.
+type CommandHelp struct {
+	Usage string   // The parameters of the command, eg: "<target> :<text>".
+	Text  []string // Lines describing the command.
+}
+
+// available reports whether the user may use the command.
+func (spec *CommandSpec) available(user *User) bool {
+	if spec.Privilege != PrivNone {
+		return user.HasPrivilege(spec.Privilege)
+	}
+	return !spec.Oper || user.IsOper()
+}
+
+// enforce checks the message meets the requirements of the spec, replying with the
+// reason to the user if not, unless the spec is silent, and drops any parameters beyond
+// the maximum. It reports whether the handler chain should be called.
+func (spec *CommandSpec) enforce(ctx *MessageContext) bool {
+	refuse := func(reply func()) bool {
+		if !spec.Silent {
+			reply()
+		}
+		return false
+	}
+
+	if spec.Registered && !ctx.Conn.isRegistered() {
+		return refuse(ctx.Conn.ReplyNotRegistered)
+	}
+
+	if (spec.Oper || spec.Privilege != PrivNone) && !spec.available(ctx.Conn.user) {
+		return refuse(ctx.Conn.ReplyNoPrivileges)
+	}
+
+	if !enoughParams(ctx.Msg, spec.MinParams) {
+		return refuse(func() { ctx.Conn.ReplyNeedMoreParams(ctx.Msg.Command) })
+	}
+
+	if !ctx.Conn.allowCommand(spec.rateClass()) {
+		return refuse(func() { ctx.Conn.ReplyTryAgain(ctx.Msg.Command) })
+	}
+
+	if spec.MaxParams > 0 && len(ctx.Msg.Params) > spec.MaxParams {
+		ctx.Msg.Params = ctx.Msg.Params[:spec.MaxParams]
+	}
+	return true
+}
+
+// builtinAliases maps alternative names of built-in commands sent by some clients to
+// the commands.
+var builtinAliases = map[string]string{
+	"MSG": CmdPrivMsg,
+}
+
+// builtinSpecs are the specs of the built-in commands.
+var builtinSpecs = map[string]CommandSpec{
+	CmdPing: {Help: CommandHelp{Usage: ":<token>", Text: []string{
+		"Checks the connection is alive. The server replies with a PONG carrying the token.",
+	}}},
+	CmdPong: {Help: CommandHelp{Usage: ":<token>", Text: []string{"Replies to a PING from the server."}}},
+	CmdCap: {Help: CommandHelp{Usage: "<LS|LIST|REQ|END> [version] [:capabilities]", Text: []string{
+		"Negotiates IRCv3 capabilities with the server.",
+	}}},
+	CmdNick: {Help: CommandHelp{Usage: "<nickname>", Text: []string{"Sets or changes your nickname."}}},
+	CmdUser: {MinParams: 3, Help: CommandHelp{Usage: "<username> 0 * :<realname>", Text: []string{
+		"Sets your username and real name when connecting.",
+	}}},
+	CmdQuit:     {Help: CommandHelp{Usage: "[:reason]", Text: []string{"Disconnects from the server, with an optional quit message."}}},
+	CmdStartTLS: {Help: CommandHelp{Text: []string{"Upgrades the connection to TLS before registering."}}},
+	CmdAuth: {Help: CommandHelp{Usage: "<mechanism> | <data>", Text: []string{
+		"Authenticates to an account with SASL. Negotiate the sasl capability first.",
+	}}},
+
+	CmdJoin: {Registered: true, MinParams: 1, Help: CommandHelp{Usage: "<channel> [key]", Text: []string{
+		"Joins the channel, creating it if it does not exist.",
+	}}},
+	CmdMode: {Registered: true, MinParams: 1, Help: CommandHelp{Usage: "<target> [modes [params ...]]", Text: []string{
+		"Shows or changes the modes of a channel. The ban, exception and invite lists",
+		"are shown by giving their mode, eg: +b, without a mask.",
+	}}},
+	CmdPrivMsg: {Registered: true, Help: CommandHelp{Usage: "<target> :<text>", Text: []string{
+		"Sends a message to a user or channel.",
+	}}},
+	CmdNotice: {Registered: true, Silent: true, Help: CommandHelp{Usage: "<target> :<text>", Text: []string{
+		"Sends a notice to a user or channel. Notices are never automatically replied to.",
+	}}},
+	CmdUserhost: {Registered: true, MinParams: 1, MaxParams: 5, Help: CommandHelp{Usage: "<nickname> [nickname ...]", Text: []string{
+		"Returns the user@host of up to five nicknames.",
+	}}},
+	CmdWhois: {Registered: true, Rate: RateExpensive, Help: CommandHelp{Usage: "[server] <nickname>", Text: []string{
+		"Returns information about the user.",
+	}}},
+	CmdCertFP: {Registered: true, Help: CommandHelp{Usage: "[LIST | ADD [fingerprint] | DEL <fingerprint>]", Text: []string{
+		"Manages the TLS client certificate fingerprints linked to your account.",
+		"ADD without a fingerprint links the certificate of your current connection.",
+	}}},
+	CmdOper: {Registered: true, MinParams: 2, Help: CommandHelp{Usage: "<name> <password>", Text: []string{
+		"Authenticates as an IRC operator.",
+	}}},
+	CmdChallenge: {Registered: true, MinParams: 1, Help: CommandHelp{Usage: "<name> | +<signature>", Text: []string{
+		"Authenticates as an IRC operator with the private key of an oper block.",
+		"CHALLENGE <name> returns a base64 nonce; sign it with the key and send",
+		"CHALLENGE +<signature>, base64 encoded, within a minute.",
+	}}},
+	CmdStats: {Registered: true, MinParams: 1, Help: CommandHelp{Usage: "<query> [target]", Text: []string{
+		"Returns server statistics. Queries: u (uptime), m (command usage).",
+		"Operators may also query k (K-lines), s (shuns), l (connections), y (connection classes),",
+		"and o (oper blocks).",
+	}}},
+	CmdAdmin: {Registered: true, Help: CommandHelp{Usage: "[server]", Text: []string{
+		"Returns the administrative contact details of the server.",
+	}}},
+	CmdInfo:    {Registered: true, Help: CommandHelp{Usage: "[server]", Text: []string{"Returns information about the server software."}}},
+	CmdVersion: {Registered: true, Help: CommandHelp{Usage: "[server]", Text: []string{"Returns the version of the server software."}}},
+	CmdTime:    {Registered: true, Help: CommandHelp{Usage: "[server]", Text: []string{"Returns the local time of the server."}}},
+	CmdLinks: {Registered: true, Help: CommandHelp{Usage: "[[server] <mask>]", Text: []string{
+		"Returns the servers of the network whose name matches the mask.",
+	}}},
+	CmdList: {Registered: true, Help: CommandHelp{Usage: "[<channel|condition>{,<channel|condition>}] [server]", Text: []string{
+		"Lists the channels matching the masks and conditions given, or all of them.",
+		"Masks beginning with ! exclude the channels they match. The conditions are:",
+		"  >n, <n        More, or fewer, than n users.",
+		"  C>n, C<n      Created more, or less, than n minutes ago.",
+		"  T>n, T<n      Topic set more, or less, than n minutes ago.",
+	}}},
+	CmdHelp: {Registered: true, Help: CommandHelp{Usage: "[command]", Text: []string{
+		"Lists the commands available to you, or returns the help text of a command.",
+	}}},
+
+	CmdKill: {Registered: true, Oper: true, Privilege: PrivKill, MinParams: 1, Help: CommandHelp{Usage: "<nick> [:<reason>]", Text: []string{
+		"Disconnects the user from the network with the given reason.",
+	}}},
+	CmdKLine: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{Usage: "[minutes] <user@host> :<reason>", Text: []string{
+		"Bans users matching the mask from the server for the given number of minutes,",
+		"or permanently if omitted, disconnecting any already connected.",
+	}}},
+	CmdUnKLine: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{Usage: "<user@host>", Text: []string{
+		"Removes the K-line on the mask.",
+	}}},
+	CmdBanInfo: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{Usage: "<user@host | filter>", Text: []string{
+		"Returns the server the K-line on the mask, or the spam filter with the name, was set on,",
+		"by whom, and when. K-lines and filters are propagated to every linked server.",
+	}}},
+	CmdShun: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{Usage: "[minutes] <user@host> :<reason>", Text: []string{
+		"Silently ignores all commands but PING, PONG, and QUIT from users matching the mask,",
+		"for the given number of minutes, or permanently if omitted.",
+	}}},
+	CmdUnShun: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{Usage: "<user@host>", Text: []string{
+		"Removes the shun on the mask.",
+	}}},
+	CmdLockdown: {Registered: true, Oper: true, Privilege: PrivAdmin, Help: CommandHelp{Usage: "[OFF|1-5] [:reason]", Text: []string{
+		"Reports or sets the lockdown level of the server, each level adding a restriction:",
+		"1: account registration disabled, 2: SASL required, 3: channel creation restricted",
+		"to operators, 4: strict flood limits, 5: new connections refused.",
+	}}},
+	CmdGlobops: {Registered: true, Oper: true, Help: CommandHelp{Usage: ":<text>", Text: []string{
+		"Sends a notice to every operator.",
+	}}},
+	CmdGlobalNotice: {Registered: true, Oper: true, Privilege: PrivAdmin, Help: CommandHelp{Usage: ":<text>", Text: []string{
+		"Sends a notice to every user on the server.",
+	}}},
+	CmdAudit: {Registered: true, Oper: true, Privilege: PrivAdmin, Help: CommandHelp{Usage: "[count] [mask]", Text: []string{
+		"Lists the most recent operator actions, optionally only those whose",
+		"operator, action, or target matches the mask.",
+	}}},
+	CmdFilter: {Registered: true, Oper: true, Privilege: PrivKLine, MinParams: 1, Help: CommandHelp{
+		Usage: "LIST | ADD <name> <text|nick|gecos> <block|kill|kline|notify> <glob|regex> <reason|-> :<pattern> | DEL <name>",
+		Text: []string{
+			"Manages the rules filtering the text of messages, or the nicks and realnames of users.",
+			"Users matching a rule are blocked, killed, or K-lined, and operators notified.",
+			"Use underscores for spaces in the reason, or - for the default reason.",
+		},
+	}},
+	CmdCensor: {Registered: true, Oper: true, Privilege: PrivAdmin, MinParams: 1, Help: CommandHelp{Usage: "LIST | ADD <word> [replacement|BLOCK] | DEL <word>", Text: []string{
+		"Manages the words censored in messages to or from censored (+G) users, and in +G channels.",
+		"Censored words are replaced, or messages containing them blocked with BLOCK.",
+	}}},
+	CmdDebug: {Registered: true, Oper: true, Privilege: PrivAdmin, MinParams: 1, Help: CommandHelp{Usage: "LOGLEVEL [[category] level] | SNOMASK [+d|-d]", Text: []string{
+		"Reports or sets the level of the server log, or of one of its categories:",
+		"listener, reader, writer, or router. Levels are trace, debug, info, warn, and error.",
+		"Set a category to default to have it follow the level of the server log.",
+		"SNOMASK subscribes to warnings and errors from the server log with +d.",
+	}}},
+	CmdDrain: {Registered: true, Oper: true, Privilege: PrivDie, Help: CommandHelp{Text: []string{
+		"Stops the server accepting new connections, while existing connections are served",
+		"until they disconnect, such as when moving users to another deployment.",
+	}}},
+	CmdRehash: {Registered: true, Oper: true, Privilege: PrivRehash, Help: CommandHelp{Text: []string{
+		"Reloads the certificate files and other reloadable configuration of the server.",
+	}}},
+	CmdConnect: {Registered: true, Oper: true, Privilege: PrivRouting, MinParams: 1, Help: CommandHelp{Usage: "<server>", Text: []string{
+		"Links the server to the server of a connect block.",
+	}}},
+	CmdSquit: {Registered: true, Oper: true, Privilege: PrivRouting, MinParams: 1, Help: CommandHelp{Usage: "<server> [:<reason>]", Text: []string{
+		"Unlinks a server linked to the server, splitting its users from the network.",
+	}}},
+	CmdMap: {Registered: true, Oper: true, Help: CommandHelp{Text: []string{
+		"Returns the servers of the network as a tree, with the number of users on each.",
+	}}},
+}
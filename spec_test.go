@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinSpecs(t *testing.T) {
+	srv, err := NewServer()
+	assert.NoError(t, err)
+	srv.registerHandlers()
+
+	for command := range srv.Router.HandlerMap {
+		spec, exists := srv.Router.Spec(command)
+		assert.True(t, exists, "no spec registered for %s", command)
+		assert.NotEmpty(t, spec.Help.Text, "no help registered for %s", command)
+	}
+	assert.Len(t, builtinSpecs, len(srv.Router.HandlerMap))
+}
+
+func TestSpecAvailable(t *testing.T) {
+	user := &User{perm: UPermUser}
+	oper := &User{perm: UPermNetOp, privileges: PrivKLine}
+
+	tests := []struct {
+		name string
+		spec CommandSpec
+		user bool
+		oper bool
+	}{
+		{name: "user", spec: CommandSpec{}, user: true, oper: true},
+		{name: "oper", spec: CommandSpec{Oper: true}, oper: true},
+		{name: "privilege held", spec: CommandSpec{Oper: true, Privilege: PrivKLine}, oper: true},
+		{name: "privilege not held", spec: CommandSpec{Oper: true, Privilege: PrivAdmin}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.user, test.spec.available(user))
+			assert.Equal(t, test.oper, test.spec.available(oper))
+		})
+	}
+}
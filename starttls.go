@@ -0,0 +1,95 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// tlsHandshakeTimeout sets how long a client has to complete the TLS handshake after STARTTLS.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// startTLSAvailable reports whether the connection may be upgraded with STARTTLS,
+// returning the reason it may not otherwise.
+func (conn *Conn) startTLSAvailable() (bool, Error) {
+	if conn.isRegistered() {
+		return false, ErrStartTLSRegistered
+	}
+
+	if _, secure := conn.socket().(*tls.Conn); secure || conn.listener.tls {
+		return false, ErrStartTLSSecure
+	}
+
+	if conn.listener.webSocket || !conn.server.hasTLSCertificates() {
+		return false, ErrStartTLSDisabled
+	}
+
+	return true, ""
+}
+
+// doStartTLS replies with RPL_STARTTLS and upgrades the connection to TLS in place.
+//
+// This must only be called from the read loop goroutine, as it replaces the
+// line scanner which the read loop uses for the next message. The socket lock
+// is held for the duration of the upgrade so the write loop cannot interleave
+// plaintext writes with the handshake.
+func (conn *Conn) doStartTLS() {
+	logger := conn.logger.WithField("operation", "starttls")
+
+	if ok, reason := conn.startTLSAvailable(); !ok {
+		conn.ReplyStartTLSFail(reason)
+		return
+	}
+
+	config := conn.server.cloneTLSConfig()
+
+	nick := conn.user.Nick()
+	if len(nick) == 0 {
+		nick = "*"
+	}
+
+	reply := conn.newMessage()
+	defer msgPool.Recycle(reply, reply.Generation())
+	reply.Code = ReplyStartTLS
+	reply.Params = []string{nick}
+	reply.Trailing = "STARTTLS successful, proceed with TLS handshake"
+	buffer := reply.RenderBuffer()
+	defer bufPool.Recycle(buffer)
+
+	conn.sockMu.Lock()
+	defer conn.sockMu.Unlock()
+
+	_ = conn.sock.SetWriteDeadline(time.Now().Add(conn.writeTimeout()))
+	_, writeErr := conn.outgoing.Write(buffer.Bytes())
+	if writeErr == nil {
+		writeErr = conn.outgoing.Flush()
+	}
+	if writeErr != nil {
+		logger.Error(fmt.Errorf("error writing to socket: %w", writeErr))
+		conn.cancel(fmt.Errorf("%w: %w", ErrStartTLSFailed, writeErr))
+		return
+	}
+
+	tlsConn := tls.Server(conn.sock, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		logger.Error(fmt.Errorf("error occurred during STARTTLS handshake: %w", err))
+		conn.cancel(fmt.Errorf("%w: %w", ErrStartTLSFailed, err))
+		return
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	conn.sock = tlsConn
+	conn.incoming = conn.server.buffers.scanner(tlsConn, conn.readBuffer)
+	conn.outgoing.Reset(tlsConn)
+	conn.setTLS(tlsConn)
+
+	logger.Debugf("connection upgraded to TLS (%s)", tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+}
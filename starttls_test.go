@@ -0,0 +1,144 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTLSClient serves a connection over a pipe, sends STARTTLS, and returns the client
+// end once the server has replied with RPL_STARTTLS.
+func startTLSClient(t *testing.T, srv *Server) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	conn := NewConn(context.Background(), srv, server, srv.logger)
+	go serve(conn)
+
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := client.Write([]byte("STARTTLS\r\n"))
+	require.NoError(t, err)
+
+	// Read byte by byte, so that none of the handshake is consumed with the reply.
+	var line []byte
+	buf := make([]byte, 1)
+	for !strings.HasSuffix(string(line), "\r\n") {
+		_, err = client.Read(buf)
+		require.NoError(t, err)
+		line = append(line, buf[0])
+	}
+	assert.Equal(t, ":irc.example.net 670 * :STARTTLS successful, proceed with TLS handshake\r\n", string(line))
+	return conn, client
+}
+
+func TestStartTLS(t *testing.T) {
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}}),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, client := startTLSClient(t, srv)
+	assert.False(t, conn.Secure())
+
+	tlsClient := tls.Client(client, &tls.Config{ServerName: "irc.example.net", InsecureSkipVerify: true})
+	require.NoError(t, tlsClient.Handshake())
+
+	// Registration continues over the upgraded connection.
+	_, err = tlsClient.Write([]byte("NICK bob\r\nUSER bob 0 * :Bob\r\n"))
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(tlsClient)
+	require.True(t, scanner.Scan())
+	assert.Contains(t, scanner.Text(), " 001 bob ")
+	assert.True(t, conn.Secure())
+	assert.Contains(t, conn.Cipher(), "TLS 1.3 ")
+}
+
+func TestStartTLSHandshakeFailure(t *testing.T) {
+	srv, err := NewServer(
+		WithHostname("irc.example.net"),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}}),
+	)
+	require.NoError(t, err)
+	srv.registerHandlers()
+
+	conn, client := startTLSClient(t, srv)
+	_, err = client.Write([]byte("NICK bob\r\n"))
+	require.NoError(t, err)
+
+	// A plaintext client fails the handshake, and is disconnected.
+	_, err = bufio.NewReader(client).ReadString('\n')
+	assert.Error(t, err)
+	<-conn.ctx.Done()
+	assert.ErrorIs(t, context.Cause(conn.ctx), ErrStartTLSFailed)
+	assert.False(t, conn.Secure())
+}
+
+func TestStartTLSUnavailable(t *testing.T) {
+	certificates := WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}})
+
+	tests := []struct {
+		name     string
+		options  []ServerOption
+		register bool
+		secure   bool
+		reason   Error
+	}{
+		{
+			name:   "no certificates",
+			reason: ErrStartTLSDisabled,
+		},
+		{
+			name:     "registered",
+			options:  []ServerOption{certificates},
+			register: true,
+			reason:   ErrStartTLSRegistered,
+		},
+		{
+			name:    "tls listener",
+			options: []ServerOption{certificates},
+			secure:  true,
+			reason:  ErrStartTLSSecure,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, err := NewServer(append([]ServerOption{WithHostname("irc.example.net")}, test.options...)...)
+			require.NoError(t, err)
+			srv.registerHandlers()
+
+			conn, route, expect := connectClient(t, srv, "")
+			conn.listener.tls = test.secure
+			nick := "*"
+			if test.register {
+				route("NICK bob")
+				route("USER bob 0 * :Bob")
+				expect(" 001 bob ")
+				nick = "bob"
+			}
+
+			ok, reason := conn.startTLSAvailable()
+			assert.False(t, ok)
+			assert.Equal(t, test.reason, reason)
+
+			route("STARTTLS")
+			expect(" 691 " + nick + " :" + test.reason.Error())
+			assert.Equal(t, test.secure, conn.Secure(), "the connection is not upgraded")
+		})
+	}
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uptime returns how long the server has been serving connections.
+func (srv *Server) Uptime() time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.started.IsZero() {
+		return 0
+	}
+	return time.Since(srv.started)
+}
+
+// doStats replies with the statistics report for the given STATS query letter.
+//
+// Reports other than u (uptime) and m (command usage) are restricted to operators. The
+// command usage report gives the mean latency of handling each command as its trailing.
+func (conn *Conn) doStats(query string, target string) {
+	nick := conn.user.Nick()
+	var batch messageBatch
+	defer batch.recycle()
+
+	reply := func(code uint16, trailing string, params ...string) {
+		msg := conn.newMessage()
+		msg.Code = code
+		msg.Params = append([]string{nick}, params...)
+		msg.Trailing = trailing
+		batch.add(msg)
+	}
+
+	switch query {
+	case "u", "m":
+	default:
+		if !conn.user.HasPrivilege(PrivSpy) {
+			conn.ReplyNoPrivileges()
+			return
+		}
+	}
+
+	switch query {
+	case "u":
+		uptime := conn.server.Uptime()
+		days := int(uptime / (24 * time.Hour))
+		uptime -= time.Duration(days) * 24 * time.Hour
+		reply(ReplyStatsUptime, fmt.Sprintf("Server Up %d days %d:%02d:%02d",
+			days, int(uptime.Hours()), int(uptime.Minutes())%60, int(uptime.Seconds())%60))
+
+	case "m":
+		for _, stats := range conn.server.Router.Snapshot() {
+			reply(ReplyStatsCommands, fmt.Sprintf("mean %dus", stats.Latency.Mean().Microseconds()),
+				stats.Command, strconv.FormatUint(stats.Count, 10), "0", "0")
+		}
+
+	case "l":
+		conn.server.Users.ForEach(func(_ string, user *User) error {
+			if user.conn == nil || (target != "" && target != user.Nick()) {
+				return nil
+			}
+
+			stats := user.conn.Stats()
+			reply(ReplyStatsLinkInfo, "",
+				fmt.Sprintf("%s[%s]", user.Nick(), user.conn.userhost()),
+				strconv.FormatInt(stats.SendQueue, 10),
+				strconv.FormatUint(stats.SentMessages, 10),
+				strconv.FormatUint(stats.SentBytes/1024, 10),
+				strconv.FormatUint(stats.ReceivedMessages, 10),
+				strconv.FormatUint(stats.ReceivedBytes/1024, 10),
+				strconv.FormatInt(int64(time.Since(stats.Connected).Seconds()), 10),
+				stats.Class,
+			)
+			return nil
+		})
+
+	case "k":
+		for _, kline := range conn.server.klines.list() {
+			user, host := splitUserhost(kline.Mask)
+			reason := kline.Reason
+			if !kline.Expires.IsZero() {
+				reason = fmt.Sprintf("%s (expires %s)", reason, kline.Expires.Format(time.RFC3339))
+			}
+			reply(ReplyStatsKLine, reason, "K", host, "*", user)
+		}
+
+	case "s":
+		for _, shun := range conn.server.shuns.list() {
+			user, host := splitUserhost(shun.Mask)
+			reason := shun.Reason
+			if !shun.Expires.IsZero() {
+				reason = fmt.Sprintf("%s (expires %s)", reason, shun.Expires.Format(time.RFC3339))
+			}
+			reply(ReplyStatsKLine, reason, "S", host, "*", user)
+		}
+
+	case "y":
+		classes, clients := conn.server.ConnClasses()
+		for i, class := range classes {
+			idle := class.IdleTimeout
+			if idle == 0 {
+				idle = conn.server.Timeouts().Ping
+			}
+			reply(ReplyStatsYLine, "", "Y", class.Name,
+				strconv.FormatInt(int64(idle.Seconds()), 10),
+				"0",
+				strconv.Itoa(class.MaxClients),
+				strconv.Itoa(class.SendQ),
+				strconv.Itoa(class.RecvQ),
+				strconv.Itoa(clients[i]),
+			)
+		}
+
+	case "o":
+		for _, block := range conn.server.opers {
+			reply(ReplyStatsNetOp, "", "O", block.hostmask, "*", block.name)
+		}
+	}
+
+	reply(ReplyEndOfStats, "End of /STATS report", query)
+
+	for i := range batch.messages {
+		conn.WriteMessage(batch.messages[i])
+	}
+}
+
+// ConnStats holds the traffic statistics of a connection.
+type ConnStats struct {
+	Class            string // Name of the connection class, empty until registered.
+	Connected        time.Time
+	SendQueue        int64 // Bytes queued for writing to the connection.
+	SentMessages     uint64
+	SentBytes        uint64
+	ReceivedMessages uint64
+	ReceivedBytes    uint64
+}
+
+// Stats returns the traffic statistics of the connection.
+func (conn *Conn) Stats() ConnStats {
+	conn.mu.RLock()
+	connected := conn.connected
+	conn.mu.RUnlock()
+
+	return ConnStats{
+		Class:            conn.Class(),
+		Connected:        connected,
+		SendQueue:        conn.sendQueue.Load(),
+		SentMessages:     conn.sentMessages.Load(),
+		SentBytes:        conn.sentBytes.Load(),
+		ReceivedMessages: conn.recvMessages.Load(),
+		ReceivedBytes:    conn.recvBytes.Load(),
+	}
+}
+
+// splitUserhost splits a user@host mask into its parts.
+func splitUserhost(mask string) (user, host string) {
+	user, host, found := strings.Cut(mask, AT)
+	if !found {
+		return "*", mask
+	}
+	return user, host
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage is a persistence backend for server state such as accounts. Values are
+// opaque byte slices stored under a key within a named bucket.
+//
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the value stored under the key, or ErrNotFound.
+	Get(bucket, key string) ([]byte, error)
+	// Put stores the value under the key, replacing any existing value.
+	Put(bucket, key string, value []byte) error
+	// Delete removes the key from the bucket. Deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// List returns a copy of every key and value stored in the bucket.
+	List(bucket string) (map[string][]byte, error)
+}
+
+// WithStorage sets the persistence backend of the server.
+// If not set, state is kept in memory and lost on restart.
+func WithStorage(storage Storage) ServerOption {
+	return option(func(s *Server) error {
+		if storage == nil {
+			return fmt.Errorf("storage must not be nil")
+		}
+		s.storage = storage
+		return nil
+	})
+}
+
+// memoryStorage is a Storage held entirely in memory.
+type memoryStorage struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStorage returns a Storage which keeps all values in memory.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (ms *memoryStorage) Get(bucket, key string) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	value, exists := ms.buckets[bucket][key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (ms *memoryStorage) Put(bucket, key string, value []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.buckets[bucket] == nil {
+		ms.buckets[bucket] = make(map[string][]byte)
+	}
+	ms.buckets[bucket][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (ms *memoryStorage) Delete(bucket, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.buckets[bucket], key)
+	return nil
+}
+
+func (ms *memoryStorage) List(bucket string) (map[string][]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	values := make(map[string][]byte, len(ms.buckets[bucket]))
+	for key, value := range ms.buckets[bucket] {
+		values[key] = append([]byte(nil), value...)
+	}
+	return values, nil
+}
+
+// fileStorage is a Storage which keeps every bucket in memory and writes it
+// through to a JSON file of the same name in a directory on each change.
+type fileStorage struct {
+	memoryStorage
+	dir string
+}
+
+// NewFileStorage returns a Storage persisted as one JSON file per bucket in the given
+// directory, which is created if it does not exist. Existing buckets are loaded eagerly.
+func NewFileStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %w", err)
+	}
+
+	fs := &fileStorage{
+		memoryStorage: memoryStorage{buckets: make(map[string]map[string][]byte)},
+		dir:           dir,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, readErr := os.ReadFile(file)
+		if readErr != nil {
+			return nil, fmt.Errorf("error reading storage bucket: %w", readErr)
+		}
+
+		bucket := make(map[string][]byte)
+		if jsonErr := json.Unmarshal(data, &bucket); jsonErr != nil {
+			return nil, fmt.Errorf("error decoding storage bucket [%s]: %w", file, jsonErr)
+		}
+
+		name := filepath.Base(file)
+		fs.buckets[name[:len(name)-len(".json")]] = bucket
+	}
+
+	return fs, nil
+}
+
+func (fs *fileStorage) Put(bucket, key string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.buckets[bucket] == nil {
+		fs.buckets[bucket] = make(map[string][]byte)
+	}
+	fs.buckets[bucket][key] = append([]byte(nil), value...)
+	return fs.flushLocked(bucket)
+}
+
+func (fs *fileStorage) Delete(bucket, key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, exists := fs.buckets[bucket][key]; !exists {
+		return nil
+	}
+	delete(fs.buckets[bucket], key)
+	return fs.flushLocked(bucket)
+}
+
+// flushLocked writes the bucket to disk, replacing the previous file atomically.
+func (fs *fileStorage) flushLocked(bucket string) error {
+	data, err := json.Marshal(fs.buckets[bucket])
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(fs.dir, bucket+".json")
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("error writing storage bucket: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// storeJSON encodes the value as JSON and stores it under the key.
+func storeJSON(storage Storage, bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return storage.Put(bucket, key, data)
+}
+
+// loadJSON loads the value stored under the key and decodes it from JSON.
+func loadJSON(storage Storage, bucket, key string, value any) error {
+	data, err := storage.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
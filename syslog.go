@@ -0,0 +1,137 @@
+//go:build !windows && !plan9
+
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogFacilities are the facility names accepted by WithSyslog.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogConfig is the syslog output configured with WithSyslog.
+type syslogConfig struct {
+	facility syslog.Priority
+	tag      string
+	network  string
+	address  string
+}
+
+// WithSyslog sends the entries of the server logger to syslog, in addition to its output,
+// with the facility by name, such as "daemon" or "local0", and the tag. The network and
+// address are those of the collector, such as "udp" and "loghost:514", or empty for the
+// local syslog daemon.
+//
+// Syslog output requires the logrus logger, and is not supported with WithSlogLogger.
+func WithSyslog(facility, tag, network, address string) ServerOption {
+	return option(func(s *Server) error {
+		priority, ok := syslogFacilities[strings.ToLower(facility)]
+		if !ok {
+			return fmt.Errorf("unknown syslog facility %q", facility)
+		}
+		s.syslog = &syslogConfig{
+			facility: priority,
+			tag:      tag,
+			network:  network,
+			address:  address,
+		}
+		return nil
+	})
+}
+
+// startSyslog connects to the syslog collector configured with WithSyslog, if any, and
+// adds a hook sending the entries of the logger to it.
+func (srv *Server) startSyslog() error {
+	if srv.syslog == nil {
+		return nil
+	}
+	if srv.logrus == nil {
+		return errors.New("syslog output requires the logrus logger")
+	}
+
+	cfg := srv.syslog
+	writer, err := syslog.Dial(cfg.network, cfg.address, cfg.facility|syslog.LOG_INFO, cfg.tag)
+	if err != nil {
+		return fmt.Errorf("error connecting to syslog: %w", err)
+	}
+
+	srv.logrus.AddHook(&syslogHook{
+		writer: writer,
+		formatter: &logrus.TextFormatter{
+			DisableColors:    true,
+			DisableTimestamp: true,
+		},
+	})
+	srv.registerOnShutdown(func() {
+		_ = writer.Close()
+	})
+
+	return nil
+}
+
+// syslogHook writes logrus entries to syslog at the severity of their level. Syslog
+// stamps the entries itself, so the formatter omits the time.
+type syslogHook struct {
+	writer    *syslog.Writer
+	formatter logrus.Formatter
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(string(line), "\n")
+
+	switch entry.Level {
+	case logrus.PanicLevel:
+		return h.writer.Crit(msg)
+	case logrus.FatalLevel:
+		return h.writer.Alert(msg)
+	case logrus.ErrorLevel:
+		return h.writer.Err(msg)
+	case logrus.WarnLevel:
+		return h.writer.Warning(msg)
+	case logrus.InfoLevel:
+		return h.writer.Info(msg)
+	default:
+		return h.writer.Debug(msg)
+	}
+}
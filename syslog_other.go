@@ -0,0 +1,26 @@
+//go:build windows || plan9
+
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import "errors"
+
+// syslogConfig is unused on platforms without syslog.
+type syslogConfig struct{}
+
+// WithSyslog is not supported on this platform, and returns an error when applied.
+func WithSyslog(facility, tag, network, address string) ServerOption {
+	return option(func(s *Server) error {
+		return errors.New("syslog output is not supported on this platform")
+	})
+}
+
+func (srv *Server) startSyslog() error {
+	return nil
+}
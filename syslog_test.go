@@ -0,0 +1,53 @@
+//go:build !windows && !plan9
+
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslog(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	srv, err := NewServer(
+		WithLogger(logger),
+		WithSyslog("local0", "dircd", "udp", collector.LocalAddr().String()),
+	)
+	require.NoError(t, err)
+
+	srv.logger.Warn("disk almost full")
+
+	buf := make([]byte, 1024)
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := collector.ReadFrom(buf)
+	require.NoError(t, err)
+
+	packet := string(buf[:n])
+	// local0 is facility 16, and warning is severity 4.
+	assert.Contains(t, packet, "<132>")
+	assert.Contains(t, packet, "dircd[")
+	assert.Contains(t, packet, `msg="disk almost full"`)
+	assert.Contains(t, packet, "component=irc-server")
+	assert.NotContains(t, packet, "time=")
+
+	_, err = NewServer(WithSyslog("nonsense", "dircd", "udp", collector.LocalAddr().String()))
+	assert.Error(t, err)
+}
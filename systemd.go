@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Environment variables set by systemd for socket activation and readiness notification.
+const (
+	envListenPID    = "LISTEN_PID"
+	envListenFDs    = "LISTEN_FDS"
+	envListenNames  = "LISTEN_FDNAMES"
+	envNotifySocket = "NOTIFY_SOCKET"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// Service state notifications understood by systemd.
+const (
+	sdReady     = "READY=1"
+	sdReloading = "RELOADING=1"
+	sdStopping  = "STOPPING=1"
+)
+
+// systemdListeners returns the listening sockets passed to the process by systemd
+// socket activation, if any. Sockets are matched to configured listeners by address,
+// and if no listeners are configured, every activated socket is served as plain IRC.
+//
+// The environment variables are cleared so they are not passed on to any children.
+func systemdListeners() ([]*net.TCPListener, error) {
+	pid, fds := os.Getenv(envListenPID), os.Getenv(envListenFDs)
+	if fds == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(envListenPID)
+	_ = os.Unsetenv(envListenFDs)
+	_ = os.Unsetenv(envListenNames)
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil // Intended for another process.
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value [%s]: %w", envListenFDs, fds, err)
+	}
+
+	return fileListeners(sdListenFDsStart, count)
+}
+
+// sdNotify sends the state notification to the service manager, if the process was
+// started by systemd with a notification socket (eg: a Type=notify unit), otherwise
+// it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv(envNotifySocket)
+	if socket == "" {
+		return nil
+	}
+
+	// A leading '@' denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error connecting to systemd notification socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyService sends the state notification to the service manager, logging any failure.
+func (srv *Server) notifyService(state string) {
+	if err := sdNotify(state); err != nil {
+		srv.logger.WithField("sub-component", "systemd").Warn(err)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"strings"
+)
+
+// numericTemplates are the canonical formats of numeric replies, following the nick the
+// reply is addressed to. Each <placeholder> is substituted with the next argument of the
+// reply, and the text after " :" is the trailing parameter. An argument given beyond the
+// placeholders replaces the text of the trailing parameter, eg: with the reason a user
+// was refused.
+var numericTemplates = map[uint16]string{
+	ReplyBounce:             "<host> <port> :Please reconnect to this server",
+	ReplyNickForceChanged:   "<nick> :Your nick has been changed",
+	ReplyTryAgain:           "<command> :" + string(ErrTryAgain),
+	ReplyUserModeIs:         "<modes>",
+	ReplyUserHost:           ":<replies>",
+	ReplyChanTopic:          "<channel> :<topic>",
+	ReplyTopicWhoTime:       "<channel> <setter> <time>",
+	ReplyCreationTime:       "<channel> <time>",
+	ReplyYoureOper:          ":You are now an IRC operator",
+	ReplyRehashing:          "<server> :Rehashing",
+	ReplyNoSuchNick:         "<nick> :" + string(ErrNoSuchNick),
+	ReplyNoSuchChannel:      "<channel> :" + string(ErrNoSuchChan),
+	ReplyNoSuchServer:       "<server> :No such server",
+	ReplyLinks:              "<mask> <server> :<hops> <info>",
+	ReplyEndOfLinks:         "<mask> :End of LINKS list",
+	ReplyMap:                ":<line>",
+	ReplyMapEnd:             ":End of MAP",
+	ReplyListStart:          "Channel :Users  Name",
+	ReplyList:               "<channel> <count> :<topic>",
+	ReplyEndOfList:          ":End of /LIST",
+	ReplyCannotSendToChan:   "<channel> :Cannot send to channel",
+	ReplyTooManyChannels:    "<channel> :" + string(ErrTooManyChans),
+	ReplyNoRecipient:        ":" + string(ErrNoRecipient) + " (<command>)",
+	ReplyNoTextToSend:       ":" + string(ErrNoTextToSend),
+	ReplyInputTooLong:       ":" + string(ErrInputTooLong),
+	ReplyUnknownCommand:     "<command> :" + string(ErrNotImplemented),
+	ReplyNoNicknameGiven:    ":" + string(ErrNoNickGiven),
+	ReplyErroneusNickname:   "<nick> :" + string(ErrErroneousNickname),
+	ReplyNicknameInUse:      "<nick> :" + string(ErrNickInUse),
+	ReplyUserNotInChannel:   "<nick> <channel> :" + string(ErrUserNotInChannel),
+	ReplyServicesDown:       "<service> :" + string(ErrServicesDown),
+	ReplyNotRegistered:      ":" + string(ErrNotRegistered),
+	ReplyNeedMoreParams:     "<command> :" + string(ErrMissingParams),
+	ReplyAlreadyRegistered:  ":" + string(ErrUserAreadySet),
+	ReplyPasswordMistmatch:  ":" + string(ErrPasswordMismatch),
+	ReplyYoureBanned:        ":" + string(ErrYoureBanned),
+	ReplyChannelIsFull:      "<channel> :" + string(ErrChannelIsFull),
+	ReplyUnknownMode:        "<char> :" + string(ErrUnknownMode),
+	ReplyInviteOnlyChan:     "<channel> :" + string(ErrInviteOnlyChan),
+	ReplyBannedFromChan:     "<channel> :" + string(ErrBannedFromChan),
+	ReplyBadChannelPass:     "<channel> :" + string(ErrBadChannelKey),
+	ReplyBanListFUll:        "<channel> <char> :" + string(ErrChanListFull),
+	ReplyNoPrivileges:       ":" + string(ErrNoPrivileges),
+	ReplyChanOpPrivsNeeded:  "<channel> :" + string(ErrChanOpPrivsNeeded),
+	ReplyNoOperHost:         ":" + string(ErrNoOperHost),
+	ReplyUsersDontMatch:     ":" + string(ErrUsersDontMatch),
+	ReplyInvalidCapCmd:      "<command> :" + string(ErrInvalidCapCmd),
+	ReplyHelpNotFound:       "<subject> :" + string(ErrHelpNotFound),
+	ReplyCannotSendToUser:   "<nick> :Cannot send to user",
+	ReplyUnknownUserMode:    ":" + string(ErrUModeUnknownFlag),
+	ReplyStartTLSFail:       ":" + string(ErrStartTLSFailed),
+	ReplyRSAChallenge2:      ":<nonce>",
+	ReplyEndOfRSAChallenge2: ":End of CHALLENGE",
+	ReplyLoggedIn:           "<mask> <account> :You are now logged in as <account>",
+	ReplyLoggedOut:          "<mask> :You are now logged out",
+	ReplySASLMechs:          "<mechanisms> :are available SASL mechanisms",
+}
+
+// numericFormat is a numeric reply template parsed into its parameters.
+type numericFormat struct {
+	middle   []string // The middle parameters, placeholders included.
+	trailing []string // The text of the trailing parameter, split around its placeholders.
+	hasText  bool     // The template has a trailing parameter.
+}
+
+// numericFormats are the numericTemplates, parsed.
+var numericFormats = parseNumericTemplates(numericTemplates)
+
+func parseNumericTemplates(templates map[uint16]string) map[uint16]numericFormat {
+	formats := make(map[uint16]numericFormat, len(templates))
+	for code, template := range templates {
+		var format numericFormat
+		middle, trailing, hasText := strings.Cut(template, COLON)
+		format.middle = strings.Fields(middle)
+		format.hasText = hasText
+		for len(trailing) > 0 {
+			start := strings.IndexByte(trailing, '<')
+			end := strings.IndexByte(trailing, '>')
+			if start < 0 || end < start {
+				format.trailing = append(format.trailing, trailing)
+				break
+			}
+			format.trailing = append(format.trailing, trailing[:start], trailing[start:end+1])
+			trailing = trailing[end+1:]
+		}
+		formats[code] = format
+	}
+	return formats
+}
+
+// isPlaceholder reports whether the part of a template is a <placeholder>.
+func isPlaceholder(part string) bool {
+	return len(part) > 2 && part[0] == '<' && part[len(part)-1] == '>'
+}
+
+// formatNumeric returns the parameters of the numeric reply with the arguments, following
+// the nick it is addressed to, the last of which is sent as the trailing parameter. Empty
+// arguments for middle parameters are omitted, such as the command of a reply to a
+// message without one. Replies without a template are sent the arguments as they are.
+func formatNumeric(code uint16, args []string) []string {
+	format, exists := numericFormats[code]
+	if !exists {
+		return args
+	}
+
+	next := 0
+	arg := func() string {
+		if next >= len(args) {
+			return "*"
+		}
+		next++
+		return args[next-1]
+	}
+
+	// Placeholders repeated in the text, such as the account of RPL_LOGGEDIN, are
+	// substituted with the same argument as in the middle parameters.
+	values := make(map[string]string, len(format.middle))
+	params := make([]string, 0, len(format.middle)+1)
+	for _, part := range format.middle {
+		if !isPlaceholder(part) {
+			params = append(params, part)
+			continue
+		}
+		value := arg()
+		values[part] = value
+		if len(value) > 0 {
+			params = append(params, value)
+		}
+	}
+	if !format.hasText {
+		return params
+	}
+
+	var text strings.Builder
+	for _, part := range format.trailing {
+		switch value, repeated := values[part]; {
+		case !isPlaceholder(part):
+			text.WriteString(part)
+		case repeated:
+			text.WriteString(value)
+		default:
+			text.WriteString(arg())
+		}
+	}
+
+	if next < len(args) {
+		return append(params, args[next])
+	}
+	return append(params, text.String())
+}
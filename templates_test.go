@@ -0,0 +1,28 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatNumeric(t *testing.T) {
+	assert.Equal(t, []string{"mallory", ErrNoSuchNick.Error()}, formatNumeric(ReplyNoSuchNick, []string{"mallory"}))
+	assert.Equal(t, []string{"*", ErrNoSuchNick.Error()}, formatNumeric(ReplyNoSuchNick, nil), "missing argument")
+	assert.Equal(t, []string{"#dircd", "Cannot send to channel (+m)"}, formatNumeric(ReplyCannotSendToChan, []string{"#dircd", "Cannot send to channel (+m)"}), "overridden text")
+	assert.Equal(t, []string{ErrMissingParams.Error()}, formatNumeric(ReplyNeedMoreParams, []string{""}), "empty command")
+	assert.Equal(t, []string{ErrNoRecipient.Error() + " (PRIVMSG)"}, formatNumeric(ReplyNoRecipient, []string{"PRIVMSG"}))
+	assert.Equal(t, []string{"#dircd", "Welcome to dircd"}, formatNumeric(ReplyChanTopic, []string{"#dircd", "Welcome to dircd"}))
+	assert.Equal(t, []string{"#dircd", "bob", "1672531200"}, formatNumeric(ReplyTopicWhoTime, []string{"#dircd", "bob", "1672531200"}))
+	assert.Equal(t,
+		[]string{"bob!bob@example.net", "bob", "You are now logged in as bob"},
+		formatNumeric(ReplyLoggedIn, []string{"bob!bob@example.net", "bob"}), "repeated placeholder")
+	assert.Equal(t, []string{"a", "b", "c"}, formatNumeric(ReplyChannelModeIs, []string{"a", "b", "c"}), "no template")
+}
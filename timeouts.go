@@ -0,0 +1,87 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Timeouts are the timeouts of client connections. Connection classes may override them
+// for the users assigned to them, see ConnClass.
+type Timeouts struct {
+	KeepAlive time.Duration // TCP keep-alive period, and how long a connection may send nothing before it is closed.
+	Ping      time.Duration // How long a connection may be idle before it is sent a PING, and closed if it does not reply.
+	Write     time.Duration // How long a write to a connection may block before it is closed.
+}
+
+// DefaultTimeouts returns the timeouts used unless configured with WithTimeouts.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		KeepAlive: 2 * time.Minute,
+		Ping:      30 * time.Second,
+		Write:     5 * time.Second,
+	}
+}
+
+// validate checks every timeout is positive.
+func (t Timeouts) validate() error {
+	var errs []error
+	for name, timeout := range map[string]time.Duration{
+		"keep-alive": t.KeepAlive, "ping": t.Ping, "write": t.Write,
+	} {
+		if timeout <= 0 {
+			errs = append(errs, fmt.Errorf("%s timeout must be positive, got %s", name, timeout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithTimeouts sets the timeouts of client connections.
+func WithTimeouts(timeouts Timeouts) ServerOption {
+	return option(func(s *Server) error {
+		if err := timeouts.validate(); err != nil {
+			return err
+		}
+		s.timeouts = &timeouts
+		return nil
+	})
+}
+
+// Timeouts returns the timeouts of client connections.
+func (srv *Server) Timeouts() Timeouts {
+	if srv.timeouts != nil {
+		return *srv.timeouts
+	}
+	return DefaultTimeouts()
+}
+
+// idleTimeout returns how long the connection may be idle before it is sent a PING.
+func (conn *Conn) idleTimeout() time.Duration {
+	if class := conn.class.Load(); class != nil && class.IdleTimeout > 0 {
+		return class.IdleTimeout
+	}
+	return conn.server.Timeouts().Ping
+}
+
+// keepAliveTimeout returns how long the connection may send nothing before it is closed.
+func (conn *Conn) keepAliveTimeout() time.Duration {
+	if class := conn.class.Load(); class != nil && class.KeepAliveTimeout > 0 {
+		return class.KeepAliveTimeout
+	}
+	return conn.server.Timeouts().KeepAlive
+}
+
+// writeTimeout returns how long a write to the connection may block before it is closed.
+func (conn *Conn) writeTimeout() time.Duration {
+	if class := conn.class.Load(); class != nil && class.WriteTimeout > 0 {
+		return class.WriteTimeout
+	}
+	return conn.server.Timeouts().Write
+}
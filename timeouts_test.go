@@ -0,0 +1,43 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts{KeepAlive: time.Minute, Ping: 10 * time.Second, Write: time.Second}
+	srv, err := NewServer(
+		WithTimeouts(timeouts),
+		WithConnClass(ConnClass{Name: defaultClassName, IdleTimeout: 20 * time.Second, WriteTimeout: 3 * time.Second}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, timeouts, srv.Timeouts())
+
+	user := &User{name: "alice", host: "host.example"}
+	conn := &Conn{server: srv, user: user, listener: &listenerConfig{}, logger: srv.logger}
+	user.conn = conn
+
+	assert.Equal(t, 10*time.Second, conn.idleTimeout())
+	assert.Equal(t, time.Minute, conn.keepAliveTimeout())
+	assert.Equal(t, time.Second, conn.writeTimeout())
+
+	assert.False(t, conn.assignClass())
+	assert.Equal(t, 20*time.Second, conn.idleTimeout())
+	assert.Equal(t, time.Minute, conn.keepAliveTimeout())
+	assert.Equal(t, 3*time.Second, conn.writeTimeout())
+
+	_, err = NewServer(WithTimeouts(Timeouts{KeepAlive: time.Minute, Ping: time.Second}))
+	assert.Error(t, err)
+	_, err = NewServer(WithConnClass(ConnClass{Name: "a", WriteTimeout: -time.Second}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+)
+
+// alpnProtocol is the ALPN protocol identifier for IRC registered with IANA.
+const alpnProtocol = "irc"
+
+// defaultTLSMinVersion is the minimum TLS version accepted unless configured otherwise.
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// tlsSettings holds the TLS hardening knobs, which are applied on top of the
+// base tls.Config once all ServerOptions have been processed, so the order in
+// which the options are given does not matter.
+type tlsSettings struct {
+	minVersion    uint16
+	cipherSuites  []uint16
+	requestClient bool
+}
+
+// WithTLSConfig sets the base TLS configuration used by TLS listeners and STARTTLS.
+// The config is cloned, so later changes made by the caller have no effect.
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return option(func(s *Server) error {
+		if config == nil {
+			return fmt.Errorf("tls config must not be nil")
+		}
+		s.tlsConfig = config.Clone()
+		return nil
+	})
+}
+
+// WithTLSMinVersion sets the minimum TLS version accepted from clients, eg: tls.VersionTLS13.
+// If not set, TLS 1.2 is the minimum.
+func WithTLSMinVersion(version uint16) ServerOption {
+	return option(func(s *Server) error {
+		if version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+			return fmt.Errorf("unsupported minimum TLS version: %#04x", version)
+		}
+		s.tls.minVersion = version
+		return nil
+	})
+}
+
+// WithTLSCipherSuites restricts the TLS 1.0-1.2 cipher suites offered to clients to
+// the given IANA names, eg: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256".
+// TLS 1.3 cipher suites are not configurable.
+func WithTLSCipherSuites(names ...string) ServerOption {
+	return option(func(s *Server) error {
+		suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+		ids := make([]uint16, 0, len(names))
+		for _, name := range names {
+			idx := slices.IndexFunc(suites, func(suite *tls.CipherSuite) bool {
+				return suite.Name == name
+			})
+			if idx < 0 {
+				return fmt.Errorf("unknown TLS cipher suite: %s", name)
+			}
+			ids = append(ids, suites[idx].ID)
+		}
+		s.tls.cipherSuites = ids
+		return nil
+	})
+}
+
+// WithTLSClientCertificates sets TLS connections to request (but not require or
+// verify against a CA) a client certificate, so that the certificate fingerprint
+// can be used to identify the client, eg: for SASL EXTERNAL.
+func WithTLSClientCertificates() ServerOption {
+	return option(func(s *Server) error {
+		s.tls.requestClient = true
+		return nil
+	})
+}
+
+// applyTLSSettings builds the effective TLS configuration from the base config
+// and the configured hardening knobs.
+func (srv *Server) applyTLSSettings() {
+	config := srv.cloneTLSConfig()
+
+	if srv.tls.minVersion != 0 {
+		config.MinVersion = srv.tls.minVersion
+	} else if config.MinVersion < defaultTLSMinVersion {
+		config.MinVersion = defaultTLSMinVersion
+	}
+
+	if len(srv.tls.cipherSuites) > 0 {
+		config.CipherSuites = srv.tls.cipherSuites
+	}
+
+	switch {
+	case srv.acmeManager != nil:
+		config.GetCertificate = srv.acmeManager.GetCertificate
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	case srv.certManager != nil:
+		config.GetCertificate = srv.certManager.GetCertificate
+	}
+
+	if !slices.Contains(config.NextProtos, alpnProtocol) {
+		config.NextProtos = append(config.NextProtos, alpnProtocol)
+	}
+
+	if srv.tls.requestClient && config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+
+	srv.tlsConfig = config
+}
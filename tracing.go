@@ -0,0 +1,123 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation name of the spans recorded by the server.
+const tracerName = "github.com/btnmasher/dircd"
+
+// Span attribute keys
+const (
+	attrCommand  = attribute.Key("irc.command")
+	attrTarget   = attribute.Key("irc.target")
+	attrHandlers = attribute.Key("irc.handlers")
+	attrOutcome  = attribute.Key("irc.outcome")
+	attrBucket   = attribute.Key("storage.bucket")
+	attrSASLMech = attribute.Key("sasl.mechanism")
+)
+
+// Outcomes of routing a command, recorded in its span.
+const (
+	outcomeCompleted      = "completed"       // Every handler in the chain was called.
+	outcomeHandled        = "handled"         // A handler stopped the chain once it handled the command.
+	outcomeAborted        = "aborted"         // A handler aborted the chain.
+	outcomeError          = "error"           // A handler aborted the chain with an error.
+	outcomeRefused        = "refused"         // The command did not satisfy its spec.
+	outcomeNotRegistered  = "not-registered"  // The connection must register to use the command.
+	outcomeShunned        = "shunned"         // The user is shunned.
+	outcomeNotImplemented = "not-implemented" // No handlers are registered for the command.
+)
+
+// WithTracerProvider sets the server to record an OpenTelemetry span for each command it
+// handles, carrying the command, its target, the handlers called, and the outcome. The
+// spans are continued by the account store and the auth providers and token validators
+// used for SASL, which receive the context of the command. Export them over OTLP by
+// configuring the provider with an OTLP exporter, eg: from the OTel SDK.
+func WithTracerProvider(provider trace.TracerProvider) ServerOption {
+	return option(func(s *Server) error {
+		if provider == nil {
+			return errors.New("tracer provider must not be nil")
+		}
+		s.tracer = provider.Tracer(tracerName)
+		return nil
+	})
+}
+
+// defaultTracer returns the tracer used unless configured with WithTracerProvider, which
+// records nothing.
+func defaultTracer() trace.Tracer {
+	return noop.NewTracerProvider().Tracer(tracerName)
+}
+
+// startCommandSpan starts the span of routing the message from the connection, continuing
+// from the context of the connection.
+func (router *Router) startCommandSpan(conn *Conn, msg *Message) (context.Context, trace.Span) {
+	parent := context.Background()
+	if conn != nil && conn.ctx != nil {
+		parent = conn.ctx
+	}
+
+	attrs := []attribute.KeyValue{attrCommand.String(msg.Command)}
+	if len(msg.Params) > 0 {
+		attrs = append(attrs, attrTarget.String(msg.Params[0]))
+	}
+	return router.tracer.Start(parent, "irc.command "+msg.Command,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endCommandSpan records the outcome of routing the command, and the handlers called, in
+// its span and ends it.
+func (c *MessageContext) endCommandSpan(span trace.Span, outcome string) {
+	if len(outcome) == 0 {
+		switch {
+		case c.err != nil:
+			outcome = outcomeError
+		case c.abort:
+			outcome = outcomeAborted
+		case c.handled:
+			outcome = outcomeHandled
+		default:
+			outcome = outcomeCompleted
+		}
+	}
+
+	span.SetAttributes(attrOutcome.String(outcome))
+	if len(c.called) > 0 {
+		span.SetAttributes(attrHandlers.StringSlice(c.called))
+	}
+	if c.err != nil {
+		span.RecordError(c.err)
+		span.SetStatus(codes.Error, c.err.Error())
+	}
+	span.End()
+}
+
+// startSpan starts a span of an internal operation continuing the trace of the context.
+func (srv *Server) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return srv.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error, if any, in the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttrs returns the attributes of the span by key.
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestCommandSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	srv, err := NewServer(WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	assert.NoError(t, err)
+
+	router := srv.Router
+	router.Handle(CmdPrivMsg, func(ctx *MessageContext) {
+		_, span := srv.startSpan(ctx.Context(), "child")
+		span.End()
+		ctx.Handled()
+	})
+	router.Handle(CmdNotice, func(ctx *MessageContext) {
+		ctx.AbortWithError(errors.New("failed"))
+	})
+
+	for _, command := range []string{CmdPrivMsg, CmdNotice} {
+		msg := msgPool.New()
+		msg.Command = command
+		msg.Params = []string{"#chan"}
+		router.RouteMessage(nil, msg)
+	}
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	child, privmsg, notice := spans[0], spans[1], spans[2]
+	assert.Equal(t, "child", child.Name())
+	assert.Equal(t, privmsg.SpanContext().TraceID(), child.Parent().TraceID())
+	assert.Equal(t, privmsg.SpanContext().SpanID(), child.Parent().SpanID())
+
+	assert.Equal(t, "irc.command PRIVMSG", privmsg.Name())
+	attrs := spanAttrs(privmsg)
+	assert.Equal(t, CmdPrivMsg, attrs[attrCommand].AsString())
+	assert.Equal(t, "#chan", attrs[attrTarget].AsString())
+	assert.Equal(t, outcomeHandled, attrs[attrOutcome].AsString())
+	assert.Len(t, attrs[attrHandlers].AsStringSlice(), 1)
+
+	assert.Equal(t, outcomeError, spanAttrs(notice)[attrOutcome].AsString())
+	assert.Equal(t, codes.Error, notice.Status().Code)
+}
+
+func TestAccountSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	srv, err := NewServer(WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	assert.NoError(t, err)
+	assert.NoError(t, srv.RegisterAccount("alice", "hunter2"))
+
+	ctx, span := srv.startSpan(context.Background(), "parent")
+	_, err = srv.authenticatePlain(ctx, "alice", "hunter2")
+	assert.NoError(t, err)
+	span.End()
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 4) {
+		get := spans[2]
+		assert.Equal(t, "storage.get", get.Name())
+		assert.Equal(t, accountsBucket, spanAttrs(get)[attrBucket].AsString())
+		assert.Equal(t, span.SpanContext().SpanID(), get.Parent().SpanID())
+	}
+}
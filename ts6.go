@@ -0,0 +1,1077 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/dircd/shared/stringutils"
+)
+
+// TS6 protocol settings
+const (
+	defaultServerID      = "0DC"
+	ts6Capabilities      = "QS EX IE KLN UNKLN ENCAP TB SERVICES EUID EOPMOD"
+	ts6HandshakeTimeout  = 30 * time.Second
+	ts6PingInterval      = 2 * time.Minute
+	ts6WriteTimeout      = 10 * time.Second
+	ts6SendQueueSize     = 4096
+	ts6MaxLineLength     = 8192
+	ts6ServerDescription = "dircd IRC server"
+)
+
+// uidChars are the characters of a TS6 user ID, the first of which must be a letter.
+const uidChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// serverIDPattern matches a TS6 server ID: a digit followed by two digits or letters.
+var serverIDPattern = regexp.MustCompile(`^[0-9][0-9A-Z]{2}$`)
+
+// ts6UserModes maps TS6 user mode letters to the user modes they set.
+var ts6UserModes = map[byte]uint64{
+	'a': UModeAdmin,
+	'D': UModeDeaf,
+	'i': UModeInvisible,
+	'o': UModeNetOp,
+	'Z': UModeSecured,
+}
+
+// WithServerID sets the TS6 server ID of the server, used to link services, eg: "0DC".
+// It must be a digit followed by two digits or upper case letters, unique on the network.
+func WithServerID(sid string) ServerOption {
+	return option(func(s *Server) error {
+		if !serverIDPattern.MatchString(sid) {
+			return fmt.Errorf("invalid server ID [%s]: expected a digit followed by two digits or upper case letters", sid)
+		}
+		s.sid = sid
+		return nil
+	})
+}
+
+// newUID returns a new TS6 user ID for a local user.
+func (srv *Server) newUID() string {
+	n := srv.uidSeq.Add(1) - 1
+
+	id := make([]byte, 6)
+	for i := len(id) - 1; i > 0; i-- {
+		id[i] = uidChars[n%36]
+		n /= 36
+	}
+	id[0] = uidChars[n%26]
+
+	return srv.sid + string(id)
+}
+
+// servicesLink is a TS6 server link to an external services package, such as Atheme
+// or Anope, which introduces its pseudo-clients (eg: NickServ) as remote users, or to
+// another TS6 server linked with CONNECT, see WithConnectBlock.
+type servicesLink struct {
+	server   *Server
+	address  string
+	name     string
+	password string
+	outbound bool // The link is established by dialing the address with CONNECT, rather than by listening on it.
+	logger   Logger
+
+	mu          sync.Mutex
+	listener    net.Listener
+	conn        net.Conn
+	connecting  bool
+	sid         string
+	description string
+	capab       map[string]bool
+	servers     map[string]*linkedServer // The servers on the link by SID, the peer included.
+	queue       chan string
+	done        chan struct{}
+	unsubscribe func()
+}
+
+// WithServicesLink sets the server to accept a TS6 server link from the services package
+// with the given server name and link password, on a dedicated listener at the address.
+// The services package must be configured to connect to the address as its uplink, with
+// the same password for both directions. Only one link is accepted at a time.
+//
+// The TS6 protocol module of the services package should be used, eg: "protocol/charybdis"
+// for Atheme, or "charybdis" for Anope.
+func WithServicesLink(address, name, password string) ServerOption {
+	return option(func(s *Server) error {
+		if len(name) == 0 || !strings.Contains(name, ".") {
+			return fmt.Errorf("invalid services server name [%s]: must contain a dot", name)
+		}
+		if len(password) == 0 || strings.ContainsAny(password, " :") {
+			return errors.New("services link password must not be empty, or contain spaces or colons")
+		}
+
+		s.servicesLink = &servicesLink{
+			server:   s,
+			address:  address,
+			name:     name,
+			password: password,
+		}
+		return nil
+	})
+}
+
+// startServicesLink starts listening for the services link, if configured.
+func (srv *Server) startServicesLink() {
+	link := srv.servicesLink
+	if link == nil {
+		return
+	}
+
+	link.logger = srv.logger.WithFields(Fields{
+		"sub-component": "services-link",
+		"link":          link.name,
+	})
+
+	listener, err := net.Listen("tcp", link.address)
+	if err != nil {
+		link.logger.Error(fmt.Errorf("error listening for services link: %w", err))
+		return
+	}
+
+	link.mu.Lock()
+	link.listener = listener
+	link.mu.Unlock()
+
+	srv.registerOnShutdown(link.close)
+
+	go func() {
+		link.logger.Infof("listening for services link at [%s]", listener.Addr())
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					link.logger.Error(fmt.Errorf("services link listener terminated: %w", err))
+				}
+				return
+			}
+			go link.serve(conn, nil)
+		}
+	}()
+}
+
+// close closes the listener and any established link.
+func (link *servicesLink) close() {
+	link.mu.Lock()
+	listener, conn := link.listener, link.conn
+	link.mu.Unlock()
+
+	if listener != nil {
+		_ = listener.Close()
+	}
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// serve performs the handshake with the services server on the connection, then
+// processes its messages until the link is closed. The result of the handshake is sent
+// to established, if not nil.
+func (link *servicesLink) serve(conn net.Conn, established chan<- error) {
+	logger := link.logger.WithField("address", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, MaxMsgLength), ts6MaxLineLength)
+
+	if err := link.handshake(conn, scanner); err != nil {
+		logger.Warn(fmt.Errorf("services link handshake failed: %w", err))
+		_, _ = fmt.Fprintf(conn, "ERROR :Closing Link: %s\r\n", err)
+		if established != nil {
+			established <- err
+		}
+		return
+	}
+	if established != nil {
+		established <- nil
+	}
+
+	logger.Infof("services link established with [%s] (%s)", link.name, link.sid)
+	defer link.teardown()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(3 * ts6PingInterval))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Warn(fmt.Errorf("services link read error: %w", err))
+			}
+			return
+		}
+
+		line := scanner.Text()
+		logger.Debugf("received: [%s]", line)
+		source, command, params := parseTS6(line)
+		if err := link.handle(source, command, params); err != nil {
+			logger.Warn(fmt.Errorf("services link closed: %w", err))
+			_, _ = fmt.Fprintf(conn, "ERROR :Closing Link: %s\r\n", err)
+			return
+		}
+	}
+}
+
+// handshake reads the PASS, CAPAB, and SERVER messages of the services server, replies
+// with those of this server, then bursts the network state and starts the link. Those of
+// this server are sent first on outbound links, as the initiator of the link.
+func (link *servicesLink) handshake(conn net.Conn, scanner *bufio.Scanner) error {
+	_ = conn.SetReadDeadline(time.Now().Add(ts6HandshakeTimeout))
+
+	if link.outbound {
+		_ = conn.SetWriteDeadline(time.Now().Add(ts6WriteTimeout))
+		for _, line := range link.credentials() {
+			if _, err := fmt.Fprint(conn, line, CRLF); err != nil {
+				return err
+			}
+		}
+	}
+
+	var sid, description string
+	capab := make(map[string]bool)
+	for len(description) == 0 {
+		if !scanner.Scan() {
+			return errors.New("connection closed during handshake")
+		}
+
+		_, command, params := parseTS6(scanner.Text())
+		switch command {
+		case "PASS":
+			// PASS <password> TS 6 :<sid>
+			if len(params) < 4 || params[1] != "TS" || params[2] != "6" {
+				return errors.New("TS6 protocol required")
+			}
+			if subtle.ConstantTimeCompare([]byte(params[0]), []byte(link.password)) != 1 {
+				return errors.New("invalid password")
+			}
+			sid = params[3]
+		case "CAPAB":
+			for _, capability := range strings.Fields(strings.Join(params, SPACE)) {
+				capab[capability] = true
+			}
+		case "SERVER":
+			// SERVER <name> <hops> :<description>
+			if len(params) < 3 || !strings.EqualFold(params[0], link.name) {
+				return errors.New("unexpected server name")
+			}
+			description = params[2]
+		case "ERROR":
+			return fmt.Errorf("remote error: %s", strings.Join(params, SPACE))
+		}
+	}
+
+	if !serverIDPattern.MatchString(sid) || sid == link.server.sid {
+		return fmt.Errorf("invalid server ID [%s]", sid)
+	}
+	if link.server.knownSID(sid, link) {
+		return fmt.Errorf("SID collision: %s", sid)
+	}
+	if !capab["ENCAP"] {
+		return errors.New("ENCAP capability required")
+	}
+
+	srv := link.server
+	link.mu.Lock()
+	if link.conn != nil {
+		link.mu.Unlock()
+		return errors.New("already linked")
+	}
+	link.conn = conn
+	link.sid = sid
+	link.description = description
+	link.capab = capab
+	link.servers = map[string]*linkedServer{
+		sid: {name: link.name, sid: sid, description: description, hops: 1, uplink: srv.Hostname()},
+	}
+	link.queue = make(chan string, ts6SendQueueSize)
+	link.done = make(chan struct{})
+	link.mu.Unlock()
+
+	if !link.outbound {
+		for _, line := range link.credentials() {
+			link.send(line)
+		}
+	}
+	link.send(fmt.Sprintf("SVINFO 6 6 0 :%d", time.Now().Unix()))
+	link.burst()
+	link.burstBans()
+	link.send(fmt.Sprintf(":%s PING %s :%s", srv.sid, srv.Hostname(), link.name))
+
+	go link.writeLoop(conn, link.queue, link.done)
+
+	link.mu.Lock()
+	link.unsubscribe = srv.Subscribe(link.relay,
+		EventUserRegistered, EventNickChange, EventChannelJoin,
+		EventMessage, EventUserQuit, EventUserKilled)
+	link.mu.Unlock()
+
+	return nil
+}
+
+// credentials returns the PASS, CAPAB, and SERVER messages introducing this server.
+func (link *servicesLink) credentials() []string {
+	srv := link.server
+	return []string{
+		fmt.Sprintf("PASS %s TS 6 :%s", link.password, srv.sid),
+		"CAPAB :" + ts6Capabilities,
+		fmt.Sprintf("SERVER %s 1 :%s", srv.Hostname(), ts6ServerDescription),
+	}
+}
+
+// burst sends the local users and channels to the services server.
+func (link *servicesLink) burst() {
+	srv := link.server
+
+	srv.Nicks.ForEach(func(_ string, user *User) error {
+		if user.conn != nil && user.conn.isRegistered() {
+			link.send(link.introduction(user))
+		}
+		return nil
+	})
+
+	srv.Channels.ForEach(func(_ string, channel *Channel) error {
+		members := make([]string, 0, channel.Nicks.Length())
+		channel.Nicks.ForEach(func(nick string, user *User) error {
+			if user.conn != nil {
+				members = append(members, link.memberPrefix(channel, user)+user.UID())
+			}
+			return nil
+		})
+
+		prefix := fmt.Sprintf(":%s SJOIN %d %s + :", srv.sid, channel.CreatedAt().Unix(), channel.Name())
+		for _, chunk := range stringutils.ChunkJoinStrings(MaxMsgLength-len(prefix)-2, SPACE, members...) {
+			link.send(prefix + chunk)
+		}
+		return nil
+	})
+}
+
+// introduction returns the UID, or EUID if supported, message introducing the local user.
+func (link *servicesLink) introduction(user *User) string {
+	srv := link.server
+
+	modes := "+"
+	for letter, umode := range ts6UserModes {
+		if user.ModeIsSet(umode) {
+			modes += string(letter)
+		}
+	}
+
+	ip := user.Hostname()
+	if net.ParseIP(ip) == nil {
+		ip = "0"
+	}
+
+	if !link.capab["EUID"] {
+		return fmt.Sprintf(":%s UID %s 1 %d %s %s %s %s %s :%s", srv.sid,
+			user.Nick(), user.NickTS(), modes, user.Name(), user.VisibleHost(), ip, user.UID(), user.Realname())
+	}
+
+	realHost := user.Hostname()
+	if realHost == user.VisibleHost() {
+		realHost = "*"
+	}
+	account := user.Account()
+	if len(account) == 0 {
+		account = "*"
+	}
+
+	return fmt.Sprintf(":%s EUID %s 1 %d %s %s %s %s %s %s %s :%s", srv.sid,
+		user.Nick(), user.NickTS(), modes, user.Name(), user.VisibleHost(), ip, user.UID(),
+		realHost, account, user.Realname())
+}
+
+// memberPrefix returns the TS6 status prefix of the channel member.
+func (link *servicesLink) memberPrefix(channel *Channel, user *User) string {
+	nick := user.Nick()
+	switch {
+	case channel.Owners.Exists(nick), channel.Admins.Exists(nick), channel.Ops.Exists(nick):
+		return "@"
+	case channel.Voiced.Exists(nick):
+		return "+"
+	}
+	return ""
+}
+
+// send queues the line to be written to the services server.
+func (link *servicesLink) send(line string) {
+	link.mu.Lock()
+	queue, conn := link.queue, link.conn
+	link.mu.Unlock()
+
+	if queue == nil {
+		return
+	}
+
+	select {
+	case queue <- line:
+	default:
+		// Dropping lines would desynchronize the network state, so drop the link instead.
+		link.logger.Error("services link send queue full, closing link")
+		_ = conn.Close()
+	}
+}
+
+// writeLoop writes queued lines to the connection, and pings the services server
+// periodically, until the link is torn down.
+func (link *servicesLink) writeLoop(conn net.Conn, queue <-chan string, done <-chan struct{}) {
+	ping := time.NewTicker(ts6PingInterval)
+	defer ping.Stop()
+
+	writer := bufio.NewWriter(conn)
+	for {
+		var line string
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			line = fmt.Sprintf(":%s PING %s :%s", link.server.sid, link.server.Hostname(), link.name)
+		case line = <-queue:
+			if len(line) == 0 { // Queued by squit to close the link once the lines before it are written.
+				_ = writer.Flush()
+				_ = conn.Close()
+				return
+			}
+		}
+
+		link.logger.Debugf("sent: [%s]", line)
+		_ = conn.SetWriteDeadline(time.Now().Add(ts6WriteTimeout))
+		_, _ = writer.WriteString(line)
+		_, _ = writer.WriteString(CRLF)
+
+		// Batch queued lines, such as a burst, into as few writes as possible.
+		if len(queue) == 0 {
+			if err := writer.Flush(); err != nil {
+				link.logger.Warn(fmt.Errorf("services link write error: %w", err))
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// teardown removes the remote users introduced by the link, as in a netsplit, and
+// resets the link to accept a new connection.
+func (link *servicesLink) teardown() {
+	link.mu.Lock()
+	if link.unsubscribe != nil {
+		link.unsubscribe()
+	}
+	close(link.done)
+	link.conn, link.queue, link.unsubscribe, link.servers = nil, nil, nil, nil
+	link.mu.Unlock()
+
+	reason := link.server.Hostname() + SPACE + link.name
+	link.server.uids.ForEach(func(_ string, user *User) error {
+		if user.link == link {
+			link.server.quitRemote(user, reason)
+		}
+		return nil
+	})
+
+	link.logger.Infof("services link with [%s] closed", link.name)
+}
+
+// relay sends local activity published on the event bus to the services server.
+func (link *servicesLink) relay(event Event) {
+	user, exists := link.server.Nicks.Get(event.Nick)
+	if !exists || user.link != nil {
+		return
+	}
+	uid := user.UID()
+
+	switch event.Type {
+	case EventUserRegistered:
+		link.send(link.introduction(user))
+
+	case EventNickChange:
+		link.send(fmt.Sprintf(":%s NICK %s :%d", uid, event.Nick, user.NickTS()))
+
+	case EventChannelJoin:
+		channel, exists := link.server.Channels.Get(event.Channel)
+		if exists {
+			link.send(fmt.Sprintf(":%s SJOIN %d %s + :%s%s", link.server.sid,
+				channel.CreatedAt().Unix(), channel.Name(), link.memberPrefix(channel, user), uid))
+		}
+
+	case EventMessage:
+		if len(event.Channel) > 0 {
+			if link.inChannel(event.Channel) {
+				link.send(fmt.Sprintf(":%s %s %s :%s", uid, event.Action, event.Channel, event.Text))
+			}
+			return
+		}
+		if target, exists := link.server.Nicks.Get(event.Target); exists && target.link == link {
+			link.send(fmt.Sprintf(":%s %s %s :%s", uid, event.Action, target.UID(), event.Text))
+		}
+
+	case EventUserQuit:
+		link.send(fmt.Sprintf(":%s QUIT :%s", uid, event.Reason))
+
+	case EventUserKilled:
+		if event.Actor != link.name { // Services already know of their own kills.
+			link.send(fmt.Sprintf(":%s QUIT :Killed (%s (%s))", uid, event.Actor, event.Reason))
+		}
+	}
+}
+
+// inChannel reports whether any user introduced by the link is a member of the channel.
+func (link *servicesLink) inChannel(name string) bool {
+	channel, exists := link.server.Channels.Get(name)
+	if !exists {
+		return false
+	}
+
+	found := errors.New("found")
+	return channel.Nicks.ForEach(func(_ string, user *User) error {
+		if user.link == link {
+			return found
+		}
+		return nil
+	}) != nil
+}
+
+// parseTS6 splits a server protocol line into its source, command, and parameters,
+// the last of which is the trailing parameter, if any.
+func parseTS6(line string) (source, command string, params []string) {
+	if strings.HasPrefix(line, COLON) {
+		source, line, _ = strings.Cut(line[1:], SPACE)
+	}
+
+	middle, trailing, hasTrailing := strings.Cut(line, SPACE+COLON)
+	if strings.HasPrefix(middle, COLON) { // No middle parameters.
+		middle, trailing, hasTrailing = "", middle[1:], true
+	}
+
+	fields := strings.Fields(middle)
+	if len(fields) == 0 {
+		return source, "", nil
+	}
+
+	command = strings.ToUpper(fields[0])
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return source, command, params
+}
+
+// handle processes a message from the services server, returning an error if the link
+// must be closed.
+func (link *servicesLink) handle(source, command string, params []string) error {
+	switch command {
+	case "PING":
+		// PING <origin> [<destination>]
+		if len(params) > 0 {
+			link.send(fmt.Sprintf(":%s PONG %s :%s", link.server.sid, link.server.Hostname(), params[0]))
+		}
+	case "UID", "EUID":
+		link.introduce(command, params)
+	case "SJOIN":
+		link.sjoin(params)
+	case "JOIN":
+		// :<uid> JOIN <ts> <channel> +
+		if user := link.remoteUser(source); user != nil && len(params) > 1 {
+			link.joinRemote(user, params[1], "")
+		}
+	case "PART":
+		if user := link.remoteUser(source); user != nil && len(params) > 0 {
+			reason := ""
+			if len(params) > 1 {
+				reason = params[1]
+			}
+			for _, name := range strings.Split(params[0], ",") {
+				link.partRemote(user, name, reason)
+			}
+		}
+	case "QUIT":
+		if user := link.remoteUser(source); user != nil {
+			reason := ""
+			if len(params) > 0 {
+				reason = params[0]
+			}
+			link.server.quitRemote(user, reason)
+		}
+	case "KILL":
+		link.kill(source, params)
+	case "NICK":
+		// :<uid> NICK <nick> :<ts>
+		if user := link.remoteUser(source); user != nil && len(params) > 0 {
+			link.server.renameRemote(user, params[0])
+			if len(params) > 1 {
+				if ts, err := strconv.ParseInt(params[1], 10, 64); err == nil {
+					user.mu.Lock()
+					user.nickTS = ts
+					user.mu.Unlock()
+				}
+			}
+		}
+	case CmdPrivMsg, CmdNotice:
+		link.message(source, command, params)
+	case "TMODE":
+		// :<source> TMODE <ts> <channel> <modes> [args...]
+		if len(params) > 2 {
+			link.channelMode(source, params[1], params[2:])
+		}
+	case "MODE":
+		if len(params) > 1 {
+			if strings.HasPrefix(params[0], "#") {
+				link.channelMode(source, params[0], params[1:])
+			} else {
+				link.userMode(params[0], params[1])
+			}
+		}
+	case "SVSMODE":
+		if len(params) > 1 {
+			link.userMode(params[0], params[1])
+		}
+	case "SVSNICK":
+		if len(params) > 1 {
+			link.forceNick(params[0], params[1])
+		}
+	case "TOPIC":
+		// :<source> TOPIC <channel> :<topic>
+		if len(params) > 1 {
+			link.topic(source, params[0], params[1])
+		}
+	case "TB":
+		// :<sid> TB <channel> <ts> [<setter>] :<topic>
+		if len(params) > 2 {
+			link.topic(source, params[0], params[len(params)-1])
+		}
+	case "ENCAP":
+		// :<source> ENCAP <target> <subcommand> [params...]
+		if len(params) > 1 {
+			link.encap(strings.ToUpper(params[1]), params[2:])
+		}
+	case "SID":
+		// :<uplink sid> SID <name> <hops> <sid> :<description>
+		return link.addServer(source, params)
+	case "SQUIT":
+		// SQUIT <sid> :<reason>, of a server behind the peer, or of the link itself.
+		if len(params) > 0 && link.splitServer(params[0]) {
+			return nil
+		}
+		return errors.New("services server quit")
+	case "ERROR":
+		return fmt.Errorf("remote error: %s", strings.Join(params, SPACE))
+	default:
+		link.logger.Debugf("ignoring unsupported command: %s", command)
+	}
+	return nil
+}
+
+// encap processes an ENCAP subcommand from the services server.
+func (link *servicesLink) encap(subcommand string, params []string) {
+	switch subcommand {
+	case "SU":
+		// SU <uid> [:<account>], logging the user in or out.
+		if user := link.localUser(params, 1); user != nil {
+			account := ""
+			if len(params) > 1 {
+				account = params[1]
+			}
+			user.SetAccount(account)
+			if len(account) > 0 {
+				user.AddMode(UModeRegistered)
+				user.conn.ReplyLoggedIn(account)
+			} else {
+				user.DelMode(UModeRegistered)
+				user.conn.ReplyLoggedOut()
+			}
+		}
+	case "RSFNC", "SVSNICK":
+		// RSFNC <uid> <nick> <new ts> <old ts>
+		if len(params) > 1 {
+			link.forceNick(params[0], params[1])
+		}
+	case "SVSMODE":
+		if len(params) > 1 {
+			link.userMode(params[0], params[1])
+		}
+	case encapSyncBan:
+		link.server.receiveBan(link, params)
+	case encapSyncUnban:
+		link.server.receiveUnban(link, params)
+	case "CHGHOST":
+		// CHGHOST <uid> <host>
+		if user := link.localUser(params, 2); user != nil {
+			user.SetVanityHost(params[1])
+			user.SetVanityEnabled(true)
+		}
+	default:
+		link.logger.Debugf("ignoring unsupported ENCAP subcommand: %s", subcommand)
+	}
+}
+
+// introduce adds a remote user from a UID or EUID message.
+//
+//	UID <nick> <hops> <ts> <umodes> <user> <host> <ip> <uid> :<gecos>
+//	EUID <nick> <hops> <ts> <umodes> <user> <host> <ip> <uid> <real host> <account> :<gecos>
+func (link *servicesLink) introduce(command string, params []string) {
+	if (command == "UID" && len(params) < 9) || (command == "EUID" && len(params) < 11) {
+		link.logger.Warnf("ignoring malformed %s", command)
+		return
+	}
+
+	ts, _ := strconv.ParseInt(params[2], 10, 64)
+	user := &User{
+		nick:   params[0],
+		name:   params[4],
+		host:   params[5],
+		real:   params[len(params)-1],
+		uid:    params[7],
+		nickTS: ts,
+		perm:   UPermServer,
+		link:   link,
+	}
+
+	if command == "EUID" {
+		if realHost := params[8]; realHost != "*" {
+			user.host = realHost
+			user.vanityHost = params[5]
+			user.vanityEnabled.Store(true)
+		}
+		if account := params[9]; account != "*" {
+			user.account = account
+		}
+	}
+	applyTS6Modes(user, params[3])
+
+	srv := link.server
+	if existing, exists := srv.Nicks.Get(user.nick); exists {
+		if existing.conn != nil {
+			// Services' nicks are authoritative; move the local user to their UID.
+			_ = existing.conn.changeNick(existing.UID())
+		} else {
+			link.server.quitRemote(existing, "Nick collision")
+		}
+	}
+
+	srv.Nicks.Set(user.nick, user)
+	srv.uids.Set(user.uid, user)
+}
+
+// sjoin joins remote users to a channel from an SJOIN message.
+//
+//	SJOIN <ts> <channel> <modes> [args...] :<[prefixes]uid> ...
+func (link *servicesLink) sjoin(params []string) {
+	if len(params) < 4 {
+		return
+	}
+
+	for _, member := range strings.Fields(params[len(params)-1]) {
+		uid := strings.TrimLeft(member, "@%+~!")
+		if user := link.remoteUser(uid); user != nil {
+			link.joinRemote(user, params[1], member[:len(member)-len(uid)])
+		}
+	}
+}
+
+// joinRemote joins the remote user to the channel, granting operator or voice status
+// if the status prefixes include it.
+func (link *servicesLink) joinRemote(user *User, name, status string) {
+	channel, joined := link.server.joinRemote(user, name)
+	if !joined {
+		return
+	}
+
+	nick := user.Nick()
+	switch {
+	case strings.ContainsAny(status, "@~!"):
+		channel.Ops.Set(nick, user)
+		link.announceMode(channel, "+o", nick)
+	case strings.Contains(status, "+"):
+		channel.Voiced.Set(nick, user)
+		link.announceMode(channel, "+v", nick)
+	}
+}
+
+// partRemote removes the remote user from the channel.
+func (link *servicesLink) partRemote(user *User, name, reason string) {
+	channel, exists := link.server.Channels.Get(name)
+	if !exists {
+		return
+	}
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = user.Hostmask()
+	msg.Command = CmdPart
+	msg.Params = []string{channel.Name()}
+	msg.Trailing = reason
+	_ = channel.RemoveUser(user.Nick(), msg)
+}
+
+// killRemote removes the remote user on behalf of a local kill, notifying the services server.
+func (link *servicesLink) killRemote(user *User, reason, source string) {
+	link.send(fmt.Sprintf(":%s KILL %s :%s (%s)", link.server.sid, user.UID(), source, reason))
+	link.server.quitRemote(user, fmt.Sprintf("Killed (%s (%s))", source, reason))
+}
+
+// kill processes a KILL message, disconnecting a local user or removing a remote one.
+//
+//	KILL <uid> :<path> (<reason>)
+func (link *servicesLink) kill(source string, params []string) {
+	if len(params) == 0 {
+		return
+	}
+
+	user := link.resolve(params[0])
+	if user == nil {
+		return
+	}
+
+	reason := "Killed by services"
+	if len(params) > 1 {
+		reason = params[1]
+		if start := strings.Index(reason, "("); start >= 0 && strings.HasSuffix(reason, ")") {
+			reason = reason[start+1 : len(reason)-1]
+		}
+	}
+
+	if user.conn != nil {
+		user.kill(reason, link.sourceName(source))
+	} else {
+		link.server.quitRemote(user, "Killed ("+reason+")")
+	}
+}
+
+// message delivers a PRIVMSG or NOTICE from the services server to local users.
+func (link *servicesLink) message(source, command string, params []string) {
+	if len(params) < 2 {
+		return
+	}
+	target, text := params[0], params[1]
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = link.sourceMask(source)
+	msg.Command = command
+	msg.Trailing = text
+
+	switch {
+	case strings.HasPrefix(target, "#"):
+		if channel, exists := link.server.Channels.Get(target); exists {
+			msg.Params = []string{channel.Name()}
+			sender := ""
+			if user := link.remoteUser(source); user != nil {
+				sender = user.Nick()
+			}
+			channel.Send(msg, sender)
+		}
+
+	case strings.HasPrefix(target, "$"):
+		// Global message to every user on matching servers, eg: $$* or $$irc.example.net
+		link.server.Users.ForEach(func(_ string, user *User) error {
+			msg.Params = []string{user.Nick()}
+			user.Write(msg.RenderBuffer())
+			return nil
+		})
+
+	default:
+		if user := link.resolve(target); user != nil && user.conn != nil {
+			msg.Params = []string{user.Nick()}
+			user.Write(msg.RenderBuffer())
+		}
+	}
+}
+
+// channelMode applies channel status modes from the services server and announces
+// the mode change to the local channel members.
+func (link *servicesLink) channelMode(source, name string, modeParams []string) {
+	channel, exists := link.server.Channels.Get(name)
+	if !exists || len(modeParams) == 0 {
+		return
+	}
+
+	modes, args := modeParams[0], modeParams[1:]
+	announced := []string{modes}
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		switch mode := modes[i]; mode {
+		case '+', '-':
+			adding = mode == '+'
+		case 'o', 'h', 'v':
+			if len(args) == 0 {
+				break
+			}
+			user := link.resolve(args[0])
+			args = args[1:]
+			if user == nil {
+				announced = append(announced, "*")
+				continue
+			}
+
+			nick := user.Nick()
+			announced = append(announced, nick)
+			statuses := channel.statusList(mode)
+			if adding {
+				statuses.Set(nick, user)
+			} else {
+				statuses.Delete(nick)
+			}
+		case 'b', 'e', 'I', 'k':
+			if len(args) > 0 {
+				announced = append(announced, args[0])
+				args = args[1:]
+			}
+		case 'l':
+			if adding && len(args) > 0 {
+				announced = append(announced, args[0])
+				args = args[1:]
+			}
+		}
+	}
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = link.sourceMask(source)
+	msg.Command = CmdMode
+	msg.Params = append([]string{channel.Name()}, announced...)
+	channel.Send(msg, "")
+}
+
+// announceMode announces a channel mode change made by the services server to the local channel members.
+func (link *servicesLink) announceMode(channel *Channel, modes string, args ...string) {
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = link.name
+	msg.Command = CmdMode
+	msg.Params = append([]string{channel.Name(), modes}, args...)
+	channel.Send(msg, "")
+}
+
+// userMode applies user modes set by the services server to the target user, and
+// notifies them if they are a local user.
+func (link *servicesLink) userMode(target, modes string) {
+	user := link.resolve(target)
+	if user == nil {
+		return
+	}
+
+	applyTS6Modes(user, modes)
+
+	if user.conn != nil {
+		msg := msgPool.New()
+		defer msgPool.Recycle(msg, msg.Generation())
+		msg.Source = link.name
+		msg.Command = CmdMode
+		msg.Params = []string{user.Nick()}
+		msg.Trailing = modes
+		user.Write(msg.RenderBuffer())
+	}
+}
+
+// forceNick changes the nick of the local user at the request of the services server.
+func (link *servicesLink) forceNick(target, newNick string) {
+	user := link.resolve(target)
+	if user == nil || user.conn == nil || user.Nick() == newNick {
+		return
+	}
+
+	if err, _ := link.server.ValidateName(newNick); err != nil {
+		link.logger.Warnf("ignoring forced nick change of [%s] to [%s]: %s", user.Nick(), newNick, err)
+		return
+	}
+
+	_ = user.conn.changeNick(newNick)
+}
+
+// topic sets the channel topic from the services server and announces it to the local channel members.
+func (link *servicesLink) topic(source, name, topic string) {
+	channel, exists := link.server.Channels.Get(name)
+	if !exists {
+		return
+	}
+
+	channel.SetTopicBy(topic, link.sourceMask(source))
+
+	msg := msgPool.New()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = link.sourceMask(source)
+	msg.Command = CmdTopic
+	msg.Params = []string{channel.Name()}
+	msg.Trailing = topic
+	channel.Send(msg, "")
+}
+
+// resolve returns the user with the given UID or nick, if any.
+func (link *servicesLink) resolve(target string) *User {
+	if user, exists := link.server.uids.Get(target); exists {
+		return user
+	}
+	if user, exists := link.server.Nicks.Get(target); exists {
+		return user
+	}
+	return nil
+}
+
+// remoteUser returns the remote user introduced by the link with the given UID, if any.
+func (link *servicesLink) remoteUser(uid string) *User {
+	if user, exists := link.server.uids.Get(uid); exists && user.link == link {
+		return user
+	}
+	return nil
+}
+
+// localUser returns the local user identified by the first parameter, if there are at
+// least count parameters and they are connected.
+func (link *servicesLink) localUser(params []string, count int) *User {
+	if len(params) < count {
+		return nil
+	}
+	if user := link.resolve(params[0]); user != nil && user.conn != nil {
+		return user
+	}
+	return nil
+}
+
+// sourceMask returns the message source to present to local users for the TS6 source.
+func (link *servicesLink) sourceMask(source string) string {
+	if user := link.remoteUser(source); user != nil {
+		return user.Hostmask()
+	}
+	return link.name
+}
+
+// sourceName returns the nick or server name of the TS6 source.
+func (link *servicesLink) sourceName(source string) string {
+	if user := link.remoteUser(source); user != nil {
+		return user.Nick()
+	}
+	return link.name
+}
+
+// applyTS6Modes applies the TS6 user mode string to the user.
+func applyTS6Modes(user *User, modes string) {
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			umode, known := ts6UserModes[modes[i]]
+			switch {
+			case !known:
+			case adding:
+				user.AddMode(umode)
+			default:
+				user.DelMode(umode)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTS6(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		source  string
+		command string
+		params  []string
+	}{
+		{
+			name:    "handshake",
+			line:    "PASS secret TS 6 :42X",
+			command: "PASS",
+			params:  []string{"secret", "TS", "6", "42X"},
+		},
+		{
+			name:    "trailing only",
+			line:    "CAPAB :QS EX ENCAP",
+			command: "CAPAB",
+			params:  []string{"QS EX ENCAP"},
+		},
+		{
+			name:    "source and trailing",
+			line:    ":42XAAAAAB PRIVMSG 0DCAAAAAA :hello there",
+			source:  "42XAAAAAB",
+			command: "PRIVMSG",
+			params:  []string{"0DCAAAAAA", "hello there"},
+		},
+		{
+			name:    "no trailing",
+			line:    ":42X ENCAP * SU 0DCAAAAAA account",
+			source:  "42X",
+			command: "ENCAP",
+			params:  []string{"*", "SU", "0DCAAAAAA", "account"},
+		},
+		{
+			name:    "lower case command",
+			line:    "ping 42X",
+			command: "PING",
+			params:  []string{"42X"},
+		},
+		{
+			name: "empty",
+			line: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, command, params := parseTS6(test.line)
+			assert.Equal(t, test.source, source)
+			assert.Equal(t, test.command, command)
+			assert.Equal(t, test.params, params)
+		})
+	}
+}
+
+func TestNewUID(t *testing.T) {
+	srv := &Server{sid: defaultServerID}
+
+	assert.Equal(t, "0DCAAAAAA", srv.newUID())
+	assert.Equal(t, "0DCAAAAAB", srv.newUID())
+
+	srv.uidSeq.Store(36)
+	assert.Equal(t, "0DCAAAABA", srv.newUID())
+}
@@ -11,6 +11,7 @@ import (
 	"bytes"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/btnmasher/dircd/shared/safemap"
 )
@@ -25,13 +26,36 @@ type User struct {
 	real          string
 	vanityHost    string
 	vanityEnabled atomic.Bool
+	account       string
 	perm          uint8
+	privileges    OperPrivilege
 	mode          uint64
+	uid           string // TS6 unique ID, assigned on registration.
+	nickTS        int64  // Unix time the nick was taken, for TS6 nick collision resolution.
 
 	conn *Conn
+
+	// sessions are the connections attached to the user besides their primary one, see
+	// WithMultiSession.
+	sessions []*Conn
+
+	// persist is set while the user is kept connected without any sessions, see WithAlwaysOn.
+	persist *persistence
+	history []historyLine
+
+	// link is the services link the user was introduced by, if they are not a local user.
+	link *servicesLink
+
+	// node is the ID of the cluster node the user is connected to, if they are not a local user.
+	node string
+
+	// channels is the set of channels the user is joined to, kept in step with channel
+	// membership by Channel.Join and Channel.RemoveUser.
+	channels map[*Channel]struct{}
 }
 
-type UserMap safemap.SafeMap[string, *User]
+// UserMap is a concurrency safe map of users.
+type UserMap = safemap.SafeMap[string, *User]
 
 // // NewUser returns a new instance of a user object with the given parameters
 // func NewUser(nickname, username, realname, hostname string) *User {
@@ -94,11 +118,27 @@ func (user *User) Nick() string {
 	return user.nick
 }
 
-// SetNick sets the nick field of the user in a concurrency-safe manner
+// UID returns the TS6 unique ID of the user in a concurrency-safe manner
+func (user *User) UID() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.uid
+}
+
+// NickTS returns the unix time the user took their nick in a concurrency-safe manner
+func (user *User) NickTS() int64 {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.nickTS
+}
+
+// SetNick sets the nick field of the user in a concurrency-safe manner,
+// recording the time the nick was taken.
 func (user *User) SetNick(new string) {
 	user.mu.Lock()
 	defer user.mu.Unlock()
 	user.nick = new
+	user.nickTS = time.Now().Unix()
 }
 
 // Name returns the username field of the user in a concurrency-safe manner
@@ -129,6 +169,13 @@ func (user *User) SetRealname(new string) {
 	user.real = new
 }
 
+// Hostname returns the hostname field of the user in a concurrency-safe manner
+func (user *User) Hostname() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.host
+}
+
 // SetHostname sets the hostname field of the user in a concurrency-safe manner
 func (user *User) SetHostname(new string) {
 	user.mu.Lock()
@@ -136,6 +183,17 @@ func (user *User) SetHostname(new string) {
 	user.host = new
 }
 
+// VisibleHost returns the hostname shown to other users, which is the vanity
+// hostname if VanityEnabled is set to true and the VanityHost is set.
+func (user *User) VisibleHost() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	if user.VanityEnabled() && len(user.vanityHost) > 0 {
+		return user.vanityHost
+	}
+	return user.host
+}
+
 // VanityHost returns the vanityhost field of the user in a concurrency-safe manner
 func (user *User) VanityHost() string {
 	user.mu.RLock()
@@ -150,6 +208,21 @@ func (user *User) SetVanityHost(new string) {
 	user.vanityHost = new
 }
 
+// Account returns the name of the account the user is logged in to in a
+// concurrency-safe manner, or an empty string if not logged in.
+func (user *User) Account() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.account
+}
+
+// SetAccount sets the account field of the user in a concurrency-safe manner.
+func (user *User) SetAccount(new string) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.account = new
+}
+
 // Permission returns the permission field of the user in a concurrency-safe manner.
 func (user *User) Permission() uint8 {
 	user.mu.RLock()
@@ -164,6 +237,27 @@ func (user *User) SetPermission(new uint8) {
 	user.perm = new
 }
 
+// Privileges returns the operator privileges of the user in a concurrency-safe manner.
+func (user *User) Privileges() OperPrivilege {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.privileges
+}
+
+// SetPrivileges sets the operator privileges of the user in a concurrency-safe manner.
+func (user *User) SetPrivileges(new OperPrivilege) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.privileges = new
+}
+
+// HasPrivilege checks if the user is an operator holding all of the given privileges.
+func (user *User) HasPrivilege(priv OperPrivilege) bool {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.perm > UPermUser && user.privileges.Has(priv)
+}
+
 // Mode returns the mode field of the user in a concurrency-safe manner.
 func (user *User) Mode() uint64 {
 	user.mu.RLock()
@@ -202,6 +296,11 @@ func (user *User) SetVanityEnabled(new bool) {
 	user.vanityEnabled.Store(new)
 }
 
+// IsOper checks if the user holds any operator permission level.
+func (user *User) IsOper() bool {
+	return user.HigherPerms(UPermUser)
+}
+
 // HigherPerms checks if the given target User has a higher permission level than
 // the Given user being checked.
 func (user *User) HigherPerms(target uint8) bool {
@@ -209,3 +308,70 @@ func (user *User) HigherPerms(target uint8) bool {
 	defer user.mu.RUnlock()
 	return user.perm > target
 }
+
+// Channels returns the channels the user is joined to in a concurrency-safe manner
+func (user *User) Channels() []*Channel {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	channels := make([]*Channel, 0, len(user.channels))
+	for channel := range user.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// InChannel checks if the user is joined to the channel in a concurrency-safe manner
+func (user *User) InChannel(channel *Channel) bool {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	_, joined := user.channels[channel]
+	return joined
+}
+
+// addChannel adds the channel to the set of channels the user is joined to.
+func (user *User) addChannel(channel *Channel) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.channels == nil {
+		user.channels = make(map[*Channel]struct{})
+	}
+	user.channels[channel] = struct{}{}
+}
+
+// removeChannel removes the channel from the set of channels the user is joined to.
+func (user *User) removeChannel(channel *Channel) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	delete(user.channels, channel)
+}
+
+// sendToAudience sends the message once to each local user in the audience of the user.
+func (srv *Server) sendToAudience(user *User, msg *Message) {
+	buffer := msg.RenderBuffer()
+	defer bufPool.Recycle(buffer)
+
+	audience := user.Audience()
+	recipients := audience[:0]
+	for _, member := range audience {
+		if member.conn != nil {
+			recipients = append(recipients, member)
+		}
+	}
+	srv.fanOut.deliver(recipients, buffer.Bytes())
+}
+
+// Audience returns the users sharing at least one channel with the user, each only once
+// however many channels they share, excluding the user themself.
+func (user *User) Audience() []*User {
+	seen := map[*User]struct{}{user: {}}
+	var audience []*User
+	for _, channel := range user.Channels() {
+		for _, member := range channel.snapshot() {
+			if _, exists := seen[member.user]; !exists {
+				seen[member.user] = struct{}{}
+				audience = append(audience, member.user)
+			}
+		}
+	}
+	return audience
+}
@@ -0,0 +1,42 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserChannels(t *testing.T) {
+	alice, bob, carol := &User{nick: "alice"}, &User{nick: "bob"}, &User{nick: "carol"}
+
+	first := NewChannel("#first", alice, CasemapASCII)
+	second := NewChannel("#second", alice, CasemapASCII)
+	for _, join := range []struct {
+		channel *Channel
+		user    *User
+	}{{first, alice}, {first, bob}, {second, alice}, {second, bob}, {second, carol}} {
+		msg := msgPool.New()
+		generation := msg.Generation()
+		join.channel.Join(join.user, "", msg)
+		msgPool.Recycle(msg, generation)
+	}
+
+	assert.ElementsMatch(t, []*Channel{first, second}, alice.Channels())
+	assert.ElementsMatch(t, []*User{bob, carol}, alice.Audience())
+	assert.ElementsMatch(t, []*User{alice, bob}, carol.Audience())
+
+	msg := msgPool.New()
+	generation := msg.Generation()
+	assert.NoError(t, second.RemoveUser("Carol", msg))
+	msgPool.Recycle(msg, generation)
+	assert.False(t, carol.InChannel(second))
+	assert.Empty(t, carol.Audience())
+	assert.ElementsMatch(t, []*User{bob}, alice.Audience())
+}
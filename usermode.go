@@ -7,7 +7,10 @@
 
 package dircd
 
-import "strings"
+import (
+	"slices"
+	"strings"
+)
 
 // Usermode Bitmasks
 const (
@@ -37,8 +40,36 @@ const (
 	UModeGlobalVoice
 	UModeWhoisInfo
 	UModeWatch
+	UModeSecureOnly
 )
 
+// userModeLetters maps the letters of the user modes shown and changed with MODE to
+// their flags, as documented in doc/User_Modes.md, besides those registered by modules.
+// Modes taking a parameter, and away, set with AWAY, are not changed with MODE.
+var userModeLetters = map[byte]uint64{
+	'A': UModeAdmin,
+	'b': UModeBot,
+	'B': UModeBanned,
+	'c': UModeCensored,
+	'C': UModeConnInfo,
+	'f': UModeFloodInfo,
+	'F': UModeFloodImmune,
+	'G': UModeGodmode,
+	'H': UModeHidden,
+	'i': UModeInvisible,
+	'I': UModeImmune,
+	'k': UModeKeyMaster,
+	'm': UModeMuted,
+	'o': UModeHelpOp,
+	'O': UModeNetOp,
+	'p': UModeProtected,
+	'r': UModeRegistered,
+	's': UModeSecured,
+	'v': UModeGlobalVoice,
+	'w': UModeWhoisInfo,
+	'z': UModeSecureOnly,
+}
+
 // UModeReq is used to define the required setter/target permission levels.
 type UModeReq struct {
 	Setter uint8
@@ -72,6 +103,7 @@ var uModeReqs = map[uint64]UModeReq{
 	UModeThrottled:   {UPermHelpOp, UPermUser},
 	UModeWhoisInfo:   {UPermUser, UPermUser},
 	UModeWatch:       {UPermNetOp, UPermHelpOp},
+	UModeSecureOnly:  {UPermUser, UPermUser},
 }
 
 // SetUserMode is  used to set a mode on a target user.
@@ -166,3 +198,84 @@ func UnsetUserMode(umode uint64, setter, target *User) error {
 
 	return nil
 }
+
+// userModeFlag returns the flag of the user mode with the letter, including those
+// registered by modules.
+func (srv *Server) userModeFlag(letter byte) (uint64, bool) {
+	if flag, exists := userModeLetters[letter]; exists {
+		return flag, true
+	}
+	flag, exists := srv.modules.userModes[letter]
+	return flag, exists
+}
+
+// userModeString returns the letters of the modes set on the user, eg: "+sz", including
+// those registered by modules.
+func (srv *Server) userModeString(user *User) string {
+	mode := user.Mode()
+	letters := make([]byte, 0, len(userModeLetters))
+	for _, modes := range []map[byte]uint64{userModeLetters, srv.modules.userModes} {
+		for letter, flag := range modes {
+			if mode&flag == flag {
+				letters = append(letters, letter)
+			}
+		}
+	}
+	slices.Sort(letters)
+	return "+" + string(letters)
+}
+
+// doUserMode applies the changes the user makes to their own modes, announcing those
+// made to them in a single MODE. Changes to modes the user may not set themself, or
+// which are already made, are ignored, and unknown letters replied to once with
+// ERR_UMODEUNKNOWNFLAG.
+func (conn *Conn) doUserMode(modes string) {
+	user := conn.user
+
+	var changes strings.Builder
+	sign, lastSign := byte('+'), byte(0)
+	unknown := false
+	for i := 0; i < len(modes); i++ {
+		letter := modes[i]
+		if letter == '+' || letter == '-' {
+			sign = letter
+			continue
+		}
+
+		flag, known := conn.server.userModeFlag(letter)
+		if !known {
+			unknown = true
+			continue
+		}
+		reqs := uModeReqs[flag]
+		if perm := user.Permission(); perm < reqs.Setter || perm < reqs.Target || user.ModeIsSet(flag) == (sign == '+') {
+			continue
+		}
+
+		if sign == '+' {
+			user.AddMode(flag)
+		} else {
+			user.DelMode(flag)
+		}
+		if sign != lastSign {
+			changes.WriteByte(sign)
+			lastSign = sign
+		}
+		changes.WriteByte(letter)
+	}
+
+	if unknown {
+		conn.ReplyNumeric(ReplyUnknownUserMode)
+	}
+	if changes.Len() == 0 {
+		return
+	}
+
+	msg := conn.newMessage()
+	defer msgPool.Recycle(msg, msg.Generation())
+	msg.Source = user.Nick()
+	msg.Command = CmdMode
+	msg.Params = []string{user.Nick()}
+	msg.Trailing = changes.String()
+	user.Write(msg.RenderBuffer())
+}
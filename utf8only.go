@@ -0,0 +1,47 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import "unicode/utf8"
+
+// failInvalidUTF8 is the code of the FAIL standard reply to a message which is not
+// valid UTF-8.
+const failInvalidUTF8 = "INVALID_UTF8"
+
+// WithUTF8Only sets the server to reject messages whose text is not valid UTF-8, and to
+// advertise UTF8ONLY in ISUPPORT so clients know to only send UTF-8.
+func WithUTF8Only() ServerOption {
+	return option(func(s *Server) error {
+		s.utf8Only = true
+		return nil
+	})
+}
+
+// checkUTF8 reports whether a message from the user must be dropped as the server only
+// accepts UTF-8 and its parameters are not valid UTF-8, replying to the user with a FAIL
+// unless it is a NOTICE.
+func (conn *Conn) checkUTF8(msg *Message) bool {
+	if !conn.server.utf8Only || validUTF8(msg) {
+		return false
+	}
+
+	if msg.Command != CmdNotice {
+		conn.ReplyFail(msg.Command, failInvalidUTF8, "Message rejected, your IRC software MUST use UTF-8 encoding on this network")
+	}
+	return true
+}
+
+// validUTF8 reports whether the parameters of the message are valid UTF-8.
+func validUTF8(msg *Message) bool {
+	for _, param := range msg.Params {
+		if !utf8.ValidString(param) {
+			return false
+		}
+	}
+	return utf8.ValidString(msg.Trailing)
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhook delivery settings
+const (
+	webhookQueueSize      = 1024
+	webhookTimeout        = 10 * time.Second
+	webhookMaxAttempts    = 5
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = 30 * time.Second
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with
+// the webhook secret, allowing receivers to verify a payload came from the server.
+const webhookSignatureHeader = "X-Dircd-Signature"
+
+// webhook delivers events from the server event bus to a URL as JSON POST requests.
+type webhook struct {
+	url    string
+	secret []byte
+	types  []EventType
+	client *http.Client
+	queue  chan Event
+	logger Logger
+}
+
+// WithWebhook sets the server to POST the given event types, or every event but
+// EventMessage if none are given, as JSON to the URL. Failed deliveries are retried with exponential backoff.
+// If the secret is not empty, each request is signed with an X-Dircd-Signature header
+// of the form "sha256=<hex HMAC-SHA256 of the body>".
+func WithWebhook(webhookURL, secret string, types ...EventType) ServerOption {
+	return option(func(s *Server) error {
+		parsed, err := url.Parse(webhookURL)
+		if err != nil {
+			return fmt.Errorf("invalid webhook URL [%s]: %w", webhookURL, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid webhook URL [%s]: scheme must be http or https", webhookURL)
+		}
+
+		s.webhooks = append(s.webhooks, &webhook{
+			url:    webhookURL,
+			secret: []byte(secret),
+			types:  types,
+			client: &http.Client{Timeout: webhookTimeout},
+			queue:  make(chan Event, webhookQueueSize),
+		})
+		return nil
+	})
+}
+
+// startWebhooks subscribes the configured webhooks to the event bus and starts their
+// delivery goroutines, which stop when the server shuts down.
+func (srv *Server) startWebhooks() {
+	if len(srv.webhooks) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.registerOnShutdown(cancel)
+
+	for _, hook := range srv.webhooks {
+		hook.logger = srv.logger.WithFields(Fields{
+			"sub-component": "webhook",
+			"url":           hook.url,
+		})
+		srv.events.subscribe(hook.enqueue, hook.types...)
+		go hook.run(ctx)
+	}
+}
+
+// enqueue queues the event for delivery, dropping it if the queue is full.
+func (hook *webhook) enqueue(event Event) {
+	select {
+	case hook.queue <- event:
+	default:
+		hook.logger.Warnf("webhook queue full, dropping [%s] event", event.Type)
+	}
+}
+
+// run delivers queued events in order until the context is cancelled.
+func (hook *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-hook.queue:
+			hook.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver POSTs the event to the webhook URL, retrying with exponential backoff on
+// network errors, 429 Too Many Requests, and 5xx responses.
+func (hook *webhook) deliver(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		hook.logger.Error(fmt.Errorf("error encoding [%s] event: %w", event.Type, err))
+		return
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := hook.post(ctx, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= webhookMaxAttempts {
+			hook.logger.Error(fmt.Errorf("failed to deliver [%s] event after %d attempts: %w", event.Type, attempt, err))
+			return
+		}
+
+		hook.logger.Debugf("retrying [%s] event delivery in %v: %s", event.Type, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// post sends a single delivery attempt, reporting whether a failure should be retried.
+func (hook *webhook) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dircd/"+Version)
+
+	if len(hook.secret) > 0 {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded: %s", resp.Status)
+	}
+}
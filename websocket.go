@@ -0,0 +1,346 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// webSocketGUID is the magic value appended to the client key when computing Sec-WebSocket-Accept.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketMaxPayload limits the size of a single (reassembled) WebSocket message.
+const webSocketMaxPayload = 16 * 1024
+
+// IRCv3 WebSocket subprotocols.
+const (
+	webSocketTextProtocol   = "text.ircv3.net"
+	webSocketBinaryProtocol = "binary.ircv3.net"
+)
+
+// WebSocket frame opcodes.
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xa
+)
+
+// webSocketListener wraps a net.Listener, handing out connections which speak
+// IRC over WebSocket, with one IRC line per WebSocket message.
+type webSocketListener struct {
+	net.Listener
+}
+
+func (wl *webSocketListener) Accept() (net.Conn, error) {
+	conn, err := wl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// wsConn adapts a WebSocket connection to a line oriented net.Conn. Reads return each
+// received message terminated by a line feed, and writes are split on line endings with
+// each line sent as its own message.
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	upgraded      atomic.Bool
+	binary        bool
+
+	readBuf []byte
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+	closed   bool
+}
+
+// Handshake performs the handshake of the underlying connection if applicable, then
+// the WebSocket HTTP upgrade.
+func (wc *wsConn) Handshake() error {
+	wc.handshakeOnce.Do(func() {
+		if hs, ok := wc.Conn.(handshaker); ok {
+			if err := hs.Handshake(); err != nil {
+				wc.handshakeErr = err
+				return
+			}
+		}
+		wc.handshakeErr = wc.upgrade()
+	})
+	return wc.handshakeErr
+}
+
+func (wc *wsConn) upgrade() error {
+	req, err := http.ReadRequest(wc.reader)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWebSocketUpgrade, err)
+	}
+	_ = req.Body.Close()
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet ||
+		!headerContainsToken(req.Header, "Connection", "upgrade") ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		_, _ = io.WriteString(wc.Conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return ErrWebSocketUpgrade
+	}
+
+	protocol := ""
+	for _, offered := range strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		offered = strings.TrimSpace(offered)
+		if offered == webSocketTextProtocol || offered == webSocketBinaryProtocol {
+			protocol = offered
+			break
+		}
+	}
+	wc.binary = protocol == webSocketBinaryProtocol
+
+	digest := sha1.Sum([]byte(key + webSocketGUID))
+
+	var response bytes.Buffer
+	response.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	response.WriteString("Upgrade: websocket\r\n")
+	response.WriteString("Connection: Upgrade\r\n")
+	response.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(digest[:]) + CRLF)
+	if protocol != "" {
+		response.WriteString("Sec-WebSocket-Protocol: " + protocol + CRLF)
+	}
+	response.WriteString(CRLF)
+
+	if _, err = wc.Conn.Write(response.Bytes()); err != nil {
+		return err
+	}
+
+	wc.upgraded.Store(true)
+	return nil
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (wc *wsConn) Read(b []byte) (int, error) {
+	if err := wc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	for len(wc.readBuf) == 0 {
+		message, err := wc.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		message = bytes.TrimRight(message, CRLF)
+		wc.readBuf = append(message, '\n')
+	}
+
+	n := copy(b, wc.readBuf)
+	wc.readBuf = wc.readBuf[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a complete data message has been received,
+// answering any control frames encountered along the way. Continuation frames
+// are only accepted within a fragmented message, and new data frames only
+// outside of one.
+func (wc *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := wc.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err = wc.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = wc.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			if opcode == wsOpContinuation && !fragmented {
+				return nil, fmt.Errorf("%w: continuation frame outside a fragmented message", ErrWebSocketFrame)
+			}
+			if opcode != wsOpContinuation && fragmented {
+				return nil, fmt.Errorf("%w: data frame within a fragmented message", ErrWebSocketFrame)
+			}
+			message = append(message, payload...)
+			if len(message) > webSocketMaxPayload {
+				return nil, fmt.Errorf("%w: message too large", ErrWebSocketFrame)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %d", ErrWebSocketFrame, opcode)
+		}
+
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+func (wc *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(wc.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if !masked {
+		return false, 0, nil, fmt.Errorf("%w: client frames must be masked", ErrWebSocketFrame)
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err = io.ReadFull(wc.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err = io.ReadFull(wc.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if length > webSocketMaxPayload {
+		return false, 0, nil, fmt.Errorf("%w: frame too large", ErrWebSocketFrame)
+	}
+
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(wc.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(wc.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (wc *wsConn) Write(b []byte) (int, error) {
+	if err := wc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	wc.writeBuf = append(wc.writeBuf, b...)
+	for {
+		idx := bytes.IndexByte(wc.writeBuf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := bytes.TrimRight(wc.writeBuf[:idx], CR)
+		wc.writeBuf = wc.writeBuf[idx+1:]
+
+		opcode := wsOpText
+		if wc.binary {
+			opcode = wsOpBinary
+		}
+
+		if err := wc.writeFrameLocked(opcode, line); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (wc *wsConn) writeFrame(opcode byte, payload []byte) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+	return wc.writeFrameLocked(opcode, payload)
+}
+
+func (wc *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	if wc.closed {
+		return net.ErrClosed
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	frame = append(frame, payload...)
+	_, err := wc.Conn.Write(frame)
+
+	if opcode == wsOpClose {
+		wc.closed = true
+	}
+
+	return err
+}
+
+// Close sends a normal closure frame if the upgrade completed, then closes the underlying connection.
+func (wc *wsConn) Close() error {
+	if wc.upgraded.Load() {
+		_ = wc.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000: Normal Closure
+	}
+	return wc.Conn.Close()
+}
+
+// NetConn returns the underlying connection that is wrapped by wc.
+func (wc *wsConn) NetConn() net.Conn {
+	return wc.Conn
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2023, btnmasher
+   All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package dircd
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clientFrame returns a masked client frame with the given opcode and payload.
+func clientFrame(fin bool, opcode byte, payload string) []byte {
+	header := opcode
+	if fin {
+		header |= 0x80
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{header, 0x80 | byte(len(payload))}, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		message string
+		err     bool
+	}{
+		{
+			name:    "single frame",
+			frames:  [][]byte{clientFrame(true, wsOpText, "PING :a")},
+			message: "PING :a",
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				clientFrame(false, wsOpText, "PING"),
+				clientFrame(false, wsOpContinuation, " :"),
+				clientFrame(true, wsOpContinuation, "a"),
+			},
+			message: "PING :a",
+		},
+		{
+			name: "control frame within a fragmented message",
+			frames: [][]byte{
+				clientFrame(false, wsOpBinary, "PING"),
+				clientFrame(true, wsOpPong, ""),
+				clientFrame(true, wsOpContinuation, " :a"),
+			},
+			message: "PING :a",
+		},
+		{
+			name:   "continuation without a fragmented message",
+			frames: [][]byte{clientFrame(true, wsOpContinuation, "PING :a")},
+			err:    true,
+		},
+		{
+			name: "data frame within a fragmented message",
+			frames: [][]byte{
+				clientFrame(false, wsOpText, "PING"),
+				clientFrame(true, wsOpText, "PING :a"),
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wc := &wsConn{reader: bufio.NewReader(bytes.NewReader(bytes.Join(test.frames, nil)))}
+
+			message, err := wc.readMessage()
+			if test.err {
+				assert.ErrorIs(t, err, ErrWebSocketFrame)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.message, string(message))
+		})
+	}
+}